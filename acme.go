@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	defaultACMECA = acme.LetsEncryptURL
+
+	// certificates are renewed 30 days before they expire
+	acmeRenewBefore = 30 * 24 * time.Hour
+	// time for the dns-01 txt records to propagate before validation
+	acmeDNSPropagation = 30 * time.Second
+	// the first retry of a failed dns-01 request, doubled up to
+	// acmeCheckInterval
+	acmeRetryDelay    = 5 * time.Minute
+	acmeCheckInterval = 12 * time.Hour
+)
+
+// CheckACMEConf validates the --dashboard-acme-* flags.
+func CheckACMEConf() error {
+	if len(conf.DashboardACME) == 0 {
+		return nil
+	}
+	if conf.DashboardTLSCert != "" {
+		return fmt.Errorf("[acme] --dashboard-acme conflicts with --dashboard-tls-cert")
+	}
+	if conf.DashboardACMEDNS != "" {
+		if _, err := newDNSProvider(conf.DashboardACMEDNS); err != nil {
+			return err
+		}
+		return nil
+	}
+	// the ca only connects to 443 for the tls-alpn-01 challenge
+	if conf.DashboardACMEHTTP == "" {
+		if _, port, err := net.SplitHostPort(conf.DashboardListen); err != nil || port != "443" {
+			return fmt.Errorf("[acme] the tls-alpn-01 challenge requires --dashboard-listen on port 443, use --dashboard-acme-http or --dashboard-acme-dns otherwise")
+		}
+	}
+	return nil
+}
+
+// ACMETLSConfig returns the tls config of the dashboard listener that obtains
+// and renews the certificates of --dashboard-acme from the acme ca. The
+// http-01 and tls-alpn-01 challenges are answered by autocert, the dns-01
+// challenge is used if --dashboard-acme-dns is set, which works behind NAT.
+func ACMETLSConfig(ctx context.Context) (*tls.Config, error) {
+	cache := autocert.DirCache(filepath.Join(conf.ClashHome, acmeCacheDir))
+	client := &acme.Client{DirectoryURL: conf.DashboardACMECA}
+
+	if conf.DashboardACMEDNS == "" {
+		m := &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       cache,
+			HostPolicy:  autocert.HostWhitelist(conf.DashboardACME...),
+			Email:       conf.DashboardACMEEmail,
+			Client:      client,
+			RenewBefore: acmeRenewBefore,
+		}
+		if conf.DashboardACMEHTTP != "" {
+			srv := &http.Server{Addr: conf.DashboardACMEHTTP, Handler: m.HTTPHandler(nil), ReadHeaderTimeout: 10 * time.Second}
+			go func() {
+				<-ctx.Done()
+				_ = srv.Close()
+			}()
+			go func() {
+				if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					logrus.Errorf("[acme] failed to serve http-01 challenges on %s: %v", conf.DashboardACMEHTTP, err)
+				}
+			}()
+		}
+		logrus.Infof("[acme] certificates of %s are managed by %s", strings.Join(conf.DashboardACME, ","), client.DirectoryURL)
+		return m.TLSConfig(), nil
+	}
+
+	provider, err := newDNSProvider(conf.DashboardACMEDNS)
+	if err != nil {
+		return nil, err
+	}
+	d := &dnsACME{client: client, cache: cache, provider: provider}
+	if err = d.load(ctx); err != nil {
+		logrus.Infof("[acme] requesting the certificate of %s: %v", strings.Join(conf.DashboardACME, ","), err)
+		if err = d.obtain(ctx); err != nil {
+			logrus.Errorf("%v, retrying in the background", err)
+		}
+	}
+	go d.renew(ctx)
+
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if cert := d.cert.Load(); cert != nil {
+				return cert, nil
+			}
+			return nil, fmt.Errorf("[acme] the certificate of %s is not obtained yet", strings.Join(conf.DashboardACME, ","))
+		},
+		NextProtos: []string{"h2", "http/1.1"},
+	}, nil
+}
+
+// dnsACME obtains one certificate of all domains with the dns-01 challenge.
+type dnsACME struct {
+	client   *acme.Client
+	cache    autocert.DirCache
+	provider dnsProvider
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+func (d *dnsACME) certKey() string {
+	return "dns01+" + strings.Join(conf.DashboardACME, ",")
+}
+
+// load reads the cached certificate, it fails if the certificate is missing,
+// does not cover the domains or needs renewal.
+func (d *dnsACME) load(ctx context.Context) error {
+	bs, err := d.cache.Get(ctx, d.certKey())
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(bs, bs)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	for _, domain := range conf.DashboardACME {
+		if err = leaf.VerifyHostname(domain); err != nil {
+			return err
+		}
+	}
+	if time.Until(leaf.NotAfter) < acmeRenewBefore {
+		return fmt.Errorf("certificate expires at %s", leaf.NotAfter.Format(time.DateTime))
+	}
+	cert.Leaf = leaf
+	d.cert.Store(&cert)
+	return nil
+}
+
+// renew renews the certificate before it expires, a certificate failed to
+// obtain at startup is retried with backoff.
+func (d *dnsACME) renew(ctx context.Context) {
+	retry := acmeRetryDelay
+	for {
+		wait := acmeCheckInterval
+		if d.cert.Load() == nil {
+			wait, retry = retry, min(retry*2, acmeCheckInterval)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if cert := d.cert.Load(); cert != nil && time.Until(cert.Leaf.NotAfter) > acmeRenewBefore {
+			continue
+		}
+		logrus.Infof("[acme] requesting the certificate of %s", strings.Join(conf.DashboardACME, ","))
+		if err := d.obtain(ctx); err != nil {
+			logrus.Errorf("[acme] failed to obtain certificate: %v", err)
+			continue
+		}
+		retry = acmeRetryDelay
+	}
+}
+
+func (d *dnsACME) obtain(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	if err := d.register(ctx); err != nil {
+		return err
+	}
+
+	order, err := d.client.AuthorizeOrder(ctx, acme.DomainIDs(conf.DashboardACME...))
+	if err != nil {
+		return fmt.Errorf("[acme] failed to create order: %w", err)
+	}
+	for _, u := range order.AuthzURLs {
+		if err = d.authorize(ctx, u); err != nil {
+			return err
+		}
+	}
+	if order, err = d.client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("[acme] order failed: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: conf.DashboardACME[0]},
+		DNSNames: conf.DashboardACME,
+	}, key)
+	if err != nil {
+		return err
+	}
+	ders, _, err := d.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("[acme] failed to issue certificate: %w", err)
+	}
+
+	var buf bytes.Buffer
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	_ = pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, der := range ders {
+		_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	if err = d.cache.Put(ctx, d.certKey(), buf.Bytes()); err != nil {
+		return fmt.Errorf("[acme] failed to save certificate: %w", err)
+	}
+	if err = d.load(ctx); err != nil {
+		return fmt.Errorf("[acme] invalid certificate issued: %w", err)
+	}
+	logrus.Infof("[acme] certificate of %s issued, expires at %s", strings.Join(conf.DashboardACME, ","),
+		d.cert.Load().Leaf.NotAfter.Format(time.DateTime))
+	return nil
+}
+
+// register loads or creates the acme account key in the cache.
+func (d *dnsACME) register(ctx context.Context) error {
+	if d.client.Key != nil {
+		return nil
+	}
+
+	var key crypto.Signer
+	if bs, err := d.cache.Get(ctx, "acme_account+key"); err == nil {
+		block, _ := pem.Decode(bs)
+		if block == nil {
+			return fmt.Errorf("[acme] invalid account key in the cache")
+		}
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return fmt.Errorf("[acme] invalid account key in the cache: %w", err)
+		}
+	} else {
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalECPrivateKey(ecKey)
+		if err != nil {
+			return err
+		}
+		if err = d.cache.Put(ctx, "acme_account+key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+			return fmt.Errorf("[acme] failed to save account key: %w", err)
+		}
+		key = ecKey
+	}
+	d.client.Key = key
+
+	acct := &acme.Account{}
+	if conf.DashboardACMEEmail != "" {
+		acct.Contact = []string{"mailto:" + conf.DashboardACMEEmail}
+	}
+	if _, err := d.client.Register(ctx, acct, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		d.client.Key = nil
+		return fmt.Errorf("[acme] failed to register account: %w", err)
+	}
+	return nil
+}
+
+func (d *dnsACME) authorize(ctx context.Context, authzURL string) error {
+	authz, err := d.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("[acme] failed to get authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("[acme] dns-01 challenge is not offered for %s", authz.Identifier.Value)
+	}
+
+	value, err := d.client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.")
+	id, err := d.provider.Present(ctx, fqdn, value)
+	if err != nil {
+		return fmt.Errorf("[acme] failed to create txt record %s: %w", fqdn, err)
+	}
+	defer func() {
+		if err := d.provider.CleanUp(context.Background(), id); err != nil {
+			logrus.Warnf("[acme] failed to remove txt record %s: %v", fqdn, err)
+		}
+	}()
+
+	logrus.Infof("[acme] txt record %s created, waiting %s for propagation", fqdn, acmeDNSPropagation)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(acmeDNSPropagation):
+	}
+
+	if _, err = d.client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("[acme] failed to accept challenge: %w", err)
+	}
+	if _, err = d.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("[acme] authorization of %s failed: %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// dnsProvider creates the txt records of the dns-01 challenge.
+type dnsProvider interface {
+	Present(ctx context.Context, fqdn, value string) (id string, err error)
+	CleanUp(ctx context.Context, id string) error
+}
+
+// newDNSProvider creates the provider of --dashboard-acme-dns:
+//
+//   - cloudflare://API_TOKEN: the token requires the Zone.DNS edit permission
+func newDNSProvider(s string) (dnsProvider, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("[acme] invalid dns provider: %w", err)
+	}
+	switch u.Scheme {
+	case "cloudflare":
+		if u.Host == "" {
+			return nil, fmt.Errorf("[acme] invalid cloudflare provider, must be cloudflare://API_TOKEN")
+		}
+		return &cloudflareDNS{token: u.Host}, nil
+	}
+	return nil, fmt.Errorf("[acme] unsupported dns provider: %s", u.Scheme)
+}
+
+type cloudflareDNS struct {
+	token string
+}
+
+func (c *cloudflareDNS) do(ctx context.Context, method, path string, body, out any) error {
+	var r bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&r).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "https://api.cloudflare.com/client/v4"+path, &r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var res struct {
+		Success bool            `json:"success"`
+		Errors  []any           `json:"errors"`
+		Result  json.RawMessage `json:"result"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("%s %s: status %d", method, path, resp.StatusCode)
+	}
+	if !res.Success {
+		return fmt.Errorf("%s %s: %v", method, path, res.Errors)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(res.Result, out)
+}
+
+// zone finds the zone of fqdn by trying its parent domains.
+func (c *cloudflareDNS) zone(ctx context.Context, fqdn string) (string, error) {
+	labels := strings.Split(fqdn, ".")
+	for i := 1; i < len(labels)-1; i++ {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		if err := c.do(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(strings.Join(labels[i:], ".")), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("no cloudflare zone found for %s", fqdn)
+}
+
+func (c *cloudflareDNS) Present(ctx context.Context, fqdn, value string) (string, error) {
+	zone, err := c.zone(ctx, fqdn)
+	if err != nil {
+		return "", err
+	}
+	var record struct {
+		ID string `json:"id"`
+	}
+	err = c.do(ctx, http.MethodPost, "/zones/"+zone+"/dns_records", map[string]any{
+		"type": "TXT", "name": fqdn, "content": value, "ttl": 120,
+	}, &record)
+	return zone + "/" + record.ID, err
+}
+
+func (c *cloudflareDNS) CleanUp(ctx context.Context, id string) error {
+	zone, record, _ := strings.Cut(id, "/")
+	return c.do(ctx, http.MethodDelete, "/zones/"+zone+"/dns_records/"+record, nil, nil)
+}
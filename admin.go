@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// adminPath serves the management api on --dashboard-listen with --admin-api
+	adminPath = "/tpclash/api/"
+	// adminMaxBody limits the request bodies of the management api
+	adminMaxBody = 64 << 10
+	// defaultProfile switches back to --config
+	defaultProfile = "default"
+)
+
+// admin is what the management api changes besides the core, the configs are
+// only kept with --admin-api or --grpc-listen.
+var admin = struct {
+	sync.Mutex
+	writePath string
+	proc      *CoreProcess
+
+	// the configs loaded last and before it, rollback loads the previous one
+	current  string
+	previous string
+
+	// profile is the active --profile, the configs of the watcher are held
+	// until the default profile is active again
+	profile string
+	held    string
+}{}
+
+// InitAdmin sets the core the management api manages.
+func InitAdmin(writePath string, proc *CoreProcess) {
+	admin.Lock()
+	defer admin.Unlock()
+	admin.writePath, admin.proc = writePath, proc
+}
+
+// recordLoadedConfig keeps the config loaded by the core for rollback.
+func recordLoadedConfig(ccStr string) {
+	if !conf.AdminAPI && conf.GRPCListen == "" {
+		return
+	}
+	admin.Lock()
+	defer admin.Unlock()
+	if ccStr != admin.current {
+		admin.previous, admin.current = admin.current, ccStr
+	}
+}
+
+// holdConfig reports whether the config of the watcher is held because a
+// profile is active.
+func holdConfig(ccStr string) bool {
+	admin.Lock()
+	defer admin.Unlock()
+	if admin.profile == "" {
+		return false
+	}
+	logrus.Infof("[admin] clash config changed, held while the profile %s is active", admin.profile)
+	admin.held = ccStr
+	return true
+}
+
+// loadProfile loads the config of a --profile, a url or a local file.
+func loadProfile(name string) (string, error) {
+	src, ok := conf.Profiles[name]
+	if !ok {
+		return "", fmt.Errorf("[admin] unknown profile %s", name)
+	}
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		rc, err := fetchRemoteConfig(context.Background(), src)
+		if err != nil {
+			return "", err
+		}
+		return rc.body, nil
+	}
+	return readLocalConfig(src)
+}
+
+// reloadActive loads the config of the active profile again.
+func reloadActive() (err error) {
+	admin.Lock()
+	defer admin.Unlock()
+
+	ctx, span := startUpdate(context.Background(), "admin")
+	defer func() { endSpan(span, err) }()
+
+	var ccStr string
+	if admin.profile != "" {
+		ccStr, err = loadProfile(admin.profile)
+	} else {
+		ccStr, err = loadConfigSource(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	if err = reloadConfig(ctx, ccStr, admin.writePath, admin.proc); err != nil {
+		return err
+	}
+	admin.held = ""
+	setSyncConfig(ccStr)
+	return nil
+}
+
+// rollbackConfig loads the config loaded before the current one, it is kept
+// until the config source changes again.
+func rollbackConfig() error {
+	admin.Lock()
+	defer admin.Unlock()
+
+	if admin.previous == "" {
+		return errors.New("[admin] no previous config to roll back to")
+	}
+	ccStr := admin.previous
+	if err := reloadConfig(context.Background(), ccStr, admin.writePath, admin.proc); err != nil {
+		return err
+	}
+	setSyncConfig(ccStr)
+	return nil
+}
+
+// switchProfile loads the config of the profile, the default profile loads
+// the config of the watcher held in the meantime.
+func switchProfile(name string) (err error) {
+	admin.Lock()
+	defer admin.Unlock()
+
+	ctx, span := startUpdate(context.Background(), "admin")
+	defer func() { endSpan(span, err) }()
+
+	var ccStr string
+	switch {
+	case name == defaultProfile && admin.held != "":
+		ccStr = admin.held
+	case name == defaultProfile:
+		ccStr, err = loadConfigSource(ctx)
+	default:
+		ccStr, err = loadProfile(name)
+	}
+	if err != nil {
+		return err
+	}
+	if err = reloadConfig(ctx, ccStr, admin.writePath, admin.proc); err != nil {
+		return err
+	}
+
+	admin.profile, admin.held = "", ""
+	if name != defaultProfile {
+		admin.profile = name
+	}
+	UpdateState(func(s *RuntimeState) { s.Config.Profile = admin.profile })
+	setSyncConfig(ccStr)
+	return nil
+}
+
+// adminDo runs an action of the management api and records it in the audit
+// log, the http and the grpc api share the actions.
+func adminDo(actor, action, target string, fn func() error) error {
+	err := fn()
+	Audit(AuditSourceAPI, actor, action, target, err)
+	config := strings.HasPrefix(action, "config.")
+	if err != nil {
+		logrus.Error(err)
+		if config {
+			Notify(EventReloadFailure, "%v", err)
+		}
+		return err
+	}
+	if config {
+		ReapplySchedule()
+		ReapplyPolicies()
+		ReapplySync()
+	}
+	return nil
+}
+
+func adminReload(actor string) error {
+	return adminDo(actor, "config.reload", redactURL(conf.ClashConfig), func() error {
+		if err := reloadActive(); err != nil {
+			return err
+		}
+		Notify(EventReloadSuccess, "clash config reloaded by %s", actor)
+		return nil
+	})
+}
+
+func adminRollback(actor string) error {
+	return adminDo(actor, "config.rollback", "", func() error {
+		if err := rollbackConfig(); err != nil {
+			return err
+		}
+		Notify(EventReloadSuccess, "clash config rolled back by %s", actor)
+		return nil
+	})
+}
+
+func adminSwitchProfile(actor, name string) error {
+	return adminDo(actor, "config.profile", name, func() error {
+		if err := switchProfile(name); err != nil {
+			return err
+		}
+		logrus.Infof("[admin] switched to the profile %s by %s", name, actor)
+		Notify(EventReloadSuccess, "switched to the profile %s by %s", name, actor)
+		return nil
+	})
+}
+
+func adminFlushRules(actor string) error {
+	return adminDo(actor, "rules.flush", "", func() error {
+		if err := FlushRules(); err != nil {
+			return err
+		}
+		logrus.Warnf("[admin] the tpclash rules are flushed by %s until they are reapplied", actor)
+		return nil
+	})
+}
+
+func adminReapplyRules(actor string) error {
+	return adminDo(actor, "rules.apply", "", func() error {
+		if err := ReapplyRules(); err != nil {
+			return err
+		}
+		logrus.Infof("[admin] the tpclash rules are reapplied by %s", actor)
+		return nil
+	})
+}
+
+func adminTestNotify(actor string) error {
+	return adminDo(actor, "notify.test", "", func() error {
+		return TestNotify(actor)
+	})
+}
+
+func adminSetLogLevel(actor string, level logrus.Level) error {
+	return adminDo(actor, "log.level", level.String(), func() error {
+		logrus.Infof("[admin] log level set to %s by %s", level, actor)
+		logrus.SetLevel(level)
+		return nil
+	})
+}
+
+// adminProfiles returns the active profile and all the profiles.
+func adminProfiles() (string, []string) {
+	admin.Lock()
+	active := admin.profile
+	admin.Unlock()
+	if active == "" {
+		active = defaultProfile
+	}
+	profiles := []string{defaultProfile}
+	for name := range conf.Profiles {
+		profiles = append(profiles, name)
+	}
+	sort.Strings(profiles[1:])
+	return active, profiles
+}
+
+// adminSources returns the config sources with the credentials redacted.
+func adminSources() map[string]any {
+	active, _ := adminProfiles()
+	mirrors := make([]string, 0, len(conf.ConfigMirrors))
+	for _, m := range conf.ConfigMirrors {
+		mirrors = append(mirrors, redactURL(m))
+	}
+	profiles := make(map[string]string, len(conf.Profiles))
+	for name, src := range conf.Profiles {
+		profiles[name] = redactURL(src)
+	}
+	sources := map[string]any{"config": redactURL(conf.ClashConfig), "mirrors": mirrors, "profiles": profiles, "active": active}
+	if conf.SyncFrom != "" {
+		sources["sync_from"] = redactURL(conf.SyncFrom)
+	}
+	return sources
+}
+
+// validProfile reports whether name is a --profile or the default profile.
+func validProfile(name string) bool {
+	_, ok := conf.Profiles[name]
+	return ok || name == defaultProfile
+}
+
+// serveAdmin is the management api of tpclash itself, a token(tpclash token
+// create) or the clash api secret is always required and the read only
+// tokens can only read.
+func serveAdmin(w http.ResponseWriter, r *http.Request) {
+	p, ok := authenticate(r)
+	if !ok {
+		if hasToken(r) {
+			logrus.Warnf("[admin] invalid token from %s", remoteIP(r))
+			recordAuthFailure(remoteIP(r))
+		}
+		writeAdminJSON(w, http.StatusUnauthorized, adminError("unauthorized"))
+		return
+	}
+	if p.readOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAdminJSON(w, http.StatusForbidden, adminError("read only token"))
+		return
+	}
+	actor := p.name
+	if ip := remoteIP(r); ip != "" {
+		actor += "@" + ip
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, adminMaxBody)
+
+	var err error
+	switch strings.TrimPrefix(r.URL.Path, adminPath) {
+	case "status":
+		if allowMethod(w, r, http.MethodGet) {
+			writeAdminJSON(w, http.StatusOK, CurrentState())
+		}
+		return
+	case "sources":
+		if allowMethod(w, r, http.MethodGet) {
+			writeAdminJSON(w, http.StatusOK, adminSources())
+		}
+		return
+	case "reload":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		err = adminReload(actor)
+	case "rollback":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		err = adminRollback(actor)
+	case "profile":
+		if r.Method == http.MethodGet {
+			active, profiles := adminProfiles()
+			writeAdminJSON(w, http.StatusOK, map[string]any{"active": active, "profiles": profiles})
+			return
+		}
+		if !allowMethod(w, r, http.MethodPut) {
+			return
+		}
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			writeAdminJSON(w, http.StatusBadRequest, adminError(`invalid request, must be {"name": "PROFILE"}`))
+			return
+		}
+		if !validProfile(req.Name) {
+			writeAdminJSON(w, http.StatusBadRequest, adminError("unknown profile "+req.Name))
+			return
+		}
+		err = adminSwitchProfile(actor, req.Name)
+	case "rules/flush":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		err = adminFlushRules(actor)
+	case "rules/reapply":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		err = adminReapplyRules(actor)
+	case "notify/test":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		err = adminTestNotify(actor)
+	case "log-level":
+		if r.Method == http.MethodGet {
+			writeAdminJSON(w, http.StatusOK, map[string]string{"level": logrus.GetLevel().String()})
+			return
+		}
+		if !allowMethod(w, r, http.MethodPut) {
+			return
+		}
+		var req struct {
+			Level string `json:"level"`
+		}
+		var level logrus.Level
+		if err = json.NewDecoder(r.Body).Decode(&req); err == nil {
+			level, err = logrus.ParseLevel(req.Level)
+		}
+		if err != nil {
+			writeAdminJSON(w, http.StatusBadRequest, adminError(`invalid request, must be {"level": "debug|info|warning|error"}`))
+			return
+		}
+		err = adminSetLogLevel(actor, level)
+	default:
+		writeAdminJSON(w, http.StatusNotFound, adminError("not found"))
+		return
+	}
+
+	if err != nil {
+		writeAdminJSON(w, http.StatusInternalServerError, adminError(err.Error()))
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeAdminJSON(w, http.StatusMethodNotAllowed, adminError("method not allowed"))
+	return false
+}
+
+func adminError(msg string) map[string]string {
+	return map[string]string{"error": msg}
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// CheckAdminConf validates the management api flags.
+func CheckAdminConf() error {
+	if conf.AdminAPI && conf.DashboardListen == "" {
+		return errors.New("[admin] --admin-api requires --dashboard-listen")
+	}
+	if len(conf.Profiles) == 0 {
+		return nil
+	}
+	if !conf.AdminAPI && conf.GRPCListen == "" {
+		return errors.New("[admin] --profile requires --admin-api or --grpc-listen")
+	}
+	if conf.SyncFrom != "" {
+		return errors.New("[admin] --profile can not be used with --sync-from, a replica loads the config of the source")
+	}
+	for name, src := range conf.Profiles {
+		if name == "" || name == defaultProfile || src == "" {
+			return fmt.Errorf("[admin] invalid profile %q, must be NAME=CONFIG and NAME must not be %s", name+"="+src, defaultProfile)
+		}
+	}
+	return nil
+}
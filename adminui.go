@@ -0,0 +1,31 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// adminUIPath serves the management page on --dashboard-listen with
+// --admin-api, the page reads and changes tpclash through adminPath.
+const adminUIPath = "/tpclash/"
+
+//go:embed adminui.html
+var adminUI []byte
+
+// serveAdminUI serves the management page, it is behind the authentication
+// of the dashboard and passes the token of ?token= to the management api.
+func serveAdminUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != adminUIPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(adminUI)
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// agentDialTimeout limits the connect and the websocket handshake
+	agentDialTimeout = 15 * time.Second
+	agentMaxBackoff  = time.Minute
+	// agentMaxMessage limits the messages of the server, the pushed configs
+	// included
+	agentMaxMessage = 16 << 20
+)
+
+// AgentMessage is the json message exchanged with the agent server, the agent
+// sends hello once connected, then status every --interval and a result for
+// each command received.
+type AgentMessage struct {
+	// hello, status, result(agent) or command(server)
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+
+	// hello
+	Node    string `json:"node,omitempty"`
+	Version string `json:"version,omitempty"`
+	Core    string `json:"core,omitempty"`
+	// sha256 of the last pushed config, empty if the running config is not
+	// the pushed one(started again, reloaded or --config changed)
+	PushedHash string `json:"pushed_hash,omitempty"`
+
+	// status
+	Status *StatusReport `json:"status,omitempty"`
+
+	// command: reload, mode, config, upgrade or status
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+	Config  string   `json:"config,omitempty"`
+
+	// result
+	OK    bool   `json:"ok,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Run TPClash managed by a central server",
+	Long: `Run TPClash as usual and keep an outbound websocket connection to the
+agent server, so the routers behind NAT can be managed centrally.
+
+The agent reports the status every --interval and runs the commands of the
+server: reload(--config again), mode MODE, config(push a clash config),
+upgrade [VERSION](self-update and restart) and status. A pushed config is
+applied until --config changes or tpclash restarts, the hello of every
+connection tells the server the hash of the pushed config still running.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := CheckAgentConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		return rootCmd.RunE(cmd, args)
+	},
+}
+
+// CheckAgentConf validates the agent flags.
+func CheckAgentConf() error {
+	u, err := url.Parse(conf.AgentServer)
+	if err != nil || u.Host == "" || (u.Scheme != "ws" && u.Scheme != "wss") {
+		return errors.New("[agent] invalid --server url, must be wss://host[:port][/path] or ws://")
+	}
+	if conf.AgentInterval <= 0 {
+		return fmt.Errorf("[agent] invalid --interval %s, must be positive", conf.AgentInterval)
+	}
+	if u.Scheme == "ws" && conf.AgentToken != "" {
+		logrus.Warnf("[agent] ⚠️ the token is sent to %s in plain text, use wss://", u.Host)
+	}
+	return nil
+}
+
+// agent is the connection of the running instance to the agent server.
+type agent struct {
+	node      string
+	writePath string
+	proc      *CoreProcess
+
+	mu sync.Mutex
+	// the hash of the last pushed config and the state config hash once it
+	// was applied, the running config is the pushed one while they match
+	pushedHash  string
+	pushedState string
+}
+
+// RunAgent connects to the --server of tpclash agent and serves it until the
+// context is done, it reconnects with backoff.
+func RunAgent(ctx context.Context, writePath string, proc *CoreProcess) {
+	if conf.AgentServer == "" {
+		return
+	}
+	node := conf.AgentName
+	if node == "" {
+		node, _ = os.Hostname()
+	}
+	a := &agent{node: node, writePath: writePath, proc: proc}
+
+	logrus.Infof("[agent] connecting to the agent server %s as %s", redactURL(conf.AgentServer), node)
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := a.serve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > agentMaxBackoff {
+			backoff = time.Second
+		}
+		logrus.Errorf("[agent] disconnected from the agent server, reconnecting in %s: %v", backoff, redactErr(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, agentMaxBackoff)
+	}
+}
+
+// serve runs a connection to the server until it fails.
+func (a *agent) serve(ctx context.Context) error {
+	ws, err := dialAgent(ctx)
+	if err != nil {
+		return err
+	}
+	ws.MaxPayloadBytes = agentMaxMessage
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		_ = ws.Close()
+	}()
+
+	if err = websocket.JSON.Send(ws, a.hello()); err != nil {
+		return err
+	}
+	logrus.Infof("[agent] connected to the agent server %s", redactURL(conf.AgentServer))
+
+	errCh := make(chan error, 2)
+	go func() {
+		ticker := time.NewTicker(conf.AgentInterval)
+		defer ticker.Stop()
+		for {
+			if err := websocket.JSON.Send(ws, a.status()); err != nil {
+				errCh <- err
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	// the commands run one at a time in the order received, the server may
+	// send the next one before the result of the last
+	cmds := make(chan AgentMessage, 16)
+	go func() {
+		defer close(cmds)
+		for {
+			var m AgentMessage
+			if err := websocket.JSON.Receive(ws, &m); err != nil {
+				errCh <- err
+				return
+			}
+			if m.Type != "command" {
+				logrus.Debugf("[agent] ignored the %q message of the server", m.Type)
+				continue
+			}
+			cmds <- m
+		}
+	}()
+	go func() {
+		for m := range cmds {
+			if err := websocket.JSON.Send(ws, a.run(m)); err != nil {
+				logrus.Debugf("[agent] failed to send the result of %s: %v", m.ID, err)
+			}
+		}
+	}()
+	return <-errCh
+}
+
+// dialAgent connects to the --server and performs the websocket handshake,
+// the token is sent as a bearer token.
+func dialAgent(ctx context.Context) (*websocket.Conn, error) {
+	u, err := url.Parse(conf.AgentServer)
+	if err != nil {
+		return nil, err
+	}
+	origin := "http://" + u.Host
+	if u.Scheme == "wss" {
+		origin = "https://" + u.Host
+	}
+	config, err := websocket.NewConfig(conf.AgentServer, origin)
+	if err != nil {
+		return nil, err
+	}
+	if conf.AgentToken != "" {
+		config.Header.Set("Authorization", "Bearer "+conf.AgentToken)
+	}
+	config.Header.Set("User-Agent", "tpclash/"+version)
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), map[string]string{"ws": "80", "wss": "443"}[u.Scheme])
+	}
+	ctx, cancel := context.WithTimeout(ctx, agentDialTimeout)
+	defer cancel()
+	var conn net.Conn
+	if u.Scheme == "wss" {
+		conn, err = (&tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("websocket handshake: %w", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+func (a *agent) hello() AgentMessage {
+	m := AgentMessage{Type: "hello", Node: a.node, Version: version, Core: CoreFlavor()}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s, err := LoadState(); err == nil && a.pushedState != "" && s.Config.Hash == a.pushedState {
+		m.PushedHash = a.pushedHash
+	}
+	return m
+}
+
+// status reports the status of the running instance without the secret of
+// the clash api.
+func (a *agent) status() AgentMessage {
+	m := AgentMessage{Type: "status", Node: a.node}
+	if cc, err := RunningConf(); err == nil {
+		m.Status = collectStatus(cc)
+		m.Status.Secret = ""
+	} else {
+		m.Error = err.Error()
+	}
+	return m
+}
+
+// run runs a command of the server and returns its result.
+func (a *agent) run(m AgentMessage) AgentMessage {
+	logrus.Infof("[agent] running the command of the server: %s %s", m.Command, strings.Join(m.Args, " "))
+	var err error
+	switch m.Command {
+	case "status":
+		s := a.status()
+		s.Type, s.ID, s.OK = "result", m.ID, s.Error == ""
+		return s
+	case "reload":
+		err = a.reload()
+	case "mode":
+		if len(m.Args) != 1 || !slices.Contains(clashModes, m.Args[0]) {
+			err = errors.New("[agent] mode requires one of rule, global or direct")
+			break
+		}
+		err = patchMode(m.Args[0])
+		Audit(AuditSourceAgent, a.actor(), "mode.switch", m.Args[0], err)
+	case "config":
+		err = a.push(m.Config)
+	case "upgrade":
+		err = a.upgrade(m.Args)
+	default:
+		err = fmt.Errorf("[agent] unknown command %q", m.Command)
+	}
+
+	r := AgentMessage{Type: "result", ID: m.ID, OK: err == nil}
+	if err != nil {
+		logrus.Errorf("[agent] the %s command of the server failed: %v", m.Command, err)
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// actor is the server in the audit log.
+func (a *agent) actor() string {
+	if u, err := url.Parse(conf.AgentServer); err == nil {
+		return u.Host
+	}
+	return ""
+}
+
+// reload loads the --config again, applied even if it did not change so a
+// pushed config can be reverted.
+func (a *agent) reload() error {
+	ctx, span := startUpdate(context.Background(), "agent")
+	ccStr, err := loadConfigSource(ctx)
+	if err == nil {
+		err = reloadConfig(ctx, ccStr, a.writePath, a.proc)
+	}
+	endSpan(span, err)
+	Audit(AuditSourceAgent, a.actor(), "config.reload", redactURL(conf.ClashConfig), err)
+	if err != nil {
+		Notify(EventReloadFailure, "%v", err)
+		return err
+	}
+	Notify(EventReloadSuccess, "clash config reloaded by the agent server")
+	ReapplySchedule()
+	ReapplyPolicies()
+	return nil
+}
+
+// push applies the config pushed by the server.
+func (a *agent) push(ccStr string) error {
+	if strings.TrimSpace(ccStr) == "" {
+		return errors.New("[agent] the pushed config is empty")
+	}
+	err := reloadConfig(context.Background(), ccStr, a.writePath, a.proc)
+	sum := hashConfig(ccStr)
+	Audit(AuditSourceAgent, a.actor(), "config.push", hex.EncodeToString(sum[:8]), err)
+	if err != nil {
+		Notify(EventReloadFailure, "%v", err)
+		return err
+	}
+	if s, err := LoadState(); err == nil {
+		a.mu.Lock()
+		a.pushedHash, a.pushedState = hex.EncodeToString(sum[:]), s.Config.Hash
+		a.mu.Unlock()
+	}
+	Notify(EventReloadSuccess, "clash config pushed by the agent server")
+	setSyncConfig(ccStr)
+	ReapplySchedule()
+	ReapplyPolicies()
+	return nil
+}
+
+// upgrade runs self-update of this executable, the restart ends the agent
+// once the update is installed.
+func (a *agent) upgrade(args []string) error {
+	if len(args) > 1 {
+		return errors.New("[agent] upgrade accepts at most one version")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("[agent] failed to get the executable path: %w", err)
+	}
+	out, err := ChildOutput(exec.Command(exe, append([]string{"self-update", "--restart"}, args...)...))
+	Audit(AuditSourceAgent, a.actor(), "tpclash.update", strings.Join(args, " "), err)
+	if err != nil {
+		return fmt.Errorf("[agent] self-update failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func init() {
+	agentCmd.Flags().StringVar(&conf.AgentServer, "server", "", "agent server websocket url(wss://host[:port][/path])")
+	agentCmd.Flags().StringVar(&conf.AgentToken, "token", "", "bearer token sent to the agent server")
+	addSecretFileFlags(agentCmd.Flags(), "token")
+	agentCmd.Flags().StringVar(&conf.AgentName, "name", "", "node name reported to the agent server(default the hostname)")
+	agentCmd.Flags().DurationVar(&conf.AgentInterval, "interval", 30*time.Second, "status report interval")
+	_ = agentCmd.MarkFlagRequired("server")
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ClashAPI is a client of the clash api(external-controller) of the core.
+type ClashAPI struct {
+	Addr   string
+	secret string
+	cli    *http.Client
+}
+
+// NewClashAPI creates a client of the controller in cc, the wildcard listen
+// address is reached through the loopback. The unix socket is preferred.
+func NewClashAPI(cc *ClashConf) *ClashAPI {
+	if sock := cc.ExternalControllerUnix; sock != "" {
+		var d net.Dialer
+		return &ClashAPI{
+			Addr: "unix:" + sock,
+			cli: &http.Client{
+				Timeout: 10 * time.Second,
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						return d.DialContext(ctx, "unix", sock)
+					},
+				},
+			},
+		}
+	}
+
+	addr := cc.ExternalController
+	if addr == "" {
+		addr = enforceExternalController
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			addr = net.JoinHostPort("127.0.0.1", port)
+		}
+	}
+
+	return &ClashAPI{
+		Addr:   addr,
+		secret: cc.Secret,
+		cli:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Do sends the request to the clash api, body and out are encoded as json.
+func (a *ClashAPI) Do(method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(bs)
+	}
+
+	host := a.Addr
+	if strings.HasPrefix(host, "unix:") {
+		host = "unix"
+	}
+	req, err := http.NewRequest(method, "http://"+host+path, r)
+	if err != nil {
+		return err
+	}
+	if a.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+a.secret)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := a.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var msg bytes.Buffer
+		_, _ = io.Copy(&msg, io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s %s: status %d: %s", method, path, resp.StatusCode, bytes.TrimSpace(msg.Bytes()))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// First reads the first message of a streaming api(e.g. /traffic).
+func (a *ClashAPI) First(path string, out any) error {
+	host := a.Addr
+	if strings.HasPrefix(host, "unix:") {
+		host = "unix"
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	if err != nil {
+		return err
+	}
+	if a.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+a.secret)
+	}
+
+	resp, err := a.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("GET %s: status %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Stream reads the messages of a streaming api(e.g. /logs) until fn returns
+// false or ctx is done.
+func (a *ClashAPI) Stream(ctx context.Context, path string, fn func(msg json.RawMessage) bool) error {
+	host := a.Addr
+	if strings.HasPrefix(host, "unix:") {
+		host = "unix"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+path, nil)
+	if err != nil {
+		return err
+	}
+	if a.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+a.secret)
+	}
+
+	// the stream never ends, only the response header is limited
+	cli := *a.cli
+	cli.Timeout = 0
+	resp, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("GET %s: status %d", path, resp.StatusCode)
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg json.RawMessage
+		if err = dec.Decode(&msg); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if !fn(msg) {
+			return nil
+		}
+	}
+}
+
+// RunningConf returns the config of the core started by tpclash, it is read
+// from the internal config file in the clash home.
+func RunningConf() (*ClashConf, error) {
+	var err error
+	if core == nil {
+		if core, err = NewCore(); err != nil {
+			return nil, err
+		}
+	}
+
+	bs, err := os.ReadFile(filepath.Join(conf.ClashHome, core.ConfigName()))
+	if err != nil {
+		return nil, fmt.Errorf("[api] failed to read the running config, is tpclash running? %w", err)
+	}
+	return core.Parse(string(bs))
+}
+
+// RunningAPI returns the clash api client of the core started by tpclash.
+func RunningAPI() (*ClashAPI, error) {
+	cc, err := RunningConf()
+	if err != nil {
+		return nil, err
+	}
+	return NewClashAPI(cc), nil
+}
+
+// ControllerSecret returns the clash api secret persisted in the clash home,
+// a random one is generated on first use.
+func ControllerSecret() (string, error) {
+	secretPath := filepath.Join(conf.ClashHome, secretFileName)
+	if bs, err := os.ReadFile(secretPath); err == nil && len(bytes.TrimSpace(bs)) > 0 {
+		return string(bytes.TrimSpace(bs)), nil
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	err = hostChange("file", fmt.Sprintf("write %s 0600(generated api secret)", secretPath), func() error {
+		if err := os.MkdirAll(conf.ClashHome, 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(secretPath, []byte(secret), 0600)
+	})
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	assetMirrorPath = "/asset/"
+	assetCacheDir   = "asset-cache"
+	// assetKeyLen is the length of the sha256 prefix naming an asset
+	assetKeyLen = 16
+	// the cached assets no longer in the config are removed once they were
+	// not fetched for assetEvictAge
+	assetEvictAge = 7 * 24 * time.Hour
+)
+
+// geoxURLKeys are the geo databases downloaded by the meta cores themselves.
+var geoxURLKeys = []string{"geoip", "geosite", "mmdb", "asn"}
+
+// defaultGeoxURLs are the geox-url defaults of mihomo, they are added to the
+// config so the databases are mirrored as well.
+var defaultGeoxURLs = map[string]string{
+	"geoip":   "https://github.com/MetaCubeX/meta-rules-dat/releases/download/latest/geoip.dat",
+	"geosite": "https://github.com/MetaCubeX/meta-rules-dat/releases/download/latest/geosite.dat",
+	"mmdb":    "https://github.com/MetaCubeX/meta-rules-dat/releases/download/latest/country.mmdb",
+	"asn":     "https://github.com/xishang0128/geoip/releases/download/latest/GeoLite2-ASN.mmdb",
+}
+
+// assetMeta is kept next to a cached asset.
+type assetMeta struct {
+	URL          string    `json:"url"`
+	FetchedAt    time.Time `json:"fetched_at"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	ContentType  string    `json:"content_type,omitempty"`
+}
+
+// assetMirror maps the keys of the rewritten urls to the upstream ones, only
+// the registered urls are fetched so the mirror is not an open proxy.
+var assetMirror = struct {
+	mu     sync.Mutex
+	urls   map[string]string
+	locks  map[string]*sync.Mutex
+	client *http.Client
+}{urls: make(map[string]string), locks: make(map[string]*sync.Mutex)}
+
+// mirrorAssets rewrites the urls of the http rule providers and geox-url to
+// the asset mirror, the missing geox-url of mihomo are set to the defaults.
+// The urls of the previous configs are forgotten, the cached copies of them
+// are still found by assetURL until they are evicted.
+func mirrorAssets(doc *yaml.Node) bool {
+	root := yamlRoot(doc)
+	if conf.AssetMirrorListen == "" || root == nil {
+		return false
+	}
+
+	urls := make(map[string]string)
+	defer func() {
+		assetMirror.mu.Lock()
+		assetMirror.urls = urls
+		assetMirror.mu.Unlock()
+	}()
+
+	var n int
+	if _, providers := yamlMapGet(root, "rule-providers"); providers != nil && providers.Kind == yaml.MappingNode {
+		for i := 1; i < len(providers.Content); i += 2 {
+			if _, u := yamlMapGet(providers.Content[i], "url"); u != nil && mirrorAssetNode(u, urls) {
+				n++
+			}
+		}
+	}
+	_, geox := yamlMapGet(root, "geox-url")
+	if geox == nil && CoreFlavor() == CoreMihomo {
+		geox = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "geox-url"}, geox)
+	}
+	if geox != nil && geox.Kind == yaml.MappingNode {
+		for _, key := range geoxURLKeys {
+			_, u := yamlMapGet(geox, key)
+			if u == nil && CoreFlavor() == CoreMihomo {
+				u = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: defaultGeoxURLs[key]}
+				geox.Content = append(geox.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, u)
+			}
+			if u != nil && mirrorAssetNode(u, urls) {
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return false
+	}
+	logrus.Debugf("[mirror] %d asset urls are served by the mirror", n)
+	return true
+}
+
+// mirrorAssetNode replaces the url of the scalar node with its mirror url and
+// registers the upstream url in urls.
+func mirrorAssetNode(n *yaml.Node, urls map[string]string) bool {
+	u, err := url.Parse(n.Value)
+	if n.Kind != yaml.ScalarNode || err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	// already mirrored, the upstream url stays registered
+	if u.Host == assetMirrorAddr() {
+		key, _, _ := strings.Cut(strings.TrimPrefix(u.Path, assetMirrorPath), "/")
+		assetMirror.mu.Lock()
+		if upstream, ok := assetMirror.urls[key]; ok {
+			urls[key] = upstream
+		}
+		assetMirror.mu.Unlock()
+		return false
+	}
+	sum := sha256.Sum256([]byte(n.Value))
+	key := hex.EncodeToString(sum[:])[:assetKeyLen]
+
+	urls[key] = n.Value
+
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		name = "asset"
+	}
+	n.Value = "http://" + assetMirrorAddr() + assetMirrorPath + key + "/" + url.PathEscape(name)
+	n.Tag, n.Style = "!!str", 0
+	return true
+}
+
+// assetMirrorAddr is the address of the mirror reachable from the core.
+func assetMirrorAddr() string {
+	host, port, err := net.SplitHostPort(conf.AssetMirrorListen)
+	if err != nil {
+		return conf.AssetMirrorListen
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// ListenAssetMirror listens on --asset-mirror-listen, it is called before the
+// core starts so the first provider updates already go through the mirror.
+func ListenAssetMirror() (net.Listener, error) {
+	if conf.AssetMirrorListen == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Join(conf.ClashHome, assetCacheDir), 0755); err != nil {
+		return nil, fmt.Errorf("[mirror] failed to create the cache dir: %w", err)
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if conf.AssetMirrorProxy != "" {
+		proxy, err := url.Parse(conf.AssetMirrorProxy)
+		if err != nil {
+			return nil, fmt.Errorf("[mirror] invalid --asset-mirror-proxy: %w", err)
+		}
+		t.Proxy = http.ProxyURL(proxy)
+	}
+	assetMirror.client = &http.Client{Timeout: conf.HttpTimeout, Transport: t}
+
+	l, err := net.Listen("tcp", conf.AssetMirrorListen)
+	if err != nil {
+		return nil, fmt.Errorf("[mirror] failed to listen on %s: %w", conf.AssetMirrorListen, err)
+	}
+	return l, nil
+}
+
+// ServeAssetMirror serves the cached assets on l until ctx is done.
+func ServeAssetMirror(ctx context.Context, l net.Listener) error {
+	if l == nil {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(assetMirrorPath, serveAsset)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	go func() {
+		ticker := time.NewTicker(conf.AssetMirrorTTL)
+		defer ticker.Stop()
+		for {
+			evictAssets()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	logrus.Infof("[mirror] asset mirror is served on %s, ttl: %s", conf.AssetMirrorListen, conf.AssetMirrorTTL)
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("[mirror] failed to serve on %s: %w", conf.AssetMirrorListen, err)
+	}
+	return nil
+}
+
+func serveAsset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, assetMirrorPath), "/")
+	if _, err := hex.DecodeString(key); err != nil || len(key) != assetKeyLen {
+		http.NotFound(w, r)
+		return
+	}
+	upstream, ok := assetURL(key)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, meta, err := cachedAsset(r.Context(), key, upstream)
+	if err != nil {
+		logrus.Errorf("[mirror] %v", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer func() { _ = f.Close() }()
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	http.ServeContent(w, r, "", meta.FetchedAt, f)
+}
+
+// assetURL returns the upstream url of the key, the urls registered by the
+// previous runs are found in the cache.
+func assetURL(key string) (string, bool) {
+	assetMirror.mu.Lock()
+	u, ok := assetMirror.urls[key]
+	assetMirror.mu.Unlock()
+	if ok {
+		return u, true
+	}
+	if meta, err := loadAssetMeta(key); err == nil && meta.URL != "" {
+		return meta.URL, true
+	}
+	return "", false
+}
+
+// cachedAsset returns the cached file of the asset, it is refreshed once it
+// is older than --asset-mirror-ttl and the stale copy is used when the
+// upstream fails.
+func cachedAsset(ctx context.Context, key, upstream string) (string, *assetMeta, error) {
+	assetMirror.mu.Lock()
+	lock, ok := assetMirror.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		assetMirror.locks[key] = lock
+	}
+	assetMirror.mu.Unlock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	file := filepath.Join(conf.ClashHome, assetCacheDir, key)
+	meta, err := loadAssetMeta(key)
+	cached := err == nil && meta.URL == upstream
+	if cached {
+		if _, err = os.Stat(file); err != nil {
+			cached = false
+		}
+	}
+	if cached && time.Since(meta.FetchedAt) < conf.AssetMirrorTTL {
+		return file, meta, nil
+	}
+	if !cached {
+		meta = &assetMeta{URL: upstream}
+	}
+
+	err = fetchAsset(ctx, file, meta, cached)
+	if err == nil {
+		if err = saveAssetMeta(key, meta); err != nil {
+			logrus.Warnf("[mirror] %v", err)
+		}
+		return file, meta, nil
+	}
+	if cached {
+		logrus.Warnf("[mirror] failed to refresh %s, serve the copy fetched at %s: %v", redactURL(upstream), meta.FetchedAt.Format(time.DateTime), err)
+		return file, meta, nil
+	}
+	return "", nil, fmt.Errorf("failed to fetch %s: %w", redactURL(upstream), err)
+}
+
+// fetchAsset downloads the asset to file, a cached copy is revalidated with
+// its etag or modification time.
+func fetchAsset(ctx context.Context, file string, meta *assetMeta, cached bool) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, meta.URL, nil)
+	if err != nil {
+		return err
+	}
+	if cached {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+	resp, err := assetMirror.client.Do(req)
+	if err != nil {
+		return redactErr(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached:
+		logrus.Debugf("[mirror] %s is not modified", redactURL(meta.URL))
+	case resp.StatusCode == http.StatusOK:
+		if err = writeFileAtomic(file, resp.Body, 0644); err != nil {
+			return err
+		}
+		meta.ETag = resp.Header.Get("ETag")
+		meta.LastModified = resp.Header.Get("Last-Modified")
+		meta.ContentType = resp.Header.Get("Content-Type")
+		logrus.Infof("[mirror] %s cached", redactURL(meta.URL))
+	default:
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	meta.FetchedAt = time.Now()
+	return nil
+}
+
+// evictAssets removes the cached assets no longer in the config once they were
+// not fetched for assetEvictAge, the assets in use are fetched again every
+// --asset-mirror-ttl.
+func evictAssets() {
+	dir := filepath.Join(conf.ClashHome, assetCacheDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logrus.Warnf("[mirror] failed to read the cache dir: %v", err)
+		return
+	}
+	assetMirror.mu.Lock()
+	registered := maps.Clone(assetMirror.urls)
+	assetMirror.mu.Unlock()
+
+	var n int
+	for _, e := range entries {
+		key := strings.TrimSuffix(e.Name(), ".json")
+		if _, ok := registered[key]; ok || e.IsDir() {
+			continue
+		}
+		var fetchedAt time.Time
+		if meta, err := loadAssetMeta(key); err == nil {
+			fetchedAt = meta.FetchedAt
+		} else if fi, err := e.Info(); err == nil {
+			fetchedAt = fi.ModTime()
+		}
+		if time.Since(fetchedAt) < assetEvictAge {
+			continue
+		}
+		if err = os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			logrus.Warnf("[mirror] failed to evict %s: %v", e.Name(), err)
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		logrus.Infof("[mirror] %d stale files evicted from the cache", n)
+	}
+}
+
+func loadAssetMeta(key string) (*assetMeta, error) {
+	bs, err := os.ReadFile(filepath.Join(conf.ClashHome, assetCacheDir, key+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var meta assetMeta
+	if err = json.Unmarshal(bs, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func saveAssetMeta(key string, meta *assetMeta) error {
+	bs, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(filepath.Join(conf.ClashHome, assetCacheDir, key+".json"), strings.NewReader(string(bs)), 0644); err != nil {
+		return fmt.Errorf("failed to save the asset metadata: %w", err)
+	}
+	return nil
+}
+
+// CheckAssetMirrorConf validates the --asset-mirror-* flags.
+func CheckAssetMirrorConf() error {
+	if conf.AssetMirrorListen == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(conf.AssetMirrorListen); err != nil {
+		return fmt.Errorf("[mirror] invalid --asset-mirror-listen: %w", err)
+	}
+	if conf.AssetMirrorTTL <= 0 {
+		return errors.New("[mirror] --asset-mirror-ttl must be positive")
+	}
+	if core.Name() == CoreSingBox {
+		logrus.Warn("[mirror] the asset mirror only rewrites clash configs, the rule sets of sing-box are not mirrored")
+	}
+	return nil
+}
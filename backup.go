@@ -0,0 +1,308 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	backupManifestName = "tpclash-backup.json"
+	backupHomeDir      = "home"
+	backupFilesDir     = "files"
+)
+
+// BackupManifest describes the archive written by `tpclash backup`.
+type BackupManifest struct {
+	Version   string    `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Home      string    `json:"home"`
+	// Files are the absolute paths outside the clash home
+	Files []string `json:"files"`
+}
+
+var restoreOpts struct {
+	homeOnly bool
+	force    bool
+}
+
+var backupCmd = &cobra.Command{
+	Use:   "backup FILE.tgz",
+	Short: "Back up the clash home and the tpclash settings",
+	Long: `Write the clash home(configs, caches, geo databases, selections, tokens...)
+and the tpclash settings(local clash config, tpclash config file, env file and
+systemd unit) to a tar.gz archive.
+
+The extracted files, the cores and the runtime files are not included, they
+are recreated by tpclash on the target host. The archive contains secrets and
+is only readable by the owner.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+		if core, err = NewCore(); err != nil {
+			logrus.Fatal(err)
+		}
+		n, err := writeBackup(args[0])
+		Audit(AuditSourceCLI, "", "tpclash.backup", args[0], err)
+		if err != nil {
+			_ = os.Remove(args[0])
+			logrus.Fatal(err)
+		}
+		logrus.Infof("[backup] %d files backed up: %s", n, args[0])
+	},
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore FILE.tgz",
+	Short: "Restore a backup written by tpclash backup",
+	Long: `Restore the clash home into --home and the tpclash settings to their
+original paths. Existing files are overwritten, the other files in the clash
+home are kept.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if proc, err := runningTPClash(); err == nil && !restoreOpts.force {
+			logrus.Fatalf("[restore] tpclash(pid %d) is running, stop it first", proc.Pid)
+		}
+		m, n, err := restoreBackup(args[0])
+		Audit(AuditSourceCLI, "", "tpclash.restore", args[0], err)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("[restore] %d files restored from the backup of %s(tpclash %s)", n, m.CreatedAt.Format(time.DateTime), m.Version)
+		if isBackupFile(m, filepath.Join(systemdDir, "tpclash.service")) && !restoreOpts.homeOnly {
+			logrus.Info("[restore] the systemd service is restored, run systemctl daemon-reload to apply it")
+		}
+		if m.Home != conf.ClashHome {
+			logrus.Warnf("[restore] the backup was taken from the clash home %s, start tpclash with --home %s", m.Home, conf.ClashHome)
+		}
+	},
+}
+
+// backupExcluded reports whether the file in the clash home is left out of
+// the backup: files recreated on start or specific to the cpu architecture.
+func backupExcluded(rel string, extracted extractManifest) bool {
+	if _, ok := extracted[rel]; ok {
+		return true
+	}
+	for _, name := range cleanRuntimeFiles {
+		if rel == name {
+			return true
+		}
+	}
+	if rel == sysctlBackupName || rel == handoffHomeDir || strings.HasPrefix(rel, handoffHomeDir+string(filepath.Separator)) {
+		return true
+	}
+	// the embedded and downloaded cores and their configs
+	return filepath.Dir(rel) == "." && (strings.HasPrefix(rel, InternalClashBinName) || strings.HasPrefix(rel, InternalSingBoxBinName))
+}
+
+// backupCandidates returns the absolute paths of the settings outside the
+// clash home, a restore writes nothing else outside the home whatever the
+// manifest of the archive lists.
+func backupCandidates() []string {
+	candidates := []string{conf.ConfFile, filepath.Join(filepath.Dir(defaultConfFile), "tpclash.env"), filepath.Join(systemdDir, "tpclash.service")}
+	if !isRemoteConfig() {
+		candidates = append(candidates, conf.ClashConfig)
+	}
+
+	var files []string
+	home := filepath.Clean(conf.ClashHome) + string(filepath.Separator)
+	for _, f := range candidates {
+		abs, err := filepath.Abs(f)
+		if err != nil || strings.HasPrefix(abs, home) {
+			continue
+		}
+		files = append(files, abs)
+	}
+	return files
+}
+
+// backupFiles returns the settings outside the clash home which exist.
+func backupFiles() []string {
+	var files []string
+	for _, f := range backupCandidates() {
+		if info, err := os.Stat(f); err == nil && info.Mode().IsRegular() {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func writeBackup(path string) (int, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("[backup] failed to create %s: %w", path, err)
+	}
+	defer func() { _ = f.Close() }()
+	out, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+
+	m := BackupManifest{Version: version, CreatedAt: time.Now(), Home: conf.ClashHome, Files: backupFiles()}
+	bs, _ := json.MarshalIndent(m, "", "  ")
+	if err = tw.WriteHeader(&tar.Header{Name: backupManifestName, Mode: 0644, Size: int64(len(bs)), ModTime: m.CreatedAt}); err != nil {
+		return 0, err
+	}
+	if _, err = tw.Write(bs); err != nil {
+		return 0, err
+	}
+
+	var n int
+	extracted := loadExtractManifest()
+	err = filepath.WalkDir(conf.ClashHome, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(conf.ClashHome, p)
+		if err != nil || rel == "." || !d.Type().IsRegular() || p == out {
+			return err
+		}
+		if backupExcluded(rel, extracted) {
+			logrus.Debugf("[backup] skip %s", rel)
+			return nil
+		}
+		n++
+		return addBackupFile(tw, p, filepath.ToSlash(filepath.Join(backupHomeDir, rel)))
+	})
+	if err != nil {
+		return 0, fmt.Errorf("[backup] failed to back up the clash home: %w", err)
+	}
+	for _, p := range m.Files {
+		if err = addBackupFile(tw, p, backupFilesDir+filepath.ToSlash(p)); err != nil {
+			return 0, fmt.Errorf("[backup] failed to back up %s: %w", p, err)
+		}
+		n++
+	}
+
+	if err = tw.Close(); err != nil {
+		return 0, fmt.Errorf("[backup] failed to write %s: %w", path, err)
+	}
+	if err = gw.Close(); err != nil {
+		return 0, fmt.Errorf("[backup] failed to write %s: %w", path, err)
+	}
+	return n, f.Sync()
+}
+
+func addBackupFile(tw *tar.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	logrus.Debugf("[backup] add %s", path)
+	if err = tw.WriteHeader(&tar.Header{Name: name, Mode: int64(info.Mode().Perm()), Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+		return err
+	}
+	// the size in the header must match, the file may be written meanwhile
+	_, err = io.CopyN(tw, f, info.Size())
+	return err
+}
+
+func restoreBackup(path string) (*BackupManifest, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("[restore] failed to open %s: %w", path, err)
+	}
+	defer func() { _ = f.Close() }()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, 0, fmt.Errorf("[restore] %s is not a tpclash backup: %w", path, err)
+	}
+	tr := tar.NewReader(gr)
+
+	// the manifest is always the first entry
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != backupManifestName {
+		return nil, 0, fmt.Errorf("[restore] %s is not a tpclash backup", path)
+	}
+	var m BackupManifest
+	if err = json.NewDecoder(tr).Decode(&m); err != nil {
+		return nil, 0, fmt.Errorf("[restore] invalid backup manifest: %w", err)
+	}
+
+	var n int
+	targets := backupCandidates()
+	for {
+		hdr, err = tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, n, fmt.Errorf("[restore] failed to read %s: %w", path, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		var target string
+		switch dir, name, _ := strings.Cut(hdr.Name, "/"); dir {
+		case backupHomeDir:
+			target, err = archiveTarget(conf.ClashHome, name)
+		case backupFilesDir:
+			if restoreOpts.homeOnly {
+				continue
+			}
+			// only the settings of this host are written outside the home
+			target = filepath.Clean("/" + name)
+			if !slices.Contains(targets, target) {
+				err = fmt.Errorf("unexpected archive entry: %s", hdr.Name)
+			}
+		default:
+			err = fmt.Errorf("unexpected archive entry: %s", hdr.Name)
+		}
+		if err != nil {
+			return nil, n, fmt.Errorf("[restore] %w", err)
+		}
+
+		logrus.Infof("[restore] restore --> %s", target)
+		if err = restoreFile(target, tr, fs.FileMode(hdr.Mode).Perm()); err != nil {
+			return nil, n, fmt.Errorf("[restore] failed to restore %s: %w", target, err)
+		}
+		n++
+	}
+	return &m, n, nil
+}
+
+func isBackupFile(m *BackupManifest, target string) bool {
+	for _, f := range m.Files {
+		if filepath.Clean(f) == filepath.Clean(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreFile writes the file atomically, a failed restore does not leave a
+// truncated config behind.
+func restoreFile(target string, r io.Reader, perm fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(target, r, perm)
+}
+
+func init() {
+	restoreCmd.Flags().BoolVar(&restoreOpts.homeOnly, "home-only", false, "only restore the clash home, not the files outside it")
+	restoreCmd.Flags().BoolVar(&restoreOpts.force, "force", false, "restore even if tpclash seems to be running")
+}
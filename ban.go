@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DashboardBan is a client banned from the dashboard proxy after repeated
+// authentication failures.
+type DashboardBan struct {
+	IP    string    `json:"ip"`
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+}
+
+// authFailures tracks the failed logins per client ip like fail2ban: a client
+// failing --dashboard-ban-attempts times within --dashboard-ban-window is
+// rejected for --dashboard-ban-time.
+var authFailures = struct {
+	sync.Mutex
+	clients map[string]*authClient
+}{clients: map[string]*authClient{}}
+
+type authClient struct {
+	failures     []time.Time
+	since, until time.Time
+}
+
+// dashboardBanlist rejects the banned clients before anything else, including
+// the oidc endpoints.
+func dashboardBanlist(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if until, ok := bannedUntil(remoteIP(r)); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+			http.Error(w, "too many authentication failures", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func bannedUntil(ip string) (time.Time, bool) {
+	authFailures.Lock()
+	defer authFailures.Unlock()
+
+	c := authFailures.clients[ip]
+	if c == nil || !time.Now().Before(c.until) {
+		return time.Time{}, false
+	}
+	return c.until, true
+}
+
+// recordAuthFailure counts a failed login of ip and bans it once the limit
+// is reached.
+func recordAuthFailure(ip string) {
+	if conf.DashboardBanAttempts <= 0 {
+		return
+	}
+
+	authFailures.Lock()
+	defer authFailures.Unlock()
+
+	now := time.Now()
+	expired := pruneAuthFailures(now)
+
+	c := authFailures.clients[ip]
+	if c == nil {
+		c = &authClient{}
+		authFailures.clients[ip] = c
+	}
+	c.failures = append(c.failures, now)
+	if len(c.failures) < conf.DashboardBanAttempts {
+		if expired {
+			saveBans(now)
+		}
+		return
+	}
+
+	c.since, c.until = now, now.Add(conf.DashboardBanTime)
+	logrus.Warnf("[dashboard] %s banned until %s after %d authentication failures", ip, c.until.Format(time.DateTime), len(c.failures))
+	// failures during the ban are not counted, the client starts over after it
+	c.failures = nil
+	saveBans(now)
+}
+
+// pruneAuthFailures forgets the failures out of the window and the expired
+// bans, it reports whether a ban has expired.
+func pruneAuthFailures(now time.Time) bool {
+	var expired bool
+	for ip, c := range authFailures.clients {
+		c.failures = slices.DeleteFunc(c.failures, func(t time.Time) bool { return now.Sub(t) > conf.DashboardBanWindow })
+		if !c.until.IsZero() && !now.Before(c.until) {
+			c.since, c.until, expired = time.Time{}, time.Time{}, true
+		}
+		if len(c.failures) == 0 && c.until.IsZero() {
+			delete(authFailures.clients, ip)
+		}
+	}
+	return expired
+}
+
+// saveBans publishes the active bans in the runtime state for `tpclash status`.
+func saveBans(now time.Time) {
+	var bans []DashboardBan
+	for _, ip := range sortedKeys(authFailures.clients) {
+		if c := authFailures.clients[ip]; now.Before(c.until) {
+			bans = append(bans, DashboardBan{IP: ip, Since: c.since, Until: c.until})
+		}
+	}
+	UpdateState(func(s *RuntimeState) { s.DashboardBans = bans })
+}
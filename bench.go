@@ -0,0 +1,552 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// the bench protocol, every message starts with benchMagic and an op
+const (
+	benchMagic      = "TPCB"
+	benchOpDownload = 'D'
+	benchOpUpload   = 'U'
+	benchOpData     = 'P'
+	benchOpStat     = 'S'
+	benchOpReply    = 'R'
+
+	benchDefaultPort = "5201"
+	benchMaxDuration = 5 * time.Minute
+	benchTCPBuffer   = 128 << 10
+	// benchUDPPayload keeps the datagrams below the mtu of most tunnels
+	benchUDPPayload = 1200
+	// magic, op, session and seq(or the padding of a stat request)
+	benchUDPHeader = len(benchMagic) + 1 + 8 + 8
+	// the reply has the packets and bytes, the stat request is padded to its
+	// size so the server never answers with more than it received
+	benchUDPReply = len(benchMagic) + 1 + 8 + 8 + 8
+	// benchGrace is how long the upload server keeps reading after the
+	// duration for the data still in flight
+	benchGrace        = time.Second
+	benchReplyTimeout = 5 * time.Second
+	benchSessionTTL   = time.Minute
+)
+
+// the paths a test runs through
+const (
+	BenchDirect      = "direct"
+	BenchIntercepted = "intercepted"
+)
+
+var benchOpts struct {
+	server   string
+	duration time.Duration
+	udp      bool
+	udpMbps  int
+}
+
+// BenchResult is the result of a throughput test of the bench command.
+type BenchResult struct {
+	Test            string   `json:"test"`
+	Path            string   `json:"path"`
+	Bytes           uint64   `json:"bytes"`
+	DurationMS      int64    `json:"duration_ms"`
+	BitsPerSecond   float64  `json:"bits_per_second"`
+	PacketsSent     int      `json:"packets_sent,omitempty"`
+	PacketsLost     int      `json:"packets_lost,omitempty"`
+	Chain           []string `json:"chain,omitempty"`
+	OverheadPercent float64  `json:"overhead_percent,omitempty"`
+	Error           string   `json:"error,omitempty"`
+}
+
+var benchCmd = &cobra.Command{
+	Use:   "bench [HOST[:PORT]]",
+	Short: "Measure the TCP/UDP throughput through the interception path and direct",
+	Long: `Measure the TCP/UDP throughput through the interception path and direct.
+
+Run the bench server on a host outside of the proxied network:
+
+  tpclash bench --server :5201
+
+then run the tests against it on the host running tpclash:
+
+  tpclash bench HOST:5201 --udp
+
+Each test runs twice, intercepted by the transparent proxy and direct with the
+routing-mark of the running config(or bound to the default route interface
+without it) like the outbound connections of the core, the difference is the
+overhead of the interception and the core on this hardware. Note that the
+intercepted traffic goes through the proxy the rules choose for the server.
+
+The bench server is not authenticated, only run it while benchmarking.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if benchOpts.server != "" {
+			if err := ServeBench(benchOpts.server); err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			logrus.Fatal("[bench] the address of a bench server is required")
+		}
+		if benchOpts.duration <= 0 || benchOpts.duration > benchMaxDuration {
+			logrus.Fatalf("[bench] invalid duration %s, must be positive and at most %s", benchOpts.duration, benchMaxDuration)
+		}
+		if benchOpts.udpMbps < 1 {
+			logrus.Fatal("[bench] --udp-mbps must be greater than 0")
+		}
+		addr := args[0]
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, benchDefaultPort)
+		}
+
+		cc, err := RunningConf()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		api := NewClashAPI(cc)
+		direct, err := benchDirectControl(cc)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		tests := []string{"tcp download", "tcp upload"}
+		if benchOpts.udp {
+			tests = append(tests, "udp upload")
+		}
+		var results []BenchResult
+		var failed bool
+		for _, test := range tests {
+			d := runBench(test, BenchDirect, addr, direct, nil)
+			logrus.Infof("[bench] %s %s: %s", test, BenchDirect, benchSummary(d))
+			i := runBench(test, BenchIntercepted, addr, nil, api)
+			logrus.Infof("[bench] %s %s: %s", test, BenchIntercepted, benchSummary(i))
+			if d.Error == "" && i.Error == "" && d.BitsPerSecond > 0 {
+				i.OverheadPercent = 100 * (1 - i.BitsPerSecond/d.BitsPerSecond)
+			}
+			failed = failed || d.Error != "" || i.Error != ""
+			results = append(results, d, i)
+		}
+
+		if jsonOutput() {
+			printJSON(results)
+		} else {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			_, _ = fmt.Fprintln(w, "TEST\tPATH\tTHROUGHPUT\tTRANSFER\tLOSS\tOVERHEAD\tCHAIN")
+			for _, r := range results {
+				throughput, transfer, loss, overhead := "-", "-", "-", "-"
+				if r.Error != "" {
+					throughput = "failed: " + r.Error
+				} else {
+					throughput, transfer = formatBitrate(r.BitsPerSecond), humanBytes(r.Bytes)
+				}
+				if r.PacketsSent > 0 {
+					loss = fmt.Sprintf("%.2f%%", 100*float64(r.PacketsLost)/float64(r.PacketsSent))
+				}
+				if r.Path == BenchIntercepted && r.OverheadPercent != 0 {
+					overhead = fmt.Sprintf("%.1f%%", r.OverheadPercent)
+				}
+				_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Test, r.Path, throughput, transfer, loss, overhead, strings.Join(r.Chain, " -> "))
+			}
+			_ = w.Flush()
+		}
+		if failed {
+			logrus.Fatal("[bench] some tests failed")
+		}
+	},
+}
+
+// benchDirectControl returns the socket option making a connection bypass the
+// interception, the same way the outbound connections of the core do.
+func benchDirectControl(cc *ClashConf) (func(network, address string, c syscall.RawConn) error, error) {
+	if cc.RoutingMark != 0 {
+		mark := cc.RoutingMark
+		logrus.Infof("[bench] the direct tests use the routing-mark %d", mark)
+		return func(_, _ string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		}, nil
+	}
+
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("[bench] failed to list routes: %w", err)
+	}
+	for _, r := range routes {
+		if r.Dst != nil || r.LinkIndex == 0 {
+			continue
+		}
+		link, err := netlink.LinkByIndex(r.LinkIndex)
+		if err != nil {
+			return nil, fmt.Errorf("[bench] failed to get the default route interface: %w", err)
+		}
+		name := link.Attrs().Name
+		logrus.Infof("[bench] the direct tests are bound to the default route interface %s", name)
+		return func(_, _ string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.BindToDevice(int(fd), name)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		}, nil
+	}
+	return nil, errors.New("[bench] no routing-mark in the running config and no default route to bind the direct tests to")
+}
+
+// runBench runs a test, the intercepted connection is looked up in the
+// connections api to make sure the core handled it.
+func runBench(test, path, addr string, control func(network, address string, c syscall.RawConn) error, api *ClashAPI) BenchResult {
+	r := BenchResult{Test: test, Path: path}
+	network, op, _ := strings.Cut(test, " ")
+	dialer := &net.Dialer{Timeout: benchReplyTimeout, Control: control}
+	conn, err := dialer.Dial(network, addr)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	defer func() { _ = conn.Close() }()
+
+	lookup := func() error {
+		if api == nil {
+			return nil
+		}
+		c, err := waitSmokeConn(api, network, conn.LocalAddr())
+		r.Chain = c.Route()
+		return err
+	}
+
+	var elapsed time.Duration
+	switch {
+	case network == "udp":
+		elapsed, err = benchUDP(conn, &r, lookup)
+	case op == "download":
+		elapsed, err = benchTCPDownload(conn, &r, lookup)
+	default:
+		elapsed, err = benchTCPUpload(conn, &r, lookup)
+	}
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.DurationMS = elapsed.Milliseconds()
+	if elapsed > 0 {
+		r.BitsPerSecond = float64(r.Bytes) * 8 / elapsed.Seconds()
+	}
+	return r
+}
+
+// benchHeader is the request of a tcp test.
+func benchHeader(op byte) []byte {
+	h := append([]byte(benchMagic), op)
+	return binary.BigEndian.AppendUint64(h, uint64(benchOpts.duration))
+}
+
+// benchTCPDownload measures the data the server sends for the duration, from
+// the first byte until the server closes the connection.
+func benchTCPDownload(conn net.Conn, r *BenchResult, lookup func() error) (time.Duration, error) {
+	if _, err := conn.Write(benchHeader(benchOpDownload)); err != nil {
+		return 0, err
+	}
+	if err := lookup(); err != nil {
+		return 0, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(benchOpts.duration + benchReplyTimeout))
+
+	buf := make([]byte, benchTCPBuffer)
+	var start time.Time
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 && start.IsZero() {
+			start = time.Now()
+		}
+		r.Bytes += uint64(n)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if start.IsZero() {
+		return 0, errors.New("no data received")
+	}
+	return time.Since(start), nil
+}
+
+// benchTCPUpload sends data for the duration, the server replies with the
+// bytes it received.
+func benchTCPUpload(conn net.Conn, r *BenchResult, lookup func() error) (time.Duration, error) {
+	if _, err := conn.Write(benchHeader(benchOpUpload)); err != nil {
+		return 0, err
+	}
+	if err := lookup(); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, benchTCPBuffer)
+	_ = conn.SetWriteDeadline(time.Now().Add(benchOpts.duration))
+	for {
+		if _, err := conn.Write(buf); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			return 0, err
+		}
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(benchGrace + benchReplyTimeout))
+	var reply [8]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return 0, fmt.Errorf("no reply from the server: %w", err)
+	}
+	r.Bytes = binary.BigEndian.Uint64(reply[:])
+	return benchOpts.duration, nil
+}
+
+// benchUDP sends datagrams at --udp-mbps for the duration, the server replies
+// to a stat request with the packets and bytes it received.
+func benchUDP(conn net.Conn, r *BenchResult, lookup func() error) (time.Duration, error) {
+	var session [8]byte
+	if _, err := rand.Read(session[:]); err != nil {
+		return 0, err
+	}
+	pkt := make([]byte, benchUDPPayload)
+	copy(pkt, benchMagic)
+	pkt[len(benchMagic)] = benchOpData
+	copy(pkt[len(benchMagic)+1:], session[:])
+	seq := pkt[len(benchMagic)+9 : benchUDPHeader]
+
+	send := func() error {
+		binary.BigEndian.PutUint64(seq, uint64(r.PacketsSent))
+		r.PacketsSent++
+		_, err := conn.Write(pkt)
+		if errors.Is(err, unix.ENOBUFS) {
+			// dropped by the local queue, that is a lost packet as well
+			return nil
+		}
+		return err
+	}
+	if err := send(); err != nil {
+		return 0, err
+	}
+	if err := lookup(); err != nil {
+		return 0, err
+	}
+
+	perSecond := float64(benchOpts.udpMbps) * 1e6 / 8 / float64(benchUDPPayload)
+	start := time.Now()
+	for elapsed := time.Duration(0); elapsed < benchOpts.duration; elapsed = time.Since(start) {
+		for allowed := int(elapsed.Seconds() * perSecond); r.PacketsSent < allowed; {
+			if err := send(); err != nil {
+				return 0, err
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	elapsed := time.Since(start)
+
+	stat := make([]byte, benchUDPReply)
+	copy(stat, benchMagic)
+	stat[len(benchMagic)] = benchOpStat
+	copy(stat[len(benchMagic)+1:], session[:])
+	reply := make([]byte, benchUDPReply)
+	for i := 0; i < 5; i++ {
+		if _, err := conn.Write(stat); err != nil {
+			return 0, err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(reply)
+		if err != nil {
+			continue
+		}
+		if n != benchUDPReply || string(reply[:len(benchMagic)]) != benchMagic || reply[len(benchMagic)] != benchOpReply ||
+			string(reply[len(benchMagic)+1:len(benchMagic)+9]) != string(session[:]) {
+			continue
+		}
+		packets := int(binary.BigEndian.Uint64(reply[len(benchMagic)+9:]))
+		r.Bytes = binary.BigEndian.Uint64(reply[len(benchMagic)+17:])
+		r.PacketsLost = max(r.PacketsSent-packets, 0)
+		return elapsed, nil
+	}
+	return 0, errors.New("no stat reply from the server")
+}
+
+// ServeBench runs the bench server on the tcp and udp address until it fails.
+func ServeBench(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("[bench] failed to listen: %w", err)
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		_ = ln.Close()
+		return fmt.Errorf("[bench] failed to listen: %w", err)
+	}
+	logrus.Infof("[bench] bench server listening on %s(tcp and udp)...", ln.Addr())
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- serveBenchUDP(pc) }()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			go serveBenchTCP(conn)
+		}
+	}()
+	err = <-errCh
+	_ = ln.Close()
+	_ = pc.Close()
+	return fmt.Errorf("[bench] bench server stopped: %w", err)
+}
+
+func serveBenchTCP(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetReadDeadline(time.Now().Add(benchReplyTimeout))
+	header := make([]byte, len(benchMagic)+1+8)
+	if _, err := io.ReadFull(conn, header); err != nil || string(header[:len(benchMagic)]) != benchMagic {
+		return
+	}
+	op := header[len(benchMagic)]
+	d := min(time.Duration(binary.BigEndian.Uint64(header[len(benchMagic)+1:])), benchMaxDuration)
+	name := "download"
+	if op == benchOpUpload {
+		name = "upload"
+	}
+	logrus.Infof("[bench] %s: tcp %s test for %s", conn.RemoteAddr(), name, d)
+
+	buf := make([]byte, benchTCPBuffer)
+	switch op {
+	case benchOpDownload:
+		_ = conn.SetWriteDeadline(time.Now().Add(d))
+		for {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	case benchOpUpload:
+		_ = conn.SetReadDeadline(time.Now().Add(d + benchGrace))
+		var total uint64
+		for {
+			n, err := conn.Read(buf)
+			total += uint64(n)
+			if err != nil {
+				break
+			}
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(benchReplyTimeout))
+		if _, err := conn.Write(binary.BigEndian.AppendUint64(nil, total)); err != nil {
+			return
+		}
+		// the data still in flight is drained, closing with unread data would
+		// reset the connection before the reply is read
+		_ = conn.SetReadDeadline(time.Now().Add(benchReplyTimeout))
+		_, _ = io.Copy(io.Discard, conn)
+	}
+}
+
+type benchSession struct {
+	packets, bytes uint64
+	seen           time.Time
+}
+
+func serveBenchUDP(pc net.PacketConn) error {
+	var mu sync.Mutex
+	sessions := make(map[string]*benchSession)
+	buf := make([]byte, 64<<10)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if n < benchUDPHeader || string(buf[:len(benchMagic)]) != benchMagic {
+			continue
+		}
+		id := string(buf[len(benchMagic)+1 : len(benchMagic)+9])
+
+		mu.Lock()
+		switch buf[len(benchMagic)] {
+		case benchOpData:
+			s, ok := sessions[id]
+			if !ok {
+				s = &benchSession{}
+				sessions[id] = s
+				logrus.Infof("[bench] %s: udp test", addr)
+			}
+			s.packets++
+			s.bytes += uint64(n)
+			s.seen = time.Now()
+		case benchOpStat:
+			s, ok := sessions[id]
+			if !ok || n < benchUDPReply {
+				break
+			}
+			reply := append([]byte(benchMagic), benchOpReply)
+			reply = append(reply, id...)
+			reply = binary.BigEndian.AppendUint64(reply, s.packets)
+			reply = binary.BigEndian.AppendUint64(reply, s.bytes)
+			_, _ = pc.WriteTo(reply, addr)
+			for k, s := range sessions {
+				if time.Since(s.seen) > benchSessionTTL {
+					delete(sessions, k)
+				}
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+// benchSummary formats a result for the log.
+func benchSummary(r BenchResult) string {
+	if r.Error != "" {
+		return "failed: " + r.Error
+	}
+	s := formatBitrate(r.BitsPerSecond)
+	if r.PacketsSent > 0 {
+		s += fmt.Sprintf(", %d/%d packets lost", r.PacketsLost, r.PacketsSent)
+	}
+	return s
+}
+
+// formatBitrate formats bits per second with a decimal unit like iperf3.
+func formatBitrate(bps float64) string {
+	units := []string{"bit/s", "Kbit/s", "Mbit/s", "Gbit/s"}
+	i := 0
+	for bps >= 1000 && i < len(units)-1 {
+		bps /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", bps, units[i])
+}
+
+func init() {
+	benchCmd.Flags().StringVar(&benchOpts.server, "server", "", "run the bench server on the address(e.g. :5201) instead of the tests")
+	benchCmd.Flags().DurationVarP(&benchOpts.duration, "duration", "t", 10*time.Second, "duration of each test")
+	benchCmd.Flags().BoolVar(&benchOpts.udp, "udp", false, "also run the udp test")
+	benchCmd.Flags().IntVar(&benchOpts.udpMbps, "udp-mbps", 100, "sending rate of the udp test in Mbit/s")
+}
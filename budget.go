@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// bypassOwnerBudget registers the clients over budget as bypass sources,
+// their traffic goes direct until the next month.
+const bypassOwnerBudget = "budget"
+
+// budgetLevel is the highest threshold a budget has crossed this month.
+type budgetLevel int
+
+const (
+	budgetOK budgetLevel = iota
+	budgetWarned
+	budgetExceeded
+)
+
+var budgetState = struct {
+	month      string
+	levels     map[string]budgetLevel
+	directFrom string
+	bypass     map[string]bool
+	// restored is set once the saved state is loaded at the first check
+	restored bool
+}{levels: map[string]budgetLevel{}, bypass: map[string]bool{}}
+
+// budgetRecord is the budget state saved in the clash home, the direct mode
+// and the bypassed clients survive the restarts until the next month.
+type budgetRecord struct {
+	Month      string                 `json:"month"`
+	Levels     map[string]budgetLevel `json:"levels,omitempty"`
+	DirectFrom string                 `json:"direct_from,omitempty"`
+	Bypass     []string               `json:"bypass,omitempty"`
+}
+
+// CheckBudgetConf validates the --budget-* flags.
+func CheckBudgetConf() error {
+	if conf.BudgetMonthly == "" && len(conf.BudgetClients) == 0 {
+		return nil
+	}
+	if conf.ClientStatsInterval <= 0 {
+		return fmt.Errorf("[budget] traffic budgets require --client-stats-interval")
+	}
+	if _, err := parseBytes(conf.BudgetMonthly); err != nil && conf.BudgetMonthly != "" {
+		return fmt.Errorf("[budget] invalid --budget-monthly: %w", err)
+	}
+	for ip, b := range conf.BudgetClients {
+		if _, err := netip.ParseAddr(ip); err != nil {
+			return fmt.Errorf("[budget] invalid client ip %s: %w", ip, err)
+		}
+		if _, err := parseBytes(b); err != nil {
+			return fmt.Errorf("[budget] invalid budget of %s: %w", ip, err)
+		}
+	}
+	return nil
+}
+
+// checkBudgets compares the monthly traffic accounted by the client stats
+// with the budgets, it is called after every client sample.
+func checkBudgets() {
+	if conf.BudgetMonthly == "" && len(conf.BudgetClients) == 0 {
+		return
+	}
+
+	if !budgetState.restored {
+		restoreBudgets()
+	}
+	month := time.Now().Format("2006-01")
+	if budgetState.month != month {
+		resetBudgets(month)
+	}
+
+	usages := monthlyUsages(month)
+	var total uint64
+	for _, u := range usages {
+		total += u
+	}
+
+	if limit, _ := parseBytes(conf.BudgetMonthly); limit > 0 {
+		if checkBudget("global", "monthly traffic", total, limit) == budgetExceeded && conf.BudgetDirect && budgetState.directFrom == "" {
+			switchDirect()
+		}
+	}
+	for ip, b := range conf.BudgetClients {
+		limit, _ := parseBytes(b)
+		if limit == 0 {
+			continue
+		}
+		if checkBudget(ip, "monthly traffic of "+clientLabel(ip), usages[ip], limit) == budgetExceeded && conf.BudgetDirect && !budgetState.bypass[ip] {
+			budgetState.bypass[ip] = true
+			applyBudgetBypass()
+			saveBudgets()
+		}
+	}
+}
+
+// checkBudget notifies once per month for each crossed threshold.
+func checkBudget(key, name string, used, limit uint64) budgetLevel {
+	level := budgetOK
+	percent := float64(used) * 100 / float64(limit)
+	switch {
+	case used >= limit:
+		level = budgetExceeded
+	case percent >= conf.BudgetWarnPercent:
+		level = budgetWarned
+	}
+	if level <= budgetState.levels[key] {
+		return level
+	}
+	budgetState.levels[key] = level
+	saveBudgets()
+
+	msg := fmt.Sprintf("%s used %.1f%%(%s of %s)", name, percent, humanBytes(used), humanBytes(limit))
+	if level == budgetExceeded {
+		logrus.Warnf("[budget] %s, budget exceeded", msg)
+		Notify(EventBudgetExceeded, "%s", msg)
+	} else {
+		logrus.Warnf("[budget] %s", msg)
+		Notify(EventBudgetWarning, "%s", msg)
+	}
+	return level
+}
+
+// resetBudgets starts a new month, the direct mode and the bypassed clients
+// switched by the budgets are restored.
+func resetBudgets(month string) {
+	if budgetState.month != "" {
+		logrus.Infof("[budget] new budget period %s started", month)
+	}
+	budgetState.month = month
+	budgetState.levels = map[string]budgetLevel{}
+
+	if budgetState.directFrom != "" {
+		err := patchMode(budgetState.directFrom)
+		Audit(AuditSourceSchedule, "budget", "mode.switch", budgetState.directFrom, err)
+		if err != nil {
+			logrus.Errorf("[budget] failed to restore %s mode: %v", budgetState.directFrom, err)
+		} else {
+			logrus.Infof("[budget] %s mode restored", budgetState.directFrom)
+		}
+		budgetState.directFrom = ""
+	}
+	if len(budgetState.bypass) > 0 {
+		budgetState.bypass = map[string]bool{}
+		applyBudgetBypass()
+	}
+	saveBudgets()
+}
+
+// restoreBudgets loads the budget state saved before the restart, the direct
+// mode and the bypassed clients of this month are applied again. The state
+// of a past month is restored by resetBudgets.
+func restoreBudgets() {
+	budgetState.restored = true
+	bs, err := os.ReadFile(filepath.Join(conf.ClashHome, budgetStateFileName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Warnf("[budget] failed to read the budget state: %v", err)
+		}
+		return
+	}
+	var r budgetRecord
+	if err = json.Unmarshal(bs, &r); err != nil {
+		logrus.Warnf("[budget] invalid budget state, ignored: %v", err)
+		return
+	}
+
+	budgetState.month, budgetState.directFrom = r.Month, r.DirectFrom
+	if r.Levels != nil {
+		budgetState.levels = r.Levels
+	}
+	for _, ip := range r.Bypass {
+		budgetState.bypass[ip] = true
+	}
+	if r.Month != time.Now().Format("2006-01") {
+		return
+	}
+	if budgetState.directFrom != "" {
+		if err = patchMode("direct"); err != nil {
+			logrus.Errorf("[budget] failed to switch to direct mode again: %v", err)
+		} else {
+			logrus.Warnf("[budget] the monthly budget is exceeded, direct mode until the next month(%s mode is restored then)", budgetState.directFrom)
+		}
+	}
+	if len(budgetState.bypass) > 0 {
+		applyBudgetBypass()
+	}
+}
+
+func saveBudgets() {
+	r := budgetRecord{Month: budgetState.month, Levels: budgetState.levels, DirectFrom: budgetState.directFrom, Bypass: sortedKeys(budgetState.bypass)}
+	bs, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return
+	}
+	statePath := filepath.Join(conf.ClashHome, budgetStateFileName)
+	if err = os.WriteFile(statePath+".tmp", bs, 0644); err == nil {
+		err = os.Rename(statePath+".tmp", statePath)
+	}
+	if err != nil {
+		logrus.Warnf("[budget] failed to save the budget state: %v", err)
+	}
+}
+
+func switchDirect() {
+	api, err := RunningAPI()
+	if err != nil {
+		logrus.Errorf("[budget] failed to switch to direct mode: %v", err)
+		return
+	}
+	var configs struct {
+		Mode string `json:"mode"`
+	}
+	if err = api.Do("GET", "/configs", nil, &configs); err != nil {
+		logrus.Errorf("[budget] failed to get mode: %v", err)
+		return
+	}
+	err = patchMode("direct")
+	Audit(AuditSourceSchedule, "budget", "mode.switch", "direct", err)
+	if err != nil {
+		logrus.Errorf("[budget] failed to switch to direct mode: %v", err)
+		return
+	}
+	budgetState.directFrom = strings.ToLower(configs.Mode)
+	saveBudgets()
+	logrus.Warn("[budget] switched to direct mode until the next month")
+}
+
+func applyBudgetBypass() {
+	var prefixes []netip.Prefix
+	for _, ip := range sortedKeys(budgetState.bypass) {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			continue
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	if err := SetBypassSources(bypassOwnerBudget, prefixes); err != nil {
+		logrus.Errorf("[budget] failed to update bypassed clients: %v", err)
+		return
+	}
+	logrus.Infof("[budget] clients over budget go direct: %v", prefixes)
+}
+
+// monthlyUsages returns the traffic of the clients in the month(2006-01).
+func monthlyUsages(month string) map[string]uint64 {
+	clientStats.Lock()
+	defer clientStats.Unlock()
+
+	usages := map[string]uint64{}
+	for ip, u := range clientStats.clients {
+		for day, t := range u.Days {
+			if strings.HasPrefix(day, month) {
+				usages[ip] += t.Upload + t.Download
+			}
+		}
+	}
+	return usages
+}
+
+// parseBytes parses a size like 500GB or 1.5TiB, all units are powers of 1024.
+func parseBytes(s string) (uint64, error) {
+	num := strings.TrimSuffix(strings.TrimSpace(strings.ToUpper(s)), "B")
+	num = strings.TrimSuffix(num, "I")
+
+	var exp int
+	if i := strings.IndexAny(num, "KMGTP"); i >= 0 && i == len(num)-1 {
+		exp = strings.IndexByte("KMGTP", num[i]) + 1
+		num = num[:i]
+	}
+
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	for i := 0; i < exp; i++ {
+		n *= 1024
+	}
+	return uint64(n), nil
+}
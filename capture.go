@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// captureExt is the extension of the capture metadata, the raw body is
+// stored beside it with captureBodyExt.
+const (
+	captureExt     = ".json"
+	captureBodyExt = ".body"
+)
+
+// ConfigCapture is a remote config fetch recorded by --config-record.
+type ConfigCapture struct {
+	Time   time.Time   `json:"time"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Size   int         `json:"size"`
+	SHA256 string      `json:"sha256"`
+}
+
+var configCapture struct {
+	sync.Mutex
+	seq int
+
+	// the metadata files replayed by --config-replay in order
+	replay []string
+	next   int
+}
+
+// CheckCaptureConf validates the record and replay flags and loads the
+// captures of --config-replay.
+func CheckCaptureConf() error {
+	if conf.ConfigRecord != "" && conf.ConfigReplay != "" {
+		return fmt.Errorf("[capture] --config-record and --config-replay can not be used together")
+	}
+	if conf.ConfigRecord != "" {
+		if conf.ConfigRecordMax < 1 {
+			return fmt.Errorf("[capture] invalid --config-record-max %d, must be greater than 0", conf.ConfigRecordMax)
+		}
+		if !isRemoteConfig() {
+			return fmt.Errorf("[capture] --config-record requires a remote --config")
+		}
+		if err := os.MkdirAll(conf.ConfigRecord, 0700); err != nil {
+			return fmt.Errorf("[capture] failed to create the capture dir: %w", err)
+		}
+		logrus.Warnf("[capture] recording the remote config fetches to %s, the captures contain the raw configs", conf.ConfigRecord)
+	}
+	if conf.ConfigReplay == "" {
+		return nil
+	}
+
+	captures, err := listCaptures(conf.ConfigReplay)
+	if err != nil {
+		return err
+	}
+	if len(captures) == 0 {
+		return fmt.Errorf("[capture] no captures found in %s", conf.ConfigReplay)
+	}
+	configCapture.replay = captures
+	logrus.Warnf("[capture] replaying %d captures from %s instead of fetching the remote config", len(captures), conf.ConfigReplay)
+	return nil
+}
+
+// listCaptures returns the metadata files of a capture dir in the recorded
+// order, or the file itself.
+func listCaptures(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("[capture] failed to read the captures: %w", err)
+	}
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
+	captures, err := filepath.Glob(filepath.Join(path, "*"+captureExt))
+	if err != nil {
+		return nil, err
+	}
+	// the names start with the time of the fetch
+	sort.Strings(captures)
+	return captures, nil
+}
+
+// recordConfigFetch writes the response of a fetch to --config-record before
+// it is decrypted or checked, the oldest captures over --config-record-max are
+// removed.
+func recordConfigFetch(url string, resp *http.Response, body []byte) {
+	if conf.ConfigRecord == "" {
+		return
+	}
+	configCapture.Lock()
+	defer configCapture.Unlock()
+
+	now := time.Now()
+	configCapture.seq++
+	name := fmt.Sprintf("%s-%04d", now.UTC().Format("20060102T150405.000Z"), configCapture.seq%10000)
+	sum := sha256.Sum256(body)
+	c := ConfigCapture{
+		Time:   now,
+		URL:    redactURL(url),
+		Status: resp.StatusCode,
+		Header: resp.Header,
+		Size:   len(body),
+		SHA256: hex.EncodeToString(sum[:]),
+	}
+	bs, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		logrus.Errorf("[capture] failed to encode the capture: %v", err)
+		return
+	}
+
+	// the metadata is written last, a capture without it is incomplete
+	base := filepath.Join(conf.ConfigRecord, name)
+	if err = os.WriteFile(base+captureBodyExt, body, 0600); err != nil {
+		logrus.Errorf("[capture] failed to write the capture: %v", err)
+		return
+	}
+	if err = os.WriteFile(base+captureExt, bs, 0600); err != nil {
+		logrus.Errorf("[capture] failed to write the capture: %v", err)
+		return
+	}
+	logrus.Debugf("[capture] recorded %s(status %d, %s)", name, c.Status, humanBytes(uint64(c.Size)))
+
+	captures, err := listCaptures(conf.ConfigRecord)
+	if err != nil {
+		logrus.Errorf("[capture] failed to list the captures: %v", err)
+		return
+	}
+	for len(captures) > conf.ConfigRecordMax {
+		old := strings.TrimSuffix(captures[0], captureExt)
+		_ = os.Remove(old + captureExt)
+		_ = os.Remove(old + captureBodyExt)
+		captures = captures[1:]
+	}
+}
+
+// replayRemoteConfig feeds the next capture of --config-replay through the
+// checks of a fetched config, the last capture is repeated once all of them
+// are replayed.
+func replayRemoteConfig() (*remoteConfig, error) {
+	configCapture.Lock()
+	n := len(configCapture.replay)
+	path := configCapture.replay[min(configCapture.next, n-1)]
+	if configCapture.next < n {
+		configCapture.next++
+		if configCapture.next == n {
+			defer logrus.Infof("[capture] all the %d captures are replayed, the last one is repeated", n)
+		}
+	}
+	configCapture.Unlock()
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("[capture] failed to read the capture: %w", err)
+	}
+	var c ConfigCapture
+	if err = json.Unmarshal(bs, &c); err != nil {
+		return nil, fmt.Errorf("[capture] invalid capture %s: %w", path, err)
+	}
+	body, err := os.ReadFile(strings.TrimSuffix(path, captureExt) + captureBodyExt)
+	if err != nil {
+		return nil, fmt.Errorf("[capture] failed to read the capture body: %w", err)
+	}
+	logrus.Infof("[capture] replaying %s(recorded at %s, status %d)", filepath.Base(path), c.Time.Format(time.RFC3339), c.Status)
+
+	if !(c.Status >= 200 && c.Status <= 299) {
+		return nil, fmt.Errorf("[config] failed to get remote config %s: status code %d", c.URL, c.Status)
+	}
+	return decodeRemoteConfig(c.URL, body, c.Header)
+}
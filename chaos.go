@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// chaosRecoverTimeout is how long a fault may take to recover, longer than
+	// the largest core restart backoff and the rules check interval
+	chaosRecoverTimeout = rulesCheckInterval + 30*time.Second
+	chaosPollInterval   = time.Second
+)
+
+var errChaosSkipped = errors.New("not applicable")
+
+var chaosState struct {
+	sync.Mutex
+	configDropped bool
+	injected      int
+	failed        []string
+}
+
+// chaosFault injects a fault and waits until tpclash recovered from it.
+type chaosFault struct {
+	name   string
+	inject func(ctx context.Context, proc *CoreProcess) error
+}
+
+var chaosFaults = []chaosFault{
+	{"kill core", chaosKillCore},
+	{"drop config source", chaosDropConfig},
+	{"flush rule", chaosFlushRule},
+}
+
+// CheckChaosConf validates the chaos mode flags, the faults are only injected
+// in test mode.
+func CheckChaosConf() error {
+	if !conf.Chaos {
+		return nil
+	}
+	if !conf.Test {
+		return fmt.Errorf("[chaos] --chaos requires --test")
+	}
+	if conf.ChaosInterval <= 0 {
+		return fmt.Errorf("[chaos] invalid --chaos-interval %s, must be positive", conf.ChaosInterval)
+	}
+	if !conf.CoreRestart && !conf.ConfigCache && !conf.RulesCheck {
+		return fmt.Errorf("[chaos] --chaos requires at least one of --core-restart, --config-cache and --rules-check")
+	}
+	return nil
+}
+
+// RunChaos injects a random fault about every --chaos-interval until the test
+// ends, one at a time.
+func RunChaos(ctx context.Context, proc *CoreProcess) {
+	logrus.Warnf("[chaos] chaos mode enabled, a fault is injected about every %s...", conf.ChaosInterval)
+	for {
+		wait := conf.ChaosInterval/2 + time.Duration(rand.Int63n(int64(conf.ChaosInterval)))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		f := chaosFaults[rand.Intn(len(chaosFaults))]
+		start := time.Now()
+		err := f.inject(ctx, proc)
+		if errors.Is(err, errChaosSkipped) {
+			logrus.Infof("[chaos] skip %s: %v", f.name, err)
+			continue
+		}
+		if ctx.Err() != nil {
+			// the test ended before the fault recovered
+			return
+		}
+
+		chaosState.Lock()
+		chaosState.injected++
+		if err != nil {
+			chaosState.failed = append(chaosState.failed, f.name+": "+err.Error())
+			logrus.Errorf("[chaos] ❌ %s is not recovered: %v", f.name, err)
+		} else {
+			logrus.Infof("[chaos] ✅ recovered from %s in %s", f.name, time.Since(start).Round(time.Millisecond))
+		}
+		chaosState.Unlock()
+	}
+}
+
+// ChaosResult returns an error if an injected fault was not recovered.
+func ChaosResult() error {
+	if !conf.Chaos {
+		return nil
+	}
+	chaosState.Lock()
+	defer chaosState.Unlock()
+
+	logrus.Infof("[chaos] %d faults injected, %d not recovered", chaosState.injected, len(chaosState.failed))
+	if len(chaosState.failed) > 0 {
+		return fmt.Errorf("[chaos] %d of %d injected faults were not recovered: %s",
+			len(chaosState.failed), chaosState.injected, strings.Join(chaosState.failed, "; "))
+	}
+	return nil
+}
+
+// chaosConfigDropped reports whether the remote config fetches must fail.
+func chaosConfigDropped() bool {
+	chaosState.Lock()
+	defer chaosState.Unlock()
+	return chaosState.configDropped
+}
+
+func setChaosConfigDropped(dropped bool) {
+	chaosState.Lock()
+	defer chaosState.Unlock()
+	chaosState.configDropped = dropped
+}
+
+// chaosKillCore kills the core, the supervision must start it again.
+func chaosKillCore(ctx context.Context, proc *CoreProcess) error {
+	if !conf.CoreRestart {
+		return fmt.Errorf("%w: --core-restart is not set", errChaosSkipped)
+	}
+	p := proc.Process()
+	if p == nil || !proc.Running() {
+		return fmt.Errorf("%w: the core is not running", errChaosSkipped)
+	}
+	logrus.Warnf("[chaos] killing the core(pid %d)...", p.Pid)
+	if err := p.Kill(); err != nil {
+		return fmt.Errorf("failed to kill the core: %w", err)
+	}
+	return chaosWait(ctx, func() error {
+		if proc.Process() == p || !proc.Running() {
+			return errors.New("the core is not restarted")
+		}
+		return chaosCoreServing()
+	})
+}
+
+// chaosDropConfig fails the remote config fetches for a check interval, the
+// running core must keep serving and the cached config must be usable for a
+// restart.
+func chaosDropConfig(ctx context.Context, _ *CoreProcess) error {
+	if !isRemoteConfig() {
+		return fmt.Errorf("%w: the config is a local file", errChaosSkipped)
+	}
+	if !conf.ConfigCache {
+		return fmt.Errorf("%w: --config-cache is not set", errChaosSkipped)
+	}
+	d := conf.CheckInterval + chaosPollInterval
+	logrus.Warnf("[chaos] dropping the config source for %s...", d)
+	setChaosConfigDropped(true)
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+	setChaosConfigDropped(false)
+	logrus.Info("[chaos] the config source is back")
+
+	ccStr, err := loadCachedConfig()
+	if err != nil {
+		return err
+	}
+	if ccStr, err = core.Fix(ccStr); err == nil {
+		_, err = core.Check(ccStr)
+	}
+	if err != nil {
+		return fmt.Errorf("the cached config is invalid: %w", err)
+	}
+	return chaosWait(ctx, chaosCoreServing)
+}
+
+// chaosFlushRule flushes a chain of the tpclash table, the rules check must
+// restore it.
+func chaosFlushRule(ctx context.Context, _ *CoreProcess) error {
+	if !conf.RulesCheck {
+		return fmt.Errorf("%w: --rules-check is not set", errChaosSkipped)
+	}
+	ruleState.Lock()
+	var chains []string
+	for c := range expectedChains() {
+		chains = append(chains, c)
+	}
+	ruleState.Unlock()
+	if len(chains) == 0 {
+		return fmt.Errorf("%w: no tpclash rules are applied", errChaosSkipped)
+	}
+
+	chain := chains[rand.Intn(len(chains))]
+	nft, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed connect to nftables: %w", err)
+	}
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: TableTPClash}
+	nft.FlushChain(&nftables.Chain{Name: chain, Table: table})
+	if err = nft.Flush(); err != nil {
+		return fmt.Errorf("failed to flush chain %s: %w", chain, err)
+	}
+	logrus.Warnf("[chaos] flushed the tpclash chain %s", chain)
+
+	return chaosWait(ctx, func() error {
+		ruleState.Lock()
+		defer ruleState.Unlock()
+		intact, err := rulesIntact()
+		if err == nil && !intact {
+			err = errors.New("the rules are not restored")
+		}
+		return err
+	})
+}
+
+// chaosCoreServing reports an error if the api of the running core does not
+// answer.
+func chaosCoreServing() error {
+	api, err := RunningAPI()
+	if err != nil {
+		return err
+	}
+	return api.Do(http.MethodGet, "/version", nil, nil)
+}
+
+// chaosWait polls check until it succeeds, its last error is returned after
+// chaosRecoverTimeout.
+func chaosWait(ctx context.Context, check func() error) error {
+	deadline := time.Now().Add(chaosRecoverTimeout)
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not recovered in %s: %w", chaosRecoverTimeout, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(chaosPollInterval):
+		}
+	}
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// severities of the check diagnostics, only the errors fail the check
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// builtinOutbounds are the proxies every clash config has.
+var builtinOutbounds = []string{"DIRECT", "REJECT", "REJECT-DROP", "PASS", "COMPATIBLE"}
+
+var checkOpts struct {
+	offline bool
+}
+
+// ConfigDiagnostic is a finding of the check command, Line is 0 if it is not
+// about a line of the config.
+type ConfigDiagnostic struct {
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// coreLinter is implemented by the cores whose configs can be checked beyond
+// Check, e.g. the references between the proxies, groups and rules.
+type coreLinter interface {
+	Core
+	// Lint returns the diagnostics of the config, the provider urls are
+	// requested if online is set
+	Lint(c string, online bool) []ConfigDiagnostic
+}
+
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check the config of --config without running it",
+	Long: `Check the config of --config without running it.
+
+Besides the validation when tpclash starts, the clash configs are checked for
+the proxies and providers referenced by the groups and rules but not defined,
+loops between the groups, duplicate and unreachable rules, the dns, tun and
+tproxy settings the interception depends on and the provider urls that can
+not be fetched
+(skipped with --offline). The diagnostics are printed with the line numbers
+of the config, the check fails if there is an error.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+		if core, err = NewCore(); err != nil {
+			logrus.Fatal(err)
+		}
+		var raw string
+		if isRemoteConfig() {
+			raw, err = loadRemoteConfig(context.Background())
+		} else {
+			raw, err = loadLocalConfig(context.Background())
+		}
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		diags := checkConfig(raw)
+		if jsonOutput() {
+			printJSON(diags)
+		} else {
+			name := redactURL(conf.ClashConfig)
+			for _, d := range diags {
+				pos := name
+				if d.Line > 0 {
+					pos += fmt.Sprintf(":%d:%d", d.Line, d.Column)
+				}
+				fmt.Printf("%s: %s: %s\n", pos, d.Severity, d.Message)
+			}
+		}
+
+		var errs, warns int
+		for _, d := range diags {
+			if d.Severity == SeverityError {
+				errs++
+			} else {
+				warns++
+			}
+		}
+		if errs > 0 {
+			logrus.Fatalf("[check] %d errors, %d warnings", errs, warns)
+		}
+		logrus.Infof("[check] the config is ok, %d warnings", warns)
+	},
+}
+
+// configPathRe matches the config key at the end of the Check errors, e.g.
+// "(dns.listen)" or "(tun.auto-route/ebpf.redirect-to-tun)".
+var configPathRe = regexp.MustCompile(`\(([a-z0-9-]+(?:\.[a-z0-9-]+)*)(?:/[a-z0-9.-]+)*\)$`)
+
+// yamlLineRe matches the line of the yaml errors.
+var yamlLineRe = regexp.MustCompile(`line (\d+):`)
+
+// checkConfig runs the validation of the core on the fixed config, and the
+// lint of the core on the config as written(with the templates rendered) so
+// that the lines match the file.
+func checkConfig(raw string) []ConfigDiagnostic {
+	rendered := tplRendering(raw)
+	var root yaml.Node
+	parsed := decodeYAML(rendered, &root) == nil
+
+	var diags []ConfigDiagnostic
+	fixed, err := core.Fix(raw)
+	if err == nil {
+		_, err = core.Check(fixed)
+	}
+	if err != nil {
+		d := ConfigDiagnostic{Severity: SeverityError, Message: err.Error()}
+		if m := yamlLineRe.FindStringSubmatch(err.Error()); m != nil {
+			d.Line, _ = strconv.Atoi(m[1])
+		} else if m := configPathRe.FindStringSubmatch(err.Error()); m != nil && parsed {
+			if n := yamlKeyNode(&root, m[1]); n != nil {
+				d.Line, d.Column = n.Line, n.Column
+			}
+		}
+		diags = append(diags, d)
+	}
+	if l, ok := core.(coreLinter); ok && parsed {
+		diags = append(diags, l.Lint(rendered, !checkOpts.offline)...)
+	} else if !ok {
+		logrus.Infof("[check] the %s core only supports the basic validation", core.Name())
+	}
+
+	sort.SliceStable(diags, func(i, j int) bool { return diags[i].Line < diags[j].Line })
+	return diags
+}
+
+// yamlKeyNode returns the key node of the dotted path, nil if it is missing.
+func yamlKeyNode(n *yaml.Node, path string) *yaml.Node {
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	key, rest, nested := strings.Cut(path, ".")
+	k, v := yamlMapGet(n, key)
+	if k == nil || !nested {
+		return k
+	}
+	return yamlKeyNode(v, rest)
+}
+
+// yamlMapGet returns the key and the value node of a mapping.
+func yamlMapGet(n *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i], n.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// clashLint holds the state of a clash config lint.
+type clashLint struct {
+	diags []ConfigDiagnostic
+	// name -> node of the definition
+	proxies, groups, proxyProviders, ruleProviders map[string]*yaml.Node
+}
+
+func (l *clashLint) add(n *yaml.Node, severity, format string, args ...any) {
+	d := ConfigDiagnostic{Severity: severity, Message: fmt.Sprintf(format, args...)}
+	if n != nil {
+		d.Line, d.Column = n.Line, n.Column
+	}
+	l.diags = append(l.diags, d)
+}
+
+func (c *clashCore) Lint(s string, online bool) []ConfigDiagnostic {
+	var doc yaml.Node
+	if err := decodeYAML(s, &doc); err != nil || len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	l := &clashLint{
+		proxies:        map[string]*yaml.Node{},
+		groups:         map[string]*yaml.Node{},
+		proxyProviders: map[string]*yaml.Node{},
+		ruleProviders:  map[string]*yaml.Node{},
+	}
+
+	l.collectNames(root, "proxies", l.proxies)
+	l.collectNames(root, "proxy-groups", l.groups)
+	for name, node := range l.groups {
+		if _, ok := l.proxies[name]; ok {
+			l.add(node, SeverityError, "proxy group %q has the name of a proxy", name)
+		}
+	}
+	l.collectProviders(root, "proxy-providers", l.proxyProviders)
+	l.collectProviders(root, "rule-providers", l.ruleProviders)
+
+	l.lintGroups(root)
+	l.lintRules(root)
+	l.lintDNS(root)
+	if online {
+		l.lintProviderURLs(root)
+	}
+	return l.diags
+}
+
+// collectNames records the names of a list of mappings, the duplicates are
+// reported.
+func (l *clashLint) collectNames(root *yaml.Node, key string, names map[string]*yaml.Node) {
+	_, list := yamlMapGet(root, key)
+	if list == nil || list.Kind != yaml.SequenceNode {
+		return
+	}
+	for _, item := range list.Content {
+		_, name := yamlMapGet(item, "name")
+		if name == nil || name.Value == "" {
+			l.add(item, SeverityError, "%s entry without a name", key)
+			continue
+		}
+		if first, ok := names[name.Value]; ok {
+			l.add(name, SeverityError, "duplicate name %q in %s, first defined at line %d", name.Value, key, first.Line)
+			continue
+		}
+		names[name.Value] = name
+	}
+}
+
+func (l *clashLint) collectProviders(root *yaml.Node, key string, providers map[string]*yaml.Node) {
+	_, m := yamlMapGet(root, key)
+	if m == nil || m.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		providers[m.Content[i].Value] = m.Content[i+1]
+	}
+}
+
+// addUndefined reports a reference to an undefined proxy, it is only a
+// warning with the proxy providers since their proxies are not known offline.
+func (l *clashLint) addUndefined(n *yaml.Node, format string, args ...any) {
+	if len(l.proxyProviders) > 0 {
+		l.add(n, SeverityWarning, format+", unless a proxy provider has it", args...)
+		return
+	}
+	l.add(n, SeverityError, format, args...)
+}
+
+// outboundDefined reports whether the name is a proxy, a group or a builtin.
+func (l *clashLint) outboundDefined(name string) bool {
+	if _, ok := l.proxies[name]; ok {
+		return true
+	}
+	if _, ok := l.groups[name]; ok {
+		return true
+	}
+	for _, b := range builtinOutbounds {
+		if name == b {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *clashLint) lintGroups(root *yaml.Node) {
+	_, list := yamlMapGet(root, "proxy-groups")
+	if list == nil || list.Kind != yaml.SequenceNode {
+		return
+	}
+	// group -> groups it references, for the loop detection
+	refs := map[string][]string{}
+	for _, g := range list.Content {
+		_, nameNode := yamlMapGet(g, "name")
+		if nameNode == nil {
+			continue
+		}
+		name := nameNode.Value
+		_, proxies := yamlMapGet(g, "proxies")
+		_, use := yamlMapGet(g, "use")
+		var members int
+		if proxies != nil {
+			for _, p := range proxies.Content {
+				members++
+				if p.Kind != yaml.ScalarNode {
+					continue
+				}
+				if !l.outboundDefined(p.Value) {
+					l.addUndefined(p, "proxy group %q references the undefined proxy %q", name, p.Value)
+				}
+				if _, ok := l.groups[p.Value]; ok {
+					refs[name] = append(refs[name], p.Value)
+				}
+			}
+		}
+		if use != nil {
+			for _, p := range use.Content {
+				members++
+				if _, ok := l.proxyProviders[p.Value]; !ok {
+					l.add(p, SeverityError, "proxy group %q uses the undefined proxy provider %q", name, p.Value)
+				}
+			}
+		}
+		// the mihomo groups can include all the proxies and providers instead
+		// the proxies of a merged anchor(<<: *group) are not resolved here
+		_, merge := yamlMapGet(g, "<<")
+		includeAll := merge != nil
+		for _, k := range []string{"include-all", "include-all-proxies", "include-all-providers"} {
+			if _, v := yamlMapGet(g, k); v != nil && v.Value == "true" {
+				includeAll = true
+			}
+		}
+		if members == 0 && !includeAll {
+			l.add(nameNode, SeverityError, "proxy group %q has no proxies", name)
+		}
+	}
+
+	// a group must not reach itself through the other groups
+	state := map[string]int{} // 1 on the stack, 2 done
+	var stack []string
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = 1
+		stack = append(stack, name)
+		for _, next := range refs[name] {
+			switch state[next] {
+			case 0:
+				visit(next)
+			case 1:
+				i := slices.Index(stack, next)
+				loop := append(slices.Clone(stack[i:]), next)
+				l.add(l.groups[next], SeverityError, "loop between the proxy groups: %s", strings.Join(loop, " -> "))
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = 2
+	}
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if state[name] == 0 {
+			visit(name)
+		}
+	}
+}
+
+// splitRule returns the type, the payload and the target of a rule, the
+// target of the logic rules follows their parenthesized conditions.
+func splitRule(rule string) (typ, payload, target string) {
+	typ, rest, _ := strings.Cut(rule, ",")
+	typ = strings.ToUpper(strings.TrimSpace(typ))
+	if i := strings.LastIndex(rest, ")"); i >= 0 && (typ == "AND" || typ == "OR" || typ == "NOT") {
+		payload = rest[:i+1]
+		fields := strings.Split(strings.TrimPrefix(rest[i+1:], ","), ",")
+		return typ, payload, strings.TrimSpace(fields[0])
+	}
+
+	fields := strings.Split(rest, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if typ == "MATCH" {
+		return typ, "", fields[0]
+	}
+	// the options follow the target, e.g. no-resolve
+	for len(fields) > 2 && (fields[len(fields)-1] == "no-resolve" || fields[len(fields)-1] == "src") {
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) < 2 {
+		return typ, strings.Join(fields, ","), ""
+	}
+	return typ, fields[0], fields[1]
+}
+
+func (l *clashLint) lintRules(root *yaml.Node) {
+	_, rules := yamlMapGet(root, "rules")
+	if rules == nil || rules.Kind != yaml.SequenceNode {
+		l.add(nil, SeverityWarning, "no rules, all the connections go to the default outbound")
+		return
+	}
+	seen := map[string]*yaml.Node{}
+	var match *yaml.Node
+	for _, r := range rules.Content {
+		typ, payload, target := splitRule(r.Value)
+		if match != nil {
+			l.add(r, SeverityWarning, "rule %q is never matched, MATCH at line %d matches everything", r.Value, match.Line)
+			continue
+		}
+		if typ == "MATCH" {
+			match = r
+		}
+
+		switch {
+		case target == "":
+			l.add(r, SeverityError, "rule %q has no target", r.Value)
+		case typ != "SUB-RULE" && !l.outboundDefined(target):
+			l.addUndefined(r, "rule %q targets the undefined proxy %q", r.Value, target)
+		}
+		if typ == "RULE-SET" {
+			if _, ok := l.ruleProviders[payload]; !ok {
+				l.add(r, SeverityError, "rule %q uses the undefined rule provider %q", r.Value, payload)
+			}
+		}
+
+		key := typ + "," + strings.ToLower(payload)
+		if first, ok := seen[key]; ok {
+			l.add(r, SeverityWarning, "duplicate rule %q, the rule at line %d matches first", r.Value, first.Line)
+			continue
+		}
+		seen[key] = r
+	}
+}
+
+// lintDNS checks the dns settings the interception depends on, the clash dns
+// answers the hijacked queries with the fake ips.
+func (l *clashLint) lintDNS(root *yaml.Node) {
+	// --enforce-config enables the dns at startup
+	enforced, hint := SeverityError, ""
+	if conf.EnforceConfig {
+		enforced, hint = SeverityWarning, ", enabled by --enforce-config"
+	}
+	dnsKey, dns := yamlMapGet(root, "dns")
+	if dns == nil {
+		l.add(nil, enforced, "dns is not configured, the hijacked queries need the clash dns(dns)"+hint)
+		return
+	}
+	if k, v := yamlMapGet(dns, "enable"); v == nil || v.Value != "true" {
+		n := k
+		if n == nil {
+			n = dnsKey
+		}
+		l.add(n, enforced, "dns is not enabled, the hijacked queries need the clash dns(dns.enable)"+hint)
+	}
+	if _, v := yamlMapGet(dns, "nameserver"); v == nil || len(v.Content) == 0 {
+		l.add(dnsKey, SeverityError, "no dns nameserver, the clash dns can not resolve the real addresses(dns.nameserver)")
+	}
+
+	if _, v := yamlMapGet(root, "tproxy-port"); v == nil || v.Value == "" || v.Value == "0" {
+		l.add(nil, SeverityWarning, "no tproxy port, the core has no transparent proxy listener(tproxy-port)"+hint)
+	}
+
+	// the k8s sidecar intercepts the pod traffic by redir-port
+	if conf.K8sSidecar {
+		return
+	}
+	// --auto-fix tun enables the tun at startup
+	fixed, fixHint := SeverityError, ""
+	if conf.AutoFixMode != "" {
+		fixed, fixHint = SeverityWarning, ", enabled by --auto-fix"
+	}
+	tunKey, tun := yamlMapGet(root, "tun")
+	if k, v := yamlMapGet(tun, "enable"); v == nil || v.Value != "true" {
+		n := k
+		if n == nil {
+			n = tunKey
+		}
+		l.add(n, fixed, "tun is not enabled, the traffic is intercepted by the clash tun(tun.enable)"+fixHint)
+		return
+	}
+	_, ebpf := yamlMapGet(root, "ebpf")
+	_, redirect := yamlMapGet(ebpf, "redirect-to-tun")
+	if k, v := yamlMapGet(tun, "auto-route"); (v == nil || v.Value != "true") && (redirect == nil || len(redirect.Content) == 0) {
+		n := k
+		if n == nil {
+			n = tunKey
+		}
+		l.add(n, fixed, "tun auto route is not enabled, no traffic is routed to the tun(tun.auto-route or ebpf.redirect-to-tun)"+fixHint)
+	}
+	if k, v := yamlMapGet(tun, "dns-hijack"); v == nil || len(v.Content) == 0 {
+		n := k
+		if n == nil {
+			n = tunKey
+		}
+		l.add(n, SeverityWarning, "no tun dns hijack, the queries to other dns servers bypass the fake ips(tun.dns-hijack)")
+	}
+}
+
+// lintProviderURLs requests the urls of the http providers concurrently.
+func (l *clashLint) lintProviderURLs(root *yaml.Node) {
+	type provider struct {
+		kind, name string
+		url        *yaml.Node
+	}
+	var ps []provider
+	for _, kind := range []string{"proxy-providers", "rule-providers"} {
+		_, m := yamlMapGet(root, kind)
+		if m == nil || m.Kind != yaml.MappingNode {
+			continue
+		}
+		for i := 0; i+1 < len(m.Content); i += 2 {
+			_, typ := yamlMapGet(m.Content[i+1], "type")
+			_, u := yamlMapGet(m.Content[i+1], "url")
+			if typ == nil || typ.Value != "http" {
+				continue
+			}
+			if u == nil || u.Value == "" {
+				l.add(m.Content[i], SeverityError, "http provider %q has no url", m.Content[i].Value)
+				continue
+			}
+			ps = append(ps, provider{kind, m.Content[i].Value, u})
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range ps {
+		p := p
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := checkProviderURL(p.url.Value); err != nil {
+				mu.Lock()
+				l.add(p.url, SeverityWarning, "the url of %s %q can not be fetched: %v", strings.TrimSuffix(p.kind, "s"), p.name, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// checkProviderURL requests the url, only the status is checked.
+func checkProviderURL(u string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), conf.HttpTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("TPClash %s %s", version, commit))
+	resp, err := configClient().Do(req)
+	if err != nil {
+		return redactErr(err)
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func init() {
+	checkCmd.Flags().BoolVar(&checkOpts.offline, "offline", false, "do not request the provider urls")
+}
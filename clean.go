@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/lorenzosaino/go-sysctl"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+// the defaults of the cores for the auto-route, used if the config does not
+// set them(mihomo: iproute2-table-index/iproute2-rule-index, sing-box:
+// iproute2_table_index/iproute2_rule_index)
+var (
+	coreTunDevices = []string{"utun", "Meta"}
+	coreRouteTable = 2022
+	coreRuleIndex  = 9000
+	coreRuleSpan   = 10
+)
+
+// cleanRuntimeFiles are written by tpclash in the clash home besides the
+// extracted files.
+var cleanRuntimeFiles = []string{pidFileName, stateFileName, controllerSocketName, coreSocketName, filepath.Join("run", coreSocketName),
+	InternalConfigName, InternalSingBoxConfigName, configCacheName, extractManifestName}
+
+var cleanOpts struct {
+	purge bool
+	force bool
+}
+
+var cleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: "Remove the rules, routes, files and service installed by tpclash",
+	Long: `Return the host to the state before tpclash, also after an unclean exit:
+
+  - the tpclash nftables table and the container runtime compatible rules
+  - the bypass ip rule and the tun device, ip rules and routes left by the core
+  - the sysctl values changed by tpclash(restored from the clash home)
+  - the tracing containers and the systemd service
+  - the extracted files and the runtime files in the clash home
+
+The tokens, the audit log and the other data in the clash home are kept
+unless --purge is set, which also removes the installed executable.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if os.Geteuid() != 0 {
+			logrus.Fatal("[clean] tpclash clean must be run as root")
+		}
+		if proc, err := runningTPClash(); err == nil && !cleanOpts.force {
+			logrus.Fatalf("[clean] tpclash(pid %d) is running, stop it first", proc.Pid)
+		}
+		var err error
+		if core, err = NewCore(); err != nil {
+			logrus.Fatal(err)
+		}
+
+		var failed []string
+		for _, step := range []struct {
+			name string
+			fn   func() error
+		}{
+			{"nftables rules", CleanRules},
+			{"container runtime compatible rules", DisableDockerCompatible},
+			{"core routes", cleanCoreRoutes},
+			{"sysctl", restoreSysctl},
+			{"tracing containers", cleanTracing},
+			{"systemd service", removeService},
+			{"clash home", cleanHome},
+		} {
+			logrus.Infof("[clean] cleaning %s...", step.name)
+			if err = step.fn(); err != nil {
+				logrus.Errorf("[clean] failed to clean %s: %v", step.name, err)
+				failed = append(failed, step.name)
+			}
+		}
+
+		if len(failed) > 0 {
+			err = fmt.Errorf("[clean] failed to clean %v", failed)
+		}
+		// the audit log is gone with --purge
+		if !cleanOpts.purge {
+			Audit(AuditSourceCLI, "", "tpclash.clean", conf.ClashHome, err)
+		}
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Info("[clean] tpclash cleaned")
+	},
+}
+
+// cleanCoreRoutes removes the tun device, the ip rules and the routes the core
+// creates with auto-route, they survive a crash of the core.
+func cleanCoreRoutes() error {
+	devices, table, ruleIndex := coreRouteConf()
+
+	for _, name := range devices {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			continue
+		}
+		// any interface may be named in the config, only tun devices are ours
+		if link.Type() != "tuntap" {
+			continue
+		}
+		logrus.Infof("[clean] delete tun device %s", name)
+		if err = netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete tun device %s: %w", name, err)
+		}
+	}
+
+	for _, family := range []int{unix.AF_INET, unix.AF_INET6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			return fmt.Errorf("failed to list ip rules: %w", err)
+		}
+		for _, r := range rules {
+			inSpan := r.Priority >= ruleIndex && r.Priority < ruleIndex+coreRuleSpan
+			if r.Table != table && !(inSpan && r.Table == unix.RT_TABLE_MAIN) {
+				continue
+			}
+			logrus.Infof("[clean] delete ip rule: pref %d lookup %d", r.Priority, r.Table)
+			r := r
+			if err = netlink.RuleDel(&r); err != nil && !errors.Is(err, unix.ENOENT) {
+				return fmt.Errorf("failed to delete ip rule %d: %w", r.Priority, err)
+			}
+		}
+
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return fmt.Errorf("failed to list routes of table %d: %w", table, err)
+		}
+		for _, route := range routes {
+			route := route
+			if err = netlink.RouteDel(&route); err != nil && !errors.Is(err, unix.ESRCH) {
+				return fmt.Errorf("failed to delete route %s of table %d: %w", route.Dst, table, err)
+			}
+		}
+		if len(routes) > 0 {
+			logrus.Infof("[clean] deleted %d routes of table %d", len(routes), table)
+		}
+	}
+	return nil
+}
+
+// coreRouteConf reads the tun device and the route table from the tun of the
+// last config written for the core(tun of clash, the tun inbounds of
+// sing-box), the defaults of the cores are used without it. The other
+// interfaces named in the config(e.g. the tun of a vpn bound by a proxy) are
+// not created by the core and never returned.
+func coreRouteConf() (devices []string, table, ruleIndex int) {
+	devices, table, ruleIndex = slices.Clone(coreTunDevices), coreRouteTable, coreRuleIndex
+
+	bs, err := os.ReadFile(filepath.Join(conf.ClashHome, core.ConfigName()))
+	if err != nil {
+		return
+	}
+	// the sing-box json is valid yaml as well
+	var root map[string]any
+	if err = yaml.Unmarshal(bs, &root); err != nil {
+		return
+	}
+	tuns := []map[string]any{}
+	if tun, ok := root["tun"].(map[string]any); ok {
+		tuns = append(tuns, tun)
+	}
+	inbounds, _ := root["inbounds"].([]any)
+	for _, in := range inbounds {
+		if tun, ok := in.(map[string]any); ok && tun["type"] == "tun" {
+			tuns = append(tuns, tun)
+		}
+	}
+	for _, tun := range tuns {
+		for _, k := range []string{"device", "interface_name"} {
+			name, _ := tun[k].(string)
+			if name == "" {
+				continue
+			}
+			// the alternate slot of a handoff
+			name = strings.TrimSuffix(name, handoffDeviceSuffix)
+			for _, d := range []string{name, name + handoffDeviceSuffix} {
+				if !slices.Contains(devices, d) {
+					devices = append(devices, d)
+				}
+			}
+		}
+		for _, k := range []string{"iproute2-table-index", "iproute2_table_index"} {
+			if n := portValue(tun[k]); n > 0 {
+				table = n
+			}
+		}
+		for _, k := range []string{"iproute2-rule-index", "iproute2_rule_index"} {
+			if n := portValue(tun[k]); n > 0 {
+				ruleIndex = n
+			}
+		}
+	}
+	return
+}
+
+// restoreSysctl restores the values recorded before tpclash changed them.
+func restoreSysctl() error {
+	backupPath := filepath.Join(conf.ClashHome, sysctlBackupName)
+	bs, err := os.ReadFile(backupPath)
+	if errors.Is(err, os.ErrNotExist) {
+		logrus.Warnf("[clean] the original sysctl values are unknown(%s not found), leave them unchanged", backupPath)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	orig := make(map[string]string)
+	if err = json.Unmarshal(bs, &orig); err != nil {
+		return fmt.Errorf("invalid %s: %w", backupPath, err)
+	}
+	for _, k := range sortedKeys(orig) {
+		logrus.Infof("[clean] restore %s = %s", k, orig[k])
+		if err = sysctl.Set(k, orig[k]); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", k, err)
+		}
+	}
+	return os.Remove(backupPath)
+}
+
+// cleanTracing removes the tracing containers if the docker daemon is running.
+func cleanTracing() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = cli.Close() }()
+	if _, err = cli.Ping(ctx); err != nil {
+		logrus.Debugf("[clean] docker daemon is not reachable, skip the tracing containers: %v", err)
+		return nil
+	}
+	return stopTracing(ctx)
+}
+
+// removeService disables and removes the systemd unit written by install.
+func removeService() error {
+	unit := filepath.Join(systemdDir, "tpclash.service")
+	if _, err := os.Stat(unit); err == nil {
+		if out, err := ChildOutput(exec.Command("systemctl", "disable", "tpclash")); err != nil {
+			logrus.Warnf("[clean] failed to disable tpclash service: %v: %s", err, bytes.TrimSpace(out))
+		}
+		logrus.Infof("[clean] remove --> %s", unit)
+		if err = os.Remove(unit); err != nil {
+			return err
+		}
+		if out, err := ChildOutput(exec.Command("systemctl", "daemon-reload")); err != nil {
+			logrus.Warnf("[clean] failed to reload systemd: %v: %s", err, bytes.TrimSpace(out))
+		}
+	}
+
+	if cleanOpts.purge {
+		bin := filepath.Join(installDir, "tpclash")
+		logrus.Infof("[clean] remove --> %s", bin)
+		if err := os.Remove(bin); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanHome removes the extracted and the runtime files, or the whole clash
+// home with --purge.
+func cleanHome() error {
+	home := filepath.Clean(conf.ClashHome)
+	if home == "/" || home == "." {
+		return fmt.Errorf("refuse to clean the clash home %s", conf.ClashHome)
+	}
+	if cleanOpts.purge {
+		logrus.Infof("[clean] remove --> %s", home)
+		return os.RemoveAll(home)
+	}
+
+	var files []string
+	for rel := range loadExtractManifest() {
+		files = append(files, rel)
+	}
+	files = append(files, cleanRuntimeFiles...)
+	for _, dir := range []string{coreRuntimeDir, filepath.Join(home, handoffHomeDir)} {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+
+	dirs := make(map[string]bool)
+	for _, rel := range files {
+		path := filepath.Join(home, rel)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		for d := filepath.Dir(rel); d != "."; d = filepath.Dir(d) {
+			dirs[d] = true
+		}
+	}
+
+	// the extracted dirs are removed if nothing else was put into them,
+	// the deepest first
+	var ds []string
+	for d := range dirs {
+		ds = append(ds, d)
+	}
+	sort.Slice(ds, func(i, j int) bool { return len(ds[i]) > len(ds[j]) })
+	for _, d := range ds {
+		_ = os.Remove(filepath.Join(home, d))
+	}
+	logrus.Infof("[clean] removed %d extracted files from %s", len(files)-len(cleanRuntimeFiles), home)
+	return nil
+}
+
+func init() {
+	cleanCmd.Flags().BoolVar(&cleanOpts.purge, "purge", false, "also remove the whole clash home and the installed executable")
+	cleanCmd.Flags().BoolVar(&cleanOpts.force, "force", false, "clean even if tpclash seems to be running")
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// clientStatsDays is how many days of daily usage are kept per client.
+const clientStatsDays = 62
+
+// clientOfflineAfter is the minimum time without connections before a client
+// is offline, at least 3 samples are missed.
+const clientOfflineAfter = 5 * time.Minute
+
+// Traffic is an amount of uploaded and downloaded bytes.
+type Traffic struct {
+	Upload   uint64 `json:"upload"`
+	Download uint64 `json:"download"`
+}
+
+// ClientUsage is the proxied traffic of a LAN client, Days is keyed by the
+// local date(2006-01-02).
+type ClientUsage struct {
+	Traffic
+	Name     string              `json:"name,omitempty"`
+	MAC      string              `json:"mac,omitempty"`
+	LastSeen time.Time           `json:"last_seen"`
+	Days     map[string]*Traffic `json:"days"`
+}
+
+var clientStats = struct {
+	sync.Mutex
+	clients map[string]*ClientUsage
+	// bytes of the active connections at the previous sample
+	conns map[string]Traffic
+	// the last sample a client had connections, the online clients
+	online map[string]time.Time
+}{clients: map[string]*ClientUsage{}, conns: map[string]Traffic{}, online: map[string]time.Time{}}
+
+// WatchClients samples the connections of the core every
+// --client-stats-interval and accounts the traffic to the source ips. The
+// bytes transferred by a connection after the last sample before it closes
+// are not accounted, a shorter interval is more accurate.
+func WatchClients(ctx context.Context) {
+	if conf.ClientStatsInterval <= 0 {
+		return
+	}
+
+	if clients, err := LoadClientStats(); err == nil {
+		clientStats.Lock()
+		clientStats.clients = clients
+		clientStats.Unlock()
+	}
+
+	logrus.Infof("[clients] client traffic accounting enabled, interval: %s", conf.ClientStatsInterval)
+	ticker := time.NewTicker(conf.ClientStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			saveClientStats()
+			return
+		case <-ticker.C:
+			if err := sampleClients(); err != nil {
+				logrus.Debugf("[clients] failed to sample connections: %v", err)
+				continue
+			}
+			saveClientStats()
+			checkBudgets()
+		}
+	}
+}
+
+func sampleClients() error {
+	api, err := RunningAPI()
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Connections []clashConn `json:"connections"`
+	}
+	if err = api.Do("GET", "/connections", nil, &resp); err != nil {
+		return err
+	}
+
+	clientStats.Lock()
+	defer clientStats.Unlock()
+
+	now := time.Now()
+	today := now.Format(time.DateOnly)
+	conns := make(map[string]Traffic, len(resp.Connections))
+	for _, c := range resp.Connections {
+		cur := Traffic{Upload: c.Upload, Download: c.Download}
+		conns[c.ID] = cur
+
+		// counters restart from 0 after a core restart
+		prev := clientStats.conns[c.ID]
+		if cur.Upload < prev.Upload || cur.Download < prev.Download {
+			prev = Traffic{}
+		}
+		delta := Traffic{Upload: cur.Upload - prev.Upload, Download: cur.Download - prev.Download}
+		if delta.Upload == 0 && delta.Download == 0 {
+			continue
+		}
+
+		u := clientStats.clients[c.Metadata.SourceIP]
+		if u == nil {
+			u = &ClientUsage{Days: map[string]*Traffic{}}
+			clientStats.clients[c.Metadata.SourceIP] = u
+		}
+		u.Upload += delta.Upload
+		u.Download += delta.Download
+		u.LastSeen = now
+		// the last known lease, the client keeps its name once the lease expired
+		if l, ok := LookupLease(c.Metadata.SourceIP); ok {
+			u.Name, u.MAC = l.Hostname, l.MAC
+		}
+		if u.Days[today] == nil {
+			u.Days[today] = &Traffic{}
+		}
+		u.Days[today].Upload += delta.Upload
+		u.Days[today].Download += delta.Download
+		pruneDays(u.Days)
+	}
+	clientStats.conns = conns
+	updatePresence(resp.Connections, now)
+	return nil
+}
+
+// updatePresence publishes the clients coming online with their first
+// connection and going offline once they had none for a while, the caller
+// holds clientStats.
+func updatePresence(conns []clashConn, now time.Time) {
+	for _, c := range conns {
+		ip := c.Metadata.SourceIP
+		if _, ok := clientStats.online[ip]; !ok {
+			PublishEvent(EventClientOnline, clientLabel(ip)+" is online", clientAttrs(ip))
+		}
+		clientStats.online[ip] = now
+	}
+	timeout := max(clientOfflineAfter, 3*conf.ClientStatsInterval)
+	for ip, seen := range clientStats.online {
+		if now.Sub(seen) >= timeout {
+			delete(clientStats.online, ip)
+			PublishEvent(EventClientOffline, clientLabel(ip)+" is offline", clientAttrs(ip))
+		}
+	}
+}
+
+func clientAttrs(ip string) map[string]string {
+	attrs := map[string]string{"ip": ip}
+	if l, ok := LookupLease(ip); ok {
+		attrs["name"], attrs["mac"] = l.Hostname, l.MAC
+	}
+	return attrs
+}
+
+func pruneDays(days map[string]*Traffic) {
+	if len(days) <= clientStatsDays {
+		return
+	}
+	keys := sortedKeys(days)
+	for _, k := range keys[:len(keys)-clientStatsDays] {
+		delete(days, k)
+	}
+}
+
+// ClientUsages returns a copy of the accounted client traffic.
+func ClientUsages() map[string]Traffic {
+	clientStats.Lock()
+	defer clientStats.Unlock()
+
+	usages := make(map[string]Traffic, len(clientStats.clients))
+	for ip, u := range clientStats.clients {
+		usages[ip] = u.Traffic
+	}
+	return usages
+}
+
+// ClientLastSeen returns the time the accounted clients were seen last.
+func ClientLastSeen() map[string]time.Time {
+	clientStats.Lock()
+	defer clientStats.Unlock()
+
+	seen := make(map[string]time.Time, len(clientStats.clients))
+	for ip, u := range clientStats.clients {
+		seen[ip] = u.LastSeen
+	}
+	return seen
+}
+
+func saveClientStats() {
+	clientStats.Lock()
+	bs, err := json.MarshalIndent(clientStats.clients, "", "  ")
+	clientStats.Unlock()
+	if err != nil {
+		return
+	}
+
+	statsPath := filepath.Join(conf.ClashHome, clientStatsFileName)
+	if err = os.WriteFile(statsPath+".tmp", bs, 0644); err == nil {
+		err = os.Rename(statsPath+".tmp", statsPath)
+	}
+	if err != nil {
+		logrus.Debugf("[clients] failed to save client stats: %v", err)
+	}
+}
+
+// LoadClientStats reads the client traffic saved by the running tpclash.
+func LoadClientStats() (map[string]*ClientUsage, error) {
+	bs, err := os.ReadFile(filepath.Join(conf.ClashHome, clientStatsFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	clients := map[string]*ClientUsage{}
+	if err = json.Unmarshal(bs, &clients); err != nil {
+		return nil, err
+	}
+	for _, u := range clients {
+		if u.Days == nil {
+			u.Days = map[string]*Traffic{}
+		}
+	}
+	return clients, nil
+}
+
+// sortedClients returns the client ips ordered by total traffic.
+func sortedClients(clients map[string]*ClientUsage) []string {
+	ips := sortedKeys(clients)
+	sort.SliceStable(ips, func(i, j int) bool {
+		a, b := clients[ips[i]], clients[ips[j]]
+		return a.Upload+a.Download > b.Upload+b.Download
+	})
+	return ips
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// CNIConf is the network config of the chained plugin, e.g.
+//
+//	{"type": "tpclash", "redirPort": 7892, "dnsPort": 1053, "namespaces": ["crawler"], "excludeCIDRs": ["10.42.0.0/16"]}
+type CNIConf struct {
+	CNIVersion   string          `json:"cniVersion"`
+	Name         string          `json:"name"`
+	Type         string          `json:"type"`
+	PrevResult   json.RawMessage `json:"prevResult,omitempty"`
+	RedirPort    uint16          `json:"redirPort"`
+	DNSPort      uint16          `json:"dnsPort"`
+	Namespaces   []string        `json:"namespaces"`
+	ExcludeCIDRs []string        `json:"excludeCIDRs"`
+}
+
+type cniResult struct {
+	IPs []struct {
+		Address string `json:"address"`
+	} `json:"ips"`
+}
+
+type cniError struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       int    `json:"code"`
+	Msg        string `json:"msg"`
+}
+
+// IsCNIPlugin reports whether tpclash is invoked by a container runtime as a
+// CNI plugin, the binary should be installed as /opt/cni/bin/tpclash.
+func IsCNIPlugin() bool {
+	return os.Getenv("CNI_COMMAND") != ""
+}
+
+// RunCNI implements a chained CNI plugin: pods created in the selected
+// namespaces get their addresses added to a node level nftables set, whose
+// TCP/DNS traffic is redirected to the clash instance running on the node, so a
+// whole namespace can be proxied without per-pod sidecars.
+func RunCNI() int {
+	var nc CNIConf
+	err := runCNI(os.Getenv("CNI_COMMAND"), os.Stdin, os.Stdout, &nc)
+	if err == nil {
+		return 0
+	}
+
+	_ = json.NewEncoder(os.Stdout).Encode(cniError{CNIVersion: nc.CNIVersion, Code: 999, Msg: err.Error()})
+	return 1
+}
+
+func runCNI(command string, stdin io.Reader, stdout io.Writer, nc *CNIConf) error {
+	if command == "VERSION" {
+		_, err := fmt.Fprint(stdout, `{"cniVersion":"1.0.0","supportedVersions":["0.3.0","0.3.1","0.4.0","1.0.0"]}`)
+		return err
+	}
+
+	bs, err := io.ReadAll(stdin)
+	if err != nil {
+		return fmt.Errorf("[cni] failed to read network config: %w", err)
+	}
+	if err = json.Unmarshal(bs, nc); err != nil {
+		return fmt.Errorf("[cni] failed to parse network config: %w", err)
+	}
+
+	var prev cniResult
+	if len(nc.PrevResult) > 0 {
+		if err = json.Unmarshal(nc.PrevResult, &prev); err != nil {
+			return fmt.Errorf("[cni] failed to parse prevResult: %w", err)
+		}
+	}
+
+	var addrs []netip.Addr
+	for _, ip := range prev.IPs {
+		p, err := netip.ParsePrefix(ip.Address)
+		if err == nil && p.Addr().Is4() {
+			addrs = append(addrs, p.Addr())
+		}
+	}
+
+	switch command {
+	case "ADD":
+		if len(nc.PrevResult) == 0 {
+			return fmt.Errorf("[cni] tpclash must be used as a chained plugin")
+		}
+		if cniPodSelected(nc) && len(addrs) > 0 {
+			if err = cniLocked(func() error { return cniAddPods(nc, addrs) }); err != nil {
+				return err
+			}
+		}
+		// chained plugins pass the previous result through
+		_, err = stdout.Write(nc.PrevResult)
+		return err
+	case "DEL":
+		if len(addrs) == 0 {
+			return nil
+		}
+		return cniLocked(func() error { return cniDelPods(addrs) })
+	case "CHECK":
+		return nil
+	}
+
+	return fmt.Errorf("[cni] unknown CNI_COMMAND: %s", command)
+}
+
+// cniPodSelected checks K8S_POD_NAMESPACE of CNI_ARGS against the namespaces
+// of the network config, all pods are selected if none is configured.
+func cniPodSelected(nc *CNIConf) bool {
+	if len(nc.Namespaces) == 0 {
+		return true
+	}
+	for _, kv := range strings.Split(os.Getenv("CNI_ARGS"), ";") {
+		if ns, ok := strings.CutPrefix(kv, "K8S_POD_NAMESPACE="); ok {
+			return slices.Contains(nc.Namespaces, ns)
+		}
+	}
+	return false
+}
+
+// cniLocked serializes concurrent plugin invocations on the node.
+func cniLocked(fn func() error) error {
+	f, err := os.OpenFile(cniLockFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("[cni] failed to open lock file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if err = unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("[cni] failed to lock: %w", err)
+	}
+	defer func() { _ = unix.Flock(int(f.Fd()), unix.LOCK_UN) }()
+
+	return fn()
+}
+
+func cniTable() *nftables.Table {
+	return &nftables.Table{Family: nftables.TableFamilyIPv4, Name: TableCNI}
+}
+
+func cniPodSet() *nftables.Set {
+	return &nftables.Set{Table: cniTable(), Name: SetCNIPods, KeyType: nftables.TypeIPAddr}
+}
+
+func cniAddPods(nc *CNIConf, addrs []netip.Addr) error {
+	nft, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("[cni] failed connect to nftables: %v", err)
+	}
+
+	tables, err := nft.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		return fmt.Errorf("[cni] failed to list nftables tables: %w", err)
+	}
+	// the table is rebuilt from the network config of every ADD so a changed
+	// redirPort/dnsPort/excludeCIDRs applies, the pods already added are kept
+	// and the table is replaced in one transaction
+	elements := addrSetElements(addrs)
+	if slices.ContainsFunc(tables, func(t *nftables.Table) bool { return t.Name == TableCNI }) {
+		pods, err := nft.GetSetElements(cniPodSet())
+		if err != nil {
+			return fmt.Errorf("[cni] failed to list pod addresses: %w", err)
+		}
+		for _, e := range pods {
+			if !slices.ContainsFunc(elements, func(a nftables.SetElement) bool { return bytes.Equal(a.Key, e.Key) }) {
+				elements = append(elements, e)
+			}
+		}
+		nft.DelTable(cniTable())
+	}
+	if err = cniCreateTable(nft, nc); err != nil {
+		return err
+	}
+
+	set := cniPodSet()
+	if err = nft.SetAddElements(set, elements); err != nil {
+		return fmt.Errorf("[cni] failed to add pod addresses: %w", err)
+	}
+	if err = nft.Flush(); err != nil {
+		return fmt.Errorf("[cni] failed to flush nftables: %v", err)
+	}
+	return nil
+}
+
+func cniDelPods(addrs []netip.Addr) error {
+	nft, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("[cni] failed connect to nftables: %v", err)
+	}
+
+	// DEL must be idempotent, missing elements(or table) are not errors
+	set := cniPodSet()
+	for _, e := range addrSetElements(addrs) {
+		if err = nft.SetDeleteElements(set, []nftables.SetElement{e}); err != nil {
+			return fmt.Errorf("[cni] failed to delete pod addresses: %w", err)
+		}
+		_ = nft.Flush()
+	}
+	return nil
+}
+
+// cniCreateTable creates the node level redirect rules:
+//
+//	ip saddr @cni_pods ip daddr @cni_exclude return
+//	ip saddr @cni_pods udp/tcp dport 53 redirect to :dnsPort
+//	ip saddr @cni_pods meta l4proto tcp redirect to :redirPort
+func cniCreateTable(nft nftBuilder, nc *CNIConf) error {
+	if nc.RedirPort == 0 {
+		return fmt.Errorf("[cni] redirPort must be set in network config")
+	}
+
+	excludes := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	for _, s := range nc.ExcludeCIDRs {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return fmt.Errorf("[cni] failed to parse exclude cidr: %s: %w", s, err)
+		}
+		excludes = append(excludes, p)
+	}
+
+	table := nft.AddTable(cniTable())
+	chain := nft.AddChain(&nftables.Chain{
+		Name:     ChainCNIPrerouting,
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	})
+
+	pods := cniPodSet()
+	if err := nft.AddSet(pods, nil); err != nil {
+		return fmt.Errorf("[cni] failed to add pod set: %w", err)
+	}
+	exclude := &nftables.Set{Table: table, Name: SetCNIExclude, KeyType: nftables.TypeIPAddr, Interval: true}
+	if err := nft.AddSet(exclude, prefixSetElements(mergePrefixes(excludes))); err != nil {
+		return fmt.Errorf("[cni] failed to add exclude set: %w", err)
+	}
+
+	fromPod := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+		&expr.Lookup{SourceRegister: 1, SetName: pods.Name, SetID: pods.ID},
+	}
+	redirect := func(port uint16) []expr.Any {
+		return []expr.Any{
+			&expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(port)},
+			&expr.Redir{RegisterProtoMin: 1},
+		}
+	}
+
+	nft.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: join(fromPod, []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+		&expr.Lookup{SourceRegister: 1, SetName: exclude.Name, SetID: exclude.ID},
+		&expr.Verdict{Kind: expr.VerdictReturn},
+	})})
+
+	if nc.DNSPort > 0 {
+		for _, proto := range []byte{unix.IPPROTO_UDP, unix.IPPROTO_TCP} {
+			nft.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: join(fromPod, []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(53)},
+			}, redirect(nc.DNSPort))})
+		}
+	}
+
+	nft.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: join(fromPod, []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+	}, redirect(nc.RedirPort))})
+
+	return nil
+}
+
+func addrSetElements(addrs []netip.Addr) []nftables.SetElement {
+	var elements []nftables.SetElement
+	for _, addr := range addrs {
+		a := addr.As4()
+		elements = append(elements, nftables.SetElement{Key: a[:]})
+	}
+	return elements
+}
+
+func join(exprs ...[]expr.Any) []expr.Any {
+	var es []expr.Any
+	for _, e := range exprs {
+		es = append(es, e...)
+	}
+	return es
+}
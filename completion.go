@@ -0,0 +1,178 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// completionTimeout bounds the clash api requests of the dynamic completions,
+// a slow core must not block the shell.
+const completionTimeout = 2 * time.Second
+
+var completionCmd = &cobra.Command{
+	Use:   "completion bash|zsh|fish",
+	Short: "Generate the shell completion script",
+	Long: `Generate the completion script of the specified shell. The proxy groups,
+proxies and providers are completed from the running core.
+
+  bash: source <(tpclash completion bash)
+        tpclash completion bash > /etc/bash_completion.d/tpclash
+  zsh:  tpclash completion zsh > "${fpath[1]}/_tpclash"
+  fish: tpclash completion fish > ~/.config/fish/completions/tpclash.fish`,
+	Args:                  cobra.ExactArgs(1),
+	ValidArgs:             []string{"bash", "zsh", "fish"},
+	DisableFlagsInUseLine: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+		switch args[0] {
+		case "bash":
+			err = rootCmd.GenBashCompletionV2(os.Stdout, true)
+		case "zsh":
+			err = rootCmd.GenZshCompletion(os.Stdout)
+		case "fish":
+			err = rootCmd.GenFishCompletion(os.Stdout, true)
+		default:
+			logrus.Fatalf("[completion] unsupported shell %s(bash|zsh|fish)", args[0])
+		}
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	},
+}
+
+// completionProxies returns the proxies of the running core, nil if it is
+// not reachable.
+func completionProxies() map[string]clashProxy {
+	api, err := RunningAPI()
+	if err != nil {
+		return nil
+	}
+	api.cli.Timeout = completionTimeout
+	proxies, err := fetchProxies(api)
+	if err != nil {
+		return nil
+	}
+	return proxies
+}
+
+// completeGroups completes the proxy group names.
+func completeGroups(_ *cobra.Command, args []string, _ string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var groups []string
+	for name, p := range completionProxies() {
+		if p.IsGroup() && name != "GLOBAL" {
+			groups = append(groups, name+"\t"+p.Type)
+		}
+	}
+	sort.Strings(groups)
+	return groups, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeSelect completes the group and then the proxies of the group.
+func completeSelect(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return completeGroups(cmd, args, toComplete)
+	}
+	if len(args) > 1 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	proxies := completionProxies()
+	g, ok := proxies[args[0]]
+	if !ok {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var names []string
+	for _, name := range g.All {
+		names = append(names, name+"\t"+proxies[name].Type)
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeProviders completes the proxy and rule provider names.
+func completeProviders(_ *cobra.Command, args []string, _ string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	api, err := RunningAPI()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	api.cli.Timeout = completionTimeout
+	ps, err := fetchProviders(api)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var names []string
+	for _, p := range ps {
+		names = append(names, p.Name+"\t"+p.kind)
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeTokens completes the names of the issued tokens.
+func completeTokens(_ *cobra.Command, args []string, _ string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	tokens, _ := LoadTokens()
+	var names []string
+	for _, t := range tokens {
+		names = append(names, t.Name+"\t"+t.Scope)
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// fixedCompletion completes one of the values.
+func fixedCompletion(values ...string) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+		return values, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// registerCompletions adds the dynamic completions of the arguments and the
+// flag values, it is called after the init of all commands.
+func registerCompletions() {
+	rootCmd.CompletionOptions.DisableDefaultCmd = true
+
+	proxiesShowCmd.ValidArgsFunction = completeGroups
+	proxiesSelectCmd.ValidArgsFunction = completeSelect
+	pingCmd.ValidArgsFunction = completeGroups
+	providersUpdateCmd.ValidArgsFunction = completeProviders
+	providersHealthcheckCmd.ValidArgsFunction = completeProviders
+	tokenRevokeCmd.ValidArgsFunction = completeTokens
+	modeCmd.ValidArgs = []string{"rule", "global", "direct"}
+
+	flags := map[*cobra.Command]map[string][]string{
+		rootCmd: {
+			"core":              {CorePremium, CoreMihomo, CoreSingBox},
+			"ui":                {"official", "yacd", "metacubexd"},
+			"lang":              {LangEN, LangZH},
+			"output":            {OutputText, OutputJSON},
+			"auto-fix":          {"tun", "ebpf"},
+			"controller-mode":   {ControllerLocalhost, ControllerUnix},
+			"controller-policy": {ControllerPolicyLocalhost, ControllerPolicyLAN, ControllerPolicyOff},
+			"notify-events":     notifyEvents,
+		},
+		initCmd:        {"bypass": {BypassLAN, BypassCN, "none"}},
+		tokenCreateCmd: {"scope": {TokenScopeRead, TokenScopeFull, TokenScopeSync}},
+		selfUpdateCmd:  {"channel": {ChannelStable, ChannelBeta}},
+	}
+	for cmd, values := range flags {
+		for name, vs := range values {
+			if err := cmd.RegisterFlagCompletionFunc(name, fixedCompletion(vs...)); err != nil {
+				logrus.Fatalf("[completion] failed to register completion of --%s: %v", name, err)
+			}
+		}
+	}
+	_ = rootCmd.MarkPersistentFlagFilename("tpclash-config", "yaml", "yml")
+	_ = rootCmd.MarkPersistentFlagFilename("config", "yaml", "yml", "json", "enc")
+	_ = rootCmd.MarkPersistentFlagDirname("home")
+	_ = rootCmd.MarkPersistentFlagDirname("ui-path")
+	_ = rootCmd.MarkPersistentFlagFilename("ui-archive", "zip", "tar", "gz", "tgz", "xz")
+}
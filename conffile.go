@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConfFile = "/etc/tpclash/tpclash.yaml"
+
+// confFileIgnored are the flags which make no sense in the config file.
+var confFileIgnored = map[string]bool{
+	"tpclash-config": true,
+	"version":        true,
+	"help":           true,
+}
+
+// LoadConfFile applies the settings of the tpclash config file to the global
+// flags not set on the command line or the environment. The keys are the
+// flag names, the lists and the KEY=VALUE flags take yaml sequences and
+// mappings:
+//
+//	config: https://example.com/clash.yaml
+//	check-interval: 5m
+//	dashboard-user:
+//	  - admin:PASSWORD
+//	geo-url:
+//	  geoip: https://example.com/geoip.metadb
+func LoadConfFile(fs *pflag.FlagSet) error {
+	path := conf.ConfFile
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		// the default file is optional
+		if errors.Is(err, os.ErrNotExist) && !fs.Changed("tpclash-config") {
+			return nil
+		}
+		return fmt.Errorf("[conffile] failed to read %s: %w", path, err)
+	}
+
+	var root yaml.Node
+	if err = yaml.Unmarshal(bs, &root); err != nil {
+		return fmt.Errorf("[conffile] failed to parse %s: %w", path, err)
+	}
+	if len(root.Content) == 0 {
+		return nil
+	}
+	doc := root.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		return fmt.Errorf("[conffile] %s must be a mapping of the flag names", path)
+	}
+
+	var applied int
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		name, v := doc.Content[i].Value, doc.Content[i+1]
+		f := fs.Lookup(name)
+		if f == nil || f.Hidden || confFileIgnored[name] {
+			return fmt.Errorf("[conffile] unknown setting %s(line %d)", name, doc.Content[i].Line)
+		}
+		// the command line overrides the file
+		if f.Changed {
+			continue
+		}
+		values, err := confFileValues(f, v)
+		if err != nil {
+			return fmt.Errorf("[conffile] invalid setting %s(line %d): %w", name, v.Line, err)
+		}
+		for _, s := range values {
+			if err = fs.Set(name, s); err != nil {
+				return fmt.Errorf("[conffile] invalid setting %s(line %d): %w", name, v.Line, err)
+			}
+		}
+		applied++
+	}
+	logrus.Debugf("[conffile] %d settings loaded from %s", applied, path)
+	return nil
+}
+
+// LoadEnv applies the TPCLASH_* environment variables to the flags not set
+// on the command line(the hidden aliases are skipped), e.g.
+// TPCLASH_CHECK_INTERVAL=5m for --check-interval.
+// The value is parsed like a single flag argument, so the list flags take
+// comma separated values.
+func LoadEnv(fs *pflag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed || f.Hidden || f.Name == "version" || f.Name == "help" {
+			return
+		}
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if sErr := fs.Set(f.Name, v); sErr != nil {
+			err = fmt.Errorf("[env] invalid %s: %w", envName(f.Name), sErr)
+		}
+	})
+	return err
+}
+
+func envName(flag string) string {
+	return "TPCLASH_" + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// confFileValues converts the yaml value to the arguments of the flag, each
+// one is set like a repeated flag.
+func confFileValues(f *pflag.Flag, v *yaml.Node) ([]string, error) {
+	typ := f.Value.Type()
+	repeatable := strings.HasSuffix(typ, "Slice") || strings.HasSuffix(typ, "Array") || typ == "stringToString"
+
+	switch v.Kind {
+	case yaml.ScalarNode:
+		return []string{v.Value}, nil
+	case yaml.SequenceNode:
+		if !repeatable {
+			return nil, errors.New("a list is not allowed")
+		}
+		var values []string
+		for _, c := range v.Content {
+			if c.Kind != yaml.ScalarNode {
+				return nil, errors.New("the list items must be scalars")
+			}
+			values = append(values, c.Value)
+		}
+		return values, nil
+	case yaml.MappingNode:
+		if typ != "stringToString" {
+			return nil, errors.New("a mapping is not allowed")
+		}
+		var values []string
+		for i := 0; i+1 < len(v.Content); i += 2 {
+			if v.Content[i+1].Kind != yaml.ScalarNode {
+				return nil, errors.New("the mapping values must be scalars")
+			}
+			values = append(values, v.Content[i].Value+"="+v.Content[i+1].Value)
+		}
+		return values, nil
+	}
+	return nil, errors.New("unsupported value")
+}
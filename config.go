@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -12,6 +14,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -22,32 +25,196 @@ import (
 	"github.com/fsnotify/fsnotify"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type TPClashConf struct {
+	Core              string
+	ClashBin          string
+	ClashExtraArgs    []string
+	ClashEnv          []string
 	ClashHome         string
 	ClashConfig       string
 	ClashUI           string
+	UIVersion         string
+	UIPath            string
+	UIURL             string
+	UIArchive         string
+	UISHA256          string
+	ConfigMirrors     []string
+	ConfigRecord      string
+	ConfigRecordMax   int
+	ConfigReplay      string
 	HttpHeader        []string
 	HttpTimeout       time.Duration
 	CheckInterval     time.Duration
 	ConfigEncPassword string
 	AutoFixMode       string
+	Presets           []string
+	Pipeline          []string
+	PipelineSkip      []string
+	PipelineTrace     bool
+	DockerNetworks    []string
+	IPv6BypassLAN     bool
+
+	GeoUpdateInterval time.Duration
+	GeoURLs           map[string]string
+	GeoInsecure       bool
+
+	Rulesets              []string
+	RulesetUpdateInterval time.Duration
+
+	K8sSidecar      bool
+	K8sProxyUID     int
+	K8sRedirPort    int
+	K8sDNSPort      int
+	K8sExcludeCIDRs []string
+
+	MemLimit         string
+	GCPercent        int
+	CoreMemLimit     string
+	CoreGCPercent    int
+	CoreRSSLimit     string
+	MemCheckInterval time.Duration
 
 	ForceExtract         bool
+	DisableExtract       bool
+	PreValidate          bool
+	CoreHandoff          bool
+	CoreRestart          bool
+	ConfigCache          bool
+	RulesCheck           bool
 	EnableTracing        bool
 	PrintVersion         bool
 	UpgradeWithGhProxy   bool
 	AllowStandardDNSPort bool
-
-	Test  bool
-	Debug bool
+	EnforceConfig        bool
+	ControllerMode       string
+	LANInterface         string
+	ControllerPolicy     string
+
+	ControllerSocketUsers  []string
+	ControllerSocketGroups []string
+	ControllerSocketToken  string
+
+	MetricsListen       string
+	HealthListen        string
+	ClientStatsInterval time.Duration
+
+	ConnLog         string
+	ConnLogSample   float64
+	ConnLogMaxSize  int
+	ConnLogMaxFiles int
+
+	DNSLog         string
+	DNSLogMaxSize  int
+	DNSLogMaxFiles int
+
+	OTelEndpoint string
+
+	Notify             []string
+	NotifyEvents       []string
+	NotifyTemplates    map[string]string
+	NotifySecret       string
+	NotifyQuotaPercent float64
+
+	ProxyCheckInterval time.Duration
+
+	BudgetMonthly     string
+	BudgetClients     map[string]string
+	BudgetWarnPercent float64
+	BudgetDirect      bool
+
+	MetricsPush         string
+	MetricsPushInterval time.Duration
+	MetricsPushToken    string
+	MetricsPushBuffer   int
+
+	MQTT          string
+	MQTTInterval  time.Duration
+	MQTTTopic     string
+	MQTTDiscovery string
+
+	Schedules []string
+	Policies  []string
+
+	DHCPLeases []string
+
+	Reflect       []string
+	ReflectIfaces []string
+
+	AgentServer   string
+	AgentToken    string
+	AgentName     string
+	AgentInterval time.Duration
+
+	SyncServe bool
+	SyncFrom  string
+	SyncToken string
+
+	AdminAPI   bool
+	GRPCListen string
+	Profiles   map[string]string
+
+	HA      bool
+	HAPeer  string
+	HAHooks []string
+
+	ConfigScripts []string
+
+	DNSFallback     []string
+	DNSFallbackPort uint16
+
+	AssetMirrorListen string
+	AssetMirrorTTL    time.Duration
+	AssetMirrorProxy  string
+
+	Plugins       []string
+	PluginTimeout time.Duration
+
+	DashboardListen           string
+	DashboardTLSCert          string
+	DashboardTLSKey           string
+	DashboardUsers            []string
+	DashboardAllow            []string
+	DashboardOIDCIssuer       string
+	DashboardOIDCClientID     string
+	DashboardOIDCClientSecret string
+	DashboardOIDCAllow        []string
+
+	DashboardACME      []string
+	DashboardACMEEmail string
+	DashboardACMECA    string
+	DashboardACMEHTTP  string
+	DashboardACMEDNS   string
+
+	DashboardBanAttempts int
+	DashboardBanWindow   time.Duration
+	DashboardBanTime     time.Duration
+
+	RunAs string
+
+	ConfFile string
+	Lang     string
+	Output   string
+
+	Test          bool
+	TestDuration  time.Duration
+	TestSuccess   int
+	Chaos         bool
+	ChaosInterval time.Duration
+	Timing        bool
+	Debug         bool
+	DryRun        bool
 }
 
 type ClashConf struct {
 	Port               int    `yaml:"port"`
 	SocksPort          int    `yaml:"socks-port"`
 	MixedPort          int    `yaml:"mixed-port"`
+	RedirPort          int    `yaml:"redir-port"`
+	TProxyPort         int    `yaml:"tproxy-port"`
 	AllowLan           bool   `yaml:"allow-lan"`
 	BindAddress        string `yaml:"bind-address"`
 	Mode               string `yaml:"mode"`
@@ -80,15 +247,28 @@ type ClashConf struct {
 		Nameserver        []string `yaml:"nameserver"`
 	} `yaml:"dns"`
 
+	Rules []string `yaml:"rules"`
+
 	// Meta
 	IPTables struct {
 		Enable bool `yaml:"enable"`
 	} `yaml:"iptables"`
+	ExternalControllerUnix string `yaml:"external-controller-unix"`
+}
+
+// DNSPort returns the port of dns.listen, 0 if it can't be parsed.
+func (c *ClashConf) DNSPort() uint16 {
+	_, port, err := net.SplitHostPort(c.DNS.Listen)
+	if err != nil {
+		return 0
+	}
+	p, _ := strconv.ParseUint(port, 10, 16)
+	return uint16(p)
 }
 
 func CheckConfig(c string) (*ClashConf, error) {
 	var cc ClashConf
-	if err := yaml.Unmarshal([]byte(c), &cc); err != nil {
+	if err := decodeYAML(c, &cc); err != nil {
 		return nil, fmt.Errorf("[config] failed to unmarshal clash config: %w", err)
 	}
 
@@ -110,7 +290,7 @@ func CheckConfig(c string) (*ClashConf, error) {
 		return nil, fmt.Errorf("[config] dns port in clash config is missing(dns.listen)")
 	}
 	if !conf.AllowStandardDNSPort && dport == 53 {
-		return nil, fmt.Errorf("[config] please do not set DNS to listen on port 53(dns.listen), see also: https://github.com/mritd/tpclash/wiki/Clash-DNS-%E7%A7%91%E6%99%AE")
+		return nil, fmt.Errorf("[config] please do not set DNS to listen on port 53(dns.listen), see also: https://github.com/mritd/tpclash/wiki/Clash-DNS-%%E7%%A7%%91%%E6%%99%%AE")
 	}
 
 	dhost := net.ParseIP(dnsHost)
@@ -118,6 +298,17 @@ func CheckConfig(c string) (*ClashConf, error) {
 		return nil, fmt.Errorf("[config] dns listening address parse failed(dns.listen): is not a valid IP address")
 	}
 
+	if conf.K8sSidecar {
+		// pod traffic is redirected by k8s-init, tun is not required
+		if cc.RedirPort == 0 {
+			return nil, fmt.Errorf("[config] redir-port must be set in k8s sidecar mode(redir-port)")
+		}
+		if conf.K8sRedirPort != cc.RedirPort {
+			return nil, fmt.Errorf("[config] redir-port %d does not match --redir-port %d(redir-port)", cc.RedirPort, conf.K8sRedirPort)
+		}
+		return &cc, nil
+	}
+
 	if cc.InterfaceName == "" && !cc.Tun.AutoDetectInterface {
 		return nil, fmt.Errorf("[config] failed to parse clash interface name(interface-name): interface-name or tun.auto-detect-interface must be set")
 	}
@@ -142,24 +333,59 @@ func CheckConfig(c string) (*ClashConf, error) {
 		return nil, fmt.Errorf("[config] ebpf needs to set routing-mark(routing-mark)")
 	}
 
-	if cc.IPTables.Enable {
+	if CoreFlavor() == CoreMihomo && cc.IPTables.Enable {
 		return nil, fmt.Errorf("[config] meta kernel must turn off iptables(iptables.enable)")
 	}
 
 	return &cc, nil
 }
 
-func WatchConfig(ctx context.Context) chan string {
-	buffer := ""
-	updateCh := make(chan string, 3)
+// isRemoteConfig reports whether --config is a remote url.
+func isRemoteConfig() bool {
+	// the replayed captures are fetched remote configs
+	if conf.ConfigReplay != "" {
+		return true
+	}
+	return strings.HasPrefix(conf.ClashConfig, "http://") || strings.HasPrefix(conf.ClashConfig, "https://")
+}
+
+// configUpdate is a config sent by the watchers, ctx carries the span of the
+// update the reload joins, AutoReload ends it.
+type configUpdate struct {
+	ctx    context.Context
+	config string
+}
+
+// startUpdate starts the span of a config update, the fetch, the fix and the
+// reload of the config are nested in it.
+func startUpdate(ctx context.Context, trigger string) (context.Context, trace.Span) {
+	return startSpan(ctx, "config.update", attribute.String("config.trigger", trigger))
+}
 
-	if strings.HasPrefix(conf.ClashConfig, "http://") || strings.HasPrefix(conf.ClashConfig, "https://") {
-		ccStr, err := loadRemoteConfig()
+func WatchConfig(ctx context.Context) chan configUpdate {
+	if conf.SyncFrom != "" {
+		return watchSync(ctx)
+	}
+
+	// only the hash of the last config is kept, not another copy of it
+	var last [sha256.Size]byte
+	updateCh := make(chan configUpdate, 3)
+
+	if isRemoteConfig() {
+		ccStr, err := loadRemoteConfig(ctx)
 		if err != nil {
-			logrus.Fatal(err)
+			cached, cacheErr := loadCachedConfig()
+			if cacheErr != nil {
+				logrus.Debug(cacheErr)
+				logrus.Fatal(err)
+			}
+			logrus.Errorf("%v, using the cached config of the last successful fetch", err)
+			ccStr = cached
+		} else {
+			cacheRemoteConfig(ccStr)
 		}
-		buffer = ccStr
-		updateCh <- autoFix(ccStr)
+		last = hashConfig(ccStr)
+		updateCh <- configUpdate{ctx: ctx, config: mustFixConfig(ccStr)}
 
 		go func() {
 			tick := time.Tick(conf.CheckInterval)
@@ -170,25 +396,37 @@ func WatchConfig(ctx context.Context) chan string {
 					logrus.Warnf("[config] stop config watching...")
 					return
 				case <-tick:
-					ccStr, err = loadRemoteConfig()
+					uctx, span := startUpdate(ctx, "watch")
+					ccStr, err = loadRemoteConfig(uctx)
 					if err != nil {
 						logrus.Error(err)
+						endSpan(span, err)
 						continue
 					}
-					if ccStr != buffer {
-						buffer = ccStr
-						updateCh <- autoFix(ccStr)
+					if sum := hashConfig(ccStr); sum != last {
+						fixed, err := fixConfig(uctx, ccStr)
+						if err != nil {
+							logrus.Errorf("%v, keeping the running config", err)
+							Notify(EventReloadFailure, "%v", err)
+							endSpan(span, err)
+							continue
+						}
+						last = sum
+						cacheRemoteConfig(ccStr)
+						updateCh <- configUpdate{ctx: uctx, config: fixed}
+						continue
 					}
+					endSpan(span, nil)
 				}
 			}
 		}()
 	} else {
-		ccStr, err := loadLocalConfig()
+		ccStr, err := loadLocalConfig(ctx)
 		if err != nil {
 			logrus.Fatal(err)
 		}
-		buffer = ccStr
-		updateCh <- autoFix(ccStr)
+		last = hashConfig(ccStr)
+		updateCh <- configUpdate{ctx: ctx, config: mustFixConfig(ccStr)}
 
 		go func() {
 			watcher, err := fsnotify.NewWatcher()
@@ -215,15 +453,26 @@ func WatchConfig(ctx context.Context) chan string {
 						continue
 					}
 					if event.Has(fsnotify.Write) {
-						ccStr, err = loadLocalConfig()
+						uctx, span := startUpdate(ctx, "watch")
+						ccStr, err = loadLocalConfig(uctx)
 						if err != nil {
 							logrus.Error(err)
+							endSpan(span, err)
 							continue
 						}
-						if ccStr != buffer {
-							buffer = ccStr
-							updateCh <- autoFix(ccStr)
+						if sum := hashConfig(ccStr); sum != last {
+							fixed, err := fixConfig(uctx, ccStr)
+							if err != nil {
+								logrus.Errorf("%v, keeping the running config", err)
+								Notify(EventReloadFailure, "%v", err)
+								endSpan(span, err)
+								continue
+							}
+							last = sum
+							updateCh <- configUpdate{ctx: uctx, config: fixed}
+							continue
 						}
+						endSpan(span, nil)
 					}
 				case err, ok := <-watcher.Errors:
 					if !ok {
@@ -239,51 +488,154 @@ func WatchConfig(ctx context.Context) chan string {
 	return updateCh
 }
 
-func AutoReload(updateCh chan string, writePath string) {
-	for ccStr := range updateCh {
+func AutoReload(updateCh chan configUpdate, writePath string, proc *CoreProcess) {
+	for u := range updateCh {
+		ccStr := u.config
+		span := trace.SpanFromContext(u.ctx)
+		if holdConfig(ccStr) {
+			endSpan(span, nil)
+			continue
+		}
 		logrus.Info("[config] clash config changed, reloading...")
 
-		ccStr = autoFix(ccStr)
-		cc, err := CheckConfig(ccStr)
+		err := reloadConfig(u.ctx, ccStr, writePath, proc)
+		endSpan(span, err)
+		metricReloads.WithLabelValues(metricResult(err)).Inc()
+		Audit(configSource(), "", "config.reload", redactURL(conf.ClashConfig), err)
 		if err != nil {
-			logrus.Errorf("[config] an error was detected in the clash config, skipping automatic reload:\n %v", err)
+			logrus.Error(err)
+			Notify(EventReloadFailure, "%v", err)
 			continue
 		}
 
-		if err := os.WriteFile(writePath, []byte(ccStr), 0644); err != nil {
-			logrus.Errorf("[config] failed to copy clash config: %v", err)
-			continue
-		}
+		logrus.Info("[config] clash config reload success...")
+		Notify(EventReloadSuccess, "clash config reloaded")
+		commitSyncConfig(ccStr)
+		ReapplySchedule()
+		ReapplyPolicies()
+		ReapplySync()
+	}
+}
 
-		apiAddr := cc.ExternalController
-		if apiAddr == "" {
-			apiAddr = "127.0.0.1:9090"
-		}
-		secret := cc.Secret
+// loadConfigSource loads --config outside of the watcher, for the reloads
+// requested by the agent and the management api.
+func loadConfigSource(ctx context.Context) (string, error) {
+	if conf.SyncFrom != "" {
+		return "", fmt.Errorf("[config] the config of a replica is synced from %s, reload the source instead", redactURL(conf.SyncFrom))
+	}
+	if isRemoteConfig() {
+		return loadRemoteConfig(ctx)
+	}
+	return loadLocalConfig(ctx)
+}
 
-		req, err := http.NewRequest("PUT", "http://"+apiAddr+"/configs", bytes.NewReader([]byte(fmt.Sprintf(`{"path": "%s"}`, writePath))))
-		if err != nil {
-			logrus.Errorf("[config] failed to create reload req: %v", err)
-			continue
-		}
-		req.Header.Set("Authorization", "Bearer "+secret)
-		cli := &http.Client{Timeout: 5 * time.Second}
+// reloadMu serializes the reloads of the config watcher and the agent, and
+// the secret rotation.
+var reloadMu sync.Mutex
+
+func reloadConfig(ctx context.Context, ccStr, writePath string, proc *CoreProcess) (err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	ctx, span := startSpan(ctx, "config.reload", attribute.String("tpclash.core", core.Name()))
+	defer func() { endSpan(span, err) }()
+
+	loaded := ccStr
+	_, fixSpan := startSpan(ctx, "config.fix")
+	ccStr, err = core.Fix(ccStr)
+	endSpan(fixSpan, err)
+	if err != nil {
+		return fmt.Errorf("[config] the config pipeline failed, skipping automatic reload:\n %w", err)
+	}
+	if ccStr, err = proc.adaptConfig(ccStr); err != nil {
+		return err
+	}
+	_, checkSpan := startSpan(ctx, "config.check")
+	cc, err := core.Check(ccStr)
+	endSpan(checkSpan, err)
+	if err != nil {
+		return fmt.Errorf("[config] an error was detected in the clash config, skipping automatic reload:\n %w", err)
+	}
 
-		resp, err := cli.Do(req)
+	if conf.PreValidate {
+		_, validateSpan := startSpan(ctx, "config.pre-validate")
+		err = preValidate(ccStr)
+		endSpan(validateSpan, err)
 		if err != nil {
-			logrus.Errorf("[config] failed to reload config: %v", err)
-			continue
+			return fmt.Errorf("[config] the new config failed the pre-validation, skipping automatic reload:\n %w", err)
 		}
-		defer func() { _ = resp.Body.Close() }()
+	}
 
-		if !(resp.StatusCode >= 200 && resp.StatusCode <= 299) {
-			var msg bytes.Buffer
-			_, _ = io.Copy(&msg, resp.Body)
-			logrus.Errorf("[config] failed to reload config: status %d: %s", resp.StatusCode, msg.String())
-		}
+	sum := hashConfig(ccStr)
+	hash := hex.EncodeToString(sum[:])
+	if err = VetoPlugins(PluginPreReload, map[string]any{"hash": hash, "config": ccStr}); err != nil {
+		return err
+	}
 
-		logrus.Info("[config] clash config reload success...")
+	_, writeSpan := startSpan(ctx, "config.write", attribute.String("config.path", writePath))
+	err = writeFileAtomic(writePath, strings.NewReader(ccStr), 0644)
+	endSpan(writeSpan, err)
+	if err != nil {
+		return fmt.Errorf("[config] failed to copy clash config: %w", err)
 	}
+	RecordConfig(ccStr)
+
+	if err = SetDNSPort(ctx, cc.DNSPort()); err != nil {
+		logrus.Errorf("[config] failed to update dns redirect rules: %v", err)
+	}
+	SetDNSFallbackTarget(cc)
+
+	_, coreSpan := startSpan(ctx, "core.reload")
+	holdDNSFallback(dnsFallbackReload, true)
+	err = core.Reload(writePath, cc, proc.Process())
+	holdDNSFallback(dnsFallbackReload, false)
+	endSpan(coreSpan, err)
+	EmitPlugins(PluginPostReload, pluginResult(map[string]any{"hash": hash}, err))
+	if err != nil {
+		return err
+	}
+	SetControllerTarget(cc)
+	recordLoadedConfig(loaded)
+	return nil
+}
+
+// writeFileAtomic writes a temp file in the same dir and renames it to path, the
+// core never reads a partially written config.
+func writeFileAtomic(path string, r io.Reader, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// reloadClashConfig asks the clash api to reload the config from writePath.
+func reloadClashConfig(writePath string, cc *ClashConf) error {
+	err := NewClashAPI(cc).Do(http.MethodPut, "/configs", map[string]string{"path": writePath}, nil)
+	if err != nil {
+		return fmt.Errorf("[config] failed to reload config: %w", err)
+	}
+	// the core recreates the unix socket of a changed config with the umask
+	if sock := cc.ExternalControllerUnix; sock != "" {
+		if err = os.Chmod(sock, 0600); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.Errorf("[controller] failed to change mode of %s: %v", sock, err)
+		}
+	}
+	return nil
 }
 
 func Encrypt(plaintext []byte, password string) []byte {
@@ -293,11 +645,72 @@ func Encrypt(plaintext []byte, password string) []byte {
 	return aead.Seal(nil, make([]byte, aead.NonceSize()), plaintext, nil)
 }
 
+// Decrypt decrypts the config in place, the plaintext overwrites the
+// ciphertext so that a large config is not held twice.
 func Decrypt(ciphertext []byte, password string) ([]byte, error) {
 	key := sha256.Sum256([]byte(password))
 	aead, _ := chacha20poly1305.NewX(key[:])
 
-	return aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext, nil)
+	return aead.Open(ciphertext[:0], make([]byte, aead.NonceSize()), ciphertext, nil)
+}
+
+// maxConfigPrealloc bounds the buffer allocated from the content length.
+const maxConfigPrealloc = 256 << 20
+
+// readConfig reads the whole config, the buffer is allocated once from the
+// size if it is known instead of being grown(and copied) while reading.
+func readConfig(r io.Reader, size int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if size > 0 && size <= maxConfigPrealloc {
+		buf.Grow(int(size) + bytes.MinRead)
+	}
+	_, err := buf.ReadFrom(r)
+	return buf.Bytes(), err
+}
+
+// hashConfig returns the sha256 of the config, it is hashed in chunks rather
+// than converted to a byte slice as a whole.
+func hashConfig(c string) [sha256.Size]byte {
+	h := sha256.New()
+	buf := make([]byte, 64<<10)
+	for len(c) > 0 {
+		n := copy(buf, c)
+		h.Write(buf[:n])
+		c = c[n:]
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// decodeYAML decodes the config from a reader instead of a byte slice copy of
+// it, an empty config decodes to the zero value like yaml.Unmarshal.
+func decodeYAML(c string, v any) error {
+	if err := yaml.NewDecoder(strings.NewReader(c)).Decode(v); !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// looksLikeConfig reports whether the document starts like a yaml mapping or
+// a json object, the error page of a mirror is rejected without parsing a
+// large config.
+func looksLikeConfig(bs []byte) bool {
+	bs = bytes.TrimPrefix(bs, []byte("\ufeff"))
+	for len(bs) > 0 {
+		var line []byte
+		line, bs, _ = bytes.Cut(bs, []byte("\n"))
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' || string(line) == "---" {
+			continue
+		}
+		if line[0] == '{' {
+			return true
+		}
+		k, _, ok := bytes.Cut(line, []byte(":"))
+		return ok && len(k) > 0 && !bytes.ContainsAny(k, "<> ")
+	}
+	return false
 }
 
 func tplRendering(c string) string {
@@ -318,151 +731,426 @@ func tplRendering(c string) string {
 	return buf.String()
 }
 
-func loadRemoteConfig() (string, error) {
+// recordFetch records the result of loading the config for the status command
+// and the metrics.
+func recordFetch(start time.Time, err error) {
+	metricFetches.WithLabelValues(metricResult(err)).Inc()
+	metricFetchDuration.Observe(time.Since(start).Seconds())
+	UpdateState(func(s *RuntimeState) {
+		s.LastFetch.Time = time.Now()
+		s.LastFetch.Error = ""
+		if err != nil {
+			s.LastFetch.Error = err.Error()
+		}
+	})
+}
+
+// RecordConfig records the hash of the config written for the core.
+func RecordConfig(c string) {
+	sum := hashConfig(c)
+	UpdateState(func(s *RuntimeState) {
+		s.Config.Hash = hex.EncodeToString(sum[:])
+		s.Config.LoadedAt = time.Now()
+	})
+}
+
+// configMirrorStagger is the delay before the next mirror is requested while
+// the previous ones are still pending, a failed mirror starts the next one at
+// once.
+const configMirrorStagger = 500 * time.Millisecond
+
+// remoteConfig is a config downloaded from the config url or a mirror.
+type remoteConfig struct {
+	url   string
+	body  string
+	quota string
+}
+
+func loadRemoteConfig(ctx context.Context) (ccStr string, err error) {
+	start := time.Now()
+	ctx, span := startSpan(ctx, "config.fetch", attribute.String("config.source", redactURL(conf.ClashConfig)))
+	defer func() {
+		recordFetch(start, err)
+		endSpan(span, err)
+	}()
 	logrus.Debugf("[config] checking remote config...")
+	if chaosConfigDropped() {
+		return "", errors.New("[chaos] the config source is dropped")
+	}
+
+	var rc *remoteConfig
+	if conf.ConfigReplay != "" {
+		rc, err = replayRemoteConfig()
+	} else {
+		urls := append([]string{conf.ClashConfig}, conf.ConfigMirrors...)
+		rc, err = fetchConfigMirrors(ctx, urls)
+	}
+	if err != nil {
+		return "", err
+	}
+	if rc.url != conf.ClashConfig {
+		logrus.Infof("[config] remote config is downloaded from the mirror %s", redactURL(rc.url))
+	}
+	checkSubscriptionQuota(rc.quota)
+	return rc.body, nil
+}
+
+// cacheRemoteConfig keeps the fetched config in the clash home with
+// --config-cache, it is used on startup when the remote config can not be
+// fetched. The replayed captures are not cached.
+func cacheRemoteConfig(ccStr string) {
+	if !conf.ConfigCache || conf.ConfigReplay != "" {
+		return
+	}
+	path := filepath.Join(conf.ClashHome, configCacheName)
+	if err := writeFileAtomic(path, strings.NewReader(ccStr), 0600); err != nil {
+		logrus.Warnf("[config] failed to cache the remote config: %v", err)
+	}
+}
+
+// loadCachedConfig returns the config cached by cacheRemoteConfig.
+func loadCachedConfig() (string, error) {
+	if !conf.ConfigCache {
+		return "", errors.New("[config] the config cache is disabled(--config-cache)")
+	}
+	path := filepath.Join(conf.ClashHome, configCacheName)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("[config] no cached config: %w", err)
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("[config] failed to read the cached config: %w", err)
+	}
+	logrus.Infof("[config] loaded the cached config of %s", fi.ModTime().Format(time.RFC3339))
+	return string(bs), nil
+}
+
+// fetchConfigMirrors requests the urls concurrently, each one configMirrorStagger
+// after the previous, and returns the first valid config. The pending requests
+// are canceled once a config is returned.
+func fetchConfigMirrors(ctx context.Context, urls []string) (*remoteConfig, error) {
+	if len(urls) == 1 {
+		return fetchRemoteConfig(ctx, urls[0])
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		rc  *remoteConfig
+		err error
+	}
+	// buffered, the canceled requests do not block on sending their results
+	results := make(chan result, len(urls))
+	stagger := time.NewTimer(0)
+	defer stagger.Stop()
+
+	var errs []error
+	next, pending := 0, 0
+	for next < len(urls) || pending > 0 {
+		var staggerC <-chan time.Time
+		if next < len(urls) {
+			staggerC = stagger.C
+		}
+		select {
+		case <-staggerC:
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.rc, nil
+			}
+			logrus.Debug(r.err)
+			errs = append(errs, r.err)
+			if next == len(urls) {
+				continue
+			}
+			// do not wait for the stagger after a failure
+			if !stagger.Stop() {
+				<-stagger.C
+			}
+		}
 
-	req, err := http.NewRequest("GET", conf.ClashConfig, nil)
+		url := urls[next]
+		next++
+		pending++
+		stagger.Reset(configMirrorStagger)
+		go func() {
+			rc, err := fetchRemoteConfig(ctx, url)
+			results <- result{rc, err}
+		}()
+	}
+	return nil, fmt.Errorf("[config] failed to download remote config from all the %d mirrors: %w", len(urls), errors.Join(errs...))
+}
+
+// fetchRemoteConfig downloads and decrypts the config, a response which does not
+// look like a yaml(or json) document is rejected so that a mirror returning an
+// error page does not win.
+func fetchRemoteConfig(ctx context.Context, url string) (*remoteConfig, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return "", fmt.Errorf("[config] failed to create remote config req: %w", err)
+		return nil, fmt.Errorf("[config] failed to create remote config req: %w", err)
 	}
 
 	for _, kv := range conf.HttpHeader {
-		ss := strings.Split(kv, "=")
-		if len(ss) != 2 {
-			return "", fmt.Errorf("[config] failed to parse http header: %s", kv)
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("[config] failed to parse http header %s, must be KEY=VALUE", k)
 		}
-		req.Header.Set(ss[0], ss[1])
+		req.Header.Set(k, v)
 	}
 
 	req.Header.Set("User-Agent", fmt.Sprintf("TPClash %s %s", version, commit))
 
-	cli := &http.Client{Timeout: conf.HttpTimeout}
-	resp, err := cli.Do(req)
+	resp, err := configClient().Do(req)
 	if err != nil {
-		return "", fmt.Errorf("[config] failed to download remote config: %v", err)
+		return nil, fmt.Errorf("[config] failed to download remote config: %v", redactErr(err))
 	}
-	defer func() { _ = resp.Body.Close() }()
+	defer func() {
+		// the connection is only reused after the body is read to the end
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		_ = resp.Body.Close()
+	}()
 
 	if !(resp.StatusCode >= 200 && resp.StatusCode <= 299) {
-		return "", fmt.Errorf("[config] failed to get remote config: status code %d", resp.StatusCode)
+		if conf.ConfigRecord != "" {
+			bs, _ := readConfig(io.LimitReader(resp.Body, 1<<20), -1)
+			recordConfigFetch(url, resp, bs)
+		}
+		return nil, fmt.Errorf("[config] failed to get remote config %s: status code %d", redactURL(url), resp.StatusCode)
 	}
 
-	bs, err := io.ReadAll(resp.Body)
+	bs, err := readConfig(resp.Body, resp.ContentLength)
 	if err != nil {
-		return "", fmt.Errorf("[config] failed to copy resp: %w", err)
+		return nil, fmt.Errorf("[config] failed to copy resp: %w", err)
 	}
+	recordConfigFetch(url, resp, bs)
+	return decodeRemoteConfig(url, bs, resp.Header)
+}
 
-	if conf.ConfigEncPassword != "" {
-		plaintext, err := Decrypt(bs, conf.ConfigEncPassword)
-		return string(plaintext), err
+// decodeRemoteConfig runs the source stages of the pipeline on the body of a
+// remote config and checks it, bs is decrypted in place.
+func decodeRemoteConfig(url string, bs []byte, header http.Header) (*remoteConfig, error) {
+	bs, err := runSourceStages(bs)
+	if err != nil {
+		return nil, fmt.Errorf("[config] failed to decode remote config %s: %w", redactURL(url), err)
 	}
 
-	return string(bs), nil
+	// an error page fails the cheap check without parsing it
+	var doc map[string]any
+	if !looksLikeConfig(bs) || yaml.Unmarshal(bs, &doc) != nil || len(doc) == 0 {
+		return nil, fmt.Errorf("[config] remote config %s is not a valid config document", redactURL(url))
+	}
+
+	return &remoteConfig{url: url, body: string(bs), quota: header.Get("subscription-userinfo")}, nil
 }
 
-func loadLocalConfig() (string, error) {
+func loadLocalConfig(ctx context.Context) (ccStr string, err error) {
+	start := time.Now()
+	_, span := startSpan(ctx, "config.fetch", attribute.String("config.source", redactURL(conf.ClashConfig)))
+	defer func() {
+		recordFetch(start, err)
+		endSpan(span, err)
+	}()
 	logrus.Debugf("[config] checking local config...")
+	return readLocalConfig(conf.ClashConfig)
+}
 
-	bs, err := os.ReadFile(conf.ClashConfig)
+// readLocalConfig reads a local config file and runs the source stages of
+// the pipeline on it.
+func readLocalConfig(path string) (string, error) {
+	bs, err := os.ReadFile(path)
 	if err != nil {
 		return "", fmt.Errorf("[config] local config read error: %w", err)
 	}
 
-	if conf.ConfigEncPassword != "" {
-		plaintext, err := Decrypt(bs, conf.ConfigEncPassword)
-		return string(plaintext), err
+	if bs, err = runSourceStages(bs); err != nil {
+		return "", fmt.Errorf("[config] failed to decode local config: %w", err)
 	}
 
 	return string(bs), nil
 }
 
-func autoFix(c string) string {
-	c = tplRendering(c)
-
-	if conf.AutoFixMode == "" {
-		return c
+func autoFix(doc *yaml.Node) bool {
+	if conf.AutoFixMode == "" || yamlRoot(doc) == nil {
+		return false
 	}
 
 	logrus.Infof("[autofix] enable config auto fix...")
 
-	var rootNode yaml.Node
-	if err := yaml.Unmarshal([]byte(c), &rootNode); err != nil {
-		logrus.Errorf("[autofix] failed to unmarshal yaml config: %v", err)
-		return c
+	patches := []struct{ key, tpl string }{
+		{"bind-address", bindAddressPatch},
+		{"external-controller", externalControllerPatch},
+		{"secret", secretPatch},
+		{"interface-name", nicPatch},
+		{"dns", dnsPatch},
 	}
-
-	var bindAddressNode yaml.Node
-	_ = yaml.Unmarshal([]byte(tplRendering(bindAddressPatch)), &bindAddressNode)
-	if !setYamlNode(&rootNode, "bind-address", bindAddressNode.Content[0]) {
-		logrus.Error("[autofix] failed to patch bind-address config")
-		return c
+	if conf.AutoFixMode == "ebpf" {
+		patches = append(patches, struct{ key, tpl string }{"tun", tunEBPFPatch},
+			struct{ key, tpl string }{"ebpf", ebpfPatch},
+			struct{ key, tpl string }{"routing-mark", routingMarkPatch})
+	} else {
+		patches = append(patches, struct{ key, tpl string }{"tun", tunStandardPatch})
 	}
 
-	var externalControllerNode yaml.Node
-	_ = yaml.Unmarshal([]byte(tplRendering(externalControllerPatch)), &externalControllerNode)
-	if !setYamlNode(&rootNode, "external-controller", externalControllerNode.Content[0]) {
-		logrus.Error("[autofix] failed to patch external-controller config")
-		return c
+	// a failed patch leaves the config unchanged
+	root := cloneYAMLNode(doc.Content[0])
+	for _, p := range patches {
+		var n yaml.Node
+		_ = yaml.Unmarshal([]byte(tplRendering(p.tpl)), &n)
+		if !setYamlNode(root, p.key, n.Content[0]) {
+			logrus.Errorf("[autofix] failed to patch %s config", p.key)
+			return false
+		}
 	}
+	doc.Content[0] = root
+	return true
+}
 
-	var secretNode yaml.Node
-	_ = yaml.Unmarshal([]byte(tplRendering(secretPatch)), &secretNode)
-	if !setYamlNode(&rootNode, "secret", secretNode.Content[0]) {
-		logrus.Error("[autofix] failed to patch secret config")
-		return c
+// enforceConfig makes sure the fields tpclash relies on are present and
+// consistent with the flags, subscriptions often miss them. Values set by the
+// user are only replaced when they can't work with tpclash.
+func enforceConfig(doc *yaml.Node) bool {
+	if !conf.EnforceConfig || yamlRoot(doc) == nil {
+		return false
 	}
 
-	var nicNode yaml.Node
-	_ = yaml.Unmarshal([]byte(tplRendering(nicPatch)), &nicNode)
-	if !setYamlNode(&rootNode, "interface-name", nicNode.Content[0]) {
-		logrus.Error("[autofix] failed to patch nic config")
-		return c
+	var cc ClashConf
+	if err := doc.Decode(&cc); err != nil {
+		return false
 	}
 
-	var dnsNode yaml.Node
-	_ = yaml.Unmarshal([]byte(tplRendering(dnsPatch)), &dnsNode)
-	if !setYamlNode(&rootNode, "dns", dnsNode.Content[0]) {
-		logrus.Error("[autofix] failed to patch dns config")
-		return c
+	patches := make(map[string]any)
+	if !cc.DNS.Enable {
+		patches["dns.enable"] = true
 	}
-
-	if conf.AutoFixMode == "ebpf" {
-		var tunNode yaml.Node
-		_ = yaml.Unmarshal([]byte(tplRendering(tunEBPFPatch)), &tunNode)
-		if !setYamlNode(&rootNode, "tun", tunNode.Content[0]) {
-			logrus.Error("[autofix] failed to patch tun config")
-			return c
+	switch mode := strings.ToLower(cc.DNS.EnhancedMode); mode {
+	case "":
+		patches["dns.enhanced-mode"] = "fake-ip"
+	case "fake-ip":
+	default:
+		// the mode chosen by the user is not replaced, the check rejects it
+		logrus.Warnf("[enforce] dns.enhanced-mode is %s, tpclash only supports fake-ip", mode)
+	}
+	if cc.TProxyPort == 0 {
+		patches["tproxy-port"] = enforceTProxyPort
+	}
+	if cc.DNS.Listen == "" {
+		patches["dns.listen"] = enforceDNSListen
+	}
+	if cc.DNS.FakeIPRange == "" {
+		patches["dns.fake-ip-range"] = enforceFakeIPRange
+	}
+	if cc.ExternalController == "" {
+		patches["external-controller"] = enforceExternalController
+	}
+	if cc.Secret == "" {
+		secret, err := ControllerSecret()
+		if err != nil {
+			logrus.Errorf("[enforce] failed to generate clash api secret: %v", err)
+		} else {
+			patches["secret"] = secret
 		}
+	}
+	if cc.RoutingMark == 0 && len(cc.Ebpf.RedirectToTun) > 0 {
+		patches["routing-mark"] = enforceRoutingMark
+	}
+	if conf.K8sSidecar && cc.RedirPort != conf.K8sRedirPort {
+		patches["redir-port"] = conf.K8sRedirPort
+	}
+	if len(patches) == 0 {
+		return false
+	}
 
-		var ebpfNode yaml.Node
-		_ = yaml.Unmarshal([]byte(tplRendering(ebpfPatch)), &ebpfNode)
-		if !setYamlNode(&rootNode, "ebpf", ebpfNode.Content[0]) {
-			logrus.Error("[autofix] failed to patch ebpf config")
-			return c
+	// a failed patch leaves the config unchanged
+	root := cloneYAMLNode(doc.Content[0])
+	for _, key := range sortedKeys(patches) {
+		if err := setYamlValue(root, key, patches[key]); err != nil {
+			logrus.Errorf("[enforce] %v", err)
+			return false
 		}
-
-		var routingMarkNode yaml.Node
-		_ = yaml.Unmarshal([]byte(tplRendering(routingMarkPatch)), &routingMarkNode)
-		if !setYamlNode(&rootNode, "routing-mark", routingMarkNode.Content[0]) {
-			logrus.Error("[autofix] failed to patch routing-mark config")
-			return c
+	}
+	for _, key := range sortedKeys(patches) {
+		if key == "secret" {
+			logrus.Warnf("[enforce] secret is missing, use the generated one(tpclash status --show-secret)")
+			continue
 		}
-	} else {
-		var tunNode yaml.Node
-		_ = yaml.Unmarshal([]byte(tplRendering(tunStandardPatch)), &tunNode)
-		if !setYamlNode(&rootNode, "tun", tunNode.Content[0]) {
-			logrus.Error("[autofix] failed to patch tun config")
-			return c
+		logrus.Warnf("[enforce] %s is missing or not supported, set to %v(use --enforce-config=false to disable)", key, patches[key])
+	}
+	doc.Content[0] = root
+	return true
+}
+
+// safeBindController applies --controller-policy to the external-controller.
+func safeBindController(doc *yaml.Node) bool {
+	var cc ClashConf
+	if yamlRoot(doc) == nil || doc.Decode(&cc) != nil || cc.ExternalController == "" {
+		return false
+	}
+	addr := safeController(cc.ExternalController, cc.Secret)
+	if addr == cc.ExternalController {
+		return false
+	}
+	if err := setYamlValue(doc, "external-controller", addr); err != nil {
+		logrus.Errorf("[controller] %v", err)
+		return false
+	}
+	return true
+}
+
+// restrictController rewrites the external-controller according to
+// --controller-mode, so that the clash api is not exposed on the network.
+// In unix mode the meta core listens on an internal unix socket, the others
+// are bound to the loopback, both are fronted by the unix socket of tpclash.
+func restrictController(doc *yaml.Node) bool {
+	if conf.ControllerMode == "" || yamlRoot(doc) == nil {
+		return false
+	}
+
+	var cc ClashConf
+	if err := doc.Decode(&cc); err != nil {
+		return false
+	}
+
+	patches := map[string]any{"external-controller": loopbackController(cc.ExternalController)}
+	if conf.ControllerMode == ControllerUnix && core.Name() == CoreMihomo {
+		patches["external-controller"] = ""
+		patches["external-controller-unix"] = CoreSocket()
+	}
+
+	// a failed patch leaves the config unchanged
+	root := cloneYAMLNode(doc.Content[0])
+	for _, key := range sortedKeys(patches) {
+		if err := setYamlValue(root, key, patches[key]); err != nil {
+			logrus.Errorf("[controller] %v", err)
+			return false
 		}
 	}
+	doc.Content[0] = root
+	return true
+}
 
-	bs, err := yaml.Marshal(&rootNode)
-	if err != nil {
-		logrus.Errorf("[autofix] failed to marshal yaml config: %v", err)
-		return c
+// loopbackController binds the controller address to the loopback.
+func loopbackController(addr string) string {
+	port := "9090"
+	if _, p, err := net.SplitHostPort(addr); err == nil && p != "" {
+		port = p
 	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
 
-	return string(bs)
+// setYamlValue sets the value of the dotted key, the missing mappings are
+// created.
+func setYamlValue(node *yaml.Node, key string, value any) error {
+	keys := strings.Split(key, ".")
+	var valueNode yaml.Node
+	if err := valueNode.Encode(map[string]any{keys[len(keys)-1]: value}); err != nil {
+		return fmt.Errorf("failed to encode %s: %w", key, err)
+	}
+	if !setYamlNode(node, key, &valueNode) {
+		return fmt.Errorf("failed to patch %s config", key)
+	}
+	return nil
 }
 
 func setYamlNode(node *yaml.Node, key string, value *yaml.Node) bool {
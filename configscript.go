@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	starjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+	"gopkg.in/yaml.v3"
+)
+
+// configScriptMaxSteps bounds a run of a config script, starlark has no access
+// to the files or the network so only a runaway loop can hold the reload.
+const configScriptMaxSteps = 50_000_000
+
+var configScriptOptions = &syntax.FileOptions{Set: true, While: true, TopLevelControl: true, GlobalReassign: true}
+
+// RunConfigScripts passes the rendered json config of sing-box through the
+// --config-script files in order. A failing script fails the config, a reload
+// keeps the running config instead of loading the config the script did not
+// mutate.
+func RunConfigScripts(c string) (string, error) {
+	for _, path := range conf.ConfigScripts {
+		var root yaml.Node
+		if err := decodeYAML(c, &root); err != nil {
+			return "", fmt.Errorf("[script] failed to parse the config for %s: %w", path, err)
+		}
+		thread, ret, err := runConfigScript(path, &root)
+		if err != nil {
+			return "", fmt.Errorf("[script] %w", err)
+		}
+		if ret == nil {
+			continue
+		}
+		encoded, err := starlark.Call(thread, starjson.Module.Members["encode"], starlark.Tuple{ret}, nil)
+		if err != nil {
+			return "", fmt.Errorf("[script] %w", scriptError(path, err))
+		}
+		var buf bytes.Buffer
+		if err = json.Indent(&buf, []byte(encoded.(starlark.String).GoString()), "", "  "); err != nil {
+			return "", fmt.Errorf("[script] %s: %w", path, err)
+		}
+		c = buf.String()
+	}
+	return c, nil
+}
+
+// patchConfigScripts is RunConfigScripts of the yaml configs, the document is
+// replaced by the config each script returns.
+func patchConfigScripts(doc *yaml.Node) (bool, error) {
+	var changed bool
+	for _, path := range conf.ConfigScripts {
+		_, ret, err := runConfigScript(path, doc)
+		if err != nil {
+			return false, fmt.Errorf("[script] %w", err)
+		}
+		if ret == nil {
+			continue
+		}
+		node, err := yamlNode(ret)
+		if err != nil {
+			return false, fmt.Errorf("[script] %s: %w", path, err)
+		}
+		doc.Content = []*yaml.Node{node}
+		changed = true
+	}
+	return changed, nil
+}
+
+// runConfigScript calls mutate of the script with the config, the returned
+// config is nil if the document is empty.
+func runConfigScript(path string, doc *yaml.Node) (*starlark.Thread, starlark.Value, error) {
+	if len(doc.Content) == 0 {
+		return nil, nil, nil
+	}
+	config, err := starlarkValue(doc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to convert the config for %s: %w", path, err)
+	}
+
+	thread, mutate, err := loadConfigScript(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	start := time.Now()
+	ret, err := starlark.Call(thread, mutate, starlark.Tuple{config}, nil)
+	if err != nil {
+		return nil, nil, scriptError(path, err)
+	}
+	if ret == starlark.None {
+		// mutated in place
+		ret = config
+	}
+	if _, ok := ret.(*starlark.Dict); !ok {
+		return nil, nil, fmt.Errorf("%s: mutate must return a dict or None, got %s", path, ret.Type())
+	}
+	logrus.Debugf("[script] %s done in %s", filepath.Base(path), time.Since(start).Round(time.Millisecond))
+	return thread, ret, nil
+}
+
+// loadConfigScript executes the top level of the script and returns its
+// mutate function.
+func loadConfigScript(path string) (*starlark.Thread, starlark.Callable, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read the config script: %w", err)
+	}
+	name := filepath.Base(path)
+	thread := &starlark.Thread{
+		Name:  name,
+		Print: func(_ *starlark.Thread, msg string) { logrus.Infof("[script] %s: %s", name, msg) },
+	}
+	thread.SetMaxExecutionSteps(configScriptMaxSteps)
+	predeclared := starlark.StringDict{
+		"core":  starlark.String(core.Name()),
+		"json":  starjson.Module,
+		"match": starlark.NewBuiltin("match", scriptMatch),
+	}
+	globals, err := starlark.ExecFileOptions(configScriptOptions, thread, path, src, predeclared)
+	if err != nil {
+		return nil, nil, scriptError(path, err)
+	}
+	mutate, ok := globals["mutate"].(starlark.Callable)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: the script must define mutate(config)", path)
+	}
+	return thread, mutate, nil
+}
+
+// scriptMatch reports whether the string contains a match of the go regexp.
+func scriptMatch(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pattern, s string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &pattern, &s); err != nil {
+		return nil, err
+	}
+	matched, err := regexp.MatchString(pattern, s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return starlark.Bool(matched), nil
+}
+
+func scriptError(path string, err error) error {
+	var evalErr *starlark.EvalError
+	if errors.As(err, &evalErr) {
+		return fmt.Errorf("config script failed:\n%s", evalErr.Backtrace())
+	}
+	return fmt.Errorf("config script %s failed: %w", path, err)
+}
+
+// starlarkValue converts a yaml node to starlark values, the order of the
+// mappings is kept and the anchors are expanded.
+func starlarkValue(n *yaml.Node) (starlark.Value, error) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		return starlarkValue(n.Content[0])
+	case yaml.AliasNode:
+		return starlarkValue(n.Alias)
+	case yaml.SequenceNode:
+		elems := make([]starlark.Value, 0, len(n.Content))
+		for _, c := range n.Content {
+			v, err := starlarkValue(c)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, v)
+		}
+		return starlark.NewList(elems), nil
+	case yaml.MappingNode:
+		dict := starlark.NewDict(len(n.Content) / 2)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if k.Tag == "!!merge" {
+				if err := mergeStarlark(dict, v); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			key, err := starlarkValue(k)
+			if err != nil {
+				return nil, err
+			}
+			value, err := starlarkValue(v)
+			if err != nil {
+				return nil, err
+			}
+			if err = dict.SetKey(key, value); err != nil {
+				return nil, fmt.Errorf("line %d: %w", k.Line, err)
+			}
+		}
+		return dict, nil
+	}
+
+	switch n.ShortTag() {
+	case "!!null":
+		return starlark.None, nil
+	case "!!bool":
+		var b bool
+		if err := n.Decode(&b); err == nil {
+			return starlark.Bool(b), nil
+		}
+	case "!!int":
+		var i int64
+		if err := n.Decode(&i); err == nil {
+			return starlark.MakeInt64(i), nil
+		}
+	case "!!float":
+		var f float64
+		if err := n.Decode(&f); err == nil {
+			return starlark.Float(f), nil
+		}
+	}
+	return starlark.String(n.Value), nil
+}
+
+// mergeStarlark adds the keys of the merged mappings(<<: *anchor) missing in
+// dict, the keys of the mapping itself take precedence.
+func mergeStarlark(dict *starlark.Dict, n *yaml.Node) error {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	merged := []*yaml.Node{n}
+	if n.Kind == yaml.SequenceNode {
+		merged = n.Content
+	}
+	for _, m := range merged {
+		v, err := starlarkValue(m)
+		if err != nil {
+			return err
+		}
+		md, ok := v.(*starlark.Dict)
+		if !ok {
+			return fmt.Errorf("line %d: only mappings can be merged", m.Line)
+		}
+		for _, item := range md.Items() {
+			if _, found, _ := dict.Get(item[0]); !found {
+				_ = dict.SetKey(item[0], item[1])
+			}
+		}
+	}
+	return nil
+}
+
+// yamlNode converts the value returned by a script back to a yaml node.
+func yamlNode(v starlark.Value) (*yaml.Node, error) {
+	n := &yaml.Node{}
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+	case starlark.Bool:
+		return n, n.Encode(bool(v))
+	case starlark.Int:
+		if i, ok := v.Int64(); ok {
+			return n, n.Encode(i)
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: v.String()}, nil
+	case starlark.Float:
+		return n, n.Encode(float64(v))
+	case starlark.String:
+		return n, n.Encode(string(v))
+	case *starlark.Dict:
+		n.Kind, n.Tag = yaml.MappingNode, "!!map"
+		for _, item := range v.Items() {
+			k, err := yamlNode(item[0])
+			if err != nil {
+				return nil, err
+			}
+			value, err := yamlNode(item[1])
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, k, value)
+		}
+		return n, nil
+	case starlark.Indexable:
+		// lists and tuples
+		n.Kind, n.Tag = yaml.SequenceNode, "!!seq"
+		for i := 0; i < v.Len(); i++ {
+			elem, err := yamlNode(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, elem)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("the %s value %s can not be written to the config", v.Type(), v)
+}
+
+// CheckConfigScriptConf loads the --config-script files so a broken script
+// is reported at the start rather than on the first reload.
+func CheckConfigScriptConf() error {
+	for _, path := range conf.ConfigScripts {
+		if _, _, err := loadConfigScript(path); err != nil {
+			return fmt.Errorf("[script] %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// expectations of a connectivity probe, any other value names a proxy that
+// must be in the chain
+const (
+	ExpectDirect = "direct"
+	ExpectProxy  = "proxy"
+	ExpectReject = "reject"
+)
+
+var connectivityOpts struct {
+	probes  []string
+	file    string
+	timeout time.Duration
+}
+
+// the default probes, a url that must go via the proxy and a domestic one
+// that must go direct
+var defaultProbes = []string{
+	"http://www.gstatic.com/generate_204 " + ExpectProxy,
+	"https://www.baidu.com " + ExpectDirect,
+}
+
+// ProbeResult is the result of a probe of the test-connectivity command.
+type ProbeResult struct {
+	URL         string   `json:"url"`
+	Expect      string   `json:"expect,omitempty"`
+	Status      int      `json:"status,omitempty"`
+	Rule        string   `json:"rule,omitempty"`
+	RulePayload string   `json:"rule_payload,omitempty"`
+	Chain       []string `json:"chain,omitempty"`
+	DurationMS  int64    `json:"duration_ms"`
+	Error       string   `json:"error,omitempty"`
+	OK          bool     `json:"ok"`
+}
+
+var testConnectivityCmd = &cobra.Command{
+	Use:   "test-connectivity",
+	Short: "Fetch the probe urls through the intercepted path and check the rules handling them",
+	Long: `Fetch the probe urls through the intercepted path and check the rules handling them.
+
+A probe is "URL [EXPECT]", the expectation is one of:
+
+  direct   the final outbound is DIRECT
+  proxy    the final outbound is a proxy(not DIRECT or REJECT)
+  reject   the request is rejected
+  <name>   the proxy or group is in the chain
+
+The probes are read from --probe and --probes(one per line, # for comments),
+a Google 204 url via the proxy and a domestic url going direct are used if
+none is specified.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if connectivityOpts.timeout <= 0 {
+			logrus.Fatal("[connectivity] timeout must be positive")
+		}
+		probes, err := loadProbes()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		api, err := RunningAPI()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if err = api.Do(http.MethodGet, "/version", nil, nil); err != nil {
+			logrus.Fatalf("[connectivity] the clash api is not reachable: %v", err)
+		}
+
+		results := make([]ProbeResult, 0, len(probes))
+		var failed int
+		for _, p := range probes {
+			fields := strings.Fields(p)
+			r := runProbe(api, fields[0], strings.Join(fields[1:], " "))
+			if !r.OK {
+				failed++
+			}
+			results = append(results, r)
+		}
+
+		if jsonOutput() {
+			printJSON(results)
+		} else {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			_, _ = fmt.Fprintln(w, "URL\tSTATUS\tRULE\tCHAIN\tEXPECT\tRESULT")
+			for _, r := range results {
+				status, rule, result := "-", r.Rule, "ok"
+				if r.Status > 0 {
+					status = fmt.Sprint(r.Status)
+				}
+				if r.RulePayload != "" {
+					rule += "," + r.RulePayload
+				}
+				if !r.OK {
+					result = "unexpected"
+					if r.Error != "" {
+						result += ": " + r.Error
+					}
+				}
+				_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.URL, status, rule, strings.Join(r.Chain, " -> "), r.Expect, result)
+			}
+			_ = w.Flush()
+		}
+		if failed > 0 {
+			logrus.Fatalf("[connectivity] %d of %d probes did not meet the expectation", failed, len(results))
+		}
+	},
+}
+
+// loadProbes returns the probes of the flags and the file.
+func loadProbes() ([]string, error) {
+	probes := slices.Clone(connectivityOpts.probes)
+	if connectivityOpts.file != "" {
+		f, err := os.Open(connectivityOpts.file)
+		if err != nil {
+			return nil, fmt.Errorf("[connectivity] failed to open probes file: %w", err)
+		}
+		defer func() { _ = f.Close() }()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if line := strings.TrimSpace(s.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				probes = append(probes, line)
+			}
+		}
+		if err = s.Err(); err != nil {
+			return nil, fmt.Errorf("[connectivity] failed to read probes file: %w", err)
+		}
+	}
+	if len(probes) == 0 {
+		probes = defaultProbes
+	}
+
+	for _, p := range probes {
+		if u := strings.Fields(p); len(u) == 0 || !strings.HasPrefix(u[0], "http://") && !strings.HasPrefix(u[0], "https://") {
+			return nil, fmt.Errorf("[connectivity] invalid probe %q, must be an http(s) url", p)
+		}
+	}
+	return probes, nil
+}
+
+// runProbe fetches the url directly, the connection is looked up in the
+// connections api for the rule and the chain handling it.
+func runProbe(api *ClashAPI, u, expect string) ProbeResult {
+	r := ProbeResult{URL: u, Expect: expect}
+
+	var mu sync.Mutex
+	var local net.Addr
+	dialer := &net.Dialer{Timeout: connectivityOpts.timeout}
+	t := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err == nil {
+				mu.Lock()
+				local = conn.LocalAddr()
+				mu.Unlock()
+			}
+			return conn, err
+		},
+		TLSHandshakeTimeout: connectivityOpts.timeout,
+	}
+	defer t.CloseIdleConnections()
+	cli := &http.Client{
+		Timeout:       connectivityOpts.timeout,
+		Transport:     t,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	start := time.Now()
+	resp, err := cli.Get(u)
+	r.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		r.Error = redactErr(err).Error()
+		r.OK = strings.EqualFold(expect, ExpectReject)
+		return r
+	}
+	r.Status = resp.StatusCode
+
+	// the connection is still open while the body is not read
+	mu.Lock()
+	addr := local
+	mu.Unlock()
+	c, err := waitSmokeConn(api, "tcp", addr)
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	_ = resp.Body.Close()
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.Rule, r.RulePayload, r.Chain = c.Rule, c.RulePayload, c.Route()
+	r.OK = probeExpected(c, expect)
+	return r
+}
+
+// probeExpected reports whether the connection meets the expectation, a probe
+// without an expectation only has to be handled by the core.
+func probeExpected(c clashConn, expect string) bool {
+	final := ""
+	if len(c.Chains) > 0 {
+		final = strings.ToUpper(c.Chains[0])
+	}
+	switch strings.ToLower(expect) {
+	case "":
+		return true
+	case ExpectDirect:
+		return final == "DIRECT"
+	case ExpectReject:
+		return strings.HasPrefix(final, "REJECT")
+	case ExpectProxy:
+		return proxiedOutbound(c.Chains)
+	}
+	return slices.Contains(c.Chains, expect)
+}
+
+func init() {
+	testConnectivityCmd.Flags().StringArrayVar(&connectivityOpts.probes, "probe", []string{}, "probe \"URL [direct|proxy|reject|PROXY]\"(repeatable)")
+	testConnectivityCmd.Flags().StringVar(&connectivityOpts.file, "probes", "", "read the probes from the file, one per line")
+	testConnectivityCmd.Flags().DurationVar(&connectivityOpts.timeout, "timeout", 10*time.Second, "timeout of each probe")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// connLogInterval is how often the connections are polled, a connection
+// is logged once it disappears from the connections api.
+const connLogInterval = time.Second
+
+// ConnRecord is a closed connection written to the connection log.
+type ConnRecord struct {
+	Time        time.Time `json:"time"`
+	Start       time.Time `json:"start"`
+	DurationMS  int64     `json:"duration_ms"`
+	Network     string    `json:"network"`
+	Type        string    `json:"type"`
+	Client      string    `json:"client"`
+	ClientName  string    `json:"client_name,omitempty"`
+	ClientMAC   string    `json:"client_mac,omitempty"`
+	ClientPort  string    `json:"client_port"`
+	Host        string    `json:"host,omitempty"`
+	DestIP      string    `json:"dest_ip"`
+	DestPort    string    `json:"dest_port"`
+	Rule        string    `json:"rule"`
+	RulePayload string    `json:"rule_payload,omitempty"`
+	Chain       []string  `json:"chain"`
+	Upload      uint64    `json:"upload"`
+	Download    uint64    `json:"download"`
+}
+
+// WatchConnLog writes the closed connections to --conn-log as JSON Lines.
+// The bytes of a connection are the ones seen at the last poll before it closed.
+func WatchConnLog(ctx context.Context) {
+	if conf.ConnLog == "" {
+		return
+	}
+	if conf.ConnLogSample <= 0 || conf.ConnLogSample > 1 {
+		logrus.Errorf("[connlog] invalid sample rate %v, must be in (0, 1]", conf.ConnLogSample)
+		return
+	}
+
+	w, err := newRotateWriter(conf.ConnLog, int64(conf.ConnLogMaxSize)<<20, conf.ConnLogMaxFiles)
+	if err != nil {
+		logrus.Errorf("[connlog] failed to open connection log: %v", err)
+		return
+	}
+	defer func() { _ = w.Close() }()
+	enc := json.NewEncoder(w)
+
+	logrus.Infof("[connlog] logging connections to %s, sample rate: %v", conf.ConnLog, conf.ConnLogSample)
+	active := map[string]clashConn{}
+	ticker := time.NewTicker(connLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		api, err := RunningAPI()
+		if err != nil {
+			logrus.Debug(err)
+			continue
+		}
+		var resp struct {
+			Connections []clashConn `json:"connections"`
+		}
+		if err = api.Do("GET", "/connections", nil, &resp); err != nil {
+			logrus.Debugf("[connlog] failed to get connections: %v", err)
+			continue
+		}
+
+		now := time.Now()
+		current := make(map[string]clashConn, len(resp.Connections))
+		for _, c := range resp.Connections {
+			if sampled(c.ID) {
+				current[c.ID] = c
+			}
+		}
+		for id, c := range active {
+			if _, ok := current[id]; ok {
+				continue
+			}
+			if err = enc.Encode(connRecord(c, now)); err != nil {
+				logrus.Errorf("[connlog] failed to write connection log: %v", err)
+			}
+		}
+		active = current
+	}
+}
+
+// sampled decides by the connection id, so a connection is either always or
+// never logged.
+func sampled(id string) bool {
+	if conf.ConnLogSample >= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return float64(h.Sum32()) < conf.ConnLogSample*math.MaxUint32
+}
+
+func connRecord(c clashConn, end time.Time) ConnRecord {
+	lease, _ := LookupLease(c.Metadata.SourceIP)
+	return ConnRecord{
+		Time:        end,
+		Start:       c.Start,
+		DurationMS:  end.Sub(c.Start).Milliseconds(),
+		Network:     c.Metadata.Network,
+		Type:        c.Metadata.Type,
+		Client:      c.Metadata.SourceIP,
+		ClientName:  lease.Hostname,
+		ClientMAC:   lease.MAC,
+		ClientPort:  c.Metadata.SourcePort,
+		Host:        c.Metadata.Host,
+		DestIP:      c.Metadata.DestinationIP,
+		DestPort:    c.Metadata.DestinationPort,
+		Rule:        c.Rule,
+		RulePayload: c.RulePayload,
+		Chain:       c.Route(),
+		Upload:      c.Upload,
+		Download:    c.Download,
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var connsOpts struct {
+	client string
+	host   string
+	proxy  string
+	kill   bool
+	json   bool
+}
+
+// clashConn is an active connection returned by the clash api.
+type clashConn struct {
+	ID       string `json:"id"`
+	Metadata struct {
+		Network         string `json:"network"`
+		Type            string `json:"type"`
+		SourceIP        string `json:"sourceIP"`
+		SourcePort      string `json:"sourcePort"`
+		DestinationIP   string `json:"destinationIP"`
+		DestinationPort string `json:"destinationPort"`
+		Host            string `json:"host"`
+	} `json:"metadata"`
+	Upload      uint64    `json:"upload"`
+	Download    uint64    `json:"download"`
+	Start       time.Time `json:"start"`
+	Chains      []string  `json:"chains"`
+	Rule        string    `json:"rule"`
+	RulePayload string    `json:"rulePayload"`
+}
+
+// Destination returns the host(or ip) and port of the connection.
+func (c clashConn) Destination() string {
+	host := c.Metadata.Host
+	if host == "" {
+		host = c.Metadata.DestinationIP
+	}
+	return net.JoinHostPort(host, c.Metadata.DestinationPort)
+}
+
+// Route returns the proxy chain in the order of the traffic, the api lists
+// the final proxy first.
+func (c clashConn) Route() []string {
+	chain := make([]string, 0, len(c.Chains))
+	for i := len(c.Chains) - 1; i >= 0; i-- {
+		chain = append(chain, c.Chains[i])
+	}
+	return chain
+}
+
+// Chain returns the joined proxy chain in the order of the traffic.
+func (c clashConn) Chain() string {
+	return strings.Join(c.Route(), " -> ")
+}
+
+var connsCmd = &cobra.Command{
+	Use:   "conns [ID...]",
+	Short: "List or kill the active connections of the core",
+	Run: func(cmd *cobra.Command, args []string) {
+		api, err := RunningAPI()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		var resp struct {
+			Connections []clashConn `json:"connections"`
+		}
+		if err = api.Do("GET", "/connections", nil, &resp); err != nil {
+			logrus.Fatalf("[conns] failed to get connections: %v", err)
+		}
+
+		conns := filterConns(resp.Connections, args)
+		sort.Slice(conns, func(i, j int) bool { return conns[i].Start.Before(conns[j].Start) })
+
+		if connsOpts.kill {
+			if len(args) == 0 && connsOpts.client == "" && connsOpts.host == "" && connsOpts.proxy == "" {
+				logrus.Fatal("[conns] specify connection ids or filters(--client/--host/--proxy) to kill connections")
+			}
+			var failed int
+			for _, c := range conns {
+				err = api.Do("DELETE", "/connections/"+url.PathEscape(c.ID), nil, nil)
+				Audit(AuditSourceCLI, "", "conns.kill", c.ID+" "+c.Destination(), err)
+				if err != nil {
+					logrus.Errorf("[conns] failed to kill connection %s: %v", c.ID, err)
+					failed++
+					continue
+				}
+				logrus.Infof("[conns] killed %s %s(%s) -> %s", c.ID, net.JoinHostPort(c.Metadata.SourceIP, c.Metadata.SourcePort), orDash(ClientName(c.Metadata.SourceIP)), c.Destination())
+			}
+			if failed > 0 {
+				logrus.Fatalf("[conns] failed to kill %d connections", failed)
+			}
+			return
+		}
+
+		if connsOpts.json || jsonOutput() {
+			printJSON(conns)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		defer func() { _ = w.Flush() }()
+
+		_, _ = fmt.Fprintln(w, "ID\tCLIENT\tDESTINATION\tNETWORK\tCHAIN\tRULE\tUP\tDOWN\tDURATION")
+		for _, c := range conns {
+			rule := c.Rule
+			if c.RulePayload != "" {
+				rule += "," + c.RulePayload
+			}
+			_, _ = fmt.Fprintf(w, "%.8s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				c.ID, clientLabel(c.Metadata.SourceIP), c.Destination(), c.Metadata.Network, c.Chain(), rule,
+				humanBytes(c.Upload), humanBytes(c.Download), since(c.Start))
+		}
+	},
+}
+
+// filterConns returns the connections matching the id prefixes and the filters.
+func filterConns(conns []clashConn, ids []string) []clashConn {
+	var matched []clashConn
+	for _, c := range conns {
+		if len(ids) > 0 {
+			var found bool
+			for _, id := range ids {
+				if strings.HasPrefix(c.ID, id) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		if connsOpts.client != "" && c.Metadata.SourceIP != connsOpts.client && !strings.EqualFold(ClientName(c.Metadata.SourceIP), connsOpts.client) {
+			continue
+		}
+		if connsOpts.host != "" && !strings.Contains(c.Destination(), connsOpts.host) {
+			continue
+		}
+		if connsOpts.proxy != "" && !containsFold(c.Chains, connsOpts.proxy) {
+			continue
+		}
+		matched = append(matched, c)
+	}
+	return matched
+}
+
+func containsFold(ss []string, s string) bool {
+	for _, v := range ss {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	connsCmd.Flags().StringVar(&connsOpts.client, "client", "", "only the connections of the specified client ip or dhcp hostname")
+	connsCmd.Flags().StringVar(&connsOpts.host, "host", "", "only the connections whose destination contains the specified string")
+	connsCmd.Flags().StringVar(&connsOpts.proxy, "proxy", "", "only the connections through the specified proxy or group")
+	connsCmd.Flags().BoolVar(&connsOpts.kill, "kill", false, "close the selected connections")
+	connsCmd.Flags().BoolVar(&connsOpts.json, "json", false, "print the connections as json")
+}
@@ -17,12 +17,77 @@ const (
 )
 
 const (
-	ChainDockerUser = "DOCKER-USER" // https://docs.docker.com/network/packet-filtering-firewalls/#docker-on-a-router
+	ChainDockerUser         = "DOCKER-USER"      // https://docs.docker.com/network/packet-filtering-firewalls/#docker-on-a-router
+	ChainNetavarkForward    = "NETAVARK_FORWARD" // podman netavark iptables driver
+	ChainCNIForward         = "CNI-FORWARD"      // podman cni firewall plugin
+	TableNetavark           = "netavark"         // podman netavark nftables driver
+	ChainNetavarkNFTForward = "FORWARD"
+)
+
+const (
+	TableTPClash = "tpclash"
+	ChainBypass  = "bypass"
+	SetBypassSrc = "bypass_src"
+
+	SetUDPKeepDst = "udp_keep_dst"
+	SetLAN6Dst    = "lan6_dst"
+
+	ChainDNSRedirect  = "dns_redirect"
+	SetDNSRedirectSrc = "dns_redirect_src"
+	ChainDNSFallback  = "dns_fallback"
+
+	dockerEmbeddedDNS = "127.0.0.11"
+
+	// k8s-init runs in the pod network namespace, a separate table keeps the
+	// sidecar from touching it
+	TablePod       = "tpclash_pod"
+	ChainPodOutput = "output"
+	SetPodExclude  = "pod_exclude"
+
+	TableCNI           = "tpclash_cni"
+	ChainCNIPrerouting = "prerouting"
+	SetCNIPods         = "cni_pods"
+	SetCNIExclude      = "cni_exclude"
+	cniLockFile        = "/run/tpclash-cni.lock"
+
+	// Packets from bypass sources are marked and looked up in the main table
+	// before the clash policy routing takes effect
+	BypassMark         = 0x7470
+	BypassRulePriority = 8999
+)
+
+const (
+	LabelProxy = "tpclash.proxy" // set to false to exclude the container from transparent proxy
 )
 
 const (
 	InternalClashBinName = "xclash"
 	InternalConfigName   = "xclash.yaml"
+
+	InternalSingBoxBinName    = "xsing-box"
+	InternalSingBoxConfigName = "xsing-box.json"
+
+	pidFileName          = "tpclash.pid"
+	extractManifestName  = ".extract.sha256"
+	uiVersionFile        = ".tpclash-ui-version"
+	customUIDir          = "custom-ui"
+	secretFileName       = "controller.secret"
+	controllerSocketName = "controller.sock"
+	coreSocketName       = "core.sock"
+	coreRuntimeDir       = "/run/tpclash"
+	stateFileName        = "tpclash.state"
+	modeFileName         = "tpclash.mode"
+	clientStatsFileName  = "tpclash.clients"
+	budgetStateFileName  = "tpclash.budget"
+	proxyHistoryFileName = "proxy-history.jsonl"
+	acmeCacheDir         = "acme"
+	rulesetDir           = "rulesets"
+	tokensFileName       = "tpclash.tokens"
+	auditFileName        = "audit.jsonl"
+	sysctlBackupName     = "sysctl.orig"
+	configCacheName      = "remote-config.cache"
+	haStateFileName      = "tpclash.ha"
+	webhookOutboxName    = "webhook-outbox.json"
 )
 
 const (
@@ -82,6 +147,95 @@ routing-mark: 666
 `
 )
 
+const (
+	enforceDNSListen          = "0.0.0.0:1053"
+	enforceFakeIPRange        = "198.18.0.1/16"
+	enforceExternalController = "127.0.0.1:9090"
+	enforceRoutingMark        = 666
+	enforceTProxyPort         = 7893
+)
+
+// initConfigTpl is the clash config generated by `tpclash init`, it uses the
+// [[ ]] delimiters since the result is rendered by tpclash again on load.
+const initConfigTpl = `# Generated by tpclash init
+mixed-port: 7890
+allow-lan: true
+bind-address: '*'
+mode: rule
+log-level: info
+ipv6: false
+external-controller: 127.0.0.1:9090
+secret: "[[.Secret]]"
+
+profile:
+  store-selected: true
+  store-fake-ip: true
+
+tun:
+  enable: true
+  stack: system
+  dns-hijack:
+    - any:53
+  auto-route: true
+  auto-redir: true
+  auto-detect-interface: true
+
+dns:
+  enable: true
+  listen: 0.0.0.0:1053
+  enhanced-mode: fake-ip
+  fake-ip-range: 198.18.0.1/16
+  fake-ip-filter:
+    - '*.lan'
+    - '*.local'
+  default-nameserver:
+    - 223.5.5.5
+    - 119.29.29.29
+  nameserver:
+    {{range $index, $server := DefaultDNS}}- {{$server}}
+    {{end}}
+
+proxy-providers:
+  subscription:
+    type: http
+    url: "[[.Subscription]]"
+    path: ./providers/subscription.yaml
+    interval: 3600
+    health-check:
+      enable: true
+      url: http://www.gstatic.com/generate_204
+      interval: 300
+
+proxy-groups:
+  - name: PROXY
+    type: select
+    proxies:
+      - AUTO
+    use:
+      - subscription
+  - name: AUTO
+    type: url-test
+    use:
+      - subscription
+    url: http://www.gstatic.com/generate_204
+    interval: 300
+
+rules:
+[[- range .BypassDomains]]
+  - DOMAIN-SUFFIX,[[.]],DIRECT
+[[- end]]
+[[- range .BypassCIDRs]]
+  - IP-CIDR,[[.]],DIRECT,no-resolve
+[[- end]]
+[[- if .BypassLAN]]
+  - GEOIP,LAN,DIRECT,no-resolve
+[[- end]]
+[[- if .BypassCN]]
+  - GEOIP,CN,DIRECT
+[[- end]]
+  - MATCH,PROXY
+`
+
 const systemdTpl = `[Unit]
 Description=Transparent proxy tool for Clash
 After=network.target
@@ -90,6 +244,7 @@ After=network.target
 Type=simple
 User=root
 Restart=on-failure
+EnvironmentFile=-/etc/tpclash/tpclash.env
 ExecStart=/usr/local/bin/tpclash%s
 
 RestartSec=10s
@@ -99,6 +254,8 @@ TimeoutStopSec=30s
 WantedBy=multi-user.target
 `
 
+const composeImage = "mritd/tpclash"
+
 const (
 	installDir = "/usr/local/bin"
 	systemdDir = "/etc/systemd/system"
@@ -118,44 +275,26 @@ const (
 	grafanaContainerName        = "tpclash-grafana"
 )
 
-const installedMessage = logo + `  👌 TPClash 安装完成, 您可以使用以下命令启动:
-     ● 启动服务: systemctl start tpclash
-     ● 停止服务: systemctl stop tpclash
-     ● 重启服务: systemctl restart tpclash
-     ● 开启自启动: systemctl enable tpclash
-     ● 关闭自启动: systemctl disable tpclash
-     ● 查看日志: journalctl -fu tpclash
-     ● 重载服务配置: systemctl daemon-reload
-`
-
-const reinstallMessage = `
-  ❗监测到您可能执行了重新安装, 重新启动前请执行重载服务配置.
-`
-
-const uninstallMessage = `  
-  ❗️在卸载前请务必先停止 TPClash
-  ❗️如果尚未停止请按 Ctrl+c 终止卸载
-  ❗️本卸序将会在 30s 后继续执行卸载命令
-
-`
-
-const uninstalledMessage = logo + `  👌 TPClash 已卸载, 如有任何问题请开启 issue 或从 Telegram 讨论组反馈
-     ● 官方仓库: https://github.com/mritd/tpclash
-     ● Telegram: https://t.me/tpclash
-`
-
 const (
 	githubLatestApi   = "https://api.github.com/repos/mritd/tpclash/releases/latest"
 	githubUpgradeAddr = "https://github.com/mritd/tpclash/releases/download/v%s/%s"
 	ghProxyAddr       = "https://ghproxy.com/"
+
+	githubReleaseApi  = "https://api.github.com/repos/%s/releases/%s"
+	githubReleasesApi = "https://api.github.com/repos/%s/releases?per_page=20"
+	tpclashRepo       = "mritd/tpclash"
+	mihomoRepo        = "MetaCubeX/mihomo"
+	singBoxRepo       = "SagerNet/sing-box"
 )
 
-const upgradedMessage = logo + `  👌 TPClash 已升级完成, 请重新启动以应用更改
-     ● 启动服务: systemctl start tpclash
-     ● 停止服务: systemctl stop tpclash
-     ● 重启服务: systemctl restart tpclash
-     ● 开启自启动: systemctl enable tpclash
-     ● 关闭自启动: systemctl disable tpclash
-     ● 查看日志: journalctl -fu tpclash
-     ● 重载服务配置: systemctl daemon-reload
-`
+const (
+	geoCountryMMDB = "Country.mmdb"
+	geoSiteDat     = "GeoSite.dat"
+	geoIPDat       = "GeoIP.dat"
+)
+
+var geoDefaultURLs = map[string]string{
+	geoCountryMMDB: "https://github.com/MetaCubeX/meta-rules-dat/releases/download/latest/country.mmdb",
+	geoSiteDat:     "https://github.com/MetaCubeX/meta-rules-dat/releases/download/latest/geosite.dat",
+	geoIPDat:       "https://github.com/MetaCubeX/meta-rules-dat/releases/download/latest/geoip.dat",
+}
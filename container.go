@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+// managedChildren are waited by their owners(e.g. the clash process), the
+// PID-1 reaper must leave them alone or exec.Cmd.Wait would fail with ECHILD.
+var managedChildren sync.Map
+
+// TrackChild marks pid as waited by its owner.
+func TrackChild(pid int) {
+	managedChildren.Store(pid, struct{}{})
+}
+
+// UntrackChild removes pid from the managed children.
+func UntrackChild(pid int) {
+	managedChildren.Delete(pid)
+}
+
+// childMu keeps the reaper out while a child is started and not yet tracked.
+var childMu sync.RWMutex
+
+// StartChild starts cmd and tracks it before the reaper can see it, the child
+// must be waited by WaitChild.
+func StartChild(cmd *exec.Cmd) error {
+	childMu.RLock()
+	defer childMu.RUnlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	TrackChild(cmd.Process.Pid)
+	return nil
+}
+
+// WaitChild waits a child started by StartChild.
+func WaitChild(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	UntrackChild(cmd.Process.Pid)
+	return err
+}
+
+// RunChild is exec.Cmd.Run of a tracked child.
+func RunChild(cmd *exec.Cmd) error {
+	if err := StartChild(cmd); err != nil {
+		return err
+	}
+	return WaitChild(cmd)
+}
+
+// ChildOutput is exec.Cmd.CombinedOutput of a tracked child.
+func ChildOutput(cmd *exec.Cmd) ([]byte, error) {
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := RunChild(cmd)
+	return out.Bytes(), err
+}
+
+// InContainer reports whether tpclash is running inside a container.
+func InContainer() bool {
+	for _, f := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(f); err == nil {
+			return true
+		}
+	}
+
+	bs, err := os.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		return false
+	}
+	for _, s := range []string{"docker", "kubepods", "containerd", "libpod"} {
+		if strings.Contains(string(bs), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckContainer verifies that the container is able to act as a gateway:
+// it must share the host network and be privileged enough to set sysctls and
+// nftables rules. PID-1 duties are taken over when there is no init process.
+func CheckContainer() {
+	logrus.Info("[container] running in container...")
+
+	if isBridgedNetwork() {
+		logrus.Warn("[container] container is not using host network, LAN clients can not use tpclash as gateway(--network=host)")
+	}
+	if !hasNetAdmin() {
+		logrus.Warn("[container] container is missing CAP_NET_ADMIN, please run with --privileged")
+	}
+	if unix.Access("/proc/sys/net/ipv4/ip_forward", unix.W_OK) != nil {
+		logrus.Warn("[container] /proc/sys is read only, sysctl can not be configured, please run with --privileged")
+	}
+	if !isMountPoint(conf.ClashHome) {
+		logrus.Warnf("[container] clash home %s is not a volume, caches and extracted files are lost when the container is recreated", conf.ClashHome)
+	}
+
+	if os.Getpid() == 1 {
+		logrus.Info("[container] running as PID 1, enable zombie process reaper...")
+		go reapChildren()
+	}
+}
+
+// isBridgedNetwork checks whether the default route goes through a veth, which
+// means the container has its own network namespace.
+func isBridgedNetwork() bool {
+	routes, err := netlink.RouteList(nil, unix.AF_INET)
+	if err != nil {
+		return false
+	}
+	for _, r := range routes {
+		if r.Dst != nil {
+			continue
+		}
+		link, err := netlink.LinkByIndex(r.LinkIndex)
+		if err != nil {
+			continue
+		}
+		return link.Type() == "veth"
+	}
+	return false
+}
+
+func hasNetAdmin() bool {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer func() { _ = f.Close() }()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+			return err == nil && caps&(1<<CAP_NET_ADMIN) != 0
+		}
+	}
+	return false
+}
+
+func isMountPoint(path string) bool {
+	bs, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	path = filepath.Clean(path)
+	for _, line := range strings.Split(string(bs), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		if mp := fields[4]; mp != "/" && (mp == path || strings.HasPrefix(path, mp+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// reapChildren reaps orphaned processes re-parented to tpclash when it runs as
+// PID 1, children started by StartChild are waited by their owners.
+func reapChildren() {
+	sigCh := make(chan os.Signal, 16)
+	signal.Notify(sigCh, unix.SIGCHLD)
+
+	for range sigCh {
+		childMu.Lock()
+		for _, pid := range zombieChildren() {
+			if _, ok := managedChildren.Load(pid); ok {
+				continue
+			}
+
+			var ws unix.WaitStatus
+			if _, err := unix.Wait4(pid, &ws, unix.WNOHANG, nil); err != nil {
+				continue
+			}
+			logrus.Debugf("[container] reaped orphan process %d: %d", pid, ws.ExitStatus())
+		}
+		childMu.Unlock()
+	}
+}
+
+// zombieChildren lists the exited but not yet waited children of tpclash.
+func zombieChildren() []int {
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+
+	var pids []int
+	for _, stat := range stats {
+		bs, err := os.ReadFile(stat)
+		if err != nil {
+			continue
+		}
+		// pid (comm) state ppid ..., comm may contain spaces
+		i := strings.LastIndexByte(string(bs), ')')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(string(bs[i+1:]))
+		if len(fields) < 2 || fields[0] != "Z" || fields[1] != strconv.Itoa(os.Getpid()) {
+			continue
+		}
+		if pid, err := strconv.Atoi(filepath.Base(filepath.Dir(stat))); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+var composeCmd = &cobra.Command{
+	Use:   "compose",
+	Short: "Print a docker-compose.yml with the current options",
+	Run: func(_ *cobra.Command, _ []string) {
+		volumes := []string{fmt.Sprintf("%s:%s", conf.ClashHome, conf.ClashHome)}
+		if !isRemoteConfig() {
+			volumes = append(volumes, fmt.Sprintf("%s:%s:ro", conf.ClashConfig, conf.ClashConfig))
+		}
+		if _, err := os.Stat(conf.ConfFile); err == nil {
+			volumes = append(volumes, fmt.Sprintf("%s:%s:ro", conf.ConfFile, conf.ConfFile))
+		}
+		if conf.EnableTracing {
+			volumes = append(volumes, "/var/run/docker.sock:/var/run/docker.sock")
+		}
+		if err := writeSecretFiles(rootCmd.PersistentFlags()); err != nil {
+			logrus.Fatalf("[compose] %v", err)
+		}
+		if _, err := os.Stat(secretDir); err == nil {
+			volumes = append(volumes, fmt.Sprintf("%s:%s:ro", secretDir, secretDir))
+		}
+		for _, name := range secretFlags {
+			if path := *secretFiles[name]; path != "" {
+				volumes = append(volumes, fmt.Sprintf("%s:%s:ro", path, path))
+			}
+		}
+
+		compose := map[string]any{
+			"services": map[string]any{
+				"tpclash": map[string]any{
+					"image":          composeImage,
+					"container_name": "tpclash",
+					"restart":        "unless-stopped",
+					"privileged":     true,
+					"network_mode":   "host",
+					"volumes":        volumes,
+					"command":        startArgs(),
+				},
+			},
+		}
+
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(compose); err != nil {
+			logrus.Fatalf("[compose] failed to marshal compose file: %v", err)
+		}
+	},
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ControllerSocket returns the unix socket of the clash api in unix mode.
+func ControllerSocket() string {
+	return filepath.Join(conf.ClashHome, controllerSocketName)
+}
+
+// CoreSocket returns the internal unix socket of the mihomo core in unix mode.
+// The core does not authenticate it, so it lives in a runtime dir accessible
+// to the user running the core only, the clash home when tpclash can not
+// create /run/tpclash.
+var CoreSocket = sync.OnceValue(func() string {
+	dir := coreRuntimeDir
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		dir = filepath.Join(conf.ClashHome, "run")
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			logrus.Errorf("[controller] failed to create the core socket dir: %v", err)
+		}
+	}
+	_ = os.Chmod(dir, 0700)
+	return filepath.Join(dir, coreSocketName)
+})
+
+// PrepareCoreSocket hands the dir of the core socket to the user running the
+// core, it must run before the privileges are dropped.
+func PrepareCoreSocket() error {
+	if conf.ControllerMode != ControllerUnix || core.Name() != CoreMihomo {
+		return nil
+	}
+	uid := -1
+	switch {
+	case conf.K8sSidecar:
+		uid = conf.K8sProxyUID
+	case conf.RunAs != "":
+		var err error
+		if uid, _, _, err = lookupRunAs(conf.RunAs); err != nil {
+			return err
+		}
+	}
+	if uid < 0 {
+		return nil
+	}
+	if err := os.Chown(filepath.Dir(CoreSocket()), uid, -1); err != nil {
+		return fmt.Errorf("[controller] failed to change owner of the core socket dir: %w", err)
+	}
+	return nil
+}
+
+// secureCoreSocket restricts the core socket to its owner once the core has
+// created it, the core creates it with the umask.
+func secureCoreSocket(ctx context.Context, sock string) {
+	for i := 0; i < 50; i++ {
+		if err := os.Chmod(sock, 0600); err == nil {
+			return
+		} else if !errors.Is(err, os.ErrNotExist) {
+			logrus.Errorf("[controller] failed to change mode of %s: %v", sock, err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	logrus.Warnf("[controller] the core socket %s was not created", sock)
+}
+
+// CheckControllerMode validates --controller-mode and --controller-policy.
+func CheckControllerMode() error {
+	switch conf.ControllerPolicy {
+	case ControllerPolicyLocalhost, ControllerPolicyLAN, ControllerPolicyOff:
+	default:
+		return fmt.Errorf("[controller] unsupported controller policy: %s(localhost|lan|off)", conf.ControllerPolicy)
+	}
+
+	switch conf.ControllerMode {
+	case "", ControllerLocalhost, ControllerUnix:
+	default:
+		return fmt.Errorf("[controller] unsupported controller mode: %s(localhost|unix)", conf.ControllerMode)
+	}
+
+	if conf.LANInterface != "" {
+		if _, err := net.InterfaceByName(conf.LANInterface); err != nil {
+			return fmt.Errorf("[controller] invalid --lan-interface %s: %w", conf.LANInterface, err)
+		}
+	}
+
+	socketAuth := len(conf.ControllerSocketUsers) > 0 || len(conf.ControllerSocketGroups) > 0 || conf.ControllerSocketToken != ""
+	if socketAuth && conf.ControllerMode != ControllerUnix {
+		return fmt.Errorf("[controller] --controller-socket-users/groups/token require --controller-mode unix")
+	}
+	return resolveSocketIDs()
+}
+
+// safeController rebinds the external controller listening on all addresses
+// without a secret according to --controller-policy, anyone on the network
+// could take over the core otherwise. --controller-mode takes precedence.
+func safeController(addr, secret string) string {
+	if conf.ControllerMode != "" || secret != "" || conf.ControllerPolicy == ControllerPolicyOff {
+		return addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return addr
+	}
+
+	safe := net.JoinHostPort("127.0.0.1", port)
+	if conf.ControllerPolicy == ControllerPolicyLAN {
+		lan, err := lanAddr()
+		if err != nil {
+			logrus.Errorf("[controller] failed to detect the lan address, bind to the loopback: %v", err)
+		} else {
+			safe = net.JoinHostPort(lan.String(), port)
+		}
+	}
+	logrus.Warnf("[controller] ⚠️ the clash api %s is exposed on all addresses without a secret, rebind to %s(--controller-policy)", addr, safe)
+	return safe
+}
+
+// lanAddr returns the ipv4 address of --lan-interface, or of the first lan
+// interface with a private address. The default route goes to the wan on a
+// router, its interface is only used by the hosts with a single interface.
+func lanAddr() (net.IP, error) {
+	if conf.LANInterface != "" {
+		link, err := netlink.LinkByName(conf.LANInterface)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find --lan-interface %s: %w", conf.LANInterface, err)
+		}
+		if ip := linkAddr4(link, false); ip != nil {
+			return ip, nil
+		}
+		return nil, fmt.Errorf("--lan-interface %s has no ipv4 address", conf.LANInterface)
+	}
+
+	wan := -1
+	if routes, err := netlink.RouteGet(net.IPv4(1, 1, 1, 1)); err == nil && len(routes) > 0 {
+		wan = routes[0].LinkIndex
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		attrs := link.Attrs()
+		if attrs.Index == wan || attrs.Flags&net.FlagLoopback != 0 || attrs.Flags&net.FlagUp == 0 || link.Type() == "tuntap" {
+			continue
+		}
+		if ip := linkAddr4(link, true); ip != nil {
+			return ip, nil
+		}
+	}
+	if wan > 0 {
+		if link, err := netlink.LinkByIndex(wan); err == nil {
+			if ip := linkAddr4(link, false); ip != nil {
+				return ip, nil
+			}
+		}
+	}
+	return nil, errors.New("no lan interface")
+}
+
+// linkAddr4 returns the first ipv4 address of link.
+func linkAddr4(link netlink.Link, private bool) net.IP {
+	addrs, err := netlink.AddrList(link, unix.AF_INET)
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if !private || a.IP.IsPrivate() {
+			return a.IP
+		}
+	}
+	return nil
+}
+
+// SetControllerTarget updates the clash api fronted by the socket and the
+// dashboard proxy.
+func SetControllerTarget(cc *ClashConf) {
+	controllerAPI.Store(NewClashAPI(cc))
+}
+
+// peerCredKey is the context key of the credentials of the socket client.
+type peerCredKey struct{}
+
+// the uids and gids allowed to use the controller socket besides root and
+// the user running tpclash
+var controllerSocketUIDs, controllerSocketGIDs []uint32
+
+// ServeControllerSocket fronts the clash api with a unix socket in the clash
+// home. The socket is accessible to root only, unless users or groups are
+// allowed by --controller-socket-users/--controller-socket-groups, they are
+// identified by the peer credentials of the connection. The clients must
+// present --controller-socket-token as the bearer token if it is set, the
+// secret of the core is added by tpclash then.
+func ServeControllerSocket(ctx context.Context, cc *ClashConf) error {
+	SetControllerTarget(cc)
+
+	sock := ControllerSocket()
+	_ = os.Remove(sock)
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		return fmt.Errorf("[controller] failed to listen on %s: %w", sock, err)
+	}
+	mode := os.FileMode(0600)
+	if len(controllerSocketUIDs) > 0 || len(controllerSocketGIDs) > 0 {
+		mode = 0666
+	}
+	if err = os.Chmod(sock, mode); err != nil {
+		_ = ln.Close()
+		return fmt.Errorf("[controller] failed to change mode of %s: %w", sock, err)
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			api := controllerAPI.Load()
+			host := api.Addr
+			if strings.HasPrefix(host, "unix:") {
+				host = "unix"
+			}
+			r.SetURL(&url.URL{Scheme: "http", Host: host})
+			if conf.ControllerSocketToken == "" {
+				return
+			}
+			r.Out.Header.Del("Authorization")
+			if api.secret != "" {
+				r.Out.Header.Set("Authorization", "Bearer "+api.secret)
+			}
+		},
+		Transport: dashboardTransport{},
+	}
+	srv := &http.Server{
+		Handler: controllerSocketAuth(proxy),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if cred, err := peerCred(c); err == nil {
+				return context.WithValue(ctx, peerCredKey{}, cred)
+			}
+			return ctx
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+		_ = os.Remove(sock)
+	}()
+
+	logrus.Infof("[controller] clash api is served on unix socket %s", sock)
+	if err = srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("[controller] controller socket error: %w", err)
+	}
+	return nil
+}
+
+func controllerSocketAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred, ok := r.Context().Value(peerCredKey{}).(*unix.Ucred)
+		if !ok {
+			http.Error(w, "unknown peer", http.StatusForbidden)
+			return
+		}
+		user := fmt.Sprintf("uid:%d", cred.Uid)
+		if !peerAllowed(cred) {
+			logrus.Warnf("[controller] rejected %s %s from %s(pid %d): not allowed", r.Method, r.URL.Path, user, cred.Pid)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if t := conf.ControllerSocketToken; t != "" {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) != 1 {
+				logrus.Warnf("[controller] rejected %s %s from %s(pid %d): invalid token", r.Method, r.URL.Path, user, cred.Pid)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		serveAudited(next, w, r, user)
+	})
+}
+
+// peerCred returns the credentials of the process connected to the socket.
+func peerCred(c net.Conn) (*unix.Ucred, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("not a unix connection")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// peerAllowed checks the peer against the allowed users and groups, the
+// supplementary groups of the peer user are taken into account.
+func peerAllowed(cred *unix.Ucred) bool {
+	if cred.Uid == 0 || int(cred.Uid) == os.Getuid() {
+		return true
+	}
+	if slices.Contains(controllerSocketUIDs, cred.Uid) || slices.Contains(controllerSocketGIDs, cred.Gid) {
+		return true
+	}
+	if len(controllerSocketGIDs) == 0 {
+		return false
+	}
+	u, err := user.LookupId(strconv.Itoa(int(cred.Uid)))
+	if err != nil {
+		return false
+	}
+	ids, _ := u.GroupIds()
+	for _, id := range ids {
+		if gid, err := strconv.ParseUint(id, 10, 32); err == nil && slices.Contains(controllerSocketGIDs, uint32(gid)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSocketIDs translates the allowed user and group names to ids.
+func resolveSocketIDs() error {
+	controllerSocketUIDs, controllerSocketGIDs = nil, nil
+	for _, name := range conf.ControllerSocketUsers {
+		id := name
+		if _, err := strconv.ParseUint(name, 10, 32); err != nil {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return fmt.Errorf("[controller] unknown user %s: %w", name, err)
+			}
+			id = u.Uid
+		}
+		uid, _ := strconv.ParseUint(id, 10, 32)
+		controllerSocketUIDs = append(controllerSocketUIDs, uint32(uid))
+	}
+	for _, name := range conf.ControllerSocketGroups {
+		id := name
+		if _, err := strconv.ParseUint(name, 10, 32); err != nil {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return fmt.Errorf("[controller] unknown group %s: %w", name, err)
+			}
+			id = g.Gid
+		}
+		gid, _ := strconv.ParseUint(id, 10, 32)
+		controllerSocketGIDs = append(controllerSocketGIDs, uint32(gid))
+	}
+	return nil
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ControllerLocalhost = "localhost"
+	ControllerUnix      = "unix"
+)
+
+// policies of the external controller exposed without a secret
+const (
+	ControllerPolicyLocalhost = "localhost"
+	ControllerPolicyLAN       = "lan"
+	ControllerPolicyOff       = "off"
+)
+
+const (
+	CorePremium = "premium"
+	CoreMihomo  = "mihomo"
+	CoreSingBox = "sing-box"
+)
+
+// coreDownloadTimeout bounds a download of a core archive, it is far larger
+// than a config.
+const coreDownloadTimeout = 10 * time.Minute
+
+// Core is a proxy core supervised by tpclash. Whatever the backend is, the
+// core must expose the settings tpclash relies on(dns, api, tun) as ClashConf,
+// so the interception rules and the dashboard work the same in front of it.
+type Core interface {
+	// Name returns the core flavor
+	Name() string
+	// Binary returns the path of the core executable, it may be downloaded
+	Binary() (string, error)
+	// ConfigName returns the name of the internal config file in the clash home
+	ConfigName() string
+	// Args returns the command line arguments to run the core in home
+	Args(confPath, home string) []string
+	// Fix renders and patches the raw config before it is checked, it runs the
+	// enabled stages of Stages
+	Fix(c string) (string, error)
+	// Stages returns the config pipeline of the core in the default order
+	Stages() []configStage
+	// Parse translates the config to ClashConf without validation
+	Parse(c string) (*ClashConf, error)
+	// Check validates the config and translates it to ClashConf
+	Check(c string) (*ClashConf, error)
+	// Reload applies the config written to confPath to the running core
+	Reload(confPath string, cc *ClashConf, proc *os.Process) error
+	// PatchSecret replaces the clash api secret of the config
+	PatchSecret(c, secret string) (string, error)
+	// Redact masks the credentials of the config for display
+	Redact(c string) (string, error)
+}
+
+// core is the core selected by --core.
+var core Core
+
+// NewCore creates the core selected by --core.
+func NewCore() (Core, error) {
+	switch flavor := CoreFlavor(); flavor {
+	case CorePremium:
+		return &clashCore{flavor: flavor}, nil
+	case CoreMihomo:
+		return &mihomoCore{clashCore{flavor: flavor}}, nil
+	case CoreSingBox:
+		return &singBoxCore{}, nil
+	default:
+		return nil, fmt.Errorf("[core] unsupported core: %s(premium|mihomo|sing-box)", flavor)
+	}
+}
+
+// clashCore is the clash premium or mihomo core.
+type clashCore struct {
+	flavor string
+}
+
+func (c *clashCore) Name() string {
+	return c.flavor
+}
+
+func (c *clashCore) Binary() (string, error) {
+	if c.flavor != embeddedCore() {
+		return "", fmt.Errorf("[core] premium core is no longer distributed, please use a premium build of tpclash")
+	}
+	return filepath.Join(conf.ClashHome, InternalClashBinName), nil
+}
+
+func (c *clashCore) ConfigName() string {
+	return InternalConfigName
+}
+
+func (c *clashCore) Args(confPath, home string) []string {
+	return []string{"-f", confPath, "-d", home, "-ext-ui", UIDir()}
+}
+
+func (c *clashCore) Fix(s string) (string, error) {
+	return runPipeline(c.Stages(), s)
+}
+
+func (c *clashCore) Stages() []configStage {
+	return []configStage{
+		{Name: "template", Run: lenient(tplRendering)},
+		{Name: "preset", Patch: lenientPatch(applyPresets)},
+		{Name: "script", Patch: patchConfigScripts},
+		{Name: "auto-fix", Patch: lenientPatch(autoFix)},
+		// before enforce which injects the generated secret
+		{Name: "bind", Patch: lenientPatch(safeBindController)},
+		{Name: "enforce", Patch: lenientPatch(enforceConfig)},
+		{Name: "ipv6", Patch: lenientPatch(excludePrefixes6)},
+		{Name: "ruleset", Patch: lenientPatch(applyRulesets)},
+		{Name: "asset-mirror", Patch: lenientPatch(mirrorAssets)},
+		{Name: "controller", Patch: lenientPatch(restrictController)},
+		{Name: "mode", Patch: lenientPatch(persistMode)},
+	}
+}
+
+func (c *clashCore) Parse(s string) (*ClashConf, error) {
+	var cc ClashConf
+	if err := decodeYAML(s, &cc); err != nil {
+		return nil, fmt.Errorf("[config] failed to unmarshal clash config: %w", err)
+	}
+	return &cc, nil
+}
+
+func (c *clashCore) Check(s string) (*ClashConf, error) {
+	return CheckConfig(s)
+}
+
+func (c *clashCore) Reload(confPath string, cc *ClashConf, _ *os.Process) error {
+	return reloadClashConfig(confPath, cc)
+}
+
+func (c *clashCore) PatchSecret(s, secret string) (string, error) {
+	return patchYAML(s, func(doc *yaml.Node) (bool, error) {
+		if yamlRoot(doc) == nil {
+			return false, fmt.Errorf("[config] the clash config is not a mapping")
+		}
+		if err := setYamlValue(doc, "secret", secret); err != nil {
+			return false, fmt.Errorf("[config] %w", err)
+		}
+		return true, nil
+	})
+}
+
+func (c *clashCore) Redact(s string) (string, error) {
+	return patchYAML(s, func(doc *yaml.Node) (bool, error) {
+		redactYAMLNode(doc)
+		return true, nil
+	})
+}
+
+// CheckCoreBinary runs the version command of an externally installed core
+// and makes sure it is the flavor selected by --core.
+func CheckCoreBinary(binPath string) (string, error) {
+	if _, err := exec.LookPath(binPath); err != nil {
+		return "", fmt.Errorf("[core] core executable %s is not available: %w", binPath, err)
+	}
+
+	versionArg := "-v"
+	if core.Name() == CoreSingBox {
+		versionArg = "version"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	bs, err := ChildOutput(exec.CommandContext(ctx, binPath, versionArg))
+	if err != nil {
+		return "", fmt.Errorf("[core] failed to get version of %s: %w: %s", binPath, err, bs)
+	}
+	out := string(bs)
+	version, _, _ := strings.Cut(strings.TrimSpace(out), "\n")
+
+	var flavor string
+	switch {
+	case strings.HasPrefix(out, "sing-box"):
+		flavor = CoreSingBox
+		// the dashboard and the api based features rely on the clash api
+		if strings.Contains(out, "Tags:") && !strings.Contains(out, "with_clash_api") {
+			return "", fmt.Errorf("[core] %s is built without clash api(with_clash_api)", binPath)
+		}
+	case strings.Contains(out, "Meta"), strings.Contains(out, "Mihomo"):
+		flavor = CoreMihomo
+	case strings.HasPrefix(out, "Clash"):
+		flavor = CorePremium
+	default:
+		return "", fmt.Errorf("[core] unrecognized core %s: %s", binPath, version)
+	}
+
+	if flavor != core.Name() {
+		return "", fmt.Errorf("[core] %s is a %s core, but %s core is selected(--core)", binPath, flavor, core.Name())
+	}
+	return version, nil
+}
+
+// embeddedCore returns the flavor of the core embedded at build time.
+func embeddedCore() string {
+	if branch == "meta" {
+		return CoreMihomo
+	}
+	return CorePremium
+}
+
+// CoreFlavor returns the core selected by --core, "meta" is an alias of mihomo.
+func CoreFlavor() string {
+	switch strings.ToLower(conf.Core) {
+	case "":
+		return embeddedCore()
+	case "meta", "clash.meta", CoreMihomo:
+		return CoreMihomo
+	case "singbox", CoreSingBox:
+		return CoreSingBox
+	default:
+		return strings.ToLower(conf.Core)
+	}
+}
+
+// mihomoCore is the mihomo core, it is embedded in the meta build and
+// downloaded from its github releases otherwise.
+type mihomoCore struct {
+	clashCore
+}
+
+// Binary prefers the core installed by upgrade-core or downloaded before, the
+// embedded core is used if there is none.
+func (c *mihomoCore) Binary() (string, error) {
+	if c.flavor == embeddedCore() {
+		if _, err := os.Stat(c.CachePath()); err != nil {
+			return filepath.Join(conf.ClashHome, InternalClashBinName), nil
+		}
+	}
+	return cachedCore(c)
+}
+
+func (c *mihomoCore) Repo() string {
+	return mihomoRepo
+}
+
+func (c *mihomoCore) AssetName(tag string) (string, error) {
+	arch, err := mihomoArch()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("mihomo-linux-%s-%s.gz", arch, tag), nil
+}
+
+func (c *mihomoCore) Unpack(r io.Reader, w io.Writer) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = gr.Close() }()
+
+	_, err = io.Copy(w, gr)
+	return err
+}
+
+func (c *mihomoCore) CachePath() string {
+	return filepath.Join(conf.ClashHome, InternalClashBinName+"-"+CoreMihomo)
+}
+
+// coreDownloader is implemented by the cores published on github releases,
+// they can be upgraded without a new tpclash release.
+type coreDownloader interface {
+	Core
+	// Repo returns the github repository of the core releases
+	Repo() string
+	// AssetName returns the release asset of the core for this platform
+	AssetName(tag string) (string, error)
+	// Unpack extracts the core executable from the release asset
+	Unpack(r io.Reader, w io.Writer) error
+	// CachePath returns the path of the downloaded core executable
+	CachePath() string
+}
+
+type githubAsset struct {
+	Name   string `json:"name"`
+	URL    string `json:"browser_download_url"`
+	Digest string `json:"digest"`
+}
+
+type githubRelease struct {
+	TagName string        `json:"tag_name"`
+	Assets  []githubAsset `json:"assets"`
+}
+
+// cachedCore returns the downloaded core, the latest version is downloaded
+// if there is none. A cached core is never upgraded implicitly, so the version
+// installed by upgrade-core stays pinned.
+func cachedCore(d coreDownloader) (string, error) {
+	binPath := d.CachePath()
+	if _, err := os.Stat(binPath); err == nil {
+		logrus.Infof("[core] using cached %s core %s: %s", d.Name(), InstalledCoreVersion(d), binPath)
+		return binPath, nil
+	}
+
+	if _, err := InstallCore(d, "", "", false); err != nil {
+		return "", err
+	}
+	return binPath, nil
+}
+
+// InstalledCoreVersion returns the version of the downloaded core.
+func InstalledCoreVersion(d coreDownloader) string {
+	bs, err := os.ReadFile(d.CachePath() + ".version")
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(bs))
+}
+
+// coreTag normalizes a user specified version to the release tag.
+func coreTag(version string) string {
+	if version != "" && version[0] >= '0' && version[0] <= '9' {
+		return "v" + version
+	}
+	return version
+}
+
+// fetchRelease returns the github release of tag, or the latest release.
+func fetchRelease(repo, name, tag string) (*githubRelease, error) {
+	api := fmt.Sprintf(githubReleaseApi, repo, "latest")
+	if tag != "" {
+		api = fmt.Sprintf(githubReleaseApi, repo, "tags/"+tag)
+	}
+
+	logrus.Infof("[github] check out the %s release from github...", name)
+	resp, err := configClient().Get(api)
+	if err != nil {
+		return nil, fmt.Errorf("[github] failed to request github api: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var release githubRelease
+	if err = json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return nil, fmt.Errorf("[github] failed to unmarshal response: %w", err)
+	}
+	if release.TagName == "" {
+		return nil, fmt.Errorf("[github] failed to get %s release %q: status %d", name, tag, resp.StatusCode)
+	}
+	return &release, nil
+}
+
+// asset returns the release asset of name.
+func (r *githubRelease) asset(name string) (githubAsset, bool) {
+	idx := slices.IndexFunc(r.Assets, func(a githubAsset) bool { return a.Name == name })
+	if idx < 0 {
+		return githubAsset{}, false
+	}
+	return r.Assets[idx], true
+}
+
+// sha256 returns the sha256 digest of the asset published by github.
+func (a githubAsset) sha256() string {
+	sum, _ := strings.CutPrefix(a.Digest, "sha256:")
+	return sum
+}
+
+// InstallCore downloads the core of tag(latest if empty) and swaps it in
+// atomically. The asset is verified against the sha256 digest published by
+// github, or against checksum if it is specified.
+func InstallCore(d coreDownloader, tag, checksum string, skipVerify bool) (string, error) {
+	release, err := fetchRelease(d.Repo(), d.Name(), coreTag(tag))
+	if err != nil {
+		return "", err
+	}
+
+	assetName, err := d.AssetName(release.TagName)
+	if err != nil {
+		return "", err
+	}
+	asset, ok := release.asset(assetName)
+	if !ok {
+		return "", fmt.Errorf("[core] asset %s not found in %s release %s", assetName, d.Name(), release.TagName)
+	}
+
+	if checksum == "" {
+		checksum = asset.sha256()
+	}
+	if checksum == "" && !skipVerify {
+		return "", fmt.Errorf("[core] no checksum published for %s, specify it with --sha256 or use --skip-verify", assetName)
+	}
+
+	downAddr := asset.URL
+	if conf.UpgradeWithGhProxy {
+		downAddr = ghProxyAddr + downAddr
+	}
+	logrus.Infof("[core] start downloading file: %s", downAddr)
+
+	cli := &http.Client{Transport: configClient().Transport, Timeout: max(conf.HttpTimeout, coreDownloadTimeout)}
+	resp, err := cli.Get(downAddr)
+	if err != nil {
+		return "", fmt.Errorf("[core] failed to download %s %s: %w", d.Name(), release.TagName, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("[core] failed to download %s %s: status %d", d.Name(), release.TagName, resp.StatusCode)
+	}
+
+	binPath := d.CachePath()
+	tmpFile, err := os.OpenFile(binPath+".tmp", os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0755)
+	if err != nil {
+		return "", fmt.Errorf("[core] failed to create temp file: %w", err)
+	}
+	defer func() {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+	}()
+
+	h := sha256.New()
+	tr := io.TeeReader(resp.Body, h)
+	if err = d.Unpack(tr, tmpFile); err != nil {
+		return "", fmt.Errorf("[core] failed to unpack %s: %w", assetName, err)
+	}
+	// the unpacker may stop before the end of the asset
+	if _, err = io.Copy(io.Discard, tr); err != nil {
+		return "", fmt.Errorf("[core] failed to download %s: %w", assetName, err)
+	}
+
+	if checksum != "" {
+		if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, checksum) {
+			return "", fmt.Errorf("[core] checksum mismatch of %s: expected %s, got %s", assetName, checksum, sum)
+		}
+		logrus.Infof("[core] checksum verified: %s", checksum)
+	} else {
+		logrus.Warnf("[core] skip checksum verification of %s", assetName)
+	}
+
+	if err = tmpFile.Sync(); err != nil {
+		return "", fmt.Errorf("[core] failed to write temp file: %w", err)
+	}
+	if err = os.Rename(tmpFile.Name(), binPath); err != nil {
+		return "", fmt.Errorf("[core] rename failed: %w", err)
+	}
+	if err = os.WriteFile(binPath+".version", []byte(release.TagName), 0644); err != nil {
+		logrus.Warnf("[core] failed to record core version: %v", err)
+	}
+
+	logrus.Infof("[core] %s core %s installed: %s", d.Name(), release.TagName, binPath)
+	return release.TagName, nil
+}
+
+// mihomoArch maps the platform of tpclash to the mihomo release asset name.
+func mihomoArch() (string, error) {
+	settings := make(map[string]string)
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			settings[s.Key] = s.Value
+		}
+	}
+
+	switch runtime.GOARCH {
+	case "amd64":
+		if settings["GOAMD64"] == "v3" {
+			return "amd64", nil
+		}
+		return "amd64-compatible", nil
+	case "386", "arm64", "mips64", "mips64le":
+		return runtime.GOARCH, nil
+	case "arm":
+		goarm := settings["GOARM"]
+		if goarm == "" {
+			goarm = "7"
+		}
+		return "armv" + goarm, nil
+	case "mips", "mipsle":
+		gomips := settings["GOMIPS"]
+		if gomips == "" {
+			gomips = "hardfloat"
+		}
+		return runtime.GOARCH + "-" + gomips, nil
+	}
+	return "", fmt.Errorf("[core] mihomo core is not available for %s", runtime.GOARCH)
+}
@@ -0,0 +1,680 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	dashboardSessionCookie = "tpclash_session"
+	dashboardStateCookie   = "tpclash_oidc_state"
+	dashboardSessionTTL    = 12 * time.Hour
+
+	oidcCallbackPath = "/oauth2/callback"
+)
+
+// controllerAPI is the clash api fronted by the dashboard proxy, it is
+// updated when the config is reloaded.
+var controllerAPI atomic.Pointer[ClashAPI]
+
+// dashboardKey signs the session cookies, sessions do not survive restarts.
+var dashboardKey = func() []byte {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return key
+}()
+
+var dashboardAllow []netip.Prefix
+
+// CheckDashboardConf validates the --dashboard-* flags, the dashboard proxy
+// refuses to start without any kind of access control.
+func CheckDashboardConf() error {
+	if conf.DashboardListen == "" {
+		return nil
+	}
+	if (conf.DashboardTLSCert == "") != (conf.DashboardTLSKey == "") {
+		return fmt.Errorf("[dashboard] --dashboard-tls-cert and --dashboard-tls-key must be specified together")
+	}
+	for _, u := range conf.DashboardUsers {
+		if name, pass, ok := strings.Cut(u, ":"); !ok || name == "" || pass == "" {
+			return fmt.Errorf("[dashboard] invalid dashboard user %q, must be USER:PASSWORD", name)
+		}
+	}
+	if conf.DashboardOIDCIssuer != "" {
+		if conf.DashboardOIDCClientID == "" {
+			return fmt.Errorf("[dashboard] --dashboard-oidc-client-id is required by oidc")
+		}
+		if len(conf.DashboardOIDCAllow) == 0 {
+			return fmt.Errorf("[dashboard] --dashboard-oidc-allow is required by oidc")
+		}
+	}
+
+	if conf.DashboardBanAttempts > 0 && (conf.DashboardBanWindow <= 0 || conf.DashboardBanTime <= 0) {
+		return fmt.Errorf("[dashboard] --dashboard-ban-window and --dashboard-ban-time must be positive")
+	}
+
+	dashboardAllow = nil
+	for _, s := range conf.DashboardAllow {
+		p, err := parsePrefix(s)
+		if err != nil {
+			return fmt.Errorf("[dashboard] invalid --dashboard-allow %s: %w", s, err)
+		}
+		dashboardAllow = append(dashboardAllow, p)
+	}
+
+	if len(conf.DashboardUsers) == 0 && conf.DashboardOIDCIssuer == "" && len(dashboardAllow) == 0 && !hasTokens() {
+		return fmt.Errorf("[dashboard] --dashboard-user, --dashboard-oidc-issuer, --dashboard-allow or a token is required to expose the dashboard")
+	}
+	return nil
+}
+
+// parsePrefix parses a CIDR or a single ip.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ServeDashboard fronts the clash api and the dashboard served by the core
+// on --dashboard-listen. The clients are authenticated by tpclash(basic auth,
+// oidc, ip allowlist), the controller secret is added to the proxied requests
+// so that it never leaves the host.
+func ServeDashboard(ctx context.Context) error {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			api := controllerAPI.Load()
+			host := api.Addr
+			if strings.HasPrefix(host, "unix:") {
+				host = "unix"
+			}
+			r.SetURL(&url.URL{Scheme: "http", Host: host})
+			r.Out.Header.Del("Cookie")
+			r.Out.Header.Del("Authorization")
+			if api.secret != "" {
+				r.Out.Header.Set("Authorization", "Bearer "+api.secret)
+			}
+			// the dashboards pass the secret of websockets in the query
+			q := r.Out.URL.Query()
+			if q.Has("token") {
+				q.Set("token", api.secret)
+				r.Out.URL.RawQuery = q.Encode()
+			}
+		},
+		Transport: dashboardTransport{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/login", oidcLogin)
+	mux.HandleFunc(oidcCallbackPath, oidcCallback)
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: dashboardSessionCookie, Path: "/", MaxAge: -1})
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+	if conf.SyncServe {
+		mux.HandleFunc(syncPath, serveSync)
+	}
+	if conf.AdminAPI {
+		mux.HandleFunc(adminPath, serveAdmin)
+		mux.Handle(adminUIPath, dashboardAuth(http.HandlerFunc(serveAdminUI)))
+	}
+	mux.Handle("/", dashboardAuth(proxy))
+
+	srv := &http.Server{
+		Addr:              conf.DashboardListen,
+		Handler:           dashboardBanlist(dashboardAllowlist(mux)),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	var err error
+	switch {
+	case len(conf.DashboardACME) > 0:
+		if srv.TLSConfig, err = ACMETLSConfig(ctx); err != nil {
+			return err
+		}
+		logrus.Infof("[dashboard] dashboard is served on https://%s/ui/", conf.DashboardListen)
+		err = srv.ListenAndServeTLS("", "")
+	case conf.DashboardTLSCert != "":
+		logrus.Infof("[dashboard] dashboard is served on https://%s/ui/", conf.DashboardListen)
+		err = srv.ListenAndServeTLS(conf.DashboardTLSCert, conf.DashboardTLSKey)
+	default:
+		logrus.Warnf("[dashboard] dashboard is served on http://%s/ui/ without tls, credentials are sent in clear text", conf.DashboardListen)
+		err = srv.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("[dashboard] failed to serve on %s: %w", conf.DashboardListen, err)
+	}
+	return nil
+}
+
+// dashboardTransport dials the current clash api, it may be a unix socket.
+type dashboardTransport struct{}
+
+func (dashboardTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t := controllerAPI.Load().cli.Transport; t != nil {
+		return t.RoundTrip(r)
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func dashboardAllowlist(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(dashboardAllow) > 0 && !allowedAddr(r.RemoteAddr) {
+			logrus.Warnf("[dashboard] rejected %s %s from %s: not in the allowlist", r.Method, r.URL.Path, remoteIP(r))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func allowedAddr(remoteAddr string) bool {
+	ap, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := ap.Addr().Unmap()
+	for _, p := range dashboardAllow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// dashboardAuth accepts a session cookie, basic auth of --dashboard-user or
+// the controller secret as a bearer token. Only the allowlist is checked if
+// neither users nor oidc are configured.
+func dashboardAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(conf.DashboardUsers) == 0 && conf.DashboardOIDCIssuer == "" && !hasTokens() {
+			serveAudited(next, w, r, "")
+			return
+		}
+		if p, ok := authenticate(r); ok {
+			if p.readOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+				http.Error(w, "read only token", http.StatusForbidden)
+				return
+			}
+			serveAudited(next, w, r, p.name)
+			return
+		}
+
+		if user, pass, ok := r.BasicAuth(); ok {
+			if checkDashboardUser(user, pass) {
+				setSession(w, r, user)
+				serveAudited(next, w, r, user)
+				return
+			}
+			logrus.Warnf("[dashboard] authentication of %s from %s failed", user, remoteIP(r))
+			recordAuthFailure(remoteIP(r))
+		} else if hasToken(r) {
+			logrus.Warnf("[dashboard] invalid token from %s", remoteIP(r))
+			recordAuthFailure(remoteIP(r))
+		}
+
+		// browsers are sent to the oidc provider
+		if conf.DashboardOIDCIssuer != "" && r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "/oauth2/login?rd="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		if len(conf.DashboardUsers) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="tpclash", charset="UTF-8"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// principal is an authenticated client of the dashboard proxy.
+type principal struct {
+	name     string
+	readOnly bool
+}
+
+// statusRecorder records the status code of the proxied response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// serveAudited proxies r and records the requests changing the core(mode
+// switches, selector changes, config reloads, etc.) in the audit log.
+func serveAudited(next http.Handler, w http.ResponseWriter, r *http.Request, user string) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	next.ServeHTTP(rec, r)
+
+	var err error
+	if rec.status < 200 || rec.status > 299 {
+		err = fmt.Errorf("status %d", rec.status)
+	}
+	// the clients of the controller socket have no address
+	actor := user
+	if ip := remoteIP(r); ip != "" && ip != "@" {
+		if actor != "" {
+			actor += "@"
+		}
+		actor += ip
+	}
+	Audit(AuditSourceAPI, actor, r.Method+" "+r.URL.Path, "", err)
+}
+
+// authenticate checks the session cookie and the bearer token of r, the
+// token is either the controller secret or one issued by `tpclash token`.
+// The dashboards pass the token of websockets in the query.
+func authenticate(r *http.Request) (principal, bool) {
+	if c, err := r.Cookie(dashboardSessionCookie); err == nil {
+		if v, ok := verifySigned(c.Value); ok {
+			user, exp, _ := strings.Cut(v, "|")
+			if ts, err := strconv.ParseInt(exp, 10, 64); err == nil && time.Now().Unix() < ts {
+				return principal{name: user}, true
+			}
+		}
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	return authenticateToken(token)
+}
+
+// authenticateToken checks the controller secret and the tokens issued by
+// `tpclash token`, the sync tokens are only accepted by the sync endpoint.
+func authenticateToken(token string) (principal, bool) {
+	p, scope, ok := lookupPrincipal(token)
+	if !ok || scope == TokenScopeSync {
+		return principal{}, false
+	}
+	return p, true
+}
+
+// authenticateSync checks the bearer token of a replica, only the controller
+// secret and the full and sync tokens can pull the snapshot. The cookies and
+// the token query of the dashboards are not accepted.
+func authenticateSync(r *http.Request) (principal, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return principal{}, false
+	}
+	p, scope, ok := lookupPrincipal(token)
+	if !ok || (scope != TokenScopeFull && scope != TokenScopeSync) {
+		return principal{}, false
+	}
+	return p, true
+}
+
+// lookupPrincipal returns the principal of token and its scope, the controller
+// secret has the full scope.
+func lookupPrincipal(token string) (principal, string, bool) {
+	if token == "" {
+		return principal{}, "", false
+	}
+	if api := controllerAPI.Load(); api.secret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(api.secret)) == 1 {
+		return principal{name: "api"}, TokenScopeFull, true
+	}
+	if t, ok := lookupToken(token); ok {
+		return principal{name: "token:" + t.Name, readOnly: t.Scope == TokenScopeRead}, t.Scope, true
+	}
+	return principal{}, "", false
+}
+
+// hasToken reports whether r carries a bearer token or a token query.
+func hasToken(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") || r.URL.Query().Get("token") != ""
+}
+
+// checkDashboardUser compares the password with --dashboard-user, the
+// password may be a bcrypt hash.
+func checkDashboardUser(user, pass string) bool {
+	for _, u := range conf.DashboardUsers {
+		name, want, _ := strings.Cut(u, ":")
+		if name != user {
+			continue
+		}
+		if strings.HasPrefix(want, "$2") {
+			return bcrypt.CompareHashAndPassword([]byte(want), []byte(pass)) == nil
+		}
+		return subtle.ConstantTimeCompare([]byte(want), []byte(pass)) == 1
+	}
+	return false
+}
+
+func setSession(w http.ResponseWriter, r *http.Request, user string) {
+	exp := time.Now().Add(dashboardSessionTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     dashboardSessionCookie,
+		Value:    sign(user + "|" + strconv.FormatInt(exp.Unix(), 10)),
+		Path:     "/",
+		Expires:  exp,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func sign(v string) string {
+	mac := hmac.New(sha256.New, dashboardKey)
+	mac.Write([]byte(v))
+	return base64.RawURLEncoding.EncodeToString([]byte(v)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifySigned(s string) (string, bool) {
+	payload, sig, ok := strings.Cut(s, ".")
+	if !ok {
+		return "", false
+	}
+	v, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", false
+	}
+	want, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, dashboardKey)
+	mac.Write(v)
+	if !hmac.Equal(mac.Sum(nil), want) {
+		return "", false
+	}
+	return string(v), true
+}
+
+// oidcProvider is the discovery document of --dashboard-oidc-issuer.
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+var oidc struct {
+	sync.Mutex
+	provider *oidcProvider
+}
+
+// oidcDiscover fetches the discovery document once it succeeds.
+func oidcDiscover(ctx context.Context) (*oidcProvider, error) {
+	oidc.Lock()
+	defer oidc.Unlock()
+	if oidc.provider != nil {
+		return oidc.provider, nil
+	}
+
+	u := strings.TrimSuffix(conf.DashboardOIDCIssuer, "/") + "/.well-known/openid-configuration"
+	var p oidcProvider
+	if err := oidcRequest(ctx, http.MethodGet, u, "", nil, &p); err != nil {
+		return nil, fmt.Errorf("[dashboard] failed to discover oidc provider: %w", err)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("[dashboard] oidc provider %s does not support the userinfo endpoint", conf.DashboardOIDCIssuer)
+	}
+	oidc.provider = &p
+	return &p, nil
+}
+
+func oidcRequest(ctx context.Context, method, u, token string, form url.Values, out any) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	cli := &http.Client{Timeout: 10 * time.Second}
+	resp, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: status %d", method, u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func oidcRedirectURI(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + oidcCallbackPath
+}
+
+func oidcLogin(w http.ResponseWriter, r *http.Request) {
+	if conf.DashboardOIDCIssuer == "" {
+		http.NotFound(w, r)
+		return
+	}
+	p, err := oidcDiscover(r.Context())
+	if err != nil {
+		logrus.Error(err)
+		http.Error(w, "oidc provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	// only redirect to the paths of the dashboard itself
+	rd := r.URL.Query().Get("rd")
+	if !strings.HasPrefix(rd, "/") || strings.HasPrefix(rd, "//") {
+		rd = "/ui/"
+	}
+	// the state, the nonce of the id token and the pkce verifier
+	buf := make([]byte, 64)
+	if _, err = rand.Read(buf); err != nil {
+		logrus.Errorf("[dashboard] failed to generate oidc state: %v", err)
+		http.Error(w, "oidc login failed", http.StatusInternalServerError)
+		return
+	}
+	state, nonce := hex.EncodeToString(buf[:16]), hex.EncodeToString(buf[16:32])
+	verifier := base64.RawURLEncoding.EncodeToString(buf[32:])
+	challenge := sha256.Sum256([]byte(verifier))
+	http.SetCookie(w, &http.Cookie{
+		Name:     dashboardStateCookie,
+		Value:    sign(strings.Join([]string{state, nonce, verifier, rd}, "|")),
+		Path:     oidcCallbackPath,
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {conf.DashboardOIDCClientID},
+		"redirect_uri":          {oidcRedirectURI(r)},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, p.AuthorizationEndpoint+"?"+q.Encode(), http.StatusFound)
+}
+
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	if conf.DashboardOIDCIssuer == "" {
+		http.NotFound(w, r)
+		return
+	}
+	c, err := r.Cookie(dashboardStateCookie)
+	if err != nil {
+		http.Error(w, "missing oidc state", http.StatusBadRequest)
+		return
+	}
+	v, ok := verifySigned(c.Value)
+	parts := strings.SplitN(v, "|", 4)
+	if !ok || len(parts) != 4 || parts[0] == "" || r.URL.Query().Get("state") != parts[0] {
+		http.Error(w, "invalid oidc state", http.StatusBadRequest)
+		return
+	}
+
+	p, err := oidcDiscover(r.Context())
+	if err != nil {
+		logrus.Error(err)
+		http.Error(w, "oidc provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	nonce, verifier, rd := parts[1], parts[2], parts[3]
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {r.URL.Query().Get("code")},
+		"redirect_uri":  {oidcRedirectURI(r)},
+		"client_id":     {conf.DashboardOIDCClientID},
+		"code_verifier": {verifier},
+	}
+	if conf.DashboardOIDCClientSecret != "" {
+		form.Set("client_secret", conf.DashboardOIDCClientSecret)
+	}
+	err = oidcRequest(r.Context(), http.MethodPost, p.TokenEndpoint, "", form, &token)
+	if err != nil || token.AccessToken == "" {
+		logrus.Errorf("[dashboard] failed to exchange oidc code: %v", err)
+		http.Error(w, "oidc login failed", http.StatusUnauthorized)
+		return
+	}
+	subject, err := oidcCheckIDToken(token.IDToken, nonce)
+	if err != nil {
+		logrus.Errorf("[dashboard] invalid oidc id token from %s: %v", remoteIP(r), err)
+		http.Error(w, "oidc login failed", http.StatusUnauthorized)
+		return
+	}
+
+	var info struct {
+		Subject       string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified *bool  `json:"email_verified"`
+	}
+	if err = oidcRequest(r.Context(), http.MethodGet, p.UserinfoEndpoint, token.AccessToken, nil, &info); err != nil {
+		logrus.Errorf("[dashboard] failed to get oidc userinfo: %v", err)
+		http.Error(w, "oidc login failed", http.StatusUnauthorized)
+		return
+	}
+	if info.Subject != subject {
+		logrus.Errorf("[dashboard] oidc userinfo subject %s does not match the id token", info.Subject)
+		http.Error(w, "oidc login failed", http.StatusUnauthorized)
+		return
+	}
+	user := info.Subject
+	if info.Email != "" && (info.EmailVerified == nil || *info.EmailVerified) {
+		user = info.Email
+	}
+	if !slices.Contains(conf.DashboardOIDCAllow, user) {
+		logrus.Warnf("[dashboard] oidc user %s from %s is not allowed", user, remoteIP(r))
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	logrus.Infof("[dashboard] oidc user %s logged in from %s", user, remoteIP(r))
+	http.SetCookie(w, &http.Cookie{Name: dashboardStateCookie, Path: oidcCallbackPath, MaxAge: -1})
+	setSession(w, r, user)
+	http.Redirect(w, r, rd, http.StatusFound)
+}
+
+// oidcCheckIDToken checks the claims of the id token and returns its
+// subject. The token comes from the token endpoint over tls, so its signature
+// is not verified(OpenID Connect Core 3.1.3.7).
+func oidcCheckIDToken(idToken, nonce string) (string, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return "", errors.New("the token endpoint returned no id token")
+	}
+	bs, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("failed to decode the id token: %w", err)
+	}
+	var claims struct {
+		Issuer   string          `json:"iss"`
+		Subject  string          `json:"sub"`
+		Audience json.RawMessage `json:"aud"`
+		Expiry   int64           `json:"exp"`
+		Nonce    string          `json:"nonce"`
+	}
+	if err = json.Unmarshal(bs, &claims); err != nil {
+		return "", fmt.Errorf("failed to parse the id token: %w", err)
+	}
+	// aud is a string or a list of strings
+	var aud []string
+	if err = json.Unmarshal(claims.Audience, &aud); err != nil {
+		aud = []string{""}
+		_ = json.Unmarshal(claims.Audience, &aud[0])
+	}
+	switch {
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return "", errors.New("nonce mismatch")
+	case strings.TrimSuffix(claims.Issuer, "/") != strings.TrimSuffix(conf.DashboardOIDCIssuer, "/"):
+		return "", fmt.Errorf("unexpected issuer %s", claims.Issuer)
+	case !slices.Contains(aud, conf.DashboardOIDCClientID):
+		return "", errors.New("the id token is not issued to the client id")
+	case time.Now().Unix() > claims.Expiry:
+		return "", errors.New("the id token is expired")
+	case claims.Subject == "":
+		return "", errors.New("the id token has no subject")
+	}
+	return claims.Subject, nil
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dhcpCheckInterval is how often the lease files are checked for changes.
+const dhcpCheckInterval = 10 * time.Second
+
+// the default lease files of dnsmasq(OpenWrt and Debian), odhcpd and Kea, the
+// missing ones are ignored
+var defaultDHCPLeases = []string{
+	"/tmp/dhcp.leases",
+	"/var/lib/misc/dnsmasq.leases",
+	"/tmp/hosts/odhcpd",
+	"/var/lib/kea/kea-leases4.csv",
+}
+
+// DHCPLease maps a LAN address to the name and mac of the client.
+type DHCPLease struct {
+	IP       string
+	MAC      string
+	Hostname string
+	// zero for the leases that do not expire
+	Expiry time.Time
+}
+
+var dhcpLeases = struct {
+	sync.Mutex
+	checked time.Time
+	mtimes  map[string]time.Time
+	leases  map[string]DHCPLease
+}{mtimes: map[string]time.Time{}, leases: map[string]DHCPLease{}}
+
+// LookupLease returns the lease of the ip from the --dhcp-leases files, they
+// are read again once they change.
+func LookupLease(ip string) (DHCPLease, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return DHCPLease{}, false
+	}
+	dhcpLeases.Lock()
+	defer dhcpLeases.Unlock()
+
+	if time.Since(dhcpLeases.checked) >= dhcpCheckInterval {
+		dhcpLeases.checked = time.Now()
+		loadLeases()
+	}
+	l, ok := dhcpLeases.leases[addr.Unmap().String()]
+	return l, ok
+}
+
+// ClientName returns the hostname of the lease of the ip, empty if unknown.
+func ClientName(ip string) string {
+	l, _ := LookupLease(ip)
+	return l.Hostname
+}
+
+// clientLabel returns "ip(hostname)" for the logs, the ip if the hostname is
+// unknown.
+func clientLabel(ip string) string {
+	if name := ClientName(ip); name != "" {
+		return ip + "(" + name + ")"
+	}
+	return ip
+}
+
+// loadLeases reads the lease files if any of them changed, the lease that
+// expires last wins if an ip is in several files.
+func loadLeases() {
+	changed := false
+	mtimes := map[string]time.Time{}
+	for _, path := range conf.DHCPLeases {
+		if path == "" {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil {
+			mtimes[path] = fi.ModTime()
+		}
+	}
+	if len(mtimes) != len(dhcpLeases.mtimes) {
+		changed = true
+	}
+	for path, t := range mtimes {
+		if !dhcpLeases.mtimes[path].Equal(t) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	leases := map[string]DHCPLease{}
+	for _, path := range conf.DHCPLeases {
+		if _, ok := mtimes[path]; !ok {
+			continue
+		}
+		ls, err := readLeaseFile(path)
+		if err != nil {
+			logrus.Warnf("[dhcp] failed to read the leases of %s: %v", path, err)
+			continue
+		}
+		for _, l := range ls {
+			if old, ok := leases[l.IP]; ok && !old.Expiry.IsZero() && (l.Expiry.IsZero() || l.Expiry.Before(old.Expiry)) {
+				continue
+			}
+			leases[l.IP] = l
+		}
+	}
+	dhcpLeases.mtimes, dhcpLeases.leases = mtimes, leases
+	logrus.Debugf("[dhcp] %d leases loaded from %d files", len(leases), len(mtimes))
+}
+
+func readLeaseFile(path string) ([]DHCPLease, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseLeases(bs)
+}
+
+// parseLeases detects the format of the lease file: the csv of Kea, the
+// lease file of odhcpd("# iface duid iaid hostname expiry id length addrs"
+// lines, the hosts lines in between included) or the lease file of dnsmasq.
+func parseLeases(bs []byte) ([]DHCPLease, error) {
+	first, _, _ := bytes.Cut(bytes.TrimSpace(bs), []byte("\n"))
+	switch {
+	case bytes.HasPrefix(first, []byte("address,")):
+		return parseKeaLeases(bs)
+	case bytes.HasPrefix(first, []byte("#")) || isHostsLine(string(first)):
+		return parseODHCPDLeases(bs), nil
+	}
+	return parseDnsmasqLeases(bs), nil
+}
+
+// parseDnsmasqLeases parses "expiry mac ip hostname clientid" lines, the
+// ipv6 leases start with "expiry iaid ip hostname duid" after the duid line.
+func parseDnsmasqLeases(bs []byte) []DHCPLease {
+	var leases []DHCPLease
+	s := bufio.NewScanner(bytes.NewReader(bs))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) < 4 {
+			continue
+		}
+		addr, err := netip.ParseAddr(f[2])
+		if err != nil {
+			continue
+		}
+		l := DHCPLease{IP: addr.Unmap().String(), Hostname: leaseHostname(f[3])}
+		if hw, err := net.ParseMAC(f[1]); err == nil {
+			l.MAC = hw.String()
+		}
+		if expiry, err := strconv.ParseInt(f[0], 10, 64); err == nil && expiry > 0 {
+			l.Expiry = time.Unix(expiry, 0)
+		}
+		leases = append(leases, l)
+	}
+	return leases
+}
+
+// parseODHCPDLeases parses the lease file of odhcpd, the v4 leases have the
+// mac in place of the duid and "ipv4" as the iaid. The hosts file written by
+// odhcpd("ip hostname" lines) is accepted too.
+func parseODHCPDLeases(bs []byte) []DHCPLease {
+	var leases []DHCPLease
+	s := bufio.NewScanner(bytes.NewReader(bs))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if !strings.HasPrefix(line, "#") {
+			if f := strings.Fields(line); len(f) >= 2 {
+				if addr, err := netip.ParseAddr(f[0]); err == nil {
+					leases = append(leases, DHCPLease{IP: addr.Unmap().String(), Hostname: leaseHostname(f[1])})
+				}
+			}
+			continue
+		}
+		f := strings.Fields(strings.TrimPrefix(line, "#"))
+		if len(f) < 8 {
+			continue
+		}
+		// the mac of a v4 lease is printed as hex
+		var mac string
+		if f[2] == "ipv4" && len(f[1]) == 12 {
+			if hw, err := hex.DecodeString(f[1]); err == nil {
+				mac = net.HardwareAddr(hw).String()
+			}
+		}
+		var expiry time.Time
+		if ts, err := strconv.ParseInt(f[4], 10, 64); err == nil && ts > 0 {
+			expiry = time.Unix(ts, 0)
+		}
+		for _, a := range f[7:] {
+			a, _, _ = strings.Cut(a, "/")
+			addr, err := netip.ParseAddr(a)
+			if err != nil {
+				continue
+			}
+			leases = append(leases, DHCPLease{IP: addr.Unmap().String(), MAC: mac, Hostname: leaseHostname(f[3]), Expiry: expiry})
+		}
+	}
+	return leases
+}
+
+// parseKeaLeases parses the memfile csv of Kea(v4 or v6), the file is
+// appended to so the last line of an address wins.
+func parseKeaLeases(bs []byte) ([]DHCPLease, error) {
+	r := csv.NewReader(bytes.NewReader(bs))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	col := func(name string) int { return slices.Index(header, name) }
+	addrCol, macCol, hostCol, expireCol, stateCol := col("address"), col("hwaddr"), col("hostname"), col("expire"), col("state")
+
+	byIP := map[string]DHCPLease{}
+	seen := map[string]bool{}
+	var order []string
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		get := func(i int) string {
+			if i < 0 || i >= len(rec) {
+				return ""
+			}
+			return rec[i]
+		}
+		addr, err := netip.ParseAddr(get(addrCol))
+		if err != nil {
+			continue
+		}
+		ip := addr.Unmap().String()
+		if !seen[ip] {
+			seen[ip] = true
+			order = append(order, ip)
+		}
+		// a released(2) or expired-reclaimed lease
+		if get(stateCol) != "" && get(stateCol) != "0" {
+			delete(byIP, ip)
+			continue
+		}
+		l := DHCPLease{IP: ip, Hostname: leaseHostname(get(hostCol))}
+		if hw, err := net.ParseMAC(get(macCol)); err == nil {
+			l.MAC = hw.String()
+		}
+		if ts, err := strconv.ParseInt(get(expireCol), 10, 64); err == nil && ts > 0 {
+			l.Expiry = time.Unix(ts, 0)
+		}
+		byIP[ip] = l
+	}
+	var leases []DHCPLease
+	for _, ip := range order {
+		if l, ok := byIP[ip]; ok {
+			leases = append(leases, l)
+		}
+	}
+	return leases, nil
+}
+
+// leaseHostname drops the placeholders of unnamed clients, the invalid names
+// marked by odhcpd and the trailing dot of the fqdns.
+func leaseHostname(s string) string {
+	s = strings.TrimSuffix(s, ".")
+	if s == "*" || s == "-" || strings.HasPrefix(s, `broken\x20`) {
+		return ""
+	}
+	return s
+}
+
+func isHostsLine(line string) bool {
+	f := strings.Fields(line)
+	if len(f) < 2 {
+		return false
+	}
+	_, err := netip.ParseAddr(f[0])
+	return err == nil
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// the clash DNS is probed every dnsFallbackProbeInterval, the fallback
+	// takes over after dnsFallbackProbeFailures failed probes in a row
+	dnsFallbackProbeInterval = 2 * time.Second
+	dnsFallbackProbeFailures = 2
+	// dnsFallbackProbeTimeout leaves time to the upstreams of the core, the
+	// probe name is not answered locally unless the fake-ip covers it
+	dnsFallbackProbeTimeout = 5 * time.Second
+	// dnsFallbackProbeName is any name, every response(NXDOMAIN, SERVFAIL...)
+	// means the core dns is alive
+	dnsFallbackProbeName = "dns-probe.tpclash."
+
+	dnsFallbackUpstreamTimeout = 3 * time.Second
+	dnsFallbackTCPIdle         = 30 * time.Second
+	// dnsFallbackMaxQueries limits the udp queries forwarded at a time
+	dnsFallbackMaxQueries = 256
+)
+
+// reasons the fallback forwarder takes over
+const (
+	dnsFallbackCore   = "core"
+	dnsFallbackReload = "reload"
+)
+
+var dnsFallback = struct {
+	sync.Mutex
+	reasons map[string]bool
+	active  bool
+	// notified is set when the takeover was notified, so is its end
+	notified bool
+	// target is the clash DNS address probed by the watcher
+	target string
+}{reasons: map[string]bool{}}
+
+// SetDNSFallbackTarget updates the clash DNS address probed by the watcher.
+func SetDNSFallbackTarget(cc *ClashConf) {
+	dnsFallback.Lock()
+	defer dnsFallback.Unlock()
+
+	dnsFallback.target = ""
+	if port := cc.DNSPort(); port > 0 {
+		host, _, _ := net.SplitHostPort(cc.DNS.Listen)
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "127.0.0.1"
+		}
+		dnsFallback.target = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+}
+
+// holdDNSFallback redirects the DNS queries to the fallback forwarder while
+// any reason holds it.
+func holdDNSFallback(reason string, hold bool) {
+	if len(conf.DNSFallback) == 0 {
+		return
+	}
+	dnsFallback.Lock()
+	defer dnsFallback.Unlock()
+
+	if hold {
+		dnsFallback.reasons[reason] = true
+	} else {
+		delete(dnsFallback.reasons, reason)
+	}
+	active := len(dnsFallback.reasons) > 0
+	if active == dnsFallback.active {
+		return
+	}
+
+	var port uint16
+	if active {
+		port = conf.DNSFallbackPort
+	}
+	if err := SetDNSFallbackPort(port); err != nil {
+		logrus.Errorf("[dns] failed to switch the dns redirect rules: %v", err)
+		return
+	}
+	dnsFallback.active = active
+	UpdateState(func(s *RuntimeState) { s.Rules.DNSFallback = active })
+
+	// the reloads are too frequent to be notified
+	switch {
+	case active && reason == dnsFallbackReload:
+		logrus.Infof("[dns] the dns queries are forwarded to %v during the reload", conf.DNSFallback)
+		dnsFallback.notified = false
+	case active:
+		logrus.Warnf("[dns] clash dns is down, the dns queries are forwarded to %v", conf.DNSFallback)
+		Notify(EventDNSFallback, "clash dns is down, the dns queries are forwarded to %v", conf.DNSFallback)
+		dnsFallback.notified = true
+	case dnsFallback.notified:
+		logrus.Info("[dns] clash dns is back, the dns queries are redirected to it again")
+		Notify(EventDNSFallback, "clash dns is back, the dns queries are redirected to it again")
+	default:
+		logrus.Info("[dns] the dns queries are redirected to clash dns again")
+	}
+}
+
+// WatchDNSFallback probes the clash DNS and hands the DNS queries to the
+// fallback forwarder while the core is down or its DNS does not answer.
+func WatchDNSFallback(ctx context.Context, proc *CoreProcess) {
+	if len(conf.DNSFallback) == 0 {
+		return
+	}
+	var failures int
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(dnsFallbackProbeInterval):
+		}
+
+		dnsFallback.Lock()
+		target := dnsFallback.target
+		dnsFallback.Unlock()
+
+		var err error
+		switch {
+		case !proc.Running():
+			err = errors.New("core is not running")
+			// no need to wait for another probe
+			failures = dnsFallbackProbeFailures
+		case target != "":
+			err = probeDNS(ctx, target)
+		}
+		if err == nil {
+			failures = 0
+			holdDNSFallback(dnsFallbackCore, false)
+			continue
+		}
+		failures++
+		logrus.Debugf("[dns] clash dns probe failed(%d): %v", failures, err)
+		if failures >= dnsFallbackProbeFailures {
+			holdDNSFallback(dnsFallbackCore, true)
+		}
+	}
+}
+
+// probeDNS sends a query to the DNS server, any response means it is alive
+// whatever its rcode.
+func probeDNS(ctx context.Context, addr string) error {
+	id := uint16(rand.Intn(1 << 16))
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	_ = b.StartQuestions()
+	_ = b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(dnsFallbackProbeName), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsFallbackProbeTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	if _, err = conn.Write(query); err != nil {
+		return err
+	}
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		var p dnsmessage.Parser
+		if h, err := p.Start(buf[:n]); err == nil && h.ID == id && h.Response {
+			return nil
+		}
+	}
+}
+
+// ServeDNSFallback forwards the DNS queries received on --dns-fallback-port
+// to the --dns-fallback servers until ctx is done. It receives queries only
+// while the rules redirect them to it, the queries which do not come from the
+// lan are dropped so that it is not an open resolver on the wan.
+func ServeDNSFallback(ctx context.Context) error {
+	if len(conf.DNSFallback) == 0 {
+		return nil
+	}
+	addr := fmt.Sprintf(":%d", conf.DNSFallbackPort)
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("[dns] failed to listen on udp %s: %w", addr, err)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		_ = pc.Close()
+		return fmt.Errorf("[dns] failed to listen on tcp %s: %w", addr, err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = pc.Close()
+		_ = ln.Close()
+	}()
+	logrus.Infof("[dns] fallback dns forwarder is listening on %s, upstreams: %v", addr, conf.DNSFallback)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if !dnsFallbackAllowed(conn.RemoteAddr()) {
+				logrus.Debugf("[dns] refused the dns connection from %s", conn.RemoteAddr())
+				_ = conn.Close()
+				continue
+			}
+			go relayDNSTCP(conn)
+		}
+	}()
+
+	sem := make(chan struct{}, dnsFallbackMaxQueries)
+	buf := make([]byte, 65535)
+	for {
+		n, raddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("[dns] failed to read the dns query: %w", err)
+		}
+		if n < 12 || !dnsFallbackAllowed(raddr) {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		default:
+			logrus.Debugf("[dns] too many dns queries in flight, dropping the query from %s", raddr)
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer func() { <-sem }()
+			resp, err := forwardDNS(query)
+			if err != nil {
+				logrus.Debugf("[dns] failed to forward the dns query from %s: %v", raddr, err)
+				return
+			}
+			_, _ = pc.WriteTo(resp, raddr)
+		}()
+	}
+}
+
+// dnsFallbackLAN6 caches the ipv6 lan prefixes accepted by the forwarder.
+var dnsFallbackLAN6 = struct {
+	sync.Mutex
+	prefixes  []netip.Prefix
+	checkedAt time.Time
+}{}
+
+// dnsFallbackAllowed reports whether addr is a lan client: the loopback, the
+// private and link-local addresses and the ipv6 lan prefixes of the host.
+func dnsFallbackAllowed(addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	if !ip.Is6() {
+		return false
+	}
+
+	dnsFallbackLAN6.Lock()
+	defer dnsFallbackLAN6.Unlock()
+	if time.Since(dnsFallbackLAN6.checkedAt) > ipv6CheckInterval {
+		prefixes, err := LANPrefixes6()
+		if err != nil {
+			logrus.Debugf("[dns] %v", err)
+		}
+		dnsFallbackLAN6.prefixes, dnsFallbackLAN6.checkedAt = prefixes, time.Now()
+	}
+	for _, p := range dnsFallbackLAN6.prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardDNS sends the udp query to the upstreams in order and returns the
+// first response.
+func forwardDNS(query []byte) ([]byte, error) {
+	var errs []error
+	for _, upstream := range conf.DNSFallback {
+		resp, err := exchangeDNS(upstream, query)
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func exchangeDNS(upstream string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", upstream, dnsFallbackUpstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(dnsFallbackUpstreamTimeout))
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore the responses of other queries
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// relayDNSTCP relays a tcp DNS connection to the first reachable upstream.
+func relayDNSTCP(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	var upstream net.Conn
+	var err error
+	for _, addr := range conf.DNSFallback {
+		if upstream, err = net.DialTimeout("tcp", addr, dnsFallbackUpstreamTimeout); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		logrus.Debugf("[dns] failed to relay the dns connection from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer func() { _ = upstream.Close() }()
+
+	done := make(chan struct{}, 2)
+	relay := func(dst, src net.Conn) {
+		buf := make([]byte, 4096)
+		for {
+			_ = src.SetReadDeadline(time.Now().Add(dnsFallbackTCPIdle))
+			n, err := src.Read(buf)
+			if n > 0 {
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					break
+				}
+			}
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					logrus.Debugf("[dns] dns connection relay ended: %v", err)
+				}
+				break
+			}
+		}
+		done <- struct{}{}
+	}
+	go relay(upstream, conn)
+	go relay(conn, upstream)
+	<-done
+}
+
+// CheckDNSFallbackConf validates --dns-fallback and adds the default port to
+// the servers.
+func CheckDNSFallbackConf() error {
+	if len(conf.DNSFallback) == 0 {
+		return nil
+	}
+	if conf.K8sSidecar {
+		return errors.New("[dns] --dns-fallback is not supported in the k8s sidecar mode")
+	}
+	if conf.DNSFallbackPort == 0 || conf.DNSFallbackPort == 53 {
+		return errors.New("[dns] --dns-fallback-port must not be 0 or 53")
+	}
+	for i, s := range conf.DNSFallback {
+		host, port, err := net.SplitHostPort(s)
+		if err != nil {
+			host, port = s, "53"
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("[dns] invalid --dns-fallback server %s, must be an ip address", s)
+		}
+		conf.DNSFallback[i] = net.JoinHostPort(host, port)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// DNSRecord is a dns event of the core written to the dns log. The core only
+// reports the dns events in its debug logs, the client of a query is not
+// included in them.
+type DNSRecord struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Domain   string    `json:"domain,omitempty"`
+	Type     string    `json:"type,omitempty"`
+	Answers  []string  `json:"answers,omitempty"`
+	FakeIP   bool      `json:"fake_ip,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Raw      string    `json:"raw"`
+}
+
+var (
+	// [DNS] www.google.com --> 198.18.0.5
+	// [DNS] www.google.com --> [1.1.1.1 2.2.2.2]
+	dnsAnswerRe = regexp.MustCompile(`^\[DNS\] (\S+) --> \[?([^\]]*)\]?$`)
+	// [DNS] resolve www.google.com A from udp://8.8.8.8:53
+	dnsUpstreamRe = regexp.MustCompile(`^\[DNS\] resolve (\S+) (\S+) from (\S+)`)
+	// [DNS Server] Exchange www.google.com. failed: i/o timeout
+	dnsErrorRe = regexp.MustCompile(`^\[DNS(?: Server)?\] (?:Exchange )?(\S+?)\.? failed: (.+)$`)
+)
+
+// parseDNSLog parses a dns log of the core, false is returned for other logs.
+func parseDNSLog(payload string, fakeRange netip.Prefix) (DNSRecord, bool) {
+	if !strings.HasPrefix(payload, "[DNS") {
+		return DNSRecord{}, false
+	}
+
+	r := DNSRecord{Time: time.Now(), Event: "other", Raw: payload}
+	if m := dnsAnswerRe.FindStringSubmatch(payload); m != nil {
+		r.Event, r.Domain = "answer", strings.TrimSuffix(m[1], ".")
+		for _, a := range strings.Fields(strings.ReplaceAll(m[2], ",", " ")) {
+			r.Answers = append(r.Answers, a)
+			if ip, err := netip.ParseAddr(a); err == nil && fakeRange.IsValid() && fakeRange.Contains(ip) {
+				r.FakeIP = true
+			}
+		}
+	} else if m = dnsUpstreamRe.FindStringSubmatch(payload); m != nil {
+		r.Event, r.Domain, r.Type, r.Upstream = "upstream", strings.TrimSuffix(m[1], "."), m[2], m[3]
+	} else if m = dnsErrorRe.FindStringSubmatch(payload); m != nil {
+		r.Event, r.Domain, r.Error = "error", m[1], m[2]
+	}
+	return r, true
+}
+
+// WatchDNSLog writes the dns events of the core to --dns-log as JSON Lines,
+// they are read from the debug logs of the clash api.
+func WatchDNSLog(ctx context.Context) {
+	if conf.DNSLog == "" {
+		return
+	}
+
+	w, err := newRotateWriter(conf.DNSLog, int64(conf.DNSLogMaxSize)<<20, conf.DNSLogMaxFiles)
+	if err != nil {
+		logrus.Errorf("[dnslog] failed to open dns log: %v", err)
+		return
+	}
+	defer func() { _ = w.Close() }()
+	enc := json.NewEncoder(w)
+
+	logrus.Infof("[dnslog] logging dns queries to %s", conf.DNSLog)
+	for {
+		if err = streamDNSLog(ctx, enc); err != nil {
+			logrus.Debugf("[dnslog] log stream interrupted: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func streamDNSLog(ctx context.Context, enc *json.Encoder) error {
+	cc, err := RunningConf()
+	if err != nil {
+		return err
+	}
+	api := NewClashAPI(cc)
+	fakeRange, _ := netip.ParsePrefix(cc.DNS.FakeIPRange)
+
+	return api.Stream(ctx, "/logs?level=debug", func(msg json.RawMessage) bool {
+		var l struct {
+			Type    string `json:"type"`
+			Payload string `json:"payload"`
+		}
+		if err := json.Unmarshal(msg, &l); err != nil {
+			return true
+		}
+		if r, ok := parseDNSLog(l.Payload, fakeRange); ok {
+			if err := enc.Encode(r); err != nil {
+				logrus.Errorf("[dnslog] failed to write dns log: %v", err)
+			}
+		}
+		return true
+	})
+}
+
+var dnsTopOpts struct {
+	limit int
+	since time.Duration
+}
+
+var dnsCmd = &cobra.Command{
+	Use:   "dns",
+	Short: "Inspect the dns log written by --dns-log",
+}
+
+var dnsTopCmd = &cobra.Command{
+	Use:   "top",
+	Short: "Show the most queried domains",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if conf.DNSLog == "" {
+			logrus.Fatal("[dnslog] --dns-log is not specified")
+		}
+
+		type domainStat struct {
+			Domain  string    `json:"domain"`
+			Count   int       `json:"queries"`
+			FakeIP  bool      `json:"fake_ip"`
+			Answers []string  `json:"last_answers"`
+			Last    time.Time `json:"last_seen"`
+		}
+		stats := map[string]*domainStat{}
+
+		var from time.Time
+		if dnsTopOpts.since > 0 {
+			from = time.Now().Add(-dnsTopOpts.since)
+		}
+		paths := []string{conf.DNSLog}
+		for i := 1; i <= conf.DNSLogMaxFiles; i++ {
+			paths = append(paths, fmt.Sprintf("%s.%d", conf.DNSLog, i))
+		}
+		for _, path := range paths {
+			err := readJSONLines(path, func(r DNSRecord) {
+				if r.Event != "answer" || r.Time.Before(from) {
+					return
+				}
+				s := stats[r.Domain]
+				if s == nil {
+					s = &domainStat{Domain: r.Domain}
+					stats[r.Domain] = s
+				}
+				s.Count++
+				if r.Time.After(s.Last) {
+					s.Last, s.FakeIP, s.Answers = r.Time, r.FakeIP, r.Answers
+				}
+			})
+			if err != nil && !os.IsNotExist(err) {
+				logrus.Fatalf("[dnslog] failed to read %s: %v", path, err)
+			}
+		}
+
+		list := make([]*domainStat, 0, len(stats))
+		for _, s := range stats {
+			list = append(list, s)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Count != list[j].Count {
+				return list[i].Count > list[j].Count
+			}
+			return list[i].Domain < list[j].Domain
+		})
+		if dnsTopOpts.limit > 0 && len(list) > dnsTopOpts.limit {
+			list = list[:dnsTopOpts.limit]
+		}
+		if jsonOutput() {
+			printJSON(list)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		defer func() { _ = w.Flush() }()
+
+		_, _ = fmt.Fprintln(w, "DOMAIN\tQUERIES\tFAKE-IP\tLAST ANSWER\tLAST SEEN")
+		for _, s := range list {
+			_, _ = fmt.Fprintf(w, "%s\t%d\t%t\t%s\t%s ago\n", s.Domain, s.Count, s.FakeIP, strings.Join(s.Answers, ","), since(s.Last))
+		}
+	},
+}
+
+// readJSONLines decodes every line of a JSON Lines file, invalid lines are skipped.
+func readJSONLines[T any](path string, fn func(T)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var v T
+		if err = json.Unmarshal(sc.Bytes(), &v); err != nil {
+			continue
+		}
+		fn(v)
+	}
+	return sc.Err()
+}
+
+func init() {
+	dnsTopCmd.Flags().IntVarP(&dnsTopOpts.limit, "limit", "n", 20, "number of domains to show(0 for all)")
+	dnsTopCmd.Flags().DurationVar(&dnsTopOpts.since, "since", 0, "only count the queries in the specified duration(e.g. 24h)")
+	dnsCmd.AddCommand(dnsTopCmd)
+}
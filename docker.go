@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	dockerRetryInterval = 30 * time.Second
+	dockerSyncDelay     = 1 * time.Second
+
+	dockerDaemonConfig     = "/etc/docker/daemon.json"
+	dockerDefaultBridge    = "docker0"
+	dockerBridgeNameOption = "com.docker.network.bridge.name"
+)
+
+// WatchDocker subscribes to the docker events api and re-syncs the compatible
+// rules whenever networks or containers change, so that a `docker compose up`
+// after tpclash has started still gets proxied. The watcher reconnects when the
+// daemon is restarted or started after tpclash. Rootless daemons found on the
+// host are watched as well until their socket is gone(the user logged out),
+// see RootlessDocker for their limitations.
+func WatchDocker(ctx context.Context) {
+	go watchDocker(ctx, nil)
+
+	watched := make(map[string]context.CancelFunc)
+	defer func() {
+		for _, cancel := range watched {
+			cancel()
+		}
+	}()
+	for {
+		found := make(map[string]bool)
+		for _, r := range DetectRootlessDocker() {
+			found[r.Socket] = true
+			if watched[r.Socket] != nil {
+				continue
+			}
+
+			logrus.Infof("[docker/rootless] found rootless docker of uid %d, network driver: %s", r.UID, r.NetDriver)
+			warnRootlessDocker(r)
+			rctx, cancel := context.WithCancel(ctx)
+			watched[r.Socket] = cancel
+			rootless := r
+			go watchDocker(rctx, &rootless)
+		}
+		for sock, cancel := range watched {
+			if !found[sock] {
+				logrus.Infof("[docker/rootless] rootless docker %s is gone, stop watching", sock)
+				cancel()
+				delete(watched, sock)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(dockerRetryInterval):
+		}
+	}
+}
+
+func watchDocker(ctx context.Context, rootless *RootlessDocker) {
+	for {
+		err := watchDockerEvents(ctx, rootless)
+		if ctx.Err() != nil {
+			return
+		}
+		logrus.Debugf("[docker] events watcher exited: %v, retry after %s...", err, dockerRetryInterval)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(dockerRetryInterval):
+		}
+	}
+}
+
+// SyncDockerCompatible reapplies the container runtime compatible rules, and
+// excludes containers labeled with tpclash.proxy=false from interception.
+func SyncDockerCompatible(ctx context.Context, cli *client.Client) {
+	if err := EnableDockerCompatible(); err != nil {
+		logrus.Errorf("[docker] failed to sync docker compatible rules: %v", err)
+	}
+
+	prefixes, err := dockerOptOutPrefixes(ctx, cli)
+	if err != nil {
+		logrus.Errorf("[docker] failed to inspect containers: %v", err)
+		return
+	}
+	if err = SetBypassSources("docker-label", prefixes); err != nil {
+		logrus.Errorf("[docker] failed to sync container bypass rules: %v", err)
+	}
+
+	if err = syncDockerBridges(ctx, cli); err != nil {
+		logrus.Errorf("[docker] failed to inspect networks: %v", err)
+		return
+	}
+	if err = SetBypassSources("docker-network", dockerUnselectedPrefixes()); err != nil {
+		logrus.Errorf("[docker] failed to sync network bypass rules: %v", err)
+	}
+
+	var subnets []netip.Prefix
+	for _, b := range DockerBridges() {
+		subnets = append(subnets, b.Subnets...)
+	}
+	if err = SetDNSRedirectSources(subnets); err != nil {
+		logrus.Errorf("[docker] failed to sync container dns rules: %v", err)
+	}
+}
+
+// dockerOptOutPrefixes returns the addresses of running containers that opt
+// out of the transparent proxy via the tpclash.proxy label.
+func dockerOptOutPrefixes(ctx context.Context, cli *client.Client) ([]netip.Prefix, error) {
+	cs, err := cli.ContainerList(ctx, types.ContainerListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", LabelProxy)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var prefixes []netip.Prefix
+	for _, c := range cs {
+		proxy, err := strconv.ParseBool(c.Labels[LabelProxy])
+		if err != nil {
+			logrus.Warnf("[docker] container %s has invalid %s label: %q", c.ID[:12], LabelProxy, c.Labels[LabelProxy])
+			continue
+		}
+		if proxy || c.NetworkSettings == nil {
+			continue
+		}
+
+		for name, n := range c.NetworkSettings.Networks {
+			addr, err := netip.ParseAddr(n.IPAddress)
+			if err != nil {
+				continue
+			}
+			logrus.Debugf("[docker] container %s(%s) opt out of proxy: %s", c.ID[:12], name, addr)
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return prefixes, nil
+}
+
+// DockerBridge is a docker managed bridge interface and the network it serves.
+type DockerBridge struct {
+	Interface string
+	Network   string
+	Subnets   []netip.Prefix
+}
+
+// dockerBridges is the latest known bridge mapping, keyed by interface name.
+var dockerBridges = struct {
+	sync.Mutex
+	m map[string]DockerBridge
+}{m: map[string]DockerBridge{}}
+
+// DockerBridges returns a snapshot of the docker managed bridges.
+func DockerBridges() []DockerBridge {
+	dockerBridges.Lock()
+	defer dockerBridges.Unlock()
+
+	bs := make([]DockerBridge, 0, len(dockerBridges.m))
+	for _, b := range dockerBridges.m {
+		bs = append(bs, b)
+	}
+	sort.Slice(bs, func(i, j int) bool { return bs[i].Interface < bs[j].Interface })
+	return bs
+}
+
+// syncDockerBridges enumerates all bridge networks(the default bridge, custom
+// names from daemon.json and br-xxxx of user-defined networks) and updates
+// the bridge mapping.
+func syncDockerBridges(ctx context.Context, cli *client.Client) error {
+	ns, err := cli.NetworkList(ctx, types.NetworkListOptions{
+		Filters: filters.NewArgs(filters.Arg("driver", "bridge")),
+	})
+	if err != nil {
+		return err
+	}
+
+	m := make(map[string]DockerBridge)
+	for _, n := range ns {
+		b := DockerBridge{Interface: dockerBridgeName(n), Network: n.Name}
+		for _, c := range n.IPAM.Config {
+			if p, err := netip.ParsePrefix(c.Subnet); err == nil {
+				b.Subnets = append(b.Subnets, p)
+			}
+		}
+		m[b.Interface] = b
+	}
+
+	dockerBridges.Lock()
+	defer dockerBridges.Unlock()
+
+	for name, b := range m {
+		if _, ok := dockerBridges.m[name]; !ok {
+			logrus.Infof("[docker] found docker bridge: %s(%s) %v", name, b.Network, b.Subnets)
+		}
+	}
+	for name, b := range dockerBridges.m {
+		if _, ok := m[name]; !ok {
+			logrus.Infof("[docker] docker bridge removed: %s(%s)", name, b.Network)
+		}
+	}
+	dockerBridges.m = m
+	return nil
+}
+
+func dockerBridgeName(n types.NetworkResource) string {
+	if name := n.Options[dockerBridgeNameOption]; name != "" {
+		return name
+	}
+
+	if n.Name == "bridge" {
+		// the default bridge can be replaced by the "bridge" option of daemon.json
+		bs, err := os.ReadFile(dockerDaemonConfig)
+		if err == nil {
+			var dc struct {
+				Bridge string `json:"bridge"`
+			}
+			if err = json.Unmarshal(bs, &dc); err == nil && dc.Bridge != "" && dc.Bridge != "none" {
+				return dc.Bridge
+			}
+		}
+		return dockerDefaultBridge
+	}
+
+	// user-defined networks: br-<first 12 chars of network id>
+	if len(n.ID) >= 12 {
+		return "br-" + n.ID[:12]
+	}
+	return "br-" + n.ID
+}
+
+// dockerUnselectedPrefixes returns the subnets of the docker bridges which are
+// not listed in --docker-networks(by network or interface name), nothing is
+// excluded if the flag is not set.
+func dockerUnselectedPrefixes() []netip.Prefix {
+	if len(conf.DockerNetworks) == 0 {
+		return nil
+	}
+
+	selected := make(map[string]bool)
+	var prefixes []netip.Prefix
+	for _, b := range DockerBridges() {
+		if slices.Contains(conf.DockerNetworks, b.Network) || slices.Contains(conf.DockerNetworks, b.Interface) {
+			selected[b.Network] = true
+			selected[b.Interface] = true
+			continue
+		}
+		logrus.Debugf("[docker] network %s(%s) is not selected, bypass subnets: %v", b.Network, b.Interface, b.Subnets)
+		prefixes = append(prefixes, b.Subnets...)
+	}
+
+	for _, name := range conf.DockerNetworks {
+		if !selected[name] {
+			logrus.Warnf("[docker] docker network %s not found", name)
+		}
+	}
+	return prefixes
+}
+
+func watchDockerEvents(ctx context.Context, rootless *RootlessDocker) error {
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if rootless != nil {
+		opts = append(opts, client.WithHost(rootless.Host()))
+	}
+
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return fmt.Errorf("[docker] failed to create docker client: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	if _, err = cli.Ping(ctx); err != nil {
+		return fmt.Errorf("[docker] failed to connect docker daemon: %w", err)
+	}
+
+	resync := func() {
+		if rootless != nil {
+			checkRootlessDocker(ctx, cli, *rootless)
+			return
+		}
+		SyncDockerCompatible(ctx, cli)
+	}
+
+	logrus.Infof("[docker] docker daemon %s connected, watching network events...", cli.DaemonHost())
+
+	// The daemon may have been (re)started after tpclash and recreated its chains
+	resync()
+
+	msgs, errs := cli.Events(ctx, types.EventsOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", string(events.NetworkEventType)),
+			filters.Arg("type", string(events.ContainerEventType)),
+			filters.Arg("type", string(events.DaemonEventType)),
+		),
+	})
+
+	// Multiple events are usually generated at the same time(e.g. compose up),
+	// merge them into a single sync
+	syncTimer := time.NewTimer(dockerSyncDelay)
+	syncTimer.Stop()
+	defer syncTimer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err = <-errs:
+			return fmt.Errorf("[docker] events stream error: %w", err)
+		case msg := <-msgs:
+			if !isDockerSyncEvent(msg) {
+				continue
+			}
+			logrus.Debugf("[docker] received event: %s %s %s", msg.Type, msg.Action, msg.Actor.ID)
+			syncTimer.Reset(dockerSyncDelay)
+		case <-syncTimer.C:
+			resync()
+		}
+	}
+}
+
+func isDockerSyncEvent(msg events.Message) bool {
+	switch msg.Type {
+	case events.NetworkEventType:
+		switch msg.Action {
+		case "create", "destroy", "connect", "disconnect":
+			return true
+		}
+	case events.ContainerEventType:
+		switch msg.Action {
+		case "start", "die", "destroy":
+			return true
+		}
+	case events.DaemonEventType:
+		return msg.Action == "reload"
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/google/nftables"
+	"github.com/sirupsen/logrus"
+)
+
+// dryRunf prints a change tpclash would make in the --dry-run mode.
+func dryRunf(kind, format string, args ...any) {
+	fmt.Printf("[dry-run] %-7s %s\n", kind, fmt.Sprintf(format, args...))
+}
+
+// hostChange applies a change of the host, with --dry-run it is printed by
+// dryRunf instead. An empty what skips the printing, the change is reported
+// by DryRun itself(e.g. the final rules, the state file).
+func hostChange(kind, what string, apply func() error) error {
+	if !conf.DryRun {
+		return apply()
+	}
+	if what != "" {
+		dryRunf(kind, "%s", what)
+	}
+	return nil
+}
+
+// DryRun prints the sysctls, files, nftables rules and ip rules tpclash would
+// change on startup instead of applying them, the core is not started. The
+// same code paths as a normal start run with the writes going through
+// hostChange, only the reads(config, docker, current system state) happen.
+func DryRun() {
+	logrus.Warn("[dry-run] nothing is applied, the changes are printed only")
+
+	if !conf.K8sSidecar {
+		Sysctl()
+	}
+	ExtractFiles()
+	PrepareUI()
+
+	var ccStr string
+	var err error
+	if isRemoteConfig() {
+		ccStr, err = loadRemoteConfig(context.Background())
+	} else {
+		ccStr, err = loadLocalConfig(context.Background())
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if ccStr, err = core.Fix(ccStr); err != nil {
+		logrus.Fatal(err)
+	}
+	cc, err := core.Check(ccStr)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	dryRunf("file", "write %s(%d bytes)", filepath.Join(conf.ClashHome, core.ConfigName()), len(ccStr))
+	dryRunf("file", "write %s, %s", filepath.Join(conf.ClashHome, stateFileName), filepath.Join(conf.ClashHome, pidFileName))
+
+	if conf.RunAs != "" {
+		dryRunf("file", "chown -R %s %s", conf.RunAs, conf.ClashHome)
+		dryRunf("process", "drop to user %s keeping CAP_NET_ADMIN, CAP_NET_RAW, CAP_NET_BIND_SERVICE", conf.RunAs)
+	}
+	dryRunf("process", "start %s core with %s", core.Name(), filepath.Join(conf.ClashHome, core.ConfigName()))
+	if cc.Tun.Enable && cc.Tun.AutoRoute {
+		dryRunf("route", "the core creates the tun device with its routes and ip rules(tun.auto-route)")
+	}
+	if len(cc.Ebpf.RedirectToTun) > 0 {
+		dryRunf("route", "the core attaches ebpf to %s redirecting to the tun device(routing-mark %d)", strings.Join(cc.Ebpf.RedirectToTun, ","), cc.RoutingMark)
+	}
+	if conf.K8sSidecar {
+		return
+	}
+
+	if err = SetDNSPort(context.Background(), cc.DNSPort()); err != nil {
+		logrus.Fatal(err)
+	}
+	dryRunDocker()
+
+	ruleState.Lock()
+	defer ruleState.Unlock()
+	bypass := mergeBypassSources()
+	dnsSources := mergePrefixes(ruleState.dnsSources)
+	if rs := formatRules(bypass, dnsSources, ruleState.dnsPort); rs != "" {
+		dryRunf("nft", "replace table ip %s:\n%s", TableTPClash, rs)
+	} else {
+		dryRunf("nft", "delete table ip %s if it exists, no rules are needed", TableTPClash)
+	}
+	if len(bypass) > 0 {
+		dryRunf("rule", "ip rule add fwmark %#x lookup main pref %d", BypassMark, BypassRulePriority)
+	}
+	bypass6 := mergeBypassSources6()
+	var lan6 []netip.Prefix
+	if conf.IPv6BypassLAN {
+		if lan6, err = LANPrefixes6(); err != nil {
+			logrus.Error(err)
+		}
+	}
+	if len(lan6) > 0 || len(bypass6) > 0 {
+		dryRunf("nft", "replace table ip6 %s(follows the prefix changes):\n%s", TableTPClash, formatRules6(lan6, bypass6))
+		dryRunf("rule", "ip -6 rule add fwmark %#x lookup main pref %d", BypassMark, BypassRulePriority)
+	} else {
+		dryRunf("nft", "delete table ip6 %s if it exists, no ipv6 rules are needed", TableTPClash)
+	}
+}
+
+// dryRunDocker syncs the docker rules once, the compatible rules are shown
+// even if the daemon is not running.
+func dryRunDocker() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err == nil {
+		defer func() { _ = cli.Close() }()
+		if _, err = cli.Ping(ctx); err == nil {
+			SyncDockerCompatible(ctx, cli)
+			return
+		}
+	}
+	logrus.Debugf("[dry-run] docker daemon is not reachable, the container rules are skipped: %v", err)
+	if err = EnableDockerCompatible(); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// formatRules renders the tpclash table built by applyRules in the nft
+// syntax, an empty string means the table is not needed.
+func formatRules(bypass, dnsSources []netip.Prefix, dnsPort uint16) string {
+	dnsRedirect := len(dnsSources) > 0 && dnsPort > 0
+	if len(bypass) == 0 && !dnsRedirect {
+		return ""
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "table ip %s {\n", TableTPClash)
+	if len(bypass) > 0 {
+		fmt.Fprintf(&b, "\tset %s {\n\t\ttype ipv4_addr\n\t\tflags interval\n\t\telements = { %s }\n\t}\n", SetBypassSrc, joinPrefixes(bypass))
+		fmt.Fprintf(&b, "\tchain %s {\n\t\ttype filter hook prerouting priority mangle;\n", ChainBypass)
+		fmt.Fprintf(&b, "\t\tip saddr @%s meta mark set %#x\n\t}\n", SetBypassSrc, BypassMark)
+	}
+	if dnsRedirect {
+		fmt.Fprintf(&b, "\tset %s {\n\t\ttype ipv4_addr\n\t\tflags interval\n\t\telements = { %s }\n\t}\n", SetDNSRedirectSrc, joinPrefixes(dnsSources))
+		fmt.Fprintf(&b, "\tchain %s {\n\t\ttype nat hook prerouting priority dstnat;\n", ChainDNSRedirect)
+		for _, proto := range []string{"udp", "tcp"} {
+			fmt.Fprintf(&b, "\t\tip saddr @%s ip daddr != %s fib daddr type local meta l4proto %s th dport 53 redirect to :%d\n",
+				SetDNSRedirectSrc, dockerEmbeddedDNS, proto, dnsPort)
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// formatRules6 renders the ipv6 tpclash table built by applyRules in the nft
+// syntax.
+func formatRules6(lan6, bypass6 []netip.Prefix) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table ip6 %s {\n", TableTPClash)
+	if len(bypass6) > 0 {
+		fmt.Fprintf(&b, "\tset %s {\n\t\ttype ipv6_addr\n\t\tflags interval\n\t\telements = { %s }\n\t}\n", SetBypassSrc, joinPrefixes(bypass6))
+	}
+	if len(lan6) > 0 {
+		fmt.Fprintf(&b, "\tset %s {\n\t\ttype ipv6_addr\n\t\tflags interval\n\t\telements = { %s }\n\t}\n", SetLAN6Dst, joinPrefixes(lan6))
+	}
+	fmt.Fprintf(&b, "\tchain %s {\n\t\ttype filter hook prerouting priority mangle;\n", ChainBypass)
+	if len(bypass6) > 0 {
+		fmt.Fprintf(&b, "\t\tip6 saddr @%s meta mark set %#x\n", SetBypassSrc, BypassMark)
+	}
+	if len(lan6) > 0 {
+		fmt.Fprintf(&b, "\t\tip6 daddr @%s meta mark set %#x\n", SetLAN6Dst, BypassMark)
+	}
+	b.WriteString("\t}\n}")
+	return b.String()
+}
+
+func familyName(f nftables.TableFamily) string {
+	switch f {
+	case nftables.TableFamilyINet:
+		return "inet"
+	case nftables.TableFamilyIPv4:
+		return "ip"
+	case nftables.TableFamilyIPv6:
+		return "ip6"
+	case nftables.TableFamilyARP:
+		return "arp"
+	case nftables.TableFamilyNetdev:
+		return "netdev"
+	case nftables.TableFamilyBridge:
+		return "bridge"
+	}
+	return fmt.Sprintf("family(%d)", f)
+}
+
+func joinPrefixes(ps []netip.Prefix) string {
+	ss := make([]string, 0, len(ps))
+	for _, p := range ps {
+		ss = append(ss, p.String())
+	}
+	return strings.Join(ss, ", ")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// client presence events, the notification events are published as well
+const (
+	EventClientOnline  = "client-online"
+	EventClientOffline = "client-offline"
+)
+
+// eventBuffer is the number of events a subscriber may fall behind, the
+// events are dropped for the slower subscribers.
+const eventBuffer = 128
+
+// Event is a change of tpclash streamed to the subscribers(grpc api).
+type Event struct {
+	Type    string            `json:"type"`
+	Time    time.Time         `json:"time"`
+	Message string            `json:"message,omitempty"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+}
+
+var eventSubs = struct {
+	sync.Mutex
+	subs map[chan Event]struct{}
+}{subs: map[chan Event]struct{}{}}
+
+// PublishEvent sends the event to all subscribers without waiting for them.
+func PublishEvent(typ, msg string, attrs map[string]string) {
+	eventSubs.Lock()
+	defer eventSubs.Unlock()
+
+	if len(eventSubs.subs) == 0 {
+		return
+	}
+	e := Event{Type: typ, Time: time.Now(), Message: msg, Attrs: attrs}
+	for ch := range eventSubs.subs {
+		select {
+		case ch <- e:
+		default:
+			logrus.Debugf("[events] subscriber is too slow, %s event dropped", typ)
+		}
+	}
+}
+
+// SubscribeEvents returns the events published from now on, cancel stops the
+// subscription.
+func SubscribeEvents() (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+	eventSubs.Lock()
+	eventSubs.subs[ch] = struct{}{}
+	eventSubs.Unlock()
+
+	return ch, func() {
+		eventSubs.Lock()
+		defer eventSubs.Unlock()
+		delete(eventSubs.subs, ch)
+	}
+}
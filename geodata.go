@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// geoDownloadTimeout bounds a download of a geo database, GeoSite.dat is far
+// larger than a config.
+const geoDownloadTimeout = 5 * time.Minute
+
+// geoFile is a geo database in the clash home and where it is downloaded from.
+type geoFile struct {
+	Name string
+	URL  string
+}
+
+// geoFiles returns the geo databases used by the selected core, the sources
+// can be replaced by --geo-url NAME=URL.
+func geoFiles() []geoFile {
+	var names []string
+	switch core.Name() {
+	case CorePremium:
+		names = []string{geoCountryMMDB}
+	case CoreMihomo:
+		names = []string{geoCountryMMDB, geoSiteDat, geoIPDat}
+	default:
+		return nil
+	}
+
+	var fs []geoFile
+	for _, name := range names {
+		url := geoDefaultURLs[name]
+		if u, ok := conf.GeoURLs[name]; ok {
+			url = u
+		}
+		fs = append(fs, geoFile{Name: name, URL: url})
+	}
+	for _, name := range sortedKeys(conf.GeoURLs) {
+		if _, ok := geoDefaultURLs[name]; !ok {
+			fs = append(fs, geoFile{Name: name, URL: conf.GeoURLs[name]})
+		}
+	}
+	return fs
+}
+
+// WatchGeoData updates the geo databases every --geo-update-interval, and asks
+// the core to reload them when any of them changed.
+func WatchGeoData(ctx context.Context, confPath string, proc *CoreProcess) {
+	if conf.GeoUpdateInterval <= 0 {
+		return
+	}
+	if len(geoFiles()) == 0 {
+		logrus.Warnf("[geodata] geo database update is not supported by %s core, skip...", core.Name())
+		return
+	}
+
+	logrus.Infof("[geodata] geo database update scheduled, interval: %s", conf.GeoUpdateInterval)
+	for {
+		updated, err := UpdateGeoData(ctx)
+		if err != nil {
+			logrus.Error(err)
+		}
+		if updated {
+			err = reloadGeoData(confPath, proc)
+			Audit(AuditSourceSchedule, "", "geodata.reload", "", err)
+			if err != nil {
+				logrus.Error(err)
+			} else {
+				logrus.Info("[geodata] geo databases reloaded...")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(conf.GeoUpdateInterval):
+		}
+	}
+}
+
+// UpdateGeoData downloads the geo databases which differ from the remote ones.
+func UpdateGeoData(ctx context.Context) (bool, error) {
+	var updated bool
+	var errs []string
+	for _, f := range geoFiles() {
+		ok, err := updateGeoFile(ctx, f)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		updated = updated || ok
+	}
+	if len(errs) > 0 {
+		return updated, fmt.Errorf("[geodata] failed to update geo databases:\n %s", strings.Join(errs, "\n "))
+	}
+	return updated, nil
+}
+
+func reloadGeoData(confPath string, proc *CoreProcess) error {
+	bs, err := os.ReadFile(confPath)
+	if err != nil {
+		return fmt.Errorf("[geodata] failed to read clash config: %w", err)
+	}
+	cc, err := core.Check(string(bs))
+	if err != nil {
+		return err
+	}
+	// the premium core loads the mmdb only once
+	if core.Name() == CorePremium {
+		return proc.Restart()
+	}
+	return core.Reload(confPath, cc, proc.Process())
+}
+
+func updateGeoFile(ctx context.Context, f geoFile) (bool, error) {
+	target := filepath.Join(conf.ClashHome, f.Name)
+
+	checksum, err := geoChecksum(ctx, f.URL)
+	if err != nil {
+		if !conf.GeoInsecure {
+			return false, fmt.Errorf("%s: %w(use --geo-insecure to update it without the checksum)", f.Name, err)
+		}
+		logrus.Warnf("[geodata] %s: %v, checksum validation is skipped(--geo-insecure)", f.Name, err)
+	}
+	if checksum != "" {
+		if sum, err := fileSHA256(target); err == nil && strings.EqualFold(sum, checksum) {
+			logrus.Debugf("[geodata] %s is up to date", f.Name)
+			return false, nil
+		}
+	}
+
+	logrus.Infof("[geodata] downloading %s: %s", f.Name, redactURL(f.URL))
+	resp, err := geoGet(ctx, f.URL)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", f.Name, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	tmpFile, err := os.OpenFile(target+".tmp", os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return false, fmt.Errorf("%s: failed to create temp file: %w", f.Name, err)
+	}
+	defer func() {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+	}()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmpFile, h), resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("%s: failed to download: %w", f.Name, err)
+	}
+	if n == 0 {
+		return false, fmt.Errorf("%s: empty file downloaded", f.Name)
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if checksum != "" && !strings.EqualFold(sum, checksum) {
+		return false, fmt.Errorf("%s: checksum mismatch: expected %s, got %s", f.Name, checksum, sum)
+	}
+	if old, err := fileSHA256(target); err == nil && old == sum {
+		logrus.Debugf("[geodata] %s is up to date", f.Name)
+		return false, nil
+	}
+
+	if err = os.Rename(tmpFile.Name(), target); err != nil {
+		return false, fmt.Errorf("%s: rename failed: %w", f.Name, err)
+	}
+	logrus.Infof("[geodata] %s updated: %s", f.Name, sum)
+	return true, nil
+}
+
+// geoChecksum fetches the <url>.sha256sum file published along with the
+// database(sha256sum format).
+func geoChecksum(ctx context.Context, url string) (string, error) {
+	resp, err := geoGet(ctx, url+".sha256sum")
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	sc := bufio.NewScanner(io.LimitReader(resp.Body, 4096))
+	if !sc.Scan() {
+		return "", fmt.Errorf("empty checksum file")
+	}
+	fields := strings.Fields(sc.Text())
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid checksum file")
+	}
+	return fields[0], nil
+}
+
+// geoGet requests the url through the transport of the config client, the
+// databases are given geoDownloadTimeout instead of --http-timeout.
+func geoGet(ctx context.Context, url string) (*http.Response, error) {
+	if conf.UpgradeWithGhProxy && strings.HasPrefix(url, "https://github.com/") {
+		url = ghProxyAddr + url
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	cli := &http.Client{Transport: configClient().Transport, Timeout: max(conf.HttpTimeout, geoDownloadTimeout)}
+	resp, err := cli.Do(req)
+	if err != nil {
+		return nil, redactErr(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("request %s failed: status %d", redactURL(url), resp.StatusCode)
+	}
+	return resp, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
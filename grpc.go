@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// grpcService mirrors the management api, the messages are the well known
+// types of protobuf so the clients only need tpclash.proto.
+const grpcService = "tpclash.v1.Admin"
+
+// grpcReadMethods can be called with the read only tokens.
+var grpcReadMethods = map[string]bool{
+	"Status":      true,
+	"GetProfiles": true,
+	"GetSources":  true,
+	"GetLogLevel": true,
+	"Events":      true,
+}
+
+type grpcActorKey struct{}
+
+// ServeGRPC serves the grpc api on --grpc-listen until ctx is done, it uses
+// the tls certificate of the dashboard if there is one.
+func ServeGRPC(ctx context.Context) error {
+	if conf.GRPCListen == "" {
+		return nil
+	}
+	if conf.ClientStatsInterval <= 0 {
+		logrus.Infof("[grpc] the %s/%s events require --client-stats-interval", EventClientOnline, EventClientOffline)
+	}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(grpcAuthUnary),
+		grpc.StreamInterceptor(grpcAuthStream),
+	}
+	if conf.DashboardTLSCert != "" {
+		creds, err := credentials.NewServerTLSFromFile(conf.DashboardTLSCert, conf.DashboardTLSKey)
+		if err != nil {
+			return fmt.Errorf("[grpc] failed to load the tls certificate: %w", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	srv := grpc.NewServer(opts...)
+	srv.RegisterService(&grpcServiceDesc, struct{}{})
+
+	l, err := net.Listen("tcp", conf.GRPCListen)
+	if err != nil {
+		return fmt.Errorf("[grpc] failed to listen on %s: %w", conf.GRPCListen, err)
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Stop()
+	}()
+	if conf.DashboardTLSCert != "" {
+		logrus.Infof("[grpc] grpc api is served on %s", conf.GRPCListen)
+	} else {
+		logrus.Warnf("[grpc] grpc api is served on %s without tls, tokens are sent in clear text", conf.GRPCListen)
+	}
+	if err = srv.Serve(l); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return fmt.Errorf("[grpc] failed to serve on %s: %w", conf.GRPCListen, err)
+	}
+	return nil
+}
+
+// grpcAuth authenticates the bearer token in the "authorization" metadata
+// like the management api and returns the actor of the audit log.
+func grpcAuth(ctx context.Context, fullMethod string) (string, error) {
+	ip := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			ip = host
+		}
+	}
+	if _, banned := bannedUntil(ip); banned {
+		return "", status.Error(codes.PermissionDenied, "banned")
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	if v := md.Get("authorization"); len(v) > 0 {
+		token, _ = strings.CutPrefix(v[0], "Bearer ")
+	}
+	p, ok := authenticateToken(token)
+	if !ok {
+		if token != "" {
+			logrus.Warnf("[grpc] invalid token from %s", ip)
+			recordAuthFailure(ip)
+		}
+		return "", status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	if p.readOnly && !grpcReadMethods[method] {
+		return "", status.Error(codes.PermissionDenied, "read only token")
+	}
+	if ip != "" {
+		return p.name + "@" + ip, nil
+	}
+	return p.name, nil
+}
+
+func grpcAuthUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	actor, err := grpcAuth(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(context.WithValue(ctx, grpcActorKey{}, actor), req)
+}
+
+func grpcAuthStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if _, err := grpcAuth(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func grpcActor(ctx context.Context) string {
+	actor, _ := ctx.Value(grpcActorKey{}).(string)
+	return actor
+}
+
+// grpcResult converts the error of an action to a grpc status.
+func grpcResult(err error) (proto.Message, error) {
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// grpcStruct converts v to a struct through its json.
+func grpcStruct(v any) (*structpb.Struct, error) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	var m map[string]any
+	if err = json.Unmarshal(bs, &m); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s, err := structpb.NewStruct(m)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return s, nil
+}
+
+// grpcUnary builds the method of a handler taking the request message T.
+func grpcUnary[T any, PT interface {
+	*T
+	proto.Message
+}](name string, fn func(ctx context.Context, req PT) (proto.Message, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := PT(new(T))
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req any) (any, error) {
+				return fn(ctx, req.(PT))
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcService + "/" + name}
+			return interceptor(ctx, req, info, handler)
+		},
+	}
+}
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcService,
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		grpcUnary("Status", func(ctx context.Context, _ *emptypb.Empty) (proto.Message, error) {
+			return grpcStruct(CurrentState())
+		}),
+		grpcUnary("Reload", func(ctx context.Context, _ *emptypb.Empty) (proto.Message, error) {
+			return grpcResult(adminReload(grpcActor(ctx)))
+		}),
+		grpcUnary("Rollback", func(ctx context.Context, _ *emptypb.Empty) (proto.Message, error) {
+			return grpcResult(adminRollback(grpcActor(ctx)))
+		}),
+		grpcUnary("GetProfiles", func(ctx context.Context, _ *emptypb.Empty) (proto.Message, error) {
+			active, profiles := adminProfiles()
+			return grpcStruct(map[string]any{"active": active, "profiles": profiles})
+		}),
+		grpcUnary("GetSources", func(ctx context.Context, _ *emptypb.Empty) (proto.Message, error) {
+			return grpcStruct(adminSources())
+		}),
+		grpcUnary("SwitchProfile", func(ctx context.Context, req *wrapperspb.StringValue) (proto.Message, error) {
+			if !validProfile(req.GetValue()) {
+				return nil, status.Errorf(codes.InvalidArgument, "unknown profile %s", req.GetValue())
+			}
+			return grpcResult(adminSwitchProfile(grpcActor(ctx), req.GetValue()))
+		}),
+		grpcUnary("FlushRules", func(ctx context.Context, _ *emptypb.Empty) (proto.Message, error) {
+			return grpcResult(adminFlushRules(grpcActor(ctx)))
+		}),
+		grpcUnary("ReapplyRules", func(ctx context.Context, _ *emptypb.Empty) (proto.Message, error) {
+			return grpcResult(adminReapplyRules(grpcActor(ctx)))
+		}),
+		grpcUnary("TestNotify", func(ctx context.Context, _ *emptypb.Empty) (proto.Message, error) {
+			return grpcResult(adminTestNotify(grpcActor(ctx)))
+		}),
+		grpcUnary("GetLogLevel", func(ctx context.Context, _ *emptypb.Empty) (proto.Message, error) {
+			return wrapperspb.String(logrus.GetLevel().String()), nil
+		}),
+		grpcUnary("SetLogLevel", func(ctx context.Context, req *wrapperspb.StringValue) (proto.Message, error) {
+			level, err := logrus.ParseLevel(req.GetValue())
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			return grpcResult(adminSetLogLevel(grpcActor(ctx), level))
+		}),
+	},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Events",
+		ServerStreams: true,
+		Handler:       grpcEvents,
+	}},
+	Metadata: "tpclash.proto",
+}
+
+// grpcEvents streams the events published after the call until the client
+// is gone.
+func grpcEvents(_ any, stream grpc.ServerStream) error {
+	if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+		return err
+	}
+	events, cancel := SubscribeEvents()
+	defer cancel()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e := <-events:
+			attrs := make(map[string]any, len(e.Attrs))
+			for k, v := range e.Attrs {
+				attrs[k] = v
+			}
+			fields, err := structpb.NewStruct(map[string]any{"type": e.Type, "time": e.Time.Format(time.RFC3339Nano), "message": e.Message, "attrs": attrs})
+			if err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			if err = stream.SendMsg(fields); err != nil {
+				return err
+			}
+		}
+	}
+}
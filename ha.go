@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// the vrrp states keepalived passes to the notify script
+const (
+	HAMaster = "MASTER"
+	HABackup = "BACKUP"
+	HAFault  = "FAULT"
+	HAStop   = "STOP"
+)
+
+const (
+	// haBypassOwner bypasses all the sources while this node is not the
+	// master, the core keeps running so the failover only changes the rules
+	haBypassOwner = "ha"
+
+	haPeerInterval = 5 * time.Second
+	haPeerTimeout  = 3 * time.Second
+	// haPeerFailures is the number of failed checks before the peer is down
+	haPeerFailures = 3
+	haHookTimeout  = 30 * time.Second
+)
+
+var haStates = []string{HAMaster, HABackup, HAFault, HAStop}
+
+var haAllSources = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+
+// HAState is the failover state of the running instance.
+type HAState struct {
+	State string    `json:"state"`
+	Since time.Time `json:"since"`
+	// "ok" or the error of the last failed check of --ha-peer
+	Peer string `json:"peer,omitempty"`
+}
+
+var haState = struct {
+	sync.Mutex
+	state  string
+	hookMu sync.Mutex
+}{}
+
+func haStatePath() string {
+	return filepath.Join(conf.ClashHome, haStateFileName)
+}
+
+// readHAState returns the state written by `tpclash ha notify`, a node is the
+// backup until keepalived says otherwise.
+func readHAState() string {
+	bs, err := os.ReadFile(haStatePath())
+	if err != nil {
+		return HABackup
+	}
+	state := strings.ToUpper(strings.TrimSpace(string(bs)))
+	for _, s := range haStates {
+		if s == state {
+			return state
+		}
+	}
+	return HABackup
+}
+
+// InitHA applies the last state before the core starts, the interception is
+// dormant unless this node is the master.
+func InitHA() error {
+	if !conf.HA {
+		return nil
+	}
+	return setHAState(readHAState())
+}
+
+// setHAState intercepts the traffic only in the MASTER state, the hooks run
+// once the rules are changed.
+func setHAState(state string) error {
+	haState.Lock()
+	defer haState.Unlock()
+
+	prev := haState.state
+	if prev == state {
+		return nil
+	}
+	var bypass []netip.Prefix
+	if state != HAMaster {
+		bypass = haAllSources
+	}
+	start := time.Now()
+	err := SetBypassSources(haBypassOwner, bypass)
+	if prev != "" {
+		Audit(AuditSourceSignal, "vrrp", "ha.transition", prev+" -> "+state, err)
+	}
+	if err != nil {
+		return fmt.Errorf("[ha] failed to switch to %s: %w", state, err)
+	}
+	haState.state = state
+	UpdateState(func(s *RuntimeState) {
+		peer := ""
+		if s.HA != nil {
+			peer = s.HA.Peer
+		}
+		s.HA = &HAState{State: state, Since: time.Now(), Peer: peer}
+	})
+
+	if state == HAMaster {
+		logrus.Infof("[ha] %s, the traffic is intercepted(%s)", state, time.Since(start).Round(time.Millisecond))
+	} else {
+		logrus.Infof("[ha] %s, the interception is dormant and the core kept warm", state)
+	}
+	if prev != "" {
+		Notify(EventHATransition, "%s -> %s", prev, state)
+		go runHAHooks(prev, state)
+	}
+	return nil
+}
+
+// runHAHooks runs the --ha-hook commands one by one with the states in the
+// environment.
+func runHAHooks(prev, state string) {
+	haState.hookMu.Lock()
+	defer haState.hookMu.Unlock()
+
+	for _, hook := range conf.HAHooks {
+		ctx, cancel := context.WithTimeout(context.Background(), haHookTimeout)
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", hook)
+		cmd.Env = append(os.Environ(), "TPCLASH_HA_STATE="+state, "TPCLASH_HA_PREVIOUS="+prev)
+		out, err := ChildOutput(cmd)
+		cancel()
+		if err != nil {
+			logrus.Errorf("[ha] hook %q failed: %v: %s", hook, err, strings.TrimSpace(string(out)))
+			continue
+		}
+		logrus.Debugf("[ha] hook %q done: %s", hook, strings.TrimSpace(string(out)))
+	}
+}
+
+// WatchHA applies the states written by `tpclash ha notify` and checks the
+// health of --ha-peer.
+func WatchHA(ctx context.Context) {
+	if !conf.HA {
+		return
+	}
+	if conf.HAPeer != "" {
+		go watchHAPeer(ctx)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.Errorf("[ha] failed to create fs watcher: %v", err)
+		return
+	}
+	defer func() { _ = watcher.Close() }()
+	if err = watcher.Add(conf.ClashHome); err != nil {
+		logrus.Errorf("[ha] failed add %s to fs watcher: %v", conf.ClashHome, err)
+		return
+	}
+	// the state may be written before the watcher was added
+	if err = setHAState(readHAState()); err != nil {
+		logrus.Error(err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Name != haStatePath() || !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+				continue
+			}
+			if err = setHAState(readHAState()); err != nil {
+				logrus.Error(err)
+				Notify(EventRulesError, "%v", err)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Errorf("[ha] fs watcher error: %v", err)
+		}
+	}
+}
+
+// watchHAPeer checks the health endpoint of the peer, a peer which is down
+// while this node is not the master means that keepalived did not fail over.
+func watchHAPeer(ctx context.Context) {
+	cli := &http.Client{Timeout: haPeerTimeout}
+	ticker := time.NewTicker(haPeerInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	down := false
+	for {
+		err := checkHAPeer(ctx, cli)
+		peer := "ok"
+		if err != nil {
+			peer = err.Error()
+			failures++
+		} else {
+			failures = 0
+		}
+		UpdateState(func(s *RuntimeState) {
+			if s.HA != nil {
+				s.HA.Peer = peer
+			}
+		})
+
+		switch {
+		case failures >= haPeerFailures && !down:
+			down = true
+			haState.Lock()
+			state := haState.state
+			haState.Unlock()
+			if state == HAMaster {
+				logrus.Warnf("[ha] the peer %s is down, no standby is available: %v", redactURL(conf.HAPeer), err)
+				Notify(EventHAPeerDown, "the peer %s is down, no standby is available: %v", redactURL(conf.HAPeer), err)
+			} else {
+				logrus.Errorf("[ha] the peer %s is down while this node is %s, check keepalived: %v", redactURL(conf.HAPeer), state, err)
+				Notify(EventHAPeerDown, "the peer %s is down while this node is %s, check keepalived: %v", redactURL(conf.HAPeer), state, err)
+			}
+		case failures == 0 && down:
+			down = false
+			logrus.Infof("[ha] the peer %s is up again", redactURL(conf.HAPeer))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func checkHAPeer(ctx context.Context, cli *http.Client) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, conf.HAPeer, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := cli.Do(req)
+	if err != nil {
+		return redactErr(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// CheckHAConf validates the ha flags.
+func CheckHAConf() error {
+	if !conf.HA {
+		if conf.HAPeer != "" || len(conf.HAHooks) > 0 {
+			return errors.New("[ha] --ha-peer and --ha-hook require --ha")
+		}
+		return nil
+	}
+	if conf.K8sSidecar {
+		return errors.New("[ha] --ha is not supported in the k8s sidecar")
+	}
+	if conf.HAPeer != "" {
+		u, err := url.Parse(conf.HAPeer)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.New("[ha] invalid --ha-peer, must be the http(s) url of the health endpoint of the peer(e.g. http://192.168.1.3:8080/readyz)")
+		}
+	}
+	return nil
+}
+
+var haCmd = &cobra.Command{
+	Use:   "ha",
+	Short: "Coordinate the failover of TPClash with keepalived(VRRP)",
+	Long: `With --ha the core of the standby keeps running but its interception is
+dormant, it is activated within seconds once keepalived reports MASTER.
+
+keepalived.conf:
+
+  vrrp_script chk_tpclash {
+      script "/usr/local/bin/tpclash ha check"
+      interval 2
+      fall 2
+  }
+  vrrp_instance VI_1 {
+      ...
+      track_script {
+          chk_tpclash
+      }
+      notify "/usr/local/bin/tpclash ha notify"
+  }`,
+}
+
+var haNotifyCmd = &cobra.Command{
+	Use:   "notify [TYPE NAME] STATE [PRIORITY]",
+	Short: "Pass the vrrp state to the running TPClash(keepalived notify script)",
+	Args:  cobra.RangeArgs(1, 4),
+	Run: func(cmd *cobra.Command, args []string) {
+		// keepalived runs the notify script with "TYPE NAME STATE PRIORITY"
+		state := args[0]
+		if len(args) >= 3 {
+			state = args[2]
+		}
+		state = strings.ToUpper(state)
+		valid := false
+		for _, s := range haStates {
+			valid = valid || s == state
+		}
+		if !valid {
+			logrus.Fatalf("[ha] unsupported state %s(%s)", state, strings.Join(haStates, "|"))
+		}
+		if err := os.MkdirAll(conf.ClashHome, 0755); err != nil {
+			logrus.Fatalf("[ha] failed to create the clash home: %v", err)
+		}
+		if err := writeFileAtomic(haStatePath(), strings.NewReader(state+"\n"), 0644); err != nil {
+			logrus.Fatalf("[ha] failed to write the state: %v", err)
+		}
+		logrus.Infof("[ha] state %s passed to tpclash", state)
+	},
+}
+
+var haCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check the running TPClash is able to intercept(keepalived track script)",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if _, err := runningTPClash(); err != nil {
+			logrus.Fatalf("[ha] tpclash is not running: %v", err)
+		}
+		s, err := LoadState()
+		if err != nil {
+			logrus.Fatalf("[ha] failed to read the state of tpclash: %v", err)
+		}
+		if s.Config.LoadedAt.IsZero() {
+			logrus.Fatal("[ha] the config is not loaded")
+		}
+		if !s.Rules.UpdatedAt.IsZero() && !s.Rules.Applied {
+			logrus.Fatalf("[ha] the rules are not applied: %s", s.Rules.Error)
+		}
+		api, err := RunningAPI()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if err = api.Do(http.MethodGet, "/version", nil, nil); err != nil {
+			logrus.Fatalf("[ha] the clash api does not answer: %v", err)
+		}
+	},
+}
+
+func init() {
+	haCmd.AddCommand(haNotifyCmd, haCheckCmd)
+}
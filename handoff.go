@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// handoffTimeout is how long the new core has to serve its api
+	handoffTimeout = 30 * time.Second
+	// handoffDeviceSuffix names the tun device of the alternate slot, mihomo
+	// numbers the devices itself(Meta, Meta1...)
+	handoffDeviceSuffix = "-b"
+	// mihomoTunDevice is the tun device of mihomo if the config names none
+	mihomoTunDevice = "Meta"
+	// handoffHomeDir is the home dir of the alternate slot in the clash home
+	handoffHomeDir = ".handoff-home"
+)
+
+// errHandoffUnsupported means the config can not be handed off, the core is
+// restarted instead.
+var errHandoffUnsupported = errors.New("handoff is not supported")
+
+// coreHandoffer is implemented by the cores which can run a second instance
+// beside the live one during a restart(--core-handoff).
+//
+// The instances use the tun device and the routes of alternating slots, the
+// ip rules of the alternate slot have a lower priority. The new instance
+// stages the config with the listeners on unused loopback ports, traffic
+// moves to its tun device when the old instance removes its routes on exit
+// and then the listeners are moved back to the configured ports by a reload.
+type coreHandoffer interface {
+	Core
+	// SwapSlot moves the tun device and the routes of the config from the
+	// primary to the alternate slot or back
+	SwapSlot(c string, toAlternate bool) (string, error)
+	// Stage rewrites the config to run beside the live core
+	Stage(c string, ports *portAllocator) (*isolatedConfig, error)
+}
+
+// handoff starts the new core before the running one is stopped, the running
+// core keeps serving if the new one fails to start.
+func (p *CoreProcess) handoff(h coreHandoffer) error {
+	bs, err := os.ReadFile(p.confPath)
+	if err != nil {
+		return fmt.Errorf("[handoff] failed to read the running config: %w", err)
+	}
+	running := string(bs)
+	oldCC, err := core.Parse(running)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	toAlternate := !p.alternate
+	p.mu.Unlock()
+	final, err := h.SwapSlot(running, toAlternate)
+	if err != nil {
+		return err
+	}
+	finalCC, err := core.Parse(final)
+	if err != nil {
+		return err
+	}
+	var ports portAllocator
+	staged, err := h.Stage(final, &ports)
+	ports.release()
+	if err != nil {
+		return err
+	}
+	stagedPath := filepath.Join(conf.ClashHome, ".handoff-"+core.ConfigName())
+	if err = os.WriteFile(stagedPath, []byte(staged.config), 0600); err != nil {
+		return fmt.Errorf("[handoff] failed to write the staged config: %w", err)
+	}
+	defer func() { _ = os.Remove(stagedPath) }()
+
+	home := coreHome(toAlternate)
+	if err = prepareCoreHome(home, coreHome(!toAlternate)); err != nil {
+		return fmt.Errorf("[handoff] failed to prepare the home of the new core: %w", err)
+	}
+
+	logrus.Infof("[handoff] starting the new %s core beside the running one...", core.Name())
+	p.mu.Lock()
+	cmd, done, err := p.spawn(stagedPath, home)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	stagedAPI := &ClashAPI{Addr: staged.controller, secret: staged.secret, cli: &http.Client{Timeout: 10 * time.Second}}
+	if err = waitCoreAPI(stagedAPI, done); err != nil {
+		_ = cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("[handoff] the new core is not ready, keep the running one: %w", err)
+	}
+
+	selections, err := runningSelections(NewClashAPI(oldCC))
+	if err != nil {
+		logrus.Warnf("[handoff] failed to read the proxy selections: %v", err)
+	}
+
+	p.mu.Lock()
+	old, oldDone := p.cmd, p.done
+	p.adopt(cmd, done)
+	p.mu.Unlock()
+
+	// the old core removes its routes on exit, traffic falls through to the
+	// routes of the new core
+	logrus.Info("[handoff] retiring the old core...")
+	if old != nil {
+		if err = old.Process.Signal(syscall.SIGINT); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			logrus.Error(err)
+		}
+		select {
+		case <-oldDone:
+		case <-time.After(coreStopTimeout):
+			logrus.Warnf("[handoff] the old core did not exit in %s, kill it...", coreStopTimeout)
+			_ = old.Process.Kill()
+			<-oldDone
+		}
+	}
+
+	if err = writeFileAtomic(p.confPath, strings.NewReader(final), 0644); err != nil {
+		return fmt.Errorf("[handoff] failed to write the config: %w", err)
+	}
+	p.mu.Lock()
+	p.alternate = toAlternate
+	p.mu.Unlock()
+	RecordConfig(final)
+	if err = stagedAPI.Do(http.MethodPut, "/configs?force=true", map[string]string{"path": p.confPath}, nil); err != nil {
+		return fmt.Errorf("[handoff] failed to move the listeners back to the configured ports: %w", err)
+	}
+
+	api := NewClashAPI(finalCC)
+	for group, proxy := range selections {
+		if err = api.Do(http.MethodPut, "/proxies/"+url.PathEscape(group), map[string]string{"name": proxy}, nil); err != nil {
+			logrus.Warnf("[handoff] failed to restore the selection of %s: %v", group, err)
+		}
+	}
+	SetControllerTarget(finalCC)
+	logrus.Infof("[handoff] %s core handed off", core.Name())
+	return nil
+}
+
+// coreHome returns the home dir of the core in a slot, the home of the
+// alternate slot links the files of the clash home. The cache(fake-ip
+// mappings, selections...) is locked by the running core, so every slot has
+// its own copy.
+func coreHome(alternate bool) string {
+	if alternate {
+		return filepath.Join(conf.ClashHome, handoffHomeDir)
+	}
+	return conf.ClashHome
+}
+
+// prepareCoreHome links the files of the clash home into the home of the
+// alternate slot and copies the cache of the running core at from into home.
+// The mappings added by the running core after the copy are lost.
+func prepareCoreHome(home, from string) error {
+	if home != conf.ClashHome {
+		if err := os.MkdirAll(home, 0755); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(conf.ClashHome)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			switch e.Name() {
+			case "cache.db", handoffHomeDir, "run":
+				continue
+			}
+			dst := filepath.Join(home, e.Name())
+			if _, err = os.Lstat(dst); err == nil {
+				continue
+			}
+			if err = os.Symlink(filepath.Join(conf.ClashHome, e.Name()), dst); err != nil {
+				return err
+			}
+		}
+	}
+
+	tmp := filepath.Join(home, ".cache.db.tmp")
+	_ = os.Remove(tmp)
+	if err := copyFile(filepath.Join(from, "cache.db"), tmp); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(home, "cache.db"))
+}
+
+// adaptConfig moves a reloaded config to the slot of the running core.
+func (p *CoreProcess) adaptConfig(c string) (string, error) {
+	h, ok := core.(coreHandoffer)
+	if p == nil || !ok {
+		return c, nil
+	}
+	p.mu.Lock()
+	alternate := p.alternate
+	p.mu.Unlock()
+	if !alternate {
+		return c, nil
+	}
+	return h.SwapSlot(c, true)
+}
+
+// waitCoreAPI waits until the api of a starting core answers.
+func waitCoreAPI(api *ClashAPI, exited chan struct{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), handoffTimeout)
+	defer cancel()
+	for {
+		err := api.Do(http.MethodGet, "/version", nil, nil)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-exited:
+			return errors.New("the core exited")
+		case <-ctx.Done():
+			return fmt.Errorf("the clash api is not ready in %s: %w", handoffTimeout, err)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// runningSelections returns the selected proxies of the selector groups.
+func runningSelections(api *ClashAPI) (map[string]string, error) {
+	proxies, err := fetchProxies(api)
+	if err != nil {
+		return nil, err
+	}
+	selections := make(map[string]string)
+	for name, p := range proxies {
+		if p.Type == "Selector" && p.Now != "" {
+			selections[name] = p.Now
+		}
+	}
+	return selections, nil
+}
+
+// SwapSlot switches the tun device, the route table and the rule index, the
+// rules of the alternate slot follow the rules of the primary slot.
+func (c *mihomoCore) SwapSlot(s string, toAlternate bool) (string, error) {
+	var root map[string]any
+	if err := decodeYAML(s, &root); err != nil {
+		return "", fmt.Errorf("[config] failed to unmarshal clash config: %w", err)
+	}
+	tun, _ := root["tun"].(map[string]any)
+	if tun == nil {
+		return "", errHandoffUnsupported
+	}
+
+	device, _ := tun["device"].(string)
+	if device == "" {
+		device = mihomoTunDevice
+	}
+	table, index := portValue(tun["iproute2-table-index"]), portValue(tun["iproute2-rule-index"])
+	if table == 0 {
+		table = coreRouteTable
+	}
+	if index == 0 {
+		index = coreRuleIndex
+	}
+
+	if toAlternate {
+		// the interface names are limited to 15 bytes
+		if len(device)+len(handoffDeviceSuffix) > 15 {
+			return "", errHandoffUnsupported
+		}
+		device, table, index = device+handoffDeviceSuffix, table+1, index+coreRuleSpan
+	} else {
+		device, table, index = strings.TrimSuffix(device, handoffDeviceSuffix), table-1, index-coreRuleSpan
+	}
+	tun["device"], tun["iproute2-table-index"], tun["iproute2-rule-index"] = device, table, index
+
+	bs, err := yaml.Marshal(root)
+	if err != nil {
+		return "", fmt.Errorf("[config] failed to marshal yaml config: %w", err)
+	}
+	return string(bs), nil
+}
+
+// Stage keeps the tun of the config, the tun mode with auto-route is required
+// as the other integrations(redirect, eBPF) can not run twice.
+func (c *mihomoCore) Stage(s string, ports *portAllocator) (*isolatedConfig, error) {
+	cc, err := c.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if !cc.Tun.Enable || !cc.Tun.AutoRoute || cc.Tun.AutoRedir || cc.IPTables.Enable || len(cc.Ebpf.RedirectToTun) > 0 {
+		return nil, errHandoffUnsupported
+	}
+
+	var root map[string]any
+	if err = decodeYAML(s, &root); err != nil {
+		return nil, fmt.Errorf("[config] failed to unmarshal clash config: %w", err)
+	}
+	if tun, _ := root["tun"].(map[string]any); tun["auto-redirect"] == true {
+		return nil, errHandoffUnsupported
+	}
+	return stageClashConfig(root, ports)
+}
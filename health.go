@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// healthCheck is the result of a health endpoint, the checks are only
+// reported by /readyz and /livez.
+type healthCheck struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// RegisterHealth serves the health endpoints on --health-listen:
+//
+//   - /healthz: tpclash is alive
+//   - /livez: tpclash is alive and the core process has not exited, the core
+//     is not restarted after a crash so the orchestrator should restart tpclash
+//   - /readyz: the core is running, the clash api answers, the config is
+//     loaded and the interception rules are applied
+func RegisterHealth(proc *CoreProcess) {
+	mux := endpointMux(conf.HealthListen)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, nil)
+	})
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, map[string]string{"core": coreCheck(proc)})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		s := CurrentState()
+		checks := map[string]string{"core": coreCheck(proc), "config": "ok", "rules": "ok", "api": "ok"}
+
+		if s.Config.LoadedAt.IsZero() {
+			checks["config"] = "not loaded"
+		}
+		if !s.Rules.UpdatedAt.IsZero() && !s.Rules.Applied {
+			checks["rules"] = s.Rules.Error
+		}
+		if api, err := RunningAPI(); err != nil {
+			checks["api"] = err.Error()
+		} else if err = api.Do("GET", "/version", nil, nil); err != nil {
+			checks["api"] = err.Error()
+		}
+		writeHealth(w, checks)
+	})
+	logrus.Infof("[health] serving health checks on http://%s/{healthz,livez,readyz}", conf.HealthListen)
+}
+
+func coreCheck(proc *CoreProcess) string {
+	if !proc.Running() {
+		return "not running"
+	}
+	return "ok"
+}
+
+func writeHealth(w http.ResponseWriter, checks map[string]string) {
+	result := healthCheck{Status: "ok", Checks: checks}
+	for _, v := range checks {
+		if v != "ok" {
+			result.Status = "failed"
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if result.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(result)
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
@@ -10,16 +13,85 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+var sysctls = [][2]string{
+	{"net.ipv4.ip_forward", "1"},
+	{"net.ipv4.conf.all.route_localnet", "1"},
+}
+
 func Sysctl() {
-	logrus.Info("[helper/sysctl] enable net.ipv4.ip_forward...")
-	if err := sysctl.Set("net.ipv4.ip_forward", "1"); err != nil {
-		logrus.Fatalf("[helper] failed to set net.ipv4.ip_forward: %v", err)
+	backupSysctl()
+
+	for _, kv := range sysctls {
+		cur, err := sysctl.Get(kv[0])
+		if err != nil {
+			cur = err.Error()
+		}
+		err = hostChange("sysctl", fmt.Sprintf("%s = %s(current: %s)", kv[0], kv[1], cur), func() error {
+			logrus.Infof("[helper/sysctl] enable %s...", kv[0])
+			return sysctl.Set(kv[0], kv[1])
+		})
+		if err != nil {
+			logrus.Fatalf("[helper/sysctl] failed to set %s: %v", kv[0], err)
+		}
+	}
+}
+
+// backupSysctl records the values before tpclash changed them for `tpclash
+// clean`, the first run wins since a restart sees the changed values. The
+// values already set to those of tpclash are not recorded, they may have been
+// changed by a tpclash before the backup existed(e.g. an upgrade).
+func backupSysctl() {
+	backupPath := filepath.Join(conf.ClashHome, sysctlBackupName)
+	if _, err := os.Stat(backupPath); err == nil {
+		return
+	}
+
+	orig := make(map[string]string)
+	for _, kv := range sysctls {
+		v, err := sysctl.Get(kv[0])
+		if err != nil {
+			logrus.Warnf("[helper/sysctl] failed to read %s: %v", kv[0], err)
+			continue
+		}
+		if v != kv[1] {
+			orig[kv[0]] = v
+		}
+	}
+	if len(orig) == 0 {
+		logrus.Debug("[helper/sysctl] the sysctls are already set to the values of tpclash, no backup is recorded")
+		return
+	}
+	bs, _ := json.MarshalIndent(orig, "", "  ")
+	err := hostChange("file", fmt.Sprintf("write %s(original sysctl values)", backupPath), func() error {
+		if err := os.MkdirAll(conf.ClashHome, 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(backupPath, bs, 0644)
+	})
+	if err != nil {
+		logrus.Warnf("[helper/sysctl] failed to save the original sysctl values: %v", err)
+	}
+}
+
+// compatibleRuntime reports which container runtime owns the given chain, the
+// runtime's forward filtering would otherwise drop the LAN traffic routed
+// through tpclash.
+func compatibleRuntime(chain *nftables.Chain) (string, bool) {
+	switch chain.Name {
+	case ChainDockerUser:
+		return "docker", true
+	case ChainNetavarkForward:
+		return "podman(netavark)", true
+	case ChainCNIForward:
+		return "podman(cni)", true
 	}
 
-	logrus.Info("[helper/sysctl] enable net.ipv4.conf.all.route_localnet...")
-	if err := sysctl.Set("net.ipv4.conf.all.route_localnet", "1"); err != nil {
-		logrus.Fatalf("[helper/sysctl] failed to set net.ipv4.conf.all.route_localnet: %v", err)
+	// netavark nftables driver: table inet netavark { chain FORWARD { ... } }
+	if chain.Table != nil && chain.Table.Name == TableNetavark && chain.Name == ChainNetavarkNFTForward {
+		return "podman(netavark-nft)", true
 	}
+
+	return "", false
 }
 
 func EnableDockerCompatible() error {
@@ -28,12 +100,29 @@ func EnableDockerCompatible() error {
 		return fmt.Errorf("[helper/nftables] failed connect to nftables: %v", err)
 	}
 
-	cs, err := nft.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	cs, err := nft.ListChains()
 	if err != nil {
 		return fmt.Errorf("[helper/nftables] failed to list nftables chain: %w", err)
 	}
+
+	var found bool
 	for _, chain := range cs {
-		if chain.Name == ChainDockerUser {
+		runtime, ok := compatibleRuntime(chain)
+		if !ok {
+			continue
+		}
+
+		rs, err := nft.GetRules(chain.Table, chain)
+		if err != nil {
+			return fmt.Errorf("[helper/nftables] failed to get nftables rules: %w", err)
+		}
+		if hasCompatibleRule(rs) {
+			logrus.Debugf("[helper/nftables] compatible rule already exists in chain %s, skip...", chain.Name)
+			continue
+		}
+
+		_ = hostChange("nft", fmt.Sprintf("insert rule %s %s %s accept(%s compatible)", familyName(chain.Table.Family), chain.Table.Name, chain.Name, runtime), func() error {
+			logrus.Infof("[helper/nftables] %s detected, enable compatible rule in chain %s...", runtime, chain.Name)
 			nft.InsertRule(&nftables.Rule{
 				Table: chain.Table,
 				Chain: chain,
@@ -41,11 +130,16 @@ func EnableDockerCompatible() error {
 					Kind: expr.VerdictAccept,
 				}},
 			})
-			if err = nft.Flush(); err != nil {
-				return fmt.Errorf("[helper/nftables] failed to flush nftables: %v", err)
-			}
+			found = true
 			return nil
-		}
+		})
+	}
+
+	if !found {
+		return nil
+	}
+	if err = nft.Flush(); err != nil {
+		return fmt.Errorf("[helper/nftables] failed to flush nftables: %v", err)
 	}
 	return nil
 }
@@ -56,31 +150,53 @@ func DisableDockerCompatible() error {
 		return fmt.Errorf("[helper/nftables] failed connect to nftables: %v", err)
 	}
 
-	cs, err := nft.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	cs, err := nft.ListChains()
 	if err != nil {
 		return fmt.Errorf("[helper/nftables] failed to list nftables chain: %w", err)
 	}
+
+	var found bool
 	for _, chain := range cs {
-		if chain.Name == ChainDockerUser {
-			rs, err := nft.GetRules(chain.Table, chain)
-			if err != nil {
-				return fmt.Errorf("[helper/nftables] failed to get nftables rules: %w", err)
-			}
-			for _, rule := range rs {
-				if len(rule.Exprs) == 1 {
-					v, ok := rule.Exprs[0].(*expr.Verdict)
-					if ok && v.Kind == expr.VerdictAccept {
-						if err = nft.DelRule(rule); err != nil {
-							return fmt.Errorf("[helper/nftables] failed to delete nftables rules: %w", err)
-						}
-					}
+		if _, ok := compatibleRuntime(chain); !ok {
+			continue
+		}
+
+		rs, err := nft.GetRules(chain.Table, chain)
+		if err != nil {
+			return fmt.Errorf("[helper/nftables] failed to get nftables rules: %w", err)
+		}
+		for _, rule := range rs {
+			if isCompatibleRule(rule) {
+				if err = nft.DelRule(rule); err != nil {
+					return fmt.Errorf("[helper/nftables] failed to delete nftables rules: %w", err)
 				}
+				found = true
 			}
-			if err = nft.Flush(); err != nil {
-				return fmt.Errorf("[helper/nftables] failed to flush nftables: %v", err)
-			}
-			return nil
 		}
 	}
+
+	if !found {
+		return nil
+	}
+	if err = nft.Flush(); err != nil {
+		return fmt.Errorf("[helper/nftables] failed to flush nftables: %v", err)
+	}
 	return nil
 }
+
+func isCompatibleRule(rule *nftables.Rule) bool {
+	if len(rule.Exprs) != 1 {
+		return false
+	}
+	v, ok := rule.Exprs[0].(*expr.Verdict)
+	return ok && v.Kind == expr.VerdictAccept
+}
+
+func hasCompatibleRule(rs []*nftables.Rule) bool {
+	for _, rule := range rs {
+		if isCompatibleRule(rule) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dnsCacheTTL is how long the resolved addresses of the config provider are
+// reused, a stale entry is still used when the lookup fails.
+const dnsCacheTTL = 5 * time.Minute
+
+// dialAttemptDelay is the delay before racing the next address of a host
+// with the pending dials(the connection attempt delay of RFC 8305).
+const dialAttemptDelay = 250 * time.Millisecond
+
+var (
+	configClientOnce sync.Once
+	configHTTPClient *http.Client
+)
+
+// configClient returns the client fetching the remote config, it is shared by
+// all the checks so that the connection(HTTP/2 or keep-alive) and the
+// resolved addresses are reused between the intervals.
+func configClient() *http.Client {
+	configClientOnce.Do(func() {
+		cache := &dnsCache{entries: make(map[string]dnsCacheEntry)}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.DialContext = cache.DialContext
+		// the custom dialer disables HTTP/2 unless it is forced
+		t.ForceAttemptHTTP2 = true
+		t.MaxIdleConnsPerHost = 2
+		// keep the connection across a check interval
+		t.IdleConnTimeout = max(90*time.Second, conf.CheckInterval+30*time.Second)
+		configHTTPClient = &http.Client{Timeout: conf.HttpTimeout, Transport: t}
+	})
+	return configHTTPClient
+}
+
+type dnsCacheEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// dnsCache resolves the hosts of the dials, the addresses are cached for
+// dnsCacheTTL regardless of the record ttl.
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]dnsCacheEntry
+	dialer  net.Dialer
+}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.addrs, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		if ok {
+			logrus.Debugf("[config] failed to resolve %s, use the cached addresses: %v", host, err)
+			return e.addrs, nil
+		}
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[host] = dnsCacheEntry{addrs: addrs, expires: time.Now().Add(dnsCacheTTL)}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+func (c *dnsCache) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return c.dialer.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.dialRace(ctx, network, interleaveAddrs(addrs), port)
+	if err != nil {
+		// the addresses may have changed, resolve them again on the next dial
+		c.mu.Lock()
+		delete(c.entries, host)
+		c.mu.Unlock()
+	}
+	return conn, err
+}
+
+// dialRace dials the addresses in order, the next one is started after
+// dialAttemptDelay or once the previous dial failed, the first connection
+// wins and the others are closed.
+func (c *dnsCache) dialRace(ctx context.Context, network string, addrs []string, port string) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no address to dial")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	var errs []error
+	var pending, next int
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if next < len(addrs) {
+				a := addrs[next]
+				next++
+				pending++
+				go func() {
+					conn, err := c.dialer.DialContext(ctx, network, net.JoinHostPort(a, port))
+					results <- result{conn, err}
+				}()
+				timer.Reset(dialAttemptDelay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				// close the connections of the dials finishing at the same time
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							_ = r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(addrs) && ctx.Err() == nil {
+				timer.Reset(0)
+			} else if pending == 0 {
+				return nil, errors.Join(errs...)
+			}
+		}
+	}
+}
+
+// interleaveAddrs alternates the ipv6 and ipv4 addresses starting with the
+// family of the first one, so a broken family only delays the dial.
+func interleaveAddrs(addrs []string) []string {
+	var first, second []string
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip != nil && (ip.To4() == nil) == (net.ParseIP(addrs[0]).To4() == nil) {
+			first = append(first, a)
+		} else {
+			second = append(second, a)
+		}
+	}
+	out := make([]string, 0, len(addrs))
+	for i := 0; i < max(len(first), len(second)); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// languages of the messages printed by tpclash(--lang)
+const (
+	LangEN = "en"
+	LangZH = "zh"
+)
+
+// message ids of the catalog
+const (
+	msgStandby         = "main.standby"
+	msgTracingStart    = "main.tracing.start"
+	msgStopping        = "main.stopping"
+	msgTracingStop     = "main.tracing.stop"
+	msgStopped         = "main.stopped"
+	msgInstalled       = "install.installed"
+	msgReinstall       = "install.reinstall"
+	msgUninstall       = "uninstall.warning"
+	msgUninstalled     = "uninstall.uninstalled"
+	msgUpgraded        = "upgrade.upgraded"
+	msgInitSub         = "init.subscription"
+	msgInitIface       = "init.interface"
+	msgInitDashboard   = "init.dashboard"
+	msgInitBypass      = "init.bypass"
+	msgInitDomains     = "init.domains"
+	msgInitCIDRs       = "init.cidrs"
+	msgInitOverwrite   = "init.overwrite"
+	msgInitInstall     = "init.install"
+	msgInitStartWith   = "init.start"
+	msgInitAborted     = "init.aborted"
+	msgInitNotTerminal = "init.not-terminal"
+)
+
+const serviceCommandsEN = `     ● Start:          systemctl start tpclash
+     ● Stop:           systemctl stop tpclash
+     ● Restart:        systemctl restart tpclash
+     ● Enable on boot: systemctl enable tpclash
+     ● Disable:        systemctl disable tpclash
+     ● Logs:           journalctl -fu tpclash
+     ● Reload units:   systemctl daemon-reload
+`
+
+const serviceCommandsZH = `     ● 启动服务: systemctl start tpclash
+     ● 停止服务: systemctl stop tpclash
+     ● 重启服务: systemctl restart tpclash
+     ● 开启自启动: systemctl enable tpclash
+     ● 关闭自启动: systemctl disable tpclash
+     ● 查看日志: journalctl -fu tpclash
+     ● 重载服务配置: systemctl daemon-reload
+`
+
+// messages is the catalog of the translated messages: the startup/shutdown
+// logs, the install/uninstall/upgrade notes and the init wizard. The other
+// logs, errors and command outputs are english only. The log messages keep
+// their [module] prefix in every language.
+var messages = map[string]map[string]string{
+	LangEN: {
+		msgStandby:      "[main] 🍄 tpclash is ready...",
+		msgTracingStart: "[main] 🔪 starting the tracing project...",
+		msgStopping:     "[main] 🛑 tpclash is stopping...",
+		msgTracingStop:  "[main] 🔪 stopping the tracing project...",
+		msgStopped:      "[main] 🛑 tpclash stopped!",
+		msgInstalled:    "  👌 TPClash is installed, manage it with the following commands:\n" + serviceCommandsEN,
+		msgReinstall:    "\n  ❗ TPClash seems to be reinstalled, reload the units before restarting it.\n",
+		msgUninstall: `
+  ❗️ Stop TPClash before uninstalling it
+  ❗️ Press Ctrl+c to abort if it is still running
+  ❗️ The uninstallation continues in 30s
+
+`,
+		msgUninstalled: `  👌 TPClash is uninstalled, please open an issue or ask in the Telegram group for any problem
+     ● Repository: https://github.com/mritd/tpclash
+     ● Telegram: https://t.me/tpclash
+`,
+		msgUpgraded:        "  👌 TPClash is upgraded, restart it to apply the changes\n" + serviceCommandsEN,
+		msgInitSub:         "Subscription url",
+		msgInitIface:       "LAN interface",
+		msgInitDashboard:   "Dashboard(official|yacd|metacubexd)",
+		msgInitBypass:      "Go direct for(lan,cn or none)",
+		msgInitDomains:     "Direct domains(comma separated, optional)",
+		msgInitCIDRs:       "Direct destination cidrs(comma separated, optional)",
+		msgInitOverwrite:   "%s already exists, overwrite it",
+		msgInitInstall:     "Install the systemd service",
+		msgInitStartWith:   "\nStart tpclash with:\n  tpclash %s\n",
+		msgInitAborted:     "[init] aborted",
+		msgInitNotTerminal: "[init] stdin is not a terminal, use --non-interactive with the flags instead",
+	},
+	LangZH: {
+		msgStandby:      "[main] 🍄 提莫队长正在待命...",
+		msgTracingStart: "[main] 🔪 永远不要忘记, 吾等为何而战...",
+		msgStopping:     "[main] 🛑 TPClash 正在停止...",
+		msgTracingStop:  "[main] 🔪 恐惧, 是万敌之首...",
+		msgStopped:      "[main] 🛑 TPClash 已关闭!",
+		msgInstalled:    "  👌 TPClash 安装完成, 您可以使用以下命令启动:\n" + serviceCommandsZH,
+		msgReinstall:    "\n  ❗监测到您可能执行了重新安装, 重新启动前请执行重载服务配置.\n",
+		msgUninstall: `
+  ❗️在卸载前请务必先停止 TPClash
+  ❗️如果尚未停止请按 Ctrl+c 终止卸载
+  ❗️本卸序将会在 30s 后继续执行卸载命令
+
+`,
+		msgUninstalled: `  👌 TPClash 已卸载, 如有任何问题请开启 issue 或从 Telegram 讨论组反馈
+     ● 官方仓库: https://github.com/mritd/tpclash
+     ● Telegram: https://t.me/tpclash
+`,
+		msgUpgraded:        "  👌 TPClash 已升级完成, 请重新启动以应用更改\n" + serviceCommandsZH,
+		msgInitSub:         "订阅地址",
+		msgInitIface:       "局域网网卡",
+		msgInitDashboard:   "Dashboard(official|yacd|metacubexd)",
+		msgInitBypass:      "直连范围(lan,cn 或 none)",
+		msgInitDomains:     "直连域名(逗号分隔, 可选)",
+		msgInitCIDRs:       "直连目标网段(逗号分隔, 可选)",
+		msgInitOverwrite:   "%s 已存在, 是否覆盖",
+		msgInitInstall:     "是否安装 systemd 服务",
+		msgInitStartWith:   "\n使用以下命令启动 tpclash:\n  tpclash %s\n",
+		msgInitAborted:     "[init] 已取消",
+		msgInitNotTerminal: "[init] 标准输入不是终端, 请使用 --non-interactive 并通过参数指定配置",
+	},
+}
+
+// T returns the message of the id in the --lang language, the english one
+// is used if it is not translated.
+func T(id string, args ...any) string {
+	msg, ok := messages[conf.Lang][id]
+	if !ok {
+		msg = messages[LangEN][id]
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// defaultLang returns the language of the locale in the environment, the
+// variables are checked in the POSIX order.
+func defaultLang() string {
+	for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if v := os.Getenv(env); v != "" {
+			if strings.HasPrefix(strings.ToLower(v), LangZH) {
+				return LangZH
+			}
+			return LangEN
+		}
+	}
+	return LangEN
+}
+
+func CheckLang() error {
+	if _, ok := messages[conf.Lang]; !ok {
+		return fmt.Errorf("[main] unsupported language %s, must be %s or %s", conf.Lang, LangEN, LangZH)
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+// bypass preferences of `tpclash init`
+const (
+	BypassLAN = "lan"
+	BypassCN  = "cn"
+)
+
+var initOpts struct {
+	nonInteractive bool
+	subscription   string
+	iface          string
+	bypass         []string
+	bypassDomains  []string
+	bypassCIDRs    []string
+	install        bool
+	force          bool
+}
+
+type initConfig struct {
+	Subscription string
+	// Interface is the lan interface(--lan-interface), the core detects the
+	// outbound interface itself
+	Interface     string
+	Secret        string
+	BypassLAN     bool
+	BypassCN      bool
+	BypassDomains []string
+	BypassCIDRs   []string
+}
+
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Generate the clash config from a subscription interactively",
+	Long: `Ask for the subscription url, the LAN interface, the dashboard and the
+bypass preferences, then write a clash config using the subscription as a
+proxy provider to the --config path and optionally install the systemd unit.
+
+With --non-interactive the answers are taken from the flags.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if conf.Core == CoreSingBox {
+			logrus.Fatal("[init] the sing-box core is not supported, write the sing-box config manually")
+		}
+		if isRemoteConfig() {
+			logrus.Fatalf("[init] --config must be a local path: %s", redactURL(conf.ClashConfig))
+		}
+
+		secret, err := randomToken()
+		if err != nil {
+			logrus.Fatalf("[init] %v", err)
+		}
+		ic := initConfig{Subscription: initOpts.subscription, Interface: initOpts.iface, Secret: secret}
+		if ic.Interface == "" {
+			ic.Interface = getMainNic()
+		}
+		bypass := initOpts.bypass
+		if !initOpts.nonInteractive {
+			if _, err := unix.IoctlGetTermios(int(os.Stdin.Fd()), unix.TCGETS); err != nil {
+				logrus.Fatal(T(msgInitNotTerminal))
+			}
+			p := &prompter{r: bufio.NewReader(os.Stdin), w: os.Stdout}
+			ic.Subscription = p.ask(T(msgInitSub), ic.Subscription, checkSubscriptionURL)
+			ic.Interface = p.ask(T(msgInitIface), ic.Interface, checkInterface)
+			conf.ClashUI = p.ask(T(msgInitDashboard), conf.ClashUI, checkDashboard)
+			bypass = trimAll(strings.Split(p.ask(T(msgInitBypass), strings.Join(bypass, ","), checkBypass), ","))
+			if domains := p.ask(T(msgInitDomains), strings.Join(initOpts.bypassDomains, ","), checkDomains); domains != "" {
+				initOpts.bypassDomains = strings.Split(domains, ",")
+			}
+			if cidrs := p.ask(T(msgInitCIDRs), strings.Join(initOpts.bypassCIDRs, ","), checkCIDRs); cidrs != "" {
+				initOpts.bypassCIDRs = strings.Split(cidrs, ",")
+			}
+			if _, err := os.Stat(conf.ClashConfig); err == nil && !initOpts.force {
+				initOpts.force = p.confirm(T(msgInitOverwrite, conf.ClashConfig), false)
+			}
+			if !initOpts.install {
+				initOpts.install = p.confirm(T(msgInitInstall), false)
+			}
+		}
+
+		for _, check := range []func() error{
+			func() error { return checkSubscriptionURL(ic.Subscription) },
+			func() error { return checkInterface(ic.Interface) },
+			func() error { return checkDashboard(conf.ClashUI) },
+			func() error { return checkBypass(strings.Join(bypass, ",")) },
+			func() error { return checkDomains(strings.Join(initOpts.bypassDomains, ",")) },
+			func() error { return checkCIDRs(strings.Join(initOpts.bypassCIDRs, ",")) },
+		} {
+			if err := check(); err != nil {
+				logrus.Fatalf("[init] %v", err)
+			}
+		}
+		conf.LANInterface = ic.Interface
+		ic.BypassLAN = slices.Contains(bypass, BypassLAN)
+		ic.BypassCN = slices.Contains(bypass, BypassCN)
+		ic.BypassDomains = trimAll(initOpts.bypassDomains)
+		ic.BypassCIDRs = trimAll(initOpts.bypassCIDRs)
+
+		if _, err := os.Stat(conf.ClashConfig); err == nil && !initOpts.force {
+			logrus.Fatalf("[init] %s already exists, use --force to overwrite it", conf.ClashConfig)
+		}
+		bs, err := renderInitConfig(ic)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if err = os.MkdirAll(filepath.Dir(conf.ClashConfig), 0755); err != nil {
+			logrus.Fatalf("[init] failed to create config dir: %v", err)
+		}
+		// the subscription url usually carries the token
+		if err = os.WriteFile(conf.ClashConfig, bs, 0600); err != nil {
+			logrus.Fatalf("[init] failed to write config: %v", err)
+		}
+		logrus.Infof("[init] config written: %s", conf.ClashConfig)
+
+		if initOpts.install {
+			installService()
+			return
+		}
+		if err = writeSecretFiles(rootCmd.PersistentFlags()); err != nil {
+			logrus.Fatalf("[init] %v", err)
+		}
+		fmt.Print(T(msgInitStartWith, strings.Join(redactArgs(startArgs()), " ")))
+	},
+}
+
+// renderInitConfig renders the config and makes sure it is still valid yaml
+// after the template rendering of tpclash on load.
+func renderInitConfig(ic initConfig) ([]byte, error) {
+	tpl, err := template.New("init").Delims("[[", "]]").Parse(initConfigTpl)
+	if err != nil {
+		return nil, fmt.Errorf("[init] failed to parse config template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err = tpl.Execute(&buf, ic); err != nil {
+		return nil, fmt.Errorf("[init] failed to render config: %w", err)
+	}
+
+	var node yaml.Node
+	if err = yaml.Unmarshal([]byte(tplRendering(buf.String())), &node); err != nil {
+		return nil, fmt.Errorf("[init] generated config is invalid: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func checkSubscriptionURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid subscription url %q, must be a http(s) url", redactURL(s))
+	}
+	if strings.ContainsAny(s, "\"\\\n") {
+		return errors.New("the subscription url must not contain quotes, backslashes or newlines")
+	}
+	return nil
+}
+
+func checkInterface(name string) error {
+	if name == "" {
+		return errors.New("the LAN interface is required")
+	}
+	if _, err := net.InterfaceByName(name); err != nil {
+		return fmt.Errorf("unknown interface %s: %w", name, err)
+	}
+	return nil
+}
+
+func checkDashboard(ui string) error {
+	switch ui {
+	case "official", "yacd", "metacubexd":
+		return nil
+	}
+	return fmt.Errorf("unsupported dashboard %s(official|yacd|metacubexd)", ui)
+}
+
+func checkBypass(s string) error {
+	for _, b := range strings.Split(s, ",") {
+		if b = strings.TrimSpace(b); b != "" && b != BypassLAN && b != BypassCN && b != "none" {
+			return fmt.Errorf("unknown bypass %s(%s|%s|none)", b, BypassLAN, BypassCN)
+		}
+	}
+	return nil
+}
+
+func checkDomains(s string) error {
+	for _, d := range trimAll(strings.Split(s, ",")) {
+		if strings.ContainsAny(d, " \t\n\"'#:/") {
+			return fmt.Errorf("invalid domain %q", d)
+		}
+	}
+	return nil
+}
+
+func checkCIDRs(s string) error {
+	for _, c := range trimAll(strings.Split(s, ",")) {
+		if _, err := netip.ParsePrefix(c); err != nil {
+			return fmt.Errorf("invalid cidr %s: %w", c, err)
+		}
+	}
+	return nil
+}
+
+// trimAll trims the items and drops the empty ones.
+func trimAll(ss []string) []string {
+	var out []string
+	for _, s := range ss {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// prompter asks the questions of the wizard, an empty answer keeps the
+// default and an invalid one is asked again.
+type prompter struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+func (p *prompter) ask(question, def string, check func(string) error) string {
+	for {
+		if def != "" {
+			_, _ = fmt.Fprintf(p.w, "%s [%s]: ", question, def)
+		} else {
+			_, _ = fmt.Fprintf(p.w, "%s: ", question)
+		}
+		line, err := p.r.ReadString('\n')
+		if err != nil && line == "" {
+			// ctrl-d, nothing more can be asked
+			_, _ = fmt.Fprintln(p.w)
+			logrus.Fatal(T(msgInitAborted))
+		}
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			answer = def
+		}
+		if check == nil {
+			return answer
+		}
+		if err = check(answer); err == nil {
+			return answer
+		}
+		_, _ = fmt.Fprintf(p.w, "  %v\n", err)
+	}
+}
+
+func (p *prompter) confirm(question string, def bool) bool {
+	d := "y/N"
+	if def {
+		d = "Y/n"
+	}
+	answer := strings.ToLower(p.ask(question+"? ("+d+")", "", nil))
+	if answer == "" {
+		return def
+	}
+	return answer == "y" || answer == "yes"
+}
+
+func init() {
+	initCmd.Flags().BoolVar(&initOpts.nonInteractive, "non-interactive", false, "take the answers from the flags instead of asking")
+	initCmd.Flags().StringVar(&initOpts.subscription, "subscription", "", "subscription url of the proxies")
+	initCmd.Flags().StringVar(&initOpts.iface, "interface", "", "LAN interface(default the main interface)")
+	initCmd.Flags().StringSliceVar(&initOpts.bypass, "bypass", []string{BypassLAN, BypassCN}, "go direct for the LAN and/or the China mainland addresses(lan,cn or none)")
+	initCmd.Flags().StringSliceVar(&initOpts.bypassDomains, "bypass-domain", []string{}, "domains(and their subdomains) going direct")
+	initCmd.Flags().StringSliceVar(&initOpts.bypassCIDRs, "bypass-cidr", []string{}, "destination cidrs going direct")
+	initCmd.Flags().BoolVar(&initOpts.install, "install", false, "install the systemd service starting with the generated config")
+	initCmd.Flags().BoolVar(&initOpts.force, "force", false, "overwrite an existing config")
+}
@@ -6,6 +6,10 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -16,96 +20,77 @@ var installCmd = &cobra.Command{
 	Use:   "install",
 	Short: "Install TPClash",
 	Run: func(cmd *cobra.Command, args []string) {
-		_, err := exec.LookPath("systemctl")
-		if err != nil {
-			logrus.Fatal("[install] the systemctl command was not found, your system may not be based on systemd")
-		}
+		installService()
+	},
+}
 
-		var reinstall bool
-		_, err = os.Stat(filepath.Join(systemdDir, "tpclash.service"))
-		reinstall = err == nil
+// installService copies the executable to the install dir and writes the
+// systemd unit starting it with the current options.
+func installService() {
+	_, err := exec.LookPath("systemctl")
+	if err != nil {
+		logrus.Fatal("[install] the systemctl command was not found, your system may not be based on systemd")
+	}
 
-		exePath, err := os.Executable()
-		if err != nil {
-			logrus.Fatalf("[install] unable to get executable file path: %v", err)
-		}
+	var reinstall bool
+	_, err = os.Stat(filepath.Join(systemdDir, "tpclash.service"))
+	reinstall = err == nil
 
-		err = os.MkdirAll(installDir, 0755)
-		if err != nil {
-			logrus.Fatalf("[install] failed to create directory: %v", err)
-		}
+	exePath, err := os.Executable()
+	if err != nil {
+		logrus.Fatalf("[install] unable to get executable file path: %v", err)
+	}
 
-		src, err := os.Open(exePath)
-		if err != nil {
-			logrus.Fatalf("[install] failed to open tpclash file: %v", err)
-		}
-		defer func() { _ = src.Close() }()
+	err = os.MkdirAll(installDir, 0755)
+	if err != nil {
+		logrus.Fatalf("[install] failed to create directory: %v", err)
+	}
 
-		dst, err := os.OpenFile(filepath.Join(installDir, "tpclash"), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0755)
-		if err != nil {
-			logrus.Fatalf("[install] failed to create executable file: %v", err)
-		}
-		defer func() { _ = dst.Close() }()
+	src, err := os.Open(exePath)
+	if err != nil {
+		logrus.Fatalf("[install] failed to open tpclash file: %v", err)
+	}
+	defer func() { _ = src.Close() }()
 
-		_, err = io.Copy(dst, src)
-		if err != nil {
-			logrus.Fatalf("[install] failed to copy executable file: %v", err)
-		}
+	dst, err := os.OpenFile(filepath.Join(installDir, "tpclash"), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0755)
+	if err != nil {
+		logrus.Fatalf("[install] failed to create executable file: %v", err)
+	}
+	defer func() { _ = dst.Close() }()
 
-		opts := ""
-		if conf.Debug {
-			opts += " --debug"
-		}
-		if conf.ClashHome != "" {
-			opts += fmt.Sprintf(" %s %s", "--home", conf.ClashHome)
-		}
-		if conf.ClashConfig != "" {
-			opts += fmt.Sprintf(" %s %s", "--config", conf.ClashConfig)
-		}
-		if conf.ClashUI != "" {
-			opts += fmt.Sprintf(" %s %s", "--ui", conf.ClashUI)
-		}
-		if conf.CheckInterval > 0 {
-			opts += fmt.Sprintf(" %s %s", "--check-interval", conf.CheckInterval.String())
-		}
-		if len(conf.HttpHeader) > 0 {
-			for _, h := range conf.HttpHeader {
-				opts += fmt.Sprintf(" %s '%s'", "--http-header", h)
-			}
-		}
-		if conf.ConfigEncPassword != "" {
-			opts += fmt.Sprintf(" %s %s", "--config-password", conf.ConfigEncPassword)
-		}
-		if conf.ForceExtract {
-			opts += " --force-extract"
-		}
-		if conf.EnableTracing {
-			opts += " --enable-tracing"
-		}
-		if conf.AllowStandardDNSPort {
-			opts += " --allow-standard-dns"
-		}
-		if conf.AutoFixMode != "" {
-			opts += fmt.Sprintf(" %s %s", "--auto-fix", conf.AutoFixMode)
-		}
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		logrus.Fatalf("[install] failed to copy executable file: %v", err)
+	}
 
-		err = os.WriteFile(filepath.Join(systemdDir, "tpclash.service"), []byte(fmt.Sprintf(systemdTpl, opts)), 0644)
-		if err != nil {
-			logrus.Fatalf("[install] failed to create systemd service: %v", err)
+	if err = writeSecretFiles(rootCmd.PersistentFlags()); err != nil {
+		logrus.Fatalf("[install] %v", err)
+	}
+	var opts string
+	for _, arg := range startArgs() {
+		if strings.HasPrefix(arg, "--") {
+			opts += " " + arg
+		} else {
+			opts += fmt.Sprintf(" '%s'", arg)
 		}
+	}
 
-		fmt.Print(installedMessage)
-		if reinstall {
-			fmt.Print(reinstallMessage)
-		}
-	},
+	err = os.WriteFile(filepath.Join(systemdDir, "tpclash.service"), []byte(fmt.Sprintf(systemdTpl, opts)), 0644)
+	if err != nil {
+		logrus.Fatalf("[install] failed to create systemd service: %v", err)
+	}
+
+	fmt.Print(logo + T(msgInstalled))
+	if reinstall {
+		fmt.Print(T(msgReinstall))
+	}
 }
 
 var uninstallCmd = &cobra.Command{
 	Use:   "uninstall",
 	Short: "Uninstall TPClash",
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Print(uninstallMessage)
+		fmt.Print(T(msgUninstall))
 		time.Sleep(30 * time.Second)
 
 		logrus.Warnf("[uninstall] remove --> %s", filepath.Join(installDir, "tpclash"))
@@ -120,6 +105,381 @@ var uninstallCmd = &cobra.Command{
 			logrus.Fatalf("[uninstall] failed to remove systemd service: %v", err)
 		}
 
-		fmt.Print(uninstalledMessage)
+		logrus.Warnf("[uninstall] remove --> %s", secretDir)
+		if err = os.RemoveAll(secretDir); err != nil {
+			logrus.Fatalf("[uninstall] failed to remove secrets: %v", err)
+		}
+
+		fmt.Print(logo + T(msgUninstalled))
 	},
 }
+
+// startArgs returns the command line flags to start tpclash with the current
+// options, it is shared by the systemd unit and the compose generator. The
+// secret flags are passed as files, see writeSecretFiles.
+func startArgs() []string {
+	var args []string
+	if conf.ConfFile != defaultConfFile {
+		args = append(args, "--tpclash-config", conf.ConfFile)
+	}
+	if conf.Core != "" {
+		args = append(args, "--core", conf.Core)
+	}
+	if conf.ClashBin != "" {
+		args = append(args, "--clash-bin", conf.ClashBin)
+	}
+	// the core is downloaded on the first start of the service
+	if conf.UpgradeWithGhProxy {
+		args = append(args, "--with-ghproxy")
+	}
+	for _, a := range conf.ClashExtraArgs {
+		args = append(args, "--clash-extra-args", a)
+	}
+	for _, e := range conf.ClashEnv {
+		args = append(args, "--clash-env", e)
+	}
+	// the service usually runs without the locale of the installing shell
+	if conf.Lang != LangEN {
+		args = append(args, "--lang", conf.Lang)
+	}
+	if conf.Debug {
+		args = append(args, "--debug")
+	}
+	if conf.ClashHome != "" {
+		args = append(args, "--home", conf.ClashHome)
+	}
+	if conf.ClashConfig != "" {
+		args = append(args, "--config", conf.ClashConfig)
+	}
+	if conf.ClashUI != "" {
+		args = append(args, "--ui", conf.ClashUI)
+	}
+	if conf.UIPath != "" {
+		args = append(args, "--ui-path", conf.UIPath)
+	}
+	if conf.UIArchive != "" {
+		args = append(args, "--ui-archive", conf.UIArchive)
+	}
+	if conf.UIURL != "" {
+		args = append(args, "--ui-url", conf.UIURL)
+	}
+	if conf.UISHA256 != "" {
+		args = append(args, "--ui-sha256", conf.UISHA256)
+	}
+	if conf.UIVersion != "" {
+		args = append(args, "--ui-version", conf.UIVersion)
+	}
+	for _, m := range conf.ConfigMirrors {
+		args = append(args, "--config-mirror", m)
+	}
+	if conf.ConfigRecord != "" {
+		args = append(args, "--config-record", conf.ConfigRecord, "--config-record-max", strconv.Itoa(conf.ConfigRecordMax))
+	}
+	if conf.ConfigReplay != "" {
+		args = append(args, "--config-replay", conf.ConfigReplay)
+	}
+	if conf.CheckInterval > 0 {
+		args = append(args, "--check-interval", conf.CheckInterval.String())
+	}
+	for _, h := range conf.HttpHeader {
+		args = append(args, "--http-header", h)
+	}
+	if conf.ConfigEncPassword != "" {
+		args = append(args, "--config-password", conf.ConfigEncPassword)
+	}
+	if conf.ForceExtract {
+		args = append(args, "--force-extract")
+	}
+	if conf.DisableExtract {
+		args = append(args, "--disable-extract")
+	}
+	if conf.CoreHandoff {
+		args = append(args, "--core-handoff")
+	}
+	if conf.CoreRestart {
+		args = append(args, "--core-restart")
+	}
+	if conf.ConfigCache {
+		args = append(args, "--config-cache")
+	}
+	if conf.RulesCheck {
+		args = append(args, "--rules-check")
+	}
+	if conf.PreValidate {
+		args = append(args, "--pre-validate")
+	}
+	if conf.EnableTracing {
+		args = append(args, "--enable-tracing")
+	}
+	if conf.AllowStandardDNSPort {
+		args = append(args, "--allow-standard-dns")
+	}
+	if conf.AutoFixMode != "" {
+		args = append(args, "--auto-fix", conf.AutoFixMode)
+	}
+	for _, s := range conf.ConfigScripts {
+		args = append(args, "--config-script", s)
+	}
+	if len(conf.Presets) > 0 {
+		args = append(args, "--preset", strings.Join(conf.Presets, ","))
+	}
+	if len(conf.Pipeline) > 0 {
+		args = append(args, "--pipeline", strings.Join(conf.Pipeline, ","))
+	}
+	if len(conf.PipelineSkip) > 0 {
+		args = append(args, "--pipeline-skip", strings.Join(conf.PipelineSkip, ","))
+	}
+	if conf.PipelineTrace {
+		args = append(args, "--pipeline-trace")
+	}
+	if conf.ControllerMode != "" {
+		args = append(args, "--controller-mode", conf.ControllerMode)
+	}
+	if conf.ControllerPolicy != ControllerPolicyLocalhost {
+		args = append(args, "--controller-policy", conf.ControllerPolicy)
+	}
+	if conf.LANInterface != "" {
+		args = append(args, "--lan-interface", conf.LANInterface)
+	}
+	if len(conf.ControllerSocketUsers) > 0 {
+		args = append(args, "--controller-socket-users", strings.Join(conf.ControllerSocketUsers, ","))
+	}
+	if len(conf.ControllerSocketGroups) > 0 {
+		args = append(args, "--controller-socket-groups", strings.Join(conf.ControllerSocketGroups, ","))
+	}
+	if conf.ControllerSocketToken != "" {
+		args = append(args, secretArgs("controller-socket-token")...)
+	}
+	if !conf.EnforceConfig {
+		args = append(args, "--enforce-config=false")
+	}
+	if conf.GeoUpdateInterval > 0 {
+		args = append(args, "--geo-update-interval", conf.GeoUpdateInterval.String())
+	}
+	for _, name := range sortedKeys(conf.GeoURLs) {
+		args = append(args, "--geo-url", name+"="+conf.GeoURLs[name])
+	}
+	if conf.GeoInsecure {
+		args = append(args, "--geo-insecure")
+	}
+	if len(conf.Rulesets) > 0 {
+		args = append(args, "--ruleset", strings.Join(conf.Rulesets, ","), "--ruleset-update-interval", conf.RulesetUpdateInterval.String())
+	}
+	if conf.MetricsListen != "" {
+		args = append(args, "--metrics-listen", conf.MetricsListen)
+	}
+	if conf.HealthListen != "" {
+		args = append(args, "--health-listen", conf.HealthListen)
+	}
+	if conf.ClientStatsInterval > 0 {
+		args = append(args, "--client-stats-interval", conf.ClientStatsInterval.String())
+	}
+	if conf.ConnLog != "" {
+		args = append(args, "--conn-log", conf.ConnLog,
+			"--conn-log-sample", strconv.FormatFloat(conf.ConnLogSample, 'f', -1, 64),
+			"--conn-log-max-size", strconv.Itoa(conf.ConnLogMaxSize),
+			"--conn-log-max-files", strconv.Itoa(conf.ConnLogMaxFiles))
+	}
+	if conf.DNSLog != "" {
+		args = append(args, "--dns-log", conf.DNSLog,
+			"--dns-log-max-size", strconv.Itoa(conf.DNSLogMaxSize),
+			"--dns-log-max-files", strconv.Itoa(conf.DNSLogMaxFiles))
+	}
+	if conf.MemLimit != "" {
+		args = append(args, "--mem-limit", conf.MemLimit)
+	}
+	if conf.GCPercent != 0 {
+		args = append(args, "--gc-percent", strconv.Itoa(conf.GCPercent))
+	}
+	if conf.CoreMemLimit != "" {
+		args = append(args, "--core-mem-limit", conf.CoreMemLimit)
+	}
+	if conf.CoreGCPercent != 0 {
+		args = append(args, "--core-gc-percent", strconv.Itoa(conf.CoreGCPercent))
+	}
+	if conf.CoreRSSLimit != "" {
+		args = append(args, "--core-rss-limit", conf.CoreRSSLimit, "--mem-check-interval", conf.MemCheckInterval.String())
+	}
+	if conf.OTelEndpoint != "" {
+		args = append(args, "--otel-endpoint", conf.OTelEndpoint)
+	}
+	for _, n := range conf.Notify {
+		args = append(args, "--notify", n)
+	}
+	if len(conf.NotifyEvents) > 0 {
+		args = append(args, "--notify-events", strings.Join(conf.NotifyEvents, ","))
+	}
+	for _, ev := range sortedKeys(conf.NotifyTemplates) {
+		args = append(args, "--notify-template", ev+"="+conf.NotifyTemplates[ev])
+	}
+	if conf.NotifySecret != "" {
+		args = append(args, secretArgs("notify-secret")...)
+	}
+	if conf.MQTT != "" {
+		args = append(args, secretArgs("mqtt")...)
+		if conf.MQTTInterval != 30*time.Second {
+			args = append(args, "--mqtt-interval", conf.MQTTInterval.String())
+		}
+		if conf.MQTTTopic != "tpclash" {
+			args = append(args, "--mqtt-topic", conf.MQTTTopic)
+		}
+		if conf.MQTTDiscovery != "homeassistant" {
+			args = append(args, "--mqtt-discovery", conf.MQTTDiscovery)
+		}
+	}
+	if conf.NotifyQuotaPercent != 90 {
+		args = append(args, "--notify-quota-percent", strconv.FormatFloat(conf.NotifyQuotaPercent, 'f', -1, 64))
+	}
+	if conf.ProxyCheckInterval > 0 {
+		args = append(args, "--proxy-check-interval", conf.ProxyCheckInterval.String())
+	}
+	if conf.MetricsPush != "" {
+		args = append(args, "--metrics-push", conf.MetricsPush)
+		if conf.MetricsPushInterval != 30*time.Second {
+			args = append(args, "--metrics-push-interval", conf.MetricsPushInterval.String())
+		}
+		if conf.MetricsPushToken != "" {
+			args = append(args, secretArgs("metrics-push-token")...)
+		}
+		if conf.MetricsPushBuffer != 100000 {
+			args = append(args, "--metrics-push-buffer", strconv.Itoa(conf.MetricsPushBuffer))
+		}
+	}
+	if conf.DashboardListen != "" {
+		args = append(args, "--dashboard-listen", conf.DashboardListen)
+		if conf.DashboardTLSCert != "" {
+			args = append(args, "--dashboard-tls-cert", conf.DashboardTLSCert, "--dashboard-tls-key", conf.DashboardTLSKey)
+		}
+		if len(conf.DashboardUsers) > 0 {
+			args = append(args, secretArgs("dashboard-user")...)
+		}
+		if len(conf.DashboardAllow) > 0 {
+			args = append(args, "--dashboard-allow", strings.Join(conf.DashboardAllow, ","))
+		}
+		if conf.DashboardOIDCIssuer != "" {
+			args = append(args, "--dashboard-oidc-issuer", conf.DashboardOIDCIssuer,
+				"--dashboard-oidc-client-id", conf.DashboardOIDCClientID,
+				"--dashboard-oidc-allow", strings.Join(conf.DashboardOIDCAllow, ","))
+			if conf.DashboardOIDCClientSecret != "" {
+				args = append(args, secretArgs("dashboard-oidc-client-secret")...)
+			}
+		}
+		if conf.DashboardBanAttempts != 5 {
+			args = append(args, "--dashboard-ban-attempts", strconv.Itoa(conf.DashboardBanAttempts))
+		}
+		if conf.DashboardBanWindow != 10*time.Minute {
+			args = append(args, "--dashboard-ban-window", conf.DashboardBanWindow.String())
+		}
+		if conf.DashboardBanTime != 30*time.Minute {
+			args = append(args, "--dashboard-ban-time", conf.DashboardBanTime.String())
+		}
+	}
+	if len(conf.DashboardACME) > 0 {
+		args = append(args, "--dashboard-acme", strings.Join(conf.DashboardACME, ","))
+		if conf.DashboardACMEEmail != "" {
+			args = append(args, "--dashboard-acme-email", conf.DashboardACMEEmail)
+		}
+		if conf.DashboardACMECA != defaultACMECA {
+			args = append(args, "--dashboard-acme-ca", conf.DashboardACMECA)
+		}
+		if conf.DashboardACMEHTTP != "" {
+			args = append(args, "--dashboard-acme-http", conf.DashboardACMEHTTP)
+		}
+		if conf.DashboardACMEDNS != "" {
+			args = append(args, secretArgs("dashboard-acme-dns")...)
+		}
+	}
+	if conf.SyncServe {
+		args = append(args, "--sync-serve")
+	}
+	if conf.SyncFrom != "" {
+		args = append(args, "--sync-from", conf.SyncFrom)
+		if conf.SyncToken != "" {
+			args = append(args, secretArgs("sync-token")...)
+		}
+	}
+	if conf.HA {
+		args = append(args, "--ha")
+		if conf.HAPeer != "" {
+			args = append(args, "--ha-peer", conf.HAPeer)
+		}
+		for _, h := range conf.HAHooks {
+			args = append(args, "--ha-hook", h)
+		}
+	}
+	if conf.BudgetMonthly != "" {
+		args = append(args, "--budget-monthly", conf.BudgetMonthly)
+	}
+	for _, ip := range sortedKeys(conf.BudgetClients) {
+		args = append(args, "--budget-client", ip+"="+conf.BudgetClients[ip])
+	}
+	if conf.BudgetWarnPercent != 80 {
+		args = append(args, "--budget-warn-percent", strconv.FormatFloat(conf.BudgetWarnPercent, 'f', -1, 64))
+	}
+	if conf.BudgetDirect {
+		args = append(args, "--budget-direct")
+	}
+	for _, s := range conf.Schedules {
+		args = append(args, "--schedule", s)
+	}
+	if !slices.Equal(conf.DHCPLeases, defaultDHCPLeases) {
+		args = append(args, "--dhcp-leases", strings.Join(conf.DHCPLeases, ","))
+	}
+	if len(conf.Reflect) > 0 {
+		args = append(args, "--reflect", strings.Join(conf.Reflect, ","), "--reflect-ifaces", strings.Join(conf.ReflectIfaces, ","))
+	}
+	if conf.AdminAPI {
+		args = append(args, "--admin-api")
+	}
+	for _, name := range sortedKeys(conf.Profiles) {
+		args = append(args, "--profile", name+"="+conf.Profiles[name])
+	}
+	if conf.GRPCListen != "" {
+		args = append(args, "--grpc-listen", conf.GRPCListen)
+	}
+	if len(conf.Plugins) > 0 {
+		for _, p := range conf.Plugins {
+			args = append(args, "--plugin", p)
+		}
+		if conf.PluginTimeout != 10*time.Second {
+			args = append(args, "--plugin-timeout", conf.PluginTimeout.String())
+		}
+	}
+	if conf.AssetMirrorListen != "" {
+		args = append(args, "--asset-mirror-listen", conf.AssetMirrorListen)
+		if conf.AssetMirrorTTL != 12*time.Hour {
+			args = append(args, "--asset-mirror-ttl", conf.AssetMirrorTTL.String())
+		}
+		if conf.AssetMirrorProxy != "" {
+			args = append(args, "--asset-mirror-proxy", conf.AssetMirrorProxy)
+		}
+	}
+	if len(conf.DNSFallback) > 0 {
+		args = append(args, "--dns-fallback", strings.Join(conf.DNSFallback, ","))
+		if conf.DNSFallbackPort != 1054 {
+			args = append(args, "--dns-fallback-port", strconv.Itoa(int(conf.DNSFallbackPort)))
+		}
+	}
+	for _, p := range conf.Policies {
+		args = append(args, "--policy", p)
+	}
+	if conf.RunAs != "" {
+		args = append(args, "--run-as", conf.RunAs)
+	}
+	if conf.IPv6BypassLAN {
+		args = append(args, "--ipv6-bypass-lan")
+	}
+	if len(conf.DockerNetworks) > 0 {
+		args = append(args, "--docker-networks", strings.Join(conf.DockerNetworks, ","))
+	}
+	return args
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// hasArgs reports whether want appears in args in order and next to each
+// other.
+func hasArgs(args []string, want ...string) bool {
+	for i := 0; i+len(want) <= len(args); i++ {
+		if slices.Equal(args[i:i+len(want)], want) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStartArgs(t *testing.T) {
+	defaults := conf
+	t.Cleanup(func() { conf = defaults })
+
+	tests := []struct {
+		name string
+		set  func(c *TPClashConf)
+		want [][]string
+		// the flags or values which must not be in the command line
+		absent []string
+	}{
+		{
+			name:   "defaults",
+			set:    func(c *TPClashConf) {},
+			want:   [][]string{{"--home", "/data/clash"}, {"--config", "/etc/clash.yaml"}, {"--ui", "yacd"}},
+			absent: []string{"--controller-policy", "--dhcp-leases", "--plugin-timeout", "--with-ghproxy", "--ha", "--lang"},
+		},
+		{
+			name: "repeatable",
+			set: func(c *TPClashConf) {
+				c.Schedules = []string{"0 23 * * * mode direct", "0 7 * * * mode rule"}
+				c.Policies = []string{"hour >= 23 => udp off"}
+				c.ConfigScripts = []string{"/etc/tpclash/a.star", "/etc/tpclash/b.star"}
+				c.HAHooks = []string{"logger ha"}
+				c.HA = true
+			},
+			want: [][]string{
+				{"--schedule", "0 23 * * * mode direct", "--schedule", "0 7 * * * mode rule"},
+				{"--policy", "hour >= 23 => udp off"},
+				{"--config-script", "/etc/tpclash/a.star", "--config-script", "/etc/tpclash/b.star"},
+				{"--ha"}, {"--ha-hook", "logger ha"},
+			},
+			absent: []string{"--ha-peer"},
+		},
+		{
+			name: "lists",
+			set: func(c *TPClashConf) {
+				c.Presets = []string{"enable-tun", "lan-bypass"}
+				c.Pipeline = []string{"presets", "enforce"}
+				c.PipelineSkip = []string{"rulesets"}
+				c.PipelineTrace = true
+				c.Reflect = []string{"mdns"}
+				c.ReflectIfaces = []string{"br-lan", "br-iot"}
+				c.DHCPLeases = []string{"/tmp/dhcp.leases"}
+				c.DNSFallback = []string{"223.5.5.5", "119.29.29.29"}
+			},
+			want: [][]string{
+				{"--preset", "enable-tun,lan-bypass"},
+				{"--pipeline", "presets,enforce"}, {"--pipeline-skip", "rulesets"}, {"--pipeline-trace"},
+				{"--reflect", "mdns", "--reflect-ifaces", "br-lan,br-iot"},
+				{"--dhcp-leases", "/tmp/dhcp.leases"},
+				{"--dns-fallback", "223.5.5.5,119.29.29.29"},
+			},
+			absent: []string{"--dns-fallback-port"},
+		},
+		{
+			name: "changed defaults",
+			set: func(c *TPClashConf) {
+				c.Plugins = []string{"/usr/local/bin/hook"}
+				c.PluginTimeout = 30 * time.Second
+				c.AssetMirrorListen = "127.0.0.1:9095"
+				c.AssetMirrorTTL = time.Hour
+				c.AssetMirrorProxy = "http://127.0.0.1:7890"
+				c.DNSFallback = []string{"223.5.5.5"}
+				c.DNSFallbackPort = 1055
+				c.Profiles = map[string]string{"work": "https://b.example.com", "home": "/etc/home.yaml"}
+			},
+			want: [][]string{
+				{"--plugin", "/usr/local/bin/hook", "--plugin-timeout", "30s"},
+				{"--asset-mirror-listen", "127.0.0.1:9095", "--asset-mirror-ttl", "1h0m0s", "--asset-mirror-proxy", "http://127.0.0.1:7890"},
+				{"--dns-fallback-port", "1055"},
+				{"--profile", "home=/etc/home.yaml", "--profile", "work=https://b.example.com"},
+			},
+		},
+		{
+			name: "services",
+			set: func(c *TPClashConf) {
+				c.AdminAPI = true
+				c.GRPCListen = ":9444"
+				c.SyncServe = true
+				c.HA = true
+				c.HAPeer = "http://192.168.1.3:8080/readyz"
+				c.ConfigReplay = "/tmp/captures"
+				c.UpgradeWithGhProxy = true
+			},
+			want: [][]string{
+				{"--admin-api"}, {"--grpc-listen", ":9444"}, {"--sync-serve"},
+				{"--ha", "--ha-peer", "http://192.168.1.3:8080/readyz"},
+				{"--config-replay", "/tmp/captures"}, {"--with-ghproxy"},
+			},
+		},
+		{
+			name: "secrets",
+			set: func(c *TPClashConf) {
+				c.ControllerSocketToken = "socket-secret"
+				c.MetricsPush = "http://vm:8428/write"
+				c.MetricsPushToken = "push-secret"
+				c.SyncFrom = "https://192.168.1.1:9443"
+				c.SyncToken = "sync-secret"
+			},
+			want: [][]string{
+				{"--controller-socket-token-file", "/etc/tpclash/secrets/controller-socket-token"},
+				{"--metrics-push", "http://vm:8428/write"},
+				{"--metrics-push-token-file", "/etc/tpclash/secrets/metrics-push-token"},
+				{"--sync-from", "https://192.168.1.1:9443", "--sync-token-file", "/etc/tpclash/secrets/sync-token"},
+			},
+			absent: []string{"socket-secret", "push-secret", "sync-secret", "--controller-socket-token", "--metrics-push-token", "--sync-token"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf = defaults
+			conf.Lang = LangEN
+			tt.set(&conf)
+			args := startArgs()
+			for _, want := range tt.want {
+				if !hasArgs(args, want...) {
+					t.Errorf("startArgs() = %q, missing %q", args, want)
+				}
+			}
+			for _, a := range tt.absent {
+				if slices.Contains(args, a) {
+					t.Errorf("startArgs() = %q, must not contain %q", args, a)
+				}
+			}
+		})
+	}
+}
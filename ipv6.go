@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ipv6CheckInterval is how often the lan prefixes are checked besides the
+	// address changes reported by netlink
+	ipv6CheckInterval = time.Minute
+	// ipv6SettleDelay is the quiet period after an address change, a new
+	// delegated prefix changes the addresses of several interfaces at once
+	ipv6SettleDelay = 3 * time.Second
+)
+
+// ipv6Templated is set once the config uses the ipv6 prefixes(the template or
+// the ipv6 stage), the config is rendered and reloaded again when they change.
+var ipv6Templated atomic.Bool
+
+// LANPrefixes6 returns the prefixes of the ipv6 global addresses of the host,
+// the prefixes delegated by the ISP are assigned to the lan interfaces from
+// them. The deprecated addresses of an old prefix and the tun devices of the
+// core are skipped, the prefixes longer than /64 are widened to /64. The
+// interfaces of the ipv6 default route(the wan) are skipped as well except
+// --lan-interface, they are only used if no other interface has a prefix(the
+// single interface hosts).
+func LANPrefixes6() ([]netip.Prefix, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("[ipv6] failed to list interfaces: %w", err)
+	}
+	wan, err := defaultRouteLinks6()
+	if err != nil {
+		return nil, err
+	}
+	var prefixes, wanPrefixes []netip.Prefix
+	for _, l := range links {
+		if l.Type() == "tuntap" || l.Attrs().Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := netlink.AddrList(l, unix.AF_INET6)
+		if err != nil {
+			return nil, fmt.Errorf("[ipv6] failed to list the addresses of %s: %w", l.Attrs().Name, err)
+		}
+		for _, a := range addrs {
+			if a.Flags&(unix.IFA_F_DEPRECATED|unix.IFA_F_TENTATIVE|unix.IFA_F_DADFAILED) != 0 {
+				continue
+			}
+			addr, ok := netip.AddrFromSlice(a.IP)
+			if !ok || !addr.Is6() || addr.Is4In6() || !addr.IsGlobalUnicast() {
+				continue
+			}
+			bits, _ := a.Mask.Size()
+			p := netip.PrefixFrom(addr, min(bits, 64)).Masked()
+			if wan[l.Attrs().Index] && l.Attrs().Name != conf.LANInterface {
+				wanPrefixes = append(wanPrefixes, p)
+			} else {
+				prefixes = append(prefixes, p)
+			}
+		}
+	}
+	if len(prefixes) == 0 {
+		prefixes = wanPrefixes
+	}
+	return mergePrefixes6(prefixes), nil
+}
+
+// defaultRouteLinks6 returns the indexes of the interfaces the ipv6 default
+// routes of the main table go through.
+func defaultRouteLinks6() (map[int]bool, error) {
+	routes, err := netlink.RouteListFiltered(unix.AF_INET6, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("[ipv6] failed to list the routes: %w", err)
+	}
+	links := map[int]bool{}
+	for _, r := range routes {
+		if r.Dst != nil {
+			if bits, _ := r.Dst.Mask.Size(); bits != 0 {
+				continue
+			}
+		}
+		links[r.LinkIndex] = true
+		for _, nh := range r.MultiPath {
+			links[nh.LinkIndex] = true
+		}
+	}
+	return links, nil
+}
+
+// templatePrefixes6 returns the lan prefixes for the config template.
+func templatePrefixes6() []string {
+	ipv6Templated.Store(true)
+	prefixes, err := LANPrefixes6()
+	if err != nil {
+		logrus.Errorf("[helper/ipv6-prefix] %v", err)
+		return nil
+	}
+	var ss []string
+	for _, p := range prefixes {
+		ss = append(ss, p.String())
+	}
+	return ss
+}
+
+// templatePrefix6 returns the first lan prefix for the config template, it is
+// empty if the host has no ipv6 global address.
+func templatePrefix6() string {
+	if ss := templatePrefixes6(); len(ss) > 0 {
+		return ss[0]
+	}
+	return ""
+}
+
+// excludePrefixes6 adds the lan prefixes to tun.route-exclude-address with
+// --ipv6-bypass-lan, the traffic of the host to the lan is not routed into the
+// tun of the core either. The prefixes of the config are kept.
+func excludePrefixes6(doc *yaml.Node) bool {
+	root := yamlRoot(doc)
+	if !conf.IPv6BypassLAN || root == nil {
+		return false
+	}
+	_, tun := yamlMapGet(root, "tun")
+	if _, enable := yamlMapGet(tun, "enable"); enable == nil || enable.Value != "true" {
+		return false
+	}
+	ipv6Templated.Store(true)
+	prefixes, err := LANPrefixes6()
+	if err != nil {
+		logrus.Errorf("[ipv6] %v", err)
+		return false
+	}
+
+	_, exclude := yamlMapGet(tun, "route-exclude-address")
+	if exclude == nil {
+		exclude = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		tun.Content = append(tun.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "route-exclude-address"}, exclude)
+	}
+	if exclude.Kind != yaml.SequenceNode {
+		logrus.Errorf("[ipv6] tun.route-exclude-address is not a list, skip...")
+		return false
+	}
+	var n int
+	for _, p := range prefixes {
+		if !slices.ContainsFunc(exclude.Content, func(e *yaml.Node) bool { return e.Value == p.String() }) {
+			exclude.Content = append(exclude.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: p.String()})
+			n++
+		}
+	}
+	if n == 0 {
+		return false
+	}
+	logrus.Debugf("[ipv6] %d lan prefixes added to tun.route-exclude-address", n)
+	return true
+}
+
+// WatchIPv6Prefixes applies the rules of --ipv6-bypass-lan to the current lan
+// prefixes and follows their changes, the config is reloaded as well when its
+// template uses them.
+func WatchIPv6Prefixes(ctx context.Context, confPath string, proc *CoreProcess) {
+	if !conf.IPv6BypassLAN && !ipv6Templated.Load() {
+		return
+	}
+
+	updates := make(chan netlink.AddrUpdate, 16)
+	if err := netlink.AddrSubscribeWithOptions(updates, ctx.Done(), netlink.AddrSubscribeOptions{
+		ErrorCallback: func(err error) { logrus.Debugf("[ipv6] address subscription error: %v", err) },
+	}); err != nil {
+		logrus.Warnf("[ipv6] failed to subscribe to the address changes, checking every %s: %v", ipv6CheckInterval, err)
+		updates = nil
+	}
+
+	current, err := LANPrefixes6()
+	if err != nil {
+		logrus.Error(err)
+	}
+	logrus.Infof("[ipv6] lan prefixes: %s", formatPrefixes6(current))
+	if conf.IPv6BypassLAN {
+		if err = SetLANPrefixes6(ctx, current); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	ticker := time.NewTicker(ipv6CheckInterval)
+	defer ticker.Stop()
+	settle := time.NewTimer(0)
+	<-settle.C
+	for {
+		select {
+		case <-ctx.Done():
+			settle.Stop()
+			return
+		case u, ok := <-updates:
+			if !ok {
+				logrus.Warnf("[ipv6] address subscription closed, checking every %s", ipv6CheckInterval)
+				updates = nil
+				continue
+			}
+			if u.LinkAddress.IP.To4() == nil {
+				settle.Reset(ipv6SettleDelay)
+			}
+			continue
+		case <-settle.C:
+		case <-ticker.C:
+		}
+
+		prefixes, err := LANPrefixes6()
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		if slices.Equal(prefixes, current) {
+			continue
+		}
+		logrus.Infof("[ipv6] lan prefixes changed: %s -> %s", formatPrefixes6(current), formatPrefixes6(prefixes))
+		current = prefixes
+		applyPrefixes6(ctx, prefixes, confPath, proc)
+	}
+}
+
+// applyPrefixes6 regenerates the rules and the config of the new prefixes.
+func applyPrefixes6(ctx context.Context, prefixes []netip.Prefix, confPath string, proc *CoreProcess) {
+	if conf.IPv6BypassLAN {
+		err := SetLANPrefixes6(ctx, prefixes)
+		Audit(AuditSourceSchedule, "", "ipv6.prefixes", formatPrefixes6(prefixes), err)
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+	if !ipv6Templated.Load() {
+		return
+	}
+
+	ctx, span := startUpdate(ctx, "ipv6")
+	ccStr, err := loadConfigSource(ctx)
+	if err == nil {
+		err = reloadConfig(ctx, ccStr, confPath, proc)
+	}
+	endSpan(span, err)
+	Audit(AuditSourceSchedule, "", "config.reload", redactURL(conf.ClashConfig), err)
+	if err != nil {
+		logrus.Error(err)
+		Notify(EventReloadFailure, "%v", err)
+		return
+	}
+	logrus.Info("[ipv6] clash config rendered with the new prefixes and reloaded")
+	Notify(EventReloadSuccess, "clash config reloaded for the new ipv6 prefixes")
+	ReapplySchedule()
+	ReapplyPolicies()
+}
+
+func formatPrefixes6(prefixes []netip.Prefix) string {
+	if len(prefixes) == 0 {
+		return "none"
+	}
+	return joinPrefixes(prefixes)
+}
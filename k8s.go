@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+var k8sInitCmd = &cobra.Command{
+	Use:   "k8s-init",
+	Short: "Setup transparent proxy rules in the pod network namespace(init container)",
+	Run: func(_ *cobra.Command, _ []string) {
+		if conf.Debug {
+			logrus.SetLevel(logrus.DebugLevel)
+		}
+
+		if err := ApplyPodRules(); err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("[k8s] pod rules applied, tcp -> :%d, dns -> :%d, proxy uid: %d", conf.K8sRedirPort, conf.K8sDNSPort, conf.K8sProxyUID)
+	},
+}
+
+var k8sSidecarCmd = &cobra.Command{
+	Use:   "k8s-sidecar",
+	Short: "Run clash as the transparent proxy sidecar of a pod",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf.K8sSidecar = true
+		return rootCmd.RunE(cmd, args)
+	},
+}
+
+// ApplyPodRules redirects the outbound traffic of the current network namespace
+// to the clash redir-port in the same way as istio-init. Traffic of the proxy uid
+// (the sidecar core), loopback and the excluded cidrs is left untouched; DNS is
+// redirected before the cidr exclusions, so clash must forward cluster domains
+// to kube-dns(e.g. nameserver-policy).
+func ApplyPodRules() error {
+	nft, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("[k8s] failed connect to nftables: %v", err)
+	}
+
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: TablePod}
+	nft.AddTable(table)
+	nft.DelTable(table)
+	if err = buildPodRules(nft); err != nil {
+		return err
+	}
+
+	if err = nft.Flush(); err != nil {
+		return fmt.Errorf("[k8s] failed to flush nftables: %v", err)
+	}
+	return nil
+}
+
+// buildPodRules adds the pod table of ApplyPodRules.
+func buildPodRules(nft nftBuilder) error {
+	excludes := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	for _, s := range conf.K8sExcludeCIDRs {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return fmt.Errorf("[k8s] failed to parse exclude cidr: %s: %w", s, err)
+		}
+		excludes = append(excludes, p)
+	}
+
+	table := nft.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: TablePod})
+
+	chain := nft.AddChain(&nftables.Chain{
+		Name:     ChainPodOutput,
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityNATDest,
+	})
+
+	set := &nftables.Set{
+		Table:    table,
+		Name:     SetPodExclude,
+		KeyType:  nftables.TypeIPAddr,
+		Interval: true,
+	}
+	if err := nft.AddSet(set, prefixSetElements(mergePrefixes(excludes))); err != nil {
+		return fmt.Errorf("[k8s] failed to add exclude set: %w", err)
+	}
+
+	ret := &expr.Verdict{Kind: expr.VerdictReturn}
+
+	// meta skuid <proxy uid> return
+	nft.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: []expr.Any{
+		&expr.Meta{Key: expr.MetaKeySKUID, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(conf.K8sProxyUID))},
+		ret,
+	}})
+
+	if conf.K8sDNSPort > 0 {
+		lo := netip.MustParseAddr("127.0.0.1").As4()
+		for _, proto := range []byte{unix.IPPROTO_UDP, unix.IPPROTO_TCP} {
+			// ip daddr != 127.0.0.1 meta l4proto udp/tcp th dport 53 redirect to :dns
+			nft.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: []expr.Any{
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: lo[:]},
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(53)},
+				&expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(conf.K8sDNSPort))},
+				&expr.Redir{RegisterProtoMin: 1},
+			}})
+		}
+	}
+
+	// ip daddr @pod_exclude return
+	nft.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+		ret,
+	}})
+
+	// meta l4proto tcp redirect to :redir
+	nft.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		&expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(conf.K8sRedirPort))},
+		&expr.Redir{RegisterProtoMin: 1},
+	}})
+	return nil
+}
+
+func chownTree(root string, uid, gid int) error {
+	return filepath.WalkDir(root, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{k8sInitCmd, k8sSidecarCmd} {
+		cmd.Flags().IntVar(&conf.K8sProxyUID, "proxy-uid", 1337, "uid of the clash process, its traffic is not redirected")
+		cmd.Flags().IntVar(&conf.K8sRedirPort, "redir-port", 7892, "clash redir-port which the pod tcp traffic is redirected to")
+	}
+	k8sInitCmd.Flags().IntVar(&conf.K8sDNSPort, "dns-port", 1053, "clash dns port which the pod dns queries are redirected to(0 to disable)")
+	k8sInitCmd.Flags().StringSliceVar(&conf.K8sExcludeCIDRs, "exclude-cidrs", []string{}, "destination cidrs that are not redirected(e.g. cluster cidr)")
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// results of a leak test check
+const (
+	LeakPass    = "pass"
+	LeakLeak    = "leak"
+	LeakUnknown = "unknown"
+)
+
+const (
+	// leakLogWarmup is how long the debug log stream of the core is given to
+	// connect before the queries are sent
+	leakLogWarmup = 500 * time.Millisecond
+	// leakLogWait is how long a query waits for its name in the debug logs
+	leakLogWait = 2 * time.Second
+	// leakQUICVersion is a reserved version(RFC 9000 15), a quic server
+	// answers it with a version negotiation packet
+	leakQUICVersion = 0x1a2a3a4a
+	// leakQUICSize is the minimum size of a datagram with an initial packet,
+	// smaller ones are dropped by the servers
+	leakQUICSize = 1200
+)
+
+var leakOpts struct {
+	api         string
+	secret      string
+	fakeIPRange string
+	dnsServers  []string
+	ipv6Targets []string
+	quicTargets []string
+	udpTargets  []string
+	timeout     time.Duration
+}
+
+// LeakCheck is the result of a check of the leaktest command.
+type LeakCheck struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+var leakTestCmd = &cobra.Command{
+	Use:   "leaktest",
+	Short: "Check if dns, ipv6 or udp traffic can escape the proxy",
+	Long: `Check if dns, ipv6 or udp traffic can escape the proxy.
+
+The probes are sent to public addresses directly, like the clients that do not
+use the dns of the gateway or only have an ipv6 route. A probe leaked if it
+got an answer but the core never saw it:
+
+  dns   a query of a random name to --dns-server over udp and tcp, it must be
+        in the debug logs of the core or answered with a fake ip
+  ipv6  a tcp connection to --ipv6-target, it must be in the connections of
+        the core or not be reachable
+  quic  a quic packet of a reserved version to --quic-target, the servers
+        answer it with a version negotiation packet
+  udp   an ntp request to --udp-target
+
+The checks run on this host by default. To test the path of a LAN client, run
+the command on the client with the clash api of the gateway:
+
+  tpclash leaktest --api 192.168.1.1:9090 --secret SECRET
+
+A probe neither seen by the core nor answered is reported as unknown, it was
+dropped or rejected by a rule. The command fails if a probe leaked.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if leakOpts.timeout <= 0 {
+			logrus.Fatal("[leaktest] timeout must be positive")
+		}
+
+		var api *ClashAPI
+		var fakeRange netip.Prefix
+		if leakOpts.api != "" {
+			api = &ClashAPI{Addr: leakOpts.api, secret: leakOpts.secret, cli: &http.Client{Timeout: 10 * time.Second}}
+		} else {
+			cc, err := RunningConf()
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			api = NewClashAPI(cc)
+			if strings.ToLower(cc.DNS.EnhancedMode) == "fake-ip" {
+				fakeRange, _ = netip.ParsePrefix(cc.DNS.FakeIPRange)
+			}
+		}
+		if leakOpts.fakeIPRange != "" {
+			p, err := netip.ParsePrefix(leakOpts.fakeIPRange)
+			if err != nil {
+				logrus.Fatalf("[leaktest] invalid fake-ip range %q: %v", leakOpts.fakeIPRange, err)
+			}
+			fakeRange = p
+		}
+		if err := api.Do(http.MethodGet, "/version", nil, nil); err != nil {
+			logrus.Fatalf("[leaktest] the clash api is not reachable: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		logs := watchLeakLogs(ctx, api)
+
+		var probes []func() LeakCheck
+		for _, s := range leakOpts.dnsServers {
+			s := s
+			probes = append(probes,
+				func() LeakCheck { return leakDNS(api, logs, fakeRange, "udp", s) },
+				func() LeakCheck { return leakDNS(api, logs, fakeRange, "tcp", s) })
+		}
+		for _, t := range leakOpts.ipv6Targets {
+			t := t
+			probes = append(probes, func() LeakCheck { return leakConn(api, "ipv6", "tcp6", t, nil) })
+		}
+		for _, t := range leakOpts.quicTargets {
+			t := t
+			probes = append(probes, func() LeakCheck { return leakConn(api, "quic", "udp", t, leakQUICProbe) })
+		}
+		for _, t := range leakOpts.udpTargets {
+			t := t
+			probes = append(probes, func() LeakCheck { return leakConn(api, "udp", "udp", t, leakNTPProbe) })
+		}
+		if len(probes) == 0 {
+			logrus.Fatal("[leaktest] no targets to probe")
+		}
+
+		// the probes wait for the core independently, they run concurrently
+		checks := make([]LeakCheck, len(probes))
+		var wg sync.WaitGroup
+		for i, p := range probes {
+			i, p := i, p
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				checks[i] = p()
+			}()
+		}
+		wg.Wait()
+
+		var leaked int
+		for _, c := range checks {
+			if c.Status == LeakLeak {
+				leaked++
+			}
+		}
+		if jsonOutput() {
+			printJSON(checks)
+		} else {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			_, _ = fmt.Fprintln(w, "CHECK\tTARGET\tSTATUS\tDETAIL")
+			for _, c := range checks {
+				_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Name, c.Target, c.Status, c.Detail)
+			}
+			_ = w.Flush()
+		}
+		if leaked > 0 {
+			logrus.Fatalf("[leaktest] %d of %d probes escaped the proxy", leaked, len(checks))
+		}
+	},
+}
+
+// leakLogs collects the debug logs of the core, the dns queries hijacked by
+// the core are only visible there.
+type leakLogs struct {
+	sync.Mutex
+	payloads []string
+	err      error
+}
+
+// watchLeakLogs streams the debug logs of the core until ctx is done.
+func watchLeakLogs(ctx context.Context, api *ClashAPI) *leakLogs {
+	l := &leakLogs{}
+	go func() {
+		err := api.Stream(ctx, "/logs?level=debug", func(msg json.RawMessage) bool {
+			var m struct {
+				Payload string `json:"payload"`
+			}
+			if json.Unmarshal(msg, &m) == nil && strings.HasPrefix(m.Payload, "[DNS") {
+				l.Lock()
+				l.payloads = append(l.payloads, m.Payload)
+				l.Unlock()
+			}
+			return true
+		})
+		if err == nil {
+			err = errors.New("the log stream ended")
+		}
+		l.Lock()
+		l.err = err
+		l.Unlock()
+	}()
+	time.Sleep(leakLogWarmup)
+	return l
+}
+
+// seen waits up to leakLogWait for a dns log of name. The error is set if
+// the logs are not available.
+func (l *leakLogs) seen(name string) (bool, error) {
+	deadline := time.Now().Add(leakLogWait)
+	for {
+		l.Lock()
+		for _, p := range l.payloads {
+			if strings.Contains(p, name) {
+				l.Unlock()
+				return true, nil
+			}
+		}
+		err := l.err
+		l.Unlock()
+		if err != nil {
+			return false, err
+		}
+		if time.Now().After(deadline) {
+			return false, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// leakDNS queries a random name from the server, the query leaked if the
+// server answered it without the core. A query not hijacked by the dns of the
+// core may still be routed through the proxy.
+func leakDNS(api *ClashAPI, logs *leakLogs, fakeRange netip.Prefix, network, server string) LeakCheck {
+	check := LeakCheck{Name: "dns/" + network, Target: server}
+	var held []net.Conn
+	var mu sync.Mutex
+	defer func() {
+		for _, c := range held {
+			_ = c.Close()
+		}
+	}()
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, network, server)
+			if err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			held = append(held, conn)
+			mu.Unlock()
+			return heldConn(conn), nil
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), leakOpts.timeout)
+	defer cancel()
+	// the probes run concurrently, the names must differ
+	token, err := randomToken()
+	if err != nil {
+		check.Status, check.Detail = LeakUnknown, err.Error()
+		return check
+	}
+	host := "tpclash-leak-" + token[:16] + ".example.com"
+	addrs, err := r.LookupNetIP(ctx, "ip4", host+".")
+
+	var dnsErr *net.DNSError
+	answered := err == nil || (errors.As(err, &dnsErr) && dnsErr.IsNotFound)
+	answer := "not found"
+	if err == nil {
+		answer = fmt.Sprint(addrs)
+	} else if !answered {
+		answer = err.Error()
+	}
+	if len(addrs) > 0 && fakeRange.IsValid() && fakeRange.Contains(addrs[0]) {
+		check.Status, check.Detail = LeakPass, "hijacked by the core, "+answer
+		return check
+	}
+	seen, logErr := logs.seen(host)
+	if seen {
+		check.Status, check.Detail = LeakPass, "hijacked by the core, "+answer
+		return check
+	}
+
+	mu.Lock()
+	var local net.Addr
+	if len(held) > 0 {
+		local = held[0].LocalAddr()
+	}
+	mu.Unlock()
+	var connErr error
+	if local != nil {
+		var c clashConn
+		if c, connErr = waitSmokeConn(api, network, local); connErr == nil {
+			check.Status = LeakPass
+			check.Detail = fmt.Sprintf("not hijacked, via %s, %s", strings.Join(c.Route(), " -> "), answer)
+			return check
+		}
+	}
+
+	switch {
+	case connErr != nil && !errors.Is(connErr, errNotIntercepted):
+		check.Status, check.Detail = LeakUnknown, connErr.Error()
+	case answered && (logErr == nil || fakeRange.IsValid()):
+		check.Status = LeakLeak
+		check.Detail = fmt.Sprintf("answered by %s without the core, %s", server, answer)
+	case answered:
+		check.Status = LeakUnknown
+		check.Detail = fmt.Sprintf("answered(%s), the logs of the core are not available: %v", answer, logErr)
+	default:
+		check.Status = LeakUnknown
+		check.Detail = "not seen by the core and no answer: " + answer
+	}
+	return check
+}
+
+// heldConn returns conn with a no-op Close, the connections of the resolver
+// must stay open until they are looked up in the connections api. The udp
+// connections keep the net.PacketConn methods the resolver relies on.
+func heldConn(conn net.Conn) net.Conn {
+	if uc, ok := conn.(*net.UDPConn); ok {
+		return heldUDPConn{uc}
+	}
+	return heldStreamConn{conn}
+}
+
+type heldUDPConn struct{ *net.UDPConn }
+
+func (heldUDPConn) Close() error { return nil }
+
+type heldStreamConn struct{ net.Conn }
+
+func (heldStreamConn) Close() error { return nil }
+
+// leakConn connects to the target and sends the probe, a probe leaked if the
+// core did not see the connection but it was established or answered. The
+// probe returns a description of the reply, an empty one if there is none.
+func leakConn(api *ClashAPI, name, network, target string, probe func(conn net.Conn) string) LeakCheck {
+	check := LeakCheck{Name: name, Target: target}
+	conn, err := net.DialTimeout(network, target, leakOpts.timeout)
+	if err != nil {
+		check.Status = LeakPass
+		check.Detail = fmt.Sprintf("not reachable: %v", err)
+		return check
+	}
+	defer func() { _ = conn.Close() }()
+
+	// the tcp handshake is the reply, the core answers it itself if the
+	// connection is intercepted
+	reply := "connected"
+	if probe != nil {
+		_ = conn.SetDeadline(time.Now().Add(leakOpts.timeout))
+		reply = probe(conn)
+	}
+	c, err := waitSmokeConn(api, strings.TrimSuffix(network, "6"), conn.LocalAddr())
+	switch {
+	case err == nil:
+		check.Status = LeakPass
+		check.Detail = fmt.Sprintf("via %s", strings.Join(c.Route(), " -> "))
+		if reply != "" {
+			check.Detail += ", " + reply
+		}
+	case !errors.Is(err, errNotIntercepted):
+		check.Status = LeakUnknown
+		check.Detail = err.Error()
+	case reply != "":
+		check.Status = LeakLeak
+		check.Detail = fmt.Sprintf("%s without the core, from %s", reply, conn.LocalAddr())
+	default:
+		check.Status = LeakUnknown
+		check.Detail = "not seen by the core and no reply, dropped or rejected"
+	}
+	return check
+}
+
+// leakQUICProbe sends a long header packet of a reserved version, a quic
+// server answers a version negotiation packet(version 0).
+func leakQUICProbe(conn net.Conn) string {
+	pkt := make([]byte, leakQUICSize)
+	pkt[0] = 0xc0
+	binary.BigEndian.PutUint32(pkt[1:], leakQUICVersion)
+	// destination and source connection ids of 8 bytes
+	pkt[5] = 8
+	_, _ = rand.Read(pkt[6:14])
+	pkt[14] = 8
+	_, _ = rand.Read(pkt[15:23])
+	if _, err := conn.Write(pkt); err != nil {
+		return ""
+	}
+
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+	if n >= 5 && buf[0]&0x80 != 0 && binary.BigEndian.Uint32(buf[1:5]) == 0 {
+		return "version negotiation received"
+	}
+	return fmt.Sprintf("%d bytes received", n)
+}
+
+// leakNTPProbe sends an ntp v3 client request.
+func leakNTPProbe(conn net.Conn) string {
+	req := make([]byte, 48)
+	req[0] = 0x1b
+	if _, err := conn.Write(req); err != nil {
+		return ""
+	}
+	n, err := conn.Read(make([]byte, 512))
+	if err != nil || n < 48 {
+		return ""
+	}
+	return "ntp reply received"
+}
+
+func init() {
+	leakTestCmd.Flags().StringVar(&leakOpts.api, "api", "", "clash api(HOST:PORT) of the gateway when testing from a LAN client, the running instance on this host by default")
+	leakTestCmd.Flags().StringVar(&leakOpts.secret, "secret", "", "clash api secret of --api")
+	leakTestCmd.Flags().StringVar(&leakOpts.fakeIPRange, "fake-ip-range", "", "fake-ip range of the core, from the running config by default")
+	leakTestCmd.Flags().StringSliceVar(&leakOpts.dnsServers, "dns-server", []string{"8.8.8.8:53", "1.1.1.1:53", "[2001:4860:4860::8888]:53"}, "public dns servers queried directly")
+	leakTestCmd.Flags().StringSliceVar(&leakOpts.ipv6Targets, "ipv6-target", []string{"[2606:4700:4700::1111]:443"}, "ipv6 addresses connected to over tcp")
+	leakTestCmd.Flags().StringSliceVar(&leakOpts.quicTargets, "quic-target", []string{"1.1.1.1:443", "[2606:4700:4700::1111]:443"}, "quic servers probed over udp")
+	leakTestCmd.Flags().StringSliceVar(&leakOpts.udpTargets, "udp-target", []string{"162.159.200.123:123"}, "ntp servers probed over udp")
+	leakTestCmd.Flags().DurationVar(&leakOpts.timeout, "timeout", 5*time.Second, "timeout of each probe")
+}
@@ -4,9 +4,9 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -29,11 +29,32 @@ var conf TPClashConf
 var rootCmd = &cobra.Command{
 	Use:   "tpclash",
 	Short: "Transparent proxy tool for Clash",
-	Run: func(_ *cobra.Command, _ []string) {
+	// command line flags > TPCLASH_* env > tpclash config file
+	PersistentPreRun: func(cmd *cobra.Command, _ []string) {
+		if err := LoadEnv(cmd.Flags()); err != nil {
+			logrus.Fatal(err)
+		}
+		if err := LoadConfFile(cmd.Root().PersistentFlags()); err != nil {
+			logrus.Fatal(err)
+		}
+		if err := LoadSecretFiles(cmd.Flags()); err != nil {
+			logrus.Fatal(err)
+		}
+		if err := CheckLang(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err := CheckOutput(); err != nil {
+			logrus.Fatal(err)
+		}
+	},
+	// the errors once the rules and the core are set up are returned, so the
+	// deferred cleanups still run
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		cmd.SilenceUsage = true
 		fmt.Printf("%s\nVersion: %s\nBuild: %s\nClash Core: %s\nCommit: %s\n\n", logo, version, build, clash, commit)
 
 		if conf.PrintVersion {
-			return
+			return nil
 		}
 
 		if conf.Debug {
@@ -41,73 +62,323 @@ var rootCmd = &cobra.Command{
 		}
 
 		logrus.Info("[main] starting tpclash...")
+		timer := newStartupTimer()
+
+		var err error
+		if core, err = NewCore(); err != nil {
+			logrus.Fatal(err)
+		}
+
+		ResolveUI(cmd)
+
+		if conf.OTelEndpoint != "" {
+			shutdown, err := InitOTel(context.Background())
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			defer shutdown()
+		}
+
+		if err = CheckControllerMode(); err != nil {
+			logrus.Fatal(err)
+		}
+
+		if err = InitNotifier(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckBudgetConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckDashboardConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckUIConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckACMEConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckMemoryConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckTestConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckChaosConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckCaptureConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckMQTTConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckScheduleConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckPolicyConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckReflectConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckSyncConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckHAConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckAdminConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckPluginConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckPresetConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckRulesetConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckPipelineConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckConfigScriptConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckAssetMirrorConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckDNSFallbackConf(); err != nil {
+			logrus.Fatal(err)
+		}
+
+		for _, m := range conf.ConfigMirrors {
+			if !isRemoteConfig() || !(strings.HasPrefix(m, "http://") || strings.HasPrefix(m, "https://")) {
+				logrus.Fatalf("[main] invalid config mirror %q, the mirrors require a remote --config and must be http(s) urls", redactURL(m))
+			}
+		}
+
+		for _, env := range conf.ClashEnv {
+			if k, _, ok := strings.Cut(env, "="); !ok || k == "" {
+				logrus.Fatalf("[main] invalid clash env %q, must be KEY=VALUE", env)
+			}
+		}
+
+		if conf.DryRun {
+			DryRun()
+			return nil
+		}
 
 		// Initialize signal control Context
 		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 		defer cancel()
 
-		// Configure Sysctl
-		Sysctl()
+		if InContainer() {
+			CheckContainer()
+		}
+
+		// Configure Sysctl, the pod network namespace is prepared by k8s-init
+		timer.Mark("init")
+		if !conf.K8sSidecar {
+			Sysctl()
+		}
+		timer.Mark("sysctl")
 
 		// Extract Clash executable and built-in configuration files
 		ExtractFiles()
+		InitState()
+		defer RemoveState()
+		PrepareUI()
+		PrepareRulesets(ctx)
+		timer.Mark("extract")
 
 		// Watch config file
 		updateCh := WatchConfig(ctx)
 
 		// Wait for the first config to return
-		clashConfStr := <-updateCh
+		clashConfStr := (<-updateCh).config
+		timer.Mark("fetch")
 
 		// Check clash config
-		cc, err := CheckConfig(clashConfStr)
+		cc, err := core.Check(clashConfStr)
 		if err != nil {
-			logrus.Fatal(err)
+			return err
 		}
 
 		// Copy remote or local clash config file to internal path
-		clashConfPath := filepath.Join(conf.ClashHome, InternalConfigName)
-		if err = os.WriteFile(clashConfPath, []byte(clashConfStr), 0644); err != nil {
-			logrus.Fatalf("[main] failed to copy clash config: %v", err)
+		clashConfPath := filepath.Join(conf.ClashHome, core.ConfigName())
+		if err = writeFileAtomic(clashConfPath, strings.NewReader(clashConfStr), 0644); err != nil {
+			return fmt.Errorf("[main] failed to copy clash config: %w", err)
+		}
+		RecordConfig(clashConfStr)
+		recordLoadedConfig(clashConfStr)
+		commitSyncConfig(clashConfStr)
+		timer.Mark("validate")
+
+		if err = PrepareCoreSocket(); err != nil {
+			return err
+		}
+		// Everything below runs with the network capabilities only
+		if err = DropPrivileges(); err != nil {
+			return err
 		}
+		defer stopSysctlHelper()
 
 		// Create child process
-		clashBinPath := filepath.Join(conf.ClashHome, InternalClashBinName)
-		clashUIPath := filepath.Join(conf.ClashHome, conf.ClashUI)
-		cmd := exec.Command(clashBinPath, "-f", clashConfPath, "-d", conf.ClashHome, "-ext-ui", clashUIPath)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.SysProcAttr = &syscall.SysProcAttr{
-			AmbientCaps: []uintptr{CAP_NET_BIND_SERVICE, CAP_NET_ADMIN, CAP_NET_RAW},
+		logrus.Infof("[main] using %s core...", core.Name())
+		if conf.ClashBin != "" {
+			coreVersion, err := CheckCoreBinary(conf.ClashBin)
+			if err != nil {
+				return err
+			}
+			logrus.Infof("[main] using external core %s: %s", conf.ClashBin, coreVersion)
+		}
+		// the providers of the core are fetched through the mirror from the start
+		mirror, err := ListenAssetMirror()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := ServeAssetMirror(ctx, mirror); err != nil {
+				logrus.Error(err)
+			}
+		}()
+		// the standby starts with the interception dormant
+		if err = InitHA(); err != nil {
+			return err
+		}
+		proc := NewCoreProcess(ctx, clashConfPath)
+		if err = proc.Start(); err != nil {
+			return err
 		}
-		logrus.Infof("[main] running cmds: %v", cmd.Args)
+		timer.Mark("core start")
+		coreStarted := time.Now()
 
-		if err = cmd.Start(); err != nil {
-			logrus.Fatalf("[main] failed to start clash process: %v: %v", err, cmd.Args)
-			cancel()
+		if err = WritePidFile(); err != nil {
+			logrus.Warnf("[main] failed to write pid file: %v", err)
 		}
-		if cmd.Process == nil {
-			logrus.Fatalf("[main] failed to start clash process: %v", cmd.Args)
-			cancel()
+		defer RemovePidFile()
+
+		// upgrade-core asks the running instance to restart the core via SIGUSR1
+		restartCh := make(chan os.Signal, 1)
+		signal.Notify(restartCh, syscall.SIGUSR1)
+		go func() {
+			for range restartCh {
+				if err := proc.Restart(); err != nil {
+					logrus.Errorf("[main] failed to restart core: %v", err)
+				}
+			}
+		}()
+
+		if !conf.K8sSidecar {
+			if err = SetDNSPort(ctx, cc.DNSPort()); err != nil {
+				logrus.Errorf("[main] failed to set dns redirect port: %v", err)
+			}
+			SetDNSFallbackTarget(cc)
+			go func() {
+				if err := ServeDNSFallback(ctx); err != nil {
+					logrus.Error(err)
+				}
+			}()
+			go WatchDNSFallback(ctx, proc)
+
+			if err = EnableDockerCompatible(); err != nil {
+				logrus.Errorf("[main] failed enable docker compatible: %v", err)
+			}
+			go WatchDocker(ctx)
 		}
+		timer.Mark("rules")
+
+		SetControllerTarget(cc)
+
+		// token rotate asks the running instance to apply the new secret via SIGUSR2
+		secretCh := make(chan os.Signal, 1)
+		signal.Notify(secretCh, syscall.SIGUSR2)
+		go func() {
+			for range secretCh {
+				if err := ApplySecret(clashConfPath, proc); err != nil {
+					logrus.Error(err)
+				}
+			}
+		}()
 
-		if err = EnableDockerCompatible(); err != nil {
-			logrus.Errorf("[main] failed enable docker compatible: %v", err)
+		if conf.ControllerMode == ControllerUnix {
+			go func() {
+				if err := ServeControllerSocket(ctx, cc); err != nil {
+					logrus.Error(err)
+				}
+			}()
+		}
+		InitAdmin(clashConfPath, proc)
+		go func() {
+			if err := ServeGRPC(ctx); err != nil {
+				logrus.Error(err)
+			}
+		}()
+		if conf.DashboardListen != "" {
+			go func() {
+				if err := ServeDashboard(ctx); err != nil {
+					logrus.Error(err)
+				}
+			}()
 		}
 
 		// Watch clash config changes, and automatically reload the config
-		go AutoReload(updateCh, clashConfPath)
+		go AutoReload(updateCh, clashConfPath, proc)
+
+		go WatchGeoData(ctx, clashConfPath, proc)
+		go WatchRulesets(ctx, clashConfPath)
+		go WatchUI(ctx)
+		go WatchClients(ctx)
+		go WatchConnLog(ctx)
+		go WatchDNSLog(ctx)
+		go WatchProxyHistory(ctx)
+		go WatchCoreMemory(ctx, proc)
+		if !conf.K8sSidecar {
+			if conf.RulesCheck {
+				go WatchRules(ctx)
+			}
+			go WatchIPv6Prefixes(ctx, clashConfPath, proc)
+		}
 
-		logrus.Info("[main] 🍄 提莫队长正在待命...")
+		if conf.MetricsListen != "" || conf.MetricsPush != "" {
+			RegisterMetrics(proc)
+		}
+		go PushMetrics(ctx)
+		go PublishMQTT(ctx)
+		go RetryWebhooks(ctx)
+		go RunSchedule(ctx)
+		go RunPolicies(ctx)
+		go RunReflector(ctx)
+		go RunAgent(ctx, clashConfPath, proc)
+		go WatchHA(ctx)
+		if conf.HealthListen != "" {
+			RegisterHealth(proc)
+		}
+		ServeEndpoints(ctx)
+
+		logrus.Info(T(msgStandby))
+		if conf.Timing || conf.Debug {
+			go timer.WaitCore(ctx, cc, coreStarted)
+		}
+		testResult := make(chan error, 1)
 		if conf.Test {
-			logrus.Warn("[main] test mode enabled, tpclash will automatically exit after 5 minutes...")
 			go func() {
-				<-time.After(5 * time.Minute)
+				testResult <- WatchTestMode(ctx)
 				cancel()
 			}()
 		}
+		if conf.Chaos {
+			go RunChaos(ctx, proc)
+		}
 
+		if conf.EnableTracing && CoreFlavor() != CorePremium {
+			logrus.Warn("[main] tracing is only supported by the premium core, disable tracing...")
+			conf.EnableTracing = false
+		}
 		if conf.EnableTracing {
-			logrus.Infof("[main] 🔪 永远不要忘记, 吾等为何而战...")
+			logrus.Info(T(msgTracingStart))
 			// always clean tracing containers
 			if err = stopTracing(ctx); err != nil {
 				logrus.Errorf("[main] ❌ tracing project cleanup failed: %v", err)
@@ -118,13 +389,20 @@ var rootCmd = &cobra.Command{
 		}
 
 		<-ctx.Done()
-		logrus.Info("[main] 🛑 TPClash 正在停止...")
-		if err = DisableDockerCompatible(); err != nil {
-			logrus.Errorf("[main] failed disable docker compatible: %v", err)
+		logrus.Info(T(msgStopping))
+		if !conf.K8sSidecar {
+			if err = DisableDockerCompatible(); err != nil {
+				logrus.Errorf("[main] failed disable docker compatible: %v", err)
+			}
+			err = CleanRules()
+			Audit(AuditSourceSignal, "", "rules.flush", "", err)
+			if err != nil {
+				logrus.Errorf("[main] failed clean tpclash rules: %v", err)
+			}
 		}
 
 		if conf.EnableTracing {
-			logrus.Infof("[main] 🔪 恐惧, 是万敌之首...")
+			logrus.Info(T(msgTracingStop))
 
 			tracingStopCtx, tracingStopCancel := context.WithTimeout(context.Background(), 30*time.Second)
 			defer tracingStopCancel()
@@ -134,34 +412,167 @@ var rootCmd = &cobra.Command{
 			}
 		}
 
-		if cmd.Process != nil {
-			if err := cmd.Process.Signal(syscall.SIGINT); err != nil {
-				logrus.Error(err)
+		signal.Stop(restartCh)
+		proc.Stop()
+
+		logrus.Info(T(msgStopped))
+		select {
+		case err = <-testResult:
+			if err != nil {
+				return err
 			}
+		default:
 		}
-
-		logrus.Info("[main] 🛑 TPClash 已关闭!")
+		return ChaosResult()
 	},
 }
 
 func init() {
 	cobra.EnableCommandSorting = false
+	// printed once by cobra.CheckErr
+	rootCmd.SilenceErrors = true
 
-	rootCmd.AddCommand(encCmd, decCmd, installCmd, uninstallCmd, upgradeCmd)
+	rootCmd.AddCommand(statusCmd, tuiCmd, proxiesCmd, pingCmd, smokeTestCmd, leakTestCmd, testConnectivityCmd, selftestCmd, benchCmd, rulesCmd, checkCmd, scheduleCmd, policyCmd, presetCmd, rulesetCmd, agentCmd, haCmd, matchCmd, connsCmd, providersCmd, modeCmd, dnsCmd, reportCmd, tokenCmd, auditCmd, configCmd, encCmd, decCmd, initCmd, installCmd, uninstallCmd, cleanCmd, backupCmd, restoreCmd, upgradeCmd, selfUpdateCmd, upgradeCoreCmd, upgradeUICmd, composeCmd, k8sInitCmd, k8sSidecarCmd, completionCmd, sysctlHelperCmd)
 
+	rootCmd.PersistentFlags().StringVar(&conf.ConfFile, "tpclash-config", defaultConfFile, "tpclash config file holding the settings of the flags, the command line flags override it")
+	rootCmd.PersistentFlags().StringVar(&conf.Lang, "lang", defaultLang(), "language of the startup/shutdown logs, the install/uninstall/upgrade notes and the init wizard(en|zh), default from LC_ALL/LC_MESSAGES/LANG, the other messages are english only")
+	rootCmd.PersistentFlags().StringVarP(&conf.Output, "output", "o", OutputText, "output format of the subcommands(text|json)")
 	rootCmd.PersistentFlags().BoolVar(&conf.Debug, "debug", false, "enable debug log")
-	rootCmd.PersistentFlags().BoolVar(&conf.Test, "test", false, "enable test mode, tpclash will automatically exit after 5 minutes")
+	rootCmd.PersistentFlags().BoolVar(&conf.DryRun, "dry-run", false, "print the sysctls, nftables rules, ip rules and files changed on startup without applying them")
+	rootCmd.PersistentFlags().BoolVar(&conf.Timing, "timing", false, "log how long each startup phase takes")
+	rootCmd.PersistentFlags().BoolVar(&conf.Test, "test", false, "enable test mode, tpclash will automatically exit after --test-duration")
+	rootCmd.PersistentFlags().DurationVar(&conf.TestDuration, "test-duration", 5*time.Minute, "how long tpclash runs in test mode")
+	rootCmd.PersistentFlags().IntVar(&conf.TestSuccess, "test-success", 0, "exit the test mode as soon as the number of successful proxied requests are observed, fail if they are not observed in --test-duration")
+	rootCmd.PersistentFlags().BoolVar(&conf.Chaos, "chaos", false, "inject random faults in test mode(kill the core, drop the config source, flush a rule) and fail the test if tpclash does not recover from them")
+	rootCmd.PersistentFlags().DurationVar(&conf.ChaosInterval, "chaos-interval", time.Minute, "average interval between the faults of --chaos")
+	rootCmd.PersistentFlags().StringVar(&conf.Core, "core", "", "proxy core flavor(premium|mihomo|sing-box), default is the embedded core")
+	rootCmd.PersistentFlags().StringVar(&conf.ClashBin, "clash-bin", "", "run an externally installed core executable instead of the embedded or downloaded one")
+	rootCmd.PersistentFlags().BoolVar(&conf.CoreHandoff, "core-handoff", false, "start the new core before stopping the running one on restarts and upgrades(mihomo tun mode)")
+	rootCmd.PersistentFlags().BoolVar(&conf.CoreRestart, "core-restart", false, "restart the core after a crash, with a backoff from 1s up to 30s")
+	rootCmd.PersistentFlags().BoolVar(&conf.ConfigCache, "config-cache", false, "cache the fetched remote config in the clash home, it is used when the remote config can not be fetched on startup")
+	rootCmd.PersistentFlags().BoolVar(&conf.RulesCheck, "rules-check", false, "check the tpclash rules every 30s and apply them again when they are changed outside of tpclash(e.g. a firewall reload)")
+	rootCmd.PersistentFlags().StringArrayVar(&conf.ClashExtraArgs, "clash-extra-args", []string{}, "extra arguments appended to the core command line(repeatable)")
+	rootCmd.PersistentFlags().StringArrayVar(&conf.ClashEnv, "clash-env", []string{}, "extra environment variables of the core(KEY=VALUE, repeatable)")
 	rootCmd.PersistentFlags().StringVarP(&conf.ClashHome, "home", "d", "/data/clash", "clash home dir")
 	rootCmd.PersistentFlags().StringVarP(&conf.ClashConfig, "config", "c", "/etc/clash.yaml", "clash config local path or remote url")
-	rootCmd.PersistentFlags().StringVarP(&conf.ClashUI, "ui", "u", "yacd", "clash dashboard(official|yacd)")
+	rootCmd.PersistentFlags().StringVarP(&conf.ClashUI, "ui", "u", "yacd", "clash dashboard(official|yacd|metacubexd)")
+	rootCmd.PersistentFlags().StringVar(&conf.UIPath, "ui-path", "", "serve a custom dashboard from the specified dir")
+	rootCmd.PersistentFlags().StringVar(&conf.UIPath, "ui-dir", "", "alias of --ui-path")
+	rootCmd.PersistentFlags().StringVar(&conf.UIArchive, "ui-archive", "", "serve a custom dashboard extracted from the local archive(zip|tar|tar.gz|tar.xz), swapped when it changes")
+	rootCmd.PersistentFlags().StringVar(&conf.UIURL, "ui-url", "", "download a custom dashboard archive(zip|tar.gz|tar.xz) from the specified url")
+	rootCmd.PersistentFlags().StringVar(&conf.UISHA256, "ui-sha256", "", "expected sha256 checksum of the --ui-url archive")
+	rootCmd.PersistentFlags().StringVar(&conf.UIVersion, "ui-version", "", "pin the downloaded dashboard to the specified version(default latest)")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.ConfigMirrors, "config-mirror", []string{}, "mirror urls of the remote config, requested concurrently with --config and the first valid one is used(repeatable)")
+	rootCmd.PersistentFlags().StringVar(&conf.ConfigRecord, "config-record", "", "record every remote config fetch(raw body and headers) to the dir for debugging")
+	rootCmd.PersistentFlags().IntVar(&conf.ConfigRecordMax, "config-record-max", 100, "number of the newest captures kept by --config-record")
+	rootCmd.PersistentFlags().StringVar(&conf.ConfigReplay, "config-replay", "", "replay the captures of the dir(or a single capture) instead of fetching the remote config, one per check")
 	rootCmd.PersistentFlags().DurationVarP(&conf.CheckInterval, "check-interval", "i", 120*time.Second, "remote config check interval")
 	rootCmd.PersistentFlags().StringSliceVar(&conf.HttpHeader, "http-header", []string{}, "http header when requesting a remote config(key=value)")
 	rootCmd.PersistentFlags().DurationVar(&conf.HttpTimeout, "http-timeout", 10*time.Second, "http request timeout when requesting a remote config")
 	rootCmd.PersistentFlags().StringVar(&conf.ConfigEncPassword, "config-password", "", "the password for encrypting the config file")
 	rootCmd.PersistentFlags().StringVar(&conf.AutoFixMode, "auto-fix", "", "automatically repair config(tun/ebpf)")
-	rootCmd.PersistentFlags().BoolVar(&conf.ForceExtract, "force-extract", false, "extract files force")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.Pipeline, "pipeline", []string{}, "order of the config pipeline stages, the stages not listed are disabled(see tpclash config pipeline --help), default all")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.PipelineSkip, "pipeline-skip", []string{}, "disable the specified config pipeline stages")
+	rootCmd.PersistentFlags().BoolVar(&conf.PipelineTrace, "pipeline-trace", false, "log every config pipeline stage at the info level")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.Presets, "preset", []string{}, "apply the built-in config presets in order(enable-tun,force-fakeip,lan-bypass,meta-sniffing, see tpclash preset)")
+	rootCmd.PersistentFlags().StringVar(&conf.ControllerMode, "controller-mode", "", "restrict the clash api to the loopback or a unix socket in the clash home(localhost|unix)")
+	rootCmd.PersistentFlags().StringVar(&conf.ControllerPolicy, "controller-policy", ControllerPolicyLocalhost, "rebind the clash api exposed on all addresses without a secret to the loopback or the lan address(localhost|lan|off)")
+	rootCmd.PersistentFlags().StringVar(&conf.LANInterface, "lan-interface", "", "lan interface whose address --controller-policy lan binds to(default the first interface with a private address besides the default route)")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.ControllerSocketUsers, "controller-socket-users", []string{}, "users(names or uids) allowed to use the controller socket besides root")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.ControllerSocketGroups, "controller-socket-groups", []string{}, "groups(names or gids) allowed to use the controller socket")
+	rootCmd.PersistentFlags().StringVar(&conf.ControllerSocketToken, "controller-socket-token", "", "bearer token required by the controller socket, the core secret is added by tpclash")
+	rootCmd.PersistentFlags().BoolVar(&conf.EnforceConfig, "enforce-config", true, "add the clash config fields required by tpclash if they are missing")
+	rootCmd.PersistentFlags().BoolVar(&conf.ForceExtract, "force-extract", false, "extract all embedded files even if they are unchanged or changed by the user")
+	rootCmd.PersistentFlags().BoolVar(&conf.DisableExtract, "disable-extract", false, "do not extract the embedded files, the core and the other files in the clash home are managed by the user")
+	rootCmd.PersistentFlags().BoolVar(&conf.PreValidate, "pre-validate", false, "run a reloaded config in a throwaway core on loopback ports before applying it")
+	rootCmd.PersistentFlags().DurationVar(&conf.GeoUpdateInterval, "geo-update-interval", 0, "update interval of the geo databases(e.g. 24h), disabled by default")
+	rootCmd.PersistentFlags().StringToStringVar(&conf.GeoURLs, "geo-url", map[string]string{}, "download url of the geo databases(NAME=URL)")
+	rootCmd.PersistentFlags().BoolVar(&conf.GeoInsecure, "geo-insecure", false, "update the geo databases without the .sha256sum file published along with them(not verified)")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.Rulesets, "ruleset", []string{}, "use the local copies of the community rulesets(loyalsoldier, see tpclash ruleset)")
+	rootCmd.PersistentFlags().DurationVar(&conf.RulesetUpdateInterval, "ruleset-update-interval", 24*time.Hour, "update interval of the --ruleset rule lists, 0 to disable")
+	rootCmd.PersistentFlags().StringVar(&conf.MetricsListen, "metrics-listen", "", "serve prometheus metrics on the specified address(e.g. :9091), disabled by default")
+	rootCmd.PersistentFlags().StringVar(&conf.HealthListen, "health-listen", "", "serve the health check endpoints(/healthz, /livez, /readyz) on the specified address, disabled by default")
+	rootCmd.PersistentFlags().DurationVar(&conf.ClientStatsInterval, "client-stats-interval", 0, "account the traffic of LAN clients at the specified interval(e.g. 10s), disabled by default")
+	rootCmd.PersistentFlags().StringVar(&conf.ConnLog, "conn-log", "", "write the closed connections to the specified file as json lines, disabled by default")
+	rootCmd.PersistentFlags().Float64Var(&conf.ConnLogSample, "conn-log-sample", 1, "sample rate of the connection log(0, 1]")
+	rootCmd.PersistentFlags().IntVar(&conf.ConnLogMaxSize, "conn-log-max-size", 100, "rotate the connection log when it grows over the specified size(MB)")
+	rootCmd.PersistentFlags().IntVar(&conf.ConnLogMaxFiles, "conn-log-max-files", 5, "number of rotated connection logs to keep")
+	rootCmd.PersistentFlags().StringVar(&conf.DNSLog, "dns-log", "", "write the dns queries of the core to the specified file as json lines, disabled by default")
+	rootCmd.PersistentFlags().IntVar(&conf.DNSLogMaxSize, "dns-log-max-size", 100, "rotate the dns log when it grows over the specified size(MB)")
+	rootCmd.PersistentFlags().IntVar(&conf.DNSLogMaxFiles, "dns-log-max-files", 5, "number of rotated dns logs to keep")
+	rootCmd.PersistentFlags().StringVar(&conf.OTelEndpoint, "otel-endpoint", "", "export opentelemetry traces of the config reloads to the otlp http endpoint(e.g. http://collector:4318)")
+	rootCmd.PersistentFlags().StringArrayVar(&conf.Notify, "notify", []string{}, "send notifications to telegram://BOT_TOKEN@CHAT_ID, bark://KEY@HOST or a webhook url(repeatable)")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.NotifyEvents, "notify-events", []string{}, "only notify the specified events("+strings.Join(notifyEvents, ",")+"), default all")
+	rootCmd.PersistentFlags().StringToStringVar(&conf.NotifyTemplates, "notify-template", map[string]string{}, "go template of the notification message(EVENT=TEMPLATE)")
+	rootCmd.PersistentFlags().StringVar(&conf.NotifySecret, "notify-secret", "", "shared secret signing the webhook notifications with hmac-sha256(X-TPClash-Signature)")
+	rootCmd.PersistentFlags().Float64Var(&conf.NotifyQuotaPercent, "notify-quota-percent", 90, "notify when the used traffic of the subscription exceeds the specified percent")
+	rootCmd.PersistentFlags().DurationVar(&conf.ProxyCheckInterval, "proxy-check-interval", 0, "test all proxies at the specified interval(e.g. 5m) and record the results for the proxy report, disabled by default")
+	rootCmd.PersistentFlags().StringVar(&conf.MemLimit, "mem-limit", "", "soft memory limit of tpclash(e.g. 32MiB, like GOMEMLIMIT)")
+	rootCmd.PersistentFlags().IntVar(&conf.GCPercent, "gc-percent", 0, "gc target percent of tpclash(like GOGC, -1 disables the gc), 0 keeps the default")
+	rootCmd.PersistentFlags().StringVar(&conf.CoreMemLimit, "core-mem-limit", "", "soft memory limit passed to the core as GOMEMLIMIT(e.g. 96MiB)")
+	rootCmd.PersistentFlags().IntVar(&conf.CoreGCPercent, "core-gc-percent", 0, "gc target percent passed to the core as GOGC(-1 disables the gc), 0 keeps the default")
+	rootCmd.PersistentFlags().StringVar(&conf.CoreRSSLimit, "core-rss-limit", "", "restart the core when its resident memory stays over the specified size(e.g. 200MiB), disabled by default")
+	rootCmd.PersistentFlags().DurationVar(&conf.MemCheckInterval, "mem-check-interval", time.Minute, "check interval of --core-rss-limit")
+	rootCmd.PersistentFlags().StringVar(&conf.BudgetMonthly, "budget-monthly", "", "monthly traffic budget of all clients(e.g. 500GB), requires --client-stats-interval")
+	rootCmd.PersistentFlags().StringToStringVar(&conf.BudgetClients, "budget-client", map[string]string{}, "monthly traffic budget of a client(IP=SIZE)")
+	rootCmd.PersistentFlags().Float64Var(&conf.BudgetWarnPercent, "budget-warn-percent", 80, "notify when the used traffic exceeds the specified percent of a budget")
+	rootCmd.PersistentFlags().BoolVar(&conf.BudgetDirect, "budget-direct", false, "go direct when a budget is exceeded until the next month")
+	rootCmd.PersistentFlags().StringVar(&conf.MetricsPush, "metrics-push", "", "push metrics in the influx line protocol to the write url(e.g. http://vm:8428/write), disabled by default")
+	rootCmd.PersistentFlags().DurationVar(&conf.MetricsPushInterval, "metrics-push-interval", 30*time.Second, "metrics push interval")
+	rootCmd.PersistentFlags().StringVar(&conf.MetricsPushToken, "metrics-push-token", "", "influxdb v2 api token of the metrics push")
+	rootCmd.PersistentFlags().IntVar(&conf.MetricsPushBuffer, "metrics-push-buffer", 100000, "max number of metric lines buffered while the push server is unreachable")
+	rootCmd.PersistentFlags().StringVar(&conf.MQTT, "mqtt", "", "publish the status to the mqtt broker(mqtt://[user:pass@]host[:port] or mqtts://), disabled by default")
+	rootCmd.PersistentFlags().DurationVar(&conf.MQTTInterval, "mqtt-interval", 30*time.Second, "mqtt status publish interval")
+	rootCmd.PersistentFlags().StringVar(&conf.MQTTTopic, "mqtt-topic", "tpclash", "mqtt topic prefix of the status, the hostname is appended")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.DHCPLeases, "dhcp-leases", defaultDHCPLeases, "dnsmasq, odhcpd or kea lease files naming the LAN clients in the status, stats and logs(missing files are ignored)")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.Reflect, "reflect", []string{}, "reflect the mdns/ssdp discovery between the --reflect-ifaces(mdns, ssdp), disabled by default")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.ReflectIfaces, "reflect-ifaces", []string{}, "the LAN interfaces(vlans) the --reflect protocols are reflected between")
+	rootCmd.PersistentFlags().BoolVar(&conf.SyncServe, "sync-serve", false, "serve the loaded config and the core state to the replicas on --dashboard-listen("+syncPath+", token required)")
+	rootCmd.PersistentFlags().StringVar(&conf.SyncFrom, "sync-from", "", "run as a replica, pull the config and the core state from the --dashboard-listen url of the source instead of --config")
+	rootCmd.PersistentFlags().StringVar(&conf.SyncToken, "sync-token", "", "token of the source for --sync-from(tpclash token create)")
+	rootCmd.PersistentFlags().BoolVar(&conf.AdminAPI, "admin-api", false, "serve the management api of tpclash on --dashboard-listen("+adminPath+", token required)")
+	rootCmd.PersistentFlags().StringVar(&conf.GRPCListen, "grpc-listen", "", "serve the grpc api of the management api and the events on the specified address(e.g. :9444), disabled by default, the client-online/client-offline events require --client-stats-interval")
+	rootCmd.PersistentFlags().StringToStringVar(&conf.Profiles, "profile", map[string]string{}, "config url or path of a profile switched to by the management api(NAME=CONFIG)")
+	rootCmd.PersistentFlags().StringVar(&conf.AssetMirrorListen, "asset-mirror-listen", "", "serve the rule providers and geox-url of the config through a local caching mirror on the specified address(e.g. 127.0.0.1:9095), disabled by default")
+	rootCmd.PersistentFlags().DurationVar(&conf.AssetMirrorTTL, "asset-mirror-ttl", 12*time.Hour, "how long a mirrored asset is served before it is refreshed, the stale copy is served when the upstream fails")
+	rootCmd.PersistentFlags().StringVar(&conf.AssetMirrorProxy, "asset-mirror-proxy", "", "proxy used by the mirror to fetch the upstream assets(e.g. http://127.0.0.1:7890)")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.DNSFallback, "dns-fallback", []string{}, "dns servers the LAN queries are forwarded to while clash dns is down or reloading(e.g. 223.5.5.5,119.29.29.29), disabled by default")
+	rootCmd.PersistentFlags().Uint16Var(&conf.DNSFallbackPort, "dns-fallback-port", 1054, "port of the fallback dns forwarder")
+	rootCmd.PersistentFlags().StringArrayVar(&conf.ConfigScripts, "config-script", []string{}, "starlark script whose mutate(config) changes the rendered config before it is checked(repeatable)")
+	rootCmd.PersistentFlags().StringArrayVar(&conf.Plugins, "plugin", []string{}, "executable receiving the lifecycle events as json on stdin, a non-zero exit of pre-reload vetoes the reload(repeatable)")
+	rootCmd.PersistentFlags().DurationVar(&conf.PluginTimeout, "plugin-timeout", 10*time.Second, "timeout of a plugin run, a pre-reload timeout vetoes the reload")
+	rootCmd.PersistentFlags().BoolVar(&conf.HA, "ha", false, "run as a keepalived(VRRP) node, the traffic is only intercepted while the node is MASTER(tpclash ha notify)")
+	rootCmd.PersistentFlags().StringVar(&conf.HAPeer, "ha-peer", "", "health url of the peer node checked every 5s(e.g. http://192.168.1.3:8080/readyz)")
+	rootCmd.PersistentFlags().StringArrayVar(&conf.HAHooks, "ha-hook", []string{}, "shell command run on the ha transitions with TPCLASH_HA_STATE and TPCLASH_HA_PREVIOUS(repeatable)")
+	rootCmd.PersistentFlags().StringArrayVar(&conf.Schedules, "schedule", []string{}, "run an action at the cron schedule(\"CRON mode|bypass|intercept|select ARGS\", repeatable, see tpclash schedule --help)")
+	rootCmd.PersistentFlags().StringArrayVar(&conf.Policies, "policy", []string{}, "apply an action while the cel expression is true(\"EXPR => mode|bypass|select|udp ARGS\", repeatable, see tpclash policy --help)")
+	rootCmd.PersistentFlags().StringVar(&conf.MQTTDiscovery, "mqtt-discovery", "homeassistant", "home assistant mqtt discovery prefix(empty to disable)")
+	rootCmd.PersistentFlags().StringVar(&conf.DashboardListen, "dashboard-listen", "", "serve the dashboard and the clash api behind authentication on the specified address(e.g. :9443), disabled by default")
+	rootCmd.PersistentFlags().StringVar(&conf.DashboardTLSCert, "dashboard-tls-cert", "", "tls certificate file of the dashboard listener")
+	rootCmd.PersistentFlags().StringVar(&conf.DashboardTLSKey, "dashboard-tls-key", "", "tls key file of the dashboard listener")
+	rootCmd.PersistentFlags().StringArrayVar(&conf.DashboardUsers, "dashboard-user", []string{}, "basic auth user of the dashboard(USER:PASSWORD, the password may be a bcrypt hash, repeatable)")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.DashboardAllow, "dashboard-allow", []string{}, "only allow the specified ips or cidrs to access the dashboard")
+	rootCmd.PersistentFlags().StringVar(&conf.DashboardOIDCIssuer, "dashboard-oidc-issuer", "", "oidc issuer url of the dashboard login")
+	rootCmd.PersistentFlags().StringVar(&conf.DashboardOIDCClientID, "dashboard-oidc-client-id", "", "oidc client id of the dashboard login")
+	rootCmd.PersistentFlags().StringVar(&conf.DashboardOIDCClientSecret, "dashboard-oidc-client-secret", "", "oidc client secret of the dashboard login")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.DashboardOIDCAllow, "dashboard-oidc-allow", []string{}, "emails(or subjects) of the oidc users allowed to access the dashboard")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.DashboardACME, "dashboard-acme", []string{}, "obtain the certificate of the dashboard listener for the specified domains from acme(let's encrypt)")
+	rootCmd.PersistentFlags().StringVar(&conf.DashboardACMEEmail, "dashboard-acme-email", "", "contact email of the acme account")
+	rootCmd.PersistentFlags().StringVar(&conf.DashboardACMECA, "dashboard-acme-ca", defaultACMECA, "acme directory url")
+	rootCmd.PersistentFlags().StringVar(&conf.DashboardACMEHTTP, "dashboard-acme-http", "", "answer the acme http-01 challenges on the specified address(e.g. :80)")
+	rootCmd.PersistentFlags().StringVar(&conf.DashboardACMEDNS, "dashboard-acme-dns", "", "use the dns-01 challenge with the dns provider(cloudflare://API_TOKEN)")
+	rootCmd.PersistentFlags().IntVar(&conf.DashboardBanAttempts, "dashboard-ban-attempts", 5, "ban the clients failing the dashboard authentication the specified times(0 to disable)")
+	rootCmd.PersistentFlags().DurationVar(&conf.DashboardBanWindow, "dashboard-ban-window", 10*time.Minute, "period in which the dashboard authentication failures are counted")
+	rootCmd.PersistentFlags().DurationVar(&conf.DashboardBanTime, "dashboard-ban-time", 30*time.Minute, "duration of the dashboard bans")
+	rootCmd.PersistentFlags().StringVar(&conf.RunAs, "run-as", "", "drop to the specified user after setup, only the network capabilities are kept")
+	rootCmd.PersistentFlags().BoolVar(&conf.IPv6BypassLAN, "ipv6-bypass-lan", false, "route the ipv6 traffic to the lan prefixes of the host(the delegated prefixes) by the main table, the rules follow the prefix changes, with tun the prefixes are added to tun.route-exclude-address, the wan interface(ipv6 default route) is skipped")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.DockerNetworks, "docker-networks", []string{}, "only proxy containers in the specified docker networks or bridges(default all)")
 	rootCmd.PersistentFlags().BoolVar(&conf.AllowStandardDNSPort, "allow-standard-dns", false, "allow standard DNS port")
+	rootCmd.PersistentFlags().BoolVar(&conf.UpgradeWithGhProxy, "with-ghproxy", false, "use ghproxy.com to download github files")
 	rootCmd.PersistentFlags().BoolVarP(&conf.PrintVersion, "version", "v", false, "version for tpclash")
+	addSecretFileFlags(rootCmd.PersistentFlags(), secretFlags...)
+	// the alias shares the value of --ui-path, it is not bound by the env and the config file
+	_ = rootCmd.PersistentFlags().MarkHidden("ui-dir")
 
 	if branch == "premium" {
 		rootCmd.PersistentFlags().BoolVar(&conf.EnableTracing, "enable-tracing", false, "auto deploy tracing dashboard")
@@ -169,5 +580,9 @@ func init() {
 }
 
 func main() {
+	if IsCNIPlugin() {
+		os.Exit(RunCNI())
+	}
+	registerCompletions()
 	cobra.CheckErr(rootCmd.Execute())
 }
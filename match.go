@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var matchOpts struct {
+	file    string
+	offline bool
+}
+
+// matchRule is a parsed clash rule, Type is normalized to the upper case
+// form without dashes so that DOMAIN-SUFFIX and DomainSuffix are the same.
+type matchRule struct {
+	Index     int
+	Raw       string
+	Type      string
+	Payload   string
+	Proxy     string
+	NoResolve bool
+}
+
+// matchTarget is the destination being traced, IPs are resolved lazily
+// because clash only resolves a domain when it reaches an ip rule.
+type matchTarget struct {
+	Host string
+	Port int
+	IP   netip.Addr
+
+	domain   bool
+	resolved bool
+	geo      *maxminddb.Reader
+	// api and the plain nameservers of the config resolve the domain, the
+	// system resolver would get a fake ip from the core
+	api         *ClashAPI
+	nameservers []string
+	fakeRange   netip.Prefix
+}
+
+var matchCmd = &cobra.Command{
+	Use:   "match HOST[:PORT]",
+	Short: "Trace which rule and proxy a destination hits",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		target, err := parseMatchTarget(args[0])
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		cc, err := matchConf()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		var api *ClashAPI
+		if !matchOpts.offline && matchOpts.file == "" {
+			api = NewClashAPI(cc)
+			if err = api.Do("GET", "/version", nil, nil); err != nil {
+				logrus.Warnf("[match] the clash api is unavailable, evaluate the config offline: %v", err)
+				api = nil
+			}
+		}
+
+		target.api = api
+		target.nameservers = plainNameservers(append(cc.DNS.DefaultNameserver, cc.DNS.Nameserver...))
+		target.fakeRange, _ = netip.ParsePrefix(cc.DNS.FakeIPRange)
+
+		if geo, err := maxminddb.Open(filepath.Join(conf.ClashHome, geoCountryMMDB)); err == nil {
+			target.geo = geo
+			defer func() { _ = geo.Close() }()
+		}
+
+		r := MatchResult{Destination: net.JoinHostPort(target.Host, strconv.Itoa(target.Port))}
+		if api != nil && target.domain {
+			r.DNS = coreLookup(cc, target.Host)
+		}
+
+		r.Mode = strings.ToLower(cc.Mode)
+		if api != nil {
+			var configs struct {
+				Mode string `json:"mode"`
+			}
+			if err = api.Do("GET", "/configs", nil, &configs); err == nil {
+				r.Mode = strings.ToLower(configs.Mode)
+			}
+		}
+		if r.Mode == "" {
+			r.Mode = "rule"
+		}
+
+		var proxy string
+		switch r.Mode {
+		case "global":
+			proxy = "GLOBAL"
+		case "direct":
+			proxy = "DIRECT"
+		default:
+			rule, skipped := evalRules(parseRules(cc.Rules), target)
+			if target.resolved {
+				r.Resolved = "failed"
+				if target.IP.IsValid() {
+					r.Resolved = target.IP.String()
+				}
+			}
+			for _, s := range skipped {
+				r.Skipped = append(r.Skipped, fmt.Sprintf("#%d %s", s.Index, s.Raw))
+			}
+			if rule == nil {
+				// clash falls back to DIRECT when no rule matches
+				r.Rule = "none"
+				proxy = "DIRECT"
+			} else {
+				r.Rule = fmt.Sprintf("#%d %s", rule.Index, rule.Raw)
+				proxy = rule.Proxy
+			}
+		}
+
+		r.Proxy = proxy
+		if api != nil {
+			if proxies, err := fetchProxies(api); err == nil {
+				r.Proxy = proxyChain(proxies, proxy)
+			}
+		}
+
+		if jsonOutput() {
+			printJSON(r)
+			return
+		}
+		printMatch(r)
+	},
+}
+
+// MatchResult is the output of the match command.
+type MatchResult struct {
+	Destination string   `json:"destination"`
+	DNS         string   `json:"dns,omitempty"`
+	Mode        string   `json:"mode"`
+	Resolved    string   `json:"resolved,omitempty"`
+	Skipped     []string `json:"skipped,omitempty"`
+	Rule        string   `json:"rule,omitempty"`
+	Proxy       string   `json:"proxy"`
+}
+
+func printMatch(r MatchResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer func() { _ = w.Flush() }()
+
+	_, _ = fmt.Fprintf(w, "Destination:\t%s\n", r.Destination)
+	if r.DNS != "" {
+		_, _ = fmt.Fprintf(w, "DNS:\t%s\n", r.DNS)
+	}
+	_, _ = fmt.Fprintf(w, "Mode:\t%s\n", r.Mode)
+	if r.Resolved != "" {
+		_, _ = fmt.Fprintf(w, "Resolved:\t%s\n", r.Resolved)
+	}
+	for _, s := range r.Skipped {
+		_, _ = fmt.Fprintf(w, "Skipped:\t%s(can not be evaluated locally)\n", s)
+	}
+	if r.Rule != "" {
+		_, _ = fmt.Fprintf(w, "Rule:\t%s\n", r.Rule)
+	}
+	_, _ = fmt.Fprintf(w, "Proxy:\t%s\n", r.Proxy)
+}
+
+// matchConf returns the clash config to trace, it is the config loaded by
+// the running core unless a file is specified.
+func matchConf() (*ClashConf, error) {
+	if matchOpts.file == "" {
+		cc, err := RunningConf()
+		if err != nil {
+			return nil, err
+		}
+		if core.Name() == CoreSingBox {
+			return nil, fmt.Errorf("[match] rule tracing is not supported by the %s core", CoreSingBox)
+		}
+		return cc, nil
+	}
+
+	bs, err := os.ReadFile(matchOpts.file)
+	if err != nil {
+		return nil, fmt.Errorf("[match] failed to read config: %w", err)
+	}
+	var cc ClashConf
+	if err = yaml.Unmarshal(bs, &cc); err != nil {
+		return nil, fmt.Errorf("[match] failed to parse config: %w", err)
+	}
+	return &cc, nil
+}
+
+func parseMatchTarget(s string) (*matchTarget, error) {
+	t := &matchTarget{Host: s, Port: 443}
+	if strings.HasPrefix(s, "[") || strings.Count(s, ":") == 1 {
+		host, port, err := net.SplitHostPort(s)
+		if err != nil {
+			return nil, fmt.Errorf("[match] invalid destination %s: %w", s, err)
+		}
+		if t.Port, err = strconv.Atoi(port); err != nil || t.Port < 1 || t.Port > 65535 {
+			return nil, fmt.Errorf("[match] invalid destination port %s", port)
+		}
+		t.Host = host
+	}
+	t.Host = strings.ToLower(strings.TrimSuffix(t.Host, "."))
+	if ip, err := netip.ParseAddr(t.Host); err == nil {
+		t.IP = ip.Unmap()
+	} else {
+		t.domain = true
+	}
+	return t, nil
+}
+
+func parseRules(rules []string) []matchRule {
+	var rs []matchRule
+	for i, raw := range rules {
+		fields := strings.Split(raw, ",")
+		for j := range fields {
+			fields[j] = strings.TrimSpace(fields[j])
+		}
+
+		r := matchRule{Index: i + 1, Raw: raw, Type: strings.ToUpper(strings.ReplaceAll(fields[0], "-", ""))}
+		switch {
+		case r.Type == "MATCH" || r.Type == "FINAL":
+			r.Type = "MATCH"
+			if len(fields) > 1 {
+				r.Proxy = fields[1]
+			}
+		case len(fields) >= 3:
+			r.Payload, r.Proxy = fields[1], fields[2]
+			for _, opt := range fields[3:] {
+				if strings.EqualFold(opt, "no-resolve") {
+					r.NoResolve = true
+				}
+			}
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+// evalRules returns the first matched rule and the rules before it that can
+// not be evaluated locally(rule sets, process rules, etc.).
+func evalRules(rules []matchRule, t *matchTarget) (*matchRule, []matchRule) {
+	var skipped []matchRule
+	for i := range rules {
+		matched, ok := rules[i].match(t)
+		if !ok {
+			skipped = append(skipped, rules[i])
+			continue
+		}
+		if matched {
+			return &rules[i], skipped
+		}
+	}
+	return nil, skipped
+}
+
+// match reports whether the rule matches the target, ok is false if the
+// rule type is not supported.
+func (r matchRule) match(t *matchTarget) (matched, ok bool) {
+	payload := strings.ToLower(r.Payload)
+	isDomain := t.domain
+
+	switch r.Type {
+	case "MATCH":
+		return true, true
+	case "DOMAIN":
+		return isDomain && t.Host == payload, true
+	case "DOMAINSUFFIX":
+		return isDomain && (t.Host == payload || strings.HasSuffix(t.Host, "."+payload)), true
+	case "DOMAINKEYWORD":
+		return isDomain && strings.Contains(t.Host, payload), true
+	case "DOMAINREGEX":
+		re, err := regexp.Compile(r.Payload)
+		if err != nil {
+			return false, false
+		}
+		return isDomain && re.MatchString(t.Host), true
+	case "IPCIDR", "IPCIDR6":
+		prefix, err := netip.ParsePrefix(r.Payload)
+		if err != nil {
+			return false, false
+		}
+		ip := t.ip(r.NoResolve)
+		return ip.IsValid() && prefix.Contains(ip), true
+	case "GEOIP":
+		ip := t.ip(r.NoResolve)
+		if !ip.IsValid() {
+			return false, true
+		}
+		if strings.EqualFold(r.Payload, "LAN") {
+			return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast(), true
+		}
+		if t.geo == nil {
+			return false, false
+		}
+		var record struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		if err := t.geo.Lookup(net.IP(ip.AsSlice()), &record); err != nil {
+			return false, false
+		}
+		return strings.EqualFold(record.Country.ISOCode, r.Payload), true
+	case "DSTPORT":
+		lo, hi, found := strings.Cut(r.Payload, "-")
+		if !found {
+			hi = lo
+		}
+		l, err1 := strconv.Atoi(lo)
+		h, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil {
+			return false, false
+		}
+		return t.Port >= l && t.Port <= h, true
+	case "NETWORK":
+		// tpclash only traces tcp destinations
+		return strings.EqualFold(r.Payload, "tcp"), true
+	}
+	return false, false
+}
+
+// ip returns the ip of the target, the domain is resolved the first time an
+// ip rule without no-resolve is reached: by the /dns/query api of the core,
+// or by the plain nameservers of the config offline. The fake ips are never
+// used, the core matches the real ip of the domain.
+func (t *matchTarget) ip(noResolve bool) netip.Addr {
+	if t.IP.IsValid() || noResolve || t.resolved {
+		return t.IP
+	}
+	t.resolved = true
+
+	if t.api != nil {
+		ip, err := t.queryCore()
+		if err == nil {
+			t.IP = ip
+			return t.IP
+		}
+		logrus.Debugf("[match] failed to resolve %s by the core: %v", t.Host, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, ns := range t.nameservers {
+		var d net.Dialer
+		r := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return d.DialContext(ctx, network, ns)
+			},
+		}
+		ips, err := r.LookupNetIP(ctx, "ip4", t.Host)
+		if err != nil || len(ips) == 0 {
+			logrus.Debugf("[match] failed to resolve %s by %s: %v", t.Host, ns, err)
+			continue
+		}
+		if ip := ips[0].Unmap(); !t.fakeRange.IsValid() || !t.fakeRange.Contains(ip) {
+			t.IP = ip
+			return t.IP
+		}
+	}
+	return t.IP
+}
+
+// queryCore resolves the domain by the resolver of the core, the answers do
+// not go through the fake-ip of its dns server.
+func (t *matchTarget) queryCore() (netip.Addr, error) {
+	var resp struct {
+		Answer []struct {
+			Type int    `json:"type"`
+			Data string `json:"data"`
+		} `json:"Answer"`
+	}
+	if err := t.api.Do(http.MethodGet, "/dns/query?type=A&name="+url.QueryEscape(t.Host), nil, &resp); err != nil {
+		return netip.Addr{}, err
+	}
+	for _, a := range resp.Answer {
+		// the A records, CNAMEs come first
+		if ip, err := netip.ParseAddr(a.Data); a.Type == 1 && err == nil {
+			return ip.Unmap(), nil
+		}
+	}
+	return netip.Addr{}, errors.New("no A record")
+}
+
+// plainNameservers returns the udp nameservers(ip, ip:port or udp://) of the
+// config as host:port, the encrypted ones need the core.
+func plainNameservers(servers []string) []string {
+	var addrs []string
+	for _, s := range servers {
+		s = strings.TrimPrefix(s, "udp://")
+		s, _, _ = strings.Cut(s, "#")
+		if ip, err := netip.ParseAddr(s); err == nil {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), "53"))
+		} else if ap, err := netip.ParseAddrPort(s); err == nil {
+			addrs = append(addrs, ap.String())
+		}
+	}
+	return addrs
+}
+
+// coreLookup queries the dns server of the running core, which is what the
+// proxied clients see.
+func coreLookup(cc *ClashConf, host string) string {
+	port := cc.DNSPort()
+	if port == 0 {
+		return "dns is not listening"
+	}
+
+	var d net.Dialer
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, network, net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ips, err := r.LookupNetIP(ctx, "ip4", host)
+	if err != nil || len(ips) == 0 {
+		return fmt.Sprintf("failed(%v)", err)
+	}
+
+	ip := ips[0].Unmap()
+	if fakeRange, err := netip.ParsePrefix(cc.DNS.FakeIPRange); err == nil && fakeRange.Contains(ip) {
+		return ip.String() + "(fake-ip, the domain is used for matching)"
+	}
+	return ip.String()
+}
+
+// proxyChain follows the current selection of proxy groups.
+func proxyChain(proxies map[string]clashProxy, name string) string {
+	chain := []string{name}
+	seen := map[string]bool{name: true}
+	for {
+		p, ok := proxies[name]
+		if !ok || !p.IsGroup() || p.Now == "" || seen[p.Now] {
+			break
+		}
+		name = p.Now
+		seen[name] = true
+		chain = append(chain, name)
+	}
+	return strings.Join(chain, " -> ")
+}
+
+func init() {
+	matchCmd.Flags().StringVarP(&matchOpts.file, "file", "f", "", "evaluate the specified clash config file offline")
+	matchCmd.Flags().BoolVar(&matchOpts.offline, "offline", false, "evaluate the running config without querying the core")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// memExceedChecks is the number of consecutive checks over --core-rss-limit
+// before the core is restarted, a short spike does not restart it.
+const memExceedChecks = 3
+
+// CheckMemoryConf validates the memory flags and applies the limits of
+// tpclash itself.
+func CheckMemoryConf() error {
+	for flag, v := range map[string]string{"--mem-limit": conf.MemLimit, "--core-mem-limit": conf.CoreMemLimit, "--core-rss-limit": conf.CoreRSSLimit} {
+		if _, err := parseBytes(v); err != nil && v != "" {
+			return fmt.Errorf("[memory] invalid %s: %w", flag, err)
+		}
+	}
+	if conf.CoreRSSLimit != "" && conf.MemCheckInterval <= 0 {
+		return fmt.Errorf("[memory] --core-rss-limit requires a positive --mem-check-interval")
+	}
+
+	if conf.MemLimit != "" {
+		n, _ := parseBytes(conf.MemLimit)
+		debug.SetMemoryLimit(int64(n))
+		logrus.Infof("[memory] tpclash memory limit: %s", humanBytes(n))
+	}
+	if conf.GCPercent != 0 {
+		debug.SetGCPercent(conf.GCPercent)
+	}
+	return nil
+}
+
+// coreMemoryEnv returns the memory hints of the core, the cores are written
+// in go and read the runtime variables. The --clash-env values come later and
+// take precedence.
+func coreMemoryEnv() []string {
+	var env []string
+	if conf.CoreMemLimit != "" {
+		n, _ := parseBytes(conf.CoreMemLimit)
+		env = append(env, "GOMEMLIMIT="+strconv.FormatUint(n, 10))
+	}
+	switch {
+	case conf.CoreGCPercent < 0:
+		env = append(env, "GOGC=off")
+	case conf.CoreGCPercent > 0:
+		env = append(env, "GOGC="+strconv.Itoa(conf.CoreGCPercent))
+	}
+	return env
+}
+
+// WatchCoreMemory restarts the core when its resident memory stays over
+// --core-rss-limit.
+func WatchCoreMemory(ctx context.Context, proc *CoreProcess) {
+	if conf.CoreRSSLimit == "" {
+		return
+	}
+	limit, _ := parseBytes(conf.CoreRSSLimit)
+	logrus.Infof("[memory] core memory cap: %s, checked every %s", humanBytes(limit), conf.MemCheckInterval)
+
+	var exceeded int
+	tick := time.NewTicker(conf.MemCheckInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+
+		p := proc.Process()
+		if p == nil {
+			continue
+		}
+		rss, err := processRSS(p.Pid)
+		if err != nil {
+			logrus.Debugf("[memory] failed to read the core memory: %v", err)
+			continue
+		}
+		if rss <= limit {
+			exceeded = 0
+			continue
+		}
+
+		exceeded++
+		logrus.Warnf("[memory] core memory %s exceeds the cap %s(%d/%d)", humanBytes(rss), humanBytes(limit), exceeded, memExceedChecks)
+		if exceeded < memExceedChecks {
+			continue
+		}
+		exceeded = 0
+		err = proc.Restart()
+		Audit(AuditSourceSchedule, "memory", "core.restart", humanBytes(rss), err)
+		if err != nil {
+			logrus.Errorf("[memory] failed to restart the core: %v", err)
+		}
+	}
+}
+
+// processRSS returns the resident memory of the process(VmRSS).
+func processRSS(pid int) (uint64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		v, ok := strings.CutPrefix(s.Text(), "VmRSS:")
+		if !ok {
+			continue
+		}
+		kb, err := strconv.ParseUint(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "kB")), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid VmRSS %q", v)
+		}
+		return kb << 10, nil
+	}
+	return 0, fmt.Errorf("VmRSS not found in /proc/%d/status", pid)
+}
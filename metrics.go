@@ -0,0 +1,151 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+const metricsNamespace = "tpclash"
+
+var (
+	metricCoreRestarts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "core_restarts_total",
+		Help:      "Number of core restarts.",
+	})
+	metricFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_fetch_total",
+		Help:      "Number of config fetches by result.",
+	}, []string{"result"})
+	metricFetchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_fetch_duration_seconds",
+		Help:      "Duration of config fetches.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	metricReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reload_total",
+		Help:      "Number of config reloads by result.",
+	}, []string{"result"})
+	metricRulesApply = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rules_apply_total",
+		Help:      "Number of nftables rule applications by result.",
+	}, []string{"result"})
+	metricRulesApplyDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rules_apply_duration_seconds",
+		Help:      "Duration of nftables rule applications.",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1},
+	})
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metricCoreRestarts, metricFetches, metricFetchDuration, metricReloads, metricRulesApply, metricRulesApplyDuration,
+	)
+}
+
+// metricResult returns the result label of an operation.
+func metricResult(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+var (
+	descCoreUp        = prometheus.NewDesc(metricsNamespace+"_core_up", "Whether the core process is running.", []string{"core"}, nil)
+	descCoreRSS       = prometheus.NewDesc(metricsNamespace+"_core_resident_memory_bytes", "Resident memory of the core process.", nil, nil)
+	descAPIUp         = prometheus.NewDesc(metricsNamespace+"_clash_api_up", "Whether the clash api is reachable.", nil, nil)
+	descUploadTotal   = prometheus.NewDesc(metricsNamespace+"_upload_bytes_total", "Total uploaded bytes reported by the core.", nil, nil)
+	descDownloadTotal = prometheus.NewDesc(metricsNamespace+"_download_bytes_total", "Total downloaded bytes reported by the core.", nil, nil)
+	descConnections   = prometheus.NewDesc(metricsNamespace+"_connections", "Number of active connections.", nil, nil)
+	descProxyDelay    = prometheus.NewDesc(metricsNamespace+"_proxy_delay_milliseconds", "Latest delay test result of the proxy, 0 means timeout.", []string{"proxy", "type"}, nil)
+
+	descClientUpload   = prometheus.NewDesc(metricsNamespace+"_client_upload_bytes_total", "Uploaded bytes of the LAN client.", []string{"client", "name"}, nil)
+	descClientDownload = prometheus.NewDesc(metricsNamespace+"_client_download_bytes_total", "Downloaded bytes of the LAN client.", []string{"client", "name"}, nil)
+)
+
+// coreCollector scrapes the core process and the clash api on every scrape,
+// so the values are never older than the scrape itself.
+type coreCollector struct {
+	proc *CoreProcess
+}
+
+func (c *coreCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{descCoreUp, descCoreRSS, descAPIUp, descUploadTotal, descDownloadTotal, descConnections, descProxyDelay, descClientUpload, descClientDownload} {
+		ch <- d
+	}
+}
+
+func (c *coreCollector) Collect(ch chan<- prometheus.Metric) {
+	up := 0.0
+	if c.proc.Running() {
+		up = 1
+	}
+	ch <- prometheus.MustNewConstMetric(descCoreUp, prometheus.GaugeValue, up, core.Name())
+	if p := c.proc.Process(); p != nil {
+		if rss, err := processRSS(p.Pid); err == nil {
+			ch <- prometheus.MustNewConstMetric(descCoreRSS, prometheus.GaugeValue, float64(rss))
+		}
+	}
+
+	for ip, t := range ClientUsages() {
+		name := ClientName(ip)
+		ch <- prometheus.MustNewConstMetric(descClientUpload, prometheus.CounterValue, float64(t.Upload), ip, name)
+		ch <- prometheus.MustNewConstMetric(descClientDownload, prometheus.CounterValue, float64(t.Download), ip, name)
+	}
+
+	api, err := RunningAPI()
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(descAPIUp, prometheus.GaugeValue, 0)
+		return
+	}
+
+	var conns struct {
+		UploadTotal   uint64 `json:"uploadTotal"`
+		DownloadTotal uint64 `json:"downloadTotal"`
+		Connections   []any  `json:"connections"`
+	}
+	if err = api.Do("GET", "/connections", nil, &conns); err != nil {
+		logrus.Debugf("[metrics] failed to get connections: %v", err)
+		ch <- prometheus.MustNewConstMetric(descAPIUp, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(descAPIUp, prometheus.GaugeValue, 1)
+	ch <- prometheus.MustNewConstMetric(descUploadTotal, prometheus.CounterValue, float64(conns.UploadTotal))
+	ch <- prometheus.MustNewConstMetric(descDownloadTotal, prometheus.CounterValue, float64(conns.DownloadTotal))
+	ch <- prometheus.MustNewConstMetric(descConnections, prometheus.GaugeValue, float64(len(conns.Connections)))
+
+	proxies, err := fetchProxies(api)
+	if err != nil {
+		logrus.Debug(err)
+		return
+	}
+	for _, p := range proxies {
+		if p.IsGroup() || len(p.History) == 0 {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(descProxyDelay, prometheus.GaugeValue, float64(p.Delay()), p.Name, p.Type)
+	}
+}
+
+// RegisterMetrics registers the core metrics and serves them on
+// --metrics-listen if it is set.
+func RegisterMetrics(proc *CoreProcess) {
+	metricsRegistry.MustRegister(&coreCollector{proc: proc})
+	if conf.MetricsListen == "" {
+		return
+	}
+	endpointMux(conf.MetricsListen).Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	logrus.Infof("[metrics] serving metrics on http://%s/metrics", conf.MetricsListen)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+// metricsPushBatch is the max number of lines of a push request.
+const metricsPushBatch = 5000
+
+// lineEscaper escapes the measurement, tag and field names and the tag values
+// of the influx line protocol.
+var lineEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// PushMetrics gathers the metrics every --metrics-push-interval and pushes them
+// to --metrics-push in the influx line protocol, which is accepted by InfluxDB
+// and VictoriaMetrics. The lines are buffered while the server is unreachable,
+// up to --metrics-push-buffer lines, the oldest are dropped first.
+func PushMetrics(ctx context.Context) {
+	if conf.MetricsPush == "" {
+		return
+	}
+
+	logrus.Infof("[metrics] pushing metrics to %s, interval: %s", redactURL(conf.MetricsPush), conf.MetricsPushInterval)
+	ticker := time.NewTicker(conf.MetricsPushInterval)
+	defer ticker.Stop()
+
+	var buf []string
+	var failing bool
+	for {
+		select {
+		case <-ctx.Done():
+			// best effort to deliver the buffered lines before exiting
+			pushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			_, _ = pushLines(pushCtx, buf)
+			cancel()
+			return
+		case <-ticker.C:
+		}
+
+		lines, err := gatherLines(time.Now())
+		if err != nil {
+			logrus.Warnf("[metrics] failed to gather metrics: %v", err)
+		}
+		buf = append(buf, lines...)
+		if dropped := len(buf) - conf.MetricsPushBuffer; dropped > 0 {
+			logrus.Warnf("[metrics] push buffer is full, %d lines dropped", dropped)
+			buf = buf[dropped:]
+		}
+
+		pushed, err := pushLines(ctx, buf)
+		buf = buf[pushed:]
+		switch {
+		case err != nil && !failing:
+			logrus.Errorf("[metrics] failed to push metrics, buffering: %v", err)
+			failing = true
+		case err == nil && failing:
+			logrus.Info("[metrics] metrics push recovered")
+			failing = false
+		}
+	}
+}
+
+// pushLines writes the lines in batches and returns how many are delivered.
+func pushLines(ctx context.Context, lines []string) (int, error) {
+	cli := &http.Client{Timeout: 30 * time.Second}
+
+	var pushed int
+	for pushed < len(lines) {
+		n := min(len(lines)-pushed, metricsPushBatch)
+		body := strings.Join(lines[pushed:pushed+n], "\n") + "\n"
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.MetricsPush, bytes.NewBufferString(body))
+		if err != nil {
+			return pushed, err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if conf.MetricsPushToken != "" {
+			req.Header.Set("Authorization", "Token "+conf.MetricsPushToken)
+		}
+
+		resp, err := cli.Do(req)
+		if err != nil {
+			return pushed, redactErr(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return pushed, fmt.Errorf("status code %d", resp.StatusCode)
+		}
+		pushed += n
+	}
+	return pushed, nil
+}
+
+// gatherLines converts the registered metrics to the influx line protocol in
+// the same layout as the telegraf prometheus input: the metric name is the
+// measurement, the labels are tags and the value is the counter/gauge field.
+func gatherLines(ts time.Time) ([]string, error) {
+	families, err := metricsRegistry.Gather()
+
+	var lines []string
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			fields := map[string]float64{}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				fields["counter"] = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				fields["gauge"] = m.GetGauge().GetValue()
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				fields["sum"], fields["count"] = h.GetSampleSum(), float64(h.GetSampleCount())
+				for _, b := range h.GetBucket() {
+					fields[strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)] = float64(b.GetCumulativeCount())
+				}
+				fields["+Inf"] = float64(h.GetSampleCount())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				fields["sum"], fields["count"] = s.GetSampleSum(), float64(s.GetSampleCount())
+				for _, q := range s.GetQuantile() {
+					fields[strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64)] = q.GetValue()
+				}
+			default:
+				fields["value"] = m.GetUntyped().GetValue()
+			}
+			if line := formatLine(mf.GetName(), m.GetLabel(), fields, ts); line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return lines, err
+}
+
+func formatLine(name string, labels []*dto.LabelPair, fields map[string]float64, ts time.Time) string {
+	var sb strings.Builder
+	sb.WriteString(lineEscaper.Replace(name))
+
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+	for _, l := range labels {
+		// empty tag values are not allowed
+		if l.GetValue() == "" {
+			continue
+		}
+		sb.WriteString("," + lineEscaper.Replace(l.GetName()) + "=" + lineEscaper.Replace(l.GetValue()))
+	}
+
+	var n int
+	for _, k := range sortedKeys(fields) {
+		v := fields[k]
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		sep := ","
+		if n == 0 {
+			sep = " "
+		}
+		sb.WriteString(sep + lineEscaper.Replace(k) + "=" + strconv.FormatFloat(v, 'g', -1, 64))
+		n++
+	}
+	if n == 0 {
+		return ""
+	}
+
+	sb.WriteString(" " + strconv.FormatInt(ts.UnixNano(), 10))
+	return sb.String()
+}
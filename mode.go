@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var modeOpts struct {
+	persist bool
+	forget  bool
+}
+
+var clashModes = []string{"rule", "global", "direct"}
+
+// PersistedMode returns the mode saved by `tpclash mode --persist`, it
+// overrides the mode of every loaded config.
+func PersistedMode() string {
+	bs, err := os.ReadFile(filepath.Join(conf.ClashHome, modeFileName))
+	if err != nil {
+		return ""
+	}
+	mode := strings.TrimSpace(string(bs))
+	if !slices.Contains(clashModes, mode) {
+		return ""
+	}
+	return mode
+}
+
+// persistMode patches the mode of the clash config with the persisted mode.
+func persistMode(doc *yaml.Node) bool {
+	mode := PersistedMode()
+	if mode == "" || yamlRoot(doc) == nil {
+		return false
+	}
+	if err := setYamlValue(doc, "mode", mode); err != nil {
+		logrus.Errorf("[mode] %v", err)
+		return false
+	}
+	logrus.Infof("[mode] use the persisted mode: %s", mode)
+	return true
+}
+
+// patchMode switches the mode of the running core.
+func patchMode(mode string) error {
+	api, err := RunningAPI()
+	if err != nil {
+		return err
+	}
+	// sing-box requires the capitalized mode name
+	if core.Name() == CoreSingBox {
+		mode = strings.ToUpper(mode[:1]) + mode[1:]
+	}
+	return api.Do("PATCH", "/configs", map[string]string{"mode": mode}, nil)
+}
+
+var modeCmd = &cobra.Command{
+	Use:   "mode [rule|global|direct]",
+	Short: "Show or switch the proxy mode of the running core",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		api, err := RunningAPI()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		modePath := filepath.Join(conf.ClashHome, modeFileName)
+
+		if modeOpts.forget {
+			if err = os.Remove(modePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				logrus.Fatalf("[mode] failed to remove the persisted mode: %v", err)
+			}
+			logrus.Info("[mode] the persisted mode is removed, the config mode is used after the next reload")
+		}
+
+		if len(args) == 0 {
+			var configs struct {
+				Mode string `json:"mode"`
+			}
+			if err = api.Do("GET", "/configs", nil, &configs); err != nil {
+				logrus.Fatalf("[mode] failed to get mode: %v", err)
+			}
+			persisted := PersistedMode()
+			if persisted == "" {
+				persisted = "none"
+			}
+			if jsonOutput() {
+				printJSON(map[string]string{"mode": strings.ToLower(configs.Mode), "persisted": PersistedMode()})
+				return
+			}
+			fmt.Printf("Mode: %s\nPersisted: %s\n", strings.ToLower(configs.Mode), persisted)
+			return
+		}
+
+		mode := strings.ToLower(args[0])
+		if !slices.Contains(clashModes, mode) {
+			logrus.Fatalf("[mode] unsupported mode %s, must be one of %s", args[0], strings.Join(clashModes, "|"))
+		}
+
+		err = patchMode(mode)
+		Audit(AuditSourceCLI, "", "mode.switch", mode, err)
+		if err != nil {
+			logrus.Fatalf("[mode] failed to switch mode: %v", err)
+		}
+		logrus.Infof("[mode] switched to %s mode", mode)
+
+		if modeOpts.persist {
+			if err = os.WriteFile(modePath, []byte(mode+"\n"), 0644); err != nil {
+				logrus.Fatalf("[mode] failed to persist mode: %v", err)
+			}
+			logrus.Infof("[mode] %s mode is persisted across config reloads", mode)
+		} else if p := PersistedMode(); p != "" && p != mode {
+			logrus.Warnf("[mode] the persisted %s mode is restored on the next reload, use --persist or --forget to change it", p)
+		}
+	},
+}
+
+func init() {
+	modeCmd.Flags().BoolVar(&modeOpts.persist, "persist", false, "keep the mode across config reloads and restarts")
+	modeCmd.Flags().BoolVar(&modeOpts.forget, "forget", false, "remove the persisted mode")
+}
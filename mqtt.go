@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// the availability payloads of the tpclash device
+const (
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+)
+
+// the packet types of the mqtt 3.1.1 subset used by the publisher
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttDisconnect = 0xe0
+)
+
+const mqttDialTimeout = 10 * time.Second
+
+// mqttClientExpiry is the number of intervals a client stays published after
+// it was seen last, then its topics are cleared.
+const mqttClientExpiry = 60
+
+var mqttIDRe = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// mqttClient publishes over a mqtt 3.1.1 connection with qos 0, nothing is
+// subscribed so the broker only sends the connack.
+type mqttClient struct {
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+// dialMQTT connects to the broker of a mqtt:// or mqtts:// url, the will is
+// published retained by the broker if the connection is lost.
+func dialMQTT(rawURL, clientID string, keepAlive time.Duration, willTopic, willPayload string) (*mqttClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	d := &net.Dialer{Timeout: mqttDialTimeout}
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		conn, err = d.Dial("tcp", hostWithPort(u.Host, "1883"))
+	case "mqtts", "ssl", "tls":
+		conn, err = tls.DialWithDialer(d, "tcp", hostWithPort(u.Host, "8883"), &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, must be mqtt or mqtts", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// clean session, retained will of qos 0
+	flags := byte(0x02 | 0x04 | 0x20)
+	var payload []byte
+	payload = appendMQTTString(payload, clientID)
+	payload = appendMQTTString(payload, willTopic)
+	payload = appendMQTTString(payload, willPayload)
+	if user := u.User.Username(); user != "" {
+		flags |= 0x80
+		payload = appendMQTTString(payload, user)
+		if pass, ok := u.User.Password(); ok {
+			flags |= 0x40
+			payload = appendMQTTString(payload, pass)
+		}
+	}
+	secs := min(int(keepAlive/time.Second), 0xffff)
+	header := appendMQTTString(nil, "MQTT")
+	header = append(header, 4, flags, byte(secs>>8), byte(secs))
+
+	c := &mqttClient{conn: conn, w: bufio.NewWriter(conn)}
+	_ = conn.SetDeadline(time.Now().Add(mqttDialTimeout))
+	if err = c.write(mqttConnect, append(header, payload...)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	ack := make([]byte, 4)
+	if _, err = io.ReadFull(conn, ack); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to read connack: %w", err)
+	}
+	if ack[0] != mqttConnack || ack[3] != 0 {
+		_ = conn.Close()
+		return nil, fmt.Errorf("connection refused by the broker, return code %d", ack[3])
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// Publish sends a qos 0 message.
+func (c *mqttClient) Publish(topic string, payload []byte, retain bool) error {
+	typ := byte(mqttPublish)
+	if retain {
+		typ |= 0x01
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(mqttDialTimeout))
+	return c.write(typ, append(appendMQTTString(nil, topic), payload...))
+}
+
+// Close disconnects from the broker, the will is not published.
+func (c *mqttClient) Close() error {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = c.write(mqttDisconnect, nil)
+	return c.conn.Close()
+}
+
+func (c *mqttClient) write(typ byte, body []byte) error {
+	_ = c.w.WriteByte(typ)
+	// the remaining length is a varint of 7 bits per byte
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		_ = c.w.WriteByte(b)
+		if n == 0 {
+			break
+		}
+	}
+	_, _ = c.w.Write(body)
+	return c.w.Flush()
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func hostWithPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// MQTTState is the state of tpclash published to the state topic.
+type MQTTState struct {
+	Core          string `json:"core"`
+	Version       string `json:"version,omitempty"`
+	Mode          string `json:"mode,omitempty"`
+	Profile       string `json:"profile"`
+	Connections   int    `json:"connections"`
+	UploadTotal   uint64 `json:"upload_total"`
+	DownloadTotal uint64 `json:"download_total"`
+	Up            uint64 `json:"up"`
+	Down          uint64 `json:"down"`
+	Clients       int    `json:"clients"`
+}
+
+// MQTTClientState is the state of a LAN client published to its topic.
+type MQTTClientState struct {
+	IP          string `json:"ip"`
+	Name        string `json:"name,omitempty"`
+	MAC         string `json:"mac,omitempty"`
+	State       string `json:"state"`
+	Connections int    `json:"connections"`
+	Upload      uint64 `json:"upload"`
+	Download    uint64 `json:"download"`
+}
+
+// mqttPublisher holds the topics of the tpclash device.
+type mqttPublisher struct {
+	node string
+	base string
+	cli  *mqttClient
+	// the intervals since the clients were seen, the ids of the expired ones
+	// are kept until their topics are cleared
+	clients map[string]int
+	expired []string
+	// the discovery payloads published on the current connection, the device
+	// is published again with the version of a new core
+	device     bool
+	discovered map[string]bool
+	version    string
+}
+
+// PublishMQTT publishes the state of tpclash and the LAN clients to
+// --mqtt every --mqtt-interval, with the discovery payloads of Home Assistant
+// under --mqtt-discovery. The state topics are retained, the availability is
+// set offline by the will of the connection if tpclash is gone.
+func PublishMQTT(ctx context.Context) {
+	if conf.MQTT == "" {
+		return
+	}
+	host, _ := os.Hostname()
+	node := strings.Trim(mqttIDRe.ReplaceAllString(strings.ToLower(host), "_"), "_")
+	if node == "" {
+		node = "tpclash"
+	}
+	p := &mqttPublisher{
+		node:    node,
+		base:    strings.TrimSuffix(conf.MQTTTopic, "/") + "/" + node,
+		clients: map[string]int{},
+	}
+
+	logrus.Infof("[mqtt] publishing the status to %s, topic: %s, interval: %s", redactURL(conf.MQTT), p.base, conf.MQTTInterval)
+	ticker := time.NewTicker(conf.MQTTInterval)
+	defer ticker.Stop()
+	var failing bool
+	for {
+		err := p.publish()
+		switch {
+		case err != nil && !failing:
+			logrus.Errorf("[mqtt] failed to publish the status, retrying: %v", redactErr(err))
+			failing = true
+		case err == nil && failing:
+			logrus.Info("[mqtt] mqtt publishing recovered")
+			failing = false
+		}
+
+		select {
+		case <-ctx.Done():
+			if p.cli != nil {
+				_ = p.cli.Publish(p.base+"/availability", []byte(mqttOffline), true)
+				_ = p.cli.Close()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publish sends the current state, the connection is reopened after an
+// error.
+func (p *mqttPublisher) publish() error {
+	state, clients := p.collect()
+	if p.cli == nil {
+		cli, err := dialMQTT(conf.MQTT, "tpclash-"+p.node, 2*conf.MQTTInterval+30*time.Second, p.base+"/availability", mqttOffline)
+		if err != nil {
+			return err
+		}
+		p.cli, p.device, p.discovered = cli, false, map[string]bool{}
+	}
+	err := p.send(state, clients)
+	if err != nil {
+		_ = p.cli.conn.Close()
+		p.cli = nil
+	}
+	return err
+}
+
+func (p *mqttPublisher) send(state MQTTState, clients []MQTTClientState) error {
+	if conf.MQTTDiscovery != "" && (!p.device || (state.Version != "" && state.Version != p.version)) {
+		if state.Version != "" {
+			p.version = state.Version
+		}
+		if err := p.discoverDevice(p.version); err != nil {
+			return err
+		}
+		p.device = true
+	}
+	if err := p.publishJSON(p.base+"/state", state); err != nil {
+		return err
+	}
+	// the empty retained payloads remove the topics from the broker and the
+	// entities from Home Assistant
+	for len(p.expired) > 0 {
+		id := p.expired[0]
+		if err := p.cli.Publish(p.base+"/client/"+id, nil, true); err != nil {
+			return err
+		}
+		if conf.MQTTDiscovery != "" {
+			if err := p.cli.Publish(p.discoveryTopic("binary_sensor", "client_"+id), nil, true); err != nil {
+				return err
+			}
+		}
+		delete(p.discovered, id)
+		p.expired = p.expired[1:]
+	}
+	for _, c := range clients {
+		id := mqttIDRe.ReplaceAllString(c.IP, "_")
+		if conf.MQTTDiscovery != "" && !p.discovered[id] {
+			if err := p.discoverClient(id, c); err != nil {
+				return err
+			}
+			p.discovered[id] = true
+		}
+		if err := p.publishJSON(p.base+"/client/"+id, c); err != nil {
+			return err
+		}
+	}
+	return p.cli.Publish(p.base+"/availability", []byte(mqttOnline), true)
+}
+
+// collect reads the state of the core and the clients, the clients seen
+// before are published offline once they have no connections and expire
+// after mqttClientExpiry intervals.
+func (p *mqttPublisher) collect() (MQTTState, []MQTTClientState) {
+	state := MQTTState{Core: "stopped", Profile: mqttProfile()}
+	perClient := map[string]*MQTTClientState{}
+	if cc, err := RunningConf(); err == nil {
+		report := collectStatus(cc)
+		if report.APIError == "" {
+			state.Core = "running"
+		}
+		state.Version, state.Mode, state.Connections = report.CoreVersion, report.Mode, report.Connections
+		state.UploadTotal, state.DownloadTotal = report.UploadTotal, report.DownloadTotal
+		state.Up, state.Down = report.Up, report.Down
+
+		var resp struct {
+			Connections []clashConn `json:"connections"`
+		}
+		if state.Core == "running" && NewClashAPI(cc).Do("GET", "/connections", nil, &resp) == nil {
+			for _, c := range resp.Connections {
+				ip := c.Metadata.SourceIP
+				if ip == "" {
+					continue
+				}
+				s := perClient[ip]
+				if s == nil {
+					s = &MQTTClientState{IP: ip, State: mqttOnline}
+					perClient[ip] = s
+				}
+				s.Connections++
+				s.Upload += c.Upload
+				s.Download += c.Download
+			}
+		}
+	}
+	state.Clients = len(perClient)
+
+	// the accounted traffic is more accurate than the active connections
+	usages := ClientUsages()
+	for ip := range p.clients {
+		p.clients[ip]++
+	}
+	for ip, seen := range ClientLastSeen() {
+		idle := int(time.Since(seen) / conf.MQTTInterval)
+		if n, ok := p.clients[ip]; (!ok || idle < n) && idle <= mqttClientExpiry {
+			p.clients[ip] = idle
+		}
+	}
+	for ip := range perClient {
+		p.clients[ip] = 0
+	}
+	var clients []MQTTClientState
+	for _, ip := range sortedKeys(p.clients) {
+		s := perClient[ip]
+		if s == nil {
+			if p.clients[ip] > mqttClientExpiry {
+				delete(p.clients, ip)
+				p.expired = append(p.expired, mqttIDRe.ReplaceAllString(ip, "_"))
+				continue
+			}
+			s = &MQTTClientState{IP: ip, State: mqttOffline}
+		}
+		if u, ok := usages[ip]; ok {
+			s.Upload, s.Download = u.Upload, u.Download
+		}
+		if l, ok := LookupLease(ip); ok {
+			s.Name, s.MAC = l.Hostname, l.MAC
+		}
+		clients = append(clients, *s)
+	}
+	return state, clients
+}
+
+// mqttProfile names the profile tpclash runs, see tpclash profile.
+func mqttProfile() string {
+	if p := CurrentState().Config.Profile; p != "" {
+		return p
+	}
+	return defaultProfile
+}
+
+func (p *mqttPublisher) publishJSON(topic string, v any) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.cli.Publish(topic, bs, true)
+}
+
+// mqttDevice is the device of the discovery payloads, the entities of tpclash
+// and its clients are grouped under it in Home Assistant.
+func (p *mqttPublisher) mqttDevice(version string) map[string]any {
+	d := map[string]any{
+		"identifiers":  []string{"tpclash_" + p.node},
+		"name":         "TPClash " + p.node,
+		"manufacturer": "TPClash",
+		"model":        CoreFlavor(),
+	}
+	if version != "" {
+		d["sw_version"] = version
+	}
+	return d
+}
+
+// discoverDevice publishes the discovery payloads of the tpclash entities.
+func (p *mqttPublisher) discoverDevice(version string) error {
+	type entity struct {
+		component, key, name, template string
+		extra                          map[string]any
+	}
+	entities := []entity{
+		{"binary_sensor", "core", "Core", "{{ value_json.core }}", map[string]any{
+			"payload_on": "running", "payload_off": "stopped", "device_class": "running"}},
+		{"sensor", "mode", "Mode", "{{ value_json.mode }}", map[string]any{"icon": "mdi:routes"}},
+		{"sensor", "profile", "Profile", "{{ value_json.profile }}", map[string]any{"icon": "mdi:file-cog"}},
+		{"sensor", "connections", "Connections", "{{ value_json.connections }}", map[string]any{
+			"state_class": "measurement", "icon": "mdi:lan-connect"}},
+		{"sensor", "clients", "Online clients", "{{ value_json.clients }}", map[string]any{
+			"state_class": "measurement", "icon": "mdi:devices"}},
+		{"sensor", "upload_total", "Upload total", "{{ value_json.upload_total }}", map[string]any{
+			"unit_of_measurement": "B", "device_class": "data_size", "state_class": "total_increasing"}},
+		{"sensor", "download_total", "Download total", "{{ value_json.download_total }}", map[string]any{
+			"unit_of_measurement": "B", "device_class": "data_size", "state_class": "total_increasing"}},
+		{"sensor", "up", "Upload speed", "{{ value_json.up }}", map[string]any{
+			"unit_of_measurement": "B/s", "device_class": "data_rate", "state_class": "measurement"}},
+		{"sensor", "down", "Download speed", "{{ value_json.down }}", map[string]any{
+			"unit_of_measurement": "B/s", "device_class": "data_rate", "state_class": "measurement"}},
+	}
+	for _, e := range entities {
+		payload := map[string]any{
+			"name":               e.name,
+			"unique_id":          "tpclash_" + p.node + "_" + e.key,
+			"state_topic":        p.base + "/state",
+			"value_template":     e.template,
+			"availability_topic": p.base + "/availability",
+			"device":             p.mqttDevice(version),
+		}
+		for k, v := range e.extra {
+			payload[k] = v
+		}
+		if err := p.publishJSON(p.discoveryTopic(e.component, e.key), payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discoverClient publishes the discovery payload of the connectivity sensor
+// of a LAN client, the traffic is in its attributes.
+func (p *mqttPublisher) discoverClient(id string, c MQTTClientState) error {
+	name := c.IP
+	if c.Name != "" {
+		name = c.Name
+	}
+	topic := p.base + "/client/" + id
+	return p.publishJSON(p.discoveryTopic("binary_sensor", "client_"+id), map[string]any{
+		"name":                  "Client " + name,
+		"unique_id":             "tpclash_" + p.node + "_client_" + id,
+		"state_topic":           topic,
+		"value_template":        "{{ value_json.state }}",
+		"payload_on":            mqttOnline,
+		"payload_off":           mqttOffline,
+		"device_class":          "connectivity",
+		"json_attributes_topic": topic,
+		"availability_topic":    p.base + "/availability",
+		"device":                p.mqttDevice(p.version),
+	})
+}
+
+func (p *mqttPublisher) discoveryTopic(component, key string) string {
+	return strings.TrimSuffix(conf.MQTTDiscovery, "/") + "/" + component + "/tpclash_" + p.node + "/" + key + "/config"
+}
+
+// CheckMQTTConf validates the mqtt flags.
+func CheckMQTTConf() error {
+	if conf.MQTT == "" {
+		return nil
+	}
+	u, err := url.Parse(conf.MQTT)
+	if err != nil || u.Host == "" || !slices.Contains([]string{"mqtt", "tcp", "mqtts", "ssl", "tls"}, u.Scheme) {
+		return errors.New("[mqtt] invalid --mqtt url, must be mqtt://[user:pass@]host[:port] or mqtts://")
+	}
+	if conf.MQTTInterval <= 0 {
+		return fmt.Errorf("[mqtt] invalid --mqtt-interval %s, must be positive", conf.MQTTInterval)
+	}
+	if strings.Trim(conf.MQTTTopic, "/") == "" {
+		return errors.New("[mqtt] --mqtt-topic must not be empty")
+	}
+	return nil
+}
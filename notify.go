@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// notification events
+const (
+	EventCoreCrash     = "core-crash"
+	EventCoreRestart   = "core-restart"
+	EventReloadSuccess = "reload-success"
+	EventReloadFailure = "reload-failure"
+	EventQuotaWarning  = "quota-warning"
+	EventRulesError    = "rules-error"
+
+	EventBudgetWarning  = "budget-warning"
+	EventBudgetExceeded = "budget-exceeded"
+
+	EventHATransition = "ha-transition"
+	EventHAPeerDown   = "ha-peer-down"
+
+	EventDNSFallback = "dns-fallback"
+)
+
+var notifyEvents = []string{EventCoreCrash, EventCoreRestart, EventReloadSuccess, EventReloadFailure, EventQuotaWarning, EventRulesError,
+	EventBudgetWarning, EventBudgetExceeded, EventHATransition, EventHAPeerDown, EventDNSFallback}
+
+const (
+	defaultNotifyTemplate = "[tpclash@{{.Host}}] {{.Event}}: {{.Message}}"
+
+	// the same notification is not sent again in notifyDedupInterval
+	notifyDedupInterval = time.Minute
+)
+
+// Notification is the data of the message templates.
+type Notification struct {
+	Event   string    `json:"event"`
+	Message string    `json:"message"`
+	Host    string    `json:"host"`
+	Time    time.Time `json:"time"`
+}
+
+// notifySink delivers the rendered notification.
+type notifySink interface {
+	Send(ctx context.Context, n Notification, text string) error
+}
+
+var notifier = struct {
+	sync.Mutex
+	sinks     []notifySink
+	templates map[string]*template.Template
+	sent      map[string]time.Time
+}{sent: map[string]time.Time{}}
+
+// InitNotifier parses --notify, --notify-events and --notify-template.
+func InitNotifier() error {
+	for _, ev := range conf.NotifyEvents {
+		if !slices.Contains(notifyEvents, ev) {
+			return fmt.Errorf("[notify] unsupported event %s, must be one of %s", ev, strings.Join(notifyEvents, ","))
+		}
+	}
+
+	templates := map[string]*template.Template{}
+	for _, ev := range notifyEvents {
+		text := defaultNotifyTemplate
+		if t, ok := conf.NotifyTemplates[ev]; ok {
+			text = t
+		}
+		tpl, err := template.New(ev).Parse(text)
+		if err != nil {
+			return fmt.Errorf("[notify] failed to parse template of %s: %w", ev, err)
+		}
+		templates[ev] = tpl
+	}
+	for ev := range conf.NotifyTemplates {
+		if !slices.Contains(notifyEvents, ev) {
+			return fmt.Errorf("[notify] unsupported template event %s", ev)
+		}
+	}
+
+	var sinks []notifySink
+	for _, s := range conf.Notify {
+		sink, err := newNotifySink(s)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	notifier.Lock()
+	notifier.sinks, notifier.templates = sinks, templates
+	notifier.Unlock()
+	return nil
+}
+
+// newNotifySink creates the sink of a --notify url:
+//
+//   - telegram://BOT_TOKEN@CHAT_ID
+//   - bark://DEVICE_KEY@HOST(default api.day.app)
+//   - http(s)://...: webhook, the notification is posted as json(webhook.go)
+func newNotifySink(s string) (notifySink, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("[notify] invalid notify url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "telegram":
+		if u.User == nil || u.Host == "" {
+			return nil, fmt.Errorf("[notify] invalid telegram url, must be telegram://BOT_TOKEN@CHAT_ID")
+		}
+		return &telegramSink{token: u.User.String(), chatID: u.Host}, nil
+	case "bark":
+		if u.User == nil {
+			return nil, fmt.Errorf("[notify] invalid bark url, must be bark://DEVICE_KEY@HOST")
+		}
+		host := u.Host
+		if host == "" {
+			host = "api.day.app"
+		}
+		return &barkSink{key: u.User.Username(), server: "https://" + host}, nil
+	case "http", "https":
+		return &webhookSink{url: s}, nil
+	}
+	return nil, fmt.Errorf("[notify] unsupported notify url scheme: %s", u.Scheme)
+}
+
+// Notify sends the event to all sinks in the background, events that are not
+// enabled and duplicates in a short time are dropped.
+func Notify(event, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	PublishEvent(event, msg, nil)
+
+	notifier.Lock()
+	defer notifier.Unlock()
+
+	if len(notifier.sinks) == 0 {
+		return
+	}
+	if len(conf.NotifyEvents) > 0 && !slices.Contains(conf.NotifyEvents, event) {
+		return
+	}
+
+	n := Notification{Event: event, Message: msg, Time: time.Now()}
+	n.Host, _ = os.Hostname()
+
+	key := event + "\x00" + n.Message
+	if t, ok := notifier.sent[key]; ok && n.Time.Sub(t) < notifyDedupInterval {
+		return
+	}
+	notifier.sent[key] = n.Time
+	for k, t := range notifier.sent {
+		if n.Time.Sub(t) >= notifyDedupInterval {
+			delete(notifier.sent, k)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := notifier.templates[event].Execute(&buf, n); err != nil {
+		logrus.Errorf("[notify] failed to render %s notification: %v", event, err)
+		return
+	}
+
+	for _, sink := range notifier.sinks {
+		sink := sink
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := sink.Send(ctx, n, buf.String()); err != nil {
+				logrus.Errorf("[notify] failed to send %s notification: %v", event, err)
+			}
+		}()
+	}
+}
+
+// TestNotify sends a test notification to all sinks and waits for them, the
+// events and the dedup of Notify do not apply.
+func TestNotify(actor string) error {
+	notifier.Lock()
+	sinks := notifier.sinks
+	notifier.Unlock()
+	if len(sinks) == 0 {
+		return errors.New("[notify] no --notify sink configured")
+	}
+
+	n := Notification{Event: "test", Message: "test notification sent by " + actor, Time: time.Now()}
+	n.Host, _ = os.Hostname()
+	var buf bytes.Buffer
+	if err := template.Must(template.New("test").Parse(defaultNotifyTemplate)).Execute(&buf, n); err != nil {
+		return fmt.Errorf("[notify] failed to render the test notification: %w", err)
+	}
+
+	errs := make([]error, len(sinks))
+	var wg sync.WaitGroup
+	for i, sink := range sinks {
+		i, sink := i, sink
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := sink.Send(ctx, n, buf.String()); err != nil {
+				errs[i] = fmt.Errorf("[notify] failed to send the test notification: %w", err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func postJSON(ctx context.Context, u string, body any) error {
+	bs, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return redactErr(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type telegramSink struct {
+	token  string
+	chatID string
+}
+
+func (s *telegramSink) Send(ctx context.Context, _ Notification, text string) error {
+	return postJSON(ctx, "https://api.telegram.org/bot"+s.token+"/sendMessage", map[string]string{
+		"chat_id": s.chatID,
+		"text":    text,
+	})
+}
+
+type barkSink struct {
+	key    string
+	server string
+}
+
+func (s *barkSink) Send(ctx context.Context, n Notification, text string) error {
+	return postJSON(ctx, s.server+"/push", map[string]string{
+		"device_key": s.key,
+		"title":      "TPClash " + n.Event,
+		"body":       text,
+		"group":      "tpclash",
+	})
+}
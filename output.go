@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// output formats of the subcommands(--output)
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+func CheckOutput() error {
+	if conf.Output != OutputText && conf.Output != OutputJSON {
+		return fmt.Errorf("[main] unsupported output %s, must be %s or %s", conf.Output, OutputText, OutputJSON)
+	}
+	return nil
+}
+
+// jsonOutput reports whether the results are printed as json, the logs are
+// still written to stderr.
+func jsonOutput() bool {
+	return conf.Output == OutputJSON
+}
+
+func printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logrus.Fatal(err)
+	}
+}
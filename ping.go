@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var pingOpts struct {
+	url         string
+	timeout     time.Duration
+	concurrency int
+	json        string
+}
+
+// PingResult is the delay test result of a proxy, Delay is 0 if the test failed.
+type PingResult struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Delay int    `json:"delay"`
+	Error string `json:"error,omitempty"`
+}
+
+// builtin proxies that can not be tested
+var pingSkipTypes = []string{"Direct", "Reject", "RejectDrop", "Pass", "Compatible", "Dns", "Block"}
+
+var pingCmd = &cobra.Command{
+	Use:   "ping [GROUP]",
+	Short: "Run delay tests of all proxies or the proxies of a group",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if pingOpts.concurrency < 1 {
+			logrus.Fatal("[ping] concurrency must be greater than 0")
+		}
+		if pingOpts.timeout < time.Millisecond {
+			logrus.Fatal("[ping] timeout must be at least 1ms")
+		}
+
+		api, err := RunningAPI()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		proxies, err := fetchProxies(api)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		var names []string
+		if len(args) > 0 {
+			g, ok := proxies[args[0]]
+			if !ok || !g.IsGroup() {
+				logrus.Fatalf("[ping] proxy group %s not found", args[0])
+			}
+			names = g.All
+		} else {
+			for name := range proxies {
+				names = append(names, name)
+			}
+		}
+
+		targets := pingTargets(proxies, names)
+		if len(targets) == 0 {
+			logrus.Fatal("[ping] no proxies to test")
+		}
+
+		results := pingProxies(api, targets, pingOpts.url, pingOpts.timeout, pingOpts.concurrency)
+		sort.Slice(results, func(i, j int) bool {
+			a, b := results[i], results[j]
+			if (a.Delay > 0) != (b.Delay > 0) {
+				return a.Delay > 0
+			}
+			if a.Delay != b.Delay {
+				return a.Delay < b.Delay
+			}
+			return a.Name < b.Name
+		})
+
+		if jsonOutput() && pingOpts.json == "" {
+			pingOpts.json = "-"
+		}
+		if pingOpts.json != "" {
+			if err = writePingJSON(pingOpts.json, results); err != nil {
+				logrus.Fatalf("[ping] failed to write json: %v", err)
+			}
+			if pingOpts.json == "-" {
+				return
+			}
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		defer func() { _ = w.Flush() }()
+
+		_, _ = fmt.Fprintln(w, "PROXY\tTYPE\tDELAY")
+		for _, r := range results {
+			delay := formatDelay(r.Delay)
+			if r.Error != "" {
+				delay = "timeout"
+			}
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", r.Name, r.Type, delay)
+		}
+	},
+}
+
+// pingTargets returns the named proxies that can be tested.
+func pingTargets(proxies map[string]clashProxy, names []string) []clashProxy {
+	var targets []clashProxy
+	for _, name := range names {
+		p, ok := proxies[name]
+		if !ok || p.IsGroup() || slices.Contains(pingSkipTypes, p.Type) {
+			continue
+		}
+		targets = append(targets, p)
+	}
+	return targets
+}
+
+// pingProxies runs the delay tests through the clash api concurrently.
+func pingProxies(api *ClashAPI, targets []clashProxy, testURL string, timeout time.Duration, concurrency int) []PingResult {
+	// the core answers after the test timeout at the latest
+	api.cli.Timeout = timeout + 5*time.Second
+
+	query := url.Values{}
+	query.Set("url", testURL)
+	query.Set("timeout", strconv.FormatInt(timeout.Milliseconds(), 10))
+
+	results := make([]PingResult, len(targets))
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for i, p := range targets {
+		i, p := i, p
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+
+			r := PingResult{Name: p.Name, Type: p.Type}
+			var resp struct {
+				Delay int `json:"delay"`
+			}
+			if err := api.Do("GET", "/proxies/"+url.PathEscape(p.Name)+"/delay?"+query.Encode(), nil, &resp); err != nil {
+				logrus.Debugf("[ping] %s: %v", p.Name, err)
+				r.Error = err.Error()
+			} else {
+				r.Delay = resp.Delay
+			}
+			results[i] = r
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func writePingJSON(path string, results []PingResult) error {
+	report := struct {
+		Time    time.Time    `json:"time"`
+		URL     string       `json:"url"`
+		Results []PingResult `json:"results"`
+	}{time.Now(), pingOpts.url, results}
+
+	out := os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		out = f
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func init() {
+	pingCmd.Flags().StringVar(&pingOpts.url, "url", "http://www.gstatic.com/generate_204", "url used to test the delay")
+	pingCmd.Flags().DurationVar(&pingOpts.timeout, "timeout", 5*time.Second, "delay test timeout of each proxy")
+	pingCmd.Flags().IntVar(&pingOpts.concurrency, "concurrency", 8, "number of proxies tested at the same time")
+	pingCmd.Flags().StringVar(&pingOpts.json, "json", "", "write the results as json to the specified file('-' for stdout)")
+}
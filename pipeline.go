@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// the source stages work on the fetched bytes, they run before the config is
+// checked to look like a config
+const (
+	StageDecrypt = "decrypt"
+	StageDecode  = "decode"
+)
+
+var sourceStageNames = []string{StageDecrypt, StageDecode}
+
+// securityStages keep the controller api off the network and the config
+// intercepting the traffic, disabling them is warned about.
+var securityStages = []string{"bind", "enforce", "controller"}
+
+// configStage is a step of the config pipeline run by Core.Fix, either Run on
+// the config text or Patch on the parsed yaml document. Most stages are
+// lenient, they log their own errors and leave the config unchanged; an error
+// of a strict stage fails the pipeline and the config is not loaded.
+type configStage struct {
+	Name string
+	Run  func(c string) (string, error)
+	// Patch changes the document in place and reports whether it changed it,
+	// the consecutive patch stages share one parse of the config
+	Patch func(doc *yaml.Node) (bool, error)
+}
+
+// lenient wraps the run of a stage that never fails the pipeline.
+func lenient(run func(c string) string) func(c string) (string, error) {
+	return func(c string) (string, error) { return run(c), nil }
+}
+
+// lenientPatch wraps the patch of a stage that never fails the pipeline.
+func lenientPatch(patch func(doc *yaml.Node) bool) func(doc *yaml.Node) (bool, error) {
+	return func(doc *yaml.Node) (bool, error) { return patch(doc), nil }
+}
+
+// patchYAML parses the yaml config, runs patch on the document and encodes it
+// again, the config is returned as is if patch did not change it.
+func patchYAML(c string, patch func(doc *yaml.Node) (bool, error)) (string, error) {
+	var doc yaml.Node
+	if err := decodeYAML(c, &doc); err != nil {
+		return "", fmt.Errorf("[config] failed to unmarshal yaml config: %w", err)
+	}
+	changed, err := patch(&doc)
+	if err != nil || !changed {
+		return c, err
+	}
+	return encodeYAMLDoc(&doc)
+}
+
+func encodeYAMLDoc(doc *yaml.Node) (string, error) {
+	bs, err := yaml.Marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("[config] failed to marshal yaml config: %w", err)
+	}
+	return string(bs), nil
+}
+
+// yamlRoot returns the top level mapping of the document, nil if the document
+// is empty or not a mapping.
+func yamlRoot(doc *yaml.Node) *yaml.Node {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+	return doc.Content[0]
+}
+
+// runStage runs one stage on the config text.
+func runStage(st configStage, c string) (string, error) {
+	if st.Patch == nil {
+		return st.Run(c)
+	}
+	return patchYAML(c, st.Patch)
+}
+
+var pipelineOpts struct {
+	until string
+}
+
+// pipelineEnabled returns the names of all in the order of --pipeline without
+// the --pipeline-skip ones, all are enabled in order by default.
+func pipelineEnabled(all []string) []string {
+	order := all
+	if len(conf.Pipeline) > 0 {
+		order = nil
+		for _, name := range conf.Pipeline {
+			if slices.Contains(all, name) {
+				order = append(order, name)
+			}
+		}
+	}
+	return slices.DeleteFunc(slices.Clone(order), func(name string) bool { return slices.Contains(conf.PipelineSkip, name) })
+}
+
+func stageNames(stages []configStage) []string {
+	names := make([]string, 0, len(stages))
+	for _, st := range stages {
+		names = append(names, st.Name)
+	}
+	return names
+}
+
+// logStage logs a finished stage, at the info level with --pipeline-trace.
+func logStage(name string, start time.Time, result string) {
+	log := logrus.Debugf
+	if conf.PipelineTrace {
+		log = logrus.Infof
+	}
+	log("[pipeline] %s done in %s, %s", name, time.Since(start).Round(time.Microsecond), result)
+}
+
+// sizeResult is the result of logStage of a stage on the config text.
+func sizeResult(in, out int, changed bool) string {
+	if !changed {
+		return "unchanged"
+	}
+	return fmt.Sprintf("%d -> %d bytes", in, out)
+}
+
+// runSourceStages runs the enabled source stages on a fetched config.
+func runSourceStages(bs []byte) ([]byte, error) {
+	for _, name := range pipelineEnabled(sourceStageNames) {
+		start := time.Now()
+		in := len(bs)
+		out, err := runSourceStage(name, bs)
+		if err != nil {
+			return nil, fmt.Errorf("%s failed: %w", name, err)
+		}
+		logStage(name, start, sizeResult(in, len(out), !bytes.Equal(bs, out)))
+		bs = out
+	}
+	return bs, nil
+}
+
+func runSourceStage(name string, bs []byte) ([]byte, error) {
+	switch name {
+	case StageDecrypt:
+		if conf.ConfigEncPassword == "" {
+			return bs, nil
+		}
+		return Decrypt(bs, conf.ConfigEncPassword)
+	case StageDecode:
+		return decodeBase64Config(bs), nil
+	}
+	return bs, nil
+}
+
+// decodeBase64Config decodes the configs served base64 encoded, bs is
+// returned unchanged unless it decodes to a config.
+func decodeBase64Config(bs []byte) []byte {
+	if looksLikeConfig(bs) {
+		return bs
+	}
+	s := strings.Join(strings.Fields(string(bs)), "")
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if decoded, err := enc.DecodeString(s); err == nil && looksLikeConfig(decoded) {
+			return decoded
+		}
+	}
+	return bs
+}
+
+// runPipeline runs the enabled stages of the core in order, it stops at the
+// first stage failing. The config is parsed once for the consecutive patch
+// stages and encoded again before a run stage and at the end.
+func runPipeline(stages []configStage, c string) (string, error) {
+	var doc *yaml.Node
+	var parsed, changed bool
+	encode := func() error {
+		if changed {
+			out, err := encodeYAMLDoc(doc)
+			if err != nil {
+				return err
+			}
+			c = out
+		}
+		doc, parsed, changed = nil, false, false
+		return nil
+	}
+
+	for _, name := range pipelineEnabled(stageNames(stages)) {
+		st := stages[slices.IndexFunc(stages, func(st configStage) bool { return st.Name == name })]
+		start := time.Now()
+		if st.Patch == nil {
+			if err := encode(); err != nil {
+				return "", err
+			}
+			out, err := st.Run(c)
+			if err != nil {
+				return "", fmt.Errorf("[pipeline] %s failed: %w", name, err)
+			}
+			logStage(name, start, sizeResult(len(c), len(out), out != c))
+			c = out
+			continue
+		}
+
+		if !parsed {
+			parsed = true
+			doc = &yaml.Node{}
+			if err := decodeYAML(c, doc); err != nil {
+				// the check of the core reports the invalid config
+				logrus.Debugf("[pipeline] failed to unmarshal yaml config, the patch stages are skipped: %v", err)
+				doc = nil
+			}
+		}
+		if doc == nil {
+			continue
+		}
+		patched, err := st.Patch(doc)
+		if err != nil {
+			return "", fmt.Errorf("[pipeline] %s failed: %w", name, err)
+		}
+		changed = changed || patched
+		result := "unchanged"
+		if patched {
+			result = "changed"
+		}
+		logStage(name, start, result)
+	}
+	if err := encode(); err != nil {
+		return "", err
+	}
+	return c, nil
+}
+
+// CheckPipelineConf validates --pipeline and --pipeline-skip against the
+// stages of the core.
+func CheckPipelineConf() error {
+	coreStages := stageNames(core.Stages())
+	all := append(slices.Clone(sourceStageNames), coreStages...)
+	for _, name := range append(slices.Clone(conf.Pipeline), conf.PipelineSkip...) {
+		if !slices.Contains(all, name) {
+			return fmt.Errorf("[pipeline] unknown stage %q of %s, must be one of %s", name, core.Name(), strings.Join(all, ", "))
+		}
+	}
+
+	seen := map[string]bool{}
+	var config bool
+	for _, name := range conf.Pipeline {
+		if seen[name] {
+			return fmt.Errorf("[pipeline] stage %s is listed twice", name)
+		}
+		seen[name] = true
+		if slices.Contains(coreStages, name) {
+			config = true
+		} else if config {
+			return fmt.Errorf("[pipeline] source stage %s must come before the config stages", name)
+		}
+	}
+	if len(conf.Pipeline) > 0 || len(conf.PipelineSkip) > 0 {
+		var disabled []string
+		enabled := append(pipelineEnabled(sourceStageNames), pipelineEnabled(coreStages)...)
+		for _, name := range all {
+			if !slices.Contains(enabled, name) {
+				disabled = append(disabled, name)
+			}
+		}
+		logrus.Infof("[pipeline] stages: %s(disabled: %s)", strings.Join(enabled, " -> "), strings.Join(disabled, ", "))
+		for _, name := range disabled {
+			if slices.Contains(securityStages, name) {
+				logrus.Warnf("[pipeline] security stage %s is disabled, the config is used as is", name)
+			}
+		}
+	}
+	return nil
+}
+
+var configPipelineCmd = &cobra.Command{
+	Use:   "pipeline",
+	Short: "Run the config pipeline on --config and report every stage",
+	Long: `Run the config pipeline on --config and report every stage.
+
+The fetched config goes through the source stages(decrypt, decode) and the
+config stages of the core, then it is validated by the core(not a stage):
+
+  clash     template, preset, script, auto-fix, bind, enforce, ipv6, ruleset, asset-mirror, controller, mode
+  sing-box  template, script, clash-api
+
+--pipeline reorders and selects the stages, --pipeline-skip disables some of
+them, both can be set in the tpclash config file. Use --until to print the
+config after a config stage.
+
+The validation always runs and can not be disabled. Converting a subscription
+(ss://, vmess:// links) and merging an override file are not supported, use a
+subscription converter serving a clash config and the config scripts instead.
+
+Disabling bind, enforce or controller leaves the controller api and the
+interception as the config sets them, a warning is logged.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+		if core, err = NewCore(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = CheckPipelineConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		stages := core.Stages()
+		if pipelineOpts.until != "" && !slices.Contains(stageNames(stages), pipelineOpts.until) {
+			logrus.Fatalf("[pipeline] unknown config stage %q of %s", pipelineOpts.until, core.Name())
+		}
+
+		// the source stages run within the fetch, see --pipeline-trace
+		c, err := loadConfigSource(context.Background())
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "STAGE\tTIME\tSIZE\tCHANGED")
+		_, _ = fmt.Fprintf(w, "%s\t-\t%d\t-\n", "source", len(c))
+		for _, name := range pipelineEnabled(stageNames(stages)) {
+			i := slices.IndexFunc(stages, func(st configStage) bool { return st.Name == name })
+			start := time.Now()
+			out, err := runStage(stages[i], c)
+			if err != nil {
+				_ = w.Flush()
+				logrus.Fatalf("[pipeline] %s failed: %v", name, err)
+			}
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%v\n", name, time.Since(start).Round(time.Microsecond), len(out), out != c)
+			c = out
+			if name == pipelineOpts.until {
+				break
+			}
+		}
+		if pipelineOpts.until != "" {
+			_ = w.Flush()
+			c, err := core.Redact(c)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			fmt.Print(c)
+			return
+		}
+
+		_, err = core.Check(c)
+		result := "ok"
+		if err != nil {
+			result = err.Error()
+		}
+		_, _ = fmt.Fprintf(w, "%s\t-\t-\t%s\n", "validate", result)
+		_ = w.Flush()
+		if err != nil {
+			logrus.Fatal("[pipeline] the config is not valid")
+		}
+	},
+}
+
+func init() {
+	configPipelineCmd.Flags().StringVar(&pipelineOpts.until, "until", "", "print the config after the specified config stage(the credentials are masked)")
+	configCmd.AddCommand(configPipelineCmd)
+}
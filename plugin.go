@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pluginContract is the version of the payload sent to the plugins, it is
+// increased when a field is removed or changes its meaning.
+const pluginContract = 1
+
+// lifecycle events of the plugins
+const (
+	PluginConfigFetched = "config-fetched"
+	PluginPreReload     = "pre-reload"
+	PluginPostReload    = "post-reload"
+	PluginCoreCrashed   = "core-crashed"
+	PluginRulesApplied  = "rules-applied"
+)
+
+const (
+	// pluginQueueSize is the number of the events waiting for the plugins,
+	// the events are dropped once the plugins fall behind
+	pluginQueueSize = 64
+	// pluginMaxOutput limits the output of a plugin kept for the logs
+	pluginMaxOutput = 4 << 10
+)
+
+// PluginPayload is written as json to the stdin of the plugins.
+type PluginPayload struct {
+	Version int       `json:"version"`
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Node    string    `json:"node"`
+	Data    any       `json:"data"`
+}
+
+// pluginJob is an event queued for the plugins, the result of a veto event
+// is sent to veto.
+type pluginJob struct {
+	payload PluginPayload
+	veto    chan error
+}
+
+var pluginQueue = struct {
+	once sync.Once
+	ch   chan pluginJob
+}{ch: make(chan pluginJob, pluginQueueSize)}
+
+// startPlugins starts the worker delivering the events one by one in order,
+// a plugin never runs two events at once.
+func startPlugins() {
+	pluginQueue.once.Do(func() {
+		go func() {
+			for job := range pluginQueue.ch {
+				var vetoed error
+				for _, plugin := range conf.Plugins {
+					err := runPlugin(plugin, job.payload)
+					if err == nil {
+						continue
+					}
+					if job.veto != nil {
+						vetoed = err
+						break
+					}
+					logrus.Errorf("[plugin] %v", err)
+				}
+				if job.veto != nil {
+					job.veto <- vetoed
+				}
+			}
+		}()
+	})
+}
+
+// EmitPlugins passes the event to the plugins in the background, the events
+// are delivered one by one in order.
+func EmitPlugins(event string, data any) {
+	if len(conf.Plugins) == 0 {
+		return
+	}
+	startPlugins()
+	select {
+	case pluginQueue.ch <- pluginJob{payload: newPluginPayload(event, data)}:
+	default:
+		logrus.Warnf("[plugin] the plugins are too slow, %s event dropped", event)
+	}
+}
+
+// VetoPlugins passes the event to the plugins after the queued events and
+// waits for them, the first plugin exiting non-zero(or timing out) vetoes the
+// action.
+func VetoPlugins(event string, data any) error {
+	if len(conf.Plugins) == 0 {
+		return nil
+	}
+	startPlugins()
+	veto := make(chan error, 1)
+	pluginQueue.ch <- pluginJob{payload: newPluginPayload(event, data), veto: veto}
+	if err := <-veto; err != nil {
+		return fmt.Errorf("[plugin] %s vetoed by %w", event, err)
+	}
+	return nil
+}
+
+func newPluginPayload(event string, data any) PluginPayload {
+	p := PluginPayload{Version: pluginContract, Event: event, Time: time.Now(), Data: data}
+	p.Node, _ = os.Hostname()
+	return p
+}
+
+// runPlugin runs the plugin with the event as its argument and the payload on
+// its stdin.
+func runPlugin(plugin string, p PluginPayload) error {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to encode the %s payload: %w", p.Event, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), conf.PluginTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, plugin, p.Event)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), "TPCLASH_EVENT="+p.Event, "TPCLASH_HOME="+conf.ClashHome)
+	var stdout, stderr limitedBuffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	start := time.Now()
+	err = RunChild(cmd)
+	if ctx.Err() != nil {
+		err = fmt.Errorf("timed out after %s", conf.PluginTimeout)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return fmt.Errorf("%s(%s): %w", filepath.Base(plugin), p.Event, err)
+	}
+	logrus.Debugf("[plugin] %s(%s) done in %s: %s", filepath.Base(plugin), p.Event, time.Since(start).Round(time.Millisecond), strings.TrimSpace(stdout.String()))
+	return nil
+}
+
+// limitedBuffer keeps the first pluginMaxOutput bytes of the output.
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := pluginMaxOutput - b.Len(); n > 0 {
+		b.Buffer.Write(p[:min(n, len(p))])
+	}
+	return len(p), nil
+}
+
+// pluginResult adds the result of an action to the payload data.
+func pluginResult(data map[string]any, err error) map[string]any {
+	data["ok"] = err == nil
+	if err != nil {
+		data["error"] = err.Error()
+	}
+	return data
+}
+
+// CheckPluginConf validates the --plugin executables.
+func CheckPluginConf() error {
+	for _, plugin := range conf.Plugins {
+		fi, err := os.Stat(plugin)
+		if err != nil {
+			return fmt.Errorf("[plugin] invalid plugin: %w", err)
+		}
+		if fi.IsDir() || fi.Mode()&0111 == 0 {
+			return fmt.Errorf("[plugin] the plugin %s is not an executable file", plugin)
+		}
+	}
+	if len(conf.Plugins) > 0 && conf.PluginTimeout <= 0 {
+		return errors.New("[plugin] --plugin-timeout must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// PolicyUDP stops intercepting the udp traffic while its policy matches, the
+// DNS queries and the fake ips are still intercepted. The clients resolving
+// by the fake-ip dns send most of their udp to the fake ips, so only the udp
+// to the real ips(e.g. games and p2p dialing ips) goes direct.
+const PolicyUDP = "udp"
+
+// bypassOwnerPolicy registers the sources bypassed by the policies.
+const bypassOwnerPolicy = "policy"
+
+// policyInterval is how often the policies are evaluated.
+const policyInterval = 15 * time.Second
+
+// policyEntry is a policy of --policy, its action is applied while the
+// expression is true.
+type policyEntry struct {
+	Raw  string
+	Expr string
+	prg  cel.Program
+	// the udp action is only supported by the policies
+	*scheduleEntry
+}
+
+// PolicyState is the state of a policy reported in the runtime state.
+type PolicyState struct {
+	Policy string    `json:"policy"`
+	Active bool      `json:"active"`
+	Since  time.Time `json:"since"`
+	Error  string    `json:"error,omitempty"`
+}
+
+var policies []*policyEntry
+
+var policyState = struct {
+	sync.Mutex
+	states []PolicyState
+	// the applied actions
+	mode    string
+	selects map[string]string
+	bypass  []netip.Prefix
+	udp     bool
+	// the selections of the groups before a policy changed them
+	previous map[string]string
+}{selects: map[string]string{}, previous: map[string]string{}}
+
+// newPolicyEnv declares the facts the policies can test:
+//
+//	now, hour, minute, weekday(0 is sunday)   the local time
+//	hostname, ha                              the host name, the --ha state
+//	between("01:00", "06:00")                 the local time is in the range
+//	iface_up("pppoe0")                        the interface is up and running
+//	iface_addrs("pppoe0")                     the cidrs of the interface
+//	file_exists("/run/vpn.up")                the file exists
+func newPolicyEnv() (*cel.Env, error) {
+	str := func(fn func(string) ref.Val) cel.OverloadOpt {
+		return cel.UnaryBinding(func(v ref.Val) ref.Val {
+			s, ok := v.Value().(string)
+			if !ok {
+				return types.NewErr("string argument required, got %s", v.Type())
+			}
+			return fn(s)
+		})
+	}
+	return cel.NewEnv(
+		cel.Variable("now", cel.TimestampType),
+		cel.Variable("hour", cel.IntType),
+		cel.Variable("minute", cel.IntType),
+		cel.Variable("weekday", cel.IntType),
+		cel.Variable("hostname", cel.StringType),
+		cel.Variable("ha", cel.StringType),
+		// between(from, to) tests the now fact, not the clock at the evaluation
+		cel.Macros(cel.NewGlobalMacro("between", 2, func(eh cel.MacroExprHelper, _ *exprpb.Expr, args []*exprpb.Expr) (*exprpb.Expr, *common.Error) {
+			return eh.GlobalCall("between_at", eh.Ident("now"), args[0], args[1]), nil
+		})),
+		cel.Function("between_at",
+			cel.Overload("between_at_timestamp_string_string", []*cel.Type{cel.TimestampType, cel.StringType, cel.StringType}, cel.BoolType,
+				cel.FunctionBinding(func(args ...ref.Val) ref.Val {
+					now, ok := args[0].Value().(time.Time)
+					if !ok {
+						return types.NewErr("between: timestamp required, got %s", args[0].Type())
+					}
+					in, err := betweenClock(now.Local(), fmt.Sprint(args[1].Value()), fmt.Sprint(args[2].Value()))
+					if err != nil {
+						return types.NewErr("between: %v", err)
+					}
+					return types.Bool(in)
+				}))),
+		cel.Function("iface_up",
+			cel.Overload("iface_up_string", []*cel.Type{cel.StringType}, cel.BoolType,
+				str(func(name string) ref.Val {
+					iface, err := net.InterfaceByName(name)
+					return types.Bool(err == nil && iface.Flags&(net.FlagUp|net.FlagRunning) == net.FlagUp|net.FlagRunning)
+				}))),
+		cel.Function("iface_addrs",
+			cel.Overload("iface_addrs_string", []*cel.Type{cel.StringType}, cel.ListType(cel.StringType),
+				str(func(name string) ref.Val {
+					var cidrs []string
+					if iface, err := net.InterfaceByName(name); err == nil {
+						addrs, _ := iface.Addrs()
+						for _, a := range addrs {
+							cidrs = append(cidrs, a.String())
+						}
+					}
+					return types.NewStringList(types.DefaultTypeAdapter, cidrs)
+				}))),
+		cel.Function("file_exists",
+			cel.Overload("file_exists_string", []*cel.Type{cel.StringType}, cel.BoolType,
+				str(func(path string) ref.Val {
+					_, err := os.Stat(path)
+					return types.Bool(err == nil)
+				}))),
+	)
+}
+
+// betweenClock reports whether the clock of t is in [from, to), the range
+// wraps around midnight when to is before from.
+func betweenClock(t time.Time, from, to string) (bool, error) {
+	minutes := func(s string) (int, error) {
+		c, err := time.Parse("15:04", s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %q, must be HH:MM", s)
+		}
+		return c.Hour()*60 + c.Minute(), nil
+	}
+	f, err := minutes(from)
+	if err != nil {
+		return false, err
+	}
+	e, err := minutes(to)
+	if err != nil {
+		return false, err
+	}
+	m := t.Hour()*60 + t.Minute()
+	if f <= e {
+		return f <= m && m < e, nil
+	}
+	return m >= f || m < e, nil
+}
+
+// policyFacts returns the variables of the policies at t.
+func policyFacts(t time.Time) map[string]any {
+	hostname, _ := os.Hostname()
+	ha := ""
+	if conf.HA {
+		haState.Lock()
+		ha = haState.state
+		haState.Unlock()
+		if ha == "" {
+			// not the running tpclash
+			ha = readHAState()
+		}
+	}
+	return map[string]any{
+		"now":      t,
+		"hour":     int64(t.Hour()),
+		"minute":   int64(t.Minute()),
+		"weekday":  int64(t.Weekday()),
+		"hostname": hostname,
+		"ha":       ha,
+	}
+}
+
+// parsePolicy parses "EXPR => ACTION ARGS", the actions are those of the
+// schedules except intercept, the sources are intercepted again once the
+// policy no longer matches, and:
+//
+//	udp off
+func parsePolicy(env *cel.Env, s string) (*policyEntry, error) {
+	i := strings.LastIndex(s, "=>")
+	if i < 0 {
+		return nil, errors.New("a policy must be EXPR => ACTION")
+	}
+	p := &policyEntry{Raw: s, Expr: strings.TrimSpace(s[:i]), scheduleEntry: &scheduleEntry{Raw: s}}
+	var rest string
+	p.Action, rest = cutField(s[i+2:])
+	switch p.Action {
+	case PolicyUDP:
+		if rest != "off" {
+			return nil, errors.New("udp requires off")
+		}
+	case ScheduleIntercept:
+		return nil, errors.New("intercept is not a policy action, the bypassed sources are intercepted once the policy no longer matches")
+	default:
+		if err := parseScheduleAction(p.scheduleEntry, rest); err != nil {
+			return nil, err
+		}
+	}
+
+	ast, iss := env.Compile(p.Expr)
+	if err := iss.Err(); err != nil {
+		return nil, err
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("the expression must be a bool, got %s", ast.OutputType())
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	p.prg = prg
+	return p, nil
+}
+
+// Match evaluates the expression of the policy with the facts.
+func (p *policyEntry) Match(facts map[string]any) (bool, error) {
+	out, _, err := p.prg.Eval(facts)
+	if err != nil {
+		return false, err
+	}
+	matched, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("the expression returned %s", out.Type())
+	}
+	return matched, nil
+}
+
+// target returns the argument of the action for the logs.
+func (p *policyEntry) target() string {
+	switch p.Action {
+	case ScheduleMode:
+		return p.Mode
+	case ScheduleSelect:
+		return p.Group + "=" + p.Proxy
+	case PolicyUDP:
+		return "off"
+	}
+	var ss []string
+	for _, src := range p.Sources {
+		ss = append(ss, src.String())
+	}
+	return strings.Join(ss, ",")
+}
+
+// CheckPolicyConf parses the --policy entries and evaluates them once, so a
+// broken expression is reported at the start.
+func CheckPolicyConf() error {
+	policies = nil
+	if len(conf.Policies) == 0 {
+		return nil
+	}
+	env, err := newPolicyEnv()
+	if err != nil {
+		return fmt.Errorf("[policy] failed to create the policy environment: %w", err)
+	}
+	facts := policyFacts(time.Now())
+	for _, s := range conf.Policies {
+		p, err := parsePolicy(env, s)
+		if err != nil {
+			return fmt.Errorf("[policy] invalid policy %q: %w", s, err)
+		}
+		if (p.Action == ScheduleBypass || p.Action == PolicyUDP) && conf.K8sSidecar {
+			return fmt.Errorf("[policy] %s policies are not supported in the k8s sidecar mode", p.Action)
+		}
+		if _, err = p.Match(facts); err != nil {
+			return fmt.Errorf("[policy] invalid policy %q: %w", s, err)
+		}
+		policies = append(policies, p)
+	}
+	return nil
+}
+
+// RunPolicies evaluates the policies every policyInterval until ctx is done
+// and applies the actions of the matching ones, a later policy overrides an
+// earlier one of the same mode or group. The state before the actions is
+// restored once the policies no longer match.
+func RunPolicies(ctx context.Context) {
+	if len(policies) == 0 {
+		return
+	}
+	logrus.Infof("[policy] %d policies loaded", len(policies))
+	waitScheduleAPI(ctx)
+	for {
+		evaluatePolicies(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(policyInterval):
+		}
+	}
+}
+
+func evaluatePolicies(now time.Time) {
+	policyState.Lock()
+	defer policyState.Unlock()
+
+	if len(policyState.states) != len(policies) {
+		policyState.states = make([]PolicyState, len(policies))
+		for i, p := range policies {
+			policyState.states[i].Policy = p.Raw
+		}
+	}
+
+	var mode string
+	selects := map[string]string{}
+	bypass := map[netip.Prefix]bool{}
+	var udp bool
+	facts := policyFacts(now)
+	for i, p := range policies {
+		st := &policyState.states[i]
+		matched, err := p.Match(facts)
+		if err != nil {
+			if st.Error != err.Error() {
+				logrus.Errorf("[policy] failed to evaluate %q: %v", p.Raw, err)
+			}
+			st.Error = err.Error()
+		} else {
+			st.Error = ""
+		}
+		if matched != st.Active {
+			st.Active, st.Since = matched, now
+			if matched {
+				logrus.Infof("[policy] %q matches", p.Raw)
+			} else {
+				logrus.Infof("[policy] %q no longer matches", p.Raw)
+			}
+		}
+		if !matched {
+			continue
+		}
+		switch p.Action {
+		case ScheduleMode:
+			mode = p.Mode
+		case ScheduleSelect:
+			selects[p.Group] = p.Proxy
+		case ScheduleBypass:
+			for _, src := range p.Sources {
+				bypass[src] = true
+			}
+		case PolicyUDP:
+			udp = true
+		}
+	}
+
+	applyPolicyMode(mode)
+	applyPolicySelects(selects)
+	applyPolicyBypass(bypass)
+	applyPolicyUDP(udp)
+
+	states := slices.Clone(policyState.states)
+	UpdateState(func(s *RuntimeState) { s.Policies = states })
+}
+
+// policyAudit records an action of the policies, the applied state is kept
+// unchanged on errors so the action is retried on the next evaluation.
+func policyAudit(action, target string, err error) {
+	Audit(AuditSourcePolicy, "policy", "policy."+action, target, err)
+	if err != nil {
+		logrus.Errorf("[policy] failed to %s %s: %v", action, target, err)
+		return
+	}
+	logrus.Infof("[policy] %s %s", action, target)
+}
+
+func applyPolicyMode(mode string) {
+	if mode == policyState.mode {
+		return
+	}
+	target := mode
+	if target == "" {
+		// the scheduled mode or the mode of the config
+		scheduleState.Lock()
+		target = scheduleState.mode
+		scheduleState.Unlock()
+		if target == "" {
+			cc, err := RunningConf()
+			if err != nil {
+				policyAudit(ScheduleMode, "restore", err)
+				return
+			}
+			target = strings.ToLower(cc.Mode)
+		}
+		if target == "" {
+			target = "rule"
+		}
+	}
+	err := patchMode(target)
+	policyAudit(ScheduleMode, target, err)
+	if err == nil {
+		policyState.mode = mode
+	}
+}
+
+func applyPolicySelects(selects map[string]string) {
+	for _, group := range sortedKeys(selects) {
+		proxy := selects[group]
+		if policyState.selects[group] == proxy {
+			continue
+		}
+		if _, ok := policyState.previous[group]; !ok {
+			prev, err := selectedProxy(group)
+			if err != nil {
+				policyAudit(ScheduleSelect, group+"="+proxy, err)
+				continue
+			}
+			policyState.previous[group] = prev
+		}
+		err := selectScheduledProxy(group, proxy)
+		policyAudit(ScheduleSelect, group+"="+proxy, err)
+		if err == nil {
+			policyState.selects[group] = proxy
+		}
+	}
+	for _, group := range sortedKeys(policyState.selects) {
+		if _, ok := selects[group]; ok {
+			continue
+		}
+		// the scheduled selection takes precedence
+		scheduleState.Lock()
+		prev, ok := scheduleState.selects[group]
+		scheduleState.Unlock()
+		if !ok {
+			prev = policyState.previous[group]
+		}
+		var err error
+		if prev != "" {
+			err = selectScheduledProxy(group, prev)
+			policyAudit(ScheduleSelect, group+"="+prev, err)
+		}
+		if err == nil {
+			delete(policyState.selects, group)
+			delete(policyState.previous, group)
+		}
+	}
+}
+
+// selectedProxy returns the proxy selected in the group.
+func selectedProxy(group string) (string, error) {
+	api, err := RunningAPI()
+	if err != nil {
+		return "", err
+	}
+	var p struct {
+		Now string `json:"now"`
+	}
+	if err = api.Do(http.MethodGet, "/proxies/"+url.PathEscape(group), nil, &p); err != nil {
+		return "", err
+	}
+	return p.Now, nil
+}
+
+func applyPolicyBypass(bypass map[netip.Prefix]bool) {
+	var prefixes []netip.Prefix
+	for p := range bypass {
+		prefixes = append(prefixes, p)
+	}
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int { return a.Addr().Compare(b.Addr()) })
+	if slices.Equal(prefixes, policyState.bypass) {
+		return
+	}
+	ss := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		ss = append(ss, p.String())
+	}
+	err := SetBypassSources(bypassOwnerPolicy, prefixes)
+	policyAudit(ScheduleBypass, "["+strings.Join(ss, ",")+"]", err)
+	if err == nil {
+		policyState.bypass = prefixes
+	}
+}
+
+func applyPolicyUDP(udp bool) {
+	if udp == policyState.udp {
+		return
+	}
+	// the fake ips are kept, their udp only works through clash
+	keep := netip.MustParsePrefix(enforceFakeIPRange).Masked()
+	if cc, err := RunningConf(); err == nil {
+		if p, err := netip.ParsePrefix(cc.DNS.FakeIPRange); err == nil {
+			keep = p.Masked()
+		}
+	}
+	target := "on"
+	if udp {
+		target = "off"
+	}
+	err := SetUDPBypass(udp, []netip.Prefix{keep})
+	policyAudit(PolicyUDP, target, err)
+	if err == nil {
+		policyState.udp = udp
+	}
+}
+
+// ReapplyPolicies restores the mode and the proxy selections of the matching
+// policies after the core loaded a config, the rules keep the others.
+func ReapplyPolicies() {
+	policyState.Lock()
+	defer policyState.Unlock()
+
+	if policyState.mode != "" {
+		if err := patchMode(policyState.mode); err != nil {
+			logrus.Errorf("[policy] failed to restore %s mode: %v", policyState.mode, err)
+		}
+	}
+	for _, group := range sortedKeys(policyState.selects) {
+		if err := selectScheduledProxy(group, policyState.selects[group]); err != nil {
+			logrus.Errorf("[policy] failed to restore the selection of %s: %v", group, err)
+		}
+	}
+}
+
+var policyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Show the policies of --policy and whether they match now",
+	Long: `Show the policies of --policy and whether they match now.
+
+A policy is "EXPR => ACTION", the action is applied while the CEL expression is
+true and undone once it is false, the policies are evaluated every 15s. The
+expressions can use:
+
+  now, hour, minute, weekday   the local time, weekday 0 is sunday
+  hostname, ha                 the host name, the --ha state(MASTER|BACKUP|FAULT)
+  between("01:00", "06:00")    the local time is in the range(may wrap midnight)
+  iface_up("pppoe0")           the interface is up and running
+  iface_addrs("pppoe0")        the cidrs of the interface
+  file_exists("/run/vpn.up")   the file exists
+
+The actions are:
+
+  mode rule|global|direct      switch the mode of the core
+  bypass IP|CIDR[,...]         stop intercepting the sources, they go direct
+  select GROUP=PROXY           select the proxy of a selector group
+  udp off                      stop intercepting the udp traffic to the real ips,
+                               the DNS and the udp to the fake ips(most of the
+                               udp of the fake-ip clients) still go to the core
+
+A later policy overrides an earlier one of the same mode or group, e.g.:
+
+  --policy '!iface_up("pppoe0") => mode direct'
+  --policy 'between("01:00", "06:00") => udp off'`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := CheckPolicyConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if len(policies) == 0 {
+			logrus.Fatal("[policy] no --policy is specified")
+		}
+
+		type policyInfo struct {
+			Policy  string `json:"policy"`
+			Matched bool   `json:"matched"`
+			Error   string `json:"error,omitempty"`
+		}
+		facts := policyFacts(time.Now())
+		var infos []policyInfo
+		for _, p := range policies {
+			info := policyInfo{Policy: p.Raw}
+			var err error
+			if info.Matched, err = p.Match(facts); err != nil {
+				info.Error = err.Error()
+			}
+			infos = append(infos, info)
+		}
+		if jsonOutput() {
+			printJSON(infos)
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "MATCH\tPOLICY")
+		for _, info := range infos {
+			match := "no"
+			switch {
+			case info.Error != "":
+				match = "error: " + info.Error
+			case info.Matched:
+				match = "yes"
+			}
+			_, _ = fmt.Fprintf(w, "%s\t%s\n", match, info.Policy)
+		}
+		_ = w.Flush()
+	},
+}
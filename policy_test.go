@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParsePolicy(t *testing.T) {
+	env, err := newPolicyEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		policy  string
+		want    policyEntry
+		sources []netip.Prefix
+		wantErr bool
+	}{
+		{
+			name:   "mode",
+			policy: `hour >= 23 => mode direct`,
+			want:   policyEntry{Expr: "hour >= 23", scheduleEntry: &scheduleEntry{Action: ScheduleMode, Mode: "direct"}},
+		},
+		{
+			name:    "bypass",
+			policy:  `between("01:00", "06:00") => bypass 192.168.1.10, 192.168.2.0/24`,
+			want:    policyEntry{Expr: `between("01:00", "06:00")`, scheduleEntry: &scheduleEntry{Action: ScheduleBypass}},
+			sources: prefixes("192.168.1.10/32", "192.168.2.0/24"),
+		},
+		{
+			name:   "select with spaces",
+			policy: `ha == "MASTER" => select Proxy Group = HK 01`,
+			want:   policyEntry{Expr: `ha == "MASTER"`, scheduleEntry: &scheduleEntry{Action: ScheduleSelect, Group: "Proxy Group", Proxy: "HK 01"}},
+		},
+		{
+			name:   "udp",
+			policy: `weekday == 0 => udp off`,
+			want:   policyEntry{Expr: "weekday == 0", scheduleEntry: &scheduleEntry{Action: PolicyUDP}},
+		},
+		{
+			name:   "arrow in the expression",
+			policy: `hostname == "a=>b" => mode global`,
+			want:   policyEntry{Expr: `hostname == "a=>b"`, scheduleEntry: &scheduleEntry{Action: ScheduleMode, Mode: "global"}},
+		},
+		{name: "no action", policy: `hour >= 23`, wantErr: true},
+		{name: "intercept", policy: `hour >= 23 => intercept 192.168.1.10`, wantErr: true},
+		{name: "udp on", policy: `hour >= 23 => udp on`, wantErr: true},
+		{name: "unknown action", policy: `hour >= 23 => reboot`, wantErr: true},
+		{name: "invalid mode", policy: `hour >= 23 => mode fast`, wantErr: true},
+		{name: "ipv6 source", policy: `hour >= 23 => bypass fd00::1`, wantErr: true},
+		{name: "select without proxy", policy: `hour >= 23 => select Proxy`, wantErr: true},
+		{name: "not a bool", policy: `hour + 1 => mode direct`, wantErr: true},
+		{name: "syntax error", policy: `hour >= => mode direct`, wantErr: true},
+		{name: "unknown variable", policy: `uptime > 10 => mode direct`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parsePolicy(env, tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePolicy(%q) error = %v, wantErr %v", tt.policy, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if p.Expr != tt.want.Expr || p.Action != tt.want.Action || p.Mode != tt.want.Mode ||
+				p.Group != tt.want.Group || p.Proxy != tt.want.Proxy || !slices.Equal(p.Sources, tt.sources) {
+				t.Fatalf("parsePolicy(%q) = %+v %+v, want %+v %+v", tt.policy, p, p.scheduleEntry, tt.want, tt.want.scheduleEntry)
+			}
+		})
+	}
+}
+
+func TestPolicyMatch(t *testing.T) {
+	env, err := newPolicyEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a saturday
+	now := time.Date(2024, 3, 9, 23, 30, 0, 0, time.Local)
+	facts := map[string]any{
+		"now":      now,
+		"hour":     int64(now.Hour()),
+		"minute":   int64(now.Minute()),
+		"weekday":  int64(now.Weekday()),
+		"hostname": "router",
+		"ha":       HAMaster,
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{expr: `hour >= 23`, want: true},
+		{expr: `hour < 23`, want: false},
+		{expr: `weekday == 6 && minute == 30`, want: true},
+		{expr: `between("23:00", "06:00")`, want: true},
+		{expr: `between("01:00", "06:00")`, want: false},
+		{expr: `between("23:30", "23:31")`, want: true},
+		{expr: `between("22:00", "23:30")`, want: false},
+		{expr: `hostname == "router" && ha == "MASTER"`, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			p, err := parsePolicy(env, tt.expr+" => mode direct")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.Match(facts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// configPreset is a curated overlay of --preset.
+type configPreset struct {
+	Description string
+	// Overlay is merged into the config, the mappings are merged key by key
+	// and the other values are replaced
+	Overlay string
+	// Defaults are merged like Overlay but only add the missing keys
+	Defaults string
+	// Prepend adds the values to the front of the sequences of the dotted
+	// keys, the values already present are moved there
+	Prepend map[string][]string
+	// Mihomo is set when the preset uses fields only mihomo supports
+	Mihomo bool
+}
+
+var configPresets = map[string]configPreset{
+	"enable-tun": {
+		Description: "enable the tun with the system stack, auto-route and the dns hijacking",
+		Overlay:     tunStandardPatch,
+	},
+	"force-fakeip": {
+		Description: "resolve with the fake-ip mode, the local names, ntp and connectivity checks get real ips",
+		Overlay: `dns:
+  enable: true
+  enhanced-mode: fake-ip
+`,
+		Defaults: `dns:
+  listen: ` + enforceDNSListen + `
+  fake-ip-range: ` + enforceFakeIPRange + `
+`,
+		Prepend: map[string][]string{
+			"dns.fake-ip-filter": {"*.lan", "*.local", "+.msftconnecttest.com", "+.msftncsi.com", "time.*.com", "ntp.*.com", "+.pool.ntp.org", "+.stun.*.*"},
+		},
+	},
+	"lan-bypass": {
+		Description: "send the private, link-local and multicast destinations and the local names direct",
+		Prepend: map[string][]string{
+			"rules": {
+				"DOMAIN-SUFFIX,lan,DIRECT",
+				"DOMAIN-SUFFIX,local,DIRECT",
+				"IP-CIDR,127.0.0.0/8,DIRECT,no-resolve",
+				"IP-CIDR,10.0.0.0/8,DIRECT,no-resolve",
+				"IP-CIDR,172.16.0.0/12,DIRECT,no-resolve",
+				"IP-CIDR,192.168.0.0/16,DIRECT,no-resolve",
+				"IP-CIDR,100.64.0.0/10,DIRECT,no-resolve",
+				"IP-CIDR,169.254.0.0/16,DIRECT,no-resolve",
+				"IP-CIDR,224.0.0.0/4,DIRECT,no-resolve",
+				"IP-CIDR6,fe80::/10,DIRECT,no-resolve",
+				"IP-CIDR6,fc00::/7,DIRECT,no-resolve",
+			},
+			"dns.fake-ip-filter": {"*.lan", "*.local"},
+		},
+	},
+	"meta-sniffing": {
+		Description: "sniff the http, tls and quic domains of the connections to ips(mihomo only)",
+		Overlay: `sniffer:
+  enable: true
+  force-dns-mapping: true
+  parse-pure-ip: true
+  sniff:
+    HTTP:
+      ports: [80, 8080-8880]
+      override-destination: true
+    TLS:
+      ports: [443, 8443]
+    QUIC:
+      ports: [443, 8443]
+  skip-domain:
+    - Mijia Cloud
+    - +.push.apple.com
+`,
+		Mihomo: true,
+	},
+}
+
+// applyPresets applies the --preset overlays in order, the config is left
+// unchanged if one of them fails.
+func applyPresets(doc *yaml.Node) bool {
+	if len(conf.Presets) == 0 {
+		return false
+	}
+
+	if len(doc.Content) == 0 {
+		*doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	if yamlRoot(doc) == nil {
+		logrus.Error("[preset] the config is not a mapping")
+		return false
+	}
+
+	root := cloneYAMLNode(doc.Content[0])
+	for _, name := range conf.Presets {
+		if err := applyPreset(root, configPresets[name]); err != nil {
+			logrus.Errorf("[preset] failed to apply %s: %v", name, err)
+			return false
+		}
+		logrus.Debugf("[preset] %s applied", name)
+	}
+	doc.Content[0] = root
+	return true
+}
+
+// cloneYAMLNode returns a deep copy of the node, the aliases still point to
+// the anchors of the original.
+func cloneYAMLNode(n *yaml.Node) *yaml.Node {
+	c := *n
+	c.Content = make([]*yaml.Node, len(n.Content))
+	for i, child := range n.Content {
+		c.Content[i] = cloneYAMLNode(child)
+	}
+	return &c
+}
+
+func applyPreset(root *yaml.Node, p configPreset) error {
+	for _, overlay := range []struct {
+		src     string
+		replace bool
+	}{{p.Overlay, true}, {p.Defaults, false}} {
+		if overlay.src == "" {
+			continue
+		}
+		var n yaml.Node
+		if err := yaml.Unmarshal([]byte(overlay.src), &n); err != nil {
+			return err
+		}
+		mergeYAMLMapping(root, n.Content[0], overlay.replace)
+	}
+	for _, key := range sortedKeys(p.Prepend) {
+		if err := prependYAMLSequence(root, key, p.Prepend[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeYAMLMapping merges the src mapping into dst, the keys of dst are
+// replaced unless they are both mappings.
+func mergeYAMLMapping(dst, src *yaml.Node, replace bool) {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		k, v := src.Content[i], src.Content[i+1]
+		_, cur := yamlMapGet(dst, k.Value)
+		switch {
+		case cur == nil:
+			dst.Content = append(dst.Content, k, v)
+		case cur.Kind == yaml.MappingNode && v.Kind == yaml.MappingNode:
+			mergeYAMLMapping(cur, v, replace)
+		case replace:
+			*cur = *v
+		}
+	}
+}
+
+// prependYAMLSequence moves the values to the front of the sequence of the
+// dotted key, the missing mappings and the sequence are created.
+func prependYAMLSequence(root *yaml.Node, key string, values []string) error {
+	n := root
+	for _, k := range strings.Split(key, ".") {
+		if n.Kind != yaml.MappingNode {
+			return fmt.Errorf("the parent of %s is not a mapping", key)
+		}
+		_, v := yamlMapGet(n, k)
+		if v == nil || v.Tag == "!!null" {
+			if v == nil {
+				v = &yaml.Node{}
+				n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: k}, v)
+			}
+			*v = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		n = v
+	}
+	if n.Kind == yaml.MappingNode && len(n.Content) == 0 {
+		*n = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	}
+	if n.Kind != yaml.SequenceNode {
+		return fmt.Errorf("%s is not a sequence", key)
+	}
+
+	prepended := map[string]bool{}
+	var items []*yaml.Node
+	for _, v := range values {
+		prepended[v] = true
+		items = append(items, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v})
+	}
+	for _, item := range n.Content {
+		if item.Kind != yaml.ScalarNode || !prepended[item.Value] {
+			items = append(items, item)
+		}
+	}
+	n.Content = items
+	return nil
+}
+
+// CheckPresetConf validates the --preset names against the core.
+func CheckPresetConf() error {
+	if len(conf.Presets) == 0 {
+		return nil
+	}
+	if CoreFlavor() == CoreSingBox {
+		return errors.New("[preset] --preset is not supported by sing-box")
+	}
+	for _, name := range conf.Presets {
+		p, ok := configPresets[name]
+		if !ok {
+			return fmt.Errorf("[preset] unknown preset %q, must be one of %s", name, strings.Join(sortedKeys(configPresets), ", "))
+		}
+		if p.Mihomo && CoreFlavor() != CoreMihomo {
+			return fmt.Errorf("[preset] %s requires the mihomo core(--core mihomo)", name)
+		}
+	}
+	return nil
+}
+
+var presetCmd = &cobra.Command{
+	Use:   "preset [NAME...]",
+	Short: "List the config presets of --preset, or print the patches of the named ones",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 0 {
+			conf.Presets = args
+			if err := CheckPresetConf(); err != nil {
+				logrus.Fatal(err)
+			}
+			c, err := patchYAML("", lenientPatch(applyPresets))
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			fmt.Print(c)
+			return
+		}
+
+		enabled := map[string]bool{}
+		for _, name := range conf.Presets {
+			enabled[name] = true
+		}
+		type presetInfo struct {
+			Name        string `json:"name"`
+			Enabled     bool   `json:"enabled"`
+			Description string `json:"description"`
+		}
+		var infos []presetInfo
+		for _, name := range sortedKeys(configPresets) {
+			infos = append(infos, presetInfo{Name: name, Enabled: enabled[name], Description: configPresets[name].Description})
+		}
+		if jsonOutput() {
+			printJSON(infos)
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "PRESET\tENABLED\tDESCRIPTION")
+		for _, info := range infos {
+			_, _ = fmt.Fprintf(w, "%s\t%v\t%s\n", info.Name, info.Enabled, info.Description)
+		}
+		_ = w.Flush()
+	},
+}
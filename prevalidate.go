@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// preValidateTimeout bounds the whole pre-validation, the core must be
+	// listening within it
+	preValidateTimeout = 20 * time.Second
+	// preValidateOutputLimit is the size of the core output kept for the error
+	preValidateOutputLimit = 16 << 10
+)
+
+// coreValidator is implemented by the cores which can run a config in a
+// throwaway instance before it replaces the live one(--pre-validate).
+type coreValidator interface {
+	Core
+	// TestArgs returns the arguments validating the config and exiting
+	TestArgs(confPath, home string) []string
+	// RunArgs returns the arguments running the config with another home dir
+	RunArgs(confPath, home string) []string
+	// Isolate rewrites the config to listen on unused loopback ports only,
+	// without the tun device and the other system changes
+	Isolate(c string, ports *portAllocator) (*isolatedConfig, error)
+}
+
+// isolatedConfig is a config rewritten for the throwaway instance.
+type isolatedConfig struct {
+	config     string
+	controller string
+	secret     string
+	// listeners are the tcp addresses of the inbounds
+	listeners []string
+	// dns is the udp address of the dns server, optional
+	dns string
+}
+
+// portAllocator hands out unused loopback ports, the ports are held until
+// release so that they are all different.
+type portAllocator struct {
+	held []io.Closer
+}
+
+func (a *portAllocator) next(network string) (string, error) {
+	if network == "udp" {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return "", err
+		}
+		a.held = append(a.held, pc)
+		return pc.LocalAddr().String(), nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	a.held = append(a.held, l)
+	return l.Addr().String(), nil
+}
+
+func (a *portAllocator) release() {
+	for _, c := range a.held {
+		_ = c.Close()
+	}
+	a.held = nil
+}
+
+// preValidate runs the config in a throwaway core on loopback ports: the core
+// must accept it(-t) and then serve the api, the inbounds and the dns.
+func preValidate(ccStr string) error {
+	v, ok := core.(coreValidator)
+	if !ok {
+		logrus.Warnf("[config] pre-validation is not supported by %s core, skip...", core.Name())
+		return nil
+	}
+	bin, err := coreBinary()
+	if err != nil {
+		return err
+	}
+
+	home, err := preValidateHome()
+	if err != nil {
+		return fmt.Errorf("[config] failed to create the pre-validation home: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(home) }()
+
+	var ports portAllocator
+	iso, err := v.Isolate(ccStr, &ports)
+	ports.release()
+	if err != nil {
+		return err
+	}
+	confPath := filepath.Join(home, core.ConfigName())
+	if err = os.WriteFile(confPath, []byte(iso.config), 0600); err != nil {
+		return fmt.Errorf("[config] failed to write the pre-validation config: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), preValidateTimeout)
+	defer cancel()
+
+	logrus.Info("[config] pre-validating the new config...")
+	out, err := ChildOutput(exec.CommandContext(ctx, bin, v.TestArgs(confPath, home)...))
+	if err != nil {
+		return fmt.Errorf("[config] the new config is rejected by the core: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	var output cappedBuffer
+	cmd := exec.CommandContext(ctx, bin, v.RunArgs(confPath, home)...)
+	cmd.Env = append(append(os.Environ(), coreMemoryEnv()...), conf.ClashEnv...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		AmbientCaps: []uintptr{CAP_NET_BIND_SERVICE, CAP_NET_ADMIN, CAP_NET_RAW},
+	}
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = 3 * time.Second
+	if err = StartChild(cmd); err != nil {
+		return fmt.Errorf("[config] failed to start the pre-validation core: %w", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = WaitChild(cmd)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if err = smokeTest(ctx, iso, done); err != nil {
+		return fmt.Errorf("[config] the new config failed the smoke test: %w\n%s", err, bytes.TrimSpace(output.Bytes()))
+	}
+	logrus.Info("[config] the new config passed the pre-validation")
+	return nil
+}
+
+// preValidateHome creates a home dir for the throwaway core with a copy of the
+// clash home(geo databases, providers, rule sets...), the core may write to
+// its home and must not touch the files of the live one. The cache locked by
+// the running core and the runtime files are left out.
+func preValidateHome() (string, error) {
+	home, err := os.MkdirTemp("", "tpclash-pre-validate-")
+	if err != nil {
+		return "", err
+	}
+	err = filepath.WalkDir(conf.ClashHome, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(conf.ClashHome, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		switch rel {
+		case "cache.db", InternalConfigName, InternalSingBoxConfigName, "run", handoffHomeDir:
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		dst := filepath.Join(home, rel)
+		switch {
+		case d.IsDir():
+			return os.Mkdir(dst, 0700)
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, dst)
+		case d.Type().IsRegular():
+			return copyFile(path, dst)
+		}
+		// sockets and the other special files
+		return nil
+	})
+	return home, err
+}
+
+// copyFile copies the regular file src to dst with its mode.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// smokeTest waits for the api of the throwaway core and then connects to its
+// inbounds and queries its dns server.
+func smokeTest(ctx context.Context, iso *isolatedConfig, exited chan struct{}) error {
+	cli := &http.Client{Timeout: time.Second}
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+iso.controller+"/version", nil)
+		if err != nil {
+			return err
+		}
+		if iso.secret != "" {
+			req.Header.Set("Authorization", "Bearer "+iso.secret)
+		}
+		resp, err := cli.Do(req)
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+			err = fmt.Errorf("status code %d", resp.StatusCode)
+		}
+
+		select {
+		case <-exited:
+			return errors.New("the core exited")
+		case <-ctx.Done():
+			return fmt.Errorf("the clash api is not ready in %s: %w", preValidateTimeout, err)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+
+	d := net.Dialer{Timeout: time.Second}
+	for _, addr := range iso.listeners {
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return fmt.Errorf("the inbound %s is not listening: %w", addr, err)
+		}
+		_ = conn.Close()
+	}
+
+	if iso.dns != "" {
+		r := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return d.DialContext(ctx, "udp", iso.dns)
+			},
+		}
+		lctx, lcancel := context.WithTimeout(ctx, 3*time.Second)
+		defer lcancel()
+		// any answer, also NXDOMAIN, proves that the dns server works
+		var dnsErr *net.DNSError
+		if _, err := r.LookupHost(lctx, "www.example.com"); err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+			return fmt.Errorf("the dns server %s does not answer: %w", iso.dns, err)
+		}
+	}
+	return nil
+}
+
+// cappedBuffer keeps the first preValidateOutputLimit bytes of the output.
+type cappedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if n := preValidateOutputLimit - b.Len(); n > 0 {
+		b.Buffer.Write(p[:min(n, len(p))])
+	}
+	return len(p), nil
+}
+
+func (c *clashCore) TestArgs(confPath, home string) []string {
+	return []string{"-t", "-f", confPath, "-d", home}
+}
+
+func (c *clashCore) RunArgs(confPath, home string) []string {
+	return []string{"-f", confPath, "-d", home}
+}
+
+// Isolate moves the ports, the mihomo listeners, the dns and the api to the
+// loopback and disables the tun, eBPF and the other system integrations.
+func (c *clashCore) Isolate(s string, ports *portAllocator) (*isolatedConfig, error) {
+	var root map[string]any
+	if err := decodeYAML(s, &root); err != nil {
+		return nil, fmt.Errorf("[config] failed to unmarshal clash config: %w", err)
+	}
+	for _, k := range []string{"tun", "auto-redir", "iptables"} {
+		if m, ok := root[k].(map[string]any); ok {
+			m["enable"] = false
+		}
+	}
+	delete(root, "ebpf")
+	return stageClashConfig(root, ports)
+}
+
+// stageClashConfig moves the ports, the mihomo listeners(the tun listeners are
+// dropped), the dns and the api of the config to unused loopback ports, so that
+// it can run beside the live core.
+func stageClashConfig(root map[string]any, ports *portAllocator) (*isolatedConfig, error) {
+	iso := &isolatedConfig{}
+
+	root["allow-lan"] = false
+	for _, k := range []string{"port", "socks-port", "mixed-port", "redir-port", "tproxy-port"} {
+		if portValue(root[k]) == 0 {
+			continue
+		}
+		addr, err := ports.next("tcp")
+		if err != nil {
+			return nil, err
+		}
+		root[k] = portValue(addr)
+		iso.listeners = append(iso.listeners, addr)
+	}
+
+	if listeners, ok := root["listeners"].([]any); ok {
+		var kept []any
+		for _, l := range listeners {
+			m, ok := l.(map[string]any)
+			if !ok || m["type"] == "tun" {
+				continue
+			}
+			addr, err := ports.next("tcp")
+			if err != nil {
+				return nil, err
+			}
+			m["listen"] = "127.0.0.1"
+			m["port"] = portValue(addr)
+			iso.listeners = append(iso.listeners, addr)
+			kept = append(kept, m)
+		}
+		root["listeners"] = kept
+	}
+
+	for _, k := range []string{"external-ui", "external-controller-tls", "external-controller-unix", "external-controller-pipe"} {
+		delete(root, k)
+	}
+	addr, err := ports.next("tcp")
+	if err != nil {
+		return nil, err
+	}
+	root["external-controller"] = addr
+	iso.controller = addr
+	iso.secret, _ = root["secret"].(string)
+
+	if dns, ok := root["dns"].(map[string]any); ok && dns["enable"] == true {
+		addr, err := ports.next("udp")
+		if err != nil {
+			return nil, err
+		}
+		dns["listen"] = addr
+		iso.dns = addr
+	}
+
+	bs, err := yaml.Marshal(root)
+	if err != nil {
+		return nil, fmt.Errorf("[config] failed to marshal yaml config: %w", err)
+	}
+	iso.config = string(bs)
+	return iso, nil
+}
+
+func (c *singBoxCore) TestArgs(confPath, home string) []string {
+	return []string{"check", "-c", confPath, "-D", home}
+}
+
+func (c *singBoxCore) RunArgs(confPath, home string) []string {
+	return []string{"run", "-c", confPath, "-D", home}
+}
+
+// Isolate drops the tun inbound and moves the other inbounds and the clash
+// api to the loopback, the dns is served by one of the inbounds.
+func (c *singBoxCore) Isolate(s string, ports *portAllocator) (*isolatedConfig, error) {
+	var root map[string]any
+	if err := json.Unmarshal([]byte(s), &root); err != nil {
+		return nil, fmt.Errorf("[config] failed to unmarshal sing-box config: %w", err)
+	}
+	iso := &isolatedConfig{}
+
+	inbounds, _ := root["inbounds"].([]any)
+	var kept []any
+	for _, in := range inbounds {
+		m, ok := in.(map[string]any)
+		if !ok || m["type"] == "tun" {
+			continue
+		}
+		if _, ok = m["listen_port"]; ok {
+			network := "tcp"
+			if m["network"] == "udp" {
+				network = "udp"
+			}
+			addr, err := ports.next(network)
+			if err != nil {
+				return nil, err
+			}
+			m["listen"] = "127.0.0.1"
+			m["listen_port"] = portValue(addr)
+			if network == "tcp" {
+				iso.listeners = append(iso.listeners, addr)
+			}
+		}
+		kept = append(kept, m)
+	}
+	root["inbounds"] = kept
+
+	experimental, _ := root["experimental"].(map[string]any)
+	clashAPI, _ := experimental["clash_api"].(map[string]any)
+	if clashAPI == nil {
+		return nil, errors.New("[config] clash api must be enabled(experimental.clash_api.external_controller)")
+	}
+	addr, err := ports.next("tcp")
+	if err != nil {
+		return nil, err
+	}
+	clashAPI["external_controller"] = addr
+	delete(clashAPI, "external_ui")
+	iso.controller = addr
+	iso.secret, _ = clashAPI["secret"].(string)
+	// an absolute cache file is locked by the running core
+	if cache, ok := experimental["cache_file"].(map[string]any); ok {
+		if p, _ := cache["path"].(string); filepath.IsAbs(p) {
+			cache["path"] = "cache.db"
+		}
+	}
+
+	bs, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("[config] failed to marshal sing-box config: %w", err)
+	}
+	iso.config = string(bs)
+	return iso, nil
+}
+
+// portValue returns the port of a config value(int or string) or of an
+// address, 0 if there is none.
+func portValue(v any) int {
+	switch p := v.(type) {
+	case int:
+		return p
+	case float64:
+		return int(p)
+	case string:
+		if _, port, err := net.SplitHostPort(p); err == nil {
+			p = port
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(p))
+		return n
+	}
+	return 0
+}
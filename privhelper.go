@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/lorenzosaino/go-sysctl"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// sysctlHelper is the root child setting the sysctls of tpclash after
+// --run-as dropped the privileges, the files of /proc/sys are writable by
+// root only whatever the capabilities. It only accepts the keys of sysctls
+// and sets them to the values of tpclash, one key per line.
+var sysctlHelper struct {
+	sync.Mutex
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+// startSysctlHelper starts the helper while tpclash is still root.
+func startSysctlHelper() error {
+	cmd := exec.Command("/proc/self/exe", "sysctl-helper")
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = StartChild(cmd); err != nil {
+		return fmt.Errorf("[privilege] failed to start the sysctl helper: %w", err)
+	}
+	sysctlHelper.cmd, sysctlHelper.in, sysctlHelper.out = cmd, in, bufio.NewReader(out)
+	return nil
+}
+
+// stopSysctlHelper stops the helper, it exits once its stdin is closed.
+func stopSysctlHelper() {
+	sysctlHelper.Lock()
+	defer sysctlHelper.Unlock()
+	if sysctlHelper.cmd == nil {
+		return
+	}
+	_ = sysctlHelper.in.Close()
+	_ = WaitChild(sysctlHelper.cmd)
+	sysctlHelper.cmd = nil
+}
+
+// setSysctl sets the sysctl key to the value of tpclash, by the helper once
+// the privileges are dropped.
+func setSysctl(key string) error {
+	i := sysctlIndex(key)
+	if i < 0 {
+		return fmt.Errorf("[helper/sysctl] %s is not managed by tpclash", key)
+	}
+
+	sysctlHelper.Lock()
+	defer sysctlHelper.Unlock()
+	if sysctlHelper.cmd == nil {
+		return sysctl.Set(key, sysctls[i][1])
+	}
+	if _, err := io.WriteString(sysctlHelper.in, key+"\n"); err != nil {
+		return fmt.Errorf("[helper/sysctl] the sysctl helper is gone: %w", err)
+	}
+	reply, err := sysctlHelper.out.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("[helper/sysctl] the sysctl helper is gone: %w", err)
+	}
+	if reply = strings.TrimSpace(reply); reply != "ok" {
+		return errors.New(reply)
+	}
+	return nil
+}
+
+// ReapplySysctl sets the sysctls of tpclash changed since the startup again,
+// e.g. the forwarding turned off by a network manager.
+func ReapplySysctl() error {
+	if conf.K8sSidecar {
+		return nil
+	}
+	var errs []error
+	for _, kv := range sysctls {
+		cur, err := sysctl.Get(kv[0])
+		if err == nil && cur == kv[1] {
+			continue
+		}
+		err = hostChange("sysctl", fmt.Sprintf("%s = %s(current: %s)", kv[0], kv[1], cur), func() error {
+			logrus.Warnf("[helper/sysctl] %s was changed, setting it to %s again", kv[0], kv[1])
+			return setSysctl(kv[0])
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("[helper/sysctl] failed to set %s: %w", kv[0], err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func sysctlIndex(key string) int {
+	for i, kv := range sysctls {
+		if kv[0] == key {
+			return i
+		}
+	}
+	return -1
+}
+
+var sysctlHelperCmd = &cobra.Command{
+	Use:    "sysctl-helper",
+	Short:  "Set the sysctls of tpclash for the unprivileged tpclash(internal)",
+	Hidden: true,
+	Args:   cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		in := bufio.NewScanner(os.Stdin)
+		for in.Scan() {
+			key := strings.TrimSpace(in.Text())
+			reply := "ok"
+			if i := sysctlIndex(key); i < 0 {
+				reply = fmt.Sprintf("%s is not managed by tpclash", key)
+			} else if err := sysctl.Set(key, sysctls[i][1]); err != nil {
+				reply = err.Error()
+			}
+			if _, err := fmt.Println(strings.ReplaceAll(reply, "\n", " ")); err != nil {
+				return
+			}
+		}
+	},
+}
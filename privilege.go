@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// retainedCaps are kept by tpclash after dropping privileges. CAP_NET_ADMIN
+// reapplies the nftables rules and the policy routes(bypass sources, dns
+// redirect, docker compatible) and the three are passed on to the core as
+// ambient capabilities, the same set the core runs with as root. The sysctls
+// need root, they are set by the sysctl helper.
+var retainedCaps = []uintptr{CAP_NET_BIND_SERVICE, CAP_NET_ADMIN, CAP_NET_RAW}
+
+// DropPrivileges switches tpclash to the --run-as user once the sysctl, the
+// embedded files and the first config are in place. Only the network
+// capabilities are retained, everything else(file access, mounts, ptrace,
+// module loading...) is given up for the lifetime of the process, which also
+// applies to the core restarted by it. The clash home is handed over to the
+// user, so the files written at runtime stay writable.
+func DropPrivileges() error {
+	if conf.RunAs == "" {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		return errors.New("[privilege] --run-as requires tpclash to be started as root")
+	}
+	if conf.K8sSidecar {
+		return errors.New("[privilege] --run-as is not supported in the k8s sidecar, use --proxy-uid instead")
+	}
+	if conf.AutoFixMode == "ebpf" {
+		return errors.New("[privilege] --run-as is not supported in the ebpf mode, loading ebpf programs requires root")
+	}
+
+	uid, gid, groups, err := lookupRunAs(conf.RunAs)
+	if err != nil {
+		return err
+	}
+	if uid == 0 {
+		return fmt.Errorf("[privilege] --run-as user %s is root", conf.RunAs)
+	}
+
+	if err = chownTree(conf.ClashHome, uid, gid); err != nil {
+		return fmt.Errorf("[privilege] failed to change owner of clash home: %w", err)
+	}
+	if err = startSysctlHelper(); err != nil {
+		return err
+	}
+
+	// the capabilities survive the uid change only with keepcaps, which is a
+	// per-thread attribute like the capabilities themselves
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0); errno != 0 {
+		if errno == syscall.ENOTSUP {
+			return errors.New("[privilege] --run-as requires tpclash to be built with CGO_ENABLED=0")
+		}
+		return fmt.Errorf("[privilege] failed to keep capabilities: %w", errno)
+	}
+	if err = syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("[privilege] failed to set groups: %w", err)
+	}
+	if err = syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("[privilege] failed to set gid: %w", err)
+	}
+	if err = syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("[privilege] failed to set uid: %w", err)
+	}
+
+	var mask uint32
+	for _, c := range retainedCaps {
+		mask |= 1 << c
+	}
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{{Effective: mask, Permitted: mask, Inheritable: mask}}
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("[privilege] failed to set capabilities: %w", errno)
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 0, 0); errno != 0 {
+		return fmt.Errorf("[privilege] failed to reset keepcaps: %w", errno)
+	}
+	// setuid binaries and file capabilities can not bring the privileges back
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		return fmt.Errorf("[privilege] failed to set no_new_privs: %w", errno)
+	}
+
+	logrus.Infof("[privilege] dropped privileges to %s(uid: %d, gid: %d)", conf.RunAs, uid, gid)
+	if !isRemoteConfig() && unix.Access(conf.ClashConfig, unix.R_OK) != nil {
+		logrus.Warnf("[privilege] config %s is not readable by %s, the changes will not be reloaded", conf.ClashConfig, conf.RunAs)
+	}
+	return nil
+}
+
+// lookupRunAs resolves the user name or uid and its groups.
+func lookupRunAs(name string) (uid, gid int, groups []int, err error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if _, nErr := strconv.Atoi(name); nErr != nil {
+			return 0, 0, nil, fmt.Errorf("[privilege] unknown user %s: %w", name, err)
+		}
+		if u, err = user.LookupId(name); err != nil {
+			return 0, 0, nil, fmt.Errorf("[privilege] unknown uid %s: %w", name, err)
+		}
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, nil, err
+	}
+	if gid, err = strconv.Atoi(u.Gid); err != nil {
+		return 0, 0, nil, err
+	}
+
+	// the supplementary groups grant e.g. the access to the docker socket
+	ids, err := u.GroupIds()
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("[privilege] failed to get groups of %s: %w", name, err)
+	}
+	for _, id := range ids {
+		if g, err := strconv.Atoi(id); err == nil {
+			groups = append(groups, g)
+		}
+	}
+	return uid, gid, groups, nil
+}
+
+// matchHomeOwner hands the file created by a subcommand running as root over
+// to the owner of the clash home, otherwise tpclash can not read it after
+// dropping privileges.
+func matchHomeOwner(path string) {
+	if os.Geteuid() != 0 {
+		return
+	}
+	info, err := os.Stat(conf.ClashHome)
+	if err != nil {
+		return
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Uid != 0 {
+		_ = os.Lchown(path, int(st.Uid), int(st.Gid))
+	}
+}
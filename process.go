@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const coreStopTimeout = 10 * time.Second
+
+// a crashed core is restarted after a backoff doubling from coreRestartBackoff
+// up to coreRestartMaxBackoff, it is reset once a core ran for coreStableTime
+const (
+	coreRestartBackoff    = time.Second
+	coreRestartMaxBackoff = 30 * time.Second
+	coreStableTime        = time.Minute
+)
+
+// CoreProcess supervises the core child process. The core can be restarted in
+// place(e.g. after upgrade-core) while the interception rules stay in effect.
+type CoreProcess struct {
+	mu       sync.Mutex
+	ctx      context.Context
+	confPath string
+	cmd      *exec.Cmd
+	done     chan struct{}
+	stopping bool
+	// alternate is set while the core runs in the alternate handoff slot
+	alternate bool
+	startedAt time.Time
+	backoff   time.Duration
+}
+
+func NewCoreProcess(ctx context.Context, confPath string) *CoreProcess {
+	return &CoreProcess{ctx: ctx, confPath: confPath}
+}
+
+// Process returns the running core process, it changes after a restart.
+func (p *CoreProcess) Process() *os.Process {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cmd == nil {
+		return nil
+	}
+	return p.cmd.Process
+}
+
+// Start runs the core, the executable is resolved again on every start so a
+// core upgraded in the meantime takes effect. The core specified by
+// --clash-bin is managed outside of tpclash and used as is.
+func (p *CoreProcess) Start() (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, span := startSpan(context.Background(), "core.start", attribute.String("tpclash.core", core.Name()))
+	defer func() { endSpan(span, err) }()
+
+	cmd, done, err := p.spawn(p.confPath, coreHome(p.alternate))
+	if err != nil {
+		return err
+	}
+	p.adopt(cmd, done)
+	return nil
+}
+
+// spawn starts a core process running the config at confPath in home, its
+// exit is only reported as a crash while it is the supervised core.
+func (p *CoreProcess) spawn(confPath, home string) (*exec.Cmd, chan struct{}, error) {
+	binPath, err := coreBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd := exec.Command(binPath, append(core.Args(confPath, home), conf.ClashExtraArgs...)...)
+	cmd.Env = append(append(os.Environ(), coreMemoryEnv()...), conf.ClashEnv...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		AmbientCaps: []uintptr{CAP_NET_BIND_SERVICE, CAP_NET_ADMIN, CAP_NET_RAW},
+	}
+	if conf.K8sSidecar {
+		// The pod rules skip traffic of the proxy uid, otherwise clash would loop
+		if err = chownTree(conf.ClashHome, conf.K8sProxyUID, conf.K8sProxyUID); err != nil {
+			return nil, nil, fmt.Errorf("[main] failed to change owner of clash home: %w", err)
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(conf.K8sProxyUID), Gid: uint32(conf.K8sProxyUID)}
+	}
+	logrus.Infof("[main] running cmds: %v", redactArgs(cmd.Args))
+
+	if err = StartChild(cmd); err != nil {
+		return nil, nil, fmt.Errorf("[main] failed to start clash process: %w: %v", err, redactArgs(cmd.Args))
+	}
+	if conf.ControllerMode == ControllerUnix && core.Name() == CoreMihomo {
+		go secureCoreSocket(p.ctx, CoreSocket())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		err := WaitChild(cmd)
+
+		p.mu.Lock()
+		// a core replaced by a handoff exits as expected
+		expected := p.stopping || p.cmd != cmd
+		p.mu.Unlock()
+		if !expected && p.ctx.Err() == nil {
+			logrus.Errorf("[main] clash process exited unexpectedly: %v", err)
+			Notify(EventCoreCrash, "%s core exited unexpectedly: %v", core.Name(), err)
+			EmitPlugins(PluginCoreCrashed, map[string]any{"core": core.Name(), "pid": cmd.Process.Pid, "error": fmt.Sprint(err)})
+		}
+		close(done)
+		if !expected && conf.CoreRestart {
+			p.recover(cmd, false)
+		}
+	}()
+	return cmd, done, nil
+}
+
+// adopt makes the started process the supervised core, the caller holds p.mu.
+func (p *CoreProcess) adopt(cmd *exec.Cmd, done chan struct{}) {
+	if p.cmd != nil {
+		metricCoreRestarts.Inc()
+	}
+	UpdateState(func(s *RuntimeState) {
+		if s.Core.PID != 0 {
+			s.Core.Restarts++
+		}
+		s.Core.Name = core.Name()
+		s.Core.PID = cmd.Process.Pid
+		s.Core.StartedAt = time.Now()
+	})
+	p.cmd, p.done = cmd, done
+	p.startedAt = time.Now()
+}
+
+// recover restarts the crashed core after the backoff, nothing is done if the
+// core was restarted or stopped in the meantime.
+func (p *CoreProcess) recover(crashed *exec.Cmd, retry bool) {
+	p.mu.Lock()
+	if !retry && time.Since(p.startedAt) >= coreStableTime {
+		p.backoff = 0
+	}
+	p.backoff = min(max(2*p.backoff, coreRestartBackoff), coreRestartMaxBackoff)
+	delay := p.backoff
+	p.mu.Unlock()
+
+	if p.ctx.Err() != nil {
+		return
+	}
+	logrus.Warnf("[main] restarting the crashed %s core in %s...", core.Name(), delay)
+	select {
+	case <-p.ctx.Done():
+		return
+	case <-time.After(delay):
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd != crashed || p.stopping || p.ctx.Err() != nil {
+		return
+	}
+	cmd, done, err := p.spawn(p.confPath, coreHome(p.alternate))
+	if err != nil {
+		logrus.Errorf("[main] failed to restart the crashed core: %v", err)
+		Notify(EventCoreRestart, "failed to restart the crashed %s core: %v", core.Name(), err)
+		// the next attempt waits for a longer backoff
+		go p.recover(crashed, true)
+		return
+	}
+	p.adopt(cmd, done)
+	Notify(EventCoreRestart, "%s core restarted after a crash", core.Name())
+}
+
+// coreBinary returns the core executable, --clash-bin or the one of the core.
+func coreBinary() (string, error) {
+	if conf.ClashBin != "" {
+		return conf.ClashBin, nil
+	}
+	return core.Binary()
+}
+
+// Running reports whether the core process is alive.
+func (p *CoreProcess) Running() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done == nil {
+		return false
+	}
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Stop interrupts the core and waits for it to exit, it is killed if it does
+// not exit in time.
+func (p *CoreProcess) Stop() {
+	p.mu.Lock()
+	cmd, done := p.cmd, p.done
+	p.stopping = true
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		p.stopping = false
+		p.mu.Unlock()
+	}()
+
+	if cmd == nil {
+		return
+	}
+	if err := cmd.Process.Signal(syscall.SIGINT); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		logrus.Error(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(coreStopTimeout):
+		logrus.Warnf("[main] clash process did not exit in %s, kill it...", coreStopTimeout)
+		_ = cmd.Process.Kill()
+		<-done
+	}
+}
+
+// Restart stops the running core and starts it again, with --core-handoff the
+// new core is started first if the core and the config support it.
+func (p *CoreProcess) Restart() (err error) {
+	_, span := startSpan(context.Background(), "core.restart", attribute.String("tpclash.core", core.Name()))
+	defer func() { endSpan(span, err) }()
+
+	if h, ok := core.(coreHandoffer); ok && conf.CoreHandoff {
+		err = p.handoff(h)
+		if !errors.Is(err, errHandoffUnsupported) {
+			if err != nil {
+				Notify(EventCoreRestart, "failed to hand off %s core: %v", core.Name(), err)
+				return err
+			}
+			Notify(EventCoreRestart, "%s core handed off", core.Name())
+			return nil
+		}
+		logrus.Info("[main] the config does not support the handoff(tun mode with auto-route only), restart the core")
+	}
+
+	logrus.Infof("[main] restarting %s core...", core.Name())
+	p.Stop()
+	if err = p.Start(); err != nil {
+		Notify(EventCoreRestart, "failed to restart %s core: %v", core.Name(), err)
+		return err
+	}
+	Notify(EventCoreRestart, "%s core restarted", core.Name())
+	return nil
+}
+
+// WritePidFile records the pid of tpclash in the clash home, so that the
+// subcommands can ask the running instance to restart the core.
+func WritePidFile() error {
+	return os.WriteFile(filepath.Join(conf.ClashHome, pidFileName), []byte(strconv.Itoa(os.Getpid())), 0644)
+}
+
+// RemovePidFile removes the pid file written by WritePidFile.
+func RemovePidFile() {
+	_ = os.Remove(filepath.Join(conf.ClashHome, pidFileName))
+}
+
+// runningTPClash returns the tpclash instance running with the same clash home.
+func runningTPClash() (*os.Process, error) {
+	bs, err := os.ReadFile(filepath.Join(conf.ClashHome, pidFileName))
+	if err != nil {
+		return nil, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(bs)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pid file: %w", err)
+	}
+
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+	if err = proc.Signal(syscall.Signal(0)); err != nil {
+		return nil, err
+	}
+	return proc, nil
+}
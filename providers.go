@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// clashProvider is a proxy or rule provider returned by the clash api.
+type clashProvider struct {
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	VehicleType string    `json:"vehicleType"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	Proxies     []any     `json:"proxies"`
+	RuleCount   int       `json:"ruleCount"`
+
+	kind string
+}
+
+// size returns the number of the proxies or the rules of the provider.
+func (p clashProvider) size() int {
+	if p.kind == "rules" {
+		return p.RuleCount
+	}
+	return len(p.Proxies)
+}
+
+// fetchProviders returns the proxy and rule providers, the builtin providers
+// are ignored. Rule providers are only supported by the meta cores.
+func fetchProviders(api *ClashAPI) ([]clashProvider, error) {
+	var ps []clashProvider
+	for _, kind := range []string{"proxies", "rules"} {
+		var resp struct {
+			Providers map[string]clashProvider `json:"providers"`
+		}
+		if err := api.Do("GET", "/providers/"+kind, nil, &resp); err != nil {
+			if kind == "rules" {
+				logrus.Debugf("[providers] failed to get rule providers: %v", err)
+				continue
+			}
+			return nil, fmt.Errorf("[providers] failed to get providers: %w", err)
+		}
+		for _, p := range resp.Providers {
+			if p.VehicleType == "Compatible" {
+				continue
+			}
+			p.kind = kind
+			ps = append(ps, p)
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		if ps[i].kind != ps[j].kind {
+			return ps[i].kind < ps[j].kind
+		}
+		return ps[i].Name < ps[j].Name
+	})
+	return ps, nil
+}
+
+// selectProviders returns the named provider or all providers of kind if
+// name is empty, an empty kind means both proxy and rule providers.
+func selectProviders(api *ClashAPI, name, kind string) ([]clashProvider, error) {
+	ps, err := fetchProviders(api)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []clashProvider
+	for _, p := range ps {
+		if (name == "" || p.Name == name) && (kind == "" || p.kind == kind) {
+			selected = append(selected, p)
+		}
+	}
+	if len(selected) == 0 {
+		if name != "" {
+			return nil, fmt.Errorf("[providers] provider %s not found", name)
+		}
+		return nil, errors.New("[providers] no providers in the config")
+	}
+	return selected, nil
+}
+
+var providersCmd = &cobra.Command{
+	Use:   "providers",
+	Short: "List the proxy and rule providers",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		api, err := RunningAPI()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		ps, err := fetchProviders(api)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		if jsonOutput() {
+			type providerJSON struct {
+				Name      string    `json:"name"`
+				Kind      string    `json:"kind"`
+				Vehicle   string    `json:"vehicle"`
+				Size      int       `json:"size"`
+				UpdatedAt time.Time `json:"updated_at"`
+			}
+			out := make([]providerJSON, 0, len(ps))
+			for _, p := range ps {
+				out = append(out, providerJSON{p.Name, p.kind, p.VehicleType, p.size(), p.UpdatedAt})
+			}
+			printJSON(out)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		defer func() { _ = w.Flush() }()
+
+		_, _ = fmt.Fprintln(w, "NAME\tKIND\tVEHICLE\tSIZE\tUPDATED")
+		for _, p := range ps {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s ago\n", p.Name, p.kind, p.VehicleType, p.size(), since(p.UpdatedAt))
+		}
+	},
+}
+
+var providersUpdateCmd = &cobra.Command{
+	Use:   "update [NAME]",
+	Short: "Update the specified or all providers",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runProviders(args, "update", "PUT", "")
+	},
+}
+
+var providersHealthcheckCmd = &cobra.Command{
+	Use:   "healthcheck [NAME]",
+	Short: "Run the health check of the specified or all proxy providers",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runProviders(args, "healthcheck", "GET", "/healthcheck")
+	},
+}
+
+func runProviders(args []string, action, method, suffix string) {
+	var name string
+	if len(args) > 0 {
+		name = args[0]
+	}
+
+	api, err := RunningAPI()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	// the core answers after the whole provider is updated or checked
+	api.cli.Timeout = 2 * time.Minute
+
+	var kind string
+	if action == "healthcheck" {
+		kind = "proxies"
+	}
+	ps, err := selectProviders(api, name, kind)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	var failed int
+	for _, p := range ps {
+		err = api.Do(method, "/providers/"+p.kind+"/"+url.PathEscape(p.Name)+suffix, nil, nil)
+		if action == "update" {
+			Audit(AuditSourceCLI, "", "providers.update", p.Name, err)
+		}
+		if err != nil {
+			logrus.Errorf("[providers] %s %s failed: %v", action, p.Name, err)
+			failed++
+			continue
+		}
+		logrus.Infof("[providers] %s %s success", action, p.Name)
+	}
+	if failed > 0 {
+		logrus.Fatalf("[providers] %s failed for %d providers", action, failed)
+	}
+}
+
+func init() {
+	providersCmd.AddCommand(providersUpdateCmd, providersHealthcheckCmd)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// clashProxy is a proxy or proxy group returned by the clash api.
+type clashProxy struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Now     string   `json:"now"`
+	All     []string `json:"all"`
+	History []struct {
+		Delay int `json:"delay"`
+	} `json:"history"`
+}
+
+// IsGroup reports whether the proxy is a proxy group.
+func (p clashProxy) IsGroup() bool {
+	return len(p.All) > 0
+}
+
+// Delay returns the latest delay of the proxy, 0 means timeout or not tested.
+func (p clashProxy) Delay() int {
+	if len(p.History) == 0 {
+		return 0
+	}
+	return p.History[len(p.History)-1].Delay
+}
+
+func fetchProxies(api *ClashAPI) (map[string]clashProxy, error) {
+	var resp struct {
+		Proxies map[string]clashProxy `json:"proxies"`
+	}
+	if err := api.Do("GET", "/proxies", nil, &resp); err != nil {
+		return nil, fmt.Errorf("[proxies] failed to get proxies: %w", err)
+	}
+	return resp.Proxies, nil
+}
+
+func formatDelay(d int) string {
+	if d <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%dms", d)
+}
+
+var proxiesCmd = &cobra.Command{
+	Use:   "proxies",
+	Short: "List proxy groups and their current selections",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		api, err := RunningAPI()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		proxies, err := fetchProxies(api)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		var groups []clashProxy
+		for _, p := range proxies {
+			if p.IsGroup() && p.Name != "GLOBAL" {
+				groups = append(groups, p)
+			}
+		}
+		sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+
+		if jsonOutput() {
+			type groupJSON struct {
+				Name    string `json:"name"`
+				Type    string `json:"type"`
+				Now     string `json:"now"`
+				Delay   int    `json:"delay"`
+				Proxies int    `json:"proxies"`
+			}
+			out := make([]groupJSON, 0, len(groups))
+			for _, g := range groups {
+				out = append(out, groupJSON{g.Name, g.Type, g.Now, proxies[g.Now].Delay(), len(g.All)})
+			}
+			printJSON(out)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		defer func() { _ = w.Flush() }()
+
+		_, _ = fmt.Fprintln(w, "GROUP\tTYPE\tNOW\tDELAY\tPROXIES")
+		for _, g := range groups {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", g.Name, g.Type, g.Now, formatDelay(proxies[g.Now].Delay()), len(g.All))
+		}
+	},
+}
+
+var proxiesShowCmd = &cobra.Command{
+	Use:   "show GROUP",
+	Short: "Show the proxies of a group with their latencies",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		api, err := RunningAPI()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		proxies, err := fetchProxies(api)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		g, ok := proxies[args[0]]
+		if !ok || !g.IsGroup() {
+			logrus.Fatalf("[proxies] proxy group %s not found", args[0])
+		}
+
+		if jsonOutput() {
+			type proxyJSON struct {
+				Name     string `json:"name"`
+				Type     string `json:"type"`
+				Delay    int    `json:"delay"`
+				Selected bool   `json:"selected"`
+			}
+			out := make([]proxyJSON, 0, len(g.All))
+			for _, name := range g.All {
+				out = append(out, proxyJSON{name, proxies[name].Type, proxies[name].Delay(), name == g.Now})
+			}
+			printJSON(out)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		defer func() { _ = w.Flush() }()
+
+		_, _ = fmt.Fprintln(w, "\tPROXY\tTYPE\tDELAY")
+		for _, name := range g.All {
+			mark := ""
+			if name == g.Now {
+				mark = "*"
+			}
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", mark, name, proxies[name].Type, formatDelay(proxies[name].Delay()))
+		}
+	},
+}
+
+var proxiesSelectCmd = &cobra.Command{
+	Use:   "select GROUP PROXY",
+	Short: "Switch the proxy of a selector group",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		group, proxy := args[0], args[1]
+
+		api, err := RunningAPI()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		proxies, err := fetchProxies(api)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		g, ok := proxies[group]
+		if !ok || !g.IsGroup() {
+			logrus.Fatalf("[proxies] proxy group %s not found", group)
+		}
+		if g.Type != "Selector" {
+			logrus.Fatalf("[proxies] proxy group %s is a %s group, only selector groups can be switched", group, g.Type)
+		}
+		if !slices.Contains(g.All, proxy) {
+			logrus.Fatalf("[proxies] proxy %s is not in group %s", proxy, group)
+		}
+
+		err = api.Do("PUT", "/proxies/"+url.PathEscape(group), map[string]string{"name": proxy}, nil)
+		Audit(AuditSourceCLI, "", "proxies.select", group+": "+proxy, err)
+		if err != nil {
+			logrus.Fatalf("[proxies] failed to switch proxy: %v", err)
+		}
+		logrus.Infof("[proxies] %s: %s -> %s", group, g.Now, proxy)
+	},
+}
+
+func init() {
+	proxiesCmd.AddCommand(proxiesShowCmd, proxiesSelectCmd)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+const redactedValue = "******"
+
+// sensitiveConfigKeys are the config fields holding credentials, the keys of
+// sing-box(snake case) are normalized to the clash form.
+var sensitiveConfigKeys = map[string]bool{
+	"password":       true,
+	"passwd":         true,
+	"obfs-password":  true,
+	"uuid":           true,
+	"secret":         true,
+	"client-secret":  true,
+	"private-key":    true,
+	"pre-shared-key": true,
+	"psk":            true,
+	"auth":           true,
+	"auth-str":       true,
+	"token":          true,
+	"authorization":  true,
+	"key":            true,
+}
+
+func isSensitiveKey(k string) bool {
+	return sensitiveConfigKeys[strings.ReplaceAll(strings.ToLower(k), "_", "-")]
+}
+
+// redactYAMLNode masks the credentials of a clash config in place: the
+// sensitive fields, the passwords of `authentication` and the queries of
+// the provider urls, which usually carry the subscription token.
+func redactYAMLNode(n *yaml.Node) {
+	if n.Kind != yaml.MappingNode {
+		for _, c := range n.Content {
+			redactYAMLNode(c)
+		}
+		return
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i].Value, n.Content[i+1]
+		switch {
+		case isSensitiveKey(k) && v.Kind == yaml.ScalarNode && v.Value != "":
+			v.Value, v.Tag, v.Style = redactedValue, "!!str", 0
+		case k == "authentication" && v.Kind == yaml.SequenceNode:
+			for _, u := range v.Content {
+				if name, _, ok := strings.Cut(u.Value, ":"); ok {
+					u.Value = name + ":" + redactedValue
+				}
+			}
+		case k == "url" && v.Kind == yaml.ScalarNode:
+			v.Value = redactURL(v.Value)
+		default:
+			redactYAMLNode(v)
+		}
+	}
+}
+
+// redactJSONValue masks the credentials of a sing-box config.
+func redactJSONValue(v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, x := range v {
+			s, isStr := x.(string)
+			switch {
+			case isSensitiveKey(k) && x != nil && (!isStr || s != ""):
+				v[k] = redactedValue
+			case k == "url" && isStr:
+				v[k] = redactURL(s)
+			default:
+				redactJSONValue(x)
+			}
+		}
+	case []any:
+		for _, x := range v {
+			redactJSONValue(x)
+		}
+	}
+}
+
+// redactErr hides the path and the query of the url in a http client error,
+// they may carry tokens(e.g. subscriptions, telegram bots).
+func redactErr(err error) error {
+	var ue *url.Error
+	if !errors.As(err, &ue) {
+		return err
+	}
+	u, pErr := url.Parse(ue.URL)
+	if pErr != nil {
+		return err
+	}
+	u.User, u.Path, u.RawPath, u.RawQuery, u.Fragment = nil, "", "", "", ""
+	return &url.Error{Op: ue.Op, URL: u.String(), Err: ue.Err}
+}
+
+// redactArgs masks the values of the secret flags passed to the core.
+func redactArgs(args []string) []string {
+	out := make([]string, len(args))
+	copy(out, args)
+	for i, a := range out {
+		name, _, hasValue := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		if !strings.HasPrefix(a, "-") || !isSensitiveKey(name) {
+			continue
+		}
+		if hasValue {
+			out[i] = a[:strings.Index(a, "=")+1] + redactedValue
+		} else if i+1 < len(out) {
+			out[i+1] = redactedValue
+		}
+	}
+	return out
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the config applied to the core",
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the running config with the credentials masked",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+		if core, err = NewCore(); err != nil {
+			logrus.Fatal(err)
+		}
+		bs, err := os.ReadFile(filepath.Join(conf.ClashHome, core.ConfigName()))
+		if err != nil {
+			logrus.Fatalf("[config] failed to read the running config, is tpclash running? %v", err)
+		}
+		c, err := core.Redact(string(bs))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Print(c)
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configShowCmd)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// reflectProto is a link local multicast discovery protocol reflected
+// between the --reflect-ifaces.
+type reflectProto struct {
+	name  string
+	group netip.AddrPort
+	// the mdns packets must be sent with ttl 255(RFC 6762 11), ssdp uses 2
+	ttl int
+}
+
+var reflectProtos = map[string]reflectProto{
+	"mdns": {name: "mdns", group: netip.MustParseAddrPort("224.0.0.251:5353"), ttl: 255},
+	"ssdp": {name: "ssdp", group: netip.MustParseAddrPort("239.255.255.250:1900"), ttl: 2},
+}
+
+const (
+	// reflectMaxSearches is the max number of the ssdp searches relayed at
+	// the same time, the others are dropped
+	reflectMaxSearches = 16
+	// reflectMaxMX caps the MX header(seconds the devices may wait before
+	// answering) of the relayed ssdp searches
+	reflectMaxMX = 5
+)
+
+var ssdpMXRe = regexp.MustCompile(`(?im)^MX:\s*(\d+)`)
+
+// reflector copies the multicast packets of a protocol received on one of
+// the interfaces to the others.
+type reflector struct {
+	proto  reflectProto
+	conn   *net.UDPConn
+	ifaces map[int]*net.Interface
+	// the addresses of the host, the packets sent by the host are dropped
+	// so the other reflectors(avahi-daemon) do not loop with us
+	local    map[netip.Addr]bool
+	searches chan struct{}
+}
+
+// RunReflector reflects the mdns/ssdp discovery between the interfaces so the
+// casting and AirPlay discovery work across the segments tpclash routes.
+func RunReflector(ctx context.Context) {
+	if len(conf.Reflect) == 0 {
+		return
+	}
+	ifaces, err := reflectInterfaces()
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	local := map[netip.Addr]bool{}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if p, err := netip.ParsePrefix(a.String()); err == nil {
+				local[p.Addr().Unmap()] = true
+			}
+		}
+	}
+
+	for _, name := range conf.Reflect {
+		r := &reflector{proto: reflectProtos[name], ifaces: ifaces, local: local, searches: make(chan struct{}, reflectMaxSearches)}
+		if err := r.listen(); err != nil {
+			logrus.Errorf("[reflect] failed to start the %s reflector: %v", name, err)
+			continue
+		}
+		logrus.Infof("[reflect] reflecting %s(%s) between %v", name, r.proto.group, conf.ReflectIfaces)
+		go func() {
+			<-ctx.Done()
+			_ = r.conn.Close()
+		}()
+		go r.serve()
+	}
+}
+
+// reflectInterfaces looks up the --reflect-ifaces, the interfaces without an
+// ipv4 address can not send the multicast packets and are skipped.
+func reflectInterfaces() (map[int]*net.Interface, error) {
+	ifaces := map[int]*net.Interface{}
+	for _, name := range conf.ReflectIfaces {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("[reflect] failed to find the interface %s: %v", name, err)
+		}
+		if ifi.Flags&net.FlagMulticast == 0 {
+			logrus.Warnf("[reflect] the interface %s does not support multicast, skipped", name)
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		if !slices.ContainsFunc(addrs, func(a net.Addr) bool {
+			p, err := netip.ParsePrefix(a.String())
+			return err == nil && p.Addr().Is4()
+		}) {
+			logrus.Warnf("[reflect] the interface %s has no ipv4 address, skipped", name)
+			continue
+		}
+		ifaces[ifi.Index] = ifi
+	}
+	if len(ifaces) < 2 {
+		return nil, errors.New("[reflect] at least 2 usable --reflect-ifaces are required")
+	}
+	return ifaces, nil
+}
+
+// listen binds the port of the protocol next to the other responders of the
+// host(avahi-daemon, minissdpd) and joins the group on the interfaces.
+func (r *reflector) listen() error {
+	lc := net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = errors.Join(
+				unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1),
+				unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1),
+			)
+		})
+		return errors.Join(err, serr)
+	}}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", ":"+strconv.Itoa(int(r.proto.group.Port())))
+	if err != nil {
+		return err
+	}
+	r.conn = pc.(*net.UDPConn)
+
+	raw, err := r.conn.SyscallConn()
+	if err != nil {
+		_ = r.conn.Close()
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		// the packets received by the other local sockets are not looped back
+		// to us, we tell the interfaces apart by the pktinfo
+		serr = errors.Join(
+			unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_PKTINFO, 1),
+			unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_LOOP, 0),
+			unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_TTL, r.proto.ttl),
+		)
+		for _, ifi := range r.ifaces {
+			mreq := &unix.IPMreqn{Multiaddr: r.proto.group.Addr().As4(), Ifindex: int32(ifi.Index)}
+			if err := unix.SetsockoptIPMreqn(int(fd), unix.IPPROTO_IP, unix.IP_ADD_MEMBERSHIP, mreq); err != nil {
+				serr = errors.Join(serr, fmt.Errorf("join %s on %s: %w", r.proto.group.Addr(), ifi.Name, err))
+			}
+		}
+	})
+	if err = errors.Join(err, serr); err != nil {
+		_ = r.conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (r *reflector) serve() {
+	buf := make([]byte, 9000)
+	oob := make([]byte, 128)
+	for {
+		n, oobn, _, src, err := r.conn.ReadMsgUDPAddrPort(buf, oob)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logrus.Errorf("[reflect] failed to read the %s packets: %v", r.proto.name, err)
+			}
+			return
+		}
+		index, dst := pktinfo(oob[:oobn])
+		in, ok := r.ifaces[index]
+		if !ok || dst != r.proto.group.Addr() || r.local[src.Addr().Unmap()] {
+			continue
+		}
+		pkt := buf[:n]
+
+		switch r.proto.name {
+		case "mdns":
+			// the legacy unicast queries(RFC 6762 6.7) expect a unicast
+			// answer from the responders, they can not be reflected
+			if src.Port() != r.proto.group.Port() {
+				continue
+			}
+		case "ssdp":
+			// the devices answer a search by unicast to the source, the
+			// search is relayed from a socket of its own to get the answers
+			if bytes.HasPrefix(pkt, []byte("M-SEARCH ")) {
+				select {
+				case r.searches <- struct{}{}:
+					go r.relaySearch(in, src, bytes.Clone(pkt))
+				default:
+					logrus.Debugf("[reflect] too many ssdp searches, dropped the search of %s", src)
+				}
+				continue
+			}
+		}
+		r.reflect(in, r.conn, pkt)
+	}
+}
+
+// reflect sends the packet received on the interface to the group on the
+// other interfaces.
+func (r *reflector) reflect(in *net.Interface, conn *net.UDPConn, pkt []byte) {
+	for index, out := range r.ifaces {
+		if index == in.Index {
+			continue
+		}
+		oob := unix.PktInfo4(&unix.Inet4Pktinfo{Ifindex: int32(index)})
+		if _, _, err := conn.WriteMsgUDPAddrPort(pkt, oob, r.proto.group); err != nil {
+			logrus.Debugf("[reflect] failed to reflect the %s packet from %s to %s: %v", r.proto.name, in.Name, out.Name, err)
+		}
+	}
+}
+
+// relaySearch sends the ssdp search to the other interfaces and forwards the
+// answers to the searcher until the MX of the search passed.
+func (r *reflector) relaySearch(in *net.Interface, src netip.AddrPort, pkt []byte) {
+	defer func() { <-r.searches }()
+
+	mx := 1
+	if m := ssdpMXRe.FindSubmatch(pkt); m != nil {
+		mx, _ = strconv.Atoi(string(m[1]))
+	}
+	mx = min(max(mx, 1), reflectMaxMX)
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		logrus.Debugf("[reflect] failed to relay the ssdp search of %s: %v", src, err)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	if raw, err := conn.SyscallConn(); err == nil {
+		_ = raw.Control(func(fd uintptr) {
+			_ = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_TTL, r.proto.ttl)
+		})
+	}
+
+	logrus.Debugf("[reflect] relaying the ssdp search of %s from %s, mx: %d", src, in.Name, mx)
+	r.reflect(in, conn, pkt)
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Duration(mx+1) * time.Second))
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		if r.local[from.Addr().Unmap()] {
+			continue
+		}
+		if _, err = r.conn.WriteToUDPAddrPort(buf[:n], src); err != nil {
+			logrus.Debugf("[reflect] failed to forward the ssdp answer of %s to %s: %v", from, src, err)
+		}
+	}
+}
+
+// pktinfo returns the interface index and the destination address of the
+// IP_PKTINFO control message.
+func pktinfo(oob []byte) (int, netip.Addr) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, netip.Addr{}
+	}
+	for _, m := range msgs {
+		if m.Header.Level != unix.IPPROTO_IP || m.Header.Type != unix.IP_PKTINFO || len(m.Data) < unix.SizeofInet4Pktinfo {
+			continue
+		}
+		// struct in_pktinfo { int ipi_ifindex; in_addr ipi_spec_dst; in_addr ipi_addr; }
+		return int(int32(binary.NativeEndian.Uint32(m.Data[0:4]))), netip.AddrFrom4([4]byte(m.Data[8:12]))
+	}
+	return 0, netip.Addr{}
+}
+
+// CheckReflectConf validates the --reflect flags.
+func CheckReflectConf() error {
+	if len(conf.Reflect) == 0 {
+		return nil
+	}
+	seen := map[string]bool{}
+	for _, name := range conf.Reflect {
+		if _, ok := reflectProtos[name]; !ok {
+			return fmt.Errorf("[reflect] unknown protocol %q, must be mdns or ssdp", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("[reflect] duplicated --reflect protocol %s", name)
+		}
+		seen[name] = true
+	}
+	if len(conf.ReflectIfaces) < 2 {
+		return errors.New("[reflect] --reflect requires at least 2 interfaces in --reflect-ifaces")
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	proxyHistoryMaxSize  = 20 << 20
+	proxyHistoryMaxFiles = 5
+
+	proxyCheckURL     = "http://www.gstatic.com/generate_204"
+	proxyCheckTimeout = 5 * time.Second
+)
+
+// proxyCheck is a round of delay tests written to the proxy history, a
+// delay of 0 means the proxy was unavailable.
+type proxyCheck struct {
+	Time   time.Time      `json:"time"`
+	Delays map[string]int `json:"delays"`
+}
+
+// WatchProxyHistory tests all proxies every --proxy-check-interval and
+// records the results in the clash home for `tpclash report proxies`.
+func WatchProxyHistory(ctx context.Context) {
+	if conf.ProxyCheckInterval <= 0 {
+		return
+	}
+
+	w, err := newRotateWriter(filepath.Join(conf.ClashHome, proxyHistoryFileName), proxyHistoryMaxSize, proxyHistoryMaxFiles)
+	if err != nil {
+		logrus.Errorf("[report] failed to open proxy history: %v", err)
+		return
+	}
+	defer func() { _ = w.Close() }()
+	enc := json.NewEncoder(w)
+
+	logrus.Infof("[report] proxy availability check scheduled, interval: %s", conf.ProxyCheckInterval)
+	ticker := time.NewTicker(conf.ProxyCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		api, err := RunningAPI()
+		if err != nil {
+			logrus.Debug(err)
+			continue
+		}
+		proxies, err := fetchProxies(api)
+		if err != nil {
+			logrus.Debug(err)
+			continue
+		}
+
+		check := proxyCheck{Time: time.Now(), Delays: map[string]int{}}
+		for _, r := range pingProxies(api, pingTargets(proxies, sortedKeys(proxies)), proxyCheckURL, proxyCheckTimeout, 8) {
+			check.Delays[r.Name] = r.Delay
+		}
+		if err = enc.Encode(check); err != nil {
+			logrus.Errorf("[report] failed to write proxy history: %v", err)
+		}
+	}
+}
+
+// proxyReport is the availability of a proxy in the report period.
+type proxyReport struct {
+	Name    string  `json:"name"`
+	Samples int     `json:"samples"`
+	Uptime  float64 `json:"uptime"`
+	P50     int     `json:"p50"`
+	P90     int     `json:"p90"`
+	P99     int     `json:"p99"`
+}
+
+var reportOpts struct {
+	since string
+	json  bool
+}
+
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Report the statistics recorded by the running TPClash",
+}
+
+var reportProxiesCmd = &cobra.Command{
+	Use:   "proxies",
+	Short: "Report the uptime and latency of proxies recorded by --proxy-check-interval",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		period, err := parseDays(reportOpts.since)
+		if err != nil {
+			logrus.Fatalf("[report] invalid --since: %v", err)
+		}
+		from := time.Now().Add(-period)
+
+		delays := map[string][]int{}
+		historyPath := filepath.Join(conf.ClashHome, proxyHistoryFileName)
+		paths := []string{historyPath}
+		for i := 1; i <= proxyHistoryMaxFiles; i++ {
+			paths = append(paths, fmt.Sprintf("%s.%d", historyPath, i))
+		}
+		for _, path := range paths {
+			err = readJSONLines(path, func(c proxyCheck) {
+				if c.Time.Before(from) {
+					return
+				}
+				for name, d := range c.Delays {
+					delays[name] = append(delays[name], d)
+				}
+			})
+			if err != nil && !os.IsNotExist(err) {
+				logrus.Fatalf("[report] failed to read %s: %v", path, err)
+			}
+		}
+		if len(delays) == 0 {
+			logrus.Fatal("[report] no proxy history in the period, is --proxy-check-interval enabled?")
+		}
+
+		var reports []proxyReport
+		for _, name := range sortedKeys(delays) {
+			reports = append(reports, newProxyReport(name, delays[name]))
+		}
+		sort.SliceStable(reports, func(i, j int) bool { return reports[i].Uptime > reports[j].Uptime })
+
+		if reportOpts.json || jsonOutput() {
+			printJSON(reports)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		defer func() { _ = w.Flush() }()
+
+		_, _ = fmt.Fprintln(w, "PROXY\tSAMPLES\tUPTIME\tP50\tP90\tP99")
+		for _, r := range reports {
+			_, _ = fmt.Fprintf(w, "%s\t%d\t%.2f%%\t%s\t%s\t%s\n", r.Name, r.Samples, r.Uptime,
+				formatDelay(r.P50), formatDelay(r.P90), formatDelay(r.P99))
+		}
+	},
+}
+
+func newProxyReport(name string, delays []int) proxyReport {
+	r := proxyReport{Name: name, Samples: len(delays)}
+
+	var ok []int
+	for _, d := range delays {
+		if d > 0 {
+			ok = append(ok, d)
+		}
+	}
+	if len(delays) > 0 {
+		r.Uptime = float64(len(ok)) * 100 / float64(len(delays))
+	}
+	sort.Ints(ok)
+	r.P50, r.P90, r.P99 = percentile(ok, 50), percentile(ok, 90), percentile(ok, 99)
+	return r
+}
+
+// percentile returns the nearest-rank percentile of the sorted values.
+func percentile(sorted []int, p int) int {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
+
+// parseDays parses a duration that also accepts a day suffix(e.g. 7d).
+func parseDays(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func init() {
+	reportProxiesCmd.Flags().StringVar(&reportOpts.since, "since", "7d", "report period(e.g. 24h, 7d)")
+	reportProxiesCmd.Flags().BoolVar(&reportOpts.json, "json", false, "print the report as json")
+	reportCmd.AddCommand(reportProxiesCmd)
+}
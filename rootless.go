@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+
+	"github.com/sirupsen/logrus"
+)
+
+const rootlessDockerSocketGlob = "/run/user/*/docker.sock"
+
+// RootlessDocker is a rootless docker daemon found on the host.
+//
+// Rootless containers live in the network namespace created by rootlesskit and
+// reach the outside through a user-mode network stack(slirp4netns, pasta or
+// vpnkit). Their traffic leaves the host as ordinary local sockets owned by the
+// daemon user, which means:
+//
+//   - it is captured by the clash tun like any other locally generated traffic,
+//     the DOCKER-USER compatible rules are not involved;
+//   - container addresses are invisible to the host, so the tpclash.proxy label
+//     and --docker-networks cannot exclude single rootless containers;
+//   - the rootlesskit port driver(builtin/slirp4netns) rewrites the source of
+//     inbound connections, so replies are always routed by the host stack.
+//
+// Intercepting inside the network namespace of rootlesskit is not supported:
+// the proxy of the host is not reachable from it unless the host loopback is
+// exposed, and the namespace is recreated with the daemon. tpclash therefore
+// only watches rootless daemons and rejects the opt outs which cannot take
+// effect, instead of silently ignoring them.
+type RootlessDocker struct {
+	UID       int
+	Socket    string
+	NetDriver string
+}
+
+// Host returns the docker client host of the rootless daemon.
+func (r RootlessDocker) Host() string {
+	return "unix://" + r.Socket
+}
+
+// DetectRootlessDocker finds rootless docker daemons by their per-user sockets.
+func DetectRootlessDocker() []RootlessDocker {
+	socks, _ := filepath.Glob(rootlessDockerSocketGlob)
+
+	var rs []RootlessDocker
+	for _, sock := range socks {
+		uid, err := strconv.Atoi(filepath.Base(filepath.Dir(sock)))
+		if err != nil {
+			continue
+		}
+		rs = append(rs, RootlessDocker{UID: uid, Socket: sock, NetDriver: rootlessNetDriver(uid)})
+	}
+	return rs
+}
+
+// rootlessNetDriver reads the --net option of the rootlesskit process owned by uid.
+func rootlessNetDriver(uid int) string {
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, proc := range procs {
+		info, err := os.Stat(proc)
+		if err != nil {
+			continue
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != uid {
+			continue
+		}
+
+		bs, err := os.ReadFile(filepath.Join(proc, "cmdline"))
+		if err != nil {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(bs), "\x00"), "\x00")
+		if len(args) == 0 || filepath.Base(args[0]) != "rootlesskit" {
+			continue
+		}
+
+		for i, arg := range args {
+			if v, ok := strings.CutPrefix(arg, "--net="); ok {
+				return v
+			}
+			if arg == "--net" && i+1 < len(args) {
+				return args[i+1]
+			}
+		}
+		return "host"
+	}
+	return "unknown"
+}
+
+// warnRootlessDocker warns about the flags which do not apply to the rootless
+// daemon.
+func warnRootlessDocker(r RootlessDocker) {
+	if len(conf.DockerNetworks) > 0 {
+		logrus.Warnf("[docker/rootless] --docker-networks has no effect on the rootless docker of uid %d, all of its containers are proxied", r.UID)
+	}
+}
+
+// checkRootlessDocker rejects the opt outs of rootless containers, they can
+// not be honored.
+func checkRootlessDocker(ctx context.Context, cli *client.Client, r RootlessDocker) {
+	cs, err := cli.ContainerList(ctx, types.ContainerListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", LabelProxy)),
+	})
+	if err != nil {
+		logrus.Errorf("[docker/rootless] failed to inspect containers of uid %d: %v", r.UID, err)
+		return
+	}
+
+	for _, c := range cs {
+		if proxy, err := strconv.ParseBool(c.Labels[LabelProxy]); err == nil && !proxy {
+			logrus.Errorf("[docker/rootless] the %s=false label of container %s(uid %d) is rejected, rootless container traffic is sent by %s on the host and always proxied", LabelProxy, c.ID[:12], r.UID, r.NetDriver)
+		}
+	}
+}
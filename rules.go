@@ -0,0 +1,792 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sys/unix"
+)
+
+// ruleState is everything the tpclash nftables table is built from, the table
+// is always re-created from the full state so that it never drifts.
+var ruleState = struct {
+	sync.Mutex
+
+	// source prefixes that should not be intercepted, grouped by the
+	// component that registered them(docker labels, etc.)
+	bypass map[string][]netip.Prefix
+
+	// container subnets whose DNS queries to the host are redirected to clash
+	dnsSources []netip.Prefix
+	dnsPort    uint16
+
+	// dnsFallbackPort is the port of the fallback dns forwarder the queries
+	// are redirected to while the clash DNS is down, 0 if it is not in use
+	dnsFallbackPort uint16
+
+	// udpBypass stops intercepting the UDP traffic except DNS, the traffic to
+	// udpKeep(the fake-ip range) is still intercepted
+	udpBypass bool
+	udpKeep   []netip.Prefix
+
+	// lan6 is the ipv6 prefixes of the host(the delegated prefixes), the
+	// traffic to them is routed by the main table, they follow the prefix
+	// changes of the ISP
+	lan6 []netip.Prefix
+
+	// flushed removes the table until the rules are reapplied, the sources
+	// are still registered
+	flushed bool
+}{bypass: map[string][]netip.Prefix{}}
+
+// SetBypassSources replaces the source prefixes registered by owner and
+// reapplies the rules. Packets from those sources are marked in prerouting
+// and routed by the main table instead of the clash tun.
+func SetBypassSources(owner string, prefixes []netip.Prefix) error {
+	ruleState.Lock()
+	defer ruleState.Unlock()
+
+	if len(prefixes) == 0 {
+		delete(ruleState.bypass, owner)
+	} else {
+		ruleState.bypass[owner] = prefixes
+	}
+
+	return applyRules(context.Background())
+}
+
+// SetDNSPort updates the clash DNS listening port used by the DNS redirect rules.
+func SetDNSPort(ctx context.Context, port uint16) error {
+	ruleState.Lock()
+	defer ruleState.Unlock()
+
+	if ruleState.dnsPort == port {
+		return nil
+	}
+	ruleState.dnsPort = port
+	if len(ruleState.dnsSources) == 0 {
+		return nil
+	}
+	return applyRules(ctx)
+}
+
+// SetDNSFallbackPort redirects the DNS queries passing the host and the DNS
+// redirect sources to the fallback forwarder on port, 0 restores the clash
+// DNS port.
+func SetDNSFallbackPort(port uint16) error {
+	ruleState.Lock()
+	defer ruleState.Unlock()
+
+	if ruleState.dnsFallbackPort == port {
+		return nil
+	}
+	ruleState.dnsFallbackPort = port
+	return applyRules(context.Background())
+}
+
+// SetUDPBypass marks the UDP traffic of all sources as bypassed when enable is
+// set, the DNS queries and the destinations in keep are still intercepted.
+func SetUDPBypass(enable bool, keep []netip.Prefix) error {
+	ruleState.Lock()
+	defer ruleState.Unlock()
+
+	ruleState.udpBypass = enable
+	ruleState.udpKeep = keep
+	return applyRules(context.Background())
+}
+
+// SetLANPrefixes6 replaces the ipv6 prefixes the traffic to which is not
+// intercepted and reapplies the rules.
+func SetLANPrefixes6(ctx context.Context, prefixes []netip.Prefix) error {
+	ruleState.Lock()
+	defer ruleState.Unlock()
+
+	ruleState.lan6 = prefixes
+	return applyRules(ctx)
+}
+
+// SetDNSRedirectSources replaces the source prefixes whose DNS queries sent to
+// the host itself are redirected to the clash DNS port.
+//
+// Containers that use the host as nameserver would otherwise query port 53 of
+// a local address where nothing listens, because the clash DNS must not listen
+// on 53. Docker's embedded resolver(127.0.0.11) lives inside the container
+// network namespace and is never affected: container-to-container names keep
+// resolving locally, and only its upstream lookups reach the host.
+func SetDNSRedirectSources(prefixes []netip.Prefix) error {
+	ruleState.Lock()
+	defer ruleState.Unlock()
+
+	ruleState.dnsSources = prefixes
+	return applyRules(context.Background())
+}
+
+// FlushRules removes the tpclash nftables table and the bypass ip rule until
+// ReapplyRules, they are not repaired in the meantime.
+func FlushRules() error {
+	ruleState.Lock()
+	defer ruleState.Unlock()
+
+	ruleState.flushed = true
+	return applyRules(context.Background())
+}
+
+// ReapplyRules applies the rules built from the rule state again, the rules
+// removed by FlushRules included.
+func ReapplyRules() error {
+	ruleState.Lock()
+	defer ruleState.Unlock()
+
+	ruleState.flushed = false
+	return errors.Join(ReapplySysctl(), applyRules(context.Background()))
+}
+
+// CleanRules removes the tpclash nftables table and the bypass ip rule.
+func CleanRules() error {
+	ruleState.Lock()
+	defer ruleState.Unlock()
+
+	ruleState.bypass = map[string][]netip.Prefix{}
+	ruleState.dnsSources = nil
+	ruleState.dnsFallbackPort = 0
+	ruleState.udpBypass = false
+	ruleState.lan6 = nil
+	return applyRules(context.Background())
+}
+
+func mergeBypassSources() []netip.Prefix {
+	return mergePrefixes(allBypassSources())
+}
+
+// mergeBypassSources6 is mergeBypassSources of the ipv6 sources, they are
+// bypassed by the ipv6 table.
+func mergeBypassSources6() []netip.Prefix {
+	return mergePrefixes6(allBypassSources())
+}
+
+func allBypassSources() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, ps := range ruleState.bypass {
+		prefixes = append(prefixes, ps...)
+	}
+	return prefixes
+}
+
+// mergePrefixes returns sorted, de-duplicated ipv4 prefixes. Interval sets
+// reject overlapping elements, so prefixes covered by others are dropped.
+func mergePrefixes(ps []netip.Prefix) []netip.Prefix {
+	return mergeFamilyPrefixes(ps, false)
+}
+
+// mergePrefixes6 is mergePrefixes of the ipv6 prefixes.
+func mergePrefixes6(ps []netip.Prefix) []netip.Prefix {
+	return mergeFamilyPrefixes(ps, true)
+}
+
+func mergeFamilyPrefixes(ps []netip.Prefix, v6 bool) []netip.Prefix {
+	seen := make(map[netip.Prefix]bool)
+	var prefixes []netip.Prefix
+	for _, p := range ps {
+		p = p.Masked()
+		if p.Addr().Is6() != v6 || p.Addr().Is4In6() || seen[p] {
+			continue
+		}
+		seen[p] = true
+		prefixes = append(prefixes, p)
+	}
+
+	sort.Slice(prefixes, func(i, j int) bool { return prefixes[i].Addr().Less(prefixes[j].Addr()) })
+
+	var merged []netip.Prefix
+	for _, p := range prefixes {
+		if len(merged) > 0 && merged[len(merged)-1].Overlaps(p) {
+			if p.Bits() < merged[len(merged)-1].Bits() {
+				merged[len(merged)-1] = p
+			}
+			continue
+		}
+		merged = append(merged, p)
+	}
+	return merged
+}
+
+// ruleSpec is what the tpclash table is built from.
+type ruleSpec struct {
+	bypass       []netip.Prefix
+	dnsSources   []netip.Prefix
+	dnsPort      uint16
+	fallbackPort uint16
+	udpBypass    bool
+	udpKeep      []netip.Prefix
+	lan6         []netip.Prefix
+	bypass6      []netip.Prefix
+}
+
+func applyRules(ctx context.Context) (err error) {
+	spec := ruleSpec{dnsPort: ruleState.dnsPort}
+	if !ruleState.flushed {
+		spec.bypass = mergeBypassSources()
+		spec.dnsSources = mergePrefixes(ruleState.dnsSources)
+		spec.fallbackPort = ruleState.dnsFallbackPort
+		spec.udpBypass = ruleState.udpBypass
+		spec.udpKeep = mergePrefixes(ruleState.udpKeep)
+		spec.lan6 = mergePrefixes6(ruleState.lan6)
+		spec.bypass6 = mergeBypassSources6()
+	}
+	bypass, dnsSources := spec.bypass, spec.dnsSources
+
+	start := time.Now()
+	_, span := startSpan(ctx, "rules.apply",
+		attribute.Int("rules.bypass_sources", len(bypass)), attribute.Int("rules.dns_redirect_sources", len(dnsSources)))
+	defer func() {
+		if err != nil {
+			Notify(EventRulesError, "%v", err)
+		}
+		_ = hostChange("plugin", "", func() error {
+			EmitPlugins(PluginRulesApplied, pluginResult(map[string]any{"bypass_sources": len(bypass), "dns_redirect_sources": len(dnsSources)}, err))
+			return nil
+		})
+		endSpan(span, err)
+		metricRulesApply.WithLabelValues(metricResult(err)).Inc()
+		metricRulesApplyDuration.Observe(time.Since(start).Seconds())
+		UpdateState(func(s *RuntimeState) {
+			s.Rules.Applied = err == nil
+			s.Rules.Error = ""
+			if err != nil {
+				s.Rules.Error = err.Error()
+			}
+			s.Rules.BypassSources = len(bypass) + len(spec.bypass6)
+			s.Rules.UDPBypass = spec.udpBypass
+			s.Rules.DNSRedirectSources = len(dnsSources)
+			s.Rules.LANPrefixes6 = nil
+			for _, p := range spec.lan6 {
+				s.Rules.LANPrefixes6 = append(s.Rules.LANPrefixes6, p.String())
+			}
+			s.Rules.UpdatedAt = time.Now()
+		})
+	}()
+
+	// the final rules are printed by DryRun
+	return hostChange("nft", "", func() error { return commitRules(spec) })
+}
+
+// commitRules replaces the tpclash tables and the bypass ip rules with the
+// ones of spec.
+func commitRules(spec ruleSpec) error {
+	nft, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("[rules] failed connect to nftables: %v", err)
+	}
+
+	// Re-create the table in a single transaction so stale rules never linger
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: TableTPClash}
+	nft.AddTable(table)
+	nft.DelTable(table)
+	if err = buildRules(nft, spec); err != nil {
+		return err
+	}
+	table6 := &nftables.Table{Family: nftables.TableFamilyIPv6, Name: TableTPClash}
+	nft.AddTable(table6)
+	nft.DelTable(table6)
+	if err = buildRules6(nft, spec); err != nil {
+		return err
+	}
+
+	if err = nft.Flush(); err != nil {
+		return fmt.Errorf("[rules] failed to flush nftables: %v", err)
+	}
+
+	if err = setBypassIPRule(unix.AF_INET, len(spec.bypass) > 0 || spec.udpBypass); err != nil {
+		return err
+	}
+	return setBypassIPRule(unix.AF_INET6, len(spec.lan6) > 0 || len(spec.bypass6) > 0)
+}
+
+// nftBuilder is the part of *nftables.Conn the rule builders use, `rules
+// render` records the objects instead of sending them to the kernel.
+type nftBuilder interface {
+	AddTable(t *nftables.Table) *nftables.Table
+	AddChain(c *nftables.Chain) *nftables.Chain
+	AddSet(s *nftables.Set, vals []nftables.SetElement) error
+	AddRule(r *nftables.Rule) *nftables.Rule
+}
+
+// buildRules adds the tpclash table for the bypass and dns redirect sources,
+// nothing is added if no rules are needed. A non-zero fallbackPort replaces
+// the clash DNS port and redirects the forwarded DNS queries as well.
+func buildRules(nft nftBuilder, spec ruleSpec) error {
+	dnsPort := spec.dnsPort
+	if spec.fallbackPort > 0 {
+		dnsPort = spec.fallbackPort
+	}
+	dnsRedirect := len(spec.dnsSources) > 0 && dnsPort > 0
+	if len(spec.bypass) == 0 && !spec.udpBypass && !dnsRedirect && spec.fallbackPort == 0 {
+		return nil
+	}
+	table := nft.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: TableTPClash})
+
+	if len(spec.bypass) > 0 || spec.udpBypass {
+		chain := nft.AddChain(&nftables.Chain{
+			Name:     ChainBypass,
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookPrerouting,
+			Priority: nftables.ChainPriorityMangle,
+		})
+		if len(spec.bypass) > 0 {
+			logrus.Debugf("[rules] apply bypass sources: %v", spec.bypass)
+			if err := addBypassRules(nft, table, chain, spec.bypass); err != nil {
+				return err
+			}
+		}
+		if spec.udpBypass {
+			logrus.Debugf("[rules] apply udp bypass, keep: %v", spec.udpKeep)
+			if err := addUDPBypassRules(nft, table, chain, spec.udpKeep); err != nil {
+				return err
+			}
+		}
+	}
+
+	if dnsRedirect {
+		logrus.Debugf("[rules] apply dns redirect sources: %v -> :%d", spec.dnsSources, dnsPort)
+		if err := addDNSRedirectRules(nft, table, spec.dnsSources, dnsPort); err != nil {
+			return err
+		}
+	}
+
+	if spec.fallbackPort > 0 {
+		logrus.Debugf("[rules] apply dns fallback -> :%d", spec.fallbackPort)
+		addDNSFallbackRules(nft, table, spec.fallbackPort)
+	}
+	return nil
+}
+
+// buildRules6 adds the ipv6 tpclash table for the lan prefixes and the ipv6
+// bypass sources, nothing is added if there are none.
+func buildRules6(nft nftBuilder, spec ruleSpec) error {
+	if len(spec.lan6) == 0 && len(spec.bypass6) == 0 {
+		return nil
+	}
+	table := nft.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv6, Name: TableTPClash})
+	chain := nft.AddChain(&nftables.Chain{
+		Name:     ChainBypass,
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityMangle,
+	})
+	if len(spec.bypass6) > 0 {
+		logrus.Debugf("[rules] apply ipv6 bypass sources: %v", spec.bypass6)
+		set := &nftables.Set{
+			Table:    table,
+			Name:     SetBypassSrc,
+			KeyType:  nftables.TypeIP6Addr,
+			Interval: true,
+		}
+		if err := nft.AddSet(set, prefixSetElements(spec.bypass6)); err != nil {
+			return fmt.Errorf("[rules] failed to add ipv6 bypass set: %w", err)
+		}
+		nft.AddRule(&nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: []expr.Any{
+				// ip6 saddr @bypass_src
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 16},
+				&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+				// meta mark set BypassMark
+				&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(BypassMark)},
+				&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+			},
+		})
+	}
+	if len(spec.lan6) == 0 {
+		return nil
+	}
+	logrus.Debugf("[rules] apply ipv6 lan prefixes: %v", spec.lan6)
+
+	set := &nftables.Set{
+		Table:    table,
+		Name:     SetLAN6Dst,
+		KeyType:  nftables.TypeIP6Addr,
+		Interval: true,
+	}
+	if err := nft.AddSet(set, prefixSetElements(spec.lan6)); err != nil {
+		return fmt.Errorf("[rules] failed to add ipv6 lan set: %w", err)
+	}
+	nft.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: []expr.Any{
+			// ip6 daddr @lan6_dst
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 24, Len: 16},
+			&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+			// meta mark set BypassMark
+			&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(BypassMark)},
+			&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+		},
+	})
+	return nil
+}
+
+func addBypassRules(nft nftBuilder, table *nftables.Table, chain *nftables.Chain, prefixes []netip.Prefix) error {
+	set := &nftables.Set{
+		Table:    table,
+		Name:     SetBypassSrc,
+		KeyType:  nftables.TypeIPAddr,
+		Interval: true,
+	}
+	if err := nft.AddSet(set, prefixSetElements(prefixes)); err != nil {
+		return fmt.Errorf("[rules] failed to add bypass set: %w", err)
+	}
+
+	nft.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: []expr.Any{
+			// ip saddr @bypass_src
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+			&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+			// meta mark set BypassMark
+			&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(BypassMark)},
+			&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+		},
+	})
+	return nil
+}
+
+// addUDPBypassRules marks the UDP traffic except DNS as bypassed, the traffic
+// to the fake ips can only work through clash and is kept.
+func addUDPBypassRules(nft nftBuilder, table *nftables.Table, chain *nftables.Chain, keep []netip.Prefix) error {
+	exprs := []expr.Any{
+		// meta l4proto udp th dport != 53
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.BigEndian.PutUint16(53)},
+	}
+	if len(keep) > 0 {
+		set := &nftables.Set{
+			Table:    table,
+			Name:     SetUDPKeepDst,
+			KeyType:  nftables.TypeIPAddr,
+			Interval: true,
+		}
+		if err := nft.AddSet(set, prefixSetElements(keep)); err != nil {
+			return fmt.Errorf("[rules] failed to add udp keep set: %w", err)
+		}
+		exprs = append(exprs,
+			// ip daddr != @udp_keep_dst
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+			&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID, Invert: true},
+		)
+	}
+	exprs = append(exprs,
+		// meta mark set BypassMark
+		&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(BypassMark)},
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+	)
+	nft.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: exprs})
+	return nil
+}
+
+func addDNSRedirectRules(nft nftBuilder, table *nftables.Table, prefixes []netip.Prefix, port uint16) error {
+	chain := nft.AddChain(&nftables.Chain{
+		Name:     ChainDNSRedirect,
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	})
+
+	set := &nftables.Set{
+		Table:    table,
+		Name:     SetDNSRedirectSrc,
+		KeyType:  nftables.TypeIPAddr,
+		Interval: true,
+	}
+	if err := nft.AddSet(set, prefixSetElements(prefixes)); err != nil {
+		return fmt.Errorf("[rules] failed to add dns redirect set: %w", err)
+	}
+
+	embeddedDNS := netip.MustParseAddr(dockerEmbeddedDNS).As4()
+	for _, proto := range []byte{unix.IPPROTO_UDP, unix.IPPROTO_TCP} {
+		nft.AddRule(&nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: []expr.Any{
+				// ip saddr @dns_redirect_src
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+				&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+				// ip daddr != 127.0.0.11
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: embeddedDNS[:]},
+				// fib daddr type local
+				&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+				// meta l4proto udp/tcp th dport 53
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(53)},
+				// redirect to :port
+				&expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(port)},
+				&expr.Redir{RegisterProtoMin: 1},
+			},
+		})
+	}
+	return nil
+}
+
+// addDNSFallbackRules redirects the DNS queries of the LAN, which the clash tun
+// hijacks normally, to the fallback forwarder. The bypass sources are not
+// intercepted by clash and keep their DNS servers.
+func addDNSFallbackRules(nft nftBuilder, table *nftables.Table, port uint16) {
+	chain := nft.AddChain(&nftables.Chain{
+		Name:     ChainDNSFallback,
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	})
+
+	for _, proto := range []byte{unix.IPPROTO_UDP, unix.IPPROTO_TCP} {
+		nft.AddRule(&nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: []expr.Any{
+				// meta mark != BypassMark
+				&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(BypassMark)},
+				// meta l4proto udp/tcp th dport 53
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(53)},
+				// redirect to :port
+				&expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(port)},
+				&expr.Redir{RegisterProtoMin: 1},
+			},
+		})
+	}
+}
+
+// prefixSetElements returns the interval set elements of the prefixes of one
+// family, ipv4 or ipv6.
+func prefixSetElements(prefixes []netip.Prefix) []nftables.SetElement {
+	var elements []nftables.SetElement
+	for _, p := range prefixes {
+		start := p.Masked().Addr()
+		elements = append(elements, nftables.SetElement{Key: start.AsSlice()})
+
+		end := lastAddr(p).Next()
+		if !end.IsValid() {
+			// the last address of the family, the interval stays open
+			continue
+		}
+		elements = append(elements, nftables.SetElement{Key: end.AsSlice(), IntervalEnd: true})
+	}
+	return elements
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	a := p.Masked().Addr().AsSlice()
+	for i := range a {
+		if bits := p.Bits() - i*8; bits <= 0 {
+			a[i] = 0xff
+		} else if bits < 8 {
+			a[i] |= 0xff >> bits
+		}
+	}
+	addr, _ := netip.AddrFromSlice(a)
+	return addr
+}
+
+func newBypassIPRule(family int) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Priority = BypassRulePriority
+	rule.Mark = BypassMark
+	rule.Table = unix.RT_TABLE_MAIN
+	return rule
+}
+
+func setBypassIPRule(family int, enable bool) error {
+	rules, err := netlink.RuleList(family)
+	if err != nil {
+		return fmt.Errorf("[rules] failed to list ip rules: %w", err)
+	}
+
+	ip := "ip"
+	if family == unix.AF_INET6 {
+		ip = "ip -6"
+	}
+	exist := hasBypassIPRule(rules)
+	switch {
+	case enable && !exist:
+		logrus.Debugf("[rules] add %s rule: fwmark %#x lookup main pref %d", ip, BypassMark, BypassRulePriority)
+		if err = netlink.RuleAdd(newBypassIPRule(family)); err != nil {
+			return fmt.Errorf("[rules] failed to add %s rule: %w", ip, err)
+		}
+	case !enable && exist:
+		logrus.Debugf("[rules] delete %s rule: fwmark %#x lookup main pref %d", ip, BypassMark, BypassRulePriority)
+		if err = netlink.RuleDel(newBypassIPRule(family)); err != nil {
+			return fmt.Errorf("[rules] failed to delete %s rule: %w", ip, err)
+		}
+	}
+	return nil
+}
+
+// bypassIPRuleExists reports whether the bypass ip rule is installed.
+func bypassIPRuleExists() bool {
+	return familyBypassIPRuleExists(unix.AF_INET)
+}
+
+func familyBypassIPRuleExists(family int) bool {
+	rules, err := netlink.RuleList(family)
+	if err != nil {
+		return false
+	}
+	return hasBypassIPRule(rules)
+}
+
+func hasBypassIPRule(rules []netlink.Rule) bool {
+	for _, r := range rules {
+		if r.Priority == BypassRulePriority && r.Mark == BypassMark {
+			return true
+		}
+	}
+	return false
+}
+
+// rulesCheckInterval is how often WatchRules verifies the tpclash rules.
+const rulesCheckInterval = 30 * time.Second
+
+// WatchRules applies the rules again when they are changed outside of
+// tpclash, e.g. by a firewall reload or an `nft flush ruleset`.
+func WatchRules(ctx context.Context) {
+	ticker := time.NewTicker(rulesCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := RepairRules(); err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+// RepairRules applies the rules again if the table, the rules of a chain or
+// the bypass ip rule do not match the rule state, it reports whether the rules
+// were applied.
+func RepairRules() (bool, error) {
+	ruleState.Lock()
+	defer ruleState.Unlock()
+
+	intact, err := rulesIntact()
+	if err != nil || intact {
+		return false, err
+	}
+	logrus.Warn("[rules] the tpclash rules were changed outside of tpclash, applying them again...")
+	err = applyRules(context.Background())
+	Audit(AuditSourceSchedule, "repair", "rules.apply", "", err)
+	return true, err
+}
+
+// expectedChains returns the number of rules in each chain built from the
+// rule state, the caller holds ruleState.
+func expectedChains() map[string]int {
+	chains := map[string]int{}
+	if ruleState.flushed {
+		return chains
+	}
+	if len(mergeBypassSources()) > 0 {
+		chains[ChainBypass]++
+	}
+	if ruleState.udpBypass {
+		chains[ChainBypass]++
+	}
+	if len(ruleState.dnsSources) > 0 && (ruleState.dnsPort > 0 || ruleState.dnsFallbackPort > 0) {
+		// udp and tcp
+		chains[ChainDNSRedirect] = 2
+	}
+	if ruleState.dnsFallbackPort > 0 {
+		chains[ChainDNSFallback] = 2
+	}
+	return chains
+}
+
+// expectedChains6 is expectedChains of the ipv6 table.
+func expectedChains6() map[string]int {
+	chains := map[string]int{}
+	if !ruleState.flushed && (len(mergePrefixes6(ruleState.lan6)) > 0 || len(mergeBypassSources6()) > 0) {
+		chains[ChainBypass] = 1
+	}
+	return chains
+}
+
+// rulesIntact reports whether the installed rules match the rule state, the
+// caller holds ruleState.
+func rulesIntact() (bool, error) {
+	nft, err := nftables.New()
+	if err != nil {
+		return false, fmt.Errorf("[rules] failed connect to nftables: %v", err)
+	}
+	intact, err := tableIntact(nft, nftables.TableFamilyIPv4, unix.AF_INET, expectedChains())
+	if err != nil || !intact {
+		return false, err
+	}
+	return tableIntact(nft, nftables.TableFamilyIPv6, unix.AF_INET6, expectedChains6())
+}
+
+// tableIntact reports whether the tpclash table and the bypass ip rule of a
+// family match the expected chains.
+func tableIntact(nft *nftables.Conn, family nftables.TableFamily, ipFamily int, want map[string]int) (bool, error) {
+	tables, err := nft.ListTablesOfFamily(family)
+	if err != nil {
+		return false, fmt.Errorf("[rules] failed to list nftables tables: %w", err)
+	}
+	var table *nftables.Table
+	for _, t := range tables {
+		if t.Name == TableTPClash {
+			table = t
+		}
+	}
+	if table == nil || len(want) == 0 {
+		// a table left without rule state is stale
+		return table == nil && len(want) == 0 && !familyBypassIPRuleExists(ipFamily), nil
+	}
+
+	chains, err := nft.ListChainsOfTableFamily(family)
+	if err != nil {
+		return false, fmt.Errorf("[rules] failed to list nftables chains: %w", err)
+	}
+	var found int
+	for _, c := range chains {
+		if c.Table.Name != TableTPClash {
+			continue
+		}
+		rules, err := nft.GetRules(table, c)
+		if err != nil {
+			return false, fmt.Errorf("[rules] failed to list the rules of chain %s: %w", c.Name, err)
+		}
+		if n, ok := want[c.Name]; !ok || len(rules) != n {
+			return false, nil
+		}
+		found++
+	}
+	return found == len(want) && familyBypassIPRuleExists(ipFamily) == (want[ChainBypass] > 0), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func prefixes(ss ...string) []netip.Prefix {
+	var ps []netip.Prefix
+	for _, s := range ss {
+		ps = append(ps, netip.MustParsePrefix(s))
+	}
+	return ps
+}
+
+func TestMergeFamilyPrefixes(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []netip.Prefix
+		v6   bool
+		want []netip.Prefix
+	}{
+		{name: "empty"},
+		{
+			name: "sorted and deduplicated",
+			in:   prefixes("192.168.2.0/24", "10.0.0.1/32", "192.168.2.0/24"),
+			want: prefixes("10.0.0.1/32", "192.168.2.0/24"),
+		},
+		{
+			name: "masked",
+			in:   prefixes("192.168.1.100/24"),
+			want: prefixes("192.168.1.0/24"),
+		},
+		{
+			name: "covered prefixes dropped",
+			in:   prefixes("192.168.1.10/32", "192.168.0.0/16", "192.168.1.0/24"),
+			want: prefixes("192.168.0.0/16"),
+		},
+		{
+			name: "ipv4 only",
+			in:   prefixes("10.0.0.0/8", "fd00::/8", "::ffff:10.0.0.1/128"),
+			want: prefixes("10.0.0.0/8"),
+		},
+		{
+			name: "ipv6 only",
+			in:   prefixes("10.0.0.0/8", "fd00::/8", "fd00:1::/64", "::ffff:10.0.0.1/128"),
+			v6:   true,
+			want: prefixes("fd00::/8"),
+		},
+		{
+			name: "everything",
+			in:   prefixes("0.0.0.0/0", "10.0.0.0/8", "::/0"),
+			want: prefixes("0.0.0.0/0"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeFamilyPrefixes(tt.in, tt.v6); !slices.Equal(got, tt.want) {
+				t.Fatalf("mergeFamilyPrefixes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefixSetElements(t *testing.T) {
+	type element struct {
+		key string
+		end bool
+	}
+	tests := []struct {
+		name string
+		in   []netip.Prefix
+		want []element
+	}{
+		{
+			name: "single address",
+			in:   prefixes("10.0.0.1/32"),
+			want: []element{{key: "10.0.0.1"}, {key: "10.0.0.2", end: true}},
+		},
+		{
+			name: "network",
+			in:   prefixes("192.168.1.0/24", "192.168.3.0/25"),
+			want: []element{{key: "192.168.1.0"}, {key: "192.168.2.0", end: true}, {key: "192.168.3.0"}, {key: "192.168.3.128", end: true}},
+		},
+		{
+			name: "unaligned",
+			in:   prefixes("172.16.7.9/12"),
+			want: []element{{key: "172.16.0.0"}, {key: "172.32.0.0", end: true}},
+		},
+		{
+			name: "open end ipv4",
+			in:   prefixes("0.0.0.0/0"),
+			want: []element{{key: "0.0.0.0"}},
+		},
+		{
+			name: "open end ipv6",
+			in:   prefixes("ff00::/8"),
+			want: []element{{key: "ff00::"}},
+		},
+		{
+			name: "ipv6",
+			in:   prefixes("2001:db8::/64"),
+			want: []element{{key: "2001:db8::"}, {key: "2001:db8:0:1::", end: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []element
+			for _, e := range prefixSetElements(tt.in) {
+				addr, ok := netip.AddrFromSlice(e.Key)
+				if !ok {
+					t.Fatalf("invalid element key %v", e.Key)
+				}
+				got = append(got, element{key: addr.String(), end: e.IntervalEnd})
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("prefixSetElements() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// rulesetMaxSize limits a downloaded rule list
+	rulesetMaxSize = 32 << 20
+	// rulesetPrepareTimeout bounds the download of the missing rule lists at
+	// startup, the providers fall back to their urls after it
+	rulesetPrepareTimeout = 30 * time.Second
+)
+
+// rulesetProvider is a rule list of a bundle.
+type rulesetProvider struct {
+	Name     string
+	Behavior string
+}
+
+// rulesetBundle is a community ruleset managed by --ruleset.
+type rulesetBundle struct {
+	Description string
+	// the url of a rule list is BaseURL + NAME + ".txt"
+	BaseURL string
+	// Match identifies the urls of the bundle in the configs, whatever mirror
+	// they are fetched from
+	Match     []string
+	Providers []rulesetProvider
+}
+
+var rulesetBundles = map[string]rulesetBundle{
+	"loyalsoldier": {
+		Description: "Loyalsoldier/clash-rules, the domain and ip lists of the china and proxy routing",
+		BaseURL:     "https://github.com/Loyalsoldier/clash-rules/releases/latest/download/",
+		Match:       []string{"Loyalsoldier/clash-rules"},
+		Providers: []rulesetProvider{
+			{"reject", "domain"},
+			{"icloud", "domain"},
+			{"apple", "domain"},
+			{"google", "domain"},
+			{"proxy", "domain"},
+			{"direct", "domain"},
+			{"private", "domain"},
+			{"gfw", "domain"},
+			{"tld-not-cn", "domain"},
+			{"telegramcidr", "ipcidr"},
+			{"cncidr", "ipcidr"},
+			{"lancidr", "ipcidr"},
+			{"applications", "classical"},
+		},
+	},
+}
+
+func (b rulesetBundle) url(p rulesetProvider) string {
+	return b.BaseURL + p.Name + ".txt"
+}
+
+func rulesetPath(bundle string, p rulesetProvider) string {
+	return filepath.Join(conf.ClashHome, rulesetDir, bundle, p.Name+".yaml")
+}
+
+// matchRuleset returns the rule list of the enabled bundles the url points to.
+func matchRuleset(u string) (string, rulesetProvider, bool) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", rulesetProvider{}, false
+	}
+	name := strings.TrimSuffix(path.Base(parsed.Path), path.Ext(parsed.Path))
+	for _, bundle := range conf.Rulesets {
+		b := rulesetBundles[bundle]
+		matched := false
+		for _, m := range b.Match {
+			matched = matched || strings.Contains(u, m)
+		}
+		if !matched {
+			continue
+		}
+		for _, p := range b.Providers {
+			if p.Name == name {
+				return bundle, p, true
+			}
+		}
+	}
+	return "", rulesetProvider{}, false
+}
+
+// lookupRuleset returns the rule list of the enabled bundles by its name.
+func lookupRuleset(name string) (string, rulesetProvider, bool) {
+	for _, bundle := range conf.Rulesets {
+		for _, p := range rulesetBundles[bundle].Providers {
+			if p.Name == name {
+				return bundle, p, true
+			}
+		}
+	}
+	return "", rulesetProvider{}, false
+}
+
+// rulesetProviderNode returns the rule provider of a rule list, the local
+// copy is used once it is downloaded.
+func rulesetProviderNode(bundle string, p rulesetProvider) (*yaml.Node, error) {
+	local := rulesetPath(bundle, p)
+	v := map[string]any{"type": "file", "behavior": p.Behavior, "path": local}
+	if _, err := os.Stat(local); err != nil {
+		v = map[string]any{"type": "http", "behavior": p.Behavior, "url": rulesetBundles[bundle].url(p), "path": local, "interval": 86400}
+	}
+	var n yaml.Node
+	if err := n.Encode(v); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// applyRulesets points the rule providers of the enabled bundles to the local
+// copies, the bundle lists referenced by RULE-SET rules are added when the
+// config does not define them.
+func applyRulesets(doc *yaml.Node) bool {
+	root := yamlRoot(doc)
+	if len(conf.Rulesets) == 0 || root == nil {
+		return false
+	}
+
+	_, providers := yamlMapGet(root, "rule-providers")
+	if providers == nil || providers.Kind != yaml.MappingNode {
+		providers = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	}
+	var n int
+	for i := 0; i+1 < len(providers.Content); i += 2 {
+		p := providers.Content[i+1]
+		_, u := yamlMapGet(p, "url")
+		if u == nil {
+			continue
+		}
+		bundle, rp, ok := matchRuleset(u.Value)
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(rulesetPath(bundle, rp)); err != nil {
+			continue
+		}
+		node, err := rulesetProviderNode(bundle, rp)
+		if err != nil {
+			logrus.Errorf("[ruleset] failed to encode %s: %v", providers.Content[i].Value, err)
+			continue
+		}
+		providers.Content[i+1] = node
+		n++
+	}
+
+	var added []string
+	for _, rule := range yamlRules(root) {
+		fields := strings.Split(rule, ",")
+		if len(fields) < 3 || strings.TrimSpace(fields[0]) != "RULE-SET" {
+			continue
+		}
+		name := strings.TrimSpace(fields[1])
+		if k, _ := yamlMapGet(providers, name); k != nil {
+			continue
+		}
+		bundle, rp, ok := lookupRuleset(name)
+		if !ok {
+			continue
+		}
+		node, err := rulesetProviderNode(bundle, rp)
+		if err != nil {
+			logrus.Errorf("[ruleset] failed to encode %s: %v", name, err)
+			continue
+		}
+		providers.Content = append(providers.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name}, node)
+		added = append(added, name)
+	}
+	if n == 0 && len(added) == 0 {
+		return false
+	}
+	if k, _ := yamlMapGet(root, "rule-providers"); k == nil {
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "rule-providers"}, providers)
+	}
+
+	logrus.Debugf("[ruleset] %d rule providers use the local copies, added: %v", n, added)
+	return true
+}
+
+// yamlRules returns the scalar rules of the config.
+func yamlRules(root *yaml.Node) []string {
+	_, rules := yamlMapGet(root, "rules")
+	if rules == nil || rules.Kind != yaml.SequenceNode {
+		return nil
+	}
+	var ss []string
+	for _, r := range rules.Content {
+		if r.Kind == yaml.ScalarNode {
+			ss = append(ss, r.Value)
+		}
+	}
+	return ss
+}
+
+// PrepareRulesets downloads the rule lists missing locally before the first
+// config is fixed, so the core starts with the local copies.
+func PrepareRulesets(ctx context.Context) {
+	var missing bool
+	for _, bundle := range conf.Rulesets {
+		for _, p := range rulesetBundles[bundle].Providers {
+			if _, err := os.Stat(rulesetPath(bundle, p)); err != nil {
+				missing = true
+			}
+		}
+	}
+	if !missing {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, rulesetPrepareTimeout)
+	defer cancel()
+	if _, err := UpdateRulesets(ctx); err != nil {
+		logrus.Warnf("%v, the missing lists are fetched by the core", err)
+	}
+}
+
+// WatchRulesets updates the rule lists every --ruleset-update-interval, and
+// asks the core to reload the providers of the updated ones.
+func WatchRulesets(ctx context.Context, confPath string) {
+	if len(conf.Rulesets) == 0 || conf.RulesetUpdateInterval <= 0 {
+		return
+	}
+	logrus.Infof("[ruleset] ruleset update scheduled, interval: %s", conf.RulesetUpdateInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(conf.RulesetUpdateInterval):
+		}
+
+		updated, err := UpdateRulesets(ctx)
+		if err != nil {
+			logrus.Error(err)
+		}
+		if len(updated) == 0 {
+			continue
+		}
+		err = reloadRulesetProviders(confPath, updated)
+		Audit(AuditSourceSchedule, "", "ruleset.reload", strings.Join(updated, ","), err)
+		if err != nil {
+			logrus.Error(err)
+		} else {
+			logrus.Infof("[ruleset] rule providers reloaded: %s", strings.Join(updated, ", "))
+		}
+	}
+}
+
+// UpdateRulesets downloads the rule lists of the enabled bundles and returns
+// the paths of the updated ones.
+func UpdateRulesets(ctx context.Context) ([]string, error) {
+	var updated []string
+	var errs []string
+	for _, bundle := range conf.Rulesets {
+		b := rulesetBundles[bundle]
+		if err := os.MkdirAll(filepath.Join(conf.ClashHome, rulesetDir, bundle), 0755); err != nil {
+			return nil, fmt.Errorf("[ruleset] failed to create the ruleset dir: %w", err)
+		}
+		for _, p := range b.Providers {
+			ok, err := updateRuleset(ctx, b.url(p), rulesetPath(bundle, p), p.Behavior)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s/%s: %v", bundle, p.Name, err))
+				continue
+			}
+			if ok {
+				updated = append(updated, rulesetPath(bundle, p))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return updated, fmt.Errorf("[ruleset] failed to update rulesets:\n %s", strings.Join(errs, "\n "))
+	}
+	return updated, nil
+}
+
+// updateRuleset downloads a rule list, it is verified by the checksum file
+// when published and by its content before the local copy is replaced.
+func updateRuleset(ctx context.Context, u, target, behavior string) (bool, error) {
+	checksum, err := geoChecksum(ctx, u)
+	if err != nil {
+		logrus.Debugf("[ruleset] %s: %v, checksum validation is skipped", path.Base(u), err)
+	}
+	if checksum != "" {
+		if sum, err := fileSHA256(target); err == nil && strings.EqualFold(sum, checksum) {
+			return false, nil
+		}
+	}
+
+	resp, err := geoGet(ctx, u)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	bs, err := io.ReadAll(io.LimitReader(resp.Body, rulesetMaxSize+1))
+	if err != nil {
+		return false, fmt.Errorf("failed to download: %w", err)
+	}
+	if len(bs) > rulesetMaxSize {
+		return false, fmt.Errorf("larger than %d bytes", rulesetMaxSize)
+	}
+
+	raw := sha256.Sum256(bs)
+	sum := hex.EncodeToString(raw[:])
+	if checksum != "" && !strings.EqualFold(sum, checksum) {
+		return false, fmt.Errorf("checksum mismatch: expected %s, got %s", checksum, sum)
+	}
+	count, err := verifyRuleset(bs, behavior)
+	if err != nil {
+		return false, err
+	}
+	if old, err := fileSHA256(target); err == nil && old == sum {
+		return false, nil
+	}
+	if err = writeFileAtomic(target, bytes.NewReader(bs), 0644); err != nil {
+		return false, err
+	}
+	logrus.Infof("[ruleset] %s updated, %d entries: %s", filepath.Base(target), count, sum)
+	return true, nil
+}
+
+// verifyRuleset checks the payload of a rule list against its behavior and
+// returns the number of the entries.
+func verifyRuleset(bs []byte, behavior string) (int, error) {
+	var list struct {
+		Payload []string `yaml:"payload"`
+	}
+	if err := yaml.Unmarshal(bs, &list); err != nil {
+		return 0, fmt.Errorf("invalid rule list: %w", err)
+	}
+	if len(list.Payload) == 0 {
+		return 0, errors.New("the rule list is empty")
+	}
+	for _, entry := range list.Payload {
+		var err error
+		switch behavior {
+		case "ipcidr":
+			_, err = netip.ParsePrefix(entry)
+		case "domain":
+			if entry == "" || strings.ContainsAny(entry, " ,/") {
+				err = errors.New("invalid domain")
+			}
+		case "classical":
+			if !strings.Contains(entry, ",") {
+				err = errors.New("invalid rule")
+			}
+		}
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s entry %q: %w", behavior, entry, err)
+		}
+	}
+	return len(list.Payload), nil
+}
+
+// reloadRulesetProviders asks the core to reload the rule providers of the
+// running config which read the updated local copies.
+func reloadRulesetProviders(confPath string, updated []string) error {
+	bs, err := os.ReadFile(confPath)
+	if err != nil {
+		return fmt.Errorf("[ruleset] failed to read clash config: %w", err)
+	}
+	var cc struct {
+		RuleProviders map[string]struct {
+			Path string `yaml:"path"`
+		} `yaml:"rule-providers"`
+	}
+	if err = decodeYAML(string(bs), &cc); err != nil {
+		return fmt.Errorf("[ruleset] failed to parse clash config: %w", err)
+	}
+	api, err := RunningAPI()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, name := range sortedKeys(cc.RuleProviders) {
+		p := cc.RuleProviders[name].Path
+		for _, u := range updated {
+			if p == u {
+				if err := api.Do(http.MethodPut, "/providers/rules/"+url.PathEscape(name), nil, nil); err != nil {
+					errs = append(errs, fmt.Errorf("[ruleset] failed to reload %s: %w", name, err))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CheckRulesetConf validates the --ruleset bundles.
+func CheckRulesetConf() error {
+	if len(conf.Rulesets) == 0 {
+		return nil
+	}
+	if CoreFlavor() == CoreSingBox {
+		return errors.New("[ruleset] --ruleset is not supported by sing-box")
+	}
+	for _, bundle := range conf.Rulesets {
+		if _, ok := rulesetBundles[bundle]; !ok {
+			return fmt.Errorf("[ruleset] unknown ruleset %q, must be one of %s", bundle, strings.Join(sortedKeys(rulesetBundles), ", "))
+		}
+	}
+	return nil
+}
+
+var rulesetOpts struct {
+	update bool
+}
+
+var rulesetCmd = &cobra.Command{
+	Use:   "ruleset",
+	Short: "Show the rule lists of --ruleset and their local copies",
+	Long: `Show the rule lists of --ruleset and their local copies.
+
+The rule lists of the bundles are downloaded to the clash home and refreshed
+every --ruleset-update-interval. The rule providers of the config fetching a
+list of a bundle(whatever mirror it uses) read the local copy instead, and the
+lists referenced by the RULE-SET rules are added to the rule providers when the
+config does not define them, e.g.:
+
+  rules:
+    - RULE-SET,reject,REJECT
+    - RULE-SET,proxy,PROXY
+    - RULE-SET,cncidr,DIRECT`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := CheckRulesetConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if len(conf.Rulesets) == 0 {
+			conf.Rulesets = sortedKeys(rulesetBundles)
+		}
+		if rulesetOpts.update {
+			if _, err := UpdateRulesets(context.Background()); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+
+		type rulesetInfo struct {
+			Bundle    string     `json:"bundle"`
+			Name      string     `json:"name"`
+			Behavior  string     `json:"behavior"`
+			URL       string     `json:"url"`
+			Path      string     `json:"path"`
+			UpdatedAt *time.Time `json:"updated_at,omitempty"`
+		}
+		var infos []rulesetInfo
+		for _, bundle := range conf.Rulesets {
+			b := rulesetBundles[bundle]
+			for _, p := range b.Providers {
+				info := rulesetInfo{Bundle: bundle, Name: p.Name, Behavior: p.Behavior, URL: b.url(p), Path: rulesetPath(bundle, p)}
+				if fi, err := os.Stat(info.Path); err == nil {
+					t := fi.ModTime()
+					info.UpdatedAt = &t
+				}
+				infos = append(infos, info)
+			}
+		}
+		if jsonOutput() {
+			printJSON(infos)
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "BUNDLE\tNAME\tBEHAVIOR\tUPDATED")
+		for _, info := range infos {
+			updated := "not downloaded"
+			if info.UpdatedAt != nil {
+				updated = info.UpdatedAt.Format(time.DateTime)
+			}
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", info.Bundle, info.Name, info.Behavior, updated)
+		}
+		_ = w.Flush()
+	},
+}
+
+func init() {
+	rulesetCmd.Flags().BoolVar(&rulesetOpts.update, "update", false, "download the rule lists before showing them")
+}
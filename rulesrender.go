@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// the rulesets `rules render` can print
+const (
+	RenderHost = "host"
+	RenderK8s  = "k8s"
+	RenderCNI  = "cni"
+)
+
+var renderOpts struct {
+	target       string
+	bypass       []string
+	dnsRedirect  []string
+	dnsPort      uint16
+	dnsFallback  uint16
+	udpBypass    bool
+	lan6         []string
+	proxyUID     int
+	redirPort    uint16
+	excludeCIDRs []string
+}
+
+var rulesCmd = &cobra.Command{
+	Use:   "rules",
+	Short: "Inspect the firewall rules of tpclash",
+}
+
+var rulesRenderCmd = &cobra.Command{
+	Use:   "render",
+	Short: "Print the ruleset tpclash installs for the flags",
+	Long: `Print the ruleset tpclash installs for the flags.
+
+The ruleset is built by the same code that installs it and printed in the
+netlink expression format of "nft --debug=netlink", nothing is read from the
+system so the output only depends on the flags and the tpclash version. Diff
+it against the golden file of a test or the output of another version before
+upgrading.
+
+The targets are:
+
+  host  the tpclash tables and ip rules, the bypass and dns redirect sources
+        are found from the containers at runtime and the ipv6 lan prefixes
+        from the interfaces, they are given by the flags here
+  k8s   the pod rules of k8s-init
+  cni   the node rules of the cni plugin`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := renderRules(os.Stdout); err != nil {
+			logrus.Fatal(err)
+		}
+	},
+}
+
+// renderRules builds the ruleset of --target and prints it to w.
+func renderRules(w io.Writer) error {
+	rec := &nftRecorder{}
+	var ipRules []string
+	switch renderOpts.target {
+	case RenderHost:
+		var bypass []netip.Prefix
+		for _, s := range renderOpts.bypass {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return fmt.Errorf("[rules] invalid cidr %q", s)
+			}
+			bypass = append(bypass, p)
+		}
+		dnsSources, err := parseRenderPrefixes(renderOpts.dnsRedirect)
+		if err != nil {
+			return err
+		}
+		var lan6 []netip.Prefix
+		for _, s := range renderOpts.lan6 {
+			p, err := netip.ParsePrefix(s)
+			if err != nil || !p.Addr().Is6() {
+				return fmt.Errorf("[rules] invalid cidr %q, must be an ipv6 cidr", s)
+			}
+			lan6 = append(lan6, p)
+		}
+		bypass, bypass6 := mergePrefixes(bypass), mergePrefixes6(bypass)
+		dnsSources, lan6 = mergePrefixes(dnsSources), mergePrefixes6(lan6)
+		spec := ruleSpec{bypass: bypass, dnsSources: dnsSources, dnsPort: renderOpts.dnsPort, fallbackPort: renderOpts.dnsFallback,
+			udpBypass: renderOpts.udpBypass, udpKeep: []netip.Prefix{netip.MustParsePrefix(enforceFakeIPRange).Masked()}, lan6: lan6, bypass6: bypass6}
+		if err = buildRules(rec, spec); err != nil {
+			return err
+		}
+		if err = buildRules6(rec, spec); err != nil {
+			return err
+		}
+		if len(bypass) > 0 || renderOpts.udpBypass {
+			ipRules = append(ipRules, fmt.Sprintf("ip rule add fwmark %#x lookup main pref %d", BypassMark, BypassRulePriority))
+		}
+		if len(lan6) > 0 || len(bypass6) > 0 {
+			ipRules = append(ipRules, fmt.Sprintf("ip -6 rule add fwmark %#x lookup main pref %d", BypassMark, BypassRulePriority))
+		}
+	case RenderK8s:
+		conf.K8sProxyUID, conf.K8sRedirPort, conf.K8sDNSPort = renderOpts.proxyUID, int(renderOpts.redirPort), int(renderOpts.dnsPort)
+		conf.K8sExcludeCIDRs = renderOpts.excludeCIDRs
+		if err := buildPodRules(rec); err != nil {
+			return err
+		}
+	case RenderCNI:
+		nc := &CNIConf{RedirPort: renderOpts.redirPort, DNSPort: renderOpts.dnsPort, ExcludeCIDRs: renderOpts.excludeCIDRs}
+		if err := cniCreateTable(rec, nc); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("[rules] invalid target %q, must be one of %s, %s, %s", renderOpts.target, RenderHost, RenderK8s, RenderCNI)
+	}
+
+	if len(rec.lines) == 0 {
+		rec.lines = append(rec.lines, "# no nftables rules are needed")
+	}
+	for _, l := range append(rec.lines, ipRules...) {
+		if _, err := fmt.Fprintln(w, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseRenderPrefixes(ss []string) ([]netip.Prefix, error) {
+	var ps []netip.Prefix
+	for _, s := range ss {
+		p, err := netip.ParsePrefix(s)
+		if err != nil || !p.Addr().Is4() {
+			return nil, fmt.Errorf("[rules] invalid cidr %q, must be an ipv4 cidr", s)
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// nftRecorder is the nftBuilder of `rules render`, the objects are printed in
+// the order they are added.
+type nftRecorder struct {
+	lines []string
+}
+
+func (r *nftRecorder) AddTable(t *nftables.Table) *nftables.Table {
+	r.lines = append(r.lines, fmt.Sprintf("table %s %s", familyName(t.Family), t.Name))
+	return t
+}
+
+func (r *nftRecorder) AddChain(c *nftables.Chain) *nftables.Chain {
+	l := fmt.Sprintf("chain %s %s %s", familyName(c.Table.Family), c.Table.Name, c.Name)
+	if c.Hooknum != nil {
+		l += fmt.Sprintf(" { type %s hook %s priority %d; }", c.Type, hookName(*c.Hooknum), priorityValue(c.Priority))
+	}
+	r.lines = append(r.lines, l)
+	return c
+}
+
+func (r *nftRecorder) AddSet(s *nftables.Set, vals []nftables.SetElement) error {
+	flags := ""
+	if s.Interval {
+		flags = " flags interval;"
+	}
+	r.lines = append(r.lines, fmt.Sprintf("set %s %s %s { type %s;%s }", familyName(s.Table.Family), s.Table.Name, s.Name, s.KeyType.Name, flags))
+	for _, e := range vals {
+		l := "\telement " + formatRenderKey(e.Key)
+		if e.IntervalEnd {
+			l += " interval-end"
+		}
+		r.lines = append(r.lines, l)
+	}
+	return nil
+}
+
+func (r *nftRecorder) AddRule(rule *nftables.Rule) *nftables.Rule {
+	r.lines = append(r.lines, fmt.Sprintf("rule %s %s %s", familyName(rule.Table.Family), rule.Table.Name, rule.Chain.Name))
+	for _, e := range rule.Exprs {
+		r.lines = append(r.lines, "\t[ "+formatExpr(e)+" ]")
+	}
+	return rule
+}
+
+func hookName(h nftables.ChainHook) string {
+	switch h {
+	case *nftables.ChainHookPrerouting:
+		return "prerouting"
+	case *nftables.ChainHookInput:
+		return "input"
+	case *nftables.ChainHookForward:
+		return "forward"
+	case *nftables.ChainHookOutput:
+		return "output"
+	case *nftables.ChainHookPostrouting:
+		return "postrouting"
+	}
+	return fmt.Sprint(uint32(h))
+}
+
+func priorityValue(p *nftables.ChainPriority) int32 {
+	if p == nil {
+		return 0
+	}
+	return int32(*p)
+}
+
+// formatRenderKey prints the ipv4 and ipv6 set keys as addresses.
+func formatRenderKey(key []byte) string {
+	if a, ok := netip.AddrFromSlice(key); ok && (len(key) == 4 || len(key) == 16) {
+		return a.String()
+	}
+	return "0x" + hex.EncodeToString(key)
+}
+
+// formatExpr prints the expressions used by the rule builders like
+// "nft --debug=netlink", the data is printed as bytes in the order they are
+// sent to the kernel.
+func formatExpr(e expr.Any) string {
+	switch e := e.(type) {
+	case *expr.Payload:
+		base := map[expr.PayloadBase]string{
+			expr.PayloadBaseLLHeader:        "link",
+			expr.PayloadBaseNetworkHeader:   "network",
+			expr.PayloadBaseTransportHeader: "transport",
+		}[e.Base]
+		return fmt.Sprintf("payload load %db @ %s header + %d => reg %d", e.Len, base, e.Offset, e.DestRegister)
+	case *expr.Meta:
+		key := map[expr.MetaKey]string{
+			expr.MetaKeyMARK:    "mark",
+			expr.MetaKeySKUID:   "skuid",
+			expr.MetaKeySKGID:   "skgid",
+			expr.MetaKeyL4PROTO: "l4proto",
+			expr.MetaKeyIIFNAME: "iifname",
+			expr.MetaKeyOIFNAME: "oifname",
+		}[e.Key]
+		if key == "" {
+			key = fmt.Sprint(uint32(e.Key))
+		}
+		if e.SourceRegister {
+			return fmt.Sprintf("meta set %s with reg %d", key, e.Register)
+		}
+		return fmt.Sprintf("meta load %s => reg %d", key, e.Register)
+	case *expr.Cmp:
+		op := map[expr.CmpOp]string{
+			expr.CmpOpEq:  "eq",
+			expr.CmpOpNeq: "neq",
+			expr.CmpOpLt:  "lt",
+			expr.CmpOpLte: "lte",
+			expr.CmpOpGt:  "gt",
+			expr.CmpOpGte: "gte",
+		}[e.Op]
+		return fmt.Sprintf("cmp %s reg %d 0x%s", op, e.Register, hex.EncodeToString(e.Data))
+	case *expr.Immediate:
+		return fmt.Sprintf("immediate reg %d 0x%s", e.Register, hex.EncodeToString(e.Data))
+	case *expr.Lookup:
+		l := fmt.Sprintf("lookup reg %d set %s", e.SourceRegister, e.SetName)
+		if e.Invert {
+			l += " 0x1"
+		}
+		return l
+	case *expr.Fib:
+		var flags []string
+		for _, f := range []struct {
+			set  bool
+			name string
+		}{{e.FlagSADDR, "saddr"}, {e.FlagDADDR, "daddr"}, {e.FlagMARK, "mark"}, {e.FlagIIF, "iif"}, {e.FlagOIF, "oif"}} {
+			if f.set {
+				flags = append(flags, f.name)
+			}
+		}
+		result := "oif"
+		switch {
+		case e.ResultADDRTYPE:
+			result = "type"
+		case e.ResultOIFNAME:
+			result = "oifname"
+		}
+		return fmt.Sprintf("fib %s %s => reg %d", strings.Join(flags, " . "), result, e.Register)
+	case *expr.Redir:
+		l := fmt.Sprintf("redir proto_min reg %d", e.RegisterProtoMin)
+		if e.RegisterProtoMax != 0 {
+			l += fmt.Sprintf(" proto_max reg %d", e.RegisterProtoMax)
+		}
+		return l
+	case *expr.Verdict:
+		kind := map[expr.VerdictKind]string{
+			expr.VerdictReturn: "return",
+			expr.VerdictGoto:   "goto",
+			expr.VerdictJump:   "jump",
+			expr.VerdictDrop:   "drop",
+			expr.VerdictAccept: "accept",
+		}[e.Kind]
+		if e.Chain != "" {
+			kind += " " + e.Chain
+		}
+		return "immediate reg 0 " + kind
+	}
+	return fmt.Sprintf("%T %+v", e, e)
+}
+
+func init() {
+	rulesCmd.AddCommand(rulesRenderCmd)
+
+	rulesRenderCmd.Flags().StringVar(&renderOpts.target, "target", RenderHost, "ruleset to render(host|k8s|cni)")
+	rulesRenderCmd.Flags().StringSliceVar(&renderOpts.bypass, "bypass", []string{}, "bypass source cidrs of the host ruleset(e.g. the opted out containers), the ipv6 ones go to the ip6 table")
+	rulesRenderCmd.Flags().StringSliceVar(&renderOpts.dnsRedirect, "dns-redirect", []string{}, "dns redirect source cidrs of the host ruleset(e.g. the docker bridges)")
+	rulesRenderCmd.Flags().Uint16Var(&renderOpts.dnsPort, "dns-port", 1053, "clash dns port the queries are redirected to(0 to disable)")
+	rulesRenderCmd.Flags().Uint16Var(&renderOpts.dnsFallback, "dns-fallback-port", 0, "render the host ruleset with the dns queries redirected to the fallback forwarder on the port")
+	rulesRenderCmd.Flags().BoolVar(&renderOpts.udpBypass, "udp-bypass", false, "render the host ruleset with the udp traffic bypassed except dns and the fake ips")
+	rulesRenderCmd.Flags().StringSliceVar(&renderOpts.lan6, "lan6", []string{}, "ipv6 lan prefixes of the host ruleset(see --ipv6-bypass-lan)")
+	rulesRenderCmd.Flags().IntVar(&renderOpts.proxyUID, "proxy-uid", 1337, "uid of the clash process of the k8s ruleset")
+	rulesRenderCmd.Flags().Uint16Var(&renderOpts.redirPort, "redir-port", 7892, "clash redir-port of the k8s and cni rulesets")
+	rulesRenderCmd.Flags().StringSliceVar(&renderOpts.excludeCIDRs, "exclude-cidrs", []string{}, "destination cidrs that are not redirected of the k8s and cni rulesets")
+}
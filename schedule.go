@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// the actions of a schedule
+const (
+	ScheduleMode      = "mode"
+	ScheduleBypass    = "bypass"
+	ScheduleIntercept = "intercept"
+	ScheduleSelect    = "select"
+)
+
+// bypassOwnerSchedule registers the sources bypassed by the schedules.
+const bypassOwnerSchedule = "schedule"
+
+const (
+	// scheduleCatchUp is how far back the schedules are looked up when tpclash
+	// starts, the weekly schedules are covered
+	scheduleCatchUp = 8 * 24 * time.Hour
+	// scheduleLookAhead is how far the next run of a schedule is searched
+	scheduleLookAhead = 366 * 24 * time.Hour
+	// scheduleAPIWait is how long the startup waits for the clash api
+	scheduleAPIWait = 30 * time.Second
+)
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronDays   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// cronSpec is a parsed cron expression, each field is a bitset of the
+// allowed values.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// the day of month and week match if either does when both are
+	// restricted, like cron
+	domAny, dowAny bool
+}
+
+// parseCron parses the 5 field cron expressions(minute hour day-of-month
+// month day-of-week) and the @ descriptors.
+func parseCron(s string) (*cronSpec, error) {
+	if d, ok := cronDescriptors[s]; ok {
+		s = d
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q, must have 5 fields", s)
+	}
+	c := &cronSpec{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, err
+	}
+	// 7 is sunday too
+	if c.dow, err = parseCronField(fields[4], 0, 7, cronDays); err != nil {
+		return nil, err
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// parseCronField parses a list of values, ranges and steps(e.g. "1-5,*/15"),
+// names are the values from first.
+func parseCronField(s string, first, last int, names []string) (uint64, error) {
+	value := func(v string) (int, error) {
+		if i := slices.Index(names, strings.ToLower(v)); i >= 0 {
+			return i + first, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < first || n > last {
+			return 0, fmt.Errorf("invalid cron value %q, must be %d-%d", v, first, last)
+		}
+		return n, nil
+	}
+
+	var set uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid cron step %q", part)
+			}
+			rng, step = part[:i], n
+		}
+		lo, hi := first, last
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = value(from); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = value(to); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// "5/15" is "5-last/15"
+				hi = last
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("invalid cron range %q", rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// Match reports whether the schedule runs in the minute of t.
+func (c *cronSpec) Match(t time.Time) bool {
+	if c.minute&(1<<t.Minute()) == 0 || c.hour&(1<<t.Hour()) == 0 || c.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dom, dow := c.dom&(1<<t.Day()) != 0, c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// Next returns the first run after t within d.
+func (c *cronSpec) Next(t time.Time, d time.Duration) (time.Time, bool) {
+	end := t.Add(d)
+	for m := t.Truncate(time.Minute).Add(time.Minute); !m.After(end); m = m.Add(time.Minute) {
+		if c.Match(m) {
+			return m, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Prev returns the last run at or before t within d.
+func (c *cronSpec) Prev(t time.Time, d time.Duration) (time.Time, bool) {
+	start := t.Add(-d)
+	for m := t.Truncate(time.Minute); !m.Before(start); m = m.Add(-time.Minute) {
+		if c.Match(m) {
+			return m, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// scheduleEntry is an action of --schedule.
+type scheduleEntry struct {
+	Raw    string
+	Cron   *cronSpec
+	Action string
+	// the mode of ScheduleMode, the sources of ScheduleBypass and
+	// ScheduleIntercept, the group and proxy of ScheduleSelect
+	Mode    string
+	Sources []netip.Prefix
+	Group   string
+	Proxy   string
+}
+
+// parseSchedule parses "CRON ACTION ARGS", the actions are:
+//
+//	mode rule|global|direct
+//	bypass IP|CIDR[,...]
+//	intercept IP|CIDR[,...]
+//	select GROUP=PROXY
+func parseSchedule(s string) (*scheduleEntry, error) {
+	e := &scheduleEntry{Raw: s}
+	rest := strings.TrimSpace(s)
+	var expr []string
+	n := 5
+	if strings.HasPrefix(rest, "@") {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		var f string
+		f, rest = cutField(rest)
+		expr = append(expr, f)
+	}
+	var err error
+	if e.Cron, err = parseCron(strings.Join(expr, " ")); err != nil {
+		return nil, err
+	}
+
+	e.Action, rest = cutField(rest)
+	if err = parseScheduleAction(e, rest); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// parseScheduleAction parses the arguments of e.Action.
+func parseScheduleAction(e *scheduleEntry, rest string) error {
+	switch e.Action {
+	case ScheduleMode:
+		e.Mode = strings.ToLower(rest)
+		if !slices.Contains(clashModes, e.Mode) {
+			return fmt.Errorf("invalid mode %q, must be one of %s", rest, strings.Join(clashModes, "|"))
+		}
+	case ScheduleBypass, ScheduleIntercept:
+		if rest == "" {
+			return fmt.Errorf("%s requires the source ips or cidrs", e.Action)
+		}
+		for _, src := range strings.Split(rest, ",") {
+			p, err := parseSourcePrefix(strings.TrimSpace(src))
+			if err != nil {
+				return err
+			}
+			e.Sources = append(e.Sources, p)
+		}
+	case ScheduleSelect:
+		// the names may contain spaces
+		group, proxy, ok := strings.Cut(rest, "=")
+		e.Group, e.Proxy = strings.TrimSpace(group), strings.TrimSpace(proxy)
+		if !ok || e.Group == "" || e.Proxy == "" {
+			return fmt.Errorf("select requires GROUP=PROXY")
+		}
+	default:
+		return fmt.Errorf("invalid action %q, must be one of %s, %s, %s, %s", e.Action, ScheduleMode, ScheduleBypass, ScheduleIntercept, ScheduleSelect)
+	}
+	return nil
+}
+
+func cutField(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i:])
+	}
+	return s, ""
+}
+
+// parseSourcePrefix parses an ipv4 address or cidr, the rules only handle
+// ipv4 sources.
+func parseSourcePrefix(s string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(s); err == nil && addr.Is4() {
+		return netip.PrefixFrom(addr, 32), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil || !p.Addr().Is4() {
+		return netip.Prefix{}, fmt.Errorf("invalid source %q, must be an ipv4 address or cidr", s)
+	}
+	return p.Masked(), nil
+}
+
+// resources returns the keys of the state the entry changes, a later entry
+// of the same key overrides it.
+func (e *scheduleEntry) resources() []string {
+	switch e.Action {
+	case ScheduleMode:
+		return []string{"mode"}
+	case ScheduleSelect:
+		return []string{"select\x00" + e.Group}
+	}
+	var keys []string
+	for _, p := range e.Sources {
+		keys = append(keys, "source\x00"+p.String())
+	}
+	return keys
+}
+
+var schedules []*scheduleEntry
+
+var scheduleState = struct {
+	sync.Mutex
+	// the scheduled state, restored after a reload of the config
+	mode    string
+	selects map[string]string
+	bypass  map[netip.Prefix]bool
+}{selects: map[string]string{}, bypass: map[netip.Prefix]bool{}}
+
+// CheckScheduleConf parses the --schedule entries.
+func CheckScheduleConf() error {
+	schedules = nil
+	for _, s := range conf.Schedules {
+		e, err := parseSchedule(s)
+		if err != nil {
+			return fmt.Errorf("[schedule] invalid schedule %q: %w", s, err)
+		}
+		schedules = append(schedules, e)
+	}
+	return nil
+}
+
+// RunSchedule runs the actions of the schedules at their times until ctx is
+// done. The last action of every mode, group and source within
+// scheduleCatchUp is applied at startup, so a restart does not lose them.
+func RunSchedule(ctx context.Context) {
+	if len(schedules) == 0 {
+		return
+	}
+	logrus.Infof("[schedule] %d schedules loaded", len(schedules))
+	waitScheduleAPI(ctx)
+	catchUpSchedules(time.Now())
+
+	last := time.Now().Truncate(time.Minute)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(last.Add(time.Minute))):
+		}
+		now := time.Now().Truncate(time.Minute)
+		if now.Sub(last) > scheduleCatchUp {
+			// the host was suspended for long
+			catchUpSchedules(now)
+			last = now
+			continue
+		}
+		for m := last.Add(time.Minute); !m.After(now); m = m.Add(time.Minute) {
+			for _, e := range schedules {
+				if e.Cron.Match(m) {
+					runScheduleEntry(e)
+				}
+			}
+		}
+		last = now
+	}
+}
+
+func waitScheduleAPI(ctx context.Context) {
+	deadline := time.Now().Add(scheduleAPIWait)
+	for time.Now().Before(deadline) {
+		if api, err := RunningAPI(); err == nil && api.Do(http.MethodGet, "/version", nil, nil) == nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// catchUpSchedules applies the last run of every resource before now, in the
+// order they ran.
+func catchUpSchedules(now time.Time) {
+	type run struct {
+		at    time.Time
+		index int
+	}
+	latest := map[string]run{}
+	for i, e := range schedules {
+		at, ok := e.Cron.Prev(now, scheduleCatchUp)
+		if !ok {
+			continue
+		}
+		for _, key := range e.resources() {
+			if r, ok := latest[key]; !ok || !at.Before(r.at) {
+				latest[key] = run{at, i}
+			}
+		}
+	}
+
+	runs := map[int]time.Time{}
+	var order []int
+	for _, r := range latest {
+		if _, ok := runs[r.index]; !ok {
+			order = append(order, r.index)
+		}
+		runs[r.index] = r.at
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := runs[order[i]], runs[order[j]]
+		return a.Before(b) || (a.Equal(b) && order[i] < order[j])
+	})
+	for _, i := range order {
+		logrus.Infof("[schedule] catching up %q of %s", schedules[i].Raw, runs[i].Format(time.DateTime))
+		runScheduleEntry(schedules[i])
+	}
+}
+
+// runScheduleEntry applies the action and records it in the scheduled state.
+func runScheduleEntry(e *scheduleEntry) {
+	var err error
+	var target string
+	scheduleState.Lock()
+	defer scheduleState.Unlock()
+
+	switch e.Action {
+	case ScheduleMode:
+		target = e.Mode
+		scheduleState.mode = e.Mode
+		err = patchMode(e.Mode)
+	case ScheduleSelect:
+		target = e.Group + "=" + e.Proxy
+		scheduleState.selects[e.Group] = e.Proxy
+		err = selectScheduledProxy(e.Group, e.Proxy)
+	case ScheduleBypass, ScheduleIntercept:
+		var ss []string
+		for _, p := range e.Sources {
+			if e.Action == ScheduleBypass {
+				scheduleState.bypass[p] = true
+			} else {
+				delete(scheduleState.bypass, p)
+			}
+			ss = append(ss, p.String())
+		}
+		target = strings.Join(ss, ",")
+		err = applyScheduleBypass()
+	}
+
+	Audit(AuditSourceSchedule, "schedule", "schedule."+e.Action, target, err)
+	if err != nil {
+		logrus.Errorf("[schedule] failed to run %q: %v", e.Raw, err)
+		return
+	}
+	logrus.Infof("[schedule] %s %s", e.Action, target)
+}
+
+func selectScheduledProxy(group, proxy string) error {
+	api, err := RunningAPI()
+	if err != nil {
+		return err
+	}
+	return api.Do(http.MethodPut, "/proxies/"+url.PathEscape(group), map[string]string{"name": proxy}, nil)
+}
+
+func applyScheduleBypass() error {
+	var prefixes []netip.Prefix
+	for p := range scheduleState.bypass {
+		prefixes = append(prefixes, p)
+	}
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int { return a.Addr().Compare(b.Addr()) })
+	return SetBypassSources(bypassOwnerSchedule, prefixes)
+}
+
+// ReapplySchedule restores the scheduled mode and proxy selections after the
+// core loaded a config, the bypassed sources are kept by the rules.
+func ReapplySchedule() {
+	scheduleState.Lock()
+	defer scheduleState.Unlock()
+
+	if scheduleState.mode != "" {
+		if err := patchMode(scheduleState.mode); err != nil {
+			logrus.Errorf("[schedule] failed to restore %s mode: %v", scheduleState.mode, err)
+		}
+	}
+	for _, group := range sortedKeys(scheduleState.selects) {
+		if err := selectScheduledProxy(group, scheduleState.selects[group]); err != nil {
+			logrus.Errorf("[schedule] failed to restore the selection of %s: %v", group, err)
+		}
+	}
+}
+
+var scheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "Show the schedules of --schedule and their next runs",
+	Long: `Show the schedules of --schedule and their next runs.
+
+A schedule is "CRON ACTION", the cron expression has the 5 fields minute, hour,
+day of month, month and day of week(or one of @yearly, @monthly, @weekly,
+@daily and @hourly) in the local time. The actions are:
+
+  mode rule|global|direct      switch the mode of the core
+  bypass IP|CIDR[,...]         stop intercepting the sources, they go direct
+  intercept IP|CIDR[,...]      intercept the bypassed sources again
+  select GROUP=PROXY           select the proxy of a selector group
+
+e.g. the devices of the kids go direct after 22:00 on school days:
+
+  --schedule "0 22 * * 0-4 bypass 192.168.1.50,192.168.1.51"
+  --schedule "0 7 * * * intercept 192.168.1.50,192.168.1.51"`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := CheckScheduleConf(); err != nil {
+			logrus.Fatal(err)
+		}
+		if len(schedules) == 0 {
+			logrus.Fatal("[schedule] no --schedule is specified")
+		}
+
+		type scheduleInfo struct {
+			Schedule string     `json:"schedule"`
+			Next     *time.Time `json:"next,omitempty"`
+		}
+		now := time.Now()
+		var infos []scheduleInfo
+		for _, e := range schedules {
+			info := scheduleInfo{Schedule: e.Raw}
+			if next, ok := e.Cron.Next(now, scheduleLookAhead); ok {
+				info.Next = &next
+			}
+			infos = append(infos, info)
+		}
+		if jsonOutput() {
+			printJSON(infos)
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "NEXT\tSCHEDULE")
+		for _, info := range infos {
+			next := "never"
+			if info.Next != nil {
+				next = info.Next.Format("2006-01-02 15:04 Mon")
+			}
+			_, _ = fmt.Fprintf(w, "%s\t%s\n", next, info.Schedule)
+		}
+		_ = w.Flush()
+	},
+}
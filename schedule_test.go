@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{expr: "* * * * *"},
+		{expr: "*/15 9-17 * * mon-fri"},
+		{expr: "0 0 1,15 jan,jul *"},
+		{expr: "5/20 * * * 7"},
+		{expr: "@daily"},
+		{expr: "@hourly"},
+		{expr: "* * * *", wantErr: true},
+		{expr: "* * * * * *", wantErr: true},
+		{expr: "60 * * * *", wantErr: true},
+		{expr: "* 24 * * *", wantErr: true},
+		{expr: "* * 0 * *", wantErr: true},
+		{expr: "* * * 13 *", wantErr: true},
+		{expr: "* * * * 8", wantErr: true},
+		{expr: "*/0 * * * *", wantErr: true},
+		{expr: "10-5 * * * *", wantErr: true},
+		{expr: "* * * foo *", wantErr: true},
+		{expr: "@reboot", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := parseCron(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCron(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCronSpecMatch(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04 Mon", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		expr string
+		time string
+		want bool
+	}{
+		{expr: "* * * * *", time: "2024-03-05 12:34 Tue", want: true},
+		{expr: "*/15 9-17 * * mon-fri", time: "2024-03-05 09:45 Tue", want: true},
+		{expr: "*/15 9-17 * * mon-fri", time: "2024-03-05 09:46 Tue", want: false},
+		{expr: "*/15 9-17 * * mon-fri", time: "2024-03-05 18:00 Tue", want: false},
+		{expr: "*/15 9-17 * * mon-fri", time: "2024-03-09 10:00 Sat", want: false},
+		{expr: "5/20 * * * *", time: "2024-03-05 10:45 Tue", want: true},
+		{expr: "5/20 * * * *", time: "2024-03-05 10:00 Tue", want: false},
+		// 7 is sunday too
+		{expr: "0 8 * * 7", time: "2024-03-10 08:00 Sun", want: true},
+		{expr: "0 0 1 jan *", time: "2024-01-01 00:00 Mon", want: true},
+		{expr: "0 0 1 jan *", time: "2024-02-01 00:00 Thu", want: false},
+		// both days restricted: either matches
+		{expr: "0 0 13 * fri", time: "2024-03-13 00:00 Wed", want: true},
+		{expr: "0 0 13 * fri", time: "2024-03-15 00:00 Fri", want: true},
+		{expr: "0 0 13 * fri", time: "2024-03-14 00:00 Thu", want: false},
+		// only the day of week restricted
+		{expr: "0 0 * * fri", time: "2024-03-13 00:00 Wed", want: false},
+		{expr: "@weekly", time: "2024-03-10 00:00 Sun", want: true},
+		{expr: "@weekly", time: "2024-03-11 00:00 Mon", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr+"@"+tt.time, func(t *testing.T) {
+			c, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.Match(at(tt.time)); got != tt.want {
+				t.Fatalf("Match(%s) = %v, want %v", tt.time, got, tt.want)
+			}
+		})
+	}
+}
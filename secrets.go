@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// secretDir keeps the credentials of the installed service, they are passed
+// as the --NAME-file flags instead of the command line.
+const secretDir = "/etc/tpclash/secrets"
+
+// secretFlags are the root flags carrying credentials, each one has a
+// --NAME-file companion reading the value from a file, one value per line for
+// the repeatable flags.
+var secretFlags = []string{
+	"dashboard-user",
+	"dashboard-oidc-client-secret",
+	"dashboard-acme-dns",
+	"notify-secret",
+	"mqtt",
+	"controller-socket-token",
+	"metrics-push-token",
+	"sync-token",
+}
+
+// secretFiles holds the values of the --NAME-file flags.
+var secretFiles = map[string]*string{}
+
+// addSecretFileFlags registers the --NAME-file flags of the secret flags.
+func addSecretFileFlags(fs *pflag.FlagSet, names ...string) {
+	for _, name := range names {
+		secretFiles[name] = fs.String(name+"-file", "", fmt.Sprintf("read --%s from the specified file(keeps the secret out of the command line)", name))
+	}
+}
+
+// LoadSecretFiles sets the secret flags not set otherwise from their
+// --NAME-file flags.
+func LoadSecretFiles(fs *pflag.FlagSet) error {
+	for name, file := range secretFiles {
+		path := *file
+		f := fs.Lookup(name)
+		if path == "" || f == nil || f.Changed {
+			continue
+		}
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("[secret] failed to read --%s-file: %w", name, err)
+		}
+		values := []string{strings.TrimSpace(string(bs))}
+		if _, ok := f.Value.(pflag.SliceValue); ok {
+			values = nil
+			for _, line := range strings.Split(string(bs), "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					values = append(values, line)
+				}
+			}
+		}
+		for _, v := range values {
+			if err = fs.Set(name, v); err != nil {
+				return fmt.Errorf("[secret] invalid --%s-file: %w", name, err)
+			}
+		}
+		// the relative paths would break the installed service
+		if abs, err := filepath.Abs(path); err == nil {
+			*file = abs
+		}
+	}
+	return nil
+}
+
+// secretArgs returns the flags passing the secret flag name to the started
+// tpclash, the file written by writeSecretFiles unless --NAME-file is set.
+func secretArgs(name string) []string {
+	if path := *secretFiles[name]; path != "" {
+		return []string{"--" + name + "-file", path}
+	}
+	return []string{"--" + name + "-file", filepath.Join(secretDir, name)}
+}
+
+// writeSecretFiles writes the secret flags set without --NAME-file to
+// secretDir, the files referenced by secretArgs.
+func writeSecretFiles(fs *pflag.FlagSet) error {
+	for _, name := range secretFlags {
+		f := fs.Lookup(name)
+		if *secretFiles[name] != "" || f == nil {
+			continue
+		}
+		values := []string{f.Value.String()}
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			values = sv.GetSlice()
+		}
+		path := filepath.Join(secretDir, name)
+		if len(values) == 0 || values[0] == "" {
+			_ = os.Remove(path)
+			continue
+		}
+		if err := os.MkdirAll(secretDir, 0700); err != nil {
+			return fmt.Errorf("[secret] failed to create %s: %w", secretDir, err)
+		}
+		if err := os.WriteFile(path, []byte(strings.Join(values, "\n")+"\n"), 0600); err != nil {
+			return fmt.Errorf("[secret] failed to write %s: %w", path, err)
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			return fmt.Errorf("[secret] failed to chmod %s: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// the veth pairs between the router(the self test process) and the client
+	// and server namespaces
+	selftestLANHost = "st-lan0"
+	selftestLANPeer = "st-lan1"
+	selftestWANHost = "st-wan0"
+	selftestWANPeer = "st-wan1"
+
+	selftestDNSPort = 1053
+	selftestTimeout = 3 * time.Second
+)
+
+var (
+	selftestRouterLAN = netip.MustParsePrefix("10.99.0.1/24")
+	selftestClient    = netip.MustParsePrefix("10.99.0.2/24")
+	selftestRouterWAN = netip.MustParsePrefix("203.0.113.1/24")
+	selftestServer    = netip.MustParsePrefix("203.0.113.10/24")
+	// the answer of the stub dns server
+	selftestFakeIP = netip.MustParseAddr("198.18.0.1")
+)
+
+var selftestOpts struct {
+	netns   bool
+	inNetns bool
+}
+
+var selftestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Run the rule engine against a stub proxy in scratch network namespaces",
+	Long: `Run the rule engine against a stub proxy in scratch network namespaces.
+
+With --netns the self test runs in a new network namespace acting as the
+router, a client and a server namespace are connected to it with veth pairs.
+A stub proxy stands in for the core: the client traffic is routed to it by
+the policy routes of the core, and the real tpclash rules(dns redirect,
+bypass sources and the cleanup) are applied and verified with traffic from
+the client. The namespaces are removed when the self test exits, the host
+network is never changed.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if !selftestOpts.netns {
+			logrus.Fatal("[selftest] only the network namespace harness is supported, use --netns")
+		}
+		if selftestOpts.inNetns {
+			runSelftest()
+			return
+		}
+		if os.Geteuid() != 0 {
+			logrus.Fatal("[selftest] root is required to create the network namespaces")
+		}
+
+		// the whole self test runs in the new namespace, so that every
+		// thread(and the netlink sockets of the rule engine) uses it
+		childArgs := []string{"selftest", "--netns", "--in-netns", "--output", conf.Output, "--lang", conf.Lang}
+		if conf.Debug {
+			childArgs = append(childArgs, "--debug")
+		}
+		child := exec.Command("/proc/self/exe", childArgs...)
+		child.Stdin, child.Stdout, child.Stderr = os.Stdin, os.Stdout, os.Stderr
+		child.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET, Pdeathsig: syscall.SIGKILL}
+		if err := RunChild(child); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.ExitCode())
+			}
+			logrus.Fatalf("[selftest] failed to start the self test in a new network namespace: %v", err)
+		}
+	},
+}
+
+func runSelftest() {
+	lab, err := newSelftestLab()
+	if err != nil {
+		logrus.Fatalf("[selftest] failed to set up the network namespaces: %v", err)
+	}
+	defer lab.Close()
+
+	checks := lab.Run()
+	var failed int
+	for _, c := range checks {
+		if c.Status == SmokeFail {
+			failed++
+		}
+	}
+	if jsonOutput() {
+		printJSON(checks)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "CHECK\tSTATUS\tDETAIL")
+		for _, c := range checks {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", c.Name, c.Status, c.Detail)
+		}
+		_ = w.Flush()
+	}
+	if failed > 0 {
+		logrus.Fatalf("[selftest] %d of %d checks failed", failed, len(checks))
+	}
+}
+
+// selftestLab is the topology of the self test, the router is the namespace
+// of the process.
+type selftestLab struct {
+	client  int
+	server  int
+	closers []io.Closer
+}
+
+func newSelftestLab() (*selftestLab, error) {
+	l := &selftestLab{client: -1, server: -1}
+	if err := l.setup(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *selftestLab) setup() error {
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return err
+	}
+	if err = netlink.LinkSetUp(lo); err != nil {
+		return err
+	}
+	if l.client, err = newNetns(); err != nil {
+		return err
+	}
+	if l.server, err = newNetns(); err != nil {
+		return err
+	}
+	if err = addSelftestVeth(selftestLANHost, selftestLANPeer, l.client, selftestRouterLAN, selftestClient); err != nil {
+		return err
+	}
+	if err = addSelftestVeth(selftestWANHost, selftestWANPeer, l.server, selftestRouterWAN, selftestServer); err != nil {
+		return err
+	}
+	if err = os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		return err
+	}
+	// the source validation of the server replies looks up the core routes
+	// with the lan interface, unlike a tun route the stub route is local
+	if err = os.WriteFile("/proc/sys/net/ipv4/conf/"+selftestWANHost+"/accept_local", []byte("1"), 0644); err != nil {
+		return err
+	}
+
+	// the policy routes of the core, the lan traffic is delivered to the
+	// stub proxy instead of a tun device
+	rule := netlink.NewRule()
+	rule.Family = unix.AF_INET
+	rule.Priority = coreRuleIndex
+	rule.IifName = selftestLANHost
+	rule.Table = coreRouteTable
+	if err = netlink.RuleAdd(rule); err != nil {
+		return fmt.Errorf("failed to add the core ip rule: %w", err)
+	}
+	route := &netlink.Route{
+		LinkIndex: lo.Attrs().Index,
+		Dst:       &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+		Table:     coreRouteTable,
+		Type:      unix.RTN_LOCAL,
+		Scope:     netlink.SCOPE_HOST,
+	}
+	if err = netlink.RouteAdd(route); err != nil {
+		return fmt.Errorf("failed to add the core route: %w", err)
+	}
+
+	// the stub proxy answers with the original destination like a core, it
+	// replies from the addresses of other hosts
+	lc := net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		})
+		return errors.Join(err, serr)
+	}}
+	proxy, err := lc.Listen(context.Background(), "tcp4", ":80")
+	if err != nil {
+		return fmt.Errorf("failed to start the stub proxy: %w", err)
+	}
+	l.serveHTTP(proxy, func(r *http.Request) string {
+		return fmt.Sprintf("proxy %v", r.Context().Value(http.LocalAddrContextKey))
+	})
+
+	var server net.Listener
+	if err = inNetns(l.server, func() (err error) {
+		server, err = net.Listen("tcp4", ":80")
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to start the server: %w", err)
+	}
+	l.serveHTTP(server, func(*http.Request) string { return "direct" })
+
+	dns, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", selftestDNSPort))
+	if err != nil {
+		return fmt.Errorf("failed to start the stub dns server: %w", err)
+	}
+	l.closers = append(l.closers, dns)
+	go serveStubDNS(dns, selftestFakeIP)
+	return nil
+}
+
+func (l *selftestLab) serveHTTP(ln net.Listener, body func(*http.Request) string) {
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, body(r))
+		}),
+		ReadHeaderTimeout: selftestTimeout,
+	}
+	l.closers = append(l.closers, srv)
+	go func() { _ = srv.Serve(ln) }()
+}
+
+// Run applies the rules step by step and checks the traffic of the client,
+// every step builds on the rules of the previous one.
+func (l *selftestLab) Run() []SmokeCheck {
+	return []SmokeCheck{
+		smokeResult("intercept", l.checkIntercept(), "the client traffic reaches the stub proxy with the original destination"),
+		smokeResult("dns-redirect", l.checkDNSRedirect(), fmt.Sprintf("the queries to %s:53 are answered by the dns port %d", selftestRouterLAN.Addr(), selftestDNSPort)),
+		smokeResult("bypass", l.checkBypass(), "the bypassed client reaches the server directly"),
+		smokeResult("clean", l.checkClean(), "the tpclash table and the bypass ip rule are removed"),
+	}
+}
+
+func (l *selftestLab) checkIntercept() error {
+	canary := selftestServer.Addr().String()
+	body, err := l.get(canary)
+	return expectBody(body, err, "proxy "+canary+":80")
+}
+
+func (l *selftestLab) checkDNSRedirect() error {
+	if _, err := l.resolve(); err == nil {
+		return errors.New("the query is answered without the dns redirect rules")
+	}
+	if err := SetDNSPort(context.Background(), selftestDNSPort); err != nil {
+		return err
+	}
+	if err := SetDNSRedirectSources([]netip.Prefix{selftestClient.Masked()}); err != nil {
+		return err
+	}
+	addr, err := l.resolve()
+	if err != nil {
+		return err
+	}
+	if addr != selftestFakeIP.String() {
+		return fmt.Errorf("got %s, want %s", addr, selftestFakeIP)
+	}
+	return nil
+}
+
+func (l *selftestLab) checkBypass() error {
+	if err := SetBypassSources("selftest", []netip.Prefix{netip.PrefixFrom(selftestClient.Addr(), 32)}); err != nil {
+		return err
+	}
+	body, err := l.get(selftestServer.Addr().String())
+	if err = expectBody(body, err, "direct"); err != nil {
+		return err
+	}
+	if !bypassIPRuleExists() {
+		return errors.New("the bypass ip rule is missing")
+	}
+	return nil
+}
+
+func (l *selftestLab) checkClean() error {
+	if err := CleanRules(); err != nil {
+		return err
+	}
+	body, err := l.get(selftestServer.Addr().String())
+	if err = expectBody(body, err, "proxy"); err != nil {
+		return err
+	}
+	if _, err = l.resolve(); err == nil {
+		return errors.New("the query is still redirected")
+	}
+	return selftestCleaned()
+}
+
+// get fetches the http server at addr from the client.
+func (l *selftestLab) get(addr string) (string, error) {
+	cli := &http.Client{
+		Timeout: selftestTimeout,
+		Transport: &http.Transport{
+			DialContext:       l.dialClient,
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := cli.Get("http://" + addr + "/")
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	bs, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return string(bs), err
+}
+
+// resolve queries the router for an A record from the client.
+func (l *selftestLab) resolve() (string, error) {
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return l.dialClient(ctx, network, net.JoinHostPort(selftestRouterLAN.Addr().String(), "53"))
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+	defer cancel()
+	addrs, err := r.LookupNetIP(ctx, "ip4", "selftest.tpclash.")
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", errors.New("no address")
+	}
+	return addrs[0].String(), nil
+}
+
+func (l *selftestLab) dialClient(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	err = inNetns(l.client, func() error {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, network, addr)
+		return err
+	})
+	return conn, err
+}
+
+func (l *selftestLab) Close() {
+	for _, c := range l.closers {
+		_ = c.Close()
+	}
+	for _, ns := range []int{l.client, l.server} {
+		if ns >= 0 {
+			_ = unix.Close(ns)
+		}
+	}
+}
+
+func expectBody(body string, err error, want string) error {
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(body, want) {
+		return fmt.Errorf("got %q, want %q", body, want)
+	}
+	return nil
+}
+
+func selftestCleaned() error {
+	nft, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	tables, err := nft.ListTables()
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		if t.Name == TableTPClash {
+			return errors.New("the tpclash table is not removed")
+		}
+	}
+	if bypassIPRuleExists() {
+		return errors.New("the bypass ip rule is not removed")
+	}
+	return nil
+}
+
+// addSelftestVeth connects the namespace ns to the router with a veth pair,
+// the router is the default gateway of ns.
+func addSelftestVeth(host, peer string, ns int, hostAddr, peerAddr netip.Prefix) error {
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: host}, PeerName: peer}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("failed to add veth %s: %w", host, err)
+	}
+	if err := setLinkAddr(host, hostAddr); err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(peer)
+	if err != nil {
+		return err
+	}
+	if err = netlink.LinkSetNsFd(link, ns); err != nil {
+		return fmt.Errorf("failed to move veth %s: %w", peer, err)
+	}
+
+	return inNetns(ns, func() error {
+		lo, err := netlink.LinkByName("lo")
+		if err != nil {
+			return err
+		}
+		if err = netlink.LinkSetUp(lo); err != nil {
+			return err
+		}
+		if err = setLinkAddr(peer, peerAddr); err != nil {
+			return err
+		}
+		return netlink.RouteAdd(&netlink.Route{Gw: hostAddr.Addr().AsSlice()})
+	})
+}
+
+func setLinkAddr(name string, p netip.Prefix) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	addr, err := netlink.ParseAddr(p.String())
+	if err != nil {
+		return err
+	}
+	if err = netlink.AddrAdd(link, addr); err != nil {
+		return fmt.Errorf("failed to add address %s to %s: %w", p, name, err)
+	}
+	return netlink.LinkSetUp(link)
+}
+
+// newNetns creates an unnamed network namespace, it lives as long as the
+// returned fd is open(or a socket of it).
+func newNetns() (ns int, err error) {
+	err = onNetnsThread(func() error {
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			return err
+		}
+		ns, err = unix.Open("/proc/thread-self/ns/net", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		return err
+	})
+	return ns, err
+}
+
+// inNetns runs fn in the network namespace ns, the sockets created by fn stay
+// in the namespace.
+func inNetns(ns int, fn func() error) error {
+	return onNetnsThread(func() error {
+		if err := unix.Setns(ns, unix.CLONE_NEWNET); err != nil {
+			return err
+		}
+		return fn()
+	})
+}
+
+// onNetnsThread runs fn on a locked thread of its own and restores the
+// namespace of the thread, a thread which can not be restored is dropped by
+// the go runtime as it exits locked.
+func onNetnsThread(fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		orig, err := unix.Open("/proc/thread-self/ns/net", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer func() { _ = unix.Close(orig) }()
+
+		err = fn()
+		if serr := unix.Setns(orig, unix.CLONE_NEWNET); serr != nil {
+			errCh <- errors.Join(err, serr)
+			return
+		}
+		runtime.UnlockOSThread()
+		errCh <- err
+	}()
+	return <-errCh
+}
+
+// serveStubDNS answers every A query with addr and the other queries with an
+// empty answer.
+func serveStubDNS(pc net.PacketConn, addr netip.Addr) {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 12 {
+			continue
+		}
+		// the question ends after the name, the type and the class
+		end := 12
+		for end < n && buf[end] != 0 {
+			end += int(buf[end]) + 1
+		}
+		end += 5
+		if end > n {
+			continue
+		}
+
+		resp := append([]byte(nil), buf[:end]...)
+		resp[2] = 0x80 | buf[2]&0x01 // QR, RD
+		resp[3] = 0x80               // RA, NOERROR
+		binary.BigEndian.PutUint16(resp[4:], 1)
+		binary.BigEndian.PutUint16(resp[6:], 0)
+		binary.BigEndian.PutUint32(resp[8:], 0)
+		if binary.BigEndian.Uint16(buf[end-4:]) == 1 {
+			binary.BigEndian.PutUint16(resp[6:], 1)
+			a := addr.As4()
+			// name pointer to the question, A, IN, ttl 60, rdlength 4
+			resp = append(resp, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+			resp = append(resp, a[:]...)
+		}
+		_, _ = pc.WriteTo(resp, from)
+	}
+}
+
+func init() {
+	selftestCmd.Flags().BoolVar(&selftestOpts.netns, "netns", false, "run the self test in scratch network namespaces")
+	selftestCmd.Flags().BoolVar(&selftestOpts.inNetns, "in-netns", false, "run inside the scratch network namespace(internal)")
+	_ = selftestCmd.Flags().MarkHidden("in-netns")
+}
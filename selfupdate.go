@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	semver "github.com/hashicorp/go-version"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// release channels of self-update
+const (
+	ChannelStable = "stable"
+	ChannelBeta   = "beta"
+)
+
+const (
+	releaseChecksumsAsset = "checksums.txt"
+	releaseSignatureAsset = "checksums.txt.sig"
+)
+
+// updatePublicKey is the base64 ed25519 public key verifying the checksums
+// of the releases, it is embedded at build time(UPDATE_PUBLIC_KEY).
+var updatePublicKey string
+
+var selfUpdateOpts struct {
+	channel string
+	restart bool
+	force   bool
+}
+
+var selfUpdateCmd = &cobra.Command{
+	Use:   "self-update [VERSION]",
+	Short: "Update TPClash to the latest release of the channel",
+	Long: `Download the release asset matching this build, verify it against the
+checksums signed by the release key and replace the executable atomically.
+
+The stable channel follows the latest release, the beta channel also includes
+the pre-releases.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if selfUpdateOpts.channel != ChannelStable && selfUpdateOpts.channel != ChannelBeta {
+			logrus.Fatalf("[self-update] unsupported channel %s(%s|%s)", selfUpdateOpts.channel, ChannelStable, ChannelBeta)
+		}
+		if binName == "" {
+			logrus.Fatal("[self-update] the release asset of this build is unknown, please update it manually")
+		}
+		pub, err := base64.StdEncoding.DecodeString(updatePublicKey)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			logrus.Fatal("[self-update] this build has no release key embedded, the update can not be verified")
+		}
+
+		var release *githubRelease
+		switch {
+		case len(args) == 1:
+			release, err = fetchRelease(tpclashRepo, "tpclash", coreTag(args[0]))
+		case selfUpdateOpts.channel == ChannelBeta:
+			release, err = fetchLatestPrerelease(tpclashRepo)
+		default:
+			release, err = fetchRelease(tpclashRepo, "tpclash", "")
+		}
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		if len(args) == 0 && !selfUpdateOpts.force && !newerVersion(release.TagName, version) {
+			logrus.Infof("[self-update] tpclash %s is up to date(%s channel: %s)", version, selfUpdateOpts.channel, release.TagName)
+			return
+		}
+		logrus.Infof("[self-update] update tpclash: %s -> %s", version, release.TagName)
+
+		checksum, err := signedChecksum(release, ed25519.PublicKey(pub))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			logrus.Fatalf("[self-update] failed to get the executable path: %v", err)
+		}
+		if exe, err = filepath.EvalSymlinks(exe); err != nil {
+			logrus.Fatalf("[self-update] failed to resolve the executable path: %v", err)
+		}
+		if err = replaceExecutable(release, exe, checksum); err != nil {
+			Audit(AuditSourceCLI, "", "tpclash.update", release.TagName, err)
+			logrus.Fatal(err)
+		}
+		Audit(AuditSourceCLI, "", "tpclash.update", release.TagName, nil)
+		logrus.Infof("[self-update] tpclash %s installed: %s", release.TagName, exe)
+
+		if !selfUpdateOpts.restart {
+			fmt.Print(logo + T(msgUpgraded))
+			return
+		}
+		if err = RunChild(exec.Command("systemctl", "is-active", "--quiet", "tpclash")); err != nil {
+			logrus.Warn("[self-update] tpclash service is not active, restart tpclash manually to apply the update")
+			return
+		}
+		logrus.Info("[self-update] restarting tpclash service...")
+		if out, err := ChildOutput(exec.Command("systemctl", "restart", "tpclash")); err != nil {
+			logrus.Fatalf("[self-update] failed to restart tpclash service: %v: %s", err, bytes.TrimSpace(out))
+		}
+	},
+}
+
+// fetchLatestPrerelease returns the newest release including the pre-releases.
+func fetchLatestPrerelease(repo string) (*githubRelease, error) {
+	logrus.Info("[github] check out the tpclash releases from github...")
+	resp, err := http.Get(fmt.Sprintf(githubReleasesApi, repo))
+	if err != nil {
+		return nil, fmt.Errorf("[github] failed to request github api: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var releases []struct {
+		githubRelease
+		Draft bool `json:"draft"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&releases); err != nil {
+		return nil, fmt.Errorf("[github] failed to unmarshal response: %w", err)
+	}
+	for _, r := range releases {
+		if !r.Draft && r.TagName != "" {
+			return &r.githubRelease, nil
+		}
+	}
+	return nil, fmt.Errorf("[github] no tpclash release found: status %d", resp.StatusCode)
+}
+
+// newerVersion reports whether tag is newer than the running version, a
+// development build is always updated.
+func newerVersion(tag, current string) bool {
+	cur, err := semver.NewVersion(current)
+	if err != nil {
+		return true
+	}
+	target, err := semver.NewVersion(tag)
+	if err != nil {
+		return true
+	}
+	return target.GreaterThan(cur)
+}
+
+// signedChecksum verifies the signature of the checksums published with the
+// release and returns the checksum of the asset of this build.
+func signedChecksum(release *githubRelease, pub ed25519.PublicKey) (string, error) {
+	sums, err := downloadAsset(release, releaseChecksumsAsset, 1<<20)
+	if err != nil {
+		return "", err
+	}
+	sig, err := downloadAsset(release, releaseSignatureAsset, 1<<10)
+	if err != nil {
+		return "", err
+	}
+	// openssl writes the raw signature, base64 is accepted as well
+	if len(sig) != ed25519.SignatureSize {
+		if sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig))); err != nil {
+			return "", fmt.Errorf("[self-update] invalid signature of %s: %w", release.TagName, err)
+		}
+	}
+	if !ed25519.Verify(pub, sums, sig) {
+		return "", fmt.Errorf("[self-update] signature verification of %s checksums failed", release.TagName)
+	}
+	logrus.Infof("[self-update] checksums of %s signed by the release key", release.TagName)
+
+	sc := bufio.NewScanner(bytes.NewReader(sums))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == binName {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("[self-update] %s is not listed in the checksums of %s", binName, release.TagName)
+}
+
+func downloadAsset(release *githubRelease, name string, limit int64) ([]byte, error) {
+	asset, ok := release.asset(name)
+	if !ok {
+		return nil, fmt.Errorf("[self-update] asset %s not found in release %s", name, release.TagName)
+	}
+	resp, err := http.Get(releaseDownloadAddr(asset))
+	if err != nil {
+		return nil, fmt.Errorf("[self-update] failed to download %s: %w", name, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[self-update] failed to download %s: status %d", name, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, limit))
+}
+
+func releaseDownloadAddr(asset githubAsset) string {
+	if conf.UpgradeWithGhProxy {
+		return ghProxyAddr + asset.URL
+	}
+	return asset.URL
+}
+
+// replaceExecutable downloads the asset of this build next to exe, checks
+// it and renames it over exe, the running process keeps the old inode.
+func replaceExecutable(release *githubRelease, exe, checksum string) error {
+	asset, ok := release.asset(binName)
+	if !ok {
+		return fmt.Errorf("[self-update] asset %s not found in release %s", binName, release.TagName)
+	}
+	downAddr := releaseDownloadAddr(asset)
+	logrus.Infof("[self-update] start downloading file: %s", downAddr)
+
+	resp, err := http.Get(downAddr)
+	if err != nil {
+		return fmt.Errorf("[self-update] failed to download %s: %w", binName, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("[self-update] failed to download %s: status %d", binName, resp.StatusCode)
+	}
+
+	// the temp file must be on the same filesystem for the rename
+	tmpFile, err := os.CreateTemp(filepath.Dir(exe), ".tpclash-update-*")
+	if err != nil {
+		return fmt.Errorf("[self-update] failed to create temp file: %w", err)
+	}
+	defer func() {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+	}()
+
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(tmpFile, h), resp.Body); err != nil {
+		return fmt.Errorf("[self-update] failed to download %s: %w", binName, err)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, checksum) {
+		return fmt.Errorf("[self-update] checksum mismatch of %s: expected %s, got %s", binName, checksum, sum)
+	}
+	logrus.Infof("[self-update] checksum verified: %s", checksum)
+
+	if err = tmpFile.Chmod(0755); err != nil {
+		return fmt.Errorf("[self-update] failed to chmod temp file: %w", err)
+	}
+	if err = tmpFile.Sync(); err != nil {
+		return fmt.Errorf("[self-update] failed to sync temp file: %w", err)
+	}
+	if err = tmpFile.Close(); err != nil {
+		return fmt.Errorf("[self-update] failed to close temp file: %w", err)
+	}
+
+	// make sure the new executable runs on this host before swapping it in
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if out, err := ChildOutput(exec.CommandContext(ctx, tmpFile.Name(), "--version")); err != nil {
+		return fmt.Errorf("[self-update] the downloaded executable does not run: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	if err = os.Rename(tmpFile.Name(), exe); err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("[self-update] permission denied replacing %s, run it as root", exe)
+		}
+		return fmt.Errorf("[self-update] failed to replace %s: %w", exe, err)
+	}
+	return nil
+}
+
+func init() {
+	selfUpdateCmd.Flags().StringVar(&selfUpdateOpts.channel, "channel", ChannelStable, "release channel(stable|beta)")
+	selfUpdateCmd.Flags().BoolVar(&selfUpdateOpts.restart, "restart", false, "restart the tpclash service after the update")
+	selfUpdateCmd.Flags().BoolVar(&selfUpdateOpts.force, "force", false, "install the latest release even if it is not newer")
+}
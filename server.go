@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// endpointMuxes are the http endpoints of tpclash itself(metrics, health
+// checks, etc.) grouped by listen address, endpoints configured with the
+// same address share one listener.
+var endpointMuxes = map[string]*http.ServeMux{}
+
+func endpointMux(addr string) *http.ServeMux {
+	mux, ok := endpointMuxes[addr]
+	if !ok {
+		mux = http.NewServeMux()
+		endpointMuxes[addr] = mux
+	}
+	return mux
+}
+
+// ServeEndpoints serves the registered endpoints until ctx is done.
+func ServeEndpoints(ctx context.Context) {
+	for _, addr := range sortedKeys(endpointMuxes) {
+		srv := &http.Server{Addr: addr, Handler: endpointMuxes[addr], ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			<-ctx.Done()
+			_ = srv.Close()
+		}()
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logrus.Error(fmt.Errorf("[server] failed to serve on %s: %w", srv.Addr, err))
+			}
+		}()
+	}
+}
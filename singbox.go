@@ -0,0 +1,307 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// singBoxConf is the part of the sing-box config that tpclash cares about.
+type singBoxConf struct {
+	DNS struct {
+		FakeIP struct {
+			Enabled    bool   `json:"enabled"`
+			Inet4Range string `json:"inet4_range"`
+		} `json:"fakeip"`
+	} `json:"dns"`
+	Inbounds []struct {
+		Type       string `json:"type"`
+		Tag        string `json:"tag"`
+		Listen     string `json:"listen"`
+		ListenPort int    `json:"listen_port"`
+		AutoRoute  bool   `json:"auto_route"`
+		Stack      string `json:"stack"`
+	} `json:"inbounds"`
+	Route struct {
+		AutoDetectInterface bool   `json:"auto_detect_interface"`
+		DefaultInterface    string `json:"default_interface"`
+		DefaultMark         int    `json:"default_mark"`
+	} `json:"route"`
+	Experimental struct {
+		ClashAPI struct {
+			ExternalController string `json:"external_controller"`
+			ExternalUI         string `json:"external_ui"`
+			Secret             string `json:"secret"`
+		} `json:"clash_api"`
+	} `json:"experimental"`
+}
+
+// singBoxCore runs sing-box in front of the same interception rules, its
+// clash api compatibility serves the dashboard and the api based features.
+type singBoxCore struct{}
+
+func (c *singBoxCore) Name() string {
+	return CoreSingBox
+}
+
+func (c *singBoxCore) Binary() (string, error) {
+	return cachedCore(c)
+}
+
+func (c *singBoxCore) Repo() string {
+	return singBoxRepo
+}
+
+func (c *singBoxCore) AssetName(tag string) (string, error) {
+	arch, err := singBoxArch()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sing-box-%s-linux-%s.tar.gz", strings.TrimPrefix(tag, "v"), arch), nil
+}
+
+// Unpack extracts the sing-box executable from the release tarball.
+func (c *singBoxCore) Unpack(r io.Reader, w io.Writer) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = gr.Close() }()
+
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return errors.New("sing-box executable not found in release archive")
+		}
+		if err != nil {
+			return err
+		}
+		if filepath.Base(hdr.Name) == "sing-box" && hdr.Typeflag == tar.TypeReg {
+			_, err = io.Copy(w, tr)
+			return err
+		}
+	}
+}
+
+func (c *singBoxCore) CachePath() string {
+	return filepath.Join(conf.ClashHome, InternalSingBoxBinName)
+}
+
+func (c *singBoxCore) ConfigName() string {
+	return InternalSingBoxConfigName
+}
+
+func (c *singBoxCore) Args(confPath, home string) []string {
+	return []string{"run", "-c", confPath, "-D", home}
+}
+
+func (c *singBoxCore) Fix(s string) (string, error) {
+	return runPipeline(c.Stages(), s)
+}
+
+func (c *singBoxCore) Stages() []configStage {
+	return []configStage{
+		{Name: "template", Run: lenient(tplRendering)},
+		{Name: "script", Run: RunConfigScripts},
+		{Name: "clash-api", Run: lenient(patchSingBoxClashAPI)},
+	}
+}
+
+// patchSingBoxClashAPI points the clash api dashboard to the extracted ui if
+// the config does not specify one, --auto-fix only supports clash configs.
+func patchSingBoxClashAPI(s string) string {
+	if conf.AutoFixMode != "" {
+		logrus.Warn("[autofix] auto fix is not supported by sing-box core, skip...")
+	}
+
+	var root map[string]any
+	if err := json.Unmarshal([]byte(s), &root); err != nil {
+		logrus.Errorf("[autofix] failed to unmarshal sing-box config: %v", err)
+		return s
+	}
+
+	experimental, _ := root["experimental"].(map[string]any)
+	if experimental == nil {
+		return s
+	}
+	clashAPI, _ := experimental["clash_api"].(map[string]any)
+	if clashAPI == nil {
+		return s
+	}
+
+	var patched bool
+	if ui, _ := clashAPI["external_ui"].(string); ui == "" {
+		clashAPI["external_ui"] = UIDir()
+		patched = true
+	}
+	if secret, _ := clashAPI["secret"].(string); secret == "" && conf.EnforceConfig {
+		secret, err := ControllerSecret()
+		if err != nil {
+			logrus.Errorf("[enforce] failed to generate clash api secret: %v", err)
+		} else {
+			clashAPI["secret"] = secret
+			patched = true
+			logrus.Warnf("[enforce] clash api secret is missing, use the generated one(tpclash status --show-secret)")
+		}
+	}
+	if conf.ControllerMode != "" {
+		addr, _ := clashAPI["external_controller"].(string)
+		clashAPI["external_controller"] = loopbackController(addr)
+		patched = true
+	}
+	if addr, _ := clashAPI["external_controller"].(string); addr != "" {
+		secret, _ := clashAPI["secret"].(string)
+		if safe := safeController(addr, secret); safe != addr {
+			clashAPI["external_controller"] = safe
+			patched = true
+		}
+	}
+	if mode := PersistedMode(); mode != "" {
+		clashAPI["default_mode"] = strings.ToUpper(mode[:1]) + mode[1:]
+		patched = true
+		logrus.Infof("[mode] use the persisted mode: %s", mode)
+	}
+	if !patched {
+		return s
+	}
+
+	bs, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		logrus.Errorf("[autofix] failed to marshal sing-box config: %v", err)
+		return s
+	}
+	return string(bs)
+}
+
+// Parse translates the sing-box config to ClashConf.
+func (c *singBoxCore) Parse(s string) (*ClashConf, error) {
+	var sc singBoxConf
+	if err := json.Unmarshal([]byte(s), &sc); err != nil {
+		return nil, fmt.Errorf("[config] failed to unmarshal sing-box config: %w", err)
+	}
+
+	var cc ClashConf
+	cc.ExternalController = sc.Experimental.ClashAPI.ExternalController
+	cc.ExternalUI = sc.Experimental.ClashAPI.ExternalUI
+	cc.Secret = sc.Experimental.ClashAPI.Secret
+	cc.InterfaceName = sc.Route.DefaultInterface
+	cc.RoutingMark = sc.Route.DefaultMark
+	cc.Tun.AutoDetectInterface = sc.Route.AutoDetectInterface
+	if sc.DNS.FakeIP.Enabled {
+		cc.DNS.EnhancedMode = "fake-ip"
+		cc.DNS.FakeIPRange = sc.DNS.FakeIP.Inet4Range
+	}
+
+	for _, in := range sc.Inbounds {
+		switch {
+		case in.Type == "tun":
+			cc.Tun.Enable = true
+			cc.Tun.AutoRoute = cc.Tun.AutoRoute || in.AutoRoute
+			cc.Tun.Stack = in.Stack
+		case in.Type == "direct" && strings.Contains(in.Tag, "dns"):
+			listen := in.Listen
+			if listen == "" || listen == "::" {
+				listen = "0.0.0.0"
+			}
+			cc.DNS.Enable = true
+			cc.DNS.Listen = net.JoinHostPort(listen, strconv.Itoa(in.ListenPort))
+		}
+	}
+	return &cc, nil
+}
+
+// Check validates the sing-box config and translates it to ClashConf.
+func (c *singBoxCore) Check(s string) (*ClashConf, error) {
+	cc, err := c.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if !cc.Tun.Enable {
+		return nil, errors.New("[config] tun inbound must be configured in sing-box config(inbounds)")
+	}
+	if !cc.Tun.AutoRoute {
+		return nil, errors.New("[config] auto_route must be enabled in tun inbound(inbounds.auto_route)")
+	}
+	if cc.InterfaceName == "" && !cc.Tun.AutoDetectInterface {
+		return nil, errors.New("[config] route.default_interface or route.auto_detect_interface must be set(route)")
+	}
+	if cc.ExternalController == "" {
+		return nil, errors.New("[config] clash api must be enabled(experimental.clash_api.external_controller)")
+	}
+	if !conf.AllowStandardDNSPort && cc.DNSPort() == 53 {
+		return nil, errors.New("[config] please do not set DNS to listen on port 53(inbounds.listen_port)")
+	}
+
+	return cc, nil
+}
+
+// Reload signals sing-box, it reloads the config file on SIGHUP.
+func (c *singBoxCore) Reload(_ string, _ *ClashConf, proc *os.Process) error {
+	if proc == nil {
+		return errors.New("[config] sing-box process is not running")
+	}
+	if err := proc.Signal(syscall.SIGHUP); err != nil {
+		return fmt.Errorf("[config] failed to reload sing-box: %w", err)
+	}
+	return nil
+}
+
+func (c *singBoxCore) PatchSecret(s, secret string) (string, error) {
+	var root map[string]any
+	if err := json.Unmarshal([]byte(s), &root); err != nil {
+		return "", fmt.Errorf("[config] failed to unmarshal sing-box config: %w", err)
+	}
+	experimental, _ := root["experimental"].(map[string]any)
+	clashAPI, _ := experimental["clash_api"].(map[string]any)
+	if clashAPI == nil {
+		return "", errors.New("[config] clash api must be enabled(experimental.clash_api.external_controller)")
+	}
+	clashAPI["secret"] = secret
+
+	bs, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("[config] failed to marshal sing-box config: %w", err)
+	}
+	return string(bs), nil
+}
+
+func (c *singBoxCore) Redact(s string) (string, error) {
+	var root map[string]any
+	if err := json.Unmarshal([]byte(s), &root); err != nil {
+		return "", fmt.Errorf("[config] failed to unmarshal sing-box config: %w", err)
+	}
+	redactJSONValue(root)
+
+	bs, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("[config] failed to marshal sing-box config: %w", err)
+	}
+	return string(bs) + "\n", nil
+}
+
+func singBoxArch() (string, error) {
+	arch, err := mihomoArch()
+	if err != nil {
+		return "", err
+	}
+	switch arch {
+	case "amd64-compatible":
+		return "amd64", nil
+	case "amd64":
+		return "amd64v3", nil
+	}
+	return arch, nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// results of a smoke test check
+const (
+	SmokePass = "pass"
+	SmokeFail = "fail"
+	SmokeSkip = "skip"
+)
+
+// smokeConnWait is how long a probe waits for its connection to show up in
+// the connections api.
+const smokeConnWait = 3 * time.Second
+
+// errNotIntercepted is returned by waitSmokeConn if the core never saw the
+// connection.
+var errNotIntercepted = errors.New("not intercepted")
+
+var smokeOpts struct {
+	url      string
+	udp      string
+	dnsProbe string
+	timeout  time.Duration
+}
+
+// SmokeCheck is the result of a check of the smoke-test command.
+type SmokeCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+var smokeTestCmd = &cobra.Command{
+	Use:   "smoke-test",
+	Short: "Verify the interception of the running instance end to end",
+	Long: `Verify the interception of the running instance from this host.
+
+The probes do not use the proxy ports, they connect to the canaries directly
+and must show up in the connections of the core:
+
+  tcp        an http request to --url through the tproxy path
+  udp        an ntp request to --udp through the tproxy path
+  dns        a dns query to --dns-probe, where no server listens, answered by the core
+  fake-ip    the canary resolves to the fake-ip range and is reachable(fake-ip mode only)
+  dashboard  the dashboard of the core(and --dashboard-listen) answers`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		u, err := url.Parse(smokeOpts.url)
+		if err != nil || u.Scheme != "http" || u.Host == "" {
+			logrus.Fatalf("[smoke-test] invalid url %q, must be a plain http url", smokeOpts.url)
+		}
+		if smokeOpts.timeout <= 0 {
+			logrus.Fatal("[smoke-test] timeout must be positive")
+		}
+
+		cc, err := RunningConf()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		api := NewClashAPI(cc)
+		if err = api.Do(http.MethodGet, "/version", nil, nil); err != nil {
+			logrus.Fatalf("[smoke-test] the clash api is not reachable: %v", err)
+		}
+
+		checks := []SmokeCheck{
+			smokeTCP(api, u),
+			smokeUDP(api, smokeOpts.udp),
+			smokeDNS(smokeOpts.dnsProbe),
+			smokeFakeIP(cc, u),
+			smokeDashboard(api),
+		}
+
+		var failed int
+		for _, c := range checks {
+			if c.Status == SmokeFail {
+				failed++
+			}
+		}
+		if jsonOutput() {
+			printJSON(checks)
+		} else {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			_, _ = fmt.Fprintln(w, "CHECK\tSTATUS\tDETAIL")
+			for _, c := range checks {
+				_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", c.Name, c.Status, c.Detail)
+			}
+			_ = w.Flush()
+		}
+		if failed > 0 {
+			logrus.Fatalf("[smoke-test] %d of %d checks failed", failed, len(checks))
+		}
+	},
+}
+
+func smokeResult(name string, err error, detail string) SmokeCheck {
+	if err != nil {
+		return SmokeCheck{Name: name, Status: SmokeFail, Detail: err.Error()}
+	}
+	return SmokeCheck{Name: name, Status: SmokePass, Detail: detail}
+}
+
+// smokeTCP sends the http request over a connection dialed directly, the
+// connection must be handled by the core.
+func smokeTCP(api *ClashAPI, u *url.URL) SmokeCheck {
+	conn, err := net.DialTimeout("tcp", urlHostPort(u), smokeOpts.timeout)
+	if err != nil {
+		return smokeResult("tcp", err, "")
+	}
+	defer func() { _ = conn.Close() }()
+
+	c, err := waitSmokeConn(api, "tcp", conn.LocalAddr())
+	if err != nil {
+		return smokeResult("tcp", err, "")
+	}
+	status, err := smokeHTTP(conn, u)
+	if err != nil {
+		return smokeResult("tcp", err, "")
+	}
+	return smokeResult("tcp", nil, fmt.Sprintf("%s -> %s via %s, status %d", u.Host, conn.RemoteAddr(), c.Chain(), status))
+}
+
+// smokeUDP sends an ntp request, the session must be handled by the core. A
+// missing reply is reported but does not fail the check, not every proxy
+// relays udp.
+func smokeUDP(api *ClashAPI, target string) SmokeCheck {
+	conn, err := net.DialTimeout("udp", target, smokeOpts.timeout)
+	if err != nil {
+		return smokeResult("udp", err, "")
+	}
+	defer func() { _ = conn.Close() }()
+
+	// ntp v3 client request
+	req := make([]byte, 48)
+	req[0] = 0x1b
+	if _, err = conn.Write(req); err != nil {
+		return smokeResult("udp", err, "")
+	}
+	c, err := waitSmokeConn(api, "udp", conn.LocalAddr())
+	if err != nil {
+		return smokeResult("udp", err, "")
+	}
+	reply := "no reply"
+	_ = conn.SetReadDeadline(time.Now().Add(smokeOpts.timeout))
+	if n, err := conn.Read(make([]byte, 512)); err == nil && n >= 48 {
+		reply = "ntp reply received"
+	}
+	return smokeResult("udp", nil, fmt.Sprintf("%s via %s, %s", target, c.Chain(), reply))
+}
+
+// smokeDNS queries an address where no dns server listens, only a hijacked
+// query is answered.
+func smokeDNS(probe string) SmokeCheck {
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, probe)
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), smokeOpts.timeout)
+	defer cancel()
+	host := smokeHost()
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return smokeResult("dns", nil, fmt.Sprintf("query to %s hijacked, %s not found", probe, host))
+		}
+		return smokeResult("dns", fmt.Errorf("query to %s not hijacked: %w", probe, err), "")
+	}
+	return smokeResult("dns", nil, fmt.Sprintf("query to %s hijacked, %s -> %s", probe, host, strings.Join(addrs, ", ")))
+}
+
+// smokeFakeIP resolves the canary with the system resolver and connects to
+// the fake ip, the core maps it back to the host.
+func smokeFakeIP(cc *ClashConf, u *url.URL) SmokeCheck {
+	if cc.DNS.EnhancedMode != "fake-ip" {
+		return SmokeCheck{Name: "fake-ip", Status: SmokeSkip, Detail: "dns enhanced-mode is not fake-ip"}
+	}
+	fakeRange, err := netip.ParsePrefix(cc.DNS.FakeIPRange)
+	if err != nil {
+		return smokeResult("fake-ip", fmt.Errorf("invalid fake-ip-range %q", cc.DNS.FakeIPRange), "")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), smokeOpts.timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip4", u.Hostname())
+	if err != nil {
+		return smokeResult("fake-ip", err, "")
+	}
+	if len(addrs) == 0 || !fakeRange.Contains(addrs[0]) {
+		return smokeResult("fake-ip", fmt.Errorf("%s resolves to %v, not in %s(filtered by fake-ip-filter?)", u.Hostname(), addrs, fakeRange), "")
+	}
+
+	_, port, _ := net.SplitHostPort(urlHostPort(u))
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(addrs[0].String(), port), smokeOpts.timeout)
+	if err != nil {
+		return smokeResult("fake-ip", err, "")
+	}
+	defer func() { _ = conn.Close() }()
+	status, err := smokeHTTP(conn, u)
+	if err != nil {
+		return smokeResult("fake-ip", err, "")
+	}
+	return smokeResult("fake-ip", nil, fmt.Sprintf("%s -> %s, status %d", u.Hostname(), addrs[0], status))
+}
+
+// smokeDashboard requests the dashboard of the core and the one served by
+// --dashboard-listen, the redirects to the login count as reachable.
+func smokeDashboard(api *ClashAPI) SmokeCheck {
+	if err := api.Do(http.MethodGet, "/ui/", nil, nil); err != nil {
+		return smokeResult("dashboard", err, "")
+	}
+	detail := api.Addr + "/ui/"
+	if conf.DashboardListen == "" {
+		return smokeResult("dashboard", nil, detail)
+	}
+
+	addr := conf.DashboardListen
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			addr = net.JoinHostPort("127.0.0.1", port)
+		}
+	}
+	scheme := "http"
+	if conf.DashboardTLSCert != "" || len(conf.DashboardACME) > 0 {
+		scheme = "https"
+	}
+	cli := &http.Client{
+		Timeout:       smokeOpts.timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := cli.Get(scheme + "://" + addr + "/")
+	if err != nil {
+		return smokeResult("dashboard", err, "")
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return smokeResult("dashboard", fmt.Errorf("%s: status %d", addr, resp.StatusCode), "")
+	}
+	return smokeResult("dashboard", nil, fmt.Sprintf("%s, %s://%s status %d", detail, scheme, addr, resp.StatusCode))
+}
+
+// smokeHTTP sends a GET request of u over conn and returns the status code.
+func smokeHTTP(conn net.Conn, u *url.URL) (int, error) {
+	_ = conn.SetDeadline(time.Now().Add(smokeOpts.timeout))
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Close = true
+	if err = req.Write(conn); err != nil {
+		return 0, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return resp.StatusCode, fmt.Errorf("%s: status %d", u, resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// waitSmokeConn waits for the connection of the local address in the
+// connections api, the probe was not intercepted if it never shows up.
+func waitSmokeConn(api *ClashAPI, network string, local net.Addr) (clashConn, error) {
+	_, port, err := net.SplitHostPort(local.String())
+	if err != nil {
+		return clashConn{}, err
+	}
+	deadline := time.Now().Add(smokeConnWait)
+	for {
+		var resp struct {
+			Connections []clashConn `json:"connections"`
+		}
+		if err = api.Do(http.MethodGet, "/connections", nil, &resp); err != nil {
+			return clashConn{}, err
+		}
+		for _, c := range resp.Connections {
+			if c.Metadata.Network == network && c.Metadata.SourcePort == port {
+				return c, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return clashConn{}, fmt.Errorf("%s connection from port %s not seen by the core, %w", network, port, errNotIntercepted)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// smokeHost returns a random name, the answer of the core can not be cached
+// by a resolver in between.
+func smokeHost() string {
+	return "tpclash-" + strconv.FormatInt(time.Now().UnixNano(), 36) + ".example.com"
+}
+
+// urlHostPort returns the host:port of u with the default port of the scheme.
+func urlHostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+func init() {
+	smokeTestCmd.Flags().StringVar(&smokeOpts.url, "url", "http://www.gstatic.com/generate_204", "http canary of the tcp and fake-ip checks")
+	smokeTestCmd.Flags().StringVar(&smokeOpts.udp, "udp", "time.cloudflare.com:123", "ntp server used as the canary of the udp check")
+	smokeTestCmd.Flags().StringVar(&smokeOpts.dnsProbe, "dns-probe", "192.0.2.53:53", "address without a dns server(TEST-NET-1), only a hijacked query to it is answered")
+	smokeTestCmd.Flags().DurationVar(&smokeOpts.timeout, "timeout", 5*time.Second, "timeout of each check")
+}
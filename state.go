@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RuntimeState is the state of the running tpclash, it is persisted in the
+// clash home so that the subcommands(e.g. status) can report it.
+type RuntimeState struct {
+	PID       int       `json:"pid"`
+	Version   string    `json:"version"`
+	StartedAt time.Time `json:"started_at"`
+
+	Core struct {
+		Name      string    `json:"name"`
+		PID       int       `json:"pid"`
+		StartedAt time.Time `json:"started_at"`
+		Restarts  int       `json:"restarts"`
+	} `json:"core"`
+
+	Config struct {
+		Source   string    `json:"source"`
+		Hash     string    `json:"hash"`
+		LoadedAt time.Time `json:"loaded_at"`
+		Profile  string    `json:"profile,omitempty"`
+	} `json:"config"`
+
+	LastFetch struct {
+		Time  time.Time `json:"time"`
+		Error string    `json:"error,omitempty"`
+	} `json:"last_fetch"`
+
+	Rules struct {
+		Backend            string    `json:"backend"`
+		Applied            bool      `json:"applied"`
+		Error              string    `json:"error,omitempty"`
+		BypassSources      int       `json:"bypass_sources"`
+		DNSRedirectSources int       `json:"dns_redirect_sources"`
+		DNSFallback        bool      `json:"dns_fallback,omitempty"`
+		UDPBypass          bool      `json:"udp_bypass,omitempty"`
+		LANPrefixes6       []string  `json:"lan_prefixes6,omitempty"`
+		UpdatedAt          time.Time `json:"updated_at"`
+	} `json:"rules"`
+
+	DashboardBans []DashboardBan `json:"dashboard_bans,omitempty"`
+
+	HA *HAState `json:"ha,omitempty"`
+
+	Policies []PolicyState `json:"policies,omitempty"`
+
+	Quota *SubscriptionInfo `json:"quota,omitempty"`
+}
+
+var runtimeState = struct {
+	sync.Mutex
+	s       RuntimeState
+	enabled bool
+}{}
+
+// InitState starts recording the runtime state of this instance.
+func InitState() {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	runtimeState.enabled = true
+	runtimeState.s.PID = os.Getpid()
+	runtimeState.s.Version = version
+	runtimeState.s.StartedAt = time.Now()
+	runtimeState.s.Config.Source = redactURL(conf.ClashConfig)
+	if conf.SyncFrom != "" {
+		runtimeState.s.Config.Source = redactURL(conf.SyncFrom)
+	}
+	runtimeState.s.Rules.Backend = "nftables"
+	saveState()
+}
+
+// CurrentState returns a copy of the runtime state of this instance.
+func CurrentState() RuntimeState {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	return runtimeState.s
+}
+
+// UpdateState modifies the runtime state and persists it, it does nothing in
+// the subcommands.
+func UpdateState(fn func(s *RuntimeState)) {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	if !runtimeState.enabled {
+		return
+	}
+	fn(&runtimeState.s)
+	saveState()
+}
+
+// RemoveState removes the state file on exit.
+func RemoveState() {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	runtimeState.enabled = false
+	_ = os.Remove(filepath.Join(conf.ClashHome, stateFileName))
+}
+
+func saveState() {
+	bs, err := json.MarshalIndent(runtimeState.s, "", "  ")
+	if err != nil {
+		return
+	}
+
+	// DryRun reports the state file, nothing of a dry run is persisted
+	statePath := filepath.Join(conf.ClashHome, stateFileName)
+	err = hostChange("file", "", func() error {
+		if err := os.WriteFile(statePath+".tmp", bs, 0644); err != nil {
+			return err
+		}
+		return os.Rename(statePath+".tmp", statePath)
+	})
+	if err != nil {
+		logrus.Debugf("[state] failed to save runtime state: %v", err)
+	}
+}
+
+// LoadState reads the runtime state of the running tpclash.
+func LoadState() (*RuntimeState, error) {
+	bs, err := os.ReadFile(filepath.Join(conf.ClashHome, stateFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var s RuntimeState
+	if err = json.Unmarshal(bs, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// redactURL hides the query of a subscription url, it usually carries a token.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return s
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "redacted"
+	}
+	return u.Redacted()
+}
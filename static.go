@@ -1,67 +1,352 @@
 package main
 
 import (
+	"bufio"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/sirupsen/logrus"
 )
 
 //go:embed static
 var static embed.FS
 
-func extract(efs embed.FS, dirEntries []fs.DirEntry, origin, target string) error {
+// embeddedDashboards are the dashboard dirs of the embed FS, only the one
+// served by the core is extracted.
+var embeddedDashboards = []string{"official", "yacd", "metacubexd"}
+
+const (
+	// the embedded files compressed at build time(task compress-static) carry
+	// the suffix, they are decompressed on extraction
+	compressedSuffix  = ".zst"
+	extractBufferSize = 256 << 10
+)
+
+// extractManifest records the extracted files(relative to the clash home),
+// files unchanged since the last extraction are skipped and the files changed
+// by the user are kept.
+type extractManifest map[string]extractRecord
+
+// extractRecord is an extracted file: the sha256 digest of its embedded
+// (compressed) content and the digest, size and mtime of the file written.
+// User is set once the file is changed or replaced by the user.
+type extractRecord struct {
+	Embedded string    `json:"embedded"`
+	Written  string    `json:"written,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	ModTime  time.Time `json:"mod_time,omitempty"`
+	User     bool      `json:"user,omitempty"`
+}
+
+func loadExtractManifest() extractManifest {
+	m := make(extractManifest)
+	bs, err := os.ReadFile(filepath.Join(conf.ClashHome, extractManifestName))
+	if err != nil {
+		return m
+	}
+	if err = json.Unmarshal(bs, &m); err == nil {
+		return m
+	}
+	// the manifests of the older versions have the embedded digests only
+	var digests map[string]string
+	if json.Unmarshal(bs, &digests) != nil {
+		logrus.Warnf("[static] invalid extract manifest, extract all files: %v", err)
+		return make(extractManifest)
+	}
+	for rel, digest := range digests {
+		m[rel] = extractRecord{Embedded: digest}
+	}
+	return m
+}
+
+func (m extractManifest) save() error {
+	bs, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(conf.ClashHome, extractManifestName)
+	return hostChange("file", "write "+path, func() error { return os.WriteFile(path, bs, 0644) })
+}
+
+// extractJob is an embedded file to extract, target is without the
+// compression suffix.
+type extractJob struct {
+	origin     string
+	target     string
+	info       fs.FileInfo
+	compressed bool
+}
+
+// collectExtract creates the dirs of the embedded tree and returns the files
+// to extract, they are written concurrently afterwards.
+func collectExtract(efs embed.FS, dirEntries []fs.DirEntry, origin, target string) ([]extractJob, error) {
+	var jobs []extractJob
 	for _, dirEntry := range dirEntries {
 		info, err := dirEntry.Info()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		perm := info.Mode().Perm()
 
-		if dirEntry.IsDir() {
-			logrus.Debugf("[static] extract -> %s %s", filepath.Join(target, dirEntry.Name()), perm.String())
+		if !dirEntry.IsDir() {
+			name := dirEntry.Name()
+			compressed := strings.HasSuffix(name, compressedSuffix)
+			jobs = append(jobs, extractJob{
+				origin:     filepath.Join(origin, name),
+				target:     filepath.Join(target, strings.TrimSuffix(name, compressedSuffix)),
+				info:       info,
+				compressed: compressed,
+			})
+			continue
+		}
 
-			err := os.MkdirAll(filepath.Join(target, dirEntry.Name()), perm)
-			if err != nil {
-				return err
-			}
+		if origin == "static" && slices.Contains(embeddedDashboards, dirEntry.Name()) && filepath.Join(target, dirEntry.Name()) != UIDir() {
+			logrus.Debugf("[static] dashboard not used, skip -> %s", filepath.Join(target, dirEntry.Name()))
+			continue
+		}
 
-			entries, err := efs.ReadDir(filepath.Join(origin, dirEntry.Name()))
-			if err != nil {
-				return err
+		// dashboards downloaded by upgrade-ui must not be mixed with the embedded files
+		marker := filepath.Join(target, dirEntry.Name(), uiVersionFile)
+		if _, err := os.Stat(marker); err == nil {
+			if !conf.ForceExtract {
+				logrus.Debugf("[static] downloaded dashboard, skip -> %s", filepath.Join(target, dirEntry.Name()))
+				continue
 			}
+			_ = os.Remove(marker)
+		}
 
-			err = extract(efs, entries, filepath.Join(origin, dirEntry.Name()), filepath.Join(target, dirEntry.Name()))
-			if err != nil {
-				return err
-			}
-		} else {
-			sf, err := static.Open(filepath.Join(origin, dirEntry.Name()))
-			if err != nil {
-				return err
+		dir := filepath.Join(target, dirEntry.Name())
+		logrus.Debugf("[static] extract -> %s %s", dir, perm.String())
+
+		if _, err := os.Stat(dir); err != nil {
+			if err = hostChange("file", fmt.Sprintf("mkdir %s %s", dir, perm.String()), func() error { return os.MkdirAll(dir, perm) }); err != nil {
+				return nil, err
 			}
-			defer func() { _ = sf.Close() }()
+		}
+
+		entries, err := efs.ReadDir(filepath.Join(origin, dirEntry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		sub, err := collectExtract(efs, entries, filepath.Join(origin, dirEntry.Name()), filepath.Join(target, dirEntry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, sub...)
+	}
+	return jobs, nil
+}
 
-			logrus.Debugf("[static] extract -> %s %s", filepath.Join(target, dirEntry.Name()), perm.String())
-			df, err := os.OpenFile(filepath.Join(target, dirEntry.Name()), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+// extractAll extracts the files with one worker per cpu, the decompression
+// of the core dominates the first start on slow routers.
+func extractAll(efs embed.FS, jobs []extractJob, old, cur extractManifest) error {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for _, job := range jobs {
+		job := job
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+
+			rel, rec, err := extractFile(efs, job, old)
+			mu.Lock()
+			defer mu.Unlock()
 			if err != nil {
-				return err
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %w", job.origin, err)
+				}
+				return
 			}
-			defer func() { _ = df.Close() }()
+			cur[rel] = rec
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
 
-			_, err = io.Copy(df, sf)
-			if err != nil {
+// extractFile writes the file unless it is unchanged since the last
+// extraction. A file which is not the one written by the last extraction has
+// been changed by the user and is kept unless --force-extract is set.
+func extractFile(efs embed.FS, job extractJob, old extractManifest) (string, extractRecord, error) {
+	rel, err := filepath.Rel(conf.ClashHome, job.target)
+	if err != nil {
+		return "", extractRecord{}, err
+	}
+
+	sf, err := efs.Open(job.origin)
+	if err != nil {
+		return "", extractRecord{}, err
+	}
+	defer func() { _ = sf.Close() }()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, sf); err != nil {
+		return "", extractRecord{}, err
+	}
+	rec := extractRecord{Embedded: hex.EncodeToString(h.Sum(nil))}
+
+	if !conf.ForceExtract {
+		prev, ok := old[rel]
+		_, statErr := os.Stat(job.target)
+		var written string
+		var modified bool
+		if ok && statErr == nil {
+			written, modified = prev.modified(job.target)
+		}
+		switch {
+		case statErr != nil:
+			// missing or removed by the user, extracted again
+		case !ok:
+			// not extracted by tpclash, e.g. a core installed by the user
+			logrus.Warnf("[static] %s is not extracted by tpclash, keep it(--force-extract to replace it)", job.target)
+			return rel, extractRecord{Embedded: rec.Embedded, User: true}, nil
+		case prev.User:
+			logrus.Debugf("[static] changed by the user, skip -> %s", job.target)
+			prev.Embedded = rec.Embedded
+			return rel, prev, nil
+		case modified:
+			logrus.Warnf("[static] %s is changed by the user, keep it(--force-extract to restore it)", job.target)
+			prev.Embedded, prev.User = rec.Embedded, true
+			return rel, prev, nil
+		case prev.Embedded == rec.Embedded:
+			logrus.Debugf("[static] unchanged, skip -> %s", job.target)
+			prev.Written = written
+			return rel, prev.stat(job.target), nil
+		}
+	}
+
+	if _, err = sf.(io.Seeker).Seek(0, io.SeekStart); err != nil {
+		return "", extractRecord{}, err
+	}
+
+	perm := job.info.Mode().Perm()
+	err = hostChange("file", fmt.Sprintf("write %s %s(%d bytes embedded)", job.target, perm.String(), job.info.Size()), func() error {
+		logrus.Debugf("[static] extract -> %s %s", job.target, perm.String())
+		written, err := writeExtracted(job, sf, perm)
+		if err != nil {
+			return err
+		}
+		rec.Written = written
+		rec = rec.stat(job.target)
+		return nil
+	})
+	if err != nil {
+		return "", extractRecord{}, err
+	}
+	return rel, rec, nil
+}
+
+// writeExtracted writes the embedded file read from sf to the target of job,
+// it returns the digest of the written file.
+func writeExtracted(job extractJob, sf io.Reader, perm fs.FileMode) (string, error) {
+	var r io.Reader = bufio.NewReaderSize(sf, extractBufferSize)
+	if job.compressed {
+		// one goroutine per decoder, the files are already extracted in parallel
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return "", err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	df, err := os.OpenFile(job.target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = df.Close() }()
+
+	wh := sha256.New()
+	if _, err = io.CopyBuffer(io.MultiWriter(df, wh), r, make([]byte, extractBufferSize)); err != nil {
+		return "", err
+	}
+	if err = df.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(wh.Sum(nil)), nil
+}
+
+// modified returns the digest of the file at path and whether it is not the
+// one written by the extraction. The file is only read if its size or mtime
+// changed.
+func (r extractRecord) modified(path string) (string, bool) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", false
+	}
+	if r.Written != "" && st.Size() == r.Size && st.ModTime().Equal(r.ModTime) {
+		return r.Written, false
+	}
+	digest, err := fileSHA256(path)
+	if err != nil {
+		return "", false
+	}
+	// the older manifests do not know the written file, it is trusted once
+	return digest, r.Written != "" && digest != r.Written
+}
+
+// stat records the size and mtime of the file at path.
+func (r extractRecord) stat(path string) extractRecord {
+	if st, err := os.Stat(path); err == nil {
+		r.Size, r.ModTime = st.Size(), st.ModTime()
+	}
+	return r
+}
+
+// pruneExtracted removes the files extracted before which are not extracted
+// anymore, e.g. the dashboards not selected by --ui or the files removed from
+// the embed FS of a newer tpclash.
+func pruneExtracted(old, cur extractManifest) {
+	for rel := range old {
+		if _, ok := cur[rel]; ok {
+			continue
+		}
+		path := filepath.Join(conf.ClashHome, rel)
+		// a downloaded or a user-managed dashboard replaced the extracted one
+		top, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+		if _, err := os.Stat(filepath.Join(conf.ClashHome, top, uiVersionFile)); err == nil || strings.HasPrefix(path, UIDir()+string(filepath.Separator)) {
+			continue
+		}
+		err := hostChange("file", fmt.Sprintf("remove %s(not extracted anymore)", path), func() error {
+			logrus.Debugf("[static] remove -> %s", path)
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
 				return err
 			}
+			// the dirs are only removed if nothing else is in them
+			for d := filepath.Dir(rel); d != "."; d = filepath.Dir(d) {
+				if os.Remove(filepath.Join(conf.ClashHome, d)) != nil {
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			logrus.Warnf("[static] failed to remove %s: %v", path, err)
 		}
 	}
-
-	return nil
 }
 
+// ExtractFiles extracts the embedded core and dashboards into the clash home,
+// only the files changed since the last extraction are written unless
+// --force-extract is set. Nothing is extracted with --disable-extract.
 func ExtractFiles() {
 	logrus.Info("[static] creating storage dir...")
 	info, err := os.Stat(conf.ClashHome)
@@ -69,14 +354,9 @@ func ExtractFiles() {
 		if !info.IsDir() {
 			logrus.Fatalf("[static] clash home path is not a dir")
 		}
-
-		if !conf.ForceExtract {
-			logrus.Infof("[static] storage dir %s already exist, skip extract...", conf.ClashHome)
-			return
-		}
 	} else {
 		if os.IsNotExist(err) {
-			if err = os.MkdirAll(conf.ClashHome, 0755); err != nil {
+			if err = hostChange("file", "mkdir "+conf.ClashHome, func() error { return os.MkdirAll(conf.ClashHome, 0755) }); err != nil {
 				logrus.Fatalf("[static] failed to create storage dir: %v", err)
 			}
 		} else {
@@ -84,19 +364,31 @@ func ExtractFiles() {
 		}
 	}
 
+	if conf.DisableExtract {
+		logrus.Infof("[static] extraction is disabled, use the files in %s", conf.ClashHome)
+		return
+	}
+
 	logrus.Info("[static] copy static files...")
 	dirEntries, err := static.ReadDir("static")
 	if err != nil {
 		logrus.Fatalf("[static] failed to read embed dir: %v", err)
 	}
 
-	err = extract(static, dirEntries, "static", conf.ClashHome)
+	jobs, err := collectExtract(static, dirEntries, "static", conf.ClashHome)
 	if err != nil {
+		logrus.Fatalf("[static] failed to create the embed dirs: %v", err)
+	}
+	old, cur := loadExtractManifest(), make(extractManifest)
+	if err = extractAll(static, jobs, old, cur); err != nil {
 		logrus.Fatalf("[static] failed to extract embed files: %v", err)
 	}
-
-	err = os.Chmod(filepath.Join(conf.ClashHome, InternalClashBinName), 0755)
-	if err != nil {
+	pruneExtracted(old, cur)
+	if err = cur.save(); err != nil {
+		logrus.Warnf("[static] failed to save extract manifest: %v", err)
+	}
+	bin := filepath.Join(conf.ClashHome, InternalClashBinName)
+	if err = hostChange("file", "chmod 0755 "+bin, func() error { return os.Chmod(bin, 0755) }); err != nil {
 		logrus.Fatalf("[static] failed to update internal clash bin mode: %v", err)
 	}
 }
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var statusOpts struct {
+	showSecret bool
+	json       bool
+	clients    bool
+}
+
+// StatusReport is the output of the status command.
+type StatusReport struct {
+	Running bool          `json:"running"`
+	State   *RuntimeState `json:"state,omitempty"`
+
+	Controller  string `json:"controller"`
+	Secret      string `json:"secret"`
+	CoreVersion string `json:"core_version,omitempty"`
+	Mode        string `json:"mode,omitempty"`
+
+	Connections   int    `json:"connections"`
+	UploadTotal   uint64 `json:"upload_total"`
+	DownloadTotal uint64 `json:"download_total"`
+	Up            uint64 `json:"up"`
+	Down          uint64 `json:"down"`
+
+	APIError string `json:"api_error,omitempty"`
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the status of the running TPClash",
+	Run: func(cmd *cobra.Command, args []string) {
+		if statusOpts.clients {
+			printClients()
+			return
+		}
+
+		cc, err := RunningConf()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		report := collectStatus(cc)
+		if !statusOpts.showSecret {
+			report.Secret = maskSecret(report.Secret)
+		}
+
+		if statusOpts.json || jsonOutput() {
+			printJSON(report)
+			return
+		}
+		printStatus(report)
+	},
+}
+
+func collectStatus(cc *ClashConf) *StatusReport {
+	api := NewClashAPI(cc)
+	report := &StatusReport{Controller: api.Addr, Secret: cc.Secret}
+
+	if _, err := runningTPClash(); err == nil {
+		report.Running = true
+		if s, err := LoadState(); err == nil {
+			report.State = s
+		}
+	}
+
+	var ver struct {
+		Version string `json:"version"`
+	}
+	if err := api.Do("GET", "/version", nil, &ver); err != nil {
+		report.APIError = err.Error()
+		return report
+	}
+	report.CoreVersion = ver.Version
+
+	var configs struct {
+		Mode string `json:"mode"`
+	}
+	if err := api.Do("GET", "/configs", nil, &configs); err == nil {
+		report.Mode = configs.Mode
+	}
+
+	var conns struct {
+		UploadTotal   uint64            `json:"uploadTotal"`
+		DownloadTotal uint64            `json:"downloadTotal"`
+		Connections   []json.RawMessage `json:"connections"`
+	}
+	if err := api.Do("GET", "/connections", nil, &conns); err == nil {
+		report.Connections = len(conns.Connections)
+		report.UploadTotal = conns.UploadTotal
+		report.DownloadTotal = conns.DownloadTotal
+	}
+
+	var traffic struct {
+		Up   uint64 `json:"up"`
+		Down uint64 `json:"down"`
+	}
+	if err := api.First("/traffic", &traffic); err == nil {
+		report.Up, report.Down = traffic.Up, traffic.Down
+	}
+	return report
+}
+
+func printStatus(r *StatusReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer func() { _ = w.Flush() }()
+
+	if s := r.State; s == nil {
+		running := "not running"
+		if r.Running {
+			running = "running"
+		}
+		_, _ = fmt.Fprintf(w, "TPClash:\t%s\n", running)
+		_, _ = fmt.Fprintf(w, "Core:\t%s %s\n", core.Name(), r.CoreVersion)
+	} else {
+		_, _ = fmt.Fprintf(w, "TPClash:\trunning(pid %d, up %s, %s)\n", s.PID, since(s.StartedAt), s.Version)
+		_, _ = fmt.Fprintf(w, "Core:\t%s %s(pid %d, up %s, restarts %d)\n", s.Core.Name, r.CoreVersion, s.Core.PID, since(s.Core.StartedAt), s.Core.Restarts)
+		profile := ""
+		if s.Config.Profile != "" {
+			profile = ", profile " + s.Config.Profile
+		}
+		_, _ = fmt.Fprintf(w, "Config:\t%s(sha256 %.12s, loaded %s%s)\n", s.Config.Source, s.Config.Hash, s.Config.LoadedAt.Format(time.DateTime), profile)
+
+		fetch := "ok"
+		if s.LastFetch.Error != "" {
+			fetch = "error: " + s.LastFetch.Error
+		}
+		_, _ = fmt.Fprintf(w, "Last fetch:\t%s %s\n", s.LastFetch.Time.Format(time.DateTime), fetch)
+		if q := s.Quota; q != nil {
+			expire := ""
+			if !q.Expire.IsZero() {
+				expire = ", expires " + q.Expire.Format(time.DateOnly)
+			}
+			_, _ = fmt.Fprintf(w, "Quota:\t%s of %s(%.1f%%%s)\n", humanBytes(q.Upload+q.Download), humanBytes(q.Total), float64(q.Upload+q.Download)*100/float64(q.Total), expire)
+		}
+
+		rules := "applied"
+		if s.Rules.UpdatedAt.IsZero() {
+			rules = "not used"
+		} else if !s.Rules.Applied {
+			rules = "error: " + s.Rules.Error
+		}
+		fallback := ""
+		if s.Rules.DNSFallback {
+			fallback = ", dns fallback"
+		}
+		if s.Rules.UDPBypass {
+			fallback += ", udp bypassed"
+		}
+		_, _ = fmt.Fprintf(w, "Rules:\t%s %s(bypass %d, dns redirect %d%s)\n", s.Rules.Backend, rules, s.Rules.BypassSources, s.Rules.DNSRedirectSources, fallback)
+		if len(s.Rules.LANPrefixes6) > 0 {
+			_, _ = fmt.Fprintf(w, "IPv6 LAN:\t%s\n", strings.Join(s.Rules.LANPrefixes6, ", "))
+		}
+		if s.HA != nil {
+			peer := ""
+			if s.HA.Peer != "" {
+				peer = ", peer " + s.HA.Peer
+			}
+			_, _ = fmt.Fprintf(w, "HA:\t%s(since %s%s)\n", s.HA.State, s.HA.Since.Format(time.DateTime), peer)
+		}
+
+		label := "Policies:"
+		for _, p := range s.Policies {
+			if p.Active {
+				_, _ = fmt.Fprintf(w, "%s\t%s(since %s)\n", label, p.Policy, p.Since.Format(time.DateTime))
+				label = ""
+			}
+		}
+
+		label = "Dashboard bans:"
+		for _, b := range s.DashboardBans {
+			if time.Now().Before(b.Until) {
+				_, _ = fmt.Fprintf(w, "%s\t%s(since %s, %s left)\n", label, b.IP, b.Since.Format(time.DateTime), time.Until(b.Until).Round(time.Second))
+				label = ""
+			}
+		}
+	}
+
+	if r.APIError != "" {
+		_, _ = fmt.Fprintf(w, "Clash API:\terror: %s\n", r.APIError)
+	} else {
+		_, _ = fmt.Fprintf(w, "Mode:\t%s\n", r.Mode)
+		_, _ = fmt.Fprintf(w, "Connections:\t%d\n", r.Connections)
+		_, _ = fmt.Fprintf(w, "Traffic:\t↑ %s/s ↓ %s/s(total ↑ %s ↓ %s)\n", humanBytes(r.Up), humanBytes(r.Down), humanBytes(r.UploadTotal), humanBytes(r.DownloadTotal))
+	}
+	_, _ = fmt.Fprintf(w, "Controller:\t%s\n", r.Controller)
+	_, _ = fmt.Fprintf(w, "Secret:\t%s\n", r.Secret)
+}
+
+// printClients prints the traffic accounted by --client-stats-interval.
+func printClients() {
+	clients, err := LoadClientStats()
+	if err != nil {
+		logrus.Fatalf("[status] failed to load client stats, is --client-stats-interval enabled? %v", err)
+	}
+
+	if statusOpts.json || jsonOutput() {
+		printJSON(clients)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer func() { _ = w.Flush() }()
+
+	today := time.Now().Format(time.DateOnly)
+	_, _ = fmt.Fprintln(w, "CLIENT\tNAME\tMAC\tUPLOAD\tDOWNLOAD\tTODAY\tLAST SEEN")
+	for _, ip := range sortedClients(clients) {
+		u := clients[ip]
+		var t Traffic
+		if d := u.Days[today]; d != nil {
+			t = *d
+		}
+		name, mac := u.Name, u.MAC
+		if l, ok := LookupLease(ip); ok {
+			name, mac = l.Hostname, l.MAC
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t↑ %s ↓ %s\t%s ago\n", ip, orDash(name), orDash(mac), humanBytes(u.Upload), humanBytes(u.Download),
+			humanBytes(t.Upload), humanBytes(t.Download), since(u.LastSeen))
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func since(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return time.Since(t).Round(time.Second).String()
+}
+
+func humanBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// maskSecret hides the secret except for its first characters.
+func maskSecret(secret string) string {
+	if len(secret) <= 4 {
+		return strings.Repeat("*", len(secret))
+	}
+	return secret[:4] + strings.Repeat("*", len(secret)-4)
+}
+
+func init() {
+	statusCmd.Flags().BoolVar(&statusOpts.showSecret, "show-secret", false, "show the clash api secret")
+	statusCmd.Flags().BoolVar(&statusOpts.json, "json", false, "print the status as json")
+	statusCmd.Flags().BoolVar(&statusOpts.clients, "clients", false, "show the traffic of LAN clients")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SubscriptionInfo is the traffic quota reported by the subscription in the
+// subscription-userinfo response header.
+type SubscriptionInfo struct {
+	Upload   uint64    `json:"upload"`
+	Download uint64    `json:"download"`
+	Total    uint64    `json:"total"`
+	Expire   time.Time `json:"expire"`
+	// the last fetch reporting the quota
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// parseSubscriptionInfo parses "upload=1; download=2; total=3; expire=4".
+func parseSubscriptionInfo(s string) (SubscriptionInfo, bool) {
+	var info SubscriptionInfo
+	var found bool
+	for _, kv := range strings.Split(s, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(k) {
+		case "upload":
+			info.Upload = n
+		case "download":
+			info.Download = n
+		case "total":
+			info.Total, found = n, true
+		case "expire":
+			if n > 0 {
+				info.Expire = time.Unix(int64(n), 0)
+			}
+		}
+	}
+	return info, found
+}
+
+// quotaWarned avoids repeating the quota warning on every config check.
+var quotaWarned atomic.Bool
+
+// checkSubscriptionQuota warns when the used traffic of the subscription
+// crosses --notify-quota-percent.
+func checkSubscriptionQuota(header string) {
+	info, ok := parseSubscriptionInfo(header)
+	if !ok || info.Total == 0 {
+		return
+	}
+	info.UpdatedAt = time.Now()
+	UpdateState(func(s *RuntimeState) { s.Quota = &info })
+	if conf.NotifyQuotaPercent <= 0 {
+		return
+	}
+
+	used := info.Upload + info.Download
+	percent := float64(used) * 100 / float64(info.Total)
+	if percent < conf.NotifyQuotaPercent {
+		quotaWarned.Store(false)
+		return
+	}
+	if quotaWarned.Swap(true) {
+		return
+	}
+	Notify(EventQuotaWarning, "subscription traffic used %.1f%%(%s of %s)", percent, humanBytes(used), humanBytes(info.Total))
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// syncPath serves the snapshot on --dashboard-listen with --sync-serve
+	syncPath = "/tpclash/sync"
+	// syncMaxSnapshot limits the snapshot a replica reads
+	syncMaxSnapshot = 64 << 20
+	// syncMaxPending limits the configs waiting to be loaded, the watcher
+	// sends at most 3 configs ahead of the reloads
+	syncMaxPending = 8
+)
+
+// SyncSnapshot is what a replica pulls from the source: the config loaded by
+// the source, as fetched before the fixes of the host, and the mode and the
+// proxy selections of its core.
+type SyncSnapshot struct {
+	Node       string            `json:"node"`
+	Hash       string            `json:"hash"`
+	Config     string            `json:"config"`
+	LoadedAt   time.Time         `json:"loaded_at"`
+	Mode       string            `json:"mode,omitempty"`
+	Selections map[string]string `json:"selections,omitempty"`
+}
+
+// etag changes with the config and the state of the core.
+func (s *SyncSnapshot) etag() string {
+	bs, _ := json.Marshal([]any{s.Hash, s.Mode, s.Selections})
+	sum := sha256.Sum256(bs)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// syncSource is the config served to the replicas, the raw configs are only
+// kept with --sync-serve.
+var syncSource = struct {
+	sync.Mutex
+	// the raw configs of the fixed configs sent to the reload
+	pending  map[[sha256.Size]byte]string
+	raw      string
+	loadedAt time.Time
+}{pending: map[[sha256.Size]byte]string{}}
+
+// fixConfig fixes a fetched config for the core, the raw config is kept to be
+// served once the fixed one is loaded.
+func fixConfig(ctx context.Context, raw string) (string, error) {
+	sum := hashConfig(raw)
+	EmitPlugins(PluginConfigFetched, map[string]any{"source": configSource(), "url": redactURL(conf.ClashConfig), "hash": hex.EncodeToString(sum[:]), "size": len(raw)})
+
+	_, span := startSpan(ctx, "config.fix")
+	fixed, err := core.Fix(raw)
+	endSpan(span, err)
+	if err != nil || !conf.SyncServe {
+		return fixed, err
+	}
+	syncSource.Lock()
+	defer syncSource.Unlock()
+	if len(syncSource.pending) >= syncMaxPending {
+		clear(syncSource.pending)
+	}
+	syncSource.pending[hashConfig(fixed)] = raw
+	return fixed, nil
+}
+
+// mustFixConfig is fixConfig of the first config, tpclash can not start
+// without it.
+func mustFixConfig(raw string) string {
+	fixed, err := fixConfig(context.Background(), raw)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return fixed
+}
+
+// commitSyncConfig serves the raw config of the fixed config just loaded.
+func commitSyncConfig(fixed string) {
+	if !conf.SyncServe {
+		return
+	}
+	syncSource.Lock()
+	defer syncSource.Unlock()
+	sum := hashConfig(fixed)
+	if raw, ok := syncSource.pending[sum]; ok {
+		syncSource.raw, syncSource.loadedAt = raw, time.Now()
+		delete(syncSource.pending, sum)
+	}
+}
+
+// setSyncConfig serves a raw config loaded without the watcher(agent push).
+func setSyncConfig(raw string) {
+	if !conf.SyncServe {
+		return
+	}
+	syncSource.Lock()
+	defer syncSource.Unlock()
+	syncSource.raw, syncSource.loadedAt = raw, time.Now()
+}
+
+// serveSync serves the snapshot to the replicas, a bearer token of the full or
+// sync scope(tpclash token create) or the clash api secret is always required.
+func serveSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := authenticateSync(r)
+	if !ok {
+		if r.Header.Get("Authorization") != "" {
+			logrus.Warnf("[sync] invalid token from %s", remoteIP(r))
+			recordAuthFailure(remoteIP(r))
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	syncSource.Lock()
+	raw, loadedAt := syncSource.raw, syncSource.loadedAt
+	syncSource.Unlock()
+	if raw == "" {
+		http.Error(w, "no config loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+	sum := hashConfig(raw)
+	snap := &SyncSnapshot{Hash: hex.EncodeToString(sum[:]), Config: raw, LoadedAt: loadedAt}
+	snap.Node, _ = os.Hostname()
+
+	// the state is left to the replica if the core does not answer
+	api := controllerAPI.Load()
+	var cfg struct {
+		Mode string `json:"mode"`
+	}
+	if err := api.Do(http.MethodGet, "/configs", nil, &cfg); err != nil {
+		logrus.Warnf("[sync] failed to read the mode of the core: %v", err)
+	} else {
+		snap.Mode = strings.ToLower(cfg.Mode)
+	}
+	if selections, err := runningSelections(api); err != nil {
+		logrus.Warnf("[sync] failed to read the proxy selections: %v", err)
+	} else {
+		snap.Selections = selections
+	}
+
+	etag := snap.etag()
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	logrus.Debugf("[sync] snapshot %s sent to %s(%s)", etag, p.name, remoteIP(r))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(snap)
+}
+
+// syncReplica is the last snapshot pulled by a replica.
+var syncReplica = struct {
+	sync.Mutex
+	etag string
+	last *SyncSnapshot
+}{}
+
+// fetchSync pulls the snapshot of --sync-from, nil if it did not change since
+// the last one.
+func fetchSync(ctx context.Context) (*SyncSnapshot, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(conf.SyncFrom, "/")+syncPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("[sync] failed to create the sync request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+conf.SyncToken)
+	req.Header.Set("User-Agent", fmt.Sprintf("TPClash %s %s", version, commit))
+	syncReplica.Lock()
+	if syncReplica.etag != "" {
+		req.Header.Set("If-None-Match", syncReplica.etag)
+	}
+	syncReplica.Unlock()
+
+	resp, err := configClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("[sync] failed to pull the snapshot of %s: %v", redactURL(conf.SyncFrom), redactErr(err))
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		_ = resp.Body.Close()
+	}()
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("[sync] failed to pull the snapshot of %s: status code %d: %s", redactURL(conf.SyncFrom), resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var snap SyncSnapshot
+	if err = json.NewDecoder(io.LimitReader(resp.Body, syncMaxSnapshot)).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("[sync] failed to decode the snapshot: %w", err)
+	}
+	if sum := hashConfig(snap.Config); hex.EncodeToString(sum[:]) != snap.Hash {
+		return nil, errors.New("[sync] the config of the snapshot does not match its hash")
+	}
+	if !looksLikeConfig([]byte(snap.Config)) {
+		return nil, errors.New("[sync] the config of the snapshot is not a valid config document")
+	}
+	syncReplica.Lock()
+	syncReplica.etag = resp.Header.Get("ETag")
+	syncReplica.Unlock()
+	return &snap, nil
+}
+
+// watchSync is WatchConfig of a replica, the config of the source is pulled
+// every --check-interval and its state is applied once the core runs.
+func watchSync(ctx context.Context) chan configUpdate {
+	updateCh := make(chan configUpdate, 3)
+
+	var last string
+	snap, err := fetchSync(ctx)
+	if err != nil {
+		cached, cacheErr := loadCachedConfig()
+		if cacheErr != nil {
+			logrus.Debug(cacheErr)
+			logrus.Fatal(err)
+		}
+		logrus.Errorf("%v, using the cached config of the last successful sync", err)
+		updateCh <- configUpdate{ctx: ctx, config: mustFixConfig(cached)}
+	} else {
+		logrus.Infof("[sync] config %s pulled from %s(%s)", snap.Hash[:12], snap.Node, redactURL(conf.SyncFrom))
+		last = snap.Hash
+		cacheRemoteConfig(snap.Config)
+		setSyncSnapshot(snap)
+		updateCh <- configUpdate{ctx: ctx, config: mustFixConfig(snap.Config)}
+	}
+
+	go func() {
+		waitScheduleAPI(ctx)
+		ReapplySync()
+
+		tick := time.Tick(conf.CheckInterval)
+		for {
+			select {
+			case <-ctx.Done():
+				close(updateCh)
+				logrus.Warnf("[sync] stop config syncing...")
+				return
+			case <-tick:
+				uctx, span := startUpdate(ctx, "sync")
+				snap, err := fetchSync(uctx)
+				if err != nil {
+					logrus.Error(err)
+					endSpan(span, err)
+					continue
+				}
+				// the state is applied again even if the snapshot did not
+				// change, the changes made on the replica are reverted
+				if snap != nil {
+					setSyncSnapshot(snap)
+					if snap.Hash != last {
+						logrus.Infof("[sync] config %s pulled from %s(%s)", snap.Hash[:12], snap.Node, redactURL(conf.SyncFrom))
+						fixed, err := fixConfig(uctx, snap.Config)
+						if err != nil {
+							logrus.Errorf("%v, keeping the running config", err)
+							Notify(EventReloadFailure, "%v", err)
+							endSpan(span, err)
+							continue
+						}
+						last = snap.Hash
+						cacheRemoteConfig(snap.Config)
+						// the state is applied after the reload
+						updateCh <- configUpdate{ctx: uctx, config: fixed}
+						continue
+					}
+				}
+				endSpan(span, nil)
+				ReapplySync()
+			}
+		}
+	}()
+	return updateCh
+}
+
+func setSyncSnapshot(snap *SyncSnapshot) {
+	syncReplica.Lock()
+	defer syncReplica.Unlock()
+	syncReplica.last = snap
+}
+
+// ReapplySync applies the mode and the proxy selections of the last snapshot
+// to the core, they are applied again after the reloads of the config.
+func ReapplySync() {
+	if conf.SyncFrom == "" {
+		return
+	}
+	syncReplica.Lock()
+	defer syncReplica.Unlock()
+	snap := syncReplica.last
+	if snap == nil {
+		return
+	}
+
+	api, err := RunningAPI()
+	if err != nil {
+		logrus.Errorf("[sync] failed to apply the state of the source: %v", err)
+		return
+	}
+	var errs []error
+	var cfg struct {
+		Mode string `json:"mode"`
+	}
+	if snap.Mode != "" && (api.Do(http.MethodGet, "/configs", nil, &cfg) != nil || !strings.EqualFold(cfg.Mode, snap.Mode)) {
+		if err = patchMode(snap.Mode); err != nil {
+			errs = append(errs, fmt.Errorf("mode %s: %w", snap.Mode, err))
+		} else {
+			logrus.Infof("[sync] switched to the %s mode as the source", snap.Mode)
+		}
+	}
+	current, _ := runningSelections(api)
+	for group, proxy := range snap.Selections {
+		if current[group] == proxy {
+			continue
+		}
+		if err = api.Do(http.MethodPut, "/proxies/"+url.PathEscape(group), map[string]string{"name": proxy}, nil); err != nil {
+			errs = append(errs, fmt.Errorf("select %s: %s: %w", group, proxy, err))
+			continue
+		}
+		logrus.Infof("[sync] selected %s of %s as the source", proxy, group)
+	}
+	if err = errors.Join(errs...); err != nil {
+		logrus.Errorf("[sync] failed to apply the state of the source: %v", err)
+	}
+}
+
+// CheckSyncConf validates the sync flags.
+func CheckSyncConf() error {
+	if conf.SyncServe && conf.DashboardListen == "" {
+		return errors.New("[sync] --sync-serve requires --dashboard-listen")
+	}
+	if conf.SyncFrom == "" {
+		return nil
+	}
+	u, err := url.Parse(conf.SyncFrom)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("[sync] invalid --sync-from url, must be the https(or http) url of the --dashboard-listen of the source")
+	}
+	if conf.SyncToken == "" {
+		return errors.New("[sync] --sync-from requires --sync-token")
+	}
+	if len(conf.ConfigMirrors) > 0 || conf.ConfigReplay != "" {
+		return errors.New("[sync] --sync-from can not be used with --config-mirror or --config-replay")
+	}
+	if u.Scheme == "http" {
+		logrus.Warnf("[sync] ⚠️ the token and the config are sent to %s in plain text, use https", u.Host)
+	}
+	logrus.Infof("[sync] the config is synced from %s, --config is ignored", redactURL(conf.SyncFrom))
+	return nil
+}
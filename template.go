@@ -14,6 +14,9 @@ var confFuncsMap = template.FuncMap{
 	"MainNic":    getMainNic,
 	"MainIP":     getMainIP,
 	"DefaultDNS": getDefaultDNS,
+	// the config is reloaded when the prefixes change
+	"IPv6Prefix":   templatePrefix6,
+	"IPv6Prefixes": templatePrefixes6,
 }
 
 func getMainNic() string {
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testPollInterval is how often the connections are polled for the proxied
+// requests in test mode.
+const testPollInterval = time.Second
+
+// CheckTestConf validates the test mode flags.
+func CheckTestConf() error {
+	if !conf.Test {
+		if conf.TestSuccess > 0 {
+			return fmt.Errorf("[test] --test-success requires --test")
+		}
+		return nil
+	}
+	if conf.TestDuration <= 0 {
+		return fmt.Errorf("[test] invalid --test-duration %s, must be positive", conf.TestDuration)
+	}
+	if conf.TestSuccess < 0 {
+		return fmt.Errorf("[test] invalid --test-success %d, must not be negative", conf.TestSuccess)
+	}
+	return nil
+}
+
+// WatchTestMode returns when the test ends, either after --test-duration or
+// once --test-success proxied requests are observed. An error is returned if
+// the duration passed before enough requests were observed.
+func WatchTestMode(ctx context.Context) error {
+	deadline := time.NewTimer(conf.TestDuration)
+	defer deadline.Stop()
+
+	if conf.TestSuccess == 0 {
+		logrus.Warnf("[test] test mode enabled, tpclash will automatically exit after %s...", conf.TestDuration)
+		select {
+		case <-ctx.Done():
+		case <-deadline.C:
+		}
+		return nil
+	}
+
+	logrus.Warnf("[test] test mode enabled, tpclash will exit after %d successful proxied requests or %s...", conf.TestSuccess, conf.TestDuration)
+	seen := make(map[string]struct{})
+	ticker := time.NewTicker(testPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-deadline.C:
+			return fmt.Errorf("[test] only %d of %d proxied requests succeeded in %s", len(seen), conf.TestSuccess, conf.TestDuration)
+		case <-ticker.C:
+		}
+
+		api, err := RunningAPI()
+		if err != nil {
+			logrus.Debug(err)
+			continue
+		}
+		var resp struct {
+			Connections []clashConn `json:"connections"`
+		}
+		if err = api.Do("GET", "/connections", nil, &resp); err != nil {
+			logrus.Debugf("[test] failed to get connections: %v", err)
+			continue
+		}
+		for _, c := range resp.Connections {
+			if _, ok := seen[c.ID]; ok || !proxiedRequest(c) {
+				continue
+			}
+			seen[c.ID] = struct{}{}
+			logrus.Infof("[test] proxied request %d/%d: %s via %s", len(seen), conf.TestSuccess, c.Destination(), c.Chain())
+		}
+		if len(seen) >= conf.TestSuccess {
+			logrus.Infof("[test] %d proxied requests succeeded, stopping...", len(seen))
+			return nil
+		}
+	}
+}
+
+// proxiedRequest reports whether the connection went through a proxy and got
+// a response, the direct and rejected connections do not count.
+func proxiedRequest(c clashConn) bool {
+	return c.Download > 0 && proxiedOutbound(c.Chains)
+}
+
+// proxiedOutbound reports whether the final outbound of the chain(listed
+// first by the api) is a proxy.
+func proxiedOutbound(chains []string) bool {
+	if len(chains) == 0 {
+		return false
+	}
+	switch strings.ToUpper(chains[0]) {
+	case "DIRECT", "REJECT", "REJECT-DROP", "PASS", "BLOCK":
+		return false
+	}
+	return true
+}
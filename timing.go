@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// coreReadyTimeout is how long the startup timing waits for the clash api.
+const coreReadyTimeout = time.Minute
+
+// startupTimer measures the startup phases, every phase is logged at debug
+// level and the summary is logged with --timing.
+type startupTimer struct {
+	mu     sync.Mutex
+	start  time.Time
+	last   time.Time
+	phases []startupPhase
+}
+
+type startupPhase struct {
+	name     string
+	duration time.Duration
+}
+
+func newStartupTimer() *startupTimer {
+	now := time.Now()
+	return &startupTimer{start: now, last: now}
+}
+
+// Mark ends the phase started by the previous mark.
+func (t *startupTimer) Mark(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.add(name, now.Sub(t.last))
+	t.last = now
+}
+
+func (t *startupTimer) add(name string, d time.Duration) {
+	t.phases = append(t.phases, startupPhase{name: name, duration: d})
+	logrus.Debugf("[timing] %s took %s", name, d.Round(time.Millisecond))
+}
+
+// WaitCore measures the time from the core start until the clash api answers
+// and then logs the summary.
+func (t *startupTimer) WaitCore(ctx context.Context, cc *ClashConf, started time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, coreReadyTimeout)
+	defer cancel()
+	api := NewClashAPI(cc)
+	for api.Do("GET", "/version", nil, nil) != nil {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				logrus.Warnf("[timing] the clash api is not ready in %s", coreReadyTimeout)
+				t.Report()
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	t.mu.Lock()
+	t.add("core ready", time.Since(started))
+	t.mu.Unlock()
+	t.Report()
+}
+
+// Report logs the phases and the total startup time with --timing.
+func (t *startupTimer) Report() {
+	if !conf.Timing {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var b strings.Builder
+	for _, p := range t.phases {
+		fmt.Fprintf(&b, "%s %s, ", p.name, p.duration.Round(time.Millisecond))
+	}
+	logrus.Infof("[timing] startup: %stotal %s", b.String(), time.Since(t.start).Round(time.Millisecond))
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// scopes of the api tokens accepted by the dashboard proxy
+const (
+	TokenScopeRead = "read"
+	TokenScopeFull = "full"
+	// TokenScopeSync only pulls the snapshot of --sync-serve
+	TokenScopeSync = "sync"
+)
+
+// APIToken is a token issued by `tpclash token create`, only the hash of the
+// token is stored.
+type APIToken struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Scope   string    `json:"scope"`
+	Created time.Time `json:"created"`
+}
+
+var tokenOpts struct {
+	scope string
+}
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage the clash api secret and the tokens of the dashboard proxy",
+}
+
+var tokenRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Regenerate the clash api secret and apply it to the running core",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cc, err := RunningConf()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		old, err := ControllerSecret()
+		if err != nil {
+			logrus.Fatalf("[token] failed to read the clash api secret: %v", err)
+		}
+		if cc.Secret != old {
+			logrus.Fatal("[token] the secret is set in the clash config, change it there instead")
+		}
+		proc, err := runningTPClash()
+		if err != nil {
+			logrus.Fatalf("[token] tpclash is not running: %v", err)
+		}
+
+		secret, err := randomToken()
+		if err != nil {
+			logrus.Fatalf("[token] %v", err)
+		}
+		if err = os.WriteFile(filepath.Join(conf.ClashHome, secretFileName), []byte(secret), 0600); err != nil {
+			logrus.Fatalf("[token] failed to save the clash api secret: %v", err)
+		}
+		if err = proc.Signal(syscall.SIGUSR2); err != nil {
+			logrus.Fatalf("[token] failed to signal tpclash: %v", err)
+		}
+		Audit(AuditSourceCLI, "", "token.rotate", "controller secret", nil)
+
+		// wait for the running instance to apply the secret
+		for i := 0; i < 20; i++ {
+			time.Sleep(500 * time.Millisecond)
+			if cc, err = RunningConf(); err == nil && cc.Secret == secret {
+				if err = NewClashAPI(cc).Do("GET", "/version", nil, nil); err == nil {
+					fmt.Println(secret)
+					return
+				}
+			}
+		}
+		logrus.Fatalf("[token] the new secret is not applied, check the logs of tpclash: %v", err)
+	},
+}
+
+var tokenCreateCmd = &cobra.Command{
+	Use:   "create NAME",
+	Short: "Issue a token of the dashboard proxy, it is printed only once",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if tokenOpts.scope != TokenScopeRead && tokenOpts.scope != TokenScopeFull && tokenOpts.scope != TokenScopeSync {
+			logrus.Fatalf("[token] unsupported scope %s(%s|%s|%s)", tokenOpts.scope, TokenScopeRead, TokenScopeFull, TokenScopeSync)
+		}
+		tokens, err := LoadTokens()
+		if err != nil && !os.IsNotExist(err) {
+			logrus.Fatal(err)
+		}
+		if slices.ContainsFunc(tokens, func(t APIToken) bool { return t.Name == args[0] }) {
+			logrus.Fatalf("[token] token %s already exists", args[0])
+		}
+
+		token, err := randomToken()
+		if err != nil {
+			logrus.Fatalf("[token] %v", err)
+		}
+		tokens = append(tokens, APIToken{Name: args[0], Hash: hashToken(token), Scope: tokenOpts.scope, Created: time.Now()})
+		err = saveTokens(tokens)
+		Audit(AuditSourceCLI, "", "token.create", args[0]+" "+tokenOpts.scope, err)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Println(token)
+	},
+}
+
+var tokenListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the tokens of the dashboard proxy",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		tokens, err := LoadTokens()
+		if err != nil && !os.IsNotExist(err) {
+			logrus.Fatal(err)
+		}
+
+		if jsonOutput() {
+			type tokenJSON struct {
+				Name    string    `json:"name"`
+				Scope   string    `json:"scope"`
+				Created time.Time `json:"created"`
+			}
+			out := make([]tokenJSON, 0, len(tokens))
+			for _, t := range tokens {
+				out = append(out, tokenJSON{t.Name, t.Scope, t.Created})
+			}
+			printJSON(out)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		defer func() { _ = w.Flush() }()
+
+		_, _ = fmt.Fprintln(w, "NAME\tSCOPE\tCREATED")
+		for _, t := range tokens {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", t.Name, t.Scope, t.Created.Format(time.DateTime))
+		}
+	},
+}
+
+var tokenRevokeCmd = &cobra.Command{
+	Use:   "revoke NAME",
+	Short: "Revoke a token of the dashboard proxy",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		tokens, err := LoadTokens()
+		if err != nil && !os.IsNotExist(err) {
+			logrus.Fatal(err)
+		}
+		n := len(tokens)
+		tokens = slices.DeleteFunc(tokens, func(t APIToken) bool { return t.Name == args[0] })
+		if len(tokens) == n {
+			logrus.Fatalf("[token] token %s not found", args[0])
+		}
+		err = saveTokens(tokens)
+		Audit(AuditSourceCLI, "", "token.revoke", args[0], err)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("[token] token %s revoked", args[0])
+	},
+}
+
+// ApplySecret patches the regenerated clash api secret into the running
+// config and reloads the core, it is triggered by `tpclash token rotate`.
+func ApplySecret(writePath string, proc *CoreProcess) error {
+	// the running config must not be replaced by a reload meanwhile
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	secret, err := ControllerSecret()
+	if err != nil {
+		return fmt.Errorf("[token] failed to read the clash api secret: %w", err)
+	}
+	bs, err := os.ReadFile(writePath)
+	if err != nil {
+		return fmt.Errorf("[token] failed to read the running config: %w", err)
+	}
+	ccStr, err := core.PatchSecret(string(bs), secret)
+	if err != nil {
+		return err
+	}
+	cc, err := core.Check(ccStr)
+	if err != nil {
+		return fmt.Errorf("[token] invalid config after rotating the secret: %w", err)
+	}
+	if err = writeFileAtomic(writePath, strings.NewReader(ccStr), 0644); err != nil {
+		return fmt.Errorf("[token] failed to write the running config: %w", err)
+	}
+	RecordConfig(ccStr)
+
+	// the core still accepts the old secret only
+	reloadCC := *cc
+	reloadCC.Secret = controllerAPI.Load().secret
+	if err = core.Reload(writePath, &reloadCC, proc.Process()); err != nil {
+		return err
+	}
+	SetControllerTarget(cc)
+	logrus.Info("[token] clash api secret rotated")
+	return nil
+}
+
+// LoadTokens reads the tokens issued by `tpclash token create`.
+func LoadTokens() ([]APIToken, error) {
+	bs, err := os.ReadFile(filepath.Join(conf.ClashHome, tokensFileName))
+	if err != nil {
+		return nil, err
+	}
+	var tokens []APIToken
+	if err = json.Unmarshal(bs, &tokens); err != nil {
+		return nil, fmt.Errorf("[token] invalid tokens file: %w", err)
+	}
+	return tokens, nil
+}
+
+func saveTokens(tokens []APIToken) error {
+	bs, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(conf.ClashHome, 0755); err != nil {
+		return err
+	}
+	tokensPath := filepath.Join(conf.ClashHome, tokensFileName)
+	if err = os.WriteFile(tokensPath, bs, 0600); err != nil {
+		return fmt.Errorf("[token] failed to save tokens: %w", err)
+	}
+	matchHomeOwner(tokensPath)
+	return nil
+}
+
+// tokenCache keeps the tokens file in memory until it is modified.
+var tokenCache struct {
+	sync.Mutex
+	modTime time.Time
+	tokens  []APIToken
+}
+
+// cachedTokens returns the tokens file, it is read again only once it is
+// modified.
+func cachedTokens() ([]APIToken, error) {
+	tokenCache.Lock()
+	defer tokenCache.Unlock()
+
+	fi, err := os.Stat(filepath.Join(conf.ClashHome, tokensFileName))
+	if err != nil {
+		tokenCache.tokens, tokenCache.modTime = nil, time.Time{}
+		return nil, err
+	}
+	if !fi.ModTime().Equal(tokenCache.modTime) {
+		tokens, err := LoadTokens()
+		if err != nil {
+			return nil, err
+		}
+		tokenCache.tokens, tokenCache.modTime = tokens, fi.ModTime()
+	}
+	return tokenCache.tokens, nil
+}
+
+// lookupToken returns the issued token matching s.
+func lookupToken(s string) (APIToken, bool) {
+	tokens, err := cachedTokens()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Error(err)
+		}
+		return APIToken{}, false
+	}
+
+	hash := hashToken(s)
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			return t, true
+		}
+	}
+	return APIToken{}, false
+}
+
+// hasTokens reports whether any token is issued.
+func hasTokens() bool {
+	tokens, _ := cachedTokens()
+	return len(tokens) > 0
+}
+
+func hashToken(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate a random token: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func init() {
+	tokenCreateCmd.Flags().StringVar(&tokenOpts.scope, "scope", TokenScopeRead, "scope of the token, read only allows GET requests, sync only pulls the snapshot of --sync-serve(read|full|sync)")
+	tokenCmd.AddCommand(tokenRotateCmd, tokenCreateCmd, tokenListCmd, tokenRevokeCmd)
+}
@@ -0,0 +1,725 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+type tuiView int
+
+const (
+	tuiOverview tuiView = iota
+	tuiConns
+	tuiProxies
+	tuiLogs
+)
+
+var tuiViewNames = []string{"Overview", "Connections", "Proxies", "Logs"}
+
+const (
+	tuiMaxLogs    = 500
+	tuiMaxHistory = 240
+)
+
+var tuiOpts struct {
+	interval time.Duration
+	logLevel string
+}
+
+type tuiLog struct {
+	Time    time.Time
+	Type    string `json:"type"`
+	Payload string `json:"payload"`
+}
+
+// tui is the state of `tpclash tui`, the api goroutines update it and the
+// main loop renders it on every change.
+type tui struct {
+	api *ClashAPI
+	cc  *ClashConf
+
+	mu     sync.Mutex
+	view   tuiView
+	width  int
+	height int
+
+	up, down      uint64
+	upHist        []uint64
+	downHist      []uint64
+	uploadTotal   uint64
+	downloadTotal uint64
+	mode          string
+
+	conns   []clashConn
+	connCur int
+
+	proxies  map[string]clashProxy
+	groups   []string
+	group    string
+	groupCur int
+	proxyCur int
+	testing  bool
+
+	logs []tuiLog
+
+	msg   string
+	msgAt time.Time
+
+	redraw chan struct{}
+}
+
+var tuiCmd = &cobra.Command{
+	Use:   "tui",
+	Short: "Show the traffic, connections, proxies and logs of the running core in the terminal",
+	Long: `A full-screen dashboard of the running core for SSH-only environments.
+
+Keys:
+  1-4, tab     switch the view(overview, connections, proxies, logs)
+  ↑/k ↓/j      move the cursor, pgup/pgdn by page
+  enter        open the proxy group / select the proxy of a selector group
+  esc          back to the proxy groups
+  t            test the latency of the proxies in the group
+  x            close the selected connection
+  r            reload the core config
+  q, ctrl-c    quit`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		fd := int(os.Stdin.Fd())
+		if _, err := unix.IoctlGetTermios(fd, unix.TCGETS); err != nil {
+			logrus.Fatal("[tui] stdin is not a terminal")
+		}
+		cc, err := RunningConf()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		t := &tui{api: NewClashAPI(cc), cc: cc, redraw: make(chan struct{}, 1)}
+		if err = t.refreshProxies(); err != nil {
+			logrus.Fatal(err)
+		}
+		if err = t.run(fd); err != nil {
+			logrus.Fatal(err)
+		}
+	},
+}
+
+func (t *tui) run(fd int) error {
+	old, err := tuiMakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("[tui] failed to set the terminal to raw mode: %w", err)
+	}
+	// the logs would break the screen, the errors are shown in the status line
+	out := logrus.StandardLogger().Out
+	logrus.SetOutput(io.Discard)
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		_ = unix.IoctlSetTermios(fd, unix.TCSETS, old)
+		logrus.SetOutput(out)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	t.resize()
+	go t.streamTraffic(ctx)
+	go t.streamLogs(ctx)
+	go t.poll(ctx)
+
+	keys := make(chan string)
+	go tuiReadKeys(os.Stdin, keys)
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+
+	for {
+		t.render()
+		select {
+		case <-t.redraw:
+		case <-winch:
+			t.resize()
+		case k, ok := <-keys:
+			if !ok || !t.handleKey(k) {
+				return nil
+			}
+		}
+	}
+}
+
+func (t *tui) notify() {
+	select {
+	case t.redraw <- struct{}{}:
+	default:
+	}
+}
+
+func (t *tui) setMsg(format string, args ...any) {
+	t.mu.Lock()
+	t.msg, t.msgAt = fmt.Sprintf(format, args...), time.Now()
+	t.mu.Unlock()
+	t.notify()
+}
+
+func (t *tui) resize() {
+	ws, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.width, t.height = 80, 24
+	if err == nil && ws.Col > 0 && ws.Row > 0 {
+		t.width, t.height = int(ws.Col), int(ws.Row)
+	}
+}
+
+// streamTraffic follows /traffic, it is reconnected after a core restart.
+func (t *tui) streamTraffic(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := t.api.Stream(ctx, "/traffic", func(msg json.RawMessage) bool {
+			var traffic struct {
+				Up   uint64 `json:"up"`
+				Down uint64 `json:"down"`
+			}
+			if json.Unmarshal(msg, &traffic) != nil {
+				return true
+			}
+			t.mu.Lock()
+			t.up, t.down = traffic.Up, traffic.Down
+			t.upHist = appendHistory(t.upHist, traffic.Up)
+			t.downHist = appendHistory(t.downHist, traffic.Down)
+			t.mu.Unlock()
+			t.notify()
+			return true
+		})
+		if err != nil {
+			t.setMsg("traffic: %v", err)
+		}
+		tuiSleep(ctx, 3*time.Second)
+	}
+}
+
+func (t *tui) streamLogs(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := t.api.Stream(ctx, "/logs?level="+url.QueryEscape(tuiOpts.logLevel), func(msg json.RawMessage) bool {
+			var l tuiLog
+			if json.Unmarshal(msg, &l) != nil {
+				return true
+			}
+			l.Time = time.Now()
+			t.mu.Lock()
+			t.logs = append(t.logs, l)
+			if len(t.logs) > tuiMaxLogs {
+				t.logs = t.logs[len(t.logs)-tuiMaxLogs:]
+			}
+			t.mu.Unlock()
+			t.notify()
+			return true
+		})
+		if err != nil {
+			t.setMsg("logs: %v", err)
+		}
+		tuiSleep(ctx, 3*time.Second)
+	}
+}
+
+// poll refreshes the connections on every interval and the proxies and the
+// mode every few intervals, they have no streaming api.
+func (t *tui) poll(ctx context.Context) {
+	ticker := time.NewTicker(tuiOpts.interval)
+	defer ticker.Stop()
+	for i := 1; ; i++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var resp struct {
+			UploadTotal   uint64      `json:"uploadTotal"`
+			DownloadTotal uint64      `json:"downloadTotal"`
+			Connections   []clashConn `json:"connections"`
+		}
+		if err := t.api.Do("GET", "/connections", nil, &resp); err != nil {
+			t.setMsg("connections: %v", err)
+			continue
+		}
+		sort.Slice(resp.Connections, func(i, j int) bool { return resp.Connections[i].Start.After(resp.Connections[j].Start) })
+		t.mu.Lock()
+		t.conns, t.uploadTotal, t.downloadTotal = resp.Connections, resp.UploadTotal, resp.DownloadTotal
+		t.mu.Unlock()
+
+		if i%5 == 0 {
+			if err := t.refreshProxies(); err != nil {
+				t.setMsg("%v", err)
+			}
+		}
+		t.notify()
+	}
+}
+
+func (t *tui) refreshProxies() error {
+	proxies, err := fetchProxies(t.api)
+	if err != nil {
+		return err
+	}
+	var configs struct {
+		Mode string `json:"mode"`
+	}
+	_ = t.api.Do("GET", "/configs", nil, &configs)
+
+	var groups []string
+	for name, p := range proxies {
+		if p.IsGroup() && name != "GLOBAL" {
+			groups = append(groups, name)
+		}
+	}
+	sort.Strings(groups)
+
+	t.mu.Lock()
+	t.proxies, t.groups, t.mode = proxies, groups, configs.Mode
+	t.mu.Unlock()
+	return nil
+}
+
+// handleKey applies the key, false quits the tui.
+func (t *tui) handleKey(k string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	page := t.height - 6
+	switch k {
+	case "q", "ctrl-c":
+		return false
+	case "1", "2", "3", "4":
+		t.view = tuiView(k[0] - '1')
+	case "tab":
+		t.view = (t.view + 1) % tuiView(len(tuiViewNames))
+	case "up", "k":
+		t.moveCursor(-1)
+	case "down", "j":
+		t.moveCursor(1)
+	case "pgup":
+		t.moveCursor(-page)
+	case "pgdown":
+		t.moveCursor(page)
+	case "esc", "backspace":
+		t.group = ""
+	case "enter":
+		if t.view != tuiProxies {
+			break
+		}
+		if t.group == "" {
+			if t.groupCur < len(t.groups) {
+				t.group = t.groups[t.groupCur]
+				g := t.proxies[t.group]
+				t.proxyCur = max(slices.Index(g.All, g.Now), 0)
+			}
+			break
+		}
+		all := t.proxies[t.group].All
+		if t.proxyCur < len(all) {
+			go t.selectProxy(t.group, all[t.proxyCur])
+		}
+	case "t":
+		if t.view == tuiProxies && t.group != "" && !t.testing {
+			t.testing = true
+			go t.testGroup(t.group)
+		}
+	case "x":
+		if t.view == tuiConns && t.connCur < len(t.conns) {
+			go t.closeConn(t.conns[t.connCur])
+		}
+	case "r":
+		go t.reload()
+	}
+	return true
+}
+
+func (t *tui) moveCursor(n int) {
+	cur, size := &t.connCur, len(t.conns)
+	switch {
+	case t.view == tuiProxies && t.group == "":
+		cur, size = &t.groupCur, len(t.groups)
+	case t.view == tuiProxies:
+		cur, size = &t.proxyCur, len(t.proxies[t.group].All)
+	case t.view != tuiConns:
+		return
+	}
+	*cur = min(max(*cur+n, 0), max(size-1, 0))
+}
+
+func (t *tui) selectProxy(group, proxy string) {
+	t.mu.Lock()
+	g := t.proxies[group]
+	t.mu.Unlock()
+	if g.Type != "Selector" {
+		t.setMsg("%s is a %s group, only selector groups can be switched", group, g.Type)
+		return
+	}
+
+	err := t.api.Do("PUT", "/proxies/"+url.PathEscape(group), map[string]string{"name": proxy}, nil)
+	Audit(AuditSourceCLI, "", "proxies.select", group+": "+proxy, err)
+	if err != nil {
+		t.setMsg("failed to switch proxy: %v", err)
+		return
+	}
+	_ = t.refreshProxies()
+	t.setMsg("%s: %s -> %s", group, g.Now, proxy)
+}
+
+func (t *tui) testGroup(group string) {
+	defer func() {
+		t.mu.Lock()
+		t.testing = false
+		t.mu.Unlock()
+	}()
+
+	t.mu.Lock()
+	targets := pingTargets(t.proxies, t.proxies[group].All)
+	t.mu.Unlock()
+	t.setMsg("testing %d proxies of %s...", len(targets), group)
+
+	// pingProxies changes the timeout of the client
+	results := pingProxies(NewClashAPI(t.cc), targets, pingOpts.url, pingOpts.timeout, pingOpts.concurrency)
+	var failed int
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+		}
+	}
+	_ = t.refreshProxies()
+	t.setMsg("%s: %d proxies tested, %d timeout", group, len(results), failed)
+}
+
+func (t *tui) closeConn(c clashConn) {
+	err := t.api.Do("DELETE", "/connections/"+url.PathEscape(c.ID), nil, nil)
+	Audit(AuditSourceCLI, "", "conns.kill", c.ID+" "+c.Destination(), err)
+	if err != nil {
+		t.setMsg("failed to close connection: %v", err)
+		return
+	}
+	t.setMsg("closed %s -> %s", net.JoinHostPort(c.Metadata.SourceIP, c.Metadata.SourcePort), c.Destination())
+}
+
+// reload asks the core to reload the config written by tpclash.
+func (t *tui) reload() {
+	t.setMsg("reloading the %s config...", core.Name())
+	path := filepath.Join(conf.ClashHome, core.ConfigName())
+	var proc *os.Process
+	if s, err := LoadState(); err == nil && s.Core.PID > 0 {
+		proc, _ = os.FindProcess(s.Core.PID)
+	}
+
+	err := core.Reload(path, t.cc, proc)
+	Audit(AuditSourceCLI, "", "config.reload", path, err)
+	if err != nil {
+		t.setMsg("%v", err)
+		return
+	}
+	_ = t.refreshProxies()
+	t.setMsg("%s config reloaded", core.Name())
+}
+
+func (t *tui) render() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var tabs []string
+	for i, name := range tuiViewNames {
+		tab := fmt.Sprintf(" %d %s ", i+1, name)
+		if tuiView(i) == t.view {
+			tab = "\x1b[7m" + tab + "\x1b[0m"
+		}
+		tabs = append(tabs, tab)
+	}
+	lines := []string{"\x1b[1mTPClash\x1b[0m " + strings.Join(tabs, ""),
+		fmt.Sprintf("↑ %s/s  ↓ %s/s  connections %d  mode %s  core %s", humanBytes(t.up), humanBytes(t.down), len(t.conns), t.mode, core.Name()),
+		""}
+
+	body := t.height - len(lines) - 1
+	switch t.view {
+	case tuiOverview:
+		lines = append(lines, t.overview(body)...)
+	case tuiConns:
+		lines = append(lines, t.connsView(body)...)
+	case tuiProxies:
+		lines = append(lines, t.proxiesView(body)...)
+	case tuiLogs:
+		lines = append(lines, t.logsView(body)...)
+	}
+	for len(lines) < t.height-1 {
+		lines = append(lines, "")
+	}
+	lines = lines[:max(t.height-1, 0)]
+
+	status := "q quit  tab switch  r reload"
+	if t.msg != "" && time.Since(t.msgAt) < 10*time.Second {
+		status = t.msg
+	}
+
+	var b bytes.Buffer
+	b.WriteString("\x1b[H")
+	for _, l := range lines {
+		b.WriteString(tuiTruncate(l, t.width))
+		b.WriteString("\x1b[K\r\n")
+	}
+	b.WriteString("\x1b[7m" + tuiPad(tuiTruncate(status, t.width), t.width) + "\x1b[0m")
+	_, _ = os.Stdout.Write(b.Bytes())
+}
+
+func (t *tui) overview(height int) []string {
+	spark := max(t.width-14, 10)
+	lines := []string{
+		"Upload   " + sparkline(t.upHist, spark),
+		"Download " + sparkline(t.downHist, spark),
+		fmt.Sprintf("Total    ↑ %s  ↓ %s", humanBytes(t.uploadTotal), humanBytes(t.downloadTotal)),
+		"",
+	}
+
+	rows := []string{"GROUP\tTYPE\tNOW\tDELAY"}
+	for _, name := range t.groups {
+		g := t.proxies[name]
+		rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%s", name, g.Type, g.Now, formatDelay(t.proxies[g.Now].Delay())))
+	}
+	groups := tuiTable(rows)
+	logs := max(height-len(lines)-len(groups)-1, 3)
+	lines = append(lines, groups...)
+	lines = append(lines, "")
+	return append(lines, t.logLines(logs)...)
+}
+
+func (t *tui) connsView(height int) []string {
+	rows := []string{"CLIENT\tDESTINATION\tNETWORK\tCHAIN\tRULE\tUP\tDOWN\tDURATION"}
+	for _, c := range t.conns {
+		rule := c.Rule
+		if c.RulePayload != "" {
+			rule += "," + c.RulePayload
+		}
+		rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s", clientLabel(c.Metadata.SourceIP), c.Destination(), c.Metadata.Network,
+			c.Chain(), rule, humanBytes(c.Upload), humanBytes(c.Download), since(c.Start)))
+	}
+	return tuiList(tuiTable(rows), t.connCur, height, t.width)
+}
+
+func (t *tui) proxiesView(height int) []string {
+	if t.group == "" {
+		rows := []string{"GROUP\tTYPE\tNOW\tDELAY\tPROXIES"}
+		for _, name := range t.groups {
+			g := t.proxies[name]
+			rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%s\t%d", name, g.Type, g.Now, formatDelay(t.proxies[g.Now].Delay()), len(g.All)))
+		}
+		return tuiList(tuiTable(rows), t.groupCur, height, t.width)
+	}
+
+	g := t.proxies[t.group]
+	help := "enter select  t test latency  esc back"
+	if g.Type != "Selector" {
+		help = "t test latency  esc back"
+	}
+	rows := []string{"\tPROXY\tTYPE\tDELAY"}
+	for _, name := range g.All {
+		mark := ""
+		if name == g.Now {
+			mark = "*"
+		}
+		rows = append(rows, fmt.Sprintf("%s\t%s\t%s\t%s", mark, name, t.proxies[name].Type, formatDelay(t.proxies[name].Delay())))
+	}
+	lines := []string{fmt.Sprintf("\x1b[1m%s\x1b[0m(%s)  %s", t.group, g.Type, help), ""}
+	return append(lines, tuiList(tuiTable(rows), t.proxyCur, height-len(lines), t.width)...)
+}
+
+func (t *tui) logsView(height int) []string {
+	return t.logLines(height)
+}
+
+// logLines returns the latest logs fitting in the height.
+func (t *tui) logLines(height int) []string {
+	logs := t.logs
+	if len(logs) > height {
+		logs = logs[len(logs)-height:]
+	}
+	var lines []string
+	for _, l := range logs {
+		lines = append(lines, fmt.Sprintf("%s %-7s %s", l.Time.Format(time.TimeOnly), strings.ToUpper(l.Type), l.Payload))
+	}
+	return lines
+}
+
+// tuiTable aligns the tab separated rows, the first row is the header.
+func tuiTable(rows []string) []string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	for _, r := range rows {
+		_, _ = fmt.Fprintln(w, r)
+	}
+	_ = w.Flush()
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+// tuiList scrolls the table to the cursor and highlights the row under it,
+// the header is always shown.
+func tuiList(table []string, cur, height, width int) []string {
+	header, rows := table[0], table[1:]
+	lines := []string{"\x1b[1m" + tuiTruncate(header, width) + "\x1b[0m"}
+	height--
+	start := 0
+	if cur >= height {
+		start = cur - height + 1
+	}
+	for i := start; i < len(rows) && i < start+height; i++ {
+		row := tuiTruncate(rows[i], width)
+		if i == cur {
+			row = "\x1b[7m" + tuiPad(row, width) + "\x1b[0m"
+		}
+		lines = append(lines, row)
+	}
+	return lines
+}
+
+func appendHistory(hist []uint64, v uint64) []uint64 {
+	hist = append(hist, v)
+	if len(hist) > tuiMaxHistory {
+		hist = hist[len(hist)-tuiMaxHistory:]
+	}
+	return hist
+}
+
+// sparkline draws the latest values scaled to the maximum of them.
+func sparkline(hist []uint64, width int) string {
+	bars := []rune("▁▂▃▄▅▆▇█")
+	if len(hist) > width {
+		hist = hist[len(hist)-width:]
+	}
+	var peak uint64
+	for _, v := range hist {
+		peak = max(peak, v)
+	}
+
+	var b strings.Builder
+	for _, v := range hist {
+		i := 0
+		if peak > 0 {
+			i = int(v * 7 / peak)
+		}
+		b.WriteRune(bars[i])
+	}
+	return fmt.Sprintf("%s %s/s", b.String(), humanBytes(peak))
+}
+
+// tuiTruncate cuts the line to the width, the escape sequences take no
+// space.
+func tuiTruncate(s string, width int) string {
+	var b strings.Builder
+	n, esc := 0, false
+	for _, r := range s {
+		switch {
+		case r == '\x1b':
+			esc = true
+		case esc:
+			if r >= '@' && r <= '~' && r != '[' {
+				esc = false
+			}
+		default:
+			if n >= width {
+				// the attributes of the cut part are reset
+				return b.String() + "\x1b[0m"
+			}
+			n++
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func tuiPad(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
+
+// tuiMakeRaw puts the terminal into the raw mode and returns the previous
+// state.
+func tuiMakeRaw(fd int) (*unix.Termios, error) {
+	old, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+	raw := *old
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN], raw.Cc[unix.VTIME] = 1, 0
+	if err = unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// tuiReadKeys sends the names of the pressed keys, an escape sequence is
+// read at once.
+func tuiReadKeys(r io.Reader, keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 16)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+		switch s := string(buf[:n]); s {
+		case "\x1b[A", "\x1bOA":
+			keys <- "up"
+		case "\x1b[B", "\x1bOB":
+			keys <- "down"
+		case "\x1b[5~":
+			keys <- "pgup"
+		case "\x1b[6~":
+			keys <- "pgdown"
+		case "\x1b":
+			keys <- "esc"
+		case "\r", "\n":
+			keys <- "enter"
+		case "\t":
+			keys <- "tab"
+		case "\x7f", "\b":
+			keys <- "backspace"
+		case "\x03":
+			keys <- "ctrl-c"
+		default:
+			if n == 1 {
+				keys <- s
+			}
+		}
+	}
+}
+
+func tuiSleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+func init() {
+	tuiCmd.Flags().DurationVar(&tuiOpts.interval, "interval", time.Second, "refresh interval of the connections")
+	tuiCmd.Flags().StringVar(&tuiOpts.logLevel, "log-level", "info", "level of the core logs shown(debug|info|warning|error)")
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/ulikunitz/xz"
+)
+
+// uiSwapDelay is the quiet period after the last write of --ui-archive before
+// the dashboard is swapped.
+const uiSwapDelay = 2 * time.Second
+
+// uiRelease is a dashboard published on github releases.
+type uiRelease struct {
+	Repo  string
+	Asset string
+}
+
+// dashboardRelease returns where the dashboard is published, the meta build
+// embeds metacubexd as the official dashboard.
+func dashboardRelease(ui string) (uiRelease, bool) {
+	switch ui {
+	case "yacd":
+		if CoreFlavor() == CorePremium {
+			return uiRelease{Repo: "haishanh/yacd", Asset: "yacd.tar.xz"}, true
+		}
+		return uiRelease{Repo: "MetaCubeX/Yacd-meta", Asset: "yacd.tar.xz"}, true
+	case "official":
+		if branch == "meta" {
+			return uiRelease{Repo: "MetaCubeX/metacubexd", Asset: "compressed-dist.tgz"}, true
+		}
+	case "metacubexd":
+		return uiRelease{Repo: "MetaCubeX/metacubexd", Asset: "compressed-dist.tgz"}, true
+	}
+	return uiRelease{}, false
+}
+
+// InstalledUIVersion returns the version of the downloaded dashboard in dir,
+// it is empty if the dashboard is extracted from tpclash.
+func InstalledUIVersion(dir string) string {
+	bs, err := os.ReadFile(filepath.Join(dir, uiVersionFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(bs))
+}
+
+// ResolveUI selects metacubexd if --ui is not specified and the embedded
+// dashboards of the premium build do not understand the selected core.
+func ResolveUI(cmd *cobra.Command) {
+	if !cmd.Flags().Changed("ui") && branch != "meta" && CoreFlavor() != CorePremium {
+		conf.ClashUI = "metacubexd"
+	}
+}
+
+// UIDir returns the dashboard served by the core: --ui-path as is, the one
+// downloaded from --ui-url or extracted from --ui-archive, or the one named by
+// --ui in the clash home.
+func UIDir() string {
+	switch {
+	case conf.UIPath != "":
+		return conf.UIPath
+	case conf.UIURL != "", conf.UIArchive != "":
+		return filepath.Join(conf.ClashHome, customUIDir)
+	}
+
+	dir := filepath.Join(conf.ClashHome, conf.ClashUI)
+	// the meta build embeds metacubexd as the official dashboard
+	if conf.ClashUI == "metacubexd" && branch == "meta" {
+		if _, err := os.Stat(dir); err != nil {
+			return filepath.Join(conf.ClashHome, "official")
+		}
+	}
+	return dir
+}
+
+// PrepareUI downloads the dashboard pinned by --ui-version, or the latest one
+// if it is neither embedded nor downloaded before. The dashboard is optional,
+// tpclash keeps running if it can not be downloaded.
+func PrepareUI() {
+	uiDir := UIDir()
+	switch {
+	case conf.UIPath != "":
+		return
+	case conf.UIArchive != "":
+		err := hostChange("file", fmt.Sprintf("extract dashboard %s -> %s", conf.UIArchive, uiDir), func() error {
+			return InstallUIFromArchive(conf.UIArchive, false)
+		})
+		if err != nil {
+			logrus.Errorf("[ui] failed to install dashboard %s: %v", conf.UIArchive, err)
+		}
+		return
+	case conf.UIURL != "":
+		if InstalledUIVersion(uiDir) == conf.UIURL {
+			return
+		}
+		err := hostChange("file", fmt.Sprintf("download dashboard %s -> %s", redactURL(conf.UIURL), uiDir), func() error {
+			return InstallUIFromURL(conf.UIURL, conf.UISHA256)
+		})
+		if err != nil {
+			logrus.Errorf("[ui] failed to download dashboard %s: %v", redactURL(conf.UIURL), err)
+		}
+		return
+	}
+
+	if _, ok := dashboardRelease(conf.ClashUI); !ok {
+		return
+	}
+
+	var tag string
+	if conf.UIVersion != "" {
+		tag = coreTag(conf.UIVersion)
+		if InstalledUIVersion(uiDir) == tag {
+			return
+		}
+	} else if _, err := os.Stat(uiDir); err == nil {
+		return
+	}
+
+	release := tag
+	if release == "" {
+		release = "latest"
+	}
+	err := hostChange("file", fmt.Sprintf("download dashboard %s(%s) -> %s", conf.ClashUI, release, uiDir), func() error {
+		_, err := InstallUI(tag, "", false)
+		return err
+	})
+	if err != nil {
+		logrus.Errorf("[ui] failed to download dashboard %s: %v", conf.ClashUI, err)
+	}
+}
+
+// InstallUIFromURL downloads a custom dashboard archive(.zip, .tar.gz, .tgz or
+// .tar.xz), the url is recorded as its version.
+func InstallUIFromURL(rawURL, checksum string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("[ui] invalid dashboard url: %w", err)
+	}
+	name := path.Base(u.Path)
+
+	archive := filepath.Join(conf.ClashHome, "."+customUIDir+".download")
+	defer func() { _ = os.Remove(archive) }()
+	if err = downloadUIArchive(rawURL, archive, checksum); err != nil {
+		return err
+	}
+
+	uiDir := filepath.Join(conf.ClashHome, customUIDir)
+	if err = installUIArchive(archive, name, uiDir, rawURL); err != nil {
+		return err
+	}
+
+	logrus.Infof("[ui] custom dashboard installed: %s", uiDir)
+	return nil
+}
+
+// InstallUIFromArchive extracts the local dashboard archive, it is skipped
+// unless forced when the installed one is extracted from the same content.
+func InstallUIFromArchive(archive string, force bool) error {
+	sum, err := fileSHA256(archive)
+	if err != nil {
+		return fmt.Errorf("[ui] failed to read dashboard archive: %w", err)
+	}
+	version := "archive:" + sum
+	uiDir := filepath.Join(conf.ClashHome, customUIDir)
+	if !force && InstalledUIVersion(uiDir) == version {
+		return nil
+	}
+	if err = installUIArchive(archive, filepath.Base(archive), uiDir, version); err != nil {
+		return err
+	}
+
+	logrus.Infof("[ui] custom dashboard installed from %s: %s", archive, uiDir)
+	return nil
+}
+
+// CheckUIConf validates the custom dashboard, it must contain an index.html.
+func CheckUIConf() error {
+	var n int
+	for _, v := range []string{conf.UIPath, conf.UIURL, conf.UIArchive} {
+		if v != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("[ui] only one of --ui-path(--ui-dir), --ui-url and --ui-archive can be specified")
+	}
+
+	switch {
+	case conf.UIPath != "":
+		if _, err := os.Stat(filepath.Join(conf.UIPath, "index.html")); err != nil {
+			return fmt.Errorf("[ui] index.html not found in dashboard dir %s", conf.UIPath)
+		}
+	case conf.UIArchive != "":
+		fi, err := os.Stat(conf.UIArchive)
+		if err != nil {
+			return fmt.Errorf("[ui] dashboard archive not found: %w", err)
+		}
+		if fi.IsDir() {
+			return fmt.Errorf("[ui] dashboard archive %s is a dir, use --ui-path instead", conf.UIArchive)
+		}
+		if !slices.ContainsFunc([]string{".zip", ".tar", ".tar.gz", ".tgz", ".tar.xz"}, func(ext string) bool { return strings.HasSuffix(conf.UIArchive, ext) }) {
+			return fmt.Errorf("[ui] unsupported dashboard archive %s, must be a .zip, .tar, .tar.gz(.tgz) or .tar.xz", conf.UIArchive)
+		}
+	}
+	return nil
+}
+
+// WatchUI swaps the dashboard when --ui-archive is replaced, and warns when
+// the index.html of --ui-dir disappears. The core serves the dashboard from
+// the disk, the changes take effect without a reload.
+func WatchUI(ctx context.Context) {
+	var dir, name string
+	switch {
+	case conf.UIArchive != "":
+		dir, name = filepath.Dir(conf.UIArchive), filepath.Base(conf.UIArchive)
+	case conf.UIPath != "":
+		dir, name = conf.UIPath, "index.html"
+	default:
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.Errorf("[ui] failed to create fs watcher: %v", err)
+		return
+	}
+	defer func() { _ = watcher.Close() }()
+	if err = watcher.Add(dir); err != nil {
+		logrus.Errorf("[ui] failed add %s to fs watcher: %v", dir, err)
+		return
+	}
+
+	// the archive is usually written in several steps, the swap waits until
+	// the writes settle
+	settle := time.NewTimer(0)
+	<-settle.C
+	for {
+		select {
+		case <-ctx.Done():
+			settle.Stop()
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Base(event.Name) != name {
+				continue
+			}
+			if conf.UIArchive != "" {
+				if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) {
+					settle.Reset(uiSwapDelay)
+				}
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+				logrus.Warnf("[ui] index.html removed from dashboard dir %s", dir)
+			} else if event.Has(fsnotify.Create) {
+				logrus.Infof("[ui] index.html restored in dashboard dir %s", dir)
+			}
+		case <-settle.C:
+			if err := InstallUIFromArchive(conf.UIArchive, false); err != nil {
+				logrus.Errorf("[ui] failed to swap dashboard, the current one is kept: %v", err)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Errorf("[ui] fs watcher error: %v", err)
+		}
+	}
+}
+
+// InstallUI downloads the dashboard of tag(latest if empty) into the ui dir.
+// The asset is verified against the sha256 digest published by github, or
+// against checksum if it is specified.
+func InstallUI(tag, checksum string, skipVerify bool) (string, error) {
+	rel, ok := dashboardRelease(conf.ClashUI)
+	if !ok {
+		return "", fmt.Errorf("[ui] dashboard %s can not be downloaded", conf.ClashUI)
+	}
+
+	release, err := fetchRelease(rel.Repo, conf.ClashUI, coreTag(tag))
+	if err != nil {
+		return "", err
+	}
+	asset, ok := release.asset(rel.Asset)
+	if !ok {
+		return "", fmt.Errorf("[ui] asset %s not found in %s release %s", rel.Asset, rel.Repo, release.TagName)
+	}
+
+	if checksum == "" {
+		checksum = asset.sha256()
+	}
+	if checksum == "" && !skipVerify {
+		return "", fmt.Errorf("[ui] no checksum published for %s, specify it with --sha256 or use --skip-verify", rel.Asset)
+	}
+
+	archive := filepath.Join(conf.ClashHome, "."+conf.ClashUI+".download")
+	defer func() { _ = os.Remove(archive) }()
+	if err = downloadUIArchive(asset.URL, archive, checksum); err != nil {
+		return "", err
+	}
+
+	uiDir := filepath.Join(conf.ClashHome, conf.ClashUI)
+	if err = installUIArchive(archive, rel.Asset, uiDir, release.TagName); err != nil {
+		return "", err
+	}
+
+	logrus.Infof("[ui] dashboard %s %s installed: %s", conf.ClashUI, release.TagName, uiDir)
+	return release.TagName, nil
+}
+
+func downloadUIArchive(downAddr, archive, checksum string) error {
+	if conf.UpgradeWithGhProxy && strings.HasPrefix(downAddr, "https://github.com/") {
+		downAddr = ghProxyAddr + downAddr
+	}
+	logrus.Infof("[ui] start downloading file: %s", redactURL(downAddr))
+
+	resp, err := http.Get(downAddr)
+	if err != nil {
+		return fmt.Errorf("[ui] failed to download dashboard: %w", redactErr(err))
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("[ui] failed to download dashboard: status %d", resp.StatusCode)
+	}
+
+	f, err := os.OpenFile(archive, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("[ui] failed to create temp file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+		return fmt.Errorf("[ui] failed to write temp file: %w", err)
+	}
+
+	if checksum == "" {
+		logrus.Warnf("[ui] skip checksum verification of %s", redactURL(downAddr))
+		return nil
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, checksum) {
+		return fmt.Errorf("[ui] checksum mismatch: expected %s, got %s", checksum, sum)
+	}
+	logrus.Infof("[ui] checksum verified: %s", checksum)
+	return nil
+}
+
+// installUIArchive extracts the archive and swaps it with uiDir, a single top
+// level directory in the archive is stripped.
+func installUIArchive(archive, name, uiDir, version string) error {
+	tmpDir := uiDir + ".new"
+	_ = os.RemoveAll(tmpDir)
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	if err := extractArchive(archive, name, tmpDir); err != nil {
+		return fmt.Errorf("[ui] failed to extract %s: %w", name, err)
+	}
+
+	root := tmpDir
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		return fmt.Errorf("[ui] failed to read extracted files: %w", err)
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		root = filepath.Join(tmpDir, entries[0].Name())
+	}
+	if _, err = os.Stat(filepath.Join(root, "index.html")); err != nil {
+		return fmt.Errorf("[ui] index.html not found in %s", name)
+	}
+	if err = os.WriteFile(filepath.Join(root, uiVersionFile), []byte(version), 0644); err != nil {
+		return fmt.Errorf("[ui] failed to record dashboard version: %w", err)
+	}
+
+	oldDir := uiDir + ".old"
+	_ = os.RemoveAll(oldDir)
+	if err = os.Rename(uiDir, oldDir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("[ui] failed to replace dashboard: %w", err)
+	}
+	if err = os.Rename(root, uiDir); err != nil {
+		_ = os.Rename(oldDir, uiDir)
+		return fmt.Errorf("[ui] failed to replace dashboard: %w", err)
+	}
+	_ = os.RemoveAll(oldDir)
+	return nil
+}
+
+// extractArchive extracts a .zip, .tar.gz(.tgz) or .tar.xz archive into dst.
+func extractArchive(archive, name, dst string) error {
+	if strings.HasSuffix(name, ".zip") {
+		return extractZip(archive, dst)
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	var r io.Reader
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = gr.Close() }()
+		r = gr
+	case strings.HasSuffix(name, ".tar.xz"):
+		if r, err = xz.NewReader(f); err != nil {
+			return err
+		}
+	case strings.HasSuffix(name, ".tar"):
+		r = f
+	default:
+		return fmt.Errorf("unsupported archive: %s", name)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := archiveTarget(dst, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err = writeArchiveFile(target, tr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func extractZip(archive, dst string) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = zr.Close() }()
+
+	for _, zf := range zr.File {
+		target, err := archiveTarget(dst, zf.Name)
+		if err != nil {
+			return err
+		}
+		if zf.FileInfo().IsDir() {
+			if err = os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = writeArchiveFile(target, rc)
+		_ = rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveTarget returns the extract path of an archive entry, entries outside
+// of dst are rejected.
+func archiveTarget(dst, name string) (string, error) {
+	name = strings.TrimPrefix(filepath.Clean(name), string(filepath.Separator))
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid archive entry: %s", name)
+	}
+	return filepath.Join(dst, name), nil
+}
+
+func writeArchiveFile(target string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	_, err = io.Copy(f, r)
+	return err
+}
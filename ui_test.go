@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestArchiveTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   string
+		want    string
+		wantErr bool
+	}{
+		{name: "file", entry: "index.html", want: "/data/ui/index.html"},
+		{name: "nested", entry: "assets/app.js", want: "/data/ui/assets/app.js"},
+		{name: "dot prefix", entry: "./assets/app.js", want: "/data/ui/assets/app.js"},
+		{name: "absolute", entry: "/index.html", want: "/data/ui/index.html"},
+		{name: "inner dot dot", entry: "assets/../index.html", want: "/data/ui/index.html"},
+		{name: "parent", entry: "../index.html", wantErr: true},
+		{name: "escape", entry: "assets/../../etc/passwd", wantErr: true},
+		{name: "root", entry: "./", want: "/data/ui"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := archiveTarget("/data/ui", tt.entry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("archiveTarget(%q) error = %v, wantErr %v", tt.entry, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("archiveTarget(%q) = %q, want %q", tt.entry, got, tt.want)
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/spf13/cobra"
 
@@ -88,10 +89,132 @@ var upgradeCmd = &cobra.Command{
 			logrus.Fatalf("[upgrade] rename failed: %v", err)
 		}
 
-		fmt.Print(upgradedMessage)
+		fmt.Print(logo + T(msgUpgraded))
+	},
+}
+
+var upgradeCoreOpts struct {
+	checksum   string
+	skipVerify bool
+	noRestart  bool
+}
+
+var upgradeCoreCmd = &cobra.Command{
+	Use:   "upgrade-core [VERSION]",
+	Short: "Upgrade the proxy core",
+	Long: `Upgrade the core selected by --core to the specified or the latest version.
+
+The installed version stays pinned until upgrade-core is run again, the running
+tpclash instance restarts the core to apply it.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+		if core, err = NewCore(); err != nil {
+			logrus.Fatal(err)
+		}
+
+		if conf.ClashBin != "" {
+			logrus.Fatalf("[upgrade-core] the core is managed externally(--clash-bin %s), please upgrade it with your package manager", conf.ClashBin)
+		}
+
+		d, ok := core.(coreDownloader)
+		if !ok {
+			logrus.Fatalf("[upgrade-core] %s core can not be upgraded separately, please upgrade tpclash", core.Name())
+		}
+
+		var tag string
+		if len(args) == 1 {
+			tag = coreTag(args[0])
+		} else {
+			release, err := fetchRelease(d.Repo(), d.Name(), "")
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			tag = release.TagName
+		}
+
+		installed := InstalledCoreVersion(d)
+		if installed == tag {
+			logrus.Infof("[upgrade-core] %s core %s is already installed", d.Name(), tag)
+			return
+		}
+		logrus.Infof("[upgrade-core] upgrade %s core: %s -> %s", d.Name(), installed, tag)
+
+		if _, err = InstallCore(d, tag, upgradeCoreOpts.checksum, upgradeCoreOpts.skipVerify); err != nil {
+			logrus.Fatal(err)
+		}
+
+		if upgradeCoreOpts.noRestart {
+			return
+		}
+		proc, err := runningTPClash()
+		if err != nil {
+			logrus.Infof("[upgrade-core] tpclash is not running, the new core will be used on next start")
+			return
+		}
+		if err = proc.Signal(syscall.SIGUSR1); err != nil {
+			logrus.Fatalf("[upgrade-core] failed to restart core: %v", err)
+		}
+		logrus.Infof("[upgrade-core] restarting core of tpclash(pid %d)...", proc.Pid)
+	},
+}
+
+var upgradeUIOpts struct {
+	checksum   string
+	skipVerify bool
+}
+
+var upgradeUICmd = &cobra.Command{
+	Use:   "upgrade-ui [VERSION]",
+	Short: "Upgrade the dashboard",
+	Long: `Download the dashboard selected by --ui(yacd|metacubexd) of the specified or
+the latest version into the clash home, it is served by the running core at once.
+The custom dashboard of --ui-url is downloaded again, the one of --ui-archive is
+extracted again.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ResolveUI(cmd)
+
+		switch {
+		case conf.UIPath != "":
+			logrus.Fatalf("[upgrade-ui] the dashboard is managed externally(--ui-path %s)", conf.UIPath)
+		case conf.UIURL != "":
+			if err := InstallUIFromURL(conf.UIURL, conf.UISHA256); err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		case conf.UIArchive != "":
+			if err := InstallUIFromArchive(conf.UIArchive, true); err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		}
+
+		tag := conf.UIVersion
+		if len(args) == 1 {
+			tag = args[0]
+		}
+		if conf.UIVersion != "" && coreTag(tag) != coreTag(conf.UIVersion) {
+			logrus.Warnf("[upgrade-ui] the dashboard is pinned to %s by --ui-version, it will be restored on next start", conf.UIVersion)
+		}
+
+		installed := InstalledUIVersion(filepath.Join(conf.ClashHome, conf.ClashUI))
+		if tag != "" && installed == coreTag(tag) {
+			logrus.Infof("[upgrade-ui] dashboard %s %s is already installed", conf.ClashUI, installed)
+			return
+		}
+
+		if _, err := InstallUI(tag, upgradeUIOpts.checksum, upgradeUIOpts.skipVerify); err != nil {
+			logrus.Fatal(err)
+		}
 	},
 }
 
 func init() {
-	upgradeCmd.PersistentFlags().BoolVar(&conf.UpgradeWithGhProxy, "with-ghproxy", true, "use ghproxy.com to download upgrade files")
+	upgradeCoreCmd.Flags().StringVar(&upgradeCoreOpts.checksum, "sha256", "", "expected sha256 checksum of the release asset(default is the digest published by github)")
+	upgradeCoreCmd.Flags().BoolVar(&upgradeCoreOpts.skipVerify, "skip-verify", false, "allow releases without a published checksum")
+	upgradeCoreCmd.Flags().BoolVar(&upgradeCoreOpts.noRestart, "no-restart", false, "do not restart the core of the running tpclash")
+
+	upgradeUICmd.Flags().StringVar(&upgradeUIOpts.checksum, "sha256", "", "expected sha256 checksum of the release asset(default is the digest published by github)")
+	upgradeUICmd.Flags().BoolVar(&upgradeUIOpts.skipVerify, "skip-verify", false, "allow releases without a published checksum")
 }
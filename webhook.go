@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// webhookAttempts is the number of the attempts of a notification before
+	// it is left to the outbox, the backoff starts at webhookBackoff
+	webhookAttempts = 4
+	webhookBackoff  = time.Second
+
+	// the outbox is retried every webhookRetryInterval, the wait of a delivery
+	// doubles up to webhookRetryMaxWait
+	webhookRetryInterval = time.Minute
+	webhookRetryMaxWait  = time.Hour
+	// the undelivered notifications older than webhookOutboxMaxAge or beyond
+	// webhookOutboxMax are dropped
+	webhookOutboxMaxAge = 72 * time.Hour
+	webhookOutboxMax    = 500
+)
+
+// webhookDelivery is a notification waiting in the outbox.
+type webhookDelivery struct {
+	ID       string          `json:"id"`
+	URL      string          `json:"url"`
+	Event    string          `json:"event"`
+	Body     json.RawMessage `json:"body"`
+	Created  time.Time       `json:"created"`
+	Attempts int             `json:"attempts"`
+	Next     time.Time       `json:"next"`
+}
+
+// webhookOutbox persists the notifications until the webhooks accepted them,
+// so they survive the restarts of tpclash.
+var webhookOutbox = struct {
+	sync.Mutex
+	loaded     bool
+	deliveries []webhookDelivery
+	// the deliveries being sent
+	inflight map[string]bool
+}{inflight: map[string]bool{}}
+
+// webhookStatusError is a non-2xx response of a webhook.
+type webhookStatusError struct {
+	code int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("status code %d", e.code)
+}
+
+// webhookRetryable reports whether the delivery may succeed later, the
+// webhooks rejecting the request are not retried.
+func webhookRetryable(err error) bool {
+	var se *webhookStatusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests || se.code == http.StatusRequestTimeout
+	}
+	return true
+}
+
+type webhookSink struct {
+	url string
+}
+
+// Send posts the notification as json, it is retried with backoff and left to
+// the outbox when the webhook is still unavailable.
+func (s *webhookSink) Send(ctx context.Context, n Notification, text string) error {
+	body, err := json.Marshal(struct {
+		Notification
+		Text string `json:"text"`
+	}{n, text})
+	if err != nil {
+		return err
+	}
+	d := webhookDelivery{ID: newDeliveryID(), URL: s.url, Event: n.Event, Body: body, Created: n.Time}
+	// the test notifications report the result right away
+	persist := n.Event != "test"
+	if persist {
+		queueWebhook(d)
+	}
+
+	backoff := webhookBackoff
+	for {
+		d.Attempts++
+		err = postWebhook(ctx, d)
+		if err == nil || !webhookRetryable(err) || d.Attempts >= webhookAttempts || ctx.Err() != nil {
+			break
+		}
+		logrus.Debugf("[notify] webhook delivery %s failed(%d), retrying in %s: %v", d.ID, d.Attempts, backoff, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	if persist {
+		finishWebhook(d, err)
+	}
+	if err != nil && persist && webhookRetryable(err) {
+		return fmt.Errorf("%w, kept in the outbox", err)
+	}
+	return err
+}
+
+// postWebhook posts the delivery once, the body is signed with --notify-secret
+// as hex(hmac-sha256(secret, TIMESTAMP + "." + BODY)).
+func postWebhook(ctx context.Context, d webhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tpclash/"+version)
+	req.Header.Set("X-TPClash-Event", d.Event)
+	req.Header.Set("X-TPClash-Delivery", d.ID)
+	req.Header.Set("X-TPClash-Timestamp", ts)
+	if conf.NotifySecret != "" {
+		mac := hmac.New(sha256.New, []byte(conf.NotifySecret))
+		mac.Write([]byte(ts + "."))
+		mac.Write(d.Body)
+		req.Header.Set("X-TPClash-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return redactErr(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &webhookStatusError{code: resp.StatusCode}
+	}
+	return nil
+}
+
+func newDeliveryID() string {
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func webhookOutboxPath() string {
+	return filepath.Join(conf.ClashHome, webhookOutboxName)
+}
+
+// loadWebhookOutbox reads the outbox left by the last run, the lock must be
+// held.
+func loadWebhookOutbox() {
+	if webhookOutbox.loaded {
+		return
+	}
+	webhookOutbox.loaded = true
+	bs, err := os.ReadFile(webhookOutboxPath())
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(bs, &webhookOutbox.deliveries); err != nil {
+		logrus.Errorf("[notify] failed to load the webhook outbox: %v", err)
+	}
+}
+
+// saveWebhookOutbox writes the outbox, the lock must be held.
+func saveWebhookOutbox() {
+	if len(webhookOutbox.deliveries) == 0 {
+		if err := os.Remove(webhookOutboxPath()); err != nil && !os.IsNotExist(err) {
+			logrus.Errorf("[notify] failed to remove the webhook outbox: %v", err)
+		}
+		return
+	}
+	bs, err := json.Marshal(webhookOutbox.deliveries)
+	if err == nil {
+		err = writeFileAtomic(webhookOutboxPath(), bytes.NewReader(bs), 0600)
+	}
+	if err != nil {
+		logrus.Errorf("[notify] failed to save the webhook outbox: %v", err)
+	}
+}
+
+func queueWebhook(d webhookDelivery) {
+	webhookOutbox.Lock()
+	defer webhookOutbox.Unlock()
+
+	loadWebhookOutbox()
+	webhookOutbox.inflight[d.ID] = true
+	webhookOutbox.deliveries = append(webhookOutbox.deliveries, d)
+	if n := len(webhookOutbox.deliveries) - webhookOutboxMax; n > 0 {
+		logrus.Warnf("[notify] the webhook outbox is full, %d oldest notifications dropped", n)
+		webhookOutbox.deliveries = slices.Delete(webhookOutbox.deliveries, 0, n)
+	}
+	saveWebhookOutbox()
+}
+
+// finishWebhook removes the delivery from the outbox once it is delivered or
+// rejected, otherwise its next retry is scheduled.
+func finishWebhook(d webhookDelivery, err error) {
+	webhookOutbox.Lock()
+	defer webhookOutbox.Unlock()
+
+	delete(webhookOutbox.inflight, d.ID)
+	i := slices.IndexFunc(webhookOutbox.deliveries, func(o webhookDelivery) bool { return o.ID == d.ID })
+	if i < 0 {
+		return
+	}
+	if err == nil || !webhookRetryable(err) {
+		webhookOutbox.deliveries = slices.Delete(webhookOutbox.deliveries, i, i+1)
+	} else {
+		wait := webhookRetryInterval << min(max(d.Attempts-webhookAttempts, 0), 6)
+		d.Next = time.Now().Add(min(wait, webhookRetryMaxWait))
+		webhookOutbox.deliveries[i] = d
+	}
+	saveWebhookOutbox()
+}
+
+// RetryWebhooks delivers the notifications of the outbox until ctx is done,
+// including those left by the last run. The outbox of a webhook is retried in
+// order, a failure defers the rest to the next round.
+func RetryWebhooks(ctx context.Context) {
+	notifier.Lock()
+	webhooks := slices.ContainsFunc(notifier.sinks, func(s notifySink) bool {
+		_, ok := s.(*webhookSink)
+		return ok
+	})
+	notifier.Unlock()
+	if !webhooks {
+		// drops the outbox of the removed webhooks
+		retryWebhooks(ctx)
+		return
+	}
+	for {
+		retryWebhooks(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(webhookRetryInterval):
+		}
+	}
+}
+
+func retryWebhooks(ctx context.Context) {
+	webhookOutbox.Lock()
+	loadWebhookOutbox()
+	now := time.Now()
+	var due []webhookDelivery
+	kept := webhookOutbox.deliveries[:0]
+	for _, d := range webhookOutbox.deliveries {
+		switch {
+		case now.Sub(d.Created) > webhookOutboxMaxAge:
+			logrus.Warnf("[notify] webhook delivery %s(%s of %s) expired after %d attempts", d.ID, d.Event, d.Created.Format(time.DateTime), d.Attempts)
+			continue
+		case !slices.Contains(conf.Notify, d.URL):
+			logrus.Warnf("[notify] webhook delivery %s dropped, its webhook is no longer configured", d.ID)
+			continue
+		case !webhookOutbox.inflight[d.ID] && !now.Before(d.Next):
+			webhookOutbox.inflight[d.ID] = true
+			due = append(due, d)
+		}
+		kept = append(kept, d)
+	}
+	webhookOutbox.deliveries = kept
+	saveWebhookOutbox()
+	webhookOutbox.Unlock()
+
+	failed := map[string]bool{}
+	for _, d := range due {
+		if failed[d.URL] || ctx.Err() != nil {
+			// keep the order of the webhook
+			finishWebhook(d, context.Canceled)
+			continue
+		}
+		d.Attempts++
+		reqCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err := postWebhook(reqCtx, d)
+		cancel()
+		switch {
+		case err == nil:
+			logrus.Infof("[notify] webhook delivery %s(%s of %s) delivered after %d attempts", d.ID, d.Event, d.Created.Format(time.DateTime), d.Attempts)
+		case webhookRetryable(err):
+			failed[d.URL] = true
+			logrus.Debugf("[notify] webhook delivery %s failed(%d): %v", d.ID, d.Attempts, err)
+		default:
+			logrus.Errorf("[notify] webhook delivery %s rejected, dropped: %v", d.ID, err)
+		}
+		finishWebhook(d, err)
+	}
+}